@@ -0,0 +1,197 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/pubsub"
+
+	"helloworld/pkg/server"
+)
+
+// "second bench" drives the service's publish endpoint, or Pub/Sub directly, with concurrent
+// publishers for a while, printing the throughput and latency percentiles, e.g.
+//
+//	second bench -topic demo -concurrency 16 -size 1024 -duration 30s
+//	second bench -target pubsub -topic demo -batch 10
+
+// benchConfig holds the flags of the bench subcommand
+type benchConfig struct {
+	target      string // http or pubsub
+	url         string
+	topic       string
+	concurrency int
+	size        int
+	batch       int
+	duration    time.Duration
+	apiKey      string
+}
+
+// benchResult is what a bench worker measured
+type benchResult struct {
+	latencies []time.Duration // of the successful requests
+	errors    int
+	lastError string
+}
+
+func benchMain(args []string) int {
+	var cfg benchConfig
+	fs := flag.NewFlagSet("bench", flag.ContinueOnError)
+	fs.StringVar(&cfg.target, "target", "http", "what to drive: http (the service's publish endpoint) or pubsub (Pub/Sub directly)")
+	fs.StringVar(&cfg.url, "url", envOr("SECOND_URL", "http://localhost:8080"), "URL of the service, for -target http")
+	fs.StringVar(&cfg.topic, "topic", "", "topic to publish to (required)")
+	fs.IntVar(&cfg.concurrency, "concurrency", 8, "number of concurrent publishers")
+	fs.IntVar(&cfg.size, "size", 100, "message payload size in bytes")
+	fs.IntVar(&cfg.batch, "batch", 1, "messages per publish request")
+	fs.DurationVar(&cfg.duration, "duration", 10*time.Second, "how long to publish for")
+	fs.StringVar(&cfg.apiKey, "api-key", os.Getenv("SECOND_API_KEY"), "API key sent in "+server.APIKeyHeader+", for -target http")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	switch {
+	case cfg.topic == "":
+		fmt.Fprintln(os.Stderr, "bench: -topic is required")
+		return 2
+	case cfg.target != "http" && cfg.target != "pubsub":
+		fmt.Fprintln(os.Stderr, "bench: -target must be http or pubsub")
+		return 2
+	case cfg.concurrency < 1 || cfg.size < 0 || cfg.batch < 1 || cfg.duration <= 0:
+		fmt.Fprintln(os.Stderr, "bench: -concurrency and -batch must be positive, -size must not be negative, -duration must be positive")
+		return 2
+	}
+
+	publish, stop, err := benchPublisher(cfg)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "bench: %v\n", err)
+		return 1
+	}
+	defer stop()
+
+	fmt.Printf("publishing %d-byte messages in batches of %d to topic %s through %s, %d publishers, for %s\n",
+		cfg.size, cfg.batch, cfg.topic, cfg.target, cfg.concurrency, cfg.duration)
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.duration)
+	defer cancel()
+	results := make([]benchResult, cfg.concurrency)
+	var wg sync.WaitGroup
+	start := time.Now()
+	for i := range results {
+		wg.Add(1)
+		go func(res *benchResult) {
+			defer wg.Done()
+			for ctx.Err() == nil {
+				t := time.Now()
+				err := publish(ctx)
+				if ctx.Err() != nil {
+					// cut short by the end of the run
+					return
+				}
+				if err != nil {
+					res.errors++
+					res.lastError = err.Error()
+					continue
+				}
+				res.latencies = append(res.latencies, time.Since(t))
+			}
+		}(&results[i])
+	}
+	wg.Wait()
+	printBenchReport(cfg, results, time.Since(start))
+	return 0
+}
+
+// benchPublisher returns a function publishing a batch of messages to the bench's target
+func benchPublisher(cfg benchConfig) (publish func(context.Context) error, stop func(), err error) {
+	payload := strings.Repeat("x", cfg.size)
+	if cfg.target == "pubsub" {
+		projectID := os.Getenv("GOOGLE_CLOUD_PROJECT")
+		if projectID == "" {
+			return nil, nil, fmt.Errorf("GOOGLE_CLOUD_PROJECT must be set for -target pubsub")
+		}
+		client, err := pubsub.NewClient(context.Background(), projectID)
+		if err != nil {
+			return nil, nil, err
+		}
+		topic := client.Topic(cfg.topic)
+		publish = func(ctx context.Context) error {
+			results := make([]*pubsub.PublishResult, cfg.batch)
+			for i := range results {
+				results[i] = topic.Publish(ctx, &pubsub.Message{Data: []byte(payload)})
+			}
+			for _, res := range results {
+				if _, err := res.Get(ctx); err != nil {
+					return err
+				}
+			}
+			return nil
+		}
+		return publish, func() { topic.Stop(); client.Close() }, nil
+	}
+
+	msgs := make([]string, cfg.batch)
+	for i := range msgs {
+		msgs[i] = payload
+	}
+	body, _ := json.Marshal(msgs)
+	target := strings.TrimSuffix(cfg.url, "/") + "/topics/" + url.PathEscape(cfg.topic)
+	httpClient := &http.Client{Transport: &http.Transport{MaxIdleConnsPerHost: cfg.concurrency}}
+	publish = func(ctx context.Context) error {
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, target, bytes.NewReader(body))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Content-Type", mediaJSON)
+		if cfg.apiKey != "" {
+			req.Header.Set(server.APIKeyHeader, cfg.apiKey)
+		}
+		resp, err := httpClient.Do(req)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		out, _ := io.ReadAll(resp.Body)
+		if resp.StatusCode != http.StatusOK {
+			return fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(out)))
+		}
+		return nil
+	}
+	return publish, httpClient.CloseIdleConnections, nil
+}
+
+// printBenchReport prints the throughput and latency percentiles of a bench run
+func printBenchReport(cfg benchConfig, results []benchResult, elapsed time.Duration) {
+	var latencies []time.Duration
+	errors, lastError := 0, ""
+	for _, res := range results {
+		latencies = append(latencies, res.latencies...)
+		errors += res.errors
+		if res.lastError != "" {
+			lastError = res.lastError
+		}
+	}
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+	requests := len(latencies)
+	seconds := elapsed.Seconds()
+	fmt.Printf("requests: %d ok, %d failed in %s\n", requests, errors, elapsed.Round(time.Millisecond))
+	fmt.Printf("throughput: %.1f requests/s, %.1f messages/s, %.1f KiB/s\n",
+		float64(requests)/seconds, float64(requests*cfg.batch)/seconds, float64(requests*cfg.batch*cfg.size)/1024/seconds)
+	if requests > 0 {
+		percentile := func(p float64) time.Duration {
+			return latencies[int(p*float64(requests-1))].Round(time.Microsecond)
+		}
+		fmt.Printf("latency: p50 %s, p90 %s, p99 %s, max %s\n", percentile(0.5), percentile(0.9), percentile(0.99), latencies[requests-1].Round(time.Microsecond))
+	}
+	if lastError != "" {
+		fmt.Printf("last error: %s\n", lastError)
+	}
+}
@@ -0,0 +1,328 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"helloworld/pkg/server"
+)
+
+// "second cli" is a command-line client of the service, e.g.
+//
+//	second cli topics
+//	second cli -o json create-subscription orders-audit orders
+//	second cli publish -attr source=cli orders '{"id":42}'
+//	second cli pull -max 10 orders-audit
+//
+// It asks for JSON responses ({"status", "lines"}) and renders them as tables, or with -o json
+// as JSON values: an array of names for listings, an object for a resource's details and the
+// response's lines otherwise.
+
+const cliUsage = `usage: second cli [-url <service-url>] [-api-key <key>] [-token <admin-token>] [-o table|json] <command> [args]
+
+commands:
+  topics                                    list topics
+  topic <name>                              show a topic
+  create-topic <name>                       create a topic
+  delete-topic <name>                       delete a topic
+  subscriptions                             list subscriptions
+  subscription <name>                       show a subscription
+  create-subscription <name> <topic>        create a subscription to a topic
+  delete-subscription <name>                delete a subscription
+  publish [-attr k=v]... <topic> <message>...
+                                            publish messages, with attributes
+  pull [-max n] [-timeout d] [-ack=false] <subscription>
+                                            receive messages
+`
+
+// mediaJSON is the media type of the requests and responses of the cli subcommand
+const mediaJSON = "application/json"
+
+// cliClient sends the requests of the cli subcommand
+type cliClient struct {
+	url    string
+	apiKey string
+	token  string
+	output string // table or json
+	http   *http.Client
+}
+
+// cliResponse is a JSON response of the service
+type cliResponse struct {
+	Status int      `json:"status"`
+	Lines  []string `json:"lines"`
+	Error  string   `json:"error"`
+}
+
+// cliAttributes collects the -attr flags of the publish command
+type cliAttributes map[string]string
+
+func (a cliAttributes) String() string { return fmt.Sprint(map[string]string(a)) }
+
+func (a cliAttributes) Set(s string) error {
+	i := strings.IndexByte(s, '=')
+	if i <= 0 {
+		return fmt.Errorf("attributes must be given as key=value")
+	}
+	a[s[:i]] = s[i+1:]
+	return nil
+}
+
+func cliMain(args []string) int {
+	c := &cliClient{http: &http.Client{}}
+	fs := flag.NewFlagSet("cli", flag.ContinueOnError)
+	fs.Usage = func() { fmt.Fprint(os.Stderr, cliUsage) }
+	fs.StringVar(&c.url, "url", envOr("SECOND_URL", "http://localhost:8080"), "URL of the service")
+	fs.StringVar(&c.apiKey, "api-key", os.Getenv("SECOND_API_KEY"), "API key sent in "+server.APIKeyHeader)
+	fs.StringVar(&c.token, "token", os.Getenv("SECOND_ADMIN_TOKEN"), "admin token")
+	fs.StringVar(&c.output, "o", "table", "output format: table or json")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if c.output != "table" && c.output != "json" {
+		fmt.Fprintln(os.Stderr, "cli: -o must be table or json")
+		return 2
+	}
+	if fs.NArg() == 0 {
+		fs.Usage()
+		return 2
+	}
+	command, args := fs.Arg(0), fs.Args()[1:]
+	err := c.run(command, args)
+	if err == errCLIUsage {
+		fs.Usage()
+		return 2
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "cli: %v\n", err)
+		return 1
+	}
+	return 0
+}
+
+// errCLIUsage is returned for a command given the wrong arguments
+var errCLIUsage = fmt.Errorf("usage")
+
+// cliStatusError is the error response of a request
+type cliStatusError struct {
+	code    int
+	status  string
+	message string
+}
+
+func (e *cliStatusError) Error() string {
+	return fmt.Sprintf("%s: %s", e.status, e.message)
+}
+
+// run runs a command of the cli subcommand
+func (c *cliClient) run(command string, args []string) error {
+	name := func(kind string) string { return "/" + kind + "/" + url.PathEscape(args[0]) }
+	nargs := map[string]int{
+		"topics": 0, "topic": 1, "create-topic": 1, "delete-topic": 1,
+		"subscriptions": 0, "subscription": 1, "create-subscription": 2, "delete-subscription": 1,
+	}
+	if n, ok := nargs[command]; ok && len(args) != n {
+		return errCLIUsage
+	}
+	switch command {
+	case "topics":
+		return c.list("/topics")
+	case "subscriptions":
+		return c.list("/subscriptions")
+	case "topic":
+		return c.details(name("topics"))
+	case "subscription":
+		return c.details(name("subscriptions"))
+	case "create-topic":
+		return c.lines(http.MethodPut, "/topics", map[string]string{"name": args[0]})
+	case "create-subscription":
+		return c.lines(http.MethodPut, "/subscriptions", map[string]string{"name": args[0], "topic": args[1]})
+	case "delete-topic":
+		return c.lines(http.MethodDelete, name("topics"), nil)
+	case "delete-subscription":
+		return c.lines(http.MethodDelete, name("subscriptions"), nil)
+	case "publish":
+		fs := flag.NewFlagSet("publish", flag.ContinueOnError)
+		attrs := cliAttributes{}
+		fs.Var(attrs, "attr", "message attribute key=value (repeatable)")
+		if err := fs.Parse(args); err != nil || fs.NArg() < 2 {
+			return errCLIUsage
+		}
+		var msgs []server.PublishMessage
+		for _, data := range fs.Args()[1:] {
+			msgs = append(msgs, server.PublishMessage{Data: data, Attributes: attrs})
+		}
+		return c.lines(http.MethodPost, "/topics/"+url.PathEscape(fs.Arg(0)), msgs)
+	case "pull":
+		fs := flag.NewFlagSet("pull", flag.ContinueOnError)
+		max := fs.Int("max", 0, "receive at most this many messages")
+		timeout := fs.Duration("timeout", time.Second, "how long to receive for")
+		ack := fs.Bool("ack", true, "ack the messages received")
+		if err := fs.Parse(args); err != nil || fs.NArg() != 1 {
+			return errCLIUsage
+		}
+		q := url.Values{"timeout": {timeout.String()}, "ack": {fmt.Sprint(*ack)}}
+		if *max > 0 {
+			q.Set("max", fmt.Sprint(*max))
+		}
+		return c.lines(http.MethodGet, "/subscriptions/"+url.PathEscape(fs.Arg(0))+"/messages?"+q.Encode(), nil)
+	}
+	return fmt.Errorf("unknown command %q (see -h)", command)
+}
+
+// do sends a request, returning the lines of a successful response
+func (c *cliClient) do(method, path string, body interface{}) ([]string, error) {
+	var rd io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return nil, err
+		}
+		rd = bytes.NewReader(data)
+	}
+	req, err := http.NewRequest(method, strings.TrimSuffix(c.url, "/")+path, rd)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", mediaJSON)
+	if body != nil {
+		req.Header.Set("Content-Type", mediaJSON)
+	}
+	if c.apiKey != "" {
+		req.Header.Set(server.APIKeyHeader, c.apiKey)
+	}
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	var r cliResponse
+	if err := json.NewDecoder(resp.Body).Decode(&r); err != nil {
+		return nil, fmt.Errorf("%s: unexpected response: %v", resp.Status, err)
+	}
+	if r.Error != "" || resp.StatusCode >= http.StatusBadRequest {
+		return nil, &cliStatusError{code: resp.StatusCode, status: resp.Status, message: r.Error}
+	}
+	return r.Lines, nil
+}
+
+// listNames returns the names of a listing, whose lines after its heading are full resource names
+func (c *cliClient) listNames(path string) ([]string, error) {
+	lines, err := c.do(http.MethodGet, path, nil)
+	if err != nil {
+		return nil, err
+	}
+	names := []string{}
+	for _, line := range lines {
+		// skip the heading and "(none)"
+		if strings.HasPrefix(line, "projects/") {
+			names = append(names, line[strings.LastIndexByte(line, '/')+1:])
+		}
+	}
+	return names, nil
+}
+
+// list renders a listing as a table of names or a JSON array
+func (c *cliClient) list(path string) error {
+	names, err := c.listNames(path)
+	if err != nil {
+		return err
+	}
+	if c.output == "json" {
+		return writeCLIJSON(names)
+	}
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "NAME")
+	for _, name := range names {
+		fmt.Fprintln(tw, name)
+	}
+	return tw.Flush()
+}
+
+// details renders a resource's details, "Key: value" lines after its full name, as a table or
+// a JSON object; indented lines, like a topic's subscriptions, list the items of the key before
+// them, which are its value in JSON
+func (c *cliClient) details(path string) error {
+	lines, err := c.do(http.MethodGet, path, nil)
+	if err != nil {
+		return err
+	}
+	keys := []string{"Name"}
+	values := map[string]string{}
+	items := map[string][]string{}
+	for i, line := range lines {
+		switch {
+		case i == 0:
+			values["Name"] = line
+		case strings.HasPrefix(line, "  "):
+			last := keys[len(keys)-1]
+			items[last] = append(items[last], strings.TrimSpace(line))
+		default:
+			key, value := line, ""
+			if j := strings.Index(line, ": "); j >= 0 {
+				key, value = line[:j], line[j+2:]
+			}
+			keys, values[key] = append(keys, key), value
+		}
+	}
+	if c.output == "json" {
+		obj := map[string]interface{}{}
+		for _, key := range keys {
+			if list, ok := items[key]; ok {
+				obj[key] = list
+			} else {
+				obj[key] = values[key]
+			}
+		}
+		return writeCLIJSON(obj)
+	}
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	for _, key := range keys {
+		fmt.Fprintf(tw, "%s\t%s\n", key, values[key])
+		for _, item := range items[key] {
+			fmt.Fprintf(tw, "\t%s\n", item)
+		}
+	}
+	return tw.Flush()
+}
+
+// lines renders the lines of a response as they are, or as a JSON array
+func (c *cliClient) lines(method, path string, body interface{}) error {
+	lines, err := c.do(method, path, body)
+	if err != nil {
+		return err
+	}
+	if c.output == "json" {
+		return writeCLIJSON(lines)
+	}
+	for _, line := range lines {
+		fmt.Println(line)
+	}
+	return nil
+}
+
+func writeCLIJSON(v interface{}) error {
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
+
+// envOr returns the value of an environment variable, or def if it isn't set
+func envOr(name, def string) string {
+	if v := os.Getenv(name); v != "" {
+		return v
+	}
+	return def
+}
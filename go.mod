@@ -3,6 +3,16 @@ module helloworld
 go 1.16
 
 require (
-	cloud.google.com/go/pubsub v1.24.0 // indirect
-	google.golang.org/api v0.85.0 // indirect
+	cloud.google.com/go/firestore v1.5.0
+	cloud.google.com/go/pubsub v1.24.0
+	cloud.google.com/go/storage v1.22.1
+	github.com/linkedin/goavro/v2 v2.15.0
+	github.com/robfig/cron/v3 v3.0.1
+	go.etcd.io/bbolt v1.3.6
+	golang.org/x/net v0.0.0-20220617184016-355a448f1bc9
+	golang.org/x/sys v0.0.0-20220615213510-4f61da869c0c
+	google.golang.org/api v0.85.0
+	google.golang.org/genproto v0.0.0-20220617124728-180714bec0ad
+	google.golang.org/grpc v1.47.0
+	google.golang.org/protobuf v1.28.0
 )
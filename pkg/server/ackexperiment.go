@@ -0,0 +1,149 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/pubsub"
+)
+
+const (
+	maxAckDelay = 10 * time.Minute
+
+	// ackExperimentWatch is how long redeliveries are watched for after the last delayed ack
+	ackExperimentWatch = 10 * time.Second
+)
+
+// With ?ackDelay=<duration>, a receive request is an experiment in ack deadlines: the messages
+// received are acked (or nacked with ack=false) only once the delay has passed, without the
+// client library extending their ack deadline meanwhile, and the request keeps receiving to
+// report which messages Pub/Sub redelivered because their deadline passed first.
+
+// ackExperimentMessage is a message of an ack deadline experiment
+type ackExperimentMessage struct {
+	i           int
+	received    time.Time
+	settled     bool
+	msgs        []*pubsub.Message // the message and its redeliveries, settled together
+	redelivered int
+}
+
+// settle acks or nacks the message and its redeliveries as the options ask
+func (m *ackExperimentMessage) settle(opts receiveOptions) {
+	for _, msg := range m.msgs {
+		opts.settle(msg)
+	}
+	m.settled = true
+}
+
+// parseAckDelay reads the ackDelay option of a receive request, 0 if it has none
+func parseAckDelay(r *http.Request) (time.Duration, error) {
+	s := r.URL.Query().Get("ackDelay")
+	if s == "" {
+		return 0, nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil || d <= 0 || d > maxAckDelay {
+		return 0, fmt.Errorf("ackDelay must be a positive duration up to %s", maxAckDelay)
+	}
+	return d, nil
+}
+
+// receiveAckExperiment serves a receive request with ackDelay: new messages are received for the
+// request's timeout, redeliveries of those until ackExperimentWatch after the last one is settled
+func receiveAckExperiment(w http.ResponseWriter, r *http.Request, subscr *pubsub.Subscription, opts receiveOptions, delay time.Duration) {
+	cfg, err := subscr.Config(r.Context())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	// a negative MaxExtension stops the client library from extending the ack deadline
+	subscr.ReceiveSettings.MaxExtension = -1
+	if opts.max > 0 {
+		subscr.ReceiveSettings.MaxOutstandingMessages = opts.max
+	}
+	start := time.Now()
+	newUntil := start.Add(opts.timeout)
+	ctx, cancel := context.WithDeadline(r.Context(), newUntil.Add(delay+ackExperimentWatch))
+	defer cancel()
+	fmt.Fprintf(w, "ack deadline experiment: acking after %s; subscription ack deadline %s (the client library may "+
+		"set a shorter one on receipt), not extended\n", delay, cfg.AckDeadline)
+	flushResponse(w)
+
+	var (
+		mu            sync.Mutex
+		messages      = map[string]*ackExperimentMessage{}
+		timers        []*time.Timer
+		received      int
+		receivedBytes int
+	)
+	err = subscr.Receive(ctx, func(_ context.Context, msg *pubsub.Message) {
+		mu.Lock()
+		defer mu.Unlock()
+		now := time.Now()
+		if m, ok := messages[msg.ID]; ok {
+			m.redelivered++
+			fmt.Fprintf(w, "[%d] redelivered message ID %s %s after it was received: the ack deadline passed before the ack\n",
+				m.i, msg.ID, now.Sub(m.received).Round(time.Millisecond))
+			if m.settled {
+				opts.settle(msg)
+			} else {
+				m.msgs = append(m.msgs, msg)
+			}
+			flushResponse(w)
+			return
+		}
+		if now.After(newUntil) || (opts.max > 0 && received == opts.max) {
+			msg.Nack()
+			return
+		}
+		m := &ackExperimentMessage{i: received, received: now, msgs: []*pubsub.Message{msg}}
+		messages[msg.ID] = m
+		received++
+		receivedBytes += len(msg.Data)
+		writeReceivedMessage(w, m.i, msg)
+		fmt.Fprintf(w, "[%d] received message ID %s, settling it in %s\n", m.i, msg.ID, delay)
+		flushResponse(w)
+		timers = append(timers, time.AfterFunc(delay, func() {
+			mu.Lock()
+			defer mu.Unlock()
+			if m.settled {
+				return
+			}
+			m.settle(opts)
+			fmt.Fprintf(w, "[%d] settled message ID %s after %s (redelivered %d times meanwhile)\n",
+				m.i, msg.ID, time.Since(m.received).Round(time.Millisecond), m.redelivered)
+			flushResponse(w)
+		}))
+	})
+	mu.Lock()
+	defer mu.Unlock()
+	// the client went away before some messages were settled: leave them for redelivery
+	for _, t := range timers {
+		t.Stop()
+	}
+	for _, m := range messages {
+		if !m.settled {
+			for _, msg := range m.msgs {
+				msg.Nack()
+			}
+			m.settled = true
+		}
+	}
+	if err != nil {
+		fmt.Fprintf(w, "sub.Receive: %v\n", err)
+	}
+	redelivered := 0
+	for _, m := range messages {
+		if m.redelivered > 0 {
+			redelivered++
+		}
+	}
+	fmt.Fprintf(w, "%d of %d messages were redelivered, their ack deadline passing before they were settled after %s\n",
+		redelivered, len(messages), delay)
+	recordReceived(subscr.ID(), received)
+	recordUsage(r, usageCounters{Received: int64(received), ReceivedBytes: int64(receivedBytes)})
+}
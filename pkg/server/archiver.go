@@ -0,0 +1,476 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/pubsub"
+	"cloud.google.com/go/storage"
+	"github.com/linkedin/goavro/v2"
+)
+
+const (
+	archiveFormatNDJSON = "ndjson"
+	archiveFormatAvro   = "avro"
+
+	defaultArchiveMaxBytes = 10 << 20
+	defaultArchiveMaxAge   = 5 * time.Minute
+)
+
+// archiveAvroSchema is the Avro record schema used for archived messages
+const archiveAvroSchema = `{
+	"type": "record",
+	"name": "Message",
+	"fields": [
+		{"name": "id",          "type": "string"},
+		{"name": "publishTime", "type": {"type": "long", "logicalType": "timestamp-millis"}},
+		{"name": "attributes",  "type": {"type": "map", "values": "string"}},
+		{"name": "orderingKey", "type": "string"},
+		{"name": "data",        "type": "bytes"}
+	]
+}`
+
+// archiveRecord is the NDJSON representation of an archived message
+type archiveRecord struct {
+	ID          string            `json:"id"`
+	PublishTime time.Time         `json:"publishTime"`
+	Attributes  map[string]string `json:"attributes,omitempty"`
+	OrderingKey string            `json:"orderingKey,omitempty"`
+	Data        string            `json:"data"`
+}
+
+// archivedObject describes a GCS object written by an archiver
+type archivedObject struct {
+	name     string
+	messages int
+	bytes    int64
+	closed   time.Time
+}
+
+// archiver is a background consumer writing messages from a subscription to GCS objects,
+// rotating to a new object once maxBytes have been written or maxAge has elapsed
+type archiver struct {
+	name         string
+	subscription string
+	bucket       string
+	prefix       string
+	format       string
+	maxBytes     int64
+	maxAge       time.Duration
+	started      time.Time
+
+	cancel context.CancelFunc
+	done   chan struct{}
+
+	mu      sync.Mutex
+	seq     int
+	cur     *archiveObjectWriter
+	objects []archivedObject
+	err     error
+}
+
+// archiveObjectWriter is the GCS object currently being written; messages are
+// only acked once the object has been finalized successfully
+type archiveObjectWriter struct {
+	name    string
+	w       *storage.Writer
+	abort   context.CancelFunc // abandons the upload without finalizing the object
+	ocf     *goavro.OCFWriter
+	opened  time.Time
+	bytes   int64
+	pending []*pubsub.Message
+}
+
+var archivers = struct {
+	sync.Mutex
+	m map[string]*archiver
+}{m: map[string]*archiver{}}
+
+// listArchiversHandler handles GET to /archivers
+func listArchiversHandler(w http.ResponseWriter, r *http.Request) {
+	archivers.Lock()
+	list := make([]*archiver, 0, len(archivers.m))
+	for _, a := range archivers.m {
+		list = append(list, a)
+	}
+	archivers.Unlock()
+	sort.Slice(list, func(i, j int) bool { return list[i].name < list[j].name })
+	fmt.Fprintln(w, "Archivers\n---------")
+	for _, a := range list {
+		fmt.Fprintln(w, a.summary())
+	}
+	if len(list) == 0 {
+		fmt.Fprintln(w, "(none)")
+	}
+}
+
+// createArchiverHandler handles PUT to /archivers
+func createArchiverHandler(w http.ResponseWriter, r *http.Request) {
+	// get archiver details from body:
+	// '{"name":"my-archiver", "subscription":"my-subscription", "bucket":"my-bucket",
+	//   "prefix":"archive/", "format":"ndjson", "maxBytes":1048576, "maxAge":"5m"}'
+	var req archiverRequest
+	if !readRequest(w, r, archiverSchema, &req) {
+		return
+	}
+	a, err := newArchiver(req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	archivers.Lock()
+	if _, ok := archivers.m[a.name]; ok {
+		archivers.Unlock()
+		http.Error(w, fmt.Sprintf("archiver %s already exists", a.name), http.StatusConflict)
+		return
+	}
+	archivers.m[a.name] = a
+	archivers.Unlock()
+
+	if err := a.start(); err != nil {
+		archivers.Lock()
+		delete(archivers.m, a.name)
+		archivers.Unlock()
+		writeLookupError(w, err)
+		return
+	}
+	fmt.Fprintf(w, "created archiver %s\n", a.name)
+}
+
+// getArchiverHandler handles GET to /archivers/<archiver-name>
+func getArchiverHandler(w http.ResponseWriter, r *http.Request) {
+	a, ok := lookupArchiver(w, r)
+	if !ok {
+		return
+	}
+	fmt.Fprintln(w, a.summary())
+	a.writeObjects(w)
+}
+
+// deleteArchiverHandler handles DELETE to /archivers/<archiver-name>
+func deleteArchiverHandler(w http.ResponseWriter, r *http.Request) {
+	a, ok := lookupArchiver(w, r)
+	if !ok {
+		return
+	}
+	a.stop()
+	archivers.Lock()
+	delete(archivers.m, a.name)
+	archivers.Unlock()
+	fmt.Fprintf(w, "stopped archiver %s\n", a.name)
+	a.writeObjects(w)
+}
+
+// lookupArchiver returns the archiver named in the path, responding 404 if there's none
+func lookupArchiver(w http.ResponseWriter, r *http.Request) (*archiver, bool) {
+	name := pathParam(r, "name")
+	archivers.Lock()
+	a, ok := archivers.m[name]
+	archivers.Unlock()
+	if !ok {
+		http.Error(w, fmt.Sprintf("archiver %s not found", name), http.StatusNotFound)
+	}
+	return a, ok
+}
+
+// archiverRequest is the body of PUT /archivers
+type archiverRequest struct {
+	Name         string `json:"name"`
+	Subscription string `json:"subscription"`
+	Bucket       string `json:"bucket"`
+	Prefix       string `json:"prefix"`
+	Format       string `json:"format"`
+	MaxBytes     int64  `json:"maxBytes"`
+	MaxAge       string `json:"maxAge"`
+}
+
+var archiverSchema = objectSchema(map[string]*jsonSchema{
+	"name":         stringSchema("archiver name"),
+	"subscription": stringSchema("subscription whose messages are archived"),
+	"bucket":       stringSchema("GCS bucket the archive objects are written to"),
+	"prefix":       stringSchema("prefix of the archive object names"),
+	"format":       {Type: "string", Description: "archive format", Enum: []string{archiveFormatNDJSON, archiveFormatAvro}},
+	"maxBytes":     numberSchema("size at which an archive object is closed", true, 1),
+	"maxAge":       stringSchema("age at which an archive object is closed, like \"5m\""),
+}, "name", "subscription", "bucket")
+
+// newArchiver validates archiver properties from a create request
+func newArchiver(req archiverRequest) (*archiver, error) {
+	a := &archiver{
+		name:         req.Name,
+		subscription: req.Subscription,
+		bucket:       req.Bucket,
+		prefix:       req.Prefix,
+		format:       archiveFormatNDJSON,
+		maxBytes:     defaultArchiveMaxBytes,
+		maxAge:       defaultArchiveMaxAge,
+	}
+	if a.name == "" {
+		return nil, fmt.Errorf("name property must not be empty")
+	}
+	if err := validateResourceName("subscription", a.subscription); err != nil {
+		return nil, err
+	}
+	if a.bucket == "" {
+		return nil, fmt.Errorf("bucket property must not be empty")
+	}
+	if req.Format != "" {
+		a.format = req.Format
+	}
+	if req.MaxBytes != 0 {
+		a.maxBytes = req.MaxBytes
+	}
+	if req.MaxAge != "" {
+		d, err := time.ParseDuration(req.MaxAge)
+		if err != nil || d <= 0 {
+			return nil, fmt.Errorf("maxAge property must be a positive duration like \"5m\"")
+		}
+		a.maxAge = d
+	}
+	return a, nil
+}
+
+// start creates the clients and launches the background consumer
+func (a *archiver) start() error {
+	projectID := setting("GOOGLE_CLOUD_PROJECT")
+	if projectID == "" {
+		return fmt.Errorf("failed to get project ID")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	client, err := pubsub.NewClient(ctx, projectID, backendOptions()...)
+	if err != nil {
+		cancel()
+		return err
+	}
+	subscr := client.Subscription(a.subscription)
+	if err := checkExists(ctx, "subscription", a.subscription, subscr.Exists); err != nil {
+		cancel()
+		client.Close()
+		return err
+	}
+	gcs, err := storage.NewClient(ctx)
+	if err != nil {
+		cancel()
+		client.Close()
+		return err
+	}
+
+	a.started = time.Now()
+	a.cancel = cancel
+	a.done = make(chan struct{})
+	go a.run(ctx, client, gcs, subscr)
+	return nil
+}
+
+// run receives messages until the archiver is stopped, then finalizes the current object
+func (a *archiver) run(ctx context.Context, client *pubsub.Client, gcs *storage.Client, subscr *pubsub.Subscription) {
+	defer close(a.done)
+	defer client.Close()
+	defer gcs.Close()
+
+	bucket := gcs.Bucket(a.bucket)
+	// messages stay outstanding until their object is closed, so the flow control is by bytes
+	// alone, leaving room for a full object being closed while the next one fills up; a limit on
+	// messages could stall receiving before an object is full
+	subscr.ReceiveSettings.MaxOutstandingMessages = -1
+	subscr.ReceiveSettings.MaxOutstandingBytes = int(2 * a.maxBytes)
+	go func() {
+		ticker := time.NewTicker(time.Second)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				var full *archiveObjectWriter
+				a.mu.Lock()
+				if a.cur != nil && time.Since(a.cur.opened) >= a.maxAge {
+					full = a.detachLocked()
+				}
+				a.mu.Unlock()
+				a.finish(full)
+			}
+		}
+	}()
+
+	err := subscr.Receive(ctx, func(_ context.Context, msg *pubsub.Message) {
+		recordReceived(a.subscription, 1)
+		var full *archiveObjectWriter
+		a.mu.Lock()
+		if err := a.writeLocked(bucket, msg); err != nil {
+			log.Printf("archiver %s: %v", a.name, err)
+			a.err = err
+			a.mu.Unlock()
+			msg.Nack()
+			return
+		}
+		if a.cur.bytes >= a.maxBytes {
+			full = a.detachLocked()
+		}
+		a.mu.Unlock()
+		a.finish(full)
+	})
+
+	a.mu.Lock()
+	if err != nil {
+		log.Printf("archiver %s: receive: %v", a.name, err)
+		a.err = err
+	}
+	last := a.detachLocked()
+	a.mu.Unlock()
+	a.finish(last)
+}
+
+// writeLocked appends msg to the current object, opening a new one if necessary
+func (a *archiver) writeLocked(bucket *storage.BucketHandle, msg *pubsub.Message) error {
+	if a.cur == nil {
+		a.seq++
+		ext := ".ndjson"
+		if a.format == archiveFormatAvro {
+			ext = ".avro"
+		}
+		now := time.Now().UTC()
+		name := fmt.Sprintf("%s%s/%s-%06d%s", a.prefix, a.name, now.Format("20060102T150405Z"), a.seq, ext)
+		// the object is uploaded as it is written and only becomes visible once closed
+		uploadCtx, abort := context.WithCancel(context.Background())
+		cur := &archiveObjectWriter{
+			name:   name,
+			w:      bucket.Object(name).NewWriter(uploadCtx),
+			abort:  abort,
+			opened: now,
+		}
+		if a.format == archiveFormatAvro {
+			cur.w.ContentType = "avro/binary"
+			ocf, err := goavro.NewOCFWriter(goavro.OCFConfig{W: cur.w, Schema: archiveAvroSchema})
+			if err != nil {
+				// unlike closing it, abandoning the upload doesn't wait on GCS while holding the lock
+				abort()
+				return err
+			}
+			cur.ocf = ocf
+		} else {
+			cur.w.ContentType = "application/x-ndjson"
+		}
+		a.cur = cur
+	}
+
+	n := int64(len(msg.Data))
+	if a.cur.ocf != nil {
+		attrs := make(map[string]interface{}, len(msg.Attributes))
+		for k, v := range msg.Attributes {
+			attrs[k] = v
+		}
+		err := a.cur.ocf.Append([]map[string]interface{}{{
+			"id":          msg.ID,
+			"publishTime": msg.PublishTime,
+			"attributes":  attrs,
+			"orderingKey": msg.OrderingKey,
+			"data":        msg.Data,
+		}})
+		if err != nil {
+			return err
+		}
+	} else {
+		line, err := json.Marshal(archiveRecord{
+			ID:          msg.ID,
+			PublishTime: msg.PublishTime,
+			Attributes:  msg.Attributes,
+			OrderingKey: msg.OrderingKey,
+			Data:        string(msg.Data),
+		})
+		if err != nil {
+			return err
+		}
+		line = append(line, '\n')
+		if _, err := a.cur.w.Write(line); err != nil {
+			return err
+		}
+		n = int64(len(line))
+	}
+	a.cur.bytes += n
+	a.cur.pending = append(a.cur.pending, msg)
+	return nil
+}
+
+// detachLocked takes the current object, if any, so that the next message opens a new one; the
+// caller finishes it once it has released the lock
+func (a *archiver) detachLocked() *archiveObjectWriter {
+	cur := a.cur
+	a.cur = nil
+	return cur
+}
+
+// finish finalizes an object taken by detachLocked, acking its messages on success; closing it
+// waits for the upload to complete, so it must not be called with the lock held
+func (a *archiver) finish(cur *archiveObjectWriter) {
+	if cur == nil {
+		return
+	}
+	err := cur.w.Close()
+	cur.abort()
+	if err != nil {
+		log.Printf("archiver %s: closing %s: %v", a.name, cur.name, err)
+		for _, msg := range cur.pending {
+			msg.Nack()
+		}
+		a.mu.Lock()
+		a.err = err
+		a.mu.Unlock()
+		return
+	}
+	for _, msg := range cur.pending {
+		msg.Ack()
+	}
+	a.mu.Lock()
+	a.objects = append(a.objects, archivedObject{
+		name:     cur.name,
+		messages: len(cur.pending),
+		bytes:    cur.bytes,
+		closed:   time.Now(),
+	})
+	a.mu.Unlock()
+}
+
+// stop cancels the consumer and waits for the current object to be finalized
+func (a *archiver) stop() {
+	a.cancel()
+	<-a.done
+}
+
+// summary returns a one-line description of the archiver
+func (a *archiver) summary() string {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	s := fmt.Sprintf("%s: subscription=%s destination=gs://%s/%s%s/ format=%s maxBytes=%d maxAge=%s objects=%d",
+		a.name, a.subscription, a.bucket, a.prefix, a.name, a.format, a.maxBytes, a.maxAge, len(a.objects))
+	if a.err != nil {
+		s += fmt.Sprintf(" lastError=%q", a.err.Error())
+	}
+	return s
+}
+
+// writeObjects lists the objects written by the archiver so far
+func (a *archiver) writeObjects(w io.Writer) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	fmt.Fprintln(w, "Objects\n-------")
+	for i, o := range a.objects {
+		fmt.Fprintf(w, "[%d] gs://%s/%s (%d messages, %d bytes, closed %s)\n",
+			i, a.bucket, o.name, o.messages, o.bytes, o.closed.Format(time.RFC3339))
+	}
+	if len(a.objects) == 0 {
+		fmt.Fprintln(w, "(none)")
+	}
+	if a.cur != nil {
+		fmt.Fprintf(w, "writing gs://%s/%s (%d messages, %d bytes)\n", a.bucket, a.cur.name, len(a.cur.pending), a.cur.bytes)
+	}
+}
@@ -0,0 +1,221 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	asyncJobPrefix = "op-"
+
+	// asyncJobRetention is how long finished jobs can still be looked up
+	asyncJobRetention = time.Hour
+
+	// maxAsyncJobOutput bounds the output kept per job; beyond it the oldest output is dropped
+	maxAsyncJobOutput = 1 << 20
+
+	asyncJobsMetric = "second_async_jobs_total"
+)
+
+// asyncJob is a long-running request run in the background: the response it writes is kept
+// as the job's progress and result, reported by GET /jobs/<id>
+type asyncJob struct {
+	ID       string
+	Request  string // method and URL
+	Started  time.Time
+	Finished time.Time // zero while running
+
+	mu          sync.Mutex
+	status      int
+	wroteHeader bool
+	output      bytes.Buffer
+	truncated   bool
+	header      http.Header
+	cancel      context.CancelFunc
+}
+
+// asyncJobs are the jobs started by requests asking for asynchronous processing
+var asyncJobs = struct {
+	sync.Mutex
+	m map[string]*asyncJob
+}{m: map[string]*asyncJob{}}
+
+// asyncable lets a long-running handler run as a job, when the request asks for it with
+// 'Prefer: respond-async' or ?async=true: the request is answered right away with 202 and the
+// job's URL in Location, and the handler's response becomes the job's output
+func asyncable(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("async") != "true" && !strings.Contains(r.Header.Get("Prefer"), "respond-async") {
+			h(w, r)
+			return
+		}
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		// the job outlives the request, so it gets a request of its own, keeping the path parameters
+		ctx, cancel := context.WithCancel(context.WithValue(context.Background(), pathParamsKey{}, r.Context().Value(pathParamsKey{})))
+		job := &asyncJob{
+			ID:      asyncJobPrefix + randomID()[:16],
+			Request: r.Method + " " + r.URL.RequestURI(),
+			Started: time.Now(),
+			status:  http.StatusOK,
+			header:  http.Header{},
+			cancel:  cancel,
+		}
+		jr := r.Clone(ctx)
+		jr.Body = io.NopCloser(bytes.NewReader(body))
+
+		asyncJobs.Lock()
+		for id, j := range asyncJobs.m {
+			if j.done() && time.Since(j.finishedAt()) > asyncJobRetention {
+				delete(asyncJobs.m, id)
+			}
+		}
+		asyncJobs.m[job.ID] = job
+		asyncJobs.Unlock()
+		counterAdd(asyncJobsMetric, "Requests run as asynchronous jobs.", 1)
+
+		go func() {
+			defer cancel()
+			defer func() {
+				if p := recover(); p != nil {
+					log.Printf("job %s: panic: %v", job.ID, p)
+					fmt.Fprintf(job, "\njob failed: %v\n", p)
+					job.mu.Lock()
+					job.status = http.StatusInternalServerError
+					job.mu.Unlock()
+				}
+				job.mu.Lock()
+				job.Finished = time.Now()
+				job.mu.Unlock()
+			}()
+			h(job, jr)
+		}()
+
+		w.Header().Set("Location", "/jobs/"+job.ID)
+		w.WriteHeader(http.StatusAccepted)
+		fmt.Fprintf(w, "started job %s: GET /jobs/%s for progress and results, DELETE to cancel\n", job.ID, job.ID)
+	}
+}
+
+// Header, WriteHeader and Write make a job the response writer of its handler
+
+func (j *asyncJob) Header() http.Header {
+	return j.header
+}
+
+func (j *asyncJob) WriteHeader(status int) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if !j.wroteHeader {
+		j.wroteHeader = true
+		j.status = status
+	}
+}
+
+func (j *asyncJob) Write(p []byte) (int, error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.output.Write(p)
+	if excess := j.output.Len() - maxAsyncJobOutput; excess > 0 {
+		j.output.Next(excess)
+		j.truncated = true
+	}
+	return len(p), nil
+}
+
+// Flush is a no-op: the output is visible to GET /jobs/<id> as soon as it's written
+func (j *asyncJob) Flush() {}
+
+func (j *asyncJob) done() bool {
+	return !j.finishedAt().IsZero()
+}
+
+func (j *asyncJob) finishedAt() time.Time {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.Finished
+}
+
+// state returns the job's state: running, succeeded or failed (with a status code of 400 or more)
+func (j *asyncJob) state() string {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	switch {
+	case j.Finished.IsZero():
+		return "running"
+	case j.status >= http.StatusBadRequest:
+		return "failed"
+	}
+	return "succeeded"
+}
+
+func (j *asyncJob) summary() string {
+	elapsed := time.Since(j.Started)
+	if f := j.finishedAt(); !f.IsZero() {
+		elapsed = f.Sub(j.Started)
+	}
+	return fmt.Sprintf("%s: %s state=%s elapsed=%s", j.ID, j.Request, j.state(), elapsed.Round(time.Millisecond))
+}
+
+func lookupAsyncJob(id string) (*asyncJob, bool) {
+	asyncJobs.Lock()
+	defer asyncJobs.Unlock()
+	j, ok := asyncJobs.m[id]
+	return j, ok
+}
+
+// writeAsyncJob reports a job's state, its response status once finished, and its output so far
+func writeAsyncJob(w http.ResponseWriter, j *asyncJob) {
+	fmt.Fprintf(w, "Job: %s\n", j.ID)
+	fmt.Fprintf(w, "Request: %s\n", j.Request)
+	fmt.Fprintf(w, "Started: %s\n", j.Started.Format(time.RFC3339))
+	state := j.state()
+	fmt.Fprintf(w, "State: %s\n", state)
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if state != "running" {
+		fmt.Fprintf(w, "Finished: %s (after %s)\n", j.Finished.Format(time.RFC3339), j.Finished.Sub(j.Started).Round(time.Millisecond))
+		fmt.Fprintf(w, "Status: %d %s\n", j.status, http.StatusText(j.status))
+	}
+	fmt.Fprintln(w, "Output:")
+	if j.truncated {
+		fmt.Fprintln(w, "(earlier output dropped)")
+	}
+	w.Write(j.output.Bytes())
+}
+
+// cancelAsyncJob cancels a running job's context; the job stops at its next check
+func cancelAsyncJob(w http.ResponseWriter, j *asyncJob) {
+	if j.done() {
+		fmt.Fprintf(w, "job %s already finished\n", j.ID)
+		return
+	}
+	j.cancel()
+	fmt.Fprintf(w, "canceled job %s\n", j.ID)
+}
+
+func asyncJobSummaries() []string {
+	asyncJobs.Lock()
+	list := make([]*asyncJob, 0, len(asyncJobs.m))
+	for _, j := range asyncJobs.m {
+		list = append(list, j)
+	}
+	asyncJobs.Unlock()
+	sort.Slice(list, func(a, b int) bool { return list[a].Started.Before(list[b].Started) })
+	var summaries []string
+	for _, j := range list {
+		summaries = append(summaries, j.summary())
+	}
+	return summaries
+}
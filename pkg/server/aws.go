@@ -0,0 +1,777 @@
+package server
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/pubsub"
+	pubsubapi "cloud.google.com/go/pubsub/apiv1"
+	"google.golang.org/api/iterator"
+	pubsubpb "google.golang.org/genproto/googleapis/pubsub/v1"
+)
+
+// The AWS facade (AWS_FACADE=true) serves a subset of the SNS and SQS query APIs at /aws, so
+// applications written against SNS/SQS can be tried against Pub/Sub by pointing their SDK's
+// endpoint at it: SNS topics are Pub/Sub topics, an SQS queue is a subscription of the same name
+// on a topic of the same name, and an SNS subscription of a queue is a route republishing the
+// SNS topic's messages to the queue's topic.
+
+const (
+	awsAccountID     = "000000000000"
+	defaultAWSRegion = "us-east-1"
+
+	snsNamespace = "http://sns.amazonaws.com/doc/2010-03-31/"
+	sqsNamespace = "http://queue.amazonaws.com/doc/2012-11-05/"
+
+	maxSQSReceiveMessages = 10
+	maxSQSWaitTime        = 20 * time.Second
+	maxSQSVisibility      = 12 * time.Hour
+	maxPubSubAckDeadline  = 600 * time.Second
+)
+
+// awsError is an error response of the query API
+type awsError struct {
+	status  int
+	code    string
+	message string
+}
+
+func (e *awsError) Error() string {
+	return e.code + ": " + e.message
+}
+
+func awsSenderError(code, format string, args ...interface{}) error {
+	return &awsError{status: http.StatusBadRequest, code: code, message: fmt.Sprintf(format, args...)}
+}
+
+// awsAuthorizationError returns an error denying the request, with the AWS error code
+func awsAuthorizationError(code string, err error) error {
+	return &awsError{status: http.StatusForbidden, code: code, message: err.Error()}
+}
+
+// awsThrottled returns the error of an admin call (see quota.go and retry.go), as a throttled AWS
+// request if the admin operations quota stayed exhausted
+func awsThrottled(err error) error {
+	var qerr *adminQuotaError
+	if errors.As(err, &qerr) {
+		return &awsError{status: http.StatusBadRequest, code: "Throttling", message: err.Error()}
+	}
+	return err
+}
+
+// awsRequest is an SNS or SQS action request with its parameters
+type awsRequest struct {
+	r      *http.Request
+	action string
+	params map[string]string
+}
+
+// awsHandler handles POST to /aws and to queue URLs /aws/<account-id>/<queue-name>
+func awsHandler(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		writeAWSError(w, snsNamespace, awsSenderError("MalformedQueryString", "%v", err))
+		return
+	}
+	req := &awsRequest{r: r, action: r.Form.Get("Action"), params: map[string]string{}}
+	for key := range r.Form {
+		req.params[key] = r.Form.Get(key)
+	}
+	if name := pathParam(r, "name"); name != "" && req.params["QueueUrl"] == "" {
+		req.params["QueueUrl"] = name
+	}
+
+	actions := map[string]func(context.Context, *pubsub.Client, *awsRequest) (interface{}, error){
+		"CreateTopic":             snsCreateTopic,
+		"ListTopics":              snsListTopics,
+		"DeleteTopic":             snsDeleteTopic,
+		"Publish":                 snsPublish,
+		"Subscribe":               snsSubscribe,
+		"CreateQueue":             sqsCreateQueue,
+		"GetQueueUrl":             sqsGetQueueURL,
+		"ListQueues":              sqsListQueues,
+		"DeleteQueue":             sqsDeleteQueue,
+		"SendMessage":             sqsSendMessage,
+		"ReceiveMessage":          sqsReceiveMessage,
+		"DeleteMessage":           sqsDeleteMessage,
+		"ChangeMessageVisibility": sqsChangeMessageVisibility,
+	}
+	namespace := snsNamespace
+	if strings.HasSuffix(req.action, "Queue") || strings.HasSuffix(req.action, "Message") || req.action == "GetQueueUrl" ||
+		req.action == "ListQueues" || req.action == "ChangeMessageVisibility" {
+		namespace = sqsNamespace
+	}
+	action, ok := actions[req.action]
+	if !ok {
+		writeAWSError(w, namespace, awsSenderError("InvalidAction", "action %q is not supported", req.action))
+		return
+	}
+	ctx := context.Background()
+	client, ok := newClient(ctx, w)
+	if !ok {
+		return
+	}
+	defer client.Close()
+	result, err := action(ctx, client, req)
+	if err != nil {
+		writeAWSError(w, namespace, err)
+		return
+	}
+	type responseMetadata struct {
+		RequestID string `xml:"RequestId"`
+	}
+	resp := struct {
+		XMLName  xml.Name
+		Xmlns    string           `xml:"xmlns,attr"`
+		Result   interface{}      `xml:",omitempty"`
+		Metadata responseMetadata `xml:"ResponseMetadata"`
+	}{
+		XMLName:  xml.Name{Local: req.action + "Response"},
+		Xmlns:    namespace,
+		Result:   result,
+		Metadata: responseMetadata{RequestID: randomID()},
+	}
+	w.Header().Set("Content-Type", "text/xml")
+	fmt.Fprint(w, xml.Header)
+	xml.NewEncoder(w).Encode(resp)
+}
+
+// writeAWSError writes an error response; errors not from the facade itself are the service's
+func writeAWSError(w http.ResponseWriter, namespace string, err error) {
+	var ae *awsError
+	if !errors.As(err, &ae) {
+		ae = &awsError{status: http.StatusInternalServerError, code: "InternalFailure", message: err.Error()}
+	}
+	errType := "Sender"
+	if ae.status >= 500 {
+		errType = "Receiver"
+	}
+	resp := struct {
+		XMLName xml.Name `xml:"ErrorResponse"`
+		Xmlns   string   `xml:"xmlns,attr"`
+		Error   struct {
+			Type    string
+			Code    string
+			Message string
+		}
+		RequestID string `xml:"RequestId"`
+	}{Xmlns: namespace, RequestID: randomID()}
+	resp.Error.Type, resp.Error.Code, resp.Error.Message = errType, ae.code, ae.message
+	w.Header().Set("Content-Type", "text/xml")
+	w.WriteHeader(ae.status)
+	fmt.Fprint(w, xml.Header)
+	xml.NewEncoder(w).Encode(resp)
+}
+
+func awsRegion() string {
+	if region := setting("AWS_REGION"); region != "" {
+		return region
+	}
+	return defaultAWSRegion
+}
+
+func topicARN(name string) string {
+	return fmt.Sprintf("arn:aws:sns:%s:%s:%s", awsRegion(), awsAccountID, name)
+}
+
+func queueURL(r *http.Request, name string) string {
+	scheme := "http"
+	if r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https" {
+		scheme = "https"
+	}
+	return fmt.Sprintf("%s://%s/aws/%s/%s", scheme, r.Host, awsAccountID, name)
+}
+
+// required returns a required parameter
+func (req *awsRequest) required(name string) (string, error) {
+	v := req.params[name]
+	if v == "" {
+		return "", awsSenderError("MissingParameter", "the request must contain the parameter %s", name)
+	}
+	return v, nil
+}
+
+// topicName returns the topic name of the TopicArn parameter
+func (req *awsRequest) topicName() (string, error) {
+	arn, err := req.required("TopicArn")
+	if err != nil {
+		return "", err
+	}
+	name := arn[strings.LastIndex(arn, ":")+1:]
+	if err := validateResourceName("topic", name); err != nil {
+		return "", awsSenderError("InvalidParameter", "TopicArn: %v", err)
+	}
+	return name, nil
+}
+
+// queueName returns the queue name of the QueueUrl parameter, or of a queue ARN
+func (req *awsRequest) queueName(param string) (string, error) {
+	v, err := req.required(param)
+	if err != nil {
+		return "", err
+	}
+	name := v[strings.LastIndexAny(v, "/:")+1:]
+	if err := validateResourceName("subscription", name); err != nil {
+		return "", awsSenderError("InvalidParameterValue", "%s: %v", param, err)
+	}
+	return name, nil
+}
+
+// attributes returns message attributes given as <prefix>.N.Name and <prefix>.N.Value.StringValue,
+// e.g. MessageAttributes.entry.1.Name for SNS and MessageAttribute.1.Name for SQS
+func (req *awsRequest) attributes(prefix string) map[string]string {
+	attrs := map[string]string{}
+	for i := 1; ; i++ {
+		name, ok := req.params[fmt.Sprintf("%s.%d.Name", prefix, i)]
+		if !ok {
+			return attrs
+		}
+		attrs[name] = req.params[fmt.Sprintf("%s.%d.Value.StringValue", prefix, i)]
+	}
+}
+
+// tags returns resource tags given as <prefix>.N.Key and <prefix>.N.Value, e.g. Tags.member.1.Key
+// for SNS and Tag.1.Key for SQS; they become the labels of the topic or subscription created
+func (req *awsRequest) tags(prefix string) map[string]string {
+	tags := map[string]string{}
+	for i := 1; ; i++ {
+		key, ok := req.params[fmt.Sprintf("%s.%d.Key", prefix, i)]
+		if !ok {
+			return tags
+		}
+		tags[key] = req.params[fmt.Sprintf("%s.%d.Value", prefix, i)]
+	}
+}
+
+func snsCreateTopic(ctx context.Context, client *pubsub.Client, req *awsRequest) (interface{}, error) {
+	name, err := req.required("Name")
+	if err != nil {
+		return nil, err
+	}
+	tags := req.tags("Tags.member")
+	if err := validateNewResource("topic", name, tags); err != nil {
+		return nil, awsSenderError("InvalidParameter", "Name: %v", err)
+	}
+	// creating an existing topic returns it, like SNS does
+	if err := ensureTopic(ctx, client, name, tags); err != nil {
+		return nil, err
+	}
+	return struct {
+		XMLName  xml.Name `xml:"CreateTopicResult"`
+		TopicArn string
+	}{TopicArn: topicARN(name)}, nil
+}
+
+func snsListTopics(ctx context.Context, client *pubsub.Client, req *awsRequest) (interface{}, error) {
+	type member struct {
+		TopicArn string
+	}
+	if err := awsThrottled(waitAdminQuota(ctx, adminOpList)); err != nil {
+		return nil, err
+	}
+	var members []member
+	it := client.Topics(ctx)
+	for {
+		t, err := it.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		members = append(members, member{TopicArn: topicARN(t.ID())})
+	}
+	return struct {
+		XMLName xml.Name `xml:"ListTopicsResult"`
+		Topics  []member `xml:"Topics>member"`
+	}{Topics: members}, nil
+}
+
+func snsDeleteTopic(ctx context.Context, client *pubsub.Client, req *awsRequest) (interface{}, error) {
+	name, err := req.topicName()
+	if err != nil {
+		return nil, err
+	}
+	if deleteConfirmationRequired() {
+		plan, err := topicDeletePlan(ctx, client.Topic(name))
+		if err != nil {
+			return nil, err
+		}
+		if err := refuseLossyDelete(plan); err != nil {
+			return nil, awsSenderError("InvalidParameter", "%v", err)
+		}
+	}
+	if _, err := deleteOrTrashTopic(ctx, client, name); err != nil {
+		return nil, awsThrottled(err)
+	}
+	return nil, nil
+}
+
+func snsPublish(ctx context.Context, client *pubsub.Client, req *awsRequest) (interface{}, error) {
+	name, err := req.topicName()
+	if err != nil {
+		return nil, err
+	}
+	message, err := req.required("Message")
+	if err != nil {
+		return nil, err
+	}
+	attrs := req.attributes("MessageAttributes.entry")
+	if subject := req.params["Subject"]; subject != "" {
+		attrs["Subject"] = subject
+	}
+	if err := authorizePublish(req.r, name, []map[string]string{attrs}); err != nil {
+		return nil, awsAuthorizationError("AuthorizationError", err)
+	}
+	id, err := publishMessage(name, &pubsub.Message{Data: []byte(message), Attributes: attrs})
+	if err != nil {
+		return nil, err
+	}
+	return struct {
+		XMLName   xml.Name `xml:"PublishResult"`
+		MessageID string   `xml:"MessageId"`
+	}{MessageID: id}, nil
+}
+
+// snsSubscribe subscribes a queue to a topic: a subscription sns-<topic>-<queue> of the topic is
+// routed to the queue's topic; messages are delivered raw, without the SNS JSON envelope
+func snsSubscribe(ctx context.Context, client *pubsub.Client, req *awsRequest) (interface{}, error) {
+	topicName, err := req.topicName()
+	if err != nil {
+		return nil, err
+	}
+	if protocol := req.params["Protocol"]; protocol != "sqs" {
+		return nil, awsSenderError("InvalidParameter", "Protocol %q is not supported, only sqs", protocol)
+	}
+	queue, err := req.queueName("Endpoint")
+	if err != nil {
+		return nil, err
+	}
+	exists, err := client.Subscription(queue).Exists(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		return nil, awsSenderError("NotFound", "queue %s does not exist", queue)
+	}
+
+	name := fmt.Sprintf("sns-%s-%s", topicName, queue)
+	if err := validateNewResource("subscription", name, nil); err != nil {
+		return nil, awsSenderError("InvalidParameter", "%v", err)
+	}
+	subscr := client.Subscription(name)
+	if exists, err := subscr.Exists(ctx); err != nil {
+		return nil, err
+	} else if !exists {
+		err := awsThrottled(retryAdmin(ctx, adminOpCreate, func() error {
+			_, err := client.CreateSubscription(ctx, name, newSubscriptionConfig(client.Topic(topicName)))
+			return err
+		}))
+		if err != nil {
+			return nil, err
+		}
+	}
+	// subscribing again returns the existing subscription, like SNS does
+	rt := &router{name: name, subscription: name, defaultTopic: queue}
+	routers.Lock()
+	_, running := routers.m[name]
+	if !running {
+		routers.m[name] = rt
+	}
+	routers.Unlock()
+	if !running {
+		if err := rt.start(); err != nil {
+			routers.Lock()
+			delete(routers.m, name)
+			routers.Unlock()
+			return nil, err
+		}
+		rt.save()
+	}
+	return struct {
+		XMLName         xml.Name `xml:"SubscribeResult"`
+		SubscriptionArn string
+	}{SubscriptionArn: topicARN(topicName) + ":" + name}, nil
+}
+
+// sqsCreateQueue creates a queue as a subscription on a topic, both named after the queue and
+// labelled with its tags
+func sqsCreateQueue(ctx context.Context, client *pubsub.Client, req *awsRequest) (interface{}, error) {
+	name, err := req.required("QueueName")
+	if err != nil {
+		return nil, err
+	}
+	tags := req.tags("Tag")
+	if err := validateNewResource("subscription", name, tags); err != nil {
+		return nil, awsSenderError("InvalidParameterValue", "QueueName: %v", err)
+	}
+	if err := checkNamingPolicy("topic", name, tags); err != nil {
+		return nil, awsSenderError("InvalidParameterValue", "QueueName: %v", err)
+	}
+	if err := ensureTopic(ctx, client, name, tags); err != nil {
+		return nil, err
+	}
+	subscr := client.Subscription(name)
+	if exists, err := subscr.Exists(ctx); err != nil {
+		return nil, err
+	} else if !exists {
+		cfg := newSubscriptionConfig(client.Topic(name))
+		cfg.Labels = withDemoLabels(tags)
+		err := awsThrottled(retryAdmin(ctx, adminOpCreate, func() error {
+			_, err := client.CreateSubscription(ctx, name, cfg)
+			return err
+		}))
+		if err != nil {
+			return nil, err
+		}
+	}
+	return struct {
+		XMLName  xml.Name `xml:"CreateQueueResult"`
+		QueueURL string   `xml:"QueueUrl"`
+	}{QueueURL: queueURL(req.r, name)}, nil
+}
+
+func sqsGetQueueURL(ctx context.Context, client *pubsub.Client, req *awsRequest) (interface{}, error) {
+	name, err := req.queueName("QueueName")
+	if err != nil {
+		return nil, err
+	}
+	if err := checkQueue(ctx, client, name); err != nil {
+		return nil, err
+	}
+	return struct {
+		XMLName  xml.Name `xml:"GetQueueUrlResult"`
+		QueueURL string   `xml:"QueueUrl"`
+	}{QueueURL: queueURL(req.r, name)}, nil
+}
+
+func sqsListQueues(ctx context.Context, client *pubsub.Client, req *awsRequest) (interface{}, error) {
+	prefix := req.params["QueueNamePrefix"]
+	if err := awsThrottled(waitAdminQuota(ctx, adminOpList)); err != nil {
+		return nil, err
+	}
+	var urls []string
+	it := client.Subscriptions(ctx)
+	for {
+		s, err := it.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if strings.HasPrefix(s.ID(), prefix) {
+			urls = append(urls, queueURL(req.r, s.ID()))
+		}
+	}
+	return struct {
+		XMLName   xml.Name `xml:"ListQueuesResult"`
+		QueueURLs []string `xml:"QueueUrl"`
+	}{QueueURLs: urls}, nil
+}
+
+func sqsDeleteQueue(ctx context.Context, client *pubsub.Client, req *awsRequest) (interface{}, error) {
+	name, err := req.queueName("QueueUrl")
+	if err != nil {
+		return nil, err
+	}
+	if err := checkQueue(ctx, client, name); err != nil {
+		return nil, err
+	}
+	topicExists, err := client.Topic(name).Exists(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if deleteConfirmationRequired() {
+		plans := []*deletePlan{subscriptionDeletePlan(ctx, client.Subscription(name))}
+		if topicExists {
+			plan, err := topicDeletePlan(ctx, client.Topic(name))
+			if err != nil {
+				return nil, err
+			}
+			// the queue's own subscription is deleted anyway
+			plans = append(plans, plan.without(name))
+		}
+		for _, plan := range plans {
+			if err := refuseLossyDelete(plan); err != nil {
+				return nil, awsSenderError("InvalidParameterValue", "%v", err)
+			}
+		}
+	}
+	err = awsThrottled(retryAdmin(ctx, adminOpDelete, func() error {
+		return client.Subscription(name).Delete(ctx)
+	}))
+	if err != nil {
+		return nil, err
+	}
+	// the queue's own topic goes too, if there is one
+	if topicExists {
+		if _, err := deleteOrTrashTopic(ctx, client, name); err != nil {
+			return nil, awsThrottled(err)
+		}
+	}
+	return nil, nil
+}
+
+func sqsSendMessage(ctx context.Context, client *pubsub.Client, req *awsRequest) (interface{}, error) {
+	name, err := req.queueName("QueueUrl")
+	if err != nil {
+		return nil, err
+	}
+	body, err := req.required("MessageBody")
+	if err != nil {
+		return nil, err
+	}
+	attrs := req.attributes("MessageAttribute")
+	if err := authorizePublish(req.r, name, []map[string]string{attrs}); err != nil {
+		return nil, awsAuthorizationError("AccessDenied", err)
+	}
+	id, err := publishMessage(name, &pubsub.Message{Data: []byte(body), Attributes: attrs})
+	if err != nil {
+		return nil, err
+	}
+	result := struct {
+		XMLName                xml.Name `xml:"SendMessageResult"`
+		MessageID              string   `xml:"MessageId"`
+		MD5OfMessageBody       string
+		MD5OfMessageAttributes string `xml:",omitempty"`
+	}{MessageID: id, MD5OfMessageBody: md5Hex([]byte(body))}
+	if len(attrs) > 0 {
+		result.MD5OfMessageAttributes = md5OfMessageAttributes(attrs)
+	}
+	return result, nil
+}
+
+// sqsMessage is a message of a ReceiveMessage response
+type sqsMessage struct {
+	MessageID              string `xml:"MessageId"`
+	ReceiptHandle          string
+	MD5OfBody              string
+	Body                   string
+	MD5OfMessageAttributes string `xml:",omitempty"`
+	Attributes             []sqsAttribute
+	MessageAttributes      []sqsMessageAttribute `xml:"MessageAttribute"`
+}
+
+type sqsAttribute struct {
+	Name  string
+	Value string
+}
+
+type sqsMessageAttribute struct {
+	Name  string
+	Value struct {
+		StringValue string
+		DataType    string
+	}
+}
+
+// sqsReceiveMessage pulls messages without acknowledging them: the ack ID is the receipt handle,
+// for DeleteMessage; VisibilityTimeout sets their ack deadline
+func sqsReceiveMessage(ctx context.Context, client *pubsub.Client, req *awsRequest) (interface{}, error) {
+	name, err := req.queueName("QueueUrl")
+	if err != nil {
+		return nil, err
+	}
+	max := 1
+	if s := req.params["MaxNumberOfMessages"]; s != "" {
+		if max, err = strconv.Atoi(s); err != nil || max < 1 || max > maxSQSReceiveMessages {
+			return nil, awsSenderError("InvalidParameterValue", "MaxNumberOfMessages must be from 1 to %d", maxSQSReceiveMessages)
+		}
+	}
+	// a pull always waits a little, there's no short polling
+	wait := time.Second
+	if s := req.params["WaitTimeSeconds"]; s != "" {
+		secs, err := strconv.Atoi(s)
+		if err != nil || secs < 0 || time.Duration(secs)*time.Second > maxSQSWaitTime {
+			return nil, awsSenderError("InvalidParameterValue", "WaitTimeSeconds must be from 0 to %d", int(maxSQSWaitTime/time.Second))
+		}
+		if time.Duration(secs)*time.Second > wait {
+			wait = time.Duration(secs) * time.Second
+		}
+	}
+	visibility, err := req.visibilityTimeout(false)
+	if err != nil {
+		return nil, err
+	}
+
+	sub, err := pubsubapi.NewSubscriberClient(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer sub.Close()
+	subscription := fmt.Sprintf("projects/%s/subscriptions/%s", setting("GOOGLE_CLOUD_PROJECT"), name)
+	pctx, cancel := context.WithTimeout(ctx, wait)
+	defer cancel()
+	resp, err := sub.Pull(pctx, &pubsubpb.PullRequest{Subscription: subscription, MaxMessages: int32(max)})
+	if err != nil && pctx.Err() == nil {
+		return nil, err
+	}
+
+	result := struct {
+		XMLName  xml.Name     `xml:"ReceiveMessageResult"`
+		Messages []sqsMessage `xml:"Message"`
+	}{}
+	var ackIDs []string
+	for _, rm := range resp.GetReceivedMessages() {
+		msg := rm.GetMessage()
+		ackIDs = append(ackIDs, rm.GetAckId())
+		m := sqsMessage{
+			MessageID:     msg.GetMessageId(),
+			ReceiptHandle: rm.GetAckId(),
+			MD5OfBody:     md5Hex(msg.GetData()),
+			Body:          string(msg.GetData()),
+			Attributes: []sqsAttribute{
+				{"SentTimestamp", strconv.FormatInt(msg.GetPublishTime().AsTime().UnixNano()/int64(time.Millisecond), 10)},
+				{"ApproximateReceiveCount", strconv.Itoa(int(rm.GetDeliveryAttempt()))},
+			},
+		}
+		if attrs := msg.GetAttributes(); len(attrs) > 0 {
+			m.MD5OfMessageAttributes = md5OfMessageAttributes(attrs)
+			for _, key := range sortedKeys(attrs) {
+				a := sqsMessageAttribute{Name: key}
+				a.Value.StringValue, a.Value.DataType = attrs[key], "String"
+				m.MessageAttributes = append(m.MessageAttributes, a)
+			}
+		}
+		result.Messages = append(result.Messages, m)
+	}
+	recordReceived(name, len(ackIDs))
+	if visibility > 0 && len(ackIDs) > 0 {
+		err := sub.ModifyAckDeadline(ctx, &pubsubpb.ModifyAckDeadlineRequest{
+			Subscription: subscription, AckIds: ackIDs, AckDeadlineSeconds: int32(visibility / time.Second),
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return result, nil
+}
+
+func sqsDeleteMessage(ctx context.Context, client *pubsub.Client, req *awsRequest) (interface{}, error) {
+	name, err := req.queueName("QueueUrl")
+	if err != nil {
+		return nil, err
+	}
+	handle, err := req.required("ReceiptHandle")
+	if err != nil {
+		return nil, err
+	}
+	sub, err := pubsubapi.NewSubscriberClient(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer sub.Close()
+	return nil, sub.Acknowledge(ctx, &pubsubpb.AcknowledgeRequest{
+		Subscription: fmt.Sprintf("projects/%s/subscriptions/%s", setting("GOOGLE_CLOUD_PROJECT"), name),
+		AckIds:       []string{handle},
+	})
+}
+
+func sqsChangeMessageVisibility(ctx context.Context, client *pubsub.Client, req *awsRequest) (interface{}, error) {
+	name, err := req.queueName("QueueUrl")
+	if err != nil {
+		return nil, err
+	}
+	handle, err := req.required("ReceiptHandle")
+	if err != nil {
+		return nil, err
+	}
+	visibility, err := req.visibilityTimeout(true)
+	if err != nil {
+		return nil, err
+	}
+	sub, err := pubsubapi.NewSubscriberClient(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer sub.Close()
+	return nil, sub.ModifyAckDeadline(ctx, &pubsubpb.ModifyAckDeadlineRequest{
+		Subscription:       fmt.Sprintf("projects/%s/subscriptions/%s", setting("GOOGLE_CLOUD_PROJECT"), name),
+		AckIds:             []string{handle},
+		AckDeadlineSeconds: int32(visibility / time.Second),
+	})
+}
+
+// visibilityTimeout returns the VisibilityTimeout parameter, capped to the longest Pub/Sub ack deadline;
+// zero makes the message visible again right away
+func (req *awsRequest) visibilityTimeout(required bool) (time.Duration, error) {
+	s := req.params["VisibilityTimeout"]
+	if s == "" {
+		if required {
+			return 0, awsSenderError("MissingParameter", "the request must contain the parameter VisibilityTimeout")
+		}
+		return 0, nil
+	}
+	secs, err := strconv.Atoi(s)
+	if err != nil || secs < 0 || time.Duration(secs)*time.Second > maxSQSVisibility {
+		return 0, awsSenderError("InvalidParameterValue", "VisibilityTimeout must be from 0 to %d", int(maxSQSVisibility/time.Second))
+	}
+	if d := time.Duration(secs) * time.Second; d < maxPubSubAckDeadline {
+		return d, nil
+	}
+	return maxPubSubAckDeadline, nil
+}
+
+// ensureTopic creates a topic with the labels unless it exists
+func ensureTopic(ctx context.Context, client *pubsub.Client, name string, labels map[string]string) error {
+	exists, err := client.Topic(name).Exists(ctx)
+	if err != nil || exists {
+		return err
+	}
+	return awsThrottled(retryAdmin(ctx, adminOpCreate, func() error {
+		_, err := client.CreateTopicWithConfig(ctx, name, &pubsub.TopicConfig{Labels: withDemoLabels(labels)})
+		return err
+	}))
+}
+
+// checkQueue returns the SQS error for a queue that doesn't exist
+func checkQueue(ctx context.Context, client *pubsub.Client, name string) error {
+	exists, err := client.Subscription(name).Exists(ctx)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return awsSenderError("AWS.SimpleQueueService.NonExistentQueue", "the specified queue %s does not exist", name)
+	}
+	return nil
+}
+
+func md5Hex(data []byte) string {
+	sum := md5.Sum(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// md5OfMessageAttributes computes the digest SQS clients check string message attributes against
+func md5OfMessageAttributes(attrs map[string]string) string {
+	h := md5.New()
+	field := func(s string) {
+		binary.Write(h, binary.BigEndian, uint32(len(s)))
+		h.Write([]byte(s))
+	}
+	for _, key := range sortedKeys(attrs) {
+		field(key)
+		field("String")
+		h.Write([]byte{1}) // string transport type
+		field(attrs[key])
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
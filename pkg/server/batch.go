@@ -0,0 +1,395 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/pubsub"
+	"google.golang.org/api/iterator"
+)
+
+const (
+	// batchWorkers bounds how many resources a batch request creates concurrently
+	batchWorkers   = 8
+	maxBatchLength = 1000
+)
+
+// runBatch calls do for each of n items using at most batchWorkers goroutines,
+// returning the per-item results in item order
+func runBatch(n int, do func(i int) string) []string {
+	results := make([]string, n)
+	items := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < batchWorkers && w < n; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range items {
+				results[i] = do(i)
+			}
+		}()
+	}
+	for i := 0; i < n; i++ {
+		items <- i
+	}
+	close(items)
+	wg.Wait()
+	return results
+}
+
+// readBatch reads a batch request body into specs, a pointer to a slice, after validating
+// its items against itemSchema, responding with an error if that fails
+func readBatch(w http.ResponseWriter, r *http.Request, itemSchema *jsonSchema, specs interface{}) bool {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return false
+	}
+	if err := decodeRequest(body, &jsonSchema{Type: "array", Items: itemSchema}, specs); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return false
+	}
+	// the body is a valid array by now, its items are only counted
+	var items []json.RawMessage
+	json.Unmarshal(body, &items)
+	if len(items) == 0 || len(items) > maxBatchLength {
+		http.Error(w, fmt.Sprintf("a batch must have 1 to %d items", maxBatchLength), http.StatusBadRequest)
+		return false
+	}
+	return true
+}
+
+// batchCreateTopicsHandler handles POST to /topics:batchCreate
+func batchCreateTopicsHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := context.Background()
+	client, ok := newClient(ctx, w)
+	if !ok {
+		return
+	}
+
+	dryRun, ok := dryRunRequested(w, r)
+	if !ok {
+		return
+	}
+
+	// get topic specs from body: '[{"name":"topic-1"}, {"name":"topic-2", "labels":{...}}, ...]'
+	var specs []createTopicRequest
+	if !readBatch(w, r, createTopicSchema, &specs) {
+		return
+	}
+
+	results := runBatch(len(specs), func(i int) string {
+		name := specs[i].Name
+		if err := validateNewResource("topic", name, specs[i].Labels); err != nil {
+			return batchError(err)
+		}
+		if dryRun {
+			return dryRunBatchItem(ctx, "topic", name, client.Topic(name).Exists, client.Topic(name).String())
+		}
+		var topic *pubsub.Topic
+		err := retryAdmin(ctx, adminOpCreate, func() (err error) {
+			topic, err = client.CreateTopicWithConfig(ctx, name, &pubsub.TopicConfig{
+				Labels: withDemoLabels(specs[i].Labels),
+			})
+			return err
+		})
+		if err != nil {
+			return fmt.Sprintf("%s: %s", name, err.Error())
+		}
+		noteResourceChange("created", "topic", name, "")
+		return fmt.Sprintf("created topic %s", topic.String())
+	})
+	for i, res := range results {
+		fmt.Fprintf(w, "[%d] %s\n", i, res)
+	}
+}
+
+var batchSubscriptionSchema = objectSchema(map[string]*jsonSchema{
+	"name":   stringSchema("subscription name"),
+	"topic":  stringSchema("name of the topic to subscribe to"),
+	"labels": stringMapSchema("labels of the subscription, besides those of this service"),
+}, "name", "topic")
+
+// batchCreateSubscriptionsHandler handles POST to /subscriptions:batchCreate
+func batchCreateSubscriptionsHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := context.Background()
+	client, ok := newClient(ctx, w)
+	if !ok {
+		return
+	}
+
+	dryRun, ok := dryRunRequested(w, r)
+	if !ok {
+		return
+	}
+
+	// get subscription specs from body: '[{"name":"subscr-1", "topic":"topic-1", "labels":{...}}, ...]'
+	var specs []struct {
+		Name   string            `json:"name"`
+		Topic  string            `json:"topic"`
+		Labels map[string]string `json:"labels"`
+	}
+	if !readBatch(w, r, batchSubscriptionSchema, &specs) {
+		return
+	}
+
+	results := runBatch(len(specs), func(i int) string {
+		spec := specs[i]
+		if err := validateNewResource("subscription", spec.Name, spec.Labels); err != nil {
+			return batchError(err)
+		}
+		if err := validateResourceName("topic", spec.Topic); err != nil {
+			return err.Error()
+		}
+		cfg := newSubscriptionConfig(client.Topic(spec.Topic))
+		cfg.Labels = withDemoLabels(spec.Labels)
+		if dryRun {
+			if err := checkExists(ctx, "topic", spec.Topic, cfg.Topic.Exists); err != nil {
+				return err.Error()
+			}
+			subscr := client.Subscription(spec.Name)
+			return dryRunBatchItem(ctx, "subscription", spec.Name, subscr.Exists, subscr.String())
+		}
+		var subscr *pubsub.Subscription
+		err := retryAdmin(ctx, adminOpCreate, func() (err error) {
+			subscr, err = client.CreateSubscription(ctx, spec.Name, cfg)
+			return err
+		})
+		if err != nil {
+			return fmt.Sprintf("%s: %s", spec.Name, err.Error())
+		}
+		noteResourceChange("created", "subscription", spec.Name, "")
+		return fmt.Sprintf("created subscription %s", subscr.String())
+	})
+	for i, res := range results {
+		fmt.Fprintf(w, "[%d] %s\n", i, res)
+	}
+}
+
+// dryRunBatchItem returns the result of a batch item a dry run would create
+func dryRunBatchItem(ctx context.Context, kind, name string, exists func(context.Context) (bool, error), resource string) string {
+	ok, err := exists(ctx)
+	switch {
+	case err != nil:
+		return (&lookupError{kind: kind, name: name, err: err}).Error()
+	case ok:
+		return fmt.Sprintf("%s %s already exists", kind, name)
+	}
+	return fmt.Sprintf("would create %s %s (dry run)", kind, resource)
+}
+
+// batchError returns an item's error as its one-line result
+func batchError(err error) string {
+	return strings.ReplaceAll(err.Error(), "\n", " ")
+}
+
+// bulkDeleteTopicsHandler handles DELETE to /topics?match=<pattern>&confirm=true
+func bulkDeleteTopicsHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := context.Background()
+	client, ok := newClient(ctx, w)
+	if !ok {
+		return
+	}
+	pattern, ok := bulkDeletePattern(w, r)
+	if !ok {
+		return
+	}
+
+	if err := waitAdminQuota(ctx, adminOpList); err != nil {
+		writeAdminError(w, err, http.StatusServiceUnavailable)
+		return
+	}
+	var names []string
+	it := client.Topics(ctx)
+	for {
+		t, err := it.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if matched, _ := path.Match(pattern, t.ID()); matched {
+			names = append(names, t.ID())
+		}
+	}
+	trash.Lock()
+	retention := trash.retention
+	trash.Unlock()
+	action := "delete"
+	if retention > 0 {
+		action = "trash"
+	}
+	if !bulkDeleteConfirmed(w, r, action, "topics", names) {
+		return
+	}
+	if !bulkDeleteLosesNothing(w, "topic", names, func(name string) (*deletePlan, error) {
+		return topicDeletePlan(ctx, client.Topic(name))
+	}) {
+		return
+	}
+
+	results := runBatch(len(names), func(i int) string {
+		if retention > 0 {
+			// like a single delete, the topics go to the trash, where they can be restored from
+			t, err := trashTopic(ctx, client, client.Topic(names[i]))
+			if err != nil {
+				return fmt.Sprintf("%s: %s", names[i], err.Error())
+			}
+			forgetTopic(names[i])
+			noteResourceChange("updated", "topic", names[i], "moved to the trash")
+			return fmt.Sprintf("moved topic %s to the trash, detaching %d subscriptions; restore it with POST /trash/%s/restore before %s",
+				names[i], len(t.Subscriptions), names[i], t.TrashedAt.Add(retention).Format(time.RFC3339))
+		}
+		err := retryAdmin(ctx, adminOpDelete, func() error {
+			return client.Topic(names[i]).Delete(ctx)
+		})
+		if err != nil {
+			return fmt.Sprintf("%s: %s", names[i], err.Error())
+		}
+		forgetTopic(names[i])
+		noteResourceChange("deleted", "topic", names[i], "")
+		return fmt.Sprintf("deleted topic %s", names[i])
+	})
+	for i, res := range results {
+		fmt.Fprintf(w, "[%d] %s\n", i, res)
+	}
+}
+
+// bulkDeleteSubscriptionsHandler handles DELETE to /subscriptions?match=<pattern>&confirm=true
+func bulkDeleteSubscriptionsHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := context.Background()
+	client, ok := newClient(ctx, w)
+	if !ok {
+		return
+	}
+	pattern, ok := bulkDeletePattern(w, r)
+	if !ok {
+		return
+	}
+
+	if err := waitAdminQuota(ctx, adminOpList); err != nil {
+		writeAdminError(w, err, http.StatusServiceUnavailable)
+		return
+	}
+	var names []string
+	it := client.Subscriptions(ctx)
+	for {
+		s, err := it.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if matched, _ := path.Match(pattern, s.ID()); matched {
+			names = append(names, s.ID())
+		}
+	}
+	if !bulkDeleteConfirmed(w, r, "delete", "subscriptions", names) {
+		return
+	}
+	if !bulkDeleteLosesNothing(w, "subscription", names, func(name string) (*deletePlan, error) {
+		return subscriptionDeletePlan(ctx, client.Subscription(name)), nil
+	}) {
+		return
+	}
+
+	results := runBatch(len(names), func(i int) string {
+		err := retryAdmin(ctx, adminOpDelete, func() error {
+			return client.Subscription(names[i]).Delete(ctx)
+		})
+		if err != nil {
+			return fmt.Sprintf("%s: %s", names[i], err.Error())
+		}
+		noteResourceChange("deleted", "subscription", names[i], "")
+		return fmt.Sprintf("deleted subscription %s", names[i])
+	})
+	for i, res := range results {
+		fmt.Fprintf(w, "[%d] %s\n", i, res)
+	}
+}
+
+// bulkDeletePattern returns the glob pattern (like "demo-*") of a bulk delete request
+func bulkDeletePattern(w http.ResponseWriter, r *http.Request) (string, bool) {
+	pattern := r.URL.Query().Get("match")
+	if pattern == "" {
+		http.Error(w, "match parameter not provided, e.g. ?match=demo-*", http.StatusBadRequest)
+		return "", false
+	}
+	if _, err := path.Match(pattern, ""); err != nil {
+		http.Error(w, fmt.Sprintf("invalid match pattern %q: %v", pattern, err), http.StatusBadRequest)
+		return "", false
+	}
+	return pattern, true
+}
+
+// bulkDeleteConfirmed checks that a bulk delete request has ?confirm=true; without it,
+// it responds with the resources the action (delete, or trash) would apply to instead
+func bulkDeleteConfirmed(w http.ResponseWriter, r *http.Request, action, kind string, names []string) bool {
+	if len(names) == 0 {
+		fmt.Fprintf(w, "no %s match\n", kind)
+		return false
+	}
+	dryRun, ok := dryRunRequested(w, r)
+	if !ok {
+		return false
+	}
+	if dryRun {
+		writeDryRun(w, fmt.Sprintf("%s these %d %s:", action, len(names), kind), names)
+		return false
+	}
+	if r.URL.Query().Get("confirm") == "true" {
+		return true
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.WriteHeader(http.StatusBadRequest)
+	fmt.Fprintf(w, "add confirm=true to %s these %d %s:\n", action, len(names), kind)
+	for _, name := range names {
+		fmt.Fprintln(w, name)
+	}
+	return false
+}
+
+// bulkDeleteLosesNothing checks, with DELETE_CONFIRMATION=true, that deleting none of the resources
+// of a bulk delete loses data, responding 428 with those whose delete plan does otherwise: they each
+// need a confirmed delete of their own
+func bulkDeleteLosesNothing(w http.ResponseWriter, kind string, names []string, plan func(string) (*deletePlan, error)) bool {
+	if !deleteConfirmationRequired() {
+		return true
+	}
+	var lossy []*deletePlan
+	for _, name := range names {
+		p, err := plan(name)
+		if err != nil {
+			writeAdminError(w, fmt.Errorf("%s %s: %v", kind, name, err), http.StatusInternalServerError)
+			return false
+		}
+		if len(p.losses) > 0 {
+			lossy = append(lossy, p)
+		}
+	}
+	if len(lossy) == 0 {
+		return true
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.WriteHeader(http.StatusPreconditionRequired)
+	fmt.Fprintf(w, "deleting %d of these %ss loses data: delete each with confirm=<token> from GET /%ss/<name>/delete-plan, or narrow the match:\n",
+		len(lossy), kind, kind)
+	for _, p := range lossy {
+		fmt.Fprintln(w, p.name)
+		for _, line := range p.lines {
+			fmt.Fprintf(w, "  %s\n", line)
+		}
+	}
+	return false
+}
@@ -0,0 +1,219 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"google.golang.org/api/option"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+)
+
+// The circuit breaker watches the calls to the Pub/Sub backend. After BREAKER_THRESHOLD consecutive
+// failures it opens: requests fail right away with 503 and Retry-After instead of piling up behind
+// a backend that doesn't answer. After BREAKER_COOLDOWN it lets a single call through, which closes
+// it again if it succeeds.
+
+const (
+	defaultBreakerThreshold = 5
+	defaultBreakerCooldown  = 30 * time.Second
+
+	breakerClosed   = "closed"
+	breakerOpen     = "open"
+	breakerHalfOpen = "half-open"
+
+	breakerStateMetric      = "second_backend_breaker_state"
+	breakerTripsMetric      = "second_backend_breaker_trips_total"
+	breakerFastFailedMetric = "second_backend_fast_failed_total"
+)
+
+var errCircuitOpen = errors.New("the Pub/Sub backend is failing, calls are suspended")
+
+// breaker is the circuit breaker shared by the service's Pub/Sub clients
+var breaker = struct {
+	sync.Mutex
+	threshold int // 0 disables the breaker
+	cooldown  time.Duration
+	state     string
+	failures  int // consecutive
+	openedAt  time.Time
+	probing   bool // a half-open call is in flight
+	lastError string
+}{threshold: defaultBreakerThreshold, cooldown: defaultBreakerCooldown, state: breakerClosed}
+
+// loadBreaker reads BREAKER_THRESHOLD and BREAKER_COOLDOWN
+func loadBreaker() {
+	breaker.Lock()
+	defer breaker.Unlock()
+	breaker.threshold, breaker.cooldown = defaultBreakerThreshold, defaultBreakerCooldown
+	if s := setting("BREAKER_THRESHOLD"); s != "" {
+		if n, err := strconv.Atoi(s); err != nil || n < 0 {
+			log.Printf("breaker: invalid BREAKER_THRESHOLD %q, using %d", s, defaultBreakerThreshold)
+		} else {
+			breaker.threshold = n
+		}
+	}
+	if s := setting("BREAKER_COOLDOWN"); s != "" {
+		if d, err := time.ParseDuration(s); err != nil || d <= 0 {
+			log.Printf("breaker: invalid BREAKER_COOLDOWN %q, using %s", s, defaultBreakerCooldown)
+		} else {
+			breaker.cooldown = d
+		}
+	}
+	setBreakerStateLocked(breaker.state)
+}
+
+// backendOptions returns the client options routing a Pub/Sub client's calls through the breaker,
+// and those of the server's Options
+func backendOptions() []option.ClientOption {
+	return append([]option.ClientOption{option.WithGRPCDialOption(grpc.WithChainUnaryInterceptor(breakerInterceptor))}, clientOptions...)
+}
+
+// breakerInterceptor fails calls while the breaker is open and records the outcome of the others
+func breakerInterceptor(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+	probe, err := breakerAllow()
+	if err != nil {
+		return err
+	}
+	err = invoker(ctx, method, req, reply, cc, opts...)
+	breakerRecord(probe, err, ctx.Err() != nil)
+	return err
+}
+
+// breakerAllow reports whether a call may go ahead, and whether it's the half-open probe
+func breakerAllow() (probe bool, err error) {
+	breaker.Lock()
+	defer breaker.Unlock()
+	switch breaker.state {
+	case breakerOpen:
+		if time.Since(breaker.openedAt) < breaker.cooldown {
+			break
+		}
+		setBreakerStateLocked(breakerHalfOpen)
+		fallthrough
+	case breakerHalfOpen:
+		if !breaker.probing {
+			breaker.probing = true
+			return true, nil
+		}
+	default:
+		return false, nil
+	}
+	counterAdd(breakerFastFailedMetric, "Backend calls failed right away by the open circuit breaker.", 1)
+	return false, errCircuitOpen
+}
+
+// breakerRecord counts a call's outcome: failures of the backend, not those the caller caused
+// or gave up on, trip the breaker
+func breakerRecord(probe bool, err error, canceled bool) {
+	breaker.Lock()
+	defer breaker.Unlock()
+	if probe {
+		breaker.probing = false
+	}
+	if canceled && err != nil {
+		return
+	}
+	if err == nil || !isBackendFailure(err) {
+		breaker.failures = 0
+		if breaker.state != breakerClosed {
+			log.Printf("breaker: backend recovered, closing")
+			setBreakerStateLocked(breakerClosed)
+		}
+		return
+	}
+	breaker.failures++
+	breaker.lastError = err.Error()
+	if breaker.threshold == 0 {
+		return
+	}
+	if probe || (breaker.state == breakerClosed && breaker.failures >= breaker.threshold) {
+		log.Printf("breaker: %d consecutive backend failures, opening for %s: %v", breaker.failures, breaker.cooldown, err)
+		breaker.openedAt = time.Now()
+		setBreakerStateLocked(breakerOpen)
+		counterAdd(breakerTripsMetric, "Times the backend circuit breaker opened.", 1)
+	}
+}
+
+// isBackendFailure reports whether an error means the backend is unwell rather than the request wrong
+func isBackendFailure(err error) bool {
+	st, ok := grpcStatus(err)
+	if !ok {
+		return false
+	}
+	switch st.Code() {
+	case codes.Unavailable, codes.DeadlineExceeded, codes.Internal, codes.Unknown:
+		return true
+	}
+	return false
+}
+
+func setBreakerStateLocked(state string) {
+	breaker.state = state
+	for _, s := range []string{breakerClosed, breakerOpen, breakerHalfOpen} {
+		v := 0.0
+		if s == state {
+			v = 1
+		}
+		gaugeSet(breakerStateMetric, "State of the backend circuit breaker (1 for the current state).", v, "state", s)
+	}
+}
+
+// breakerRetryAfter returns how long until the open breaker lets a call through, 0 if it isn't open
+func breakerRetryAfter() time.Duration {
+	breaker.Lock()
+	defer breaker.Unlock()
+	if breaker.state != breakerOpen {
+		return 0
+	}
+	if d := breaker.cooldown - time.Since(breaker.openedAt); d > 0 {
+		return d
+	}
+	return 0
+}
+
+// writeCircuitOpen responds with 503 and Retry-After if the breaker is open, reporting whether it did
+func writeCircuitOpen(w http.ResponseWriter) bool {
+	d := breakerRetryAfter()
+	if d == 0 {
+		return false
+	}
+	counterAdd(breakerFastFailedMetric, "Backend calls failed right away by the open circuit breaker.", 1)
+	w.Header().Set("Retry-After", strconv.Itoa(int(d/time.Second)+1))
+	http.Error(w, errCircuitOpen.Error(), http.StatusServiceUnavailable)
+	return true
+}
+
+// readyzHandler handles GET to /readyz: 200 while the backend is usable, 503 while the breaker is open
+func readyzHandler(w http.ResponseWriter, r *http.Request) {
+	breaker.Lock()
+	state, failures, lastError := breaker.state, breaker.failures, breaker.lastError
+	breaker.Unlock()
+	if d := breakerRetryAfter(); d > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(int(d/time.Second)+1))
+		w.WriteHeader(http.StatusServiceUnavailable)
+		fmt.Fprintf(w, "not ready: circuit breaker %s after %d consecutive backend failures, retry in %s\n", state, failures, d.Round(time.Second))
+		fmt.Fprintf(w, "last error: %s\n", lastError)
+		return
+	}
+	fmt.Fprintf(w, "ready: circuit breaker %s (%d consecutive backend failures)\n", state, failures)
+}
+
+func breakerSummaries() []string {
+	breaker.Lock()
+	defer breaker.Unlock()
+	if breaker.threshold == 0 {
+		return []string{"disabled"}
+	}
+	s := fmt.Sprintf("%s: %d consecutive failures, threshold %d, cooldown %s", breaker.state, breaker.failures, breaker.threshold, breaker.cooldown)
+	if breaker.lastError != "" {
+		s += ", last error: " + breaker.lastError
+	}
+	return []string{s}
+}
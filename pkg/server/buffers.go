@@ -0,0 +1,172 @@
+package server
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/pubsub"
+)
+
+// The in-memory buffers are bounded, so that a forgotten consumer or a flood of delayed messages
+// can't exhaust the service's memory: CONSUMER_BUFFER_LIMITS bounds each warm session's buffer and
+// message log, DELAY_QUEUE_LIMITS the delay queue, ROUTE_BUFFER_LIMITS the messages each route is
+// republishing (failed ones are nacked and retried by redelivery), TAIL_BUFFER_LIMITS the messages
+// each tail or tap is yet to write, each as comma-separated limits like
+// messages=1000,bytes=10MiB,age=1h,policy=drop-oldest. Beyond the messages or bytes limit, the
+// drop-oldest policy drops the oldest messages to make room, reject refuses new ones; messages
+// older than age are dropped either way. Routes and tails receive through streaming pulls that
+// pause at their limits instead, leaving the messages in the subscription, so the policy doesn't
+// apply to them. Drops are counted in second_buffer_dropped_messages_total.
+
+const (
+	bufferPolicyDropOldest = "drop-oldest"
+	bufferPolicyReject     = "reject"
+
+	bufferDroppedMetric  = "second_buffer_dropped_messages_total"
+	bufferMessagesMetric = "second_buffer_messages"
+	bufferBytesMetric    = "second_buffer_bytes"
+
+	consumerBuffer    = "consumer"     // the warm sessions' buffers, returned to the subscription when dropped
+	consumerLogBuffer = "consumer-log" // the messages they retain for viewers
+	delayBuffer       = "delay-queue"
+	routeBuffer       = "route"
+	tailBuffer        = "tail"
+)
+
+// bufferLimits bound an in-memory buffer of messages; zero limits are unlimited
+type bufferLimits struct {
+	messages int
+	bytes    int
+	age      time.Duration
+	policy   string
+}
+
+// bufferDefaults are the limits of each buffer, and the variable overriding them
+var bufferDefaults = map[string]struct {
+	env    string
+	limits bufferLimits
+}{
+	consumerBuffer: {"CONSUMER_BUFFER_LIMITS", bufferLimits{messages: 1000, bytes: maxWarmBufferedBytes, age: time.Hour, policy: bufferPolicyDropOldest}},
+	delayBuffer:    {"DELAY_QUEUE_LIMITS", bufferLimits{messages: 10000, bytes: 64 << 20, policy: bufferPolicyReject}},
+	routeBuffer:    {"ROUTE_BUFFER_LIMITS", bufferLimits{messages: 1000, bytes: 64 << 20, age: 10 * time.Minute, policy: bufferPolicyReject}},
+	tailBuffer:     {"TAIL_BUFFER_LIMITS", bufferLimits{messages: 1000, bytes: 10 << 20, age: time.Minute, policy: bufferPolicyReject}},
+}
+
+// loadBufferLimits returns the limits of a buffer, its defaults overridden by its variable;
+// invalid entries are logged and ignored
+func loadBufferLimits(buffer string) bufferLimits {
+	def := bufferDefaults[buffer]
+	limits := def.limits
+	s := setting(def.env)
+	if s == "" {
+		return limits
+	}
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		i := strings.Index(part, "=")
+		if i < 0 {
+			log.Printf("buffers: invalid %s entry %q (ignored)", def.env, part)
+			continue
+		}
+		key, value := part[:i], part[i+1:]
+		var n int
+		var err error
+		switch key {
+		case "messages":
+			if n, err = strconv.Atoi(value); err == nil && n >= 0 {
+				limits.messages = n
+			}
+		case "bytes":
+			if n, err = parseByteSize(value); err == nil && n >= 0 {
+				limits.bytes = n
+			}
+		case "age":
+			var d time.Duration
+			if d, err = time.ParseDuration(value); err == nil && d >= 0 {
+				limits.age = d
+			}
+			n = int(d)
+		case "policy":
+			if value != bufferPolicyDropOldest && value != bufferPolicyReject {
+				err = fmt.Errorf("must be %s or %s", bufferPolicyDropOldest, bufferPolicyReject)
+			}
+			if err == nil {
+				limits.policy = value
+			}
+		default:
+			err = fmt.Errorf("unknown limit")
+		}
+		if err != nil || n < 0 {
+			log.Printf("buffers: invalid %s entry %q (ignored)", def.env, part)
+		}
+	}
+	return limits
+}
+
+// parseByteSize parses a size in bytes, optionally with a KiB, MiB or GiB suffix
+func parseByteSize(s string) (int, error) {
+	mult := 1
+	for suffix, m := range map[string]int{"KiB": 1 << 10, "MiB": 1 << 20, "GiB": 1 << 30} {
+		if strings.HasSuffix(s, suffix) {
+			s, mult = strings.TrimSuffix(s, suffix), m
+			break
+		}
+	}
+	n, err := strconv.Atoi(s)
+	return n * mult, err
+}
+
+// full reports whether a buffer of the messages and bytes has no room for a message of size bytes
+func (l bufferLimits) full(messages, bytes, size int) bool {
+	return (l.messages > 0 && messages+1 > l.messages) || (l.bytes > 0 && bytes+size > l.bytes)
+}
+
+// applyTo bounds the streaming pull of the subscription by the messages and bytes limits
+func (l bufferLimits) applyTo(subscr *pubsub.Subscription) {
+	subscr.ReceiveSettings.MaxOutstandingMessages = l.messages
+	subscr.ReceiveSettings.MaxOutstandingBytes = l.bytes
+	if l.messages == 0 {
+		subscr.ReceiveSettings.MaxOutstandingMessages = -1 // no limit
+	}
+	if l.bytes == 0 {
+		subscr.ReceiveSettings.MaxOutstandingBytes = -1
+	}
+}
+
+// expired reports whether a message buffered at the time is beyond the age limit
+func (l bufferLimits) expired(at time.Time) bool {
+	return l.age > 0 && time.Since(at) > l.age
+}
+
+func (l bufferLimits) String() string {
+	limit := func(n int) string {
+		if n == 0 {
+			return "unlimited"
+		}
+		return strconv.Itoa(n)
+	}
+	age := "unlimited"
+	if l.age > 0 {
+		age = l.age.String()
+	}
+	return fmt.Sprintf("messages=%s bytes=%s age=%s policy=%s", limit(l.messages), limit(l.bytes), age, l.policy)
+}
+
+// recordBufferDrops counts messages dropped from a buffer, for the reason: age, full (dropped to
+// make room) or rejected
+func recordBufferDrops(buffer, reason string, n int) {
+	if n == 0 {
+		return
+	}
+	counterAdd(bufferDroppedMetric, "Messages dropped from in-memory buffers, by buffer and reason (age, full or rejected).",
+		float64(n), "buffer", buffer, "reason", reason)
+}
+
+// recordBufferSize records the messages and bytes held by a buffer
+func recordBufferSize(buffer string, messages, bytes int) {
+	gaugeSet(bufferMessagesMetric, "Messages held by in-memory buffers, by buffer.", float64(messages), "buffer", buffer)
+	gaugeSet(bufferBytesMetric, "Bytes held by in-memory buffers, by buffer.", float64(bytes), "buffer", buffer)
+}
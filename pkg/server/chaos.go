@@ -0,0 +1,180 @@
+package server
+
+import (
+	"fmt"
+	"math/rand"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// chaosConfig describes the faults injected in chaos mode; faults only ever affect this
+// service's own behaviour (responses, route processing), never the data stored in Pub/Sub
+type chaosConfig struct {
+	Enabled       bool    `json:"enabled"`
+	Latency       string  `json:"latency,omitempty"`
+	Jitter        string  `json:"jitter,omitempty"`
+	ErrorRate     float64 `json:"errorRate,omitempty"`
+	DuplicateRate float64 `json:"duplicateRate,omitempty"`
+	PathPrefix    string  `json:"pathPrefix,omitempty"`
+
+	latency time.Duration
+	jitter  time.Duration
+}
+
+var chaosSchema = objectSchema(map[string]*jsonSchema{
+	"enabled":       booleanSchema("inject faults"),
+	"latency":       stringSchema("latency added to requests, like \"200ms\""),
+	"jitter":        stringSchema("random latency added on top, up to this duration"),
+	"errorRate":     numberSchema("share of requests failing with 503, from 0 to 1", false, 0),
+	"duplicateRate": numberSchema("share of received messages delivered twice, from 0 to 1", false, 0),
+	"pathPrefix":    stringSchema("path prefix of the requests faults are injected into"),
+})
+
+var chaos = struct {
+	sync.Mutex
+	cfg chaosConfig
+}{}
+
+func init() {
+	rand.Seed(time.Now().UnixNano())
+}
+
+// chaosModeAllowed reports whether /debug/chaos may be used, which requires CHAOS_MODE=true
+func chaosModeAllowed() bool {
+	return setting("CHAOS_MODE") == "true"
+}
+
+// getChaosHandler handles GET to /debug/chaos
+func getChaosHandler(w http.ResponseWriter, r *http.Request) {
+	if !chaosModeAllowed() {
+		http.NotFound(w, r)
+		return
+	}
+	chaos.Lock()
+	cfg := chaos.cfg
+	chaos.Unlock()
+	fmt.Fprintln(w, cfg.String())
+}
+
+// putChaosHandler handles PUT to /debug/chaos
+func putChaosHandler(w http.ResponseWriter, r *http.Request) {
+	if !chaosModeAllowed() {
+		http.NotFound(w, r)
+		return
+	}
+	// get fault settings from body:
+	// '{"enabled":true, "latency":"200ms", "jitter":"100ms", "errorRate":0.1, "duplicateRate":0.05, "pathPrefix":"/subscriptions"}'
+	var cfg chaosConfig
+	if !readRequest(w, r, chaosSchema, &cfg) {
+		return
+	}
+	if err := cfg.validate(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	chaos.Lock()
+	chaos.cfg = cfg
+	chaos.Unlock()
+	fmt.Fprintln(w, cfg.String())
+}
+
+// deleteChaosHandler handles DELETE to /debug/chaos
+func deleteChaosHandler(w http.ResponseWriter, r *http.Request) {
+	if !chaosModeAllowed() {
+		http.NotFound(w, r)
+		return
+	}
+	chaos.Lock()
+	chaos.cfg = chaosConfig{}
+	chaos.Unlock()
+	fmt.Fprintln(w, "chaos disabled")
+}
+
+// validate checks the settings and parses the durations
+func (cfg *chaosConfig) validate() error {
+	var err error
+	if cfg.Latency != "" {
+		if cfg.latency, err = time.ParseDuration(cfg.Latency); err != nil || cfg.latency < 0 {
+			return fmt.Errorf("latency must be a non-negative duration")
+		}
+	}
+	if cfg.Jitter != "" {
+		if cfg.jitter, err = time.ParseDuration(cfg.Jitter); err != nil || cfg.jitter < 0 {
+			return fmt.Errorf("jitter must be a non-negative duration")
+		}
+	}
+	if cfg.ErrorRate < 0 || cfg.ErrorRate > 1 {
+		return fmt.Errorf("errorRate must be between 0 and 1")
+	}
+	if cfg.DuplicateRate < 0 || cfg.DuplicateRate > 1 {
+		return fmt.Errorf("duplicateRate must be between 0 and 1")
+	}
+	return nil
+}
+
+// String describes the settings
+func (cfg chaosConfig) String() string {
+	if !cfg.Enabled {
+		return "chaos disabled"
+	}
+	prefix := cfg.PathPrefix
+	if prefix == "" {
+		prefix = "/"
+	}
+	return fmt.Sprintf("chaos enabled: latency=%s jitter=%s errorRate=%g duplicateRate=%g pathPrefix=%s",
+		cfg.latency, cfg.jitter, cfg.ErrorRate, cfg.DuplicateRate, prefix)
+}
+
+// chaosMiddleware injects latency and errors into requests matching the chaos settings
+func chaosMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// never interfere with turning chaos off again
+		if !strings.HasPrefix(r.URL.Path, "/debug/") {
+			chaos.Lock()
+			cfg := chaos.cfg
+			chaos.Unlock()
+			if cfg.Enabled && strings.HasPrefix(r.URL.Path, cfg.PathPrefix) {
+				if err := cfg.inject(); err != nil {
+					http.Error(w, err.Error(), http.StatusServiceUnavailable)
+					return
+				}
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// chaosFault injects latency and errors into background processing, e.g. of routes
+func chaosFault() error {
+	chaos.Lock()
+	cfg := chaos.cfg
+	chaos.Unlock()
+	if !cfg.Enabled {
+		return nil
+	}
+	return cfg.inject()
+}
+
+// chaosDuplicate reports whether a received message should be delivered to the client twice
+func chaosDuplicate() bool {
+	chaos.Lock()
+	defer chaos.Unlock()
+	return chaos.cfg.Enabled && rand.Float64() < chaos.cfg.DuplicateRate
+}
+
+// inject sleeps for the configured latency and returns an error at the configured rate
+func (cfg chaosConfig) inject() error {
+	d := cfg.latency
+	if cfg.jitter > 0 {
+		d += time.Duration(rand.Int63n(int64(cfg.jitter)))
+	}
+	if d > 0 {
+		time.Sleep(d)
+	}
+	if rand.Float64() < cfg.ErrorRate {
+		return fmt.Errorf("chaos: injected error")
+	}
+	return nil
+}
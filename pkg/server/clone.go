@@ -0,0 +1,187 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"cloud.google.com/go/pubsub"
+	"google.golang.org/api/iterator"
+)
+
+// subscriptionCloneRequest is the body of POST /subscriptions/<subscription-name>/clone
+type subscriptionCloneRequest struct {
+	NewName        string `json:"newName"`
+	SeekToSnapshot bool   `json:"seekToSnapshot"`
+}
+
+var subscriptionCloneSchema = objectSchema(map[string]*jsonSchema{
+	"newName":        stringSchema("name of the new subscription"),
+	"seekToSnapshot": booleanSchema("whether the clone starts from a snapshot of the source's backlog"),
+}, "newName")
+
+// subscriptionCloneHandler handles POST to /subscriptions/<subscription-name>/clone,
+// creating a new subscription with the same configuration as the source subscription
+func subscriptionCloneHandler(ctx context.Context, w http.ResponseWriter, r *http.Request, client *pubsub.Client, subscr *pubsub.Subscription) {
+	// get clone details from body:
+	// '{"newName":"my-subscription-copy", "seekToSnapshot":true}'
+	var req subscriptionCloneRequest
+	if !readRequest(w, r, subscriptionCloneSchema, &req) {
+		return
+	}
+	newName, seek := req.NewName, req.SeekToSnapshot
+	if err := validateResourceName("subscription", newName); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	cfg, err := subscr.Config(ctx)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	cfg.Labels = withDemoLabels(cfg.Labels)
+	if err := checkNamingPolicy("subscription", newName, cfg.Labels); err != nil {
+		writeCreateError(w, err)
+		return
+	}
+	if cfg.Detached {
+		http.Error(w, fmt.Sprintf("subscription %s is detached from its topic", subscr.ID()), http.StatusConflict)
+		return
+	}
+
+	// snapshot the source first, so the clone can start from the same backlog
+	var snapshot *pubsub.SnapshotConfig
+	if seek {
+		snapshot, err = subscr.CreateSnapshot(ctx, "")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		defer snapshot.Delete(ctx)
+	}
+
+	clone, err := client.CreateSubscription(ctx, newName, cfg)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	noteResourceChange("created", "subscription", clone.ID(), "clone of "+subscr.ID())
+	fmt.Fprintf(w, "created subscription %s as a clone of %s\n", clone.String(), subscr.String())
+
+	if snapshot != nil {
+		if err := clone.SeekToSnapshot(ctx, snapshot.Snapshot); err != nil {
+			fmt.Fprintf(w, "seeking to snapshot of %s: %v\n", subscr.ID(), err)
+			return
+		}
+		fmt.Fprintf(w, "seeked %s to a snapshot of %s\n", clone.ID(), subscr.ID())
+	}
+}
+
+// topicCloneRequest is the body of POST /topics/<topic-name>/clone
+type topicCloneRequest struct {
+	NewName           string            `json:"newName"`
+	WithSubscriptions bool              `json:"withSubscriptions"`
+	SubscriptionNames map[string]string `json:"subscriptionNames"`
+}
+
+var topicCloneSchema = objectSchema(map[string]*jsonSchema{
+	"newName":           stringSchema("name of the new topic"),
+	"withSubscriptions": booleanSchema("whether the topic's subscriptions are recreated on the new topic"),
+	"subscriptionNames": stringMapSchema("names of the recreated subscriptions, by source subscription"),
+}, "newName")
+
+// topicCloneHandler handles POST to /topics/<topic-name>/clone, creating a new topic with the
+// same configuration and optionally recreating the topic's subscriptions on the new topic
+func topicCloneHandler(ctx context.Context, w http.ResponseWriter, r *http.Request, client *pubsub.Client, topic *pubsub.Topic) {
+	// get clone details from body:
+	// '{"newName":"my-topic-v2", "withSubscriptions":true, "subscriptionNames":{"old-subscr":"new-subscr"}}'
+	var req topicCloneRequest
+	if !readRequest(w, r, topicCloneSchema, &req) {
+		return
+	}
+	newName, withSubscrs := req.NewName, req.WithSubscriptions
+	if err := validateResourceName("topic", newName); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	subscrNames := map[string]string{}
+	for from, to := range req.SubscriptionNames {
+		if err := validateResourceName("subscription", to); err != nil {
+			http.Error(w, fmt.Sprintf("subscriptionNames.%s: %v", from, err), http.StatusBadRequest)
+			return
+		}
+		subscrNames[from] = to
+	}
+
+	cfg, err := topic.Config(ctx)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	cfg.Labels = withDemoLabels(cfg.Labels)
+	if err := checkNamingPolicy("topic", newName, cfg.Labels); err != nil {
+		writeCreateError(w, err)
+		return
+	}
+	// collect the subscriptions before creating anything, so a listing error leaves no partial clone
+	var subscrCfgs []pubsub.SubscriptionConfig
+	if withSubscrs {
+		it := topic.Subscriptions(ctx)
+		for {
+			s, err := it.Next()
+			if err == iterator.Done {
+				break
+			}
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			sc, err := s.Config(ctx)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			subscrCfgs = append(subscrCfgs, sc)
+		}
+	}
+
+	clone, err := client.CreateTopicWithConfig(ctx, newName, &cfg)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	noteResourceChange("created", "topic", clone.ID(), "clone of "+topic.ID())
+	fmt.Fprintf(w, "created topic %s as a clone of %s\n", clone.String(), topic.String())
+
+	for i, sc := range subscrCfgs {
+		oldName := sc.ID()
+		name, ok := subscrNames[oldName]
+		if !ok {
+			name = clonedSubscriptionName(oldName, topic.ID(), newName)
+		}
+		sc.Labels = withDemoLabels(sc.Labels)
+		if err := validateNewResource("subscription", name, sc.Labels); err != nil {
+			fmt.Fprintf(w, "[%d] %s: %s\n", i, oldName, batchError(err))
+			continue
+		}
+		sc.Topic = clone
+		s, err := client.CreateSubscription(ctx, name, sc)
+		if err != nil {
+			fmt.Fprintf(w, "[%d] %s: %s\n", i, oldName, err.Error())
+			continue
+		}
+		noteResourceChange("created", "subscription", s.ID(), "clone of "+oldName)
+		fmt.Fprintf(w, "[%d] created subscription %s as a clone of %s\n", i, s.String(), oldName)
+	}
+}
+
+// clonedSubscriptionName derives the name of a subscription recreated on a cloned topic:
+// the old topic name is replaced by the new one if it is part of the name, otherwise it is appended
+func clonedSubscriptionName(subscrName, oldTopicName, newTopicName string) string {
+	if strings.Contains(subscrName, oldTopicName) {
+		return strings.Replace(subscrName, oldTopicName, newTopicName, 1)
+	}
+	return subscrName + "-" + newTopicName
+}
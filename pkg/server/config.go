@@ -0,0 +1,262 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/firestore"
+)
+
+// Routes, ingest routes and publish API keys can be kept in Firestore, one document per route or
+// key, in the collections <FIRESTORE_CONFIG_PREFIX>-routes, -ingest and -keys. The service watches
+// them and applies changes as they're made, so the configuration changes without a redeploy. A
+// document's ID is the name of the route (or the principal of the key), and its fields are those of
+// the PUT /routes and PUT /ingest payloads and of the PUBLISH_POLICY_FILE grants.
+
+const (
+	configRetryInterval = 10 * time.Second
+
+	configChangesMetric = "second_config_changes_total"
+)
+
+// configCollection is a watched Firestore collection, with the documents applied from it
+type configCollection struct {
+	name    string
+	apply   func(id string, doc *firestore.DocumentSnapshot) error // doc is nil when removed
+	applied map[string]time.Time                                   // update time of each applied document
+
+	mu         sync.Mutex
+	documents  int
+	lastChange time.Time
+	lastError  string
+}
+
+var configCollections = struct {
+	sync.Mutex
+	list []*configCollection
+}{}
+
+// startConfigWatch watches the configuration collections if FIRESTORE_CONFIG_PREFIX is set
+func startConfigWatch() {
+	prefix := setting("FIRESTORE_CONFIG_PREFIX")
+	if prefix == "" {
+		return
+	}
+	projectID := setting("GOOGLE_CLOUD_PROJECT")
+	if projectID == "" {
+		log.Printf("config: failed to get project ID (Firestore configuration disabled)")
+		return
+	}
+	client, err := firestore.NewClient(context.Background(), projectID)
+	if err != nil {
+		log.Printf("config: %v (Firestore configuration disabled)", err)
+		return
+	}
+	configCollections.Lock()
+	defer configCollections.Unlock()
+	configCollections.list = []*configCollection{
+		{name: prefix + "-routes", apply: applyRouteConfig},
+		{name: prefix + "-ingest", apply: applyIngestConfig},
+		{name: prefix + "-keys", apply: applyKeyConfig},
+	}
+	for _, c := range configCollections.list {
+		c.applied = map[string]time.Time{}
+		go c.watch(client)
+	}
+	log.Printf("Watching configuration in Firestore collections %s-*", prefix)
+}
+
+// watch applies the collection's documents, then their changes, resuming after errors
+func (c *configCollection) watch(client *firestore.Client) {
+	for {
+		it := client.Collection(c.name).Snapshots(context.Background())
+		for {
+			snap, err := it.Next()
+			if err == nil {
+				err = c.reconcile(snap)
+			}
+			if err != nil {
+				log.Printf("config: %s: %v", c.name, err)
+				c.mu.Lock()
+				c.lastError = err.Error()
+				c.mu.Unlock()
+				break
+			}
+		}
+		it.Stop()
+		time.Sleep(configRetryInterval)
+	}
+}
+
+// reconcile applies the documents added or changed since the last snapshot and removes those
+// deleted; comparing whole snapshots rather than following changes also catches up with the
+// changes made while the watch was interrupted
+func (c *configCollection) reconcile(snap *firestore.QuerySnapshot) error {
+	docs, err := snap.Documents.GetAll()
+	if err != nil {
+		return err
+	}
+	seen := map[string]bool{}
+	changed := 0
+	for _, doc := range docs {
+		id := doc.Ref.ID
+		seen[id] = true
+		if at, ok := c.applied[id]; ok && at.Equal(doc.UpdateTime) {
+			continue
+		}
+		changed++
+		c.applied[id] = doc.UpdateTime
+		if err := c.apply(id, doc); err != nil {
+			log.Printf("config: %s/%s: %v", c.name, id, err)
+			c.mu.Lock()
+			c.lastError = fmt.Sprintf("%s: %v", id, err)
+			c.mu.Unlock()
+		}
+	}
+	for id := range c.applied {
+		if seen[id] {
+			continue
+		}
+		changed++
+		delete(c.applied, id)
+		if err := c.apply(id, nil); err != nil {
+			log.Printf("config: %s/%s: %v", c.name, id, err)
+		}
+	}
+	c.mu.Lock()
+	c.documents = len(docs)
+	if changed > 0 {
+		c.lastChange = time.Now()
+		counterAdd(configChangesMetric, "Configuration documents applied from Firestore, by collection.", float64(changed), "collection", c.name)
+	}
+	c.mu.Unlock()
+	return nil
+}
+
+// decodeConfigDocument decodes a document's fields like the JSON payload of the same object
+func decodeConfigDocument(doc *firestore.DocumentSnapshot, v interface{}) error {
+	data, err := json.Marshal(doc.Data())
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// applyRouteConfig replaces the route named by the document, or stops it when the document is removed
+func applyRouteConfig(name string, doc *firestore.DocumentSnapshot) error {
+	routers.Lock()
+	old := routers.m[name]
+	delete(routers.m, name)
+	routers.Unlock()
+	if old != nil {
+		old.stop()
+		log.Printf("config: stopped route %s", name)
+	}
+	// the route now belongs to Firestore, not to the state store
+	stateDelete(routesBucket, name)
+	if doc == nil {
+		return nil
+	}
+
+	var spec routeSpec
+	if err := decodeConfigDocument(doc, &spec); err != nil {
+		return err
+	}
+	spec.Name = name
+	rt := spec.router()
+	if err := rt.validate(); err != nil {
+		return err
+	}
+	routers.Lock()
+	if _, ok := routers.m[name]; ok {
+		routers.Unlock()
+		return fmt.Errorf("route %s was created meanwhile", name)
+	}
+	routers.m[name] = rt
+	routers.Unlock()
+	if err := rt.start(); err != nil {
+		routers.Lock()
+		delete(routers.m, name)
+		routers.Unlock()
+		return err
+	}
+	log.Printf("config: started route %s", name)
+	return nil
+}
+
+// applyIngestConfig replaces the ingest route named by the document, or deletes it when the
+// document is removed
+func applyIngestConfig(name string, doc *firestore.DocumentSnapshot) error {
+	if doc == nil {
+		ingestRoutes.Lock()
+		delete(ingestRoutes.m, name)
+		ingestRoutes.Unlock()
+		return nil
+	}
+	var req struct {
+		Topic     string           `json:"topic"`
+		Signature *ingestSignature `json:"signature"`
+	}
+	if err := decodeConfigDocument(doc, &req); err != nil {
+		return err
+	}
+	ir, err := newIngestRoute(name, req.Topic, req.Signature)
+	if err != nil {
+		return err
+	}
+	ingestRoutes.Lock()
+	ingestRoutes.m[name] = ir
+	ingestRoutes.Unlock()
+	return nil
+}
+
+// applyKeyConfig replaces the publish grant of the document, or revokes it when the document is
+// removed; the first grant turns the publish policy on, and revoking grants never turns it off
+func applyKeyConfig(id string, doc *firestore.DocumentSnapshot) error {
+	publishPolicy.Lock()
+	delete(publishPolicy.configured, id)
+	publishPolicy.Unlock()
+	if doc == nil {
+		return nil
+	}
+	g := &publishGrant{}
+	if err := decodeConfigDocument(doc, g); err != nil {
+		return err
+	}
+	if g.Principal == "" {
+		g.Principal = id
+	}
+	if err := g.validate(); err != nil {
+		return err
+	}
+	publishPolicy.Lock()
+	publishPolicy.configured[id] = g
+	publishPolicy.enforced = true
+	publishPolicy.Unlock()
+	return nil
+}
+
+func configSummaries() []string {
+	configCollections.Lock()
+	defer configCollections.Unlock()
+	var list []string
+	for _, c := range configCollections.list {
+		c.mu.Lock()
+		s := fmt.Sprintf("%s: %d documents", c.name, c.documents)
+		if !c.lastChange.IsZero() {
+			s += ", last change applied " + c.lastChange.Format(time.RFC3339)
+		}
+		if c.lastError != "" {
+			s += ", last error: " + c.lastError
+		}
+		c.mu.Unlock()
+		list = append(list, s)
+	}
+	sort.Strings(list)
+	return list
+}
@@ -0,0 +1,398 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/pubsub"
+)
+
+// The warm sessions (see warm.go) are the service's long-lived consumers: GET /consumers lists
+// them and GET /consumers/<session-id>/stats shows a session's flow control at work, the messages
+// and bytes outstanding against its limits and whether receiving is paused because they're reached.
+// GET /consumers/<session-id>/messages reads the messages a session received, each numbered by an
+// increasing offset, without taking them from its buffer: viewers page through them independently
+// with after=<offset>, at their own pace, as long as the session retains them.
+// POST /consumers opens one with its concurrency settings, the goroutines of its streaming pull
+// and the messages handed to its handler at once (received and not settled yet), and
+// PATCH /consumers/<session-id> changes them live, restarting the streaming pull.
+
+const (
+	maxConsumerGoroutines  = 64
+	maxConsumerConcurrency = 1000
+
+	// maxConsumerMessagesLimit is the most messages GET /consumers/<session-id>/messages returns
+	maxConsumerMessagesLimit     = 1000
+	defaultConsumerMessagesLimit = 100
+)
+
+// consumerMessage is a message received by a warm session, at its offset
+type consumerMessage struct {
+	offset   int64
+	received time.Time
+	msg      *pubsub.Message
+}
+
+// consumerLog retains the messages received by a warm session within the CONSUMER_BUFFER_LIMITS
+// (see buffers.go), guarded by its mutex; offsets start at 1
+type consumerLog struct {
+	entries []consumerMessage // oldest first
+	bytes   int
+	last    int64 // offset of the last message received
+}
+
+// add numbers a message received and retains it, unless the limits reject it
+func (l *consumerLog) add(msg *pubsub.Message, limits bufferLimits) consumerMessage {
+	l.last++
+	m := consumerMessage{offset: l.last, received: time.Now(), msg: msg}
+	l.expire(limits)
+	dropped := 0
+	for len(l.entries) > 0 && limits.policy == bufferPolicyDropOldest && limits.full(len(l.entries), l.bytes, len(msg.Data)) {
+		l.bytes -= len(l.entries[0].msg.Data)
+		l.entries = l.entries[1:]
+		dropped++
+	}
+	recordBufferDrops(consumerLogBuffer, "full", dropped)
+	if limits.full(len(l.entries), l.bytes, len(msg.Data)) {
+		recordBufferDrops(consumerLogBuffer, "rejected", 1)
+		return m
+	}
+	l.entries = append(l.entries, m)
+	l.bytes += len(msg.Data)
+	return m
+}
+
+// expire drops the messages beyond the age limit
+func (l *consumerLog) expire(limits bufferLimits) {
+	n := 0
+	for n < len(l.entries) && limits.expired(l.entries[n].received) {
+		l.bytes -= len(l.entries[n].msg.Data)
+		n++
+	}
+	l.entries = l.entries[n:]
+	recordBufferDrops(consumerLogBuffer, "age", n)
+}
+
+// after returns up to limit messages following the offset
+func (l *consumerLog) after(offset int64, limit int) []consumerMessage {
+	i := sort.Search(len(l.entries), func(i int) bool { return l.entries[i].offset > offset })
+	entries := l.entries[i:]
+	if len(entries) > limit {
+		entries = entries[:limit]
+	}
+	return append([]consumerMessage(nil), entries...)
+}
+
+// first returns the offset of the oldest message retained, that of the next message if none is
+func (l *consumerLog) first() int64 {
+	if len(l.entries) == 0 {
+		return l.last + 1
+	}
+	return l.entries[0].offset
+}
+
+// consumerSettings are the concurrency settings of a warm session
+type consumerSettings struct {
+	NumGoroutines  int `json:"numGoroutines"`  // of the streaming pull
+	MaxConcurrency int `json:"maxConcurrency"` // messages handled at once, its MaxOutstandingMessages
+}
+
+// defaultConsumerSettings are the settings of the warm sessions opened with ?warm=true
+func defaultConsumerSettings() consumerSettings {
+	return consumerSettings{NumGoroutines: pubsub.DefaultReceiveSettings.NumGoroutines, MaxConcurrency: maxWarmBuffered}
+}
+
+// check responds 400 to settings out of bounds, returning false
+func (c consumerSettings) check(w http.ResponseWriter) bool {
+	if c.NumGoroutines < 1 || c.NumGoroutines > maxConsumerGoroutines {
+		http.Error(w, fmt.Sprintf("numGoroutines must be between 1 and %d", maxConsumerGoroutines), http.StatusBadRequest)
+		return false
+	}
+	if c.MaxConcurrency < 1 || c.MaxConcurrency > maxConsumerConcurrency {
+		http.Error(w, fmt.Sprintf("maxConcurrency must be between 1 and %d", maxConsumerConcurrency), http.StatusBadRequest)
+		return false
+	}
+	return true
+}
+
+func (c consumerSettings) String() string {
+	return fmt.Sprintf("numGoroutines=%d maxConcurrency=%d", c.NumGoroutines, c.MaxConcurrency)
+}
+
+var consumerSettingsSchema = map[string]*jsonSchema{
+	"numGoroutines":  numberSchema(fmt.Sprintf("goroutines of the streaming pull, at most %d", maxConsumerGoroutines), true, 1),
+	"maxConcurrency": numberSchema(fmt.Sprintf("messages handled at once (received and not settled yet), at most %d", maxConsumerConcurrency), true, 1),
+}
+
+// consumerUpdates serializes the restarts of warm sessions for new settings
+var consumerUpdates sync.Mutex
+
+var (
+	createConsumerSchema = objectSchema(map[string]*jsonSchema{
+		"subscription":   stringSchema("subscription to receive from"),
+		"numGoroutines":  consumerSettingsSchema["numGoroutines"],
+		"maxConcurrency": consumerSettingsSchema["maxConcurrency"],
+	}, "subscription")
+	updateConsumerSchema = objectSchema(consumerSettingsSchema)
+)
+
+// consumerStats are the flow control statistics of a warm session, guarded by its mutex
+type consumerStats struct {
+	opened           time.Time
+	received         int // messages received by the streaming pull
+	pulls            int // pulls by clients
+	outstanding      int // messages received but not settled yet
+	outstandingBytes int
+	peakOutstanding  int
+	peakBytes        int
+	paused           bool // the outstanding messages or bytes reached the limits
+	pausedSince      time.Time
+	pauses           int
+	pausedTotal      time.Duration // excluding the current pause
+	restarts         int           // of the streaming pull, for new settings
+}
+
+// update recomputes the statistics for the messages now buffered, of at most maxMessages
+func (c *consumerStats) update(buffered []consumerMessage, maxMessages, maxBytes int) {
+	c.outstanding, c.outstandingBytes = len(buffered), 0
+	for _, m := range buffered {
+		c.outstandingBytes += len(m.msg.Data)
+	}
+	if c.outstanding > c.peakOutstanding {
+		c.peakOutstanding = c.outstanding
+	}
+	if c.outstandingBytes > c.peakBytes {
+		c.peakBytes = c.outstandingBytes
+	}
+	paused := c.outstanding >= maxMessages || (maxBytes > 0 && c.outstandingBytes >= maxBytes)
+	switch {
+	case paused && !c.paused:
+		c.pauses++
+		c.pausedSince = time.Now()
+	case !paused && c.paused:
+		c.pausedTotal += time.Since(c.pausedSince)
+	}
+	c.paused = paused
+}
+
+// state describes whether the session is receiving
+func (c *consumerStats) state() string {
+	if c.paused {
+		return fmt.Sprintf("paused for %s (flow control limit reached)", time.Since(c.pausedSince).Round(time.Millisecond))
+	}
+	return "receiving"
+}
+
+// lookupConsumer returns the warm session with the given ID if the request may see it
+func lookupConsumer(r *http.Request, id string) *warmSession {
+	warmSessions.Lock()
+	s := warmSessions.m[id]
+	warmSessions.Unlock()
+	if s == nil || !tenantOwns(r, s.subscription) {
+		return nil
+	}
+	return s
+}
+
+// listConsumersHandler handles GET to /consumers: admins see every warm session, tenants those
+// of their subscriptions
+func listConsumersHandler(w http.ResponseWriter, r *http.Request) {
+	if requestTenant(r) == "" && !requireAdmin(w, r) {
+		return
+	}
+	warmSessions.Lock()
+	sessions := make([]*warmSession, 0, len(warmSessions.m))
+	for _, s := range warmSessions.m {
+		if tenantOwns(r, s.subscription) {
+			sessions = append(sessions, s)
+		}
+	}
+	warmSessions.Unlock()
+	sort.Slice(sessions, func(i, j int) bool { return sessions[i].id < sessions[j].id })
+
+	fmt.Fprintln(w, "Consumers (warm sessions):")
+	fmt.Fprintln(w, "--------------------------------")
+	for _, s := range sessions {
+		s.mu.Lock()
+		fmt.Fprintf(w, "%s: subscription %s, %s, %d messages (%d bytes) outstanding, %s\n",
+			s.id, s.subscription, s.settings, s.stats.outstanding, s.stats.outstandingBytes, s.stats.state())
+		s.mu.Unlock()
+	}
+	if len(sessions) == 0 {
+		fmt.Fprintln(w, "(none)")
+	}
+}
+
+// consumerStatsHandler handles GET to /consumers/<session-id>/stats
+func consumerStatsHandler(w http.ResponseWriter, r *http.Request) {
+	id := pathParam(r, "id")
+	s := lookupConsumer(r, id)
+	if s == nil {
+		http.Error(w, fmt.Sprintf("consumer %s not found (warm sessions close after %s without pulls)", id, warmSessionIdle), http.StatusNotFound)
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	c := s.stats
+	pausedTotal := c.pausedTotal
+	if c.paused {
+		pausedTotal += time.Since(c.pausedSince)
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	fmt.Fprintf(w, "Consumer %s\n", s.id)
+	fmt.Fprintf(w, "Subscription: %s\n", s.subscription)
+	fmt.Fprintf(w, "State: %s\n", c.state())
+	fmt.Fprintf(w, "Settings: %s (restarted %d times)\n", s.settings, c.restarts)
+	fmt.Fprintf(w, "Outstanding messages: %d of %d (peak %d)\n", c.outstanding, s.settings.MaxConcurrency, c.peakOutstanding)
+	fmt.Fprintf(w, "Outstanding bytes: %d of %d (peak %d)\n", c.outstandingBytes, s.limits.bytes, c.peakBytes)
+	fmt.Fprintf(w, "Buffer limits: %s; %d messages (%d bytes) retained for viewers\n", s.limits, len(s.log.entries), s.log.bytes)
+	fmt.Fprintf(w, "Pauses: %d, paused for %s in total\n", c.pauses, pausedTotal.Round(time.Millisecond))
+	fmt.Fprintf(w, "Received: %d messages in %d pulls\n", c.received, c.pulls)
+	fmt.Fprintf(w, "Open for: %s, last pull %s ago\n", time.Since(c.opened).Round(time.Second), time.Since(s.lastPull).Round(time.Second))
+	if s.err != nil {
+		fmt.Fprintf(w, "Error: %v\n", s.err)
+	}
+}
+
+// createConsumerHandler handles POST to /consumers, opening a warm session with the given
+// concurrency settings; admins open them on any subscription, tenants on theirs
+func createConsumerHandler(w http.ResponseWriter, r *http.Request) {
+	if requestTenant(r) == "" && !requireAdmin(w, r) {
+		return
+	}
+	// get consumer details from body: '{"subscription":"orders-audit", "numGoroutines":2, "maxConcurrency":10}'
+	var req struct {
+		Subscription string `json:"subscription"`
+		consumerSettings
+	}
+	req.consumerSettings = defaultConsumerSettings()
+	if !readRequest(w, r, createConsumerSchema, &req) {
+		return
+	}
+	if err := validateResourceName("subscription", req.Subscription); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !req.consumerSettings.check(w) {
+		return
+	}
+	ctx, cancel := withRequestDeadline(context.Background(), r)
+	defer cancel()
+	client, ok := newClient(context.Background(), w)
+	if !ok {
+		return
+	}
+	if err := checkExists(ctx, "subscription", req.Subscription, client.Subscription(req.Subscription).Exists); err != nil {
+		writeLookupError(w, err)
+		return
+	}
+	s := openWarmSession(client, req.Subscription, req.consumerSettings)
+	w.Header().Set(warmSessionHeader, s.id)
+	w.WriteHeader(http.StatusCreated)
+	fmt.Fprintf(w, "created consumer %s on subscription %s: %s\n", s.id, s.subscription, s.settings)
+	fmt.Fprintf(w, "pull with GET /subscriptions/%s/messages?warmSession=%s (it closes after %s without pulls)\n",
+		s.subscription, s.id, warmSessionIdle)
+}
+
+// updateConsumerHandler handles PATCH to /consumers/<session-id>, changing its concurrency
+// settings; the streaming pull restarts with them, returning the buffered messages for redelivery
+func updateConsumerHandler(w http.ResponseWriter, r *http.Request) {
+	if requestTenant(r) == "" && !requireAdmin(w, r) {
+		return
+	}
+	id := pathParam(r, "id")
+	s := lookupConsumer(r, id)
+	if s == nil {
+		http.Error(w, fmt.Sprintf("consumer %s not found (warm sessions close after %s without pulls)", id, warmSessionIdle), http.StatusNotFound)
+		return
+	}
+	// get the settings to change from body: '{"numGoroutines":4, "maxConcurrency":50}'
+	consumerUpdates.Lock()
+	defer consumerUpdates.Unlock()
+	s.mu.Lock()
+	old := s.settings
+	s.mu.Unlock()
+	settings := old
+	if !readRequest(w, r, updateConsumerSchema, &settings) {
+		return
+	}
+	if !settings.check(w) {
+		return
+	}
+	if settings == old {
+		fmt.Fprintf(w, "consumer %s unchanged: %s\n", s.id, settings)
+		return
+	}
+
+	returned := s.close()
+	s.mu.Lock()
+	s.settings = settings
+	s.stats.restarts++
+	s.updateStatsLocked()
+	s.startReceiveLocked()
+	s.mu.Unlock()
+	fmt.Fprintf(w, "updated consumer %s: %s (was %s)\n", s.id, settings, old)
+	fmt.Fprintf(w, "restarted the streaming pull, returning %d buffered messages for redelivery\n", returned)
+}
+
+// consumerMessagesHandler handles GET to /consumers/<session-id>/messages[?after=<offset>&limit=N],
+// returning the messages the session received after the offset (0 for the oldest it retains),
+// without taking them from its buffer
+func consumerMessagesHandler(w http.ResponseWriter, r *http.Request) {
+	id := pathParam(r, "id")
+	s := lookupConsumer(r, id)
+	if s == nil {
+		http.Error(w, fmt.Sprintf("consumer %s not found (warm sessions close after %s without pulls)", id, warmSessionIdle), http.StatusNotFound)
+		return
+	}
+	q := r.URL.Query()
+	var after int64
+	if v := q.Get("after"); v != "" {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || n < 0 {
+			http.Error(w, "after must be an offset, a non-negative integer", http.StatusBadRequest)
+			return
+		}
+		after = n
+	}
+	limit := defaultConsumerMessagesLimit
+	if v := q.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > maxConsumerMessagesLimit {
+			http.Error(w, fmt.Sprintf("limit must be between 1 and %d", maxConsumerMessagesLimit), http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+
+	s.mu.Lock()
+	s.expireLocked()
+	entries := s.log.after(after, limit)
+	first, last := s.log.first(), s.log.last
+	limits := s.limits
+	s.mu.Unlock()
+	if after > last {
+		http.Error(w, fmt.Sprintf("offset %d is beyond the last message received, %d", after, last), http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	if after+1 < first {
+		fmt.Fprintf(w, "messages %d to %d are no longer retained (limits: %s)\n", after+1, first-1, limits)
+	}
+	next := after
+	for _, e := range entries {
+		fmt.Fprintf(w, "[%d] Received: %s\n", e.offset, e.received.UTC().Format(time.RFC3339Nano))
+		writeReceivedMessage(w, int(e.offset), e.msg)
+		next = e.offset
+	}
+	if len(entries) == 0 {
+		fmt.Fprintln(w, "(no messages after this offset yet)")
+	}
+	fmt.Fprintf(w, "next: after=%d (last offset %d)\n", next, last)
+}
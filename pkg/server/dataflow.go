@@ -0,0 +1,317 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	dataflow "google.golang.org/api/dataflow/v1b3"
+)
+
+const (
+	defaultDataflowRegion = "us-central1"
+
+	dataflowTemplateGCS      = "pubsub-to-gcs"
+	dataflowTemplateBigQuery = "pubsub-to-bigquery"
+)
+
+var dataflowJobNameInvalid = regexp.MustCompile(`[^a-z0-9-]`)
+
+// dataflowJob is a Dataflow job launched through /jobs
+type dataflowJob struct {
+	ID       string
+	Name     string
+	Template string
+	Region   string
+	Source   string
+	Output   string
+	Launched time.Time
+}
+
+// dataflowJobs are the jobs launched by this instance, oldest first
+var dataflowJobs = struct {
+	sync.Mutex
+	list []*dataflowJob
+}{}
+
+var launchJobSchema = objectSchema(map[string]*jsonSchema{
+	"template":     {Type: "string", Description: "streaming template", Enum: []string{dataflowTemplateGCS, dataflowTemplateBigQuery}},
+	"topic":        stringSchema("topic the job reads (or subscription)"),
+	"subscription": stringSchema("subscription the job reads, for pubsub-to-bigquery (or topic)"),
+	"output":       stringSchema("gs://<bucket>/<dir>/ directory for pubsub-to-gcs, [<project>:]<dataset>.<table> for pubsub-to-bigquery"),
+	"jobName":      stringSchema("job name (default second-<source>-<time>)"),
+	"tempLocation": stringSchema("gs:// directory for temporary files"),
+	"parameters":   stringMapSchema("further template parameters"),
+}, "template", "output")
+
+func dataflowRegion() string {
+	if region := setting("DATAFLOW_REGION"); region != "" {
+		return region
+	}
+	return defaultDataflowRegion
+}
+
+// launchJobHandler handles POST to /jobs, launching a Google-provided streaming template reading
+// a topic or subscription: pubsub-to-gcs writes windowed text files to a gs:// directory,
+// pubsub-to-bigquery inserts JSON messages into a table
+func launchJobHandler(w http.ResponseWriter, r *http.Request) {
+	// get job details from body:
+	// '{"template":"pubsub-to-gcs"|"pubsub-to-bigquery", "topic":"<topic-name>"|"subscription":"<subscr-name>",
+	//   "output":"gs://<bucket>/<dir>/"|"[<project>:]<dataset>.<table>", "jobName":"<name>",
+	//   "tempLocation":"gs://<bucket>/<dir>", "parameters":{...}}'
+	var req struct {
+		Template     string            `json:"template"`
+		Topic        string            `json:"topic"`
+		Subscription string            `json:"subscription"`
+		Output       string            `json:"output"`
+		JobName      string            `json:"jobName"`
+		TempLocation string            `json:"tempLocation"`
+		Parameters   map[string]string `json:"parameters"`
+	}
+	if !readRequest(w, r, launchJobSchema, &req) {
+		return
+	}
+	projectID := setting("GOOGLE_CLOUD_PROJECT")
+	if projectID == "" {
+		http.Error(w, "failed to get project ID", http.StatusServiceUnavailable)
+		return
+	}
+	if (req.Topic == "") == (req.Subscription == "") {
+		http.Error(w, "exactly one of topic and subscription must be provided", http.StatusBadRequest)
+		return
+	}
+	source := req.Topic
+	if req.Topic != "" {
+		if err := validateResourceName("topic", req.Topic); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	} else {
+		if err := validateResourceName("subscription", req.Subscription); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		source = req.Subscription
+	}
+
+	region := dataflowRegion()
+	params := map[string]string{}
+	var templateName string
+	switch req.Template {
+	case dataflowTemplateGCS:
+		if req.Topic == "" {
+			http.Error(w, "the pubsub-to-gcs template reads a topic", http.StatusBadRequest)
+			return
+		}
+		if !strings.HasPrefix(req.Output, "gs://") {
+			http.Error(w, "output must be a gs://<bucket>/<dir>/ directory", http.StatusBadRequest)
+			return
+		}
+		templateName = "Cloud_PubSub_to_GCS_Text"
+		params["inputTopic"] = fmt.Sprintf("projects/%s/topics/%s", projectID, req.Topic)
+		params["outputDirectory"] = strings.TrimSuffix(req.Output, "/") + "/"
+		params["outputFilenamePrefix"] = source + "-"
+	case dataflowTemplateBigQuery:
+		table := req.Output
+		if strings.Count(table, ".") != 1 || strings.HasPrefix(table, "gs://") {
+			http.Error(w, "output must be a [<project>:]<dataset>.<table> table", http.StatusBadRequest)
+			return
+		}
+		if !strings.Contains(table, ":") {
+			table = projectID + ":" + table
+		}
+		params["outputTableSpec"] = table
+		if req.Topic != "" {
+			templateName = "PubSub_to_BigQuery"
+			params["inputTopic"] = fmt.Sprintf("projects/%s/topics/%s", projectID, req.Topic)
+		} else {
+			templateName = "PubSub_Subscription_to_BigQuery"
+			params["inputSubscription"] = fmt.Sprintf("projects/%s/subscriptions/%s", projectID, req.Subscription)
+		}
+	default:
+		http.Error(w, fmt.Sprintf("template must be %q or %q", dataflowTemplateGCS, dataflowTemplateBigQuery), http.StatusBadRequest)
+		return
+	}
+	for k, v := range req.Parameters {
+		params[k] = v
+	}
+	jobName := req.JobName
+	if jobName == "" {
+		// job names are lowercase letters, digits and dashes
+		jobName = fmt.Sprintf("second-%s-%s", dataflowJobNameInvalid.ReplaceAllString(strings.ToLower(source), "-"), time.Now().UTC().Format("20060102-150405"))
+	}
+
+	ctx := r.Context()
+	svc, err := dataflow.NewService(ctx)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	launch := &dataflow.LaunchTemplateParameters{
+		JobName:    jobName,
+		Parameters: params,
+		Environment: &dataflow.RuntimeEnvironment{
+			TempLocation:         req.TempLocation,
+			AdditionalUserLabels: demoLabels(),
+		},
+	}
+	gcsPath := fmt.Sprintf("gs://dataflow-templates-%s/latest/%s", region, templateName)
+	resp, err := svc.Projects.Locations.Templates.Launch(projectID, region, launch).GcsPath(gcsPath).Context(ctx).Do()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("launch %s: %v", gcsPath, err), http.StatusBadGateway)
+		return
+	}
+	if resp.Job == nil {
+		http.Error(w, "the launch returned no job", http.StatusBadGateway)
+		return
+	}
+	job := &dataflowJob{
+		ID:       resp.Job.Id,
+		Name:     jobName,
+		Template: req.Template,
+		Region:   region,
+		Source:   source,
+		Output:   req.Output,
+		Launched: time.Now(),
+	}
+	dataflowJobs.Lock()
+	dataflowJobs.list = append(dataflowJobs.list, job)
+	dataflowJobs.Unlock()
+	fmt.Fprintf(w, "launched job %s (%s) from %s\n", job.ID, job.Name, gcsPath)
+	fmt.Fprintf(w, "console: https://console.cloud.google.com/dataflow/jobs/%s/%s?project=%s\n", region, job.ID, projectID)
+}
+
+// listJobsHandler handles GET to /jobs, showing the current state of the asynchronous jobs (see
+// async.go) and of the Dataflow jobs launched through /jobs
+func listJobsHandler(w http.ResponseWriter, r *http.Request) {
+	dataflowJobs.Lock()
+	list := append([]*dataflowJob(nil), dataflowJobs.list...)
+	dataflowJobs.Unlock()
+
+	fmt.Fprintln(w, "Jobs\n----")
+	async := asyncJobSummaries()
+	for _, s := range async {
+		fmt.Fprintln(w, s)
+	}
+	if len(list) == 0 {
+		if len(async) == 0 {
+			fmt.Fprintln(w, "(none)")
+		}
+		return
+	}
+	svc, err := dataflow.NewService(r.Context())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	projectID := setting("GOOGLE_CLOUD_PROJECT")
+	for _, job := range list {
+		var state string
+		if j, err := svc.Projects.Locations.Jobs.Get(projectID, job.Region, job.ID).Context(r.Context()).Do(); err != nil {
+			state = fmt.Sprintf("unknown (%v)", err)
+		} else {
+			state = j.CurrentState
+		}
+		fmt.Fprintf(w, "%s: name=%s template=%s source=%s output=%s launched=%s state=%s\n",
+			job.ID, job.Name, job.Template, job.Source, job.Output, job.Launched.Format(time.RFC3339), state)
+	}
+}
+
+// getJobHandler handles GET to /jobs/<job-id>
+func getJobHandler(w http.ResponseWriter, r *http.Request) {
+	if j, ok := lookupLocalJob(w, r); ok {
+		if j != nil {
+			writeAsyncJob(w, j)
+		}
+		return
+	}
+	projectID := setting("GOOGLE_CLOUD_PROJECT")
+	svc, err := dataflow.NewService(r.Context())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	id := pathParam(r, "id")
+	j, err := svc.Projects.Locations.Jobs.Get(projectID, jobRegion(id), id).Context(r.Context()).Do()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	fmt.Fprintf(w, "Job: %s\n", j.Id)
+	fmt.Fprintf(w, "Name: %s\n", j.Name)
+	fmt.Fprintf(w, "Type: %s\n", j.Type)
+	fmt.Fprintf(w, "Location: %s\n", j.Location)
+	fmt.Fprintf(w, "Created: %s\n", j.CreateTime)
+	fmt.Fprintf(w, "State: %s (since %s)\n", j.CurrentState, j.CurrentStateTime)
+	if j.RequestedState != "" {
+		fmt.Fprintf(w, "Requested state: %s\n", j.RequestedState)
+	}
+}
+
+// stopJobHandler handles DELETE to /jobs/<job-id>[?drain=true]: cancels the job, or drains it,
+// letting it finish processing the messages it has already read
+func stopJobHandler(w http.ResponseWriter, r *http.Request) {
+	if j, ok := lookupLocalJob(w, r); ok {
+		if j != nil {
+			cancelAsyncJob(w, j)
+		}
+		return
+	}
+	projectID := setting("GOOGLE_CLOUD_PROJECT")
+	svc, err := dataflow.NewService(r.Context())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	id := pathParam(r, "id")
+	state := "JOB_STATE_CANCELLED"
+	if r.URL.Query().Get("drain") == "true" {
+		state = "JOB_STATE_DRAINED"
+	}
+	j, err := svc.Projects.Locations.Jobs.Update(projectID, jobRegion(id), id, &dataflow.Job{RequestedState: state}).Context(r.Context()).Do()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	fmt.Fprintf(w, "requested %s for job %s (now %s)\n", state, id, j.CurrentState)
+}
+
+// lookupLocalJob returns the asynchronous job named in the path, reporting whether the ID is
+// one of an asynchronous job rather than a Dataflow job; unknown ones get a 404 and a nil job
+func lookupLocalJob(w http.ResponseWriter, r *http.Request) (*asyncJob, bool) {
+	id := pathParam(r, "id")
+	if !strings.HasPrefix(id, asyncJobPrefix) {
+		return nil, false
+	}
+	j, ok := lookupAsyncJob(id)
+	if !ok {
+		http.Error(w, fmt.Sprintf("job %s not found", id), http.StatusNotFound)
+		return nil, true
+	}
+	return j, true
+}
+
+// jobRegion returns the region a job was launched in, the configured one for jobs not launched here
+func jobRegion(id string) string {
+	dataflowJobs.Lock()
+	defer dataflowJobs.Unlock()
+	for _, job := range dataflowJobs.list {
+		if job.ID == id {
+			return job.Region
+		}
+	}
+	return dataflowRegion()
+}
+
+func jobSummaries() []string {
+	dataflowJobs.Lock()
+	defer dataflowJobs.Unlock()
+	var list []string
+	for _, job := range dataflowJobs.list {
+		list = append(list, fmt.Sprintf("%s: name=%s template=%s source=%s output=%s", job.ID, job.Name, job.Template, job.Source, job.Output))
+	}
+	return list
+}
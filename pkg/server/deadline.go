@@ -0,0 +1,82 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Callers can bound how long a request may take with an X-Request-Deadline header, an RFC 3339
+// time or a duration like 2s, or a Request-Timeout header in seconds. The request's context then
+// ends at the deadline, as do the backend calls of the topic and subscription endpoints, and a
+// request cut short by it gets 504: a publish reports which messages were published in time (the
+// others may still be), a pull that received nothing returns 504 and one that received messages
+// returns them, ending at the deadline instead of its timeout.
+
+// requestDeadlineKey is the request context key of the deadline the caller asked for
+type requestDeadlineKey struct{}
+
+// parseRequestDeadline returns the deadline of the request's X-Request-Deadline or
+// Request-Timeout header, zero if it has none
+func parseRequestDeadline(r *http.Request) (time.Time, error) {
+	if s := r.Header.Get("X-Request-Deadline"); s != "" {
+		if t, err := time.Parse(time.RFC3339Nano, s); err == nil {
+			return t, nil
+		}
+		d, err := time.ParseDuration(s)
+		if err != nil || d <= 0 {
+			return time.Time{}, fmt.Errorf("X-Request-Deadline must be an RFC 3339 time or a positive duration, like 2s")
+		}
+		return time.Now().Add(d), nil
+	}
+	if s := r.Header.Get("Request-Timeout"); s != "" {
+		secs, err := strconv.ParseFloat(s, 64)
+		if err != nil || secs <= 0 {
+			return time.Time{}, fmt.Errorf("Request-Timeout must be a positive number of seconds")
+		}
+		return time.Now().Add(time.Duration(secs * float64(time.Second))), nil
+	}
+	return time.Time{}, nil
+}
+
+// applyRequestDeadline ends the request's context at the deadline the caller asked for, responding
+// 400 to an invalid one and 504 to one already past; the returned function releases the context
+func applyRequestDeadline(w http.ResponseWriter, r *http.Request) (*http.Request, context.CancelFunc, bool) {
+	deadline, err := parseRequestDeadline(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return r, func() {}, false
+	}
+	if deadline.IsZero() {
+		return r, func() {}, true
+	}
+	if !time.Now().Before(deadline) {
+		http.Error(w, fmt.Sprintf("the request deadline %s has passed", deadline.Format(time.RFC3339Nano)), http.StatusGatewayTimeout)
+		return r, func() {}, false
+	}
+	ctx, cancel := context.WithDeadline(context.WithValue(r.Context(), requestDeadlineKey{}, deadline), deadline)
+	return r.WithContext(ctx), cancel, true
+}
+
+// withRequestDeadline bounds ctx, like the background context of backend calls, by the request's
+// deadline, if the caller gave one
+func withRequestDeadline(ctx context.Context, r *http.Request) (context.Context, context.CancelFunc) {
+	deadline, ok := r.Context().Value(requestDeadlineKey{}).(time.Time)
+	if !ok {
+		return ctx, func() {}
+	}
+	return context.WithDeadline(ctx, deadline)
+}
+
+// requestDeadlineExceeded reports whether the deadline the caller gave the request has passed
+func requestDeadlineExceeded(r *http.Request) bool {
+	deadline, ok := r.Context().Value(requestDeadlineKey{}).(time.Time)
+	return ok && !time.Now().Before(deadline)
+}
+
+// writeDeadlineExceeded responds 504 to a request cut short by its deadline while doing something
+func writeDeadlineExceeded(w http.ResponseWriter, doing string) {
+	http.Error(w, "request deadline exceeded "+doing, http.StatusGatewayTimeout)
+}
@@ -0,0 +1,56 @@
+package server
+
+import (
+	"crypto/subtle"
+	"expvar"
+	"net/http"
+	_ "net/http/pprof" // registers /debug/pprof/ handlers
+	"runtime"
+	"strings"
+	"time"
+)
+
+var startTime = time.Now()
+
+func init() {
+	expvar.Publish("goroutines", expvar.Func(func() interface{} { return runtime.NumGoroutine() }))
+	expvar.Publish("uptime", expvar.Func(func() interface{} { return time.Since(startTime).Round(time.Second).String() }))
+}
+
+// debugEndpointsEnabled reports whether the pprof and expvar endpoints are exposed, which requires DEBUG_ENDPOINTS=true
+func debugEndpointsEnabled() bool {
+	return setting("DEBUG_ENDPOINTS") == "true"
+}
+
+// isAdmin reports whether the request carries the admin token from ADMIN_TOKEN as a bearer token;
+// without ADMIN_TOKEN set nobody is an admin
+func isAdmin(r *http.Request) bool {
+	token := setting("ADMIN_TOKEN")
+	if token == "" {
+		return false
+	}
+	auth := r.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, "Bearer ") {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(strings.TrimPrefix(auth, "Bearer ")), []byte(token)) == 1
+}
+
+// debugMiddleware restricts the /debug endpoints to admins, hiding pprof and expvar
+// (registered on the default mux as a side effect of importing them) unless enabled
+func debugMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, "/debug/") {
+			if (strings.HasPrefix(r.URL.Path, "/debug/pprof/") || r.URL.Path == "/debug/vars") && !debugEndpointsEnabled() {
+				http.NotFound(w, r)
+				return
+			}
+			if !isAdmin(r) {
+				w.Header().Set("WWW-Authenticate", "Bearer")
+				http.Error(w, "admin token required", http.StatusUnauthorized)
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,136 @@
+package server
+
+import (
+	"container/list"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultDedupCacheSize = 10000
+	defaultDedupWindow    = 10 * time.Minute
+
+	dedupSkippedMetric = "second_dedup_skipped_total"
+)
+
+// PublishMessage is a message in a publish request; plain strings in the
+// request are messages without a dedupKey
+type PublishMessage struct {
+	Data       string            `json:"data"`
+	Attributes map[string]string `json:"attributes,omitempty"`
+	DedupKey   string            `json:"dedupKey,omitempty"`
+	ClientID   string            `json:"clientId,omitempty"` // echoed in the message's result, not published
+}
+
+// resultPrefix returns the prefix of the result line of the i-th message of a publish request,
+// which names the message's clientId if it has one
+func (m PublishMessage) resultPrefix(i int) string {
+	if m.ClientID == "" {
+		return fmt.Sprintf("[%d]", i)
+	}
+	return fmt.Sprintf("[%d] clientId %s:", i, m.ClientID)
+}
+
+// UnmarshalJSON accepts both "text" and {"data":"text", "attributes":{...}, "dedupKey":"key", "clientId":"id"}
+func (m *PublishMessage) UnmarshalJSON(b []byte) error {
+	if err := json.Unmarshal(b, &m.Data); err == nil {
+		return nil
+	}
+	type plain PublishMessage
+	if err := json.Unmarshal(b, (*plain)(m)); err != nil {
+		return fmt.Errorf("message must be a string or {\"data\":..., \"attributes\":{...}, \"dedupKey\":..., \"clientId\":...}")
+	}
+	if strings.ContainsAny(m.ClientID, "\r\n") {
+		return fmt.Errorf("clientId must be a single line")
+	}
+	return nil
+}
+
+// dedupEntry remembers the message published for a dedup key
+type dedupEntry struct {
+	key       string // topic name and dedup key
+	messageID string // empty while the publish is in flight
+	at        time.Time
+}
+
+// dedupCache holds the dedup keys of recently published messages, bounded in size
+// and in time: keys older than the window no longer suppress republishing
+var dedupCache = struct {
+	sync.Mutex
+	size    int
+	window  time.Duration
+	lru     *list.List // of *dedupEntry, most recently published first
+	entries map[string]*list.Element
+}{lru: list.New(), entries: map[string]*list.Element{}}
+
+// startDedupCache reads the dedup cache settings
+func startDedupCache() {
+	dedupCache.Lock()
+	defer dedupCache.Unlock()
+	dedupCache.size = defaultDedupCacheSize
+	if s := setting("DEDUP_CACHE_SIZE"); s != "" {
+		if n, err := strconv.Atoi(s); err != nil || n < 1 {
+			log.Printf("dedup: invalid DEDUP_CACHE_SIZE %q, using %d", s, defaultDedupCacheSize)
+		} else {
+			dedupCache.size = n
+		}
+	}
+	dedupCache.window = defaultDedupWindow
+	if s := setting("DEDUP_WINDOW"); s != "" {
+		if d, err := time.ParseDuration(s); err != nil || d <= 0 {
+			log.Printf("dedup: invalid DEDUP_WINDOW %q, using %s", s, defaultDedupWindow)
+		} else {
+			dedupCache.window = d
+		}
+	}
+}
+
+// dedupReserve claims a dedup key for a message about to be published to a topic; if the key
+// was already claimed within the window it reports the duplicate and the message ID published
+// for the key (empty if that publish is still in flight)
+func dedupReserve(topicName, dedupKey string) (string, bool) {
+	dedupCache.Lock()
+	defer dedupCache.Unlock()
+	key := topicName + "\x00" + dedupKey
+	if e, ok := dedupCache.entries[key]; ok {
+		entry := e.Value.(*dedupEntry)
+		if time.Since(entry.at) <= dedupCache.window {
+			counterAdd(dedupSkippedMetric, "Published messages skipped as duplicates of a recent dedupKey, by topic.", 1, "topic", topicName)
+			return entry.messageID, true
+		}
+		dedupCache.lru.Remove(e)
+		delete(dedupCache.entries, key)
+	}
+	dedupCache.entries[key] = dedupCache.lru.PushFront(&dedupEntry{key: key, at: time.Now()})
+	for dedupCache.lru.Len() > dedupCache.size {
+		oldest := dedupCache.lru.Back()
+		dedupCache.lru.Remove(oldest)
+		delete(dedupCache.entries, oldest.Value.(*dedupEntry).key)
+	}
+	return "", false
+}
+
+// dedupRecord records the message ID published for a reserved dedup key
+func dedupRecord(topicName, dedupKey, messageID string) {
+	dedupCache.Lock()
+	defer dedupCache.Unlock()
+	if e, ok := dedupCache.entries[topicName+"\x00"+dedupKey]; ok {
+		e.Value.(*dedupEntry).messageID = messageID
+	}
+}
+
+// dedupRelease gives up a reserved dedup key after its publish failed, so a retry isn't skipped
+func dedupRelease(topicName, dedupKey string) {
+	dedupCache.Lock()
+	defer dedupCache.Unlock()
+	key := topicName + "\x00" + dedupKey
+	if e, ok := dedupCache.entries[key]; ok {
+		dedupCache.lru.Remove(e)
+		delete(dedupCache.entries, key)
+	}
+}
@@ -0,0 +1,294 @@
+package server
+
+import (
+	"container/heap"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/pubsub"
+)
+
+const (
+	maxDeliverAfter         = 7 * 24 * time.Hour
+	delayedRetryInterval    = 30 * time.Second
+	maxDelayedDeliveryTries = 5
+
+	publishedMessagesMetric = "second_messages_published_total"
+)
+
+// delayedMessage is a message held back until it is due for publishing
+type delayedMessage struct {
+	ID         string            `json:"id"`
+	Topic      string            `json:"topic"`
+	Data       []byte            `json:"data"`
+	Attributes map[string]string `json:"attributes,omitempty"`
+	Due        time.Time         `json:"due"`
+	Enqueued   time.Time         `json:"enqueued,omitempty"`
+	Attempts   int               `json:"attempts,omitempty"`
+	LastError  string            `json:"lastError,omitempty"`
+}
+
+// delayHeap orders delayed messages by due time
+type delayHeap []*delayedMessage
+
+func (h delayHeap) Len() int            { return len(h) }
+func (h delayHeap) Less(i, j int) bool  { return h[i].Due.Before(h[j].Due) }
+func (h delayHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *delayHeap) Push(x interface{}) { *h = append(*h, x.(*delayedMessage)) }
+func (h *delayHeap) Pop() interface{} {
+	old := *h
+	m := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return m
+}
+
+// delayQueue emulates delayed delivery, which Pub/Sub doesn't provide natively:
+// messages are kept in memory (and in DELAY_QUEUE_FILE, if set) until due, within the
+// DELAY_QUEUE_LIMITS (see buffers.go)
+var delayQueue = struct {
+	sync.Mutex
+	path  string
+	msgs  delayHeap
+	bytes int
+	wake  chan struct{}
+}{wake: make(chan struct{}, 1)}
+
+// errDelayQueueFull rejects a delayed message the delay queue has no room for
+var errDelayQueueFull = errors.New("the delay queue is full")
+
+// startDelayQueue loads persisted delayed messages and starts delivering them when due
+func startDelayQueue() {
+	delayQueue.Lock()
+	delayQueue.path = setting("DELAY_QUEUE_FILE")
+	if delayQueue.path != "" {
+		data, err := os.ReadFile(delayQueue.path)
+		if err != nil && !os.IsNotExist(err) {
+			log.Printf("delay queue: %v", err)
+		}
+		if len(data) > 0 {
+			if err := json.Unmarshal(data, &delayQueue.msgs); err != nil {
+				log.Printf("delay queue: %s: %v", delayQueue.path, err)
+			}
+			heap.Init(&delayQueue.msgs)
+			for _, m := range delayQueue.msgs {
+				delayQueue.bytes += len(m.Data)
+			}
+			log.Printf("Loaded %d delayed messages from %s", len(delayQueue.msgs), delayQueue.path)
+		}
+	}
+	delayQueue.Unlock()
+
+	go runDelayQueue()
+}
+
+// enqueueDelayed holds msg back until due, returning its delay ID; errDelayQueueFull if the queue
+// has no room for it
+func enqueueDelayed(topicName string, msg *pubsub.Message, due time.Time) (string, error) {
+	m := &delayedMessage{
+		ID:         randomID(),
+		Topic:      topicName,
+		Data:       msg.Data,
+		Attributes: msg.Attributes,
+		Due:        due,
+		Enqueued:   time.Now(),
+	}
+	limits := loadBufferLimits(delayBuffer)
+	delayQueue.Lock()
+	expireDelayedLocked(limits)
+	dropped := 0
+	for len(delayQueue.msgs) > 0 && limits.policy == bufferPolicyDropOldest &&
+		limits.full(len(delayQueue.msgs), delayQueue.bytes, len(m.Data)) {
+		oldest := 0
+		for i, d := range delayQueue.msgs {
+			if d.Enqueued.Before(delayQueue.msgs[oldest].Enqueued) {
+				oldest = i
+			}
+		}
+		d := removeDelayedLocked(oldest)
+		log.Printf("delay queue: dropping message %s for topic %s to make room", d.ID, d.Topic)
+		dropped++
+	}
+	recordBufferDrops(delayBuffer, "full", dropped)
+	if limits.full(len(delayQueue.msgs), delayQueue.bytes, len(m.Data)) {
+		delayQueue.Unlock()
+		recordBufferDrops(delayBuffer, "rejected", 1)
+		return "", errDelayQueueFull
+	}
+	pushDelayedLocked(m)
+	if err := saveDelayQueueLocked(); err != nil {
+		log.Printf("delay queue: %v", err)
+	}
+	delayQueue.Unlock()
+
+	// the new message may be due before the one the queue is currently waiting for
+	select {
+	case delayQueue.wake <- struct{}{}:
+	default:
+	}
+	return m.ID, nil
+}
+
+// pushDelayedLocked adds a message to the delay queue
+func pushDelayedLocked(m *delayedMessage) {
+	heap.Push(&delayQueue.msgs, m)
+	delayQueue.bytes += len(m.Data)
+	recordBufferSize(delayBuffer, len(delayQueue.msgs), delayQueue.bytes)
+}
+
+// removeDelayedLocked takes the i-th message out of the delay queue
+func removeDelayedLocked(i int) *delayedMessage {
+	m := heap.Remove(&delayQueue.msgs, i).(*delayedMessage)
+	delayQueue.bytes -= len(m.Data)
+	recordBufferSize(delayBuffer, len(delayQueue.msgs), delayQueue.bytes)
+	return m
+}
+
+// expireDelayedLocked drops the messages held back for longer than the age limit, returning
+// whether it dropped any
+func expireDelayedLocked(limits bufferLimits) bool {
+	dropped := 0
+	for i := 0; i < len(delayQueue.msgs); {
+		m := delayQueue.msgs[i]
+		// messages persisted before they were timestamped are as old as the queue's start
+		if m.Enqueued.IsZero() {
+			m.Enqueued = time.Now()
+		}
+		if !limits.expired(m.Enqueued) {
+			i++
+			continue
+		}
+		removeDelayedLocked(i)
+		log.Printf("delay queue: dropping message %s for topic %s, held back since %s", m.ID, m.Topic, m.Enqueued.Format(time.RFC3339))
+		dropped++
+		i = 0 // removing reorders the heap
+	}
+	recordBufferDrops(delayBuffer, "age", dropped)
+	return dropped > 0
+}
+
+// runDelayQueue publishes delayed messages as they become due, retrying failed deliveries
+func runDelayQueue() {
+	timer := time.NewTimer(time.Hour)
+	for {
+		delayQueue.Lock()
+		var due []*delayedMessage
+		now := time.Now()
+		limits := loadBufferLimits(delayBuffer)
+		expired := expireDelayedLocked(limits)
+		for len(delayQueue.msgs) > 0 && !delayQueue.msgs[0].Due.After(now) {
+			due = append(due, removeDelayedLocked(0))
+		}
+		delayQueue.Unlock()
+
+		for _, m := range due {
+			if _, err := publishMessage(m.Topic, &pubsub.Message{Data: m.Data, Attributes: m.Attributes}); err != nil {
+				m.Attempts++
+				m.LastError = err.Error()
+				if m.Attempts >= maxDelayedDeliveryTries {
+					log.Printf("delay queue: dropping message %s for topic %s after %d attempts: %v", m.ID, m.Topic, m.Attempts, err)
+					continue
+				}
+				log.Printf("delay queue: message %s for topic %s: %v", m.ID, m.Topic, err)
+				m.Due = time.Now().Add(delayedRetryInterval)
+				delayQueue.Lock()
+				pushDelayedLocked(m)
+				delayQueue.Unlock()
+			}
+		}
+
+		delayQueue.Lock()
+		if len(due) > 0 || expired {
+			if err := saveDelayQueueLocked(); err != nil {
+				log.Printf("delay queue: %v", err)
+			}
+		}
+		wait := time.Hour
+		if len(delayQueue.msgs) > 0 {
+			wait = time.Until(delayQueue.msgs[0].Due)
+		}
+		if limits.age > 0 && wait > limits.age {
+			// the held back messages are checked against the age limit in the meantime
+			wait = limits.age
+		}
+		delayQueue.Unlock()
+
+		if !timer.Stop() {
+			select {
+			case <-timer.C:
+			default:
+			}
+		}
+		timer.Reset(wait)
+		select {
+		case <-timer.C:
+		case <-delayQueue.wake:
+		}
+	}
+}
+
+// delayedHandler handles GET to /delayed
+func delayedHandler(w http.ResponseWriter, r *http.Request) {
+	delayQueue.Lock()
+	msgs := make(delayHeap, len(delayQueue.msgs))
+	copy(msgs, delayQueue.msgs)
+	bytes := delayQueue.bytes
+	delayQueue.Unlock()
+
+	fmt.Fprintln(w, "Delayed messages\n----------------")
+	fmt.Fprintf(w, "%d messages, %d bytes (limits: %s)\n", len(msgs), bytes, loadBufferLimits(delayBuffer))
+	if len(msgs) == 0 {
+		fmt.Fprintln(w, "(none)")
+	}
+	for msgs.Len() > 0 {
+		m := heap.Pop(&msgs).(*delayedMessage)
+		fmt.Fprintf(w, "%s: topic=%s due=%s bytes=%d", m.ID, m.Topic, m.Due.Format(time.RFC3339), len(m.Data))
+		if m.Attempts > 0 {
+			fmt.Fprintf(w, " attempts=%d lastError=%q", m.Attempts, m.LastError)
+		}
+		fmt.Fprintln(w)
+	}
+}
+
+// publishMessage publishes a single message to a topic and returns its message ID
+func publishMessage(topicName string, msg *pubsub.Message) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	topic, release, err := acquireTopic(topicName)
+	if err != nil {
+		return "", err
+	}
+	defer release()
+	id, err := topic.Publish(ctx, msg).Get(ctx)
+	if err == nil {
+		recordPublished(topicName, 1)
+	}
+	return id, err
+}
+
+// recordPublished records that n messages were published to a topic through this service
+func recordPublished(topicName string, n int) {
+	counterAdd(publishedMessagesMetric, "Messages published through this service, by topic.", float64(n), "topic", topicName)
+}
+
+// saveDelayQueueLocked writes all pending delayed messages to the delay queue file, if any
+func saveDelayQueueLocked() error {
+	if delayQueue.path == "" {
+		return nil
+	}
+	data, err := json.Marshal(delayQueue.msgs)
+	if err != nil {
+		return err
+	}
+	tmp := delayQueue.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, delayQueue.path)
+}
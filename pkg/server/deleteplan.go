@@ -0,0 +1,210 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/pubsub"
+	"google.golang.org/api/iterator"
+)
+
+// With DELETE_CONFIRMATION=true, deleting a topic with attached subscriptions or a subscription
+// with a backlog (or whose backlog is unknown) takes two steps, like a console confirming a
+// destructive action: GET .../delete-plan shows what would be lost along with a confirmation
+// token, which the DELETE must pass back as confirm=<token> before it expires, or it gets 428.
+// A token is used once, and only covers the losses its plan showed: a subscription attached to the
+// topic since requires a new plan. GraphQL deletes take the token as their confirm argument; bulk
+// deletes and the AWS facade refuse to delete resources whose plan loses something (see
+// bulkDeleteLosesNothing and refuseLossyDelete).
+
+// deleteTokenTTL is how long a confirmation token stays valid
+const deleteTokenTTL = 5 * time.Minute
+
+// deletePlan is what deleting a topic or subscription would lose
+type deletePlan struct {
+	kind, name string
+	losses     []string // what is lost, like the subscriptions detached, empty if nothing is
+	lines      []string // the losses explained
+}
+
+// deleteToken is a confirmation token issued with a delete plan
+type deleteToken struct {
+	kind, name string
+	losses     []string
+	expires    time.Time
+}
+
+// deleteConfirmations holds the confirmation tokens issued, by token
+var deleteConfirmations = struct {
+	sync.Mutex
+	tokens map[string]deleteToken
+}{tokens: map[string]deleteToken{}}
+
+// deleteConfirmationRequired reports whether deletes need a confirmation token
+func deleteConfirmationRequired() bool {
+	return setting("DELETE_CONFIRMATION") == "true"
+}
+
+// topicDeletePlan lists what deleting a topic would lose: its subscriptions are detached
+func topicDeletePlan(ctx context.Context, topic *pubsub.Topic) (*deletePlan, error) {
+	plan := &deletePlan{kind: "topic", name: topic.ID()}
+	it := topic.Subscriptions(ctx)
+	for {
+		subscr, err := it.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		plan.losses = append(plan.losses, subscr.ID())
+		plan.lines = append(plan.lines, fmt.Sprintf("subscription %s is detached and stops receiving messages", subscr.ID()))
+	}
+	return plan, nil
+}
+
+// subscriptionDeletePlan lists what deleting a subscription would lose: its undelivered messages,
+// per its backlog metrics
+func subscriptionDeletePlan(ctx context.Context, subscr *pubsub.Subscription) *deletePlan {
+	plan := &deletePlan{kind: "subscription", name: subscr.ID()}
+	undelivered, at, err := latestSubscriptionMetric(ctx, setting("GOOGLE_CLOUD_PROJECT"), subscr.ID(),
+		"pubsub.googleapis.com/subscription/num_undelivered_messages")
+	switch {
+	case err != nil:
+		plan.lines = []string{fmt.Sprintf("its backlog is unknown (%v): any undelivered messages are lost", err)}
+	case at.IsZero():
+		plan.lines = []string{"its backlog is unknown (no recent backlog metrics): any undelivered messages are lost"}
+	case undelivered > 0:
+		plan.lines = []string{fmt.Sprintf("%d undelivered messages are lost (as of %s)", int64(undelivered), at.Format(time.RFC3339))}
+	default:
+		return plan
+	}
+	plan.losses = []string{"backlog"}
+	return plan
+}
+
+// without returns the plan of a topic without the loss of one of its subscriptions
+func (p *deletePlan) without(subscription string) *deletePlan {
+	plan := &deletePlan{kind: p.kind, name: p.name}
+	for i, loss := range p.losses {
+		if loss != subscription {
+			plan.losses = append(plan.losses, loss)
+			plan.lines = append(plan.lines, p.lines[i])
+		}
+	}
+	return plan
+}
+
+// issueDeleteToken returns a new confirmation token for the plan
+func issueDeleteToken(plan *deletePlan) (string, time.Time) {
+	token := randomID()
+	expires := time.Now().Add(deleteTokenTTL)
+	deleteConfirmations.Lock()
+	defer deleteConfirmations.Unlock()
+	now := time.Now()
+	for t, dt := range deleteConfirmations.tokens {
+		if now.After(dt.expires) {
+			delete(deleteConfirmations.tokens, t)
+		}
+	}
+	deleteConfirmations.tokens[token] = deleteToken{kind: plan.kind, name: plan.name, losses: plan.losses, expires: expires}
+	return token, expires
+}
+
+// takeDeleteToken returns what a confirmation token was issued for and uses it up, or false if
+// it's unknown, used or expired
+func takeDeleteToken(token string) (deleteToken, bool) {
+	deleteConfirmations.Lock()
+	defer deleteConfirmations.Unlock()
+	dt, ok := deleteConfirmations.tokens[token]
+	delete(deleteConfirmations.tokens, token)
+	return dt, ok && !time.Now().After(dt.expires)
+}
+
+// deleteConfirmed checks the confirmation token of a DELETE whose plan loses something, responding
+// 428 if it's missing, expired, for another resource or doesn't cover the losses; the token is used up
+func deleteConfirmed(w http.ResponseWriter, r *http.Request, plan *deletePlan) bool {
+	if err := confirmDelete(plan, r.URL.Query().Get("confirm")); err != nil {
+		http.Error(w, err.Error(), http.StatusPreconditionRequired)
+		return false
+	}
+	return true
+}
+
+// confirmDelete checks the confirmation token of a delete whose plan loses something, returning why
+// it's refused; the token is used up
+func confirmDelete(plan *deletePlan, token string) error {
+	if len(plan.losses) == 0 {
+		return nil
+	}
+	planPath := fmt.Sprintf("GET /%ss/%s/delete-plan", plan.kind, plan.name)
+	if token == "" {
+		return fmt.Errorf("deleting %s %s loses data: get a confirmation token with %s and pass it as confirm=<token>",
+			plan.kind, plan.name, planPath)
+	}
+	dt, ok := takeDeleteToken(token)
+	switch {
+	case !ok:
+		return fmt.Errorf("the confirmation token is unknown, used or expired: get a new one with %s", planPath)
+	case dt.kind != plan.kind || dt.name != plan.name:
+		return fmt.Errorf("the confirmation token is for %s %s: get one with %s", dt.kind, dt.name, planPath)
+	}
+	for _, loss := range plan.losses {
+		if !containsString(dt.losses, loss) {
+			return fmt.Errorf("%s %s changed since its delete plan: review a new one with %s", plan.kind, plan.name, planPath)
+		}
+	}
+	return nil
+}
+
+// refuseLossyDelete returns an error if DELETE_CONFIRMATION is on and the plan loses something, for
+// the AWS facade, whose deletes can't carry a confirmation token
+func refuseLossyDelete(plan *deletePlan) error {
+	if !deleteConfirmationRequired() || len(plan.losses) == 0 {
+		return nil
+	}
+	return fmt.Errorf("deleting %s %s loses data: review GET /%ss/%s/delete-plan and delete it with its confirmation token through the API",
+		plan.kind, plan.name, plan.kind, plan.name)
+}
+
+// writeDeletePlan writes a delete plan with a confirmation token
+func writeDeletePlan(w http.ResponseWriter, plan *deletePlan, resource string) {
+	fmt.Fprintf(w, "Deleting %s %s:\n", plan.kind, resource)
+	for _, line := range plan.lines {
+		fmt.Fprintf(w, "  %s\n", line)
+	}
+	if len(plan.losses) == 0 {
+		fmt.Fprintln(w, "  loses nothing (no confirmation needed)")
+	}
+	token, expires := issueDeleteToken(plan)
+	fmt.Fprintf(w, "confirmation token: %s (pass it as confirm=<token>, valid until %s)\n", token, expires.Format(time.RFC3339))
+}
+
+// writeDeleteDryRun writes what a delete would do and lose, for ?dryRun=true
+func writeDeleteDryRun(w http.ResponseWriter, action string, plan *deletePlan) {
+	details := append([]string{}, plan.lines...)
+	if len(plan.losses) == 0 {
+		details = append(details, "loses nothing")
+	} else if deleteConfirmationRequired() {
+		details = append(details, fmt.Sprintf("(needs confirm=<token> from GET /%ss/%s/delete-plan)", plan.kind, plan.name))
+	}
+	writeDryRun(w, action, details)
+}
+
+// topicDeletePlanHandler handles GET to /topics/<topic-name>/delete-plan
+func topicDeletePlanHandler(ctx context.Context, w http.ResponseWriter, r *http.Request, client *pubsub.Client, topic *pubsub.Topic) {
+	plan, err := topicDeletePlan(ctx, topic)
+	if err != nil {
+		writeAdminError(w, err, http.StatusInternalServerError)
+		return
+	}
+	writeDeletePlan(w, plan, topic.String())
+}
+
+// subscriptionDeletePlanHandler handles GET to /subscriptions/<subscription-name>/delete-plan
+func subscriptionDeletePlanHandler(ctx context.Context, w http.ResponseWriter, r *http.Request, client *pubsub.Client, subscr *pubsub.Subscription) {
+	writeDeletePlan(w, subscriptionDeletePlan(ctx, subscr), subscr.String())
+}
@@ -0,0 +1,249 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+
+	"cloud.google.com/go/pubsub"
+	"google.golang.org/api/iterator"
+)
+
+// POST /diff compares a manifest, the file the shell's apply command takes, with the project's
+// topics and subscriptions and returns what applying it would change, without changing anything:
+// the resources to create, those to update field by field, and those created by this service
+// (labeled demo) the manifest doesn't declare, which a full sync would delete. Subscriptions may
+// declare the labels and retention settings of PUT /subscriptions, which are compared when given.
+
+// manifest declares topics and subscriptions
+type manifest struct {
+	Topics        []string                    `json:"topics"`
+	Subscriptions []createSubscriptionRequest `json:"subscriptions"`
+
+	retention map[string]retentionProps // the subscriptions' retention settings parsed by check, by name
+}
+
+var manifestSchema = objectSchema(map[string]*jsonSchema{
+	"topics":        {Type: "array", Description: "names of the topics", Items: stringSchema("topic name")},
+	"subscriptions": {Type: "array", Description: "the subscriptions", Items: createSubscriptionSchema},
+})
+
+// diffEntry is a resource the manifest would change
+type diffEntry struct {
+	op      string // "+" create, "~" update or "-" delete
+	kind    string
+	name    string
+	changes []string // for updates, "field: live -> manifest"; for creates, the configuration
+}
+
+// diffHandler handles POST to /diff
+func diffHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := context.Background()
+	client, ok := newClient(ctx, w)
+	if !ok {
+		return
+	}
+	defer client.Close()
+
+	// get the manifest from body:
+	// '{"topics":["orders", ...], "subscriptions":[{"name":"orders-audit", "topic":"orders",
+	//   "labels":{...}, "retainAckedMessages":true, "retentionDuration":"24h"}, ...]}'
+	var m manifest
+	if !readRequest(w, r, manifestSchema, &m) {
+		return
+	}
+	if err := m.check(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := waitAdminQuota(r.Context(), adminOpList); err != nil {
+		writeAdminError(w, err, http.StatusServiceUnavailable)
+		return
+	}
+	entries, err := manifestDiff(ctx, client, &m)
+	if err != nil {
+		writeAdminError(w, err, http.StatusInternalServerError)
+		return
+	}
+	writeDiff(w, entries)
+}
+
+// check validates the names and retention settings of a manifest
+func (m *manifest) check() error {
+	m.retention = map[string]retentionProps{}
+	for _, name := range m.Topics {
+		if err := validateResourceName("topic", name); err != nil {
+			return err
+		}
+	}
+	for _, s := range m.Subscriptions {
+		if err := validateResourceName("subscription", s.Name); err != nil {
+			return err
+		}
+		if err := validateResourceName("topic", s.Topic); err != nil {
+			return err
+		}
+		rp, err := s.retentionRequest.parse()
+		if err != nil {
+			return fmt.Errorf("subscription %s: %v", s.Name, err)
+		}
+		m.retention[s.Name] = rp
+	}
+	return nil
+}
+
+// manifestDiff lists how the project differs from a checked manifest
+func manifestDiff(ctx context.Context, client *pubsub.Client, m *manifest) ([]diffEntry, error) {
+	topics := map[string]bool{}
+	for _, name := range m.Topics {
+		topics[name] = true
+	}
+	subscrs := map[string]createSubscriptionRequest{}
+	for _, s := range m.Subscriptions {
+		subscrs[s.Name] = s
+	}
+	retention := m.retention
+	liveTopics, err := liveTopicConfigs(ctx, client)
+	if err != nil {
+		return nil, err
+	}
+	liveSubscrs, err := liveSubscriptionConfigs(ctx, client)
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []diffEntry
+	for name := range topics {
+		if _, ok := liveTopics[name]; !ok {
+			entries = append(entries, diffEntry{op: "+", kind: "topic", name: name, changes: topicDetails(pubsub.TopicConfig{Labels: demoLabels()})})
+		}
+	}
+	for name, cfg := range liveTopics {
+		if !topics[name] && cfg.Labels[demoLabel] != "" {
+			entries = append(entries, diffEntry{op: "-", kind: "topic", name: name})
+		}
+	}
+	for name, s := range subscrs {
+		live, ok := liveSubscrs[name]
+		if !ok {
+			cfg := newSubscriptionConfig(client.Topic(s.Topic))
+			cfg.Labels = withDemoLabels(s.Labels)
+			retention[name].apply(&cfg)
+			entries = append(entries, diffEntry{op: "+", kind: "subscription", name: name, changes: subscriptionDetails(cfg)})
+			continue
+		}
+		if changes := subscriptionChanges(live, s, retention[name]); len(changes) > 0 {
+			entries = append(entries, diffEntry{op: "~", kind: "subscription", name: name, changes: changes})
+		}
+	}
+	for name, cfg := range liveSubscrs {
+		if _, ok := subscrs[name]; !ok && cfg.Labels[demoLabel] != "" {
+			entries = append(entries, diffEntry{op: "-", kind: "subscription", name: name})
+		}
+	}
+	sortDiff(entries)
+	return entries, nil
+}
+
+// subscriptionChanges returns how a live subscription differs from its declaration, for the
+// fields the declaration gives
+func subscriptionChanges(live pubsub.SubscriptionConfig, s createSubscriptionRequest, rp retentionProps) []string {
+	var changes []string
+	liveTopic := detachedTopic
+	if live.Topic != nil && live.Topic.String() != detachedTopic {
+		liveTopic = live.Topic.ID()
+	}
+	if liveTopic != s.Topic {
+		changes = append(changes, fmt.Sprintf("topic: %s -> %s (recreates the subscription, losing its backlog)", liveTopic, s.Topic))
+	}
+	for _, k := range sortedKeys(s.Labels) {
+		if v, ok := live.Labels[k]; !ok {
+			changes = append(changes, fmt.Sprintf("labels.%s: (none) -> %s", k, s.Labels[k]))
+		} else if v != s.Labels[k] {
+			changes = append(changes, fmt.Sprintf("labels.%s: %s -> %s", k, v, s.Labels[k]))
+		}
+	}
+	if rp.retainAckedMessages != nil && *rp.retainAckedMessages != live.RetainAckedMessages {
+		changes = append(changes, fmt.Sprintf("retainAckedMessages: %t -> %t", live.RetainAckedMessages, *rp.retainAckedMessages))
+	}
+	if rp.retentionDuration != 0 && rp.retentionDuration != live.RetentionDuration {
+		changes = append(changes, fmt.Sprintf("retentionDuration: %s -> %s", live.RetentionDuration, rp.retentionDuration))
+	}
+	return changes
+}
+
+// sortDiff orders the entries of a diff by kind and name
+func sortDiff(entries []diffEntry) {
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].kind != entries[j].kind {
+			return entries[i].kind == "topic"
+		}
+		return entries[i].name < entries[j].name
+	})
+}
+
+// writeDiffEntries writes the entries of a diff, returning how many there are of each op
+func writeDiffEntries(w io.Writer, entries []diffEntry) map[string]int {
+	counts := map[string]int{}
+	for _, e := range entries {
+		counts[e.op]++
+		fmt.Fprintf(w, "%s %s %s\n", e.op, e.kind, e.name)
+		for _, c := range e.changes {
+			fmt.Fprintf(w, "    %s\n", c)
+		}
+	}
+	return counts
+}
+
+// writeDiff writes the entries of a diff with a summary
+func writeDiff(w http.ResponseWriter, entries []diffEntry) {
+	counts := writeDiffEntries(w, entries)
+	if len(entries) == 0 {
+		fmt.Fprintln(w, "no changes: the topics and subscriptions match the manifest")
+		return
+	}
+	fmt.Fprintf(w, "%d to create, %d to update, %d to delete (created by this service, not in the manifest)\n",
+		counts["+"], counts["~"], counts["-"])
+}
+
+// liveTopicConfigs returns the configurations of the project's topics, by name
+func liveTopicConfigs(ctx context.Context, client *pubsub.Client) (map[string]pubsub.TopicConfig, error) {
+	configs := map[string]pubsub.TopicConfig{}
+	it := client.Topics(ctx)
+	for {
+		topic, err := it.Next()
+		if err == iterator.Done {
+			return configs, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		cfg, err := topic.Config(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("topic %s: %v", topic.ID(), err)
+		}
+		configs[topic.ID()] = cfg
+	}
+}
+
+// liveSubscriptionConfigs returns the configurations of the project's subscriptions, by name
+func liveSubscriptionConfigs(ctx context.Context, client *pubsub.Client) (map[string]pubsub.SubscriptionConfig, error) {
+	configs := map[string]pubsub.SubscriptionConfig{}
+	it := client.Subscriptions(ctx)
+	for {
+		subscr, err := it.Next()
+		if err == iterator.Done {
+			return configs, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		cfg, err := subscr.Config(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("subscription %s: %v", subscr.ID(), err)
+		}
+		configs[subscr.ID()] = cfg
+	}
+}
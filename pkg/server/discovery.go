@@ -0,0 +1,514 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// The routes are documented from the router itself: GET /- returns a discovery document listing
+// every registered route with its parameters, accepted request types and schema, and GET / renders
+// the same list for humans. Only the descriptions below are written by hand; a route without one
+// is still listed.
+
+const (
+	docTitle = "Pub/Sub Demo Service"
+
+	// docUsageWidth is the width of the method and path column of the human-readable rendering
+	docUsageWidth = 36
+)
+
+// docNotes are the notes following the routes on the index page
+var docNotes = []string{
+	"Responses of 1 KiB or more are gzip-compressed for clients sending 'Accept-Encoding: gzip'.",
+	"Bulk deletes, batch creates, imports, clones and replays run as asynchronous jobs with 'Prefer: respond-async' or",
+	"?async=true: they return 202 with the job's URL in Location, GET /jobs/<job-id> reports progress and the result.",
+	"PUT, POST and DELETE requests with an 'Idempotency-Key' header are answered once; retries with the same key within",
+	"IDEMPOTENCY_WINDOW get the same response (409 while the first is in progress, 422 if the request differs).",
+	"An 'X-Request-Deadline' header (an RFC 3339 time or a duration like 2s) or 'Request-Timeout' (seconds) bounds how",
+	"long a request may take: publishes and pulls cut short by it get 504, though a pull returns what it received.",
+	"Requests with a tenant's API key (see POST /admin/keys) only reach the topic and subscription endpoints, and only",
+	"the topics and subscriptions of the tenant's namespace, named without the '<namespace>-' prefix.",
+	"Requests with a workshop token (see POST /admin/tokens) only reach the topic and subscription endpoints of the",
+	"token's verbs, and only the topics and subscriptions whose names match its pattern, until it expires.",
+	"With SMTP_PORT set, mail to <topic-name>@<domain> is published to the topic (headers as attributes, body as data).",
+	"Request bodies must be sent as application/json (unless noted otherwise), else the request gets 415. Responses are",
+	"text/plain, or with 'Accept: application/json' {\"status\":<code>, \"lines\":[...]} (or \"error\":\"<message>\"), or with",
+	"'Accept: text/event-stream' an event per line (errors as an 'error' event); other Accept types get 406.",
+	"Receives and tails streamed as events are paced by the client: a slow reader pauses the pull (or, with",
+	"SSE_OVERFLOW=nack, gets overflowing messages nacked) and gets 'lag' events saying how far behind it is.",
+	"429 and 503 responses carry a jittered Retry-After; as JSON, their \"retry\" property also gives the wait and the",
+	"backoff for further retries: {\"afterSeconds\", \"backoff\":{\"initialSeconds\", \"multiplier\", \"maxSeconds\", \"jitter\"}}.",
+	"Request bodies with unknown properties, properties of the wrong type or missing required properties get a 400",
+	"listing each offending field, like 'retentionDuration: must be a string, got integer'.",
+	"Names with characters like % or + are given escaped in paths (/topics/100%25-done); paths with empty elements, a",
+	"trailing slash (unless REDIRECT_TRAILING_SLASH=true) or more elements than a route are 404s, not nested names.",
+	"With DEBUG_ENDPOINTS=true, GET /debug/pprof/ serves runtime profiles and GET /debug/vars runtime variables",
+	"(all /debug endpoints require the admin token).",
+	"Topics and subscriptions named in paths or payloads that can't be looked up get 403 naming the missing permission",
+	"(like pubsub.topics.get) when access is denied, 404 when they don't exist and 503 with Retry-After when the",
+	"backend fails transiently.",
+	"With NAMING_POLICY_FILE set, topics and subscriptions created (also by batches and clones) must follow its naming",
+	"rules and carry their required labels, else the request gets 422 explaining the rules.",
+	"Creating, updating and deleting topics and subscriptions (one by one, in batches or in bulk) take ?dryRun=true to",
+	"preview the change: the request is validated and what would be created, changed or lost is returned, nothing changes.",
+	"The other routes changing something respond 400 to ?dryRun=true, without making the change.",
+	"GET /- returns this documentation as a JSON discovery document.",
+}
+
+// routeDoc describes a route for its documentation
+type routeDoc struct {
+	query []string // query parameters
+	lines []string // description
+}
+
+// routeDocs are the descriptions of the routes, by method and pattern
+var routeDocs = map[string]routeDoc{
+	"GET /":  {lines: []string{"this documentation"}},
+	"GET /-": {lines: []string{"this documentation as a JSON discovery document: routes with their parameters, request types and schemas"}},
+
+	"GET /topics": {lines: []string{"list topics"}},
+	"PUT /topics": {query: []string{"dryRun"}, lines: []string{`create topic;        payload: '{"name":"<topic-name>", "labels":{"<name>":"<value>", ...}}'`}},
+	"DELETE /topics": {query: []string{"match", "confirm", "dryRun"}, lines: []string{
+		"delete all topics matching the glob pattern match=<pattern>, like demo-* (without confirm=true: list them;",
+		"with TRASH_RETENTION set they go to the trash; with DELETE_CONFIRMATION=true, 428 if one has subscriptions)"}},
+	"POST /topics:batchCreate": {query: []string{"dryRun"}, lines: []string{`create topics:       payload: '[{"name":"<topic-name>"}, ...]' (concurrently, with per-item results)`}},
+	"GET /topics/{name}":       {lines: []string{"topic configuration and subscriptions, with an ETag (304 for a matching If-None-Match)"}},
+	"POST /topics/{name}": {query: []string{"deliverAfter", "encrypt", "atomic"}, lines: []string{
+		`publish messages;    payload: '["<message-1-text>", "<message-2-text>", ...]'`,
+		`                     (or '[{"data":"<message-text>", "attributes":{...}, "dedupKey":"<key>", "clientId":"<id>"}, ...]';`,
+		"                      messages whose dedupKey was published to the topic within DEDUP_WINDOW are skipped,",
+		"                      a message's clientId is echoed in its result line, '[<i>] clientId <id>: ...')",
+		"(or as application/x-ndjson, a message per line, or multipart/form-data, a message per part with its",
+		" Content-Type and file name as the contentType and filename attributes and its form name as clientId)",
+		"(with PUBLISH_POLICY_FILE set, requires an X-API-Key allowed to publish to the topic, 403 otherwise)",
+		"(429 with Retry-After when publishing is throttled, see PUBLISH_FLOW_CONTROL; 207 when some messages failed,",
+		" like those over Pub/Sub's size limits, which are skipped: the result lines tell which)",
+		"atomic=true: also check the messages against the topic's schema, publishing none if any is invalid (422)",
+		"deliverAfter=<duration>: publish messages once the delay has passed (held in a server-side delay queue;",
+		" at most the age limit of DELAY_QUEUE_LIMITS, if any)",
+		"encrypt=<key-ref>: publish messages encrypted with a fresh data key, wrapped with local:<name> (see",
+		"ENCRYPTION_KEYS) or a Cloud KMS key projects/.../cryptoKeys/<key>; received messages are decrypted",
+		"when this service has the key"}},
+	"DELETE /topics/{name}": {query: []string{"confirm", "dryRun"}, lines: []string{
+		"delete topic (with TRASH_RETENTION set: move it to the trash, detaching its subscriptions; requests for",
+		"a trashed topic get 410 until it's restored or purged)",
+		"(with DELETE_CONFIRMATION=true, a topic with subscriptions needs confirm=<token> from its delete plan, 428 otherwise)"}},
+	"GET /topics/{name}/delete-plan": {lines: []string{
+		"what deleting the topic would lose (its subscriptions are detached), with a confirmation token for the",
+		"DELETE, valid for 5 minutes"}},
+	"POST /topics/{name}/import": {lines: []string{`import messages:     payload: '{"gcsUri":"gs://<bucket>/<object>", "batchSize":<n>, "ratePerSecond":<n>}'`}},
+	"POST /topics/{name}/clone": {lines: []string{
+		`clone topic:         payload: '{"newName":"<topic-name>", "withSubscriptions":true|false,`,
+		`                              "subscriptionNames":{"<old-subscr-name>":"<new-subscr-name>", ...}}'`}},
+	"POST /topics/{name}/tap": {lines: []string{
+		"stream the messages published from now on until disconnected, a line per message (an event each with",
+		"'Accept: text/event-stream'), through a subscription created for the tap and deleted afterwards"}},
+
+	"GET /subscriptions": {lines: []string{"list subscriptions"}},
+	"PUT /subscriptions": {query: []string{"dryRun"}, lines: []string{
+		`create subscription: payload: '{"name":"<subscr-name">, "topic":"<topic-name>", "labels":{...},`,
+		`                              "retainAckedMessages":true|false, "retentionDuration":"<duration>"}'`}},
+	"DELETE /subscriptions": {query: []string{"match", "confirm", "dryRun"}, lines: []string{
+		"delete all subscriptions matching the glob pattern match=<pattern> (without confirm=true: list them;",
+		"with DELETE_CONFIRMATION=true, 428 if one has a backlog)"}},
+	"POST /subscriptions:batchCreate": {query: []string{"dryRun"}, lines: []string{`create subscriptions: payload: '[{"name":"<subscr-name>", "topic":"<topic-name>"}, ...]'`}},
+	"GET /subscriptions/{name}":       {lines: []string{"subscription configuration, with an ETag (304 for a matching If-None-Match)"}},
+	"POST /subscriptions/{name}": {query: []string{"max", "timeout", "ack", "ackDelay", "nackTimes", "dedupWindow", "session", "dedupBy", "warm", "warmSession"}, lines: []string{
+		"deprecated: receive messages like GET /subscriptions/{name}/messages (responses have a Deprecation header)"}},
+	"GET /subscriptions/{name}/messages": {query: []string{"max", "timeout", "ack", "ackDelay", "nackTimes", "dedupWindow", "session", "dedupBy", "warm", "warmSession"}, lines: []string{
+		"receive messages:    up to max=<n>, for timeout=<duration> (default 1s, up to 1m), with ack=false leaving them",
+		"                     unacked for redelivery",
+		"ackDelay=<duration>: ack deadline experiment: settle messages only after the delay (up to 10m), without",
+		"extending their ack deadline, reporting the messages redelivered as their deadline passed first",
+		"nackTimes=<n>: redelivery demo: nack each message n times, then ack it, reporting every delivery attempt",
+		"(for 30s unless timeout is given; with a dead letter policy, messages go to the dead letter topic after",
+		"maxDeliveryAttempts)",
+		"dedupWindow=<duration>&session=<session-id>[&dedupBy=<attr-name>]: suppress the messages (by message ID",
+		"or attribute) already delivered to the session",
+		"session=<session-id>: note messages delivered to the session before (how often, since when; without",
+		"dedupWindow they're still delivered), with a count of redeliveries after the messages",
+		"warm=true: keep the streaming pull open: the session ID is returned in the Warm-Session header",
+		"(sessions close after 2m without pulls)",
+		"warmSession=<session-id>: receive the messages buffered by the warm session right away"}},
+	"PATCH /subscriptions/{name}": {query: []string{"dryRun"}, lines: []string{
+		`update subscription: payload: '{"retainAckedMessages":true|false, "retentionDuration":"<duration>"}'`,
+		"(requires 'If-Match: <ETag>' of the configuration it's based on: 428 without, 412 if it changed)"}},
+	"DELETE /subscriptions/{name}": {query: []string{"confirm", "dryRun"}, lines: []string{
+		"delete subscription (with DELETE_CONFIRMATION=true, a subscription with a backlog, or whose backlog is",
+		"unknown, needs confirm=<token> from its delete plan, 428 otherwise)"}},
+	"GET /subscriptions/{name}/delete-plan": {lines: []string{
+		"what deleting the subscription would lose (its undelivered messages, per its backlog metrics), with a",
+		"confirmation token for the DELETE, valid for 5 minutes"}},
+	"GET /subscriptions/{name}/lag":    {lines: []string{"backlog, oldest unacked message age, receive rate and estimated time to drain"}},
+	"POST /subscriptions/{name}/clone": {lines: []string{`clone subscription: payload: '{"newName":"<subscr-name>", "seekToSnapshot":true|false}'`}},
+	"POST /subscriptions/{name}/ordered": {query: []string{"workers", "work"}, lines: []string{
+		"receive and process messages with one worker per ordering key (workers=per-key) or a shared pool",
+		"of workers=<n>, each taking work=<duration> per message, showing per ordering key whether messages",
+		"were processed in publish order"}},
+	"POST /subscriptions/{name}/replay": {lines: []string{
+		`seek back in time:   payload: '{"from":"<RFC 3339 time>", "pull":true|false}'`,
+		"                     (acked messages are only replayed with retainAckedMessages or topic message retention)"}},
+	"POST /subscriptions/{name}/search": {lines: []string{
+		`search the backlog:  payload: '{"query":"<text>", "regex":true|false, "jsonPath":"$.a.b", "sample":<n>, "timeout":"10s"}'`,
+		"                     (pulls up to sample messages, default 100, returning those matching; all are nacked)"}},
+	"GET /subscriptions/{name}/tail": {query: []string{"since"}, lines: []string{
+		"stream the topic's messages from since=<duration> ago (default 5m) until disconnected, a line per message",
+		"(an event each with 'Accept: text/event-stream'), through a disposable subscription; without topic message",
+		"retention the subscription's backlog is streamed instead"}},
+
+	"GET /archivers": {lines: []string{"list archivers"}},
+	"PUT /archivers": {lines: []string{
+		`create archiver:     payload: '{"name":"<archiver-name>", "subscription":"<subscr-name>", "bucket":"<bucket-name>",`,
+		`                              "prefix":"<object-prefix>", "format":"ndjson"|"avro", "maxBytes":<n>, "maxAge":"<duration>"}'`}},
+	"GET /archivers/{name}":    {lines: []string{"show archiver and objects written"}},
+	"DELETE /archivers/{name}": {lines: []string{"stop archiver (finalizes current object)"}},
+
+	"GET /sinks": {lines: []string{"list BigQuery sinks"}},
+	"PUT /sinks": {lines: []string{
+		`create sink:         payload: '{"name":"<sink-name>", "subscription":"<subscr-name>", "table":"[<project>.]<dataset>.<table>",`,
+		`                              "columns":[{"name":"<column>", "type":"STRING|INT64|FLOAT64|BOOL|BYTES|TIMESTAMP|JSON",`,
+		`                              "from":"data|messageId|publishTime|orderingKey|attributes[.<key>]|json[.<path>]"}, ...],`,
+		`                              "batchSize":<n>, "maxDelay":"<duration>"}'`,
+		"                     (streams rows through the BigQuery Storage Write API; messages are acked once written)"}},
+	"GET /sinks/{name}":    {lines: []string{"show sink and its column mapping"}},
+	"DELETE /sinks/{name}": {lines: []string{"stop sink (writes the pending rows)"}},
+
+	"GET /jobs": {lines: []string{"list asynchronous jobs and the Dataflow jobs launched here, with their current state"}},
+	"POST /jobs": {lines: []string{
+		`launch a Dataflow template: payload: '{"template":"pubsub-to-gcs"|"pubsub-to-bigquery",`,
+		`                              "topic":"<topic-name>"|"subscription":"<subscr-name>",`,
+		`                              "output":"gs://<bucket>/<dir>/"|"[<project>:]<dataset>.<table>",`,
+		`                              "jobName":"<name>", "tempLocation":"gs://<bucket>/<dir>", "parameters":{...}}'`}},
+	"GET /jobs/{id}":    {lines: []string{"show asynchronous job progress and output, or Dataflow job status"}},
+	"DELETE /jobs/{id}": {query: []string{"drain"}, lines: []string{"cancel asynchronous job, or cancel (or with drain=true drain) Dataflow job"}},
+
+	"POST /rpc/{name}": {lines: []string{
+		`request/reply:       payload: '{"data":"<request-text>", "attributes":{...}, "replyTopic":"<topic-name>", "timeout":"<duration>"}'`,
+		"                     (responders publish the reply to the replyTopic attribute, copying the correlationId attribute)"}},
+
+	"GET /schedules": {lines: []string{"list schedules"}},
+	"PUT /schedules": {lines: []string{
+		`create schedule:     payload: '{"name":"<schedule-name>", "topic":"<topic-name>", "schedule":"*/5 * * * *"|"@every 30s",`,
+		`                              "payload":"tick {{.Seq}} at {{.Time}}", "attributes":{...}}'`}},
+	"GET /schedules/{name}":         {lines: []string{"show schedule and last run status"}},
+	"DELETE /schedules/{name}":      {lines: []string{"delete schedule"}},
+	"POST /schedules/{name}/pause":  {lines: []string{"pause schedule"}},
+	"POST /schedules/{name}/resume": {lines: []string{"resume schedule"}},
+
+	"GET /delayed": {lines: []string{"list messages waiting in the delay queue, with its size against the DELAY_QUEUE_LIMITS"}},
+	"POST /replays": {lines: []string{
+		`republish logged publishes: payload: '{"topic":"<topic-name>", "from":<seq>, "to":<seq>, "since":"<RFC 3339 time>",`,
+		`                              "until":"<RFC 3339 time>", "failed":true|false, "target":"<topic-name>", "dryRun":true|false}'`,
+		"(the publish log keeps the last PUBLISH_LOG_SIZE messages published with POST /topics/{name}, numbered in",
+		" order; the selected ones are republished to their topic or target, dryRun lists them instead)"}},
+
+	"POST /diff": {lines: []string{
+		`compare a manifest with the project, changing nothing: payload: '{"topics":["<topic-name>", ...],`,
+		`                              "subscriptions":[{"name":"<subscr-name>", "topic":"<topic-name>", "labels":{...},`,
+		`                              "retainAckedMessages":true|false, "retentionDuration":"<duration>"}, ...]}'`,
+		"(the file of the shell's apply; lists the topics and subscriptions to create with their configuration, the",
+		" subscriptions to update field by field, like 'topic: <live> -> <manifest>', and those created by this",
+		" service that the manifest doesn't declare, to delete)"}},
+
+	"GET /routes": {lines: []string{"list routes"}},
+	"PUT /routes": {lines: []string{
+		`create route:        payload: '{"name":"<route-name>", "subscription":"<subscr-name>", "defaultTopic":"<topic-name>",`,
+		`                              "rules":[{"name":"<rule-name>", "attribute":"<attr-name>"|"jsonPath":"$.a.b[0]",`,
+		`                                        "equals":"<value>"|"matches":"<regexp>", "topic":"<topic-name>"}, ...]}'`}},
+	"GET /routes/{name}":    {lines: []string{"show route and per-rule counters"}},
+	"DELETE /routes/{name}": {lines: []string{"stop route"}},
+
+	"GET /priority": {lines: []string{"list priority queues"}},
+	"PUT /priority": {lines: []string{
+		`create priority queue: payload: '{"name":"<queue-name>", "levels":["high", "medium", "low"]}'`,
+		"                     (one topic <queue-name>-<level> and subscription <queue-name>-<level>-sub per level)"}},
+	"GET /priority/{name}":          {lines: []string{"show priority queue and per-level counters"}},
+	"POST /priority/{name}":         {lines: []string{`publish messages:    payload: '[{"data":"<message-text>", "priority":"<level>"}, ...]' (default: lowest level)`}},
+	"DELETE /priority/{name}":       {lines: []string{"delete priority queue with its topics and subscriptions"}},
+	"POST /priority/{name}/receive": {query: []string{"max"}, lines: []string{"receive up to max=<n> messages, draining higher priority levels first"}},
+
+	"GET /ingest": {lines: []string{"list webhook ingest routes"}},
+	"PUT /ingest": {lines: []string{
+		`create ingest route: payload: '{"name":"<route-name>", "topic":"<topic-name>",`,
+		`                              "signature":{"scheme":"github"|"stripe"|"hmac-sha256", "secret":"<secret>",`,
+		`                                           "header":"<header-name>" (hmac-sha256 only, default X-Signature)}}'`}},
+	"POST /ingest/{name}":   {lines: []string{"webhook: verifies the signature (if configured, else 401) and publishes the body to the route's topic"}},
+	"DELETE /ingest/{name}": {lines: []string{"delete ingest route"}},
+
+	"GET /outbox": {query: []string{"status"}, lines: []string{"list the most recent outbox records (status=pending|published|failed)"}},
+	"POST /outbox": {lines: []string{
+		"write outbox records (all or none), published in order by a background dispatcher:",
+		`                     payload: '[{"topic":"<topic-name>", "data":"<message-text>", "attributes":{...}}, ...]'`}},
+	"GET /outbox/{id}": {lines: []string{"show outbox record and its publish status"}},
+
+	"GET /graphql": {query: []string{"query", "variables"}, lines: []string{"GraphQL schema; with query=<query>[&variables=<json>]: run a query"}},
+	"POST /graphql": {lines: []string{
+		`GraphQL queries and mutations: payload: '{"query":"<document>", "variables":{...}, "operationName":"<name>"}'`,
+		"(subscriptions to live messages over a WebSocket on /graphql, using the graphql-transport-ws protocol)"}},
+	"GET /stomp": {lines: []string{
+		"STOMP 1.0-1.2 over WebSocket (also on /graphql with a v1x.stomp subprotocol): SEND to /topic/<topic-name>,",
+		"  SUBSCRIBE to /subscription/<subscription-name> (ack: auto|client|client-individual), ACK/NACK;",
+		"  /queue/<name> names a topic and a subscription of the same name"}},
+
+	"POST /aws": {lines: []string{
+		"SNS/SQS query API facade (requires AWS_FACADE=true), for SDKs whose endpoint is set to <service-url>/aws:",
+		"  SNS CreateTopic, ListTopics, DeleteTopic, Publish, Subscribe (Protocol=sqs, raw delivery)",
+		"  SQS CreateQueue, GetQueueUrl, ListQueues, DeleteQueue, SendMessage, ReceiveMessage, DeleteMessage,",
+		"  ChangeMessageVisibility; a queue is a subscription on a topic, both named after the queue"}},
+	"POST /aws/{account}/{name}": {lines: []string{"SQS actions on a queue URL"}},
+
+	"GET /redaction": {lines: []string{"list the redaction rules applied to messages shown in responses (see REDACTION_FILE)"}},
+	"PUT /redaction": {lines: []string{
+		"replace redaction rules (requires the admin token):",
+		`                     payload: '[{"name":"<rule-name>", "pattern":"<regexp>"|"jsonPath":"<a.b.*.c>"|"attribute":"<key>",`,
+		`                                "replacement":"<text>"}, ...]'`}},
+
+	"GET /metrics": {lines: []string{
+		"service metrics (Prometheus text format), including per-route latency histograms",
+		"and admin operations quota usage (topic/subscription create, delete and list calls",
+		"beyond ADMIN_QUOTA are held back, then fail with 429 and Retry-After; those failing",
+		"transiently are retried, see ADMIN_RETRY_ATTEMPTS, then fail with 503 and Retry-After)"}},
+	"GET /readyz": {lines: []string{
+		"readiness: 503 with Retry-After while the backend circuit breaker is open (see BREAKER_THRESHOLD),",
+		"during which requests needing the backend fail right away with 503 and Retry-After"}},
+	"GET /status": {lines: []string{"auto-refreshing overview page: uptime, throughput, routes, archivers, schedules, recent errors, configuration"}},
+	"GET /slo":    {lines: []string{"per-route compliance with the latency/error objectives (see SLO_FILE) and error budget burn rates"}},
+
+	"POST /selftest": {lines: []string{
+		"end-to-end test:     creates a temporary topic and subscription, publishes and receives a probe",
+		"                     message, cleans up and reports per-step latencies (503 if any step fails)"}},
+
+	"GET /janitor": {query: []string{"ttl"}, lines: []string{"dry run: list demo resources the janitor would delete (see JANITOR_TTL), older than ttl=<duration>"}},
+	"GET /expiring": {query: []string{"window"}, lines: []string{
+		"subscriptions expiring within window=<duration> (default EXPIRY_WINDOW) for lack of activity, as estimated",
+		"from their created-at and renewed-at labels and the messages received through this service"}},
+
+	"GET /watch": {query: []string{"kind"}, lines: []string{
+		"stream changes to topics and subscriptions until disconnected, a line per change (an event each with",
+		"'Accept: text/event-stream'), like '<time> created topic orders source=api': changes made through this",
+		"service as they happen, others found by listing the project every WATCH_INTERVAL; kind=topic|subscription"}},
+	"GET /summary": {query: []string{"backlog"}, lines: []string{
+		"health overview of the project: topic and subscription counts, the total backlog from Cloud Monitoring",
+		"(left out with backlog=false) and hygiene findings, like subscriptions without a dead-letter policy,",
+		"topics without subscriptions, detached subscriptions and names breaking the naming policy"}},
+	"GET /orphans": {query: []string{"age"}, lines: []string{
+		"subscriptions whose topic was deleted, detached subscriptions and topics without subscriptions created",
+		"over age=<duration> (default 24h) ago, excluding the trash and dead-letter topics, with a cleanup token"}},
+	"DELETE /orphans": {query: []string{"confirm", "age", "dryRun"}, lines: []string{
+		"delete the orphans a cleanup token from GET /orphans (passed as confirm=<token>, with the same age) was",
+		"issued for and that still are; orphaned topics go to the trash with TRASH_RETENTION"}},
+	"GET /drift": {query: []string{"refresh"}, lines: []string{
+		"the drift of the project from the baseline manifest found by the last check (every DRIFT_INTERVAL), or by",
+		"one made now with refresh=true: resources missing, changed, or labeled demo but not in the baseline"}},
+	"GET /drift/baseline":    {lines: []string{"the registered baseline manifest"}},
+	"PUT /drift/baseline":    {lines: []string{"register the baseline manifest the project is checked against, in the format of POST /diff"}},
+	"DELETE /drift/baseline": {lines: []string{"delete the baseline manifest, stopping the drift checks"}},
+	"GET /trash":             {lines: []string{"topics in the trash, with when they're purged (see TRASH_RETENTION) and their detached subscriptions"}},
+	"POST /trash/{name}/restore": {lines: []string{
+		"restore a trashed topic, recreating its subscriptions with their configuration (the messages they held",
+		"are lost)"}},
+	"DELETE /trash/{name}": {lines: []string{"purge a trashed topic now, deleting it and its detached subscriptions"}},
+
+	"POST /admin/reload": {lines: []string{
+		"re-read CONFIG_FILE and the policy and redaction files (like SIGHUP; requires the admin token),",
+		"reporting the settings applied and those requiring a restart"}},
+	"GET /admin/keys": {lines: []string{"list API keys (hashed) with their scopes, expiry and state (all /admin endpoints require the admin token)"}},
+	"POST /admin/keys": {lines: []string{
+		`create API key:      payload: '{"principal":"<name>", "scopes":["publish:<topic-pattern>",...], "expiresIn":"<duration>",`,
+		`                              "requiredAttributes":{"<attr-name>":"<value>|$principal",...}}'`,
+		"                     the key is shown once; send it in X-API-Key (turns the publish policy on);",
+		`                     with "namespace":"<tenant>" the key belongs to a tenant (scopes default to publish:*)`}},
+	"POST /admin/keys/{id}/rotate":  {query: []string{"grace"}, lines: []string{"replace the key, keeping the old one valid for the grace=<duration> period (default 1h)"}},
+	"POST /admin/keys/{id}/disable": {lines: []string{"disable key"}},
+	"DELETE /admin/keys/{id}":       {lines: []string{"delete key"}},
+	"GET /admin/tokens":             {lines: []string{"list workshop tokens (hashed) with their names pattern, verbs and expiry"}},
+	"POST /admin/tokens": {lines: []string{
+		`mint workshop token: payload: '{"principal":"<name>", "names":"<pattern>", "verbs":["read","create","update",`,
+		`                              "delete","publish","receive"], "expiresIn":"<duration, at most 24h, default 8h>"}'`,
+		"                     the token is shown once; send it as 'Authorization: Bearer <token>'"}},
+	"DELETE /admin/tokens/{id}": {lines: []string{"revoke workshop token"}},
+
+	"GET /usage": {query: []string{"from", "to", "account", "by"}, lines: []string{
+		"messages and bytes published and received, and admin calls, per account (tenant:<namespace>,",
+		"key:<key-id>, principal:<name>, admin or anonymous), from=<date> to=<date> in UTC (default: the",
+		"last 30 days), only of account=<account>, by=day; requires the admin token, except for tenants,",
+		"who see their own usage"}},
+
+	"GET /consumers": {lines: []string{
+		"list the warm sessions (see warm=true) with their outstanding messages; requires the admin token,",
+		"except for tenants, who see those of their subscriptions"}},
+	"GET /consumers/{id}/stats": {lines: []string{
+		"flow control of a warm session: outstanding messages and bytes against the limits, whether receiving",
+		"is paused as they're reached, pauses so far, messages received and pulls"}},
+	"GET /consumers/{id}/messages": {query: []string{"after", "limit"}, lines: []string{
+		"messages a warm session received after=<offset> (default 0, from the oldest it retains within the",
+		"CONSUMER_BUFFER_LIMITS), limit=N (default 100), each numbered by an increasing offset, without taking them",
+		"from its buffer: viewers read them independently, continuing from the 'next: after=<offset>' line"}},
+	"POST /consumers": {lines: []string{
+		`open a warm session:  payload: '{"subscription":"<subscription-name>", "numGoroutines":<1-64>, "maxConcurrency":<1-1000>}'`,
+		"with the goroutines of its streaming pull (default 10) and the messages handed to it at once, received and",
+		"not settled yet (default 100); pull with warmSession=<id>; requires the admin token, except for tenants"}},
+	"PATCH /consumers/{id}": {lines: []string{
+		`change a warm session's concurrency:  payload: '{"numGoroutines":<1-64>, "maxConcurrency":<1-1000>}'`,
+		"restarting its streaming pull, which returns the messages it buffered for redelivery"}},
+
+	"GET /debug/chaos": {lines: []string{"show fault injection settings (requires CHAOS_MODE=true)"}},
+	"PUT /debug/chaos": {lines: []string{
+		`inject faults:       payload: '{"enabled":true, "latency":"<duration>", "jitter":"<duration>", "errorRate":<0-1>,`,
+		`                              "duplicateRate":<0-1>, "pathPrefix":"<url-path-prefix>"}'`}},
+	"DELETE /debug/chaos": {lines: []string{"stop injecting faults"}},
+}
+
+// routeSchemas are the schemas of the request bodies validated against one, by route
+var routeSchemas = map[string]*jsonSchema{
+	"PUT /topics":                       createTopicSchema,
+	"POST /topics:batchCreate":          {Type: "array", Items: createTopicSchema},
+	"POST /topics/{name}/import":        topicImportSchema,
+	"POST /topics/{name}/clone":         topicCloneSchema,
+	"PUT /subscriptions":                createSubscriptionSchema,
+	"POST /subscriptions:batchCreate":   {Type: "array", Items: batchSubscriptionSchema},
+	"POST /diff":                        manifestSchema,
+	"PUT /drift/baseline":               manifestSchema,
+	"POST /admin/tokens":                createTokenSchema,
+	"POST /consumers":                   createConsumerSchema,
+	"PATCH /consumers/{id}":             updateConsumerSchema,
+	"PATCH /subscriptions/{name}":       updateSubscriptionSchema,
+	"POST /subscriptions/{name}/clone":  subscriptionCloneSchema,
+	"POST /subscriptions/{name}/search": searchSchema,
+	"POST /rpc/{name}":                  rpcSchema,
+	"PUT /archivers":                    archiverSchema,
+	"PUT /schedules":                    createScheduleSchema,
+	"PUT /routes":                       routeSchema,
+	"PUT /priority":                     createPriorityQueueSchema,
+	"POST /priority/{name}":             publishPrioritySchema,
+	"POST /outbox":                      writeOutboxSchema,
+	"PUT /ingest":                       createIngestRouteSchema,
+	"PUT /debug/chaos":                  chaosSchema,
+	"PUT /redaction":                    redactionRulesSchema,
+	"PUT /sinks":                        createSinkSchema,
+	"POST /jobs":                        launchJobSchema,
+	"POST /subscriptions/{name}/replay": subscriptionReplaySchema,
+	"POST /admin/keys":                  createKeySchema,
+}
+
+// discoveryParameter is a path or query parameter of a route
+type discoveryParameter struct {
+	Name     string `json:"name"`
+	In       string `json:"in"` // path or query
+	Required bool   `json:"required,omitempty"`
+}
+
+// discoveryRoute is a route of the discovery document
+type discoveryRoute struct {
+	Method        string               `json:"method"`
+	Path          string               `json:"path"`
+	Href          string               `json:"href"` // URI template (RFC 6570) of the route's URLs
+	Description   string               `json:"description,omitempty"`
+	Parameters    []discoveryParameter `json:"parameters,omitempty"`
+	RequestTypes  []string             `json:"requestTypes,omitempty"`
+	RequestSchema *jsonSchema          `json:"requestSchema,omitempty"`
+	ResponseTypes []string             `json:"responseTypes,omitempty"`
+}
+
+// href returns the URI template of the route's URLs, with its query parameters
+func (route apiRoute) href() string {
+	href := route.pattern
+	if q := routeDocs[route.method+" "+route.pattern].query; len(q) > 0 {
+		href += "{?" + strings.Join(q, ",") + "}"
+	}
+	return href
+}
+
+// discovery describes the route for the discovery document
+func (route apiRoute) discovery() discoveryRoute {
+	key := route.method + " " + route.pattern
+	rd := routeDocs[key]
+	// the alignment of the human-readable rendering is of no use here
+	lines := make([]string, len(rd.lines))
+	for i, line := range rd.lines {
+		lines[i] = strings.Join(strings.Fields(line), " ")
+	}
+	d := discoveryRoute{
+		Method:        route.method,
+		Path:          route.pattern,
+		Href:          route.href(),
+		Description:   strings.Join(lines, "\n"),
+		RequestSchema: routeSchemas[key],
+		ResponseTypes: responseTypes,
+	}
+	for _, seg := range route.segments {
+		if strings.HasPrefix(seg, "{") && strings.HasSuffix(seg, "}") {
+			d.Parameters = append(d.Parameters, discoveryParameter{Name: seg[1 : len(seg)-1], In: "path", Required: true})
+		}
+	}
+	for _, q := range rd.query {
+		d.Parameters = append(d.Parameters, discoveryParameter{Name: q, In: "query"})
+	}
+	if route.method != http.MethodGet && route.method != http.MethodDelete {
+		if types, ok := routeBodyTypes[key]; ok {
+			d.RequestTypes = types
+		} else {
+			d.RequestTypes = []string{mediaJSON}
+		}
+	}
+	if ownResponseTypeRoutes[key] {
+		d.ResponseTypes = nil
+	}
+	return d
+}
+
+// discoveryHandler handles GET to /-, returning the discovery document of the routes
+func (m *apiMux) discoveryHandler(w http.ResponseWriter, r *http.Request) {
+	doc := struct {
+		Name   string            `json:"name"`
+		Links  map[string]string `json:"links"`
+		Routes []discoveryRoute  `json:"routes"`
+		Notes  []string          `json:"notes"`
+	}{Name: docTitle, Links: map[string]string{"self": "/-", "index": "/"}, Notes: docNotes}
+	for _, route := range m.routes {
+		doc.Routes = append(doc.Routes, route.discovery())
+	}
+	w.Header().Set("Content-Type", mediaJSON)
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.SetEscapeHTML(false)
+	enc.Encode(doc)
+}
+
+// indexHandler handles GET to /, rendering the routes and their descriptions for humans
+func (m *apiMux) indexHandler(w http.ResponseWriter, r *http.Request) {
+	fmt.Fprintln(w, docTitle)
+	fmt.Fprintln(w, strings.Repeat("-", len(docTitle)))
+	group := ""
+	for _, route := range m.routes {
+		// a blank line separates the routes of each top-level path element
+		g := strings.SplitN(strings.TrimPrefix(route.pattern, "/"), "/", 2)[0]
+		g = strings.SplitN(g, ":", 2)[0]
+		if group != "" && g != group {
+			fmt.Fprintln(w)
+		}
+		group = g
+
+		usage := fmt.Sprintf("%-6s %s", route.method, route.href())
+		lines := routeDocs[route.method+" "+route.pattern].lines
+		if len(lines) == 0 {
+			fmt.Fprintln(w, usage)
+			continue
+		}
+		if len(usage) < docUsageWidth {
+			usage += strings.Repeat(" ", docUsageWidth-len(usage))
+		} else {
+			usage += " "
+		}
+		fmt.Fprintf(w, "%s# %s\n", usage, lines[0])
+		for _, line := range lines[1:] {
+			fmt.Fprintf(w, "%s# %s\n", strings.Repeat(" ", docUsageWidth), line)
+		}
+	}
+	fmt.Fprintln(w)
+	for _, note := range docNotes {
+		fmt.Fprintln(w, note)
+	}
+}
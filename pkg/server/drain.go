@@ -0,0 +1,117 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// On shutdown the streaming responses, /watch, tails and taps, receives and the STOMP and GraphQL
+// WebSocket sessions, are drained before the HTTP server shuts down: Drain tells them the server
+// is shutting down, so that they end with a final "server shutting down" line (a "shutdown" event
+// for server-sent events, an ERROR frame for STOMP, an error per operation for GraphQL) and close
+// cleanly, and waits up to DRAIN_WINDOW for them. Streams opened while draining get 503.
+
+const (
+	defaultDrainWindow = 5 * time.Second
+
+	// drainPoll is how often Drain checks whether the streams have ended
+	drainPoll = 20 * time.Millisecond
+
+	// shutdownNotice ends the streams drained on shutdown
+	shutdownNotice = "server shutting down: reconnect to resume"
+)
+
+// streams are the open streaming responses
+var streams = struct {
+	sync.Mutex
+	draining bool
+	stop     chan struct{} // closed when draining starts
+	open     int
+}{stop: make(chan struct{})}
+
+// beginStream registers a streaming response, returning the function ending it; while draining it
+// responds 503 and returns false instead
+func beginStream(w http.ResponseWriter) (func(), bool) {
+	streams.Lock()
+	defer streams.Unlock()
+	if streams.draining {
+		http.Error(w, "server shutting down", http.StatusServiceUnavailable)
+		return nil, false
+	}
+	streams.open++
+	return func() {
+		streams.Lock()
+		streams.open--
+		streams.Unlock()
+	}, true
+}
+
+// drainSignal returns the channel closed when the streams are to end
+func drainSignal() <-chan struct{} {
+	streams.Lock()
+	defer streams.Unlock()
+	return streams.stop
+}
+
+// draining reports whether the streams are to end
+func draining() bool {
+	select {
+	case <-drainSignal():
+		return true
+	default:
+		return false
+	}
+}
+
+// withDrain returns a context derived from ctx that also ends when the streams are to end
+func withDrain(ctx context.Context) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(ctx)
+	stop := drainSignal()
+	go func() {
+		select {
+		case <-stop:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	return ctx, cancel
+}
+
+// writeShutdownNotice ends a streaming response drained on shutdown, as a "shutdown" event if
+// it's an event stream
+func writeShutdownNotice(w http.ResponseWriter) {
+	if ew := eventStreamWriter(w); ew != nil {
+		ew.writeEvents("shutdown", []byte(shutdownNotice))
+		flushResponse(ew)
+		return
+	}
+	fmt.Fprintln(w, shutdownNotice)
+	flushResponse(w)
+}
+
+// Drain tells the streaming responses that the server is shutting down and waits for them to end,
+// up to DRAIN_WINDOW (5s by default); call it before shutting the HTTP server down, which doesn't
+// wait for WebSocket sessions and would cut the other streams at its timeout. It returns the
+// number of streams still open.
+func Drain() int {
+	streams.Lock()
+	if !streams.draining {
+		streams.draining = true
+		close(streams.stop)
+	}
+	streams.Unlock()
+
+	deadline := time.Now().Add(envDuration("DRAIN_WINDOW", defaultDrainWindow))
+	for {
+		streams.Lock()
+		open := streams.open
+		streams.Unlock()
+		if open == 0 || !time.Now().Before(deadline) {
+			return open
+		}
+		time.Sleep(drainPoll)
+	}
+}
@@ -0,0 +1,347 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/pubsub"
+)
+
+// A baseline manifest, registered with PUT /drift/baseline in the format of POST /diff, is what
+// the project should look like. Every DRIFT_INTERVAL the leader compares the project with it, like
+// POST /diff does, and GET /drift reports the drift found last: resources missing, changed, or
+// created by this service (labeled demo) but not in the baseline. The drift is also exposed as
+// metrics and, with DRIFT_TOPIC set, published to that topic as an event whenever it changes,
+// including when it's resolved.
+
+const (
+	defaultDriftInterval = 5 * time.Minute
+
+	// driftCheckTimeout bounds a comparison of the project with the baseline
+	driftCheckTimeout = time.Minute
+
+	driftResourcesMetric = "second_drift_resources"
+	driftCheckedMetric   = "second_drift_last_check_timestamp_seconds"
+
+	// baselineKey is the key of the baseline in its bucket of the state store
+	baselineKey = "baseline"
+)
+
+// driftBaseline is the registered baseline manifest
+type driftBaseline struct {
+	Manifest     manifest  `json:"manifest"`
+	RegisteredAt time.Time `json:"registeredAt"`
+}
+
+// drift holds the baseline and the result of the last comparison with it
+var drift = struct {
+	sync.Mutex
+	interval    time.Duration
+	topic       string // DRIFT_TOPIC, where drift events are published
+	baseline    *driftBaseline
+	lastCheck   time.Time
+	entries     []diffEntry // the drift found by the last check
+	fingerprint string      // of entries, to tell when the drift changes
+	err         string      // of the last check
+	published   int
+}{}
+
+// driftEvent is the message published to DRIFT_TOPIC when the drift changes
+type driftEvent struct {
+	CheckedAt  time.Time        `json:"checkedAt"`
+	Baseline   time.Time        `json:"baselineRegisteredAt"`
+	Resolved   bool             `json:"resolved"`
+	Missing    int              `json:"missing"`
+	Changed    int              `json:"changed"`
+	Unexpected int              `json:"unexpected"`
+	Drift      []driftEventItem `json:"drift,omitempty"`
+}
+
+type driftEventItem struct {
+	Change  string   `json:"change"` // missing, changed or unexpected
+	Kind    string   `json:"kind"`
+	Name    string   `json:"name"`
+	Details []string `json:"details,omitempty"`
+}
+
+// driftChanges names the ops of a diff's entries as drift from the baseline
+var driftChanges = map[string]string{"+": "missing", "~": "changed", "-": "unexpected"}
+
+// startDrift reads the drift settings, loads the baseline from the state store and starts
+// comparing the project with it, unless DRIFT_INTERVAL is 0
+func startDrift() {
+	drift.Lock()
+	defer drift.Unlock()
+	drift.interval = defaultDriftInterval
+	if s := setting("DRIFT_INTERVAL"); s != "" {
+		if d, err := time.ParseDuration(s); err != nil || d < 0 {
+			log.Printf("drift: invalid DRIFT_INTERVAL %q, using %s", s, defaultDriftInterval)
+		} else {
+			drift.interval = d
+		}
+	}
+	drift.topic = setting("DRIFT_TOPIC")
+	drift.baseline = nil
+	stateLoad(baselineBucket, func(key string, data []byte) error {
+		b := &driftBaseline{}
+		if err := json.Unmarshal(data, b); err != nil {
+			return err
+		}
+		if err := b.Manifest.check(); err != nil {
+			return err
+		}
+		drift.baseline = b
+		return nil
+	})
+	if drift.interval == 0 {
+		return
+	}
+	interval := drift.interval
+	go func() {
+		for {
+			// with several replicas, the leader checks the drift
+			if isLeader() {
+				if err := checkDrift(); err != nil {
+					log.Printf("drift: %v", err)
+				}
+			}
+			time.Sleep(interval)
+		}
+	}()
+}
+
+// checkDrift compares the project with the baseline once, if one is registered, recording the
+// drift and publishing it if it changed
+func checkDrift() error {
+	drift.Lock()
+	b, topicName := drift.baseline, drift.topic
+	drift.Unlock()
+	if b == nil {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), driftCheckTimeout)
+	defer cancel()
+	client, err := pubsub.NewClient(ctx, setting("GOOGLE_CLOUD_PROJECT"), backendOptions()...)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+	entries, err := func() ([]diffEntry, error) {
+		if err := waitAdminQuota(ctx, adminOpList); err != nil {
+			return nil, err
+		}
+		return manifestDiff(ctx, client, &b.Manifest)
+	}()
+
+	drift.Lock()
+	if drift.baseline != b {
+		// replaced or removed while comparing
+		drift.Unlock()
+		return nil
+	}
+	drift.lastCheck = time.Now()
+	if err != nil {
+		drift.err = err.Error()
+		drift.Unlock()
+		return err
+	}
+	drift.err = ""
+	fingerprint := driftFingerprint(entries)
+	changed := fingerprint != drift.fingerprint
+	drift.entries, drift.fingerprint = entries, fingerprint
+	event := newDriftEvent(drift.lastCheck, b, entries)
+	drift.Unlock()
+
+	gaugeSet(driftCheckedMetric, "When the project was last compared with the baseline manifest.", float64(event.CheckedAt.Unix()))
+	for op, change := range driftChanges {
+		n := 0
+		for _, e := range entries {
+			if e.op == op {
+				n++
+			}
+		}
+		gaugeSet(driftResourcesMetric, "Topics and subscriptions drifting from the baseline manifest, by change.", float64(n), "change", change)
+	}
+	if !changed || topicName == "" {
+		return nil
+	}
+	data, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	topic := client.Topic(topicName)
+	defer topic.Stop()
+	state := "detected"
+	if event.Resolved {
+		state = "resolved"
+	}
+	_, err = topic.Publish(ctx, &pubsub.Message{Data: data, Attributes: map[string]string{"event": "drift", "drift": state}}).Get(ctx)
+	drift.Lock()
+	defer drift.Unlock()
+	if err != nil {
+		// the drift is recorded all the same, and published with the next change
+		drift.err = fmt.Sprintf("publishing the drift to topic %s: %v", topicName, err)
+		log.Printf("drift: %s", drift.err)
+		return nil
+	}
+	drift.published++
+	return nil
+}
+
+// driftFingerprint identifies a drift, to tell when it changes
+func driftFingerprint(entries []diffEntry) string {
+	var b strings.Builder
+	for _, e := range entries {
+		fmt.Fprintf(&b, "%s %s %s %s\n", e.op, e.kind, e.name, strings.Join(e.changes, "; "))
+	}
+	return b.String()
+}
+
+// newDriftEvent returns the event reporting a drift
+func newDriftEvent(checkedAt time.Time, b *driftBaseline, entries []diffEntry) driftEvent {
+	event := driftEvent{CheckedAt: checkedAt, Baseline: b.RegisteredAt, Resolved: len(entries) == 0}
+	for _, e := range entries {
+		item := driftEventItem{Change: driftChanges[e.op], Kind: e.kind, Name: e.name}
+		if e.op == "~" {
+			item.Details = e.changes
+		}
+		event.Drift = append(event.Drift, item)
+		switch e.op {
+		case "+":
+			event.Missing++
+		case "~":
+			event.Changed++
+		case "-":
+			event.Unexpected++
+		}
+	}
+	return event
+}
+
+// putBaselineHandler handles PUT to /drift/baseline, registering the baseline manifest
+func putBaselineHandler(w http.ResponseWriter, r *http.Request) {
+	// get the manifest from body, in the format of POST /diff
+	var m manifest
+	if !readRequest(w, r, manifestSchema, &m) {
+		return
+	}
+	if err := m.check(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	b := &driftBaseline{Manifest: m, RegisteredAt: time.Now().UTC()}
+	drift.Lock()
+	drift.baseline = b
+	drift.lastCheck, drift.entries, drift.fingerprint, drift.err = time.Time{}, nil, "", ""
+	interval := drift.interval
+	drift.Unlock()
+	statePut(baselineBucket, baselineKey, b)
+
+	fmt.Fprintf(w, "registered a baseline of %d topics and %d subscriptions", len(m.Topics), len(m.Subscriptions))
+	if interval == 0 {
+		fmt.Fprintln(w, "; DRIFT_INTERVAL is 0, check it with GET /drift?refresh=true")
+		return
+	}
+	fmt.Fprintf(w, ", checked every %s\n", interval)
+}
+
+// getBaselineHandler handles GET to /drift/baseline
+func getBaselineHandler(w http.ResponseWriter, r *http.Request) {
+	drift.Lock()
+	b := drift.baseline
+	drift.Unlock()
+	if b == nil {
+		http.Error(w, "no baseline registered: register one with PUT /drift/baseline", http.StatusNotFound)
+		return
+	}
+	fmt.Fprintf(w, "Baseline registered at %s\n", b.RegisteredAt.Format(time.RFC3339))
+	for _, name := range b.Manifest.Topics {
+		fmt.Fprintf(w, "topic %s\n", name)
+	}
+	for _, s := range b.Manifest.Subscriptions {
+		line := fmt.Sprintf("subscription %s on topic %s", s.Name, s.Topic)
+		if len(s.Labels) > 0 {
+			line += " labels " + formatLabels(s.Labels)
+		}
+		fmt.Fprintln(w, line)
+	}
+}
+
+// deleteBaselineHandler handles DELETE to /drift/baseline, which stops the drift checks
+func deleteBaselineHandler(w http.ResponseWriter, r *http.Request) {
+	drift.Lock()
+	b := drift.baseline
+	drift.baseline = nil
+	drift.lastCheck, drift.entries, drift.fingerprint, drift.err = time.Time{}, nil, "", ""
+	drift.Unlock()
+	if b == nil {
+		http.Error(w, "no baseline registered", http.StatusNotFound)
+		return
+	}
+	stateDelete(baselineBucket, baselineKey)
+	for _, change := range driftChanges {
+		gaugeDelete(driftResourcesMetric, "change", change)
+	}
+	fmt.Fprintln(w, "deleted the baseline; drift is no longer checked")
+}
+
+// driftHandler handles GET to /drift[?refresh=true], reporting the drift found by the last check,
+// or by a check made now with refresh=true
+func driftHandler(w http.ResponseWriter, r *http.Request) {
+	switch s := r.URL.Query().Get("refresh"); s {
+	case "", "false":
+	case "true":
+		if err := checkDrift(); err != nil {
+			writeAdminError(w, err, http.StatusInternalServerError)
+			return
+		}
+	default:
+		http.Error(w, "refresh must be true or false", http.StatusBadRequest)
+		return
+	}
+	drift.Lock()
+	defer drift.Unlock()
+	if drift.baseline == nil {
+		http.Error(w, "no baseline registered: register one with PUT /drift/baseline", http.StatusNotFound)
+		return
+	}
+	writeDriftStatusLocked(w)
+	if drift.lastCheck.IsZero() {
+		fmt.Fprintln(w, "not checked yet (check now with refresh=true)")
+		return
+	}
+	counts := writeDiffEntries(w, drift.entries)
+	if len(drift.entries) == 0 {
+		fmt.Fprintln(w, "no drift: the topics and subscriptions match the baseline")
+		return
+	}
+	fmt.Fprintf(w, "drift: %d missing, %d changed, %d unexpected (created by this service, not in the baseline)\n",
+		counts["+"], counts["~"], counts["-"])
+}
+
+// writeDriftStatusLocked reports the drift checks' configuration and last run
+func writeDriftStatusLocked(w io.Writer) {
+	fmt.Fprintf(w, "baseline registered at %s", drift.baseline.RegisteredAt.Format(time.RFC3339))
+	if drift.interval == 0 {
+		fmt.Fprint(w, ", not checked periodically (DRIFT_INTERVAL=0)")
+	} else {
+		fmt.Fprintf(w, ", checked every %s", drift.interval)
+	}
+	if !drift.lastCheck.IsZero() {
+		fmt.Fprintf(w, " lastCheck=%s", drift.lastCheck.Format(time.RFC3339))
+	}
+	if drift.topic != "" {
+		fmt.Fprintf(w, " topic=%s published=%d", drift.topic, drift.published)
+	}
+	fmt.Fprintln(w)
+	if drift.err != "" {
+		fmt.Fprintf(w, "    last check error: %s\n", drift.err)
+	}
+}
@@ -0,0 +1,93 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// The endpoints creating, updating and deleting topics and subscriptions take ?dryRun=true to
+// preview a change: the request is validated and the configuration it would create or the changes
+// it would make are computed and returned, but nothing is changed. The backend is only read, to
+// tell what exists. Other routes changing something respond 400 to ?dryRun=true rather than
+// make the change for real.
+
+// dryRunRequested reports whether the request asks for a dry run, responding 400 to an invalid
+// dryRun and returning false as its second result
+func dryRunRequested(w http.ResponseWriter, r *http.Request) (bool, bool) {
+	switch s := r.URL.Query().Get("dryRun"); s {
+	case "", "false":
+		return false, true
+	case "true":
+		return true, true
+	default:
+		http.Error(w, "dryRun must be true or false", http.StatusBadRequest)
+		return false, false
+	}
+}
+
+// checkDryRun responds 400 to a dry run of a route changing something that can't preview its
+// changes (those documented with a dryRun parameter can), returning false
+func checkDryRun(route apiRoute, w http.ResponseWriter, r *http.Request) bool {
+	switch r.URL.Query().Get("dryRun") {
+	case "", "false":
+		return true
+	}
+	routeKey := route.method + " " + route.pattern
+	if route.method == http.MethodGet || route.method == http.MethodHead || containsString(routeDocs[routeKey].query, "dryRun") {
+		return true
+	}
+	http.Error(w, fmt.Sprintf("%s doesn't support dryRun: nothing was changed", routeKey), http.StatusBadRequest)
+	return false
+}
+
+// writeDryRun writes what a dry run would do, with details like the configuration it would create
+func writeDryRun(w http.ResponseWriter, action string, details []string) {
+	fmt.Fprintf(w, "dry run, nothing changed: would %s\n", action)
+	for _, d := range details {
+		fmt.Fprintf(w, "  %s\n", d)
+	}
+}
+
+// configChanges returns the "key: old -> new" changes between two configurations' "key: value" details
+func configChanges(before, after []string) []string {
+	old := map[string]string{}
+	for _, d := range before {
+		key, value := splitDetail(d)
+		old[key] = value
+	}
+	var changes []string
+	for _, d := range after {
+		key, value := splitDetail(d)
+		if prev, ok := old[key]; !ok {
+			changes = append(changes, fmt.Sprintf("%s: (none) -> %s", key, value))
+		} else if prev != value {
+			changes = append(changes, fmt.Sprintf("%s: %s -> %s", key, prev, value))
+		}
+	}
+	return changes
+}
+
+// splitDetail splits a "key: value" detail line
+func splitDetail(d string) (string, string) {
+	if i := strings.Index(d, ": "); i >= 0 {
+		return d[:i], d[i+2:]
+	}
+	return d, ""
+}
+
+// dryRunCreatable checks that a topic or subscription a dry run would create doesn't exist yet,
+// responding 409 if it does, or with the error of the lookup
+func dryRunCreatable(ctx context.Context, w http.ResponseWriter, kind, name string, exists func(context.Context) (bool, error)) bool {
+	ok, err := exists(ctx)
+	if err != nil {
+		writeLookupError(w, &lookupError{kind: kind, name: name, err: err})
+		return false
+	}
+	if ok {
+		http.Error(w, fmt.Sprintf("%s %s already exists", kind, name), http.StatusConflict)
+		return false
+	}
+	return true
+}
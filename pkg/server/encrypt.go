@@ -0,0 +1,247 @@
+package server
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/pubsub"
+	cloudkms "google.golang.org/api/cloudkms/v1"
+)
+
+// Envelope encryption: a message published with ?encrypt=<key-ref> has its data encrypted with a
+// fresh AES-256-GCM data key, which is itself encrypted ("wrapped") with the referenced key and
+// carried in the message's attributes. The key reference is either local:<name>, naming one of
+// the ENCRYPTION_KEYS, or a Cloud KMS key's resource name projects/.../cryptoKeys/<key>.
+// Received messages are decrypted when this service has the key, and shown encrypted otherwise.
+
+const (
+	encryptionAttr    = "encryption"
+	encryptionKeyAttr = "encryptionKey"
+	wrappedKeyAttr    = "encryptedDataKey"
+
+	encryptionAlgorithm = "aes256-gcm"
+	localKeyPrefix      = "local:"
+
+	// maxUnwrappedKeys bounds the cache of data keys unwrapped with Cloud KMS
+	maxUnwrappedKeys = 1000
+)
+
+// unwrappedKeys caches data keys unwrapped with Cloud KMS, by wrapped key, so that receiving a
+// batch encrypted with one data key doesn't call KMS for each message
+var unwrappedKeys = struct {
+	sync.Mutex
+	m map[string][]byte
+}{m: map[string][]byte{}}
+
+// localEncryptionKey returns a key of ENCRYPTION_KEYS, given as <name>=<base64 32-byte key>,...
+func localEncryptionKey(name string) ([]byte, error) {
+	for _, entry := range strings.Split(setting("ENCRYPTION_KEYS"), ",") {
+		i := strings.IndexByte(entry, '=')
+		if i < 0 || strings.TrimSpace(entry[:i]) != name {
+			continue
+		}
+		key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(entry[i+1:]))
+		if err != nil || len(key) != 32 {
+			return nil, fmt.Errorf("encryption key %s is not a base64-encoded 32-byte key", name)
+		}
+		return key, nil
+	}
+	return nil, fmt.Errorf("encryption key %s is not configured in ENCRYPTION_KEYS", name)
+}
+
+// validateKeyRef checks that a key reference is local:<name> or a Cloud KMS key resource name
+func validateKeyRef(keyRef string) error {
+	if strings.HasPrefix(keyRef, localKeyPrefix) {
+		_, err := localEncryptionKey(strings.TrimPrefix(keyRef, localKeyPrefix))
+		return err
+	}
+	parts := strings.Split(keyRef, "/")
+	if len(parts) != 8 || parts[0] != "projects" || parts[2] != "locations" || parts[4] != "keyRings" || parts[6] != "cryptoKeys" {
+		return fmt.Errorf("encryption key must be local:<name> or projects/<project>/locations/<location>/keyRings/<ring>/cryptoKeys/<key>")
+	}
+	return nil
+}
+
+// encryptMessage encrypts a message's data in place, adding the attributes needed to decrypt it
+func encryptMessage(ctx context.Context, keyRef string, msg *pubsub.Message) error {
+	dataKey := make([]byte, 32)
+	if _, err := rand.Read(dataKey); err != nil {
+		return err
+	}
+	sealed, err := sealAESGCM(dataKey, msg.Data, nil)
+	if err != nil {
+		return err
+	}
+	wrapped, err := wrapDataKey(ctx, keyRef, dataKey)
+	if err != nil {
+		return err
+	}
+	if msg.Attributes == nil {
+		msg.Attributes = map[string]string{}
+	}
+	msg.Data = sealed
+	msg.Attributes[encryptionAttr] = encryptionAlgorithm
+	msg.Attributes[encryptionKeyAttr] = keyRef
+	msg.Attributes[wrappedKeyAttr] = base64.StdEncoding.EncodeToString(wrapped)
+	return nil
+}
+
+// decryptMessage returns a copy of an encrypted message with its data decrypted and the encryption
+// attributes removed; messages that aren't encrypted are returned as they are
+func decryptMessage(ctx context.Context, msg *pubsub.Message) (*pubsub.Message, error) {
+	algorithm, ok := msg.Attributes[encryptionAttr]
+	if !ok {
+		return msg, nil
+	}
+	if algorithm != encryptionAlgorithm {
+		return nil, fmt.Errorf("unsupported encryption %q", algorithm)
+	}
+	keyRef := msg.Attributes[encryptionKeyAttr]
+	wrapped, err := base64.StdEncoding.DecodeString(msg.Attributes[wrappedKeyAttr])
+	if err != nil {
+		return nil, fmt.Errorf("malformed %s attribute", wrappedKeyAttr)
+	}
+	dataKey, err := unwrapDataKey(ctx, keyRef, wrapped)
+	if err != nil {
+		return nil, err
+	}
+	data, err := openAESGCM(dataKey, msg.Data, nil)
+	if err != nil {
+		return nil, err
+	}
+	attrs := make(map[string]string, len(msg.Attributes))
+	for k, v := range msg.Attributes {
+		switch k {
+		case encryptionAttr, encryptionKeyAttr, wrappedKeyAttr:
+		default:
+			attrs[k] = v
+		}
+	}
+	decrypted := *msg
+	decrypted.Data = data
+	decrypted.Attributes = attrs
+	return &decrypted, nil
+}
+
+// wrapDataKey encrypts a data key with the referenced key
+func wrapDataKey(ctx context.Context, keyRef string, dataKey []byte) ([]byte, error) {
+	if strings.HasPrefix(keyRef, localKeyPrefix) {
+		key, err := localEncryptionKey(strings.TrimPrefix(keyRef, localKeyPrefix))
+		if err != nil {
+			return nil, err
+		}
+		return sealAESGCM(key, dataKey, []byte(keyRef))
+	}
+	svc, err := cloudkms.NewService(ctx)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := svc.Projects.Locations.KeyRings.CryptoKeys.Encrypt(keyRef, &cloudkms.EncryptRequest{
+		Plaintext: base64.StdEncoding.EncodeToString(dataKey),
+	}).Context(ctx).Do()
+	if err != nil {
+		return nil, fmt.Errorf("kms encrypt: %v", err)
+	}
+	return base64.StdEncoding.DecodeString(resp.Ciphertext)
+}
+
+// unwrapDataKey decrypts a data key with the referenced key
+func unwrapDataKey(ctx context.Context, keyRef string, wrapped []byte) ([]byte, error) {
+	if strings.HasPrefix(keyRef, localKeyPrefix) {
+		key, err := localEncryptionKey(strings.TrimPrefix(keyRef, localKeyPrefix))
+		if err != nil {
+			return nil, err
+		}
+		return openAESGCM(key, wrapped, []byte(keyRef))
+	}
+	if err := validateKeyRef(keyRef); err != nil {
+		return nil, err
+	}
+	cacheKey := keyRef + "/" + string(wrapped)
+	unwrappedKeys.Lock()
+	dataKey, ok := unwrappedKeys.m[cacheKey]
+	unwrappedKeys.Unlock()
+	if ok {
+		return dataKey, nil
+	}
+
+	svc, err := cloudkms.NewService(ctx)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := svc.Projects.Locations.KeyRings.CryptoKeys.Decrypt(keyRef, &cloudkms.DecryptRequest{
+		Ciphertext: base64.StdEncoding.EncodeToString(wrapped),
+	}).Context(ctx).Do()
+	if err != nil {
+		return nil, fmt.Errorf("kms decrypt: %v", err)
+	}
+	if dataKey, err = base64.StdEncoding.DecodeString(resp.Plaintext); err != nil {
+		return nil, err
+	}
+	unwrappedKeys.Lock()
+	if len(unwrappedKeys.m) >= maxUnwrappedKeys {
+		unwrappedKeys.m = map[string][]byte{}
+	}
+	unwrappedKeys.m[cacheKey] = dataKey
+	unwrappedKeys.Unlock()
+	return dataKey, nil
+}
+
+// sealAESGCM encrypts with AES-GCM, prefixing the ciphertext with its random nonce
+func sealAESGCM(key, plaintext, additional []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize(), gcm.NonceSize()+len(plaintext)+gcm.Overhead())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return gcm.Seal(nonce, nonce, plaintext, additional), nil
+}
+
+// openAESGCM decrypts what sealAESGCM encrypted
+func openAESGCM(key, sealed, additional []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	if len(sealed) < gcm.NonceSize() {
+		return nil, fmt.Errorf("ciphertext too short")
+	}
+	plaintext, err := gcm.Open(nil, sealed[:gcm.NonceSize()], sealed[gcm.NonceSize():], additional)
+	if err != nil {
+		return nil, fmt.Errorf("decryption failed: wrong key or tampered message")
+	}
+	return plaintext, nil
+}
+
+// decryptForDisplay decrypts a received message for a response, with a bounded wait for Cloud KMS;
+// messages that can't be decrypted are returned encrypted, with the reason
+func decryptForDisplay(msg *pubsub.Message) (*pubsub.Message, error) {
+	if _, ok := msg.Attributes[encryptionAttr]; !ok {
+		return msg, nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	decrypted, err := decryptMessage(ctx, msg)
+	if err != nil {
+		return msg, err
+	}
+	return decrypted, nil
+}
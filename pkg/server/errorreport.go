@@ -0,0 +1,163 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"runtime/debug"
+	"strconv"
+	"sync"
+	"time"
+
+	clouderrorreporting "google.golang.org/api/clouderrorreporting/v1beta1"
+)
+
+const (
+	defaultErrorReportingThreshold = 5
+
+	// errorReportingWindow is the period server errors of a route are counted over; a route
+	// is reported at most once per window
+	errorReportingWindow = time.Minute
+
+	// maxReportedErrorBody bounds how much of an error response is included in a report
+	maxReportedErrorBody = 1 << 10
+)
+
+// errorReporting sends handler panics and routes failing repeatedly to Cloud Error Reporting,
+// enabled with ERROR_REPORTING=true
+var errorReporting = struct {
+	sync.Mutex
+	svc       *clouderrorreporting.Service
+	project   string
+	service   string
+	version   string
+	threshold int
+	failures  map[string]*routeFailures
+}{failures: map[string]*routeFailures{}}
+
+// routeFailures counts a route's server errors in the current window
+type routeFailures struct {
+	windowStart time.Time
+	count       int
+	reported    bool
+}
+
+// startErrorReporting reads the error reporting settings
+func startErrorReporting() {
+	if setting("ERROR_REPORTING") != "true" {
+		return
+	}
+	errorReporting.Lock()
+	defer errorReporting.Unlock()
+	errorReporting.project = setting("GOOGLE_CLOUD_PROJECT")
+	if errorReporting.project == "" {
+		log.Printf("error reporting: failed to get project ID (error reporting disabled)")
+		return
+	}
+	errorReporting.threshold = defaultErrorReportingThreshold
+	if s := setting("ERROR_REPORTING_THRESHOLD"); s != "" {
+		if n, err := strconv.Atoi(s); err != nil || n < 1 {
+			log.Printf("error reporting: invalid ERROR_REPORTING_THRESHOLD %q, using %d", s, defaultErrorReportingThreshold)
+		} else {
+			errorReporting.threshold = n
+		}
+	}
+	// App Engine sets GAE_SERVICE and GAE_VERSION, which group the reports
+	errorReporting.service = setting("GAE_SERVICE")
+	if errorReporting.service == "" {
+		errorReporting.service = "second"
+	}
+	errorReporting.version = setting("GAE_VERSION")
+	svc, err := clouderrorreporting.NewService(context.Background())
+	if err != nil {
+		log.Printf("error reporting: %v (error reporting disabled)", err)
+		return
+	}
+	errorReporting.svc = svc
+}
+
+// recoverMiddleware turns handler panics into 500 responses, reporting them with their stack trace
+func recoverMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer func() {
+			v := recover()
+			if v == nil {
+				return
+			}
+			if v == http.ErrAbortHandler {
+				panic(v)
+			}
+			// the stack trace must directly follow the message, for Error Reporting to parse it
+			msg := fmt.Sprintf("panic: %v\n\n%s", v, debug.Stack())
+			log.Printf("%s %s: %s", r.Method, r.URL.Path, msg)
+			recordRecentError(r.Method+" "+r.URL.Path, http.StatusInternalServerError, fmt.Sprintf("panic: %v", v))
+			reportError(r, http.StatusInternalServerError, msg, nil)
+			http.Error(w, "internal error", http.StatusInternalServerError)
+		}()
+		next.ServeHTTP(w, r)
+	})
+}
+
+// noteServerError counts a route's server error, reporting the route once it failed
+// ERROR_REPORTING_THRESHOLD times within errorReportingWindow, e.g. as Pub/Sub calls keep failing
+func noteServerError(r *http.Request, route string, status int, body []byte) {
+	errorReporting.Lock()
+	if errorReporting.svc == nil {
+		errorReporting.Unlock()
+		return
+	}
+	f, ok := errorReporting.failures[route]
+	if !ok || time.Since(f.windowStart) > errorReportingWindow {
+		f = &routeFailures{windowStart: time.Now()}
+		errorReporting.failures[route] = f
+	}
+	f.count++
+	report := f.count >= errorReporting.threshold && !f.reported
+	if report {
+		f.reported = true
+	}
+	count := f.count
+	errorReporting.Unlock()
+
+	if report {
+		msg := fmt.Sprintf("%s failed %d times within %s, last with %d: %s", route, count, errorReportingWindow, status, body)
+		reportError(r, status, msg, &clouderrorreporting.SourceLocation{FunctionName: route})
+	}
+}
+
+// reportError sends an error event with the request's context in the background; events
+// without a stack trace in msg need a location to be grouped by
+func reportError(r *http.Request, status int, msg string, location *clouderrorreporting.SourceLocation) {
+	errorReporting.Lock()
+	svc, project := errorReporting.svc, errorReporting.project
+	serviceContext := &clouderrorreporting.ServiceContext{Service: errorReporting.service, Version: errorReporting.version}
+	errorReporting.Unlock()
+	if svc == nil {
+		return
+	}
+
+	event := &clouderrorreporting.ReportedErrorEvent{
+		EventTime:      time.Now().Format(time.RFC3339Nano),
+		Message:        msg,
+		ServiceContext: serviceContext,
+		Context: &clouderrorreporting.ErrorContext{
+			HttpRequest: &clouderrorreporting.HttpRequestContext{
+				Method:             r.Method,
+				Url:                r.URL.String(),
+				UserAgent:          r.UserAgent(),
+				Referrer:           r.Referer(),
+				RemoteIp:           r.RemoteAddr,
+				ResponseStatusCode: int64(status),
+			},
+			ReportLocation: location,
+		},
+	}
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		if _, err := svc.Projects.Events.Report("projects/"+project, event).Context(ctx).Do(); err != nil {
+			log.Printf("error reporting: %v", err)
+		}
+	}()
+}
@@ -0,0 +1,126 @@
+package server
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"cloud.google.com/go/pubsub"
+)
+
+// Topic and subscription detail responses carry an ETag computed from the configuration they show.
+// PATCH requires the ETag the operator last saw in If-Match, so that of two operators editing the
+// same subscription the second one is told it changed (412) instead of silently overwriting it.
+// Pub/Sub itself has no conditional updates, so this narrows the window rather than closing it.
+
+// topicDetails returns the configuration of a topic as "key: value" lines
+func topicDetails(cfg pubsub.TopicConfig) []string {
+	details := []string{"Labels: " + formatLabels(cfg.Labels)}
+	if regions := cfg.MessageStoragePolicy.AllowedPersistenceRegions; len(regions) > 0 {
+		details = append(details, "Allowed persistence regions: "+strings.Join(regions, ", "))
+	}
+	if cfg.KMSKeyName != "" {
+		details = append(details, "KMS key: "+cfg.KMSKeyName)
+	}
+	if cfg.SchemaSettings != nil {
+		details = append(details, fmt.Sprintf("Schema: %s (encoding %v)", cfg.SchemaSettings.Schema, cfg.SchemaSettings.Encoding))
+	}
+	if cfg.RetentionDuration != nil {
+		details = append(details, fmt.Sprintf("Retention duration: %v", cfg.RetentionDuration))
+	}
+	return details
+}
+
+// subscriptionDetails returns the configuration of a subscription as "key: value" lines
+func subscriptionDetails(cfg pubsub.SubscriptionConfig) []string {
+	var details []string
+	if cfg.Topic != nil {
+		details = append(details, "Topic: "+cfg.Topic.ID())
+	}
+	details = append(details,
+		fmt.Sprintf("Ack deadline: %s", cfg.AckDeadline),
+		fmt.Sprintf("Retain acked messages: %t", cfg.RetainAckedMessages),
+		fmt.Sprintf("Retention duration: %s", cfg.RetentionDuration),
+		fmt.Sprintf("Expiration policy: %v", cfg.ExpirationPolicy),
+		fmt.Sprintf("Message ordering: %t", cfg.EnableMessageOrdering),
+		"Labels: "+formatLabels(cfg.Labels),
+	)
+	if cfg.PushConfig.Endpoint != "" {
+		details = append(details, fmt.Sprintf("Push endpoint: %s %s", cfg.PushConfig.Endpoint, formatLabels(cfg.PushConfig.Attributes)))
+	}
+	if cfg.BigQueryConfig.Table != "" {
+		details = append(details, "BigQuery table: "+cfg.BigQueryConfig.Table)
+	}
+	if cfg.Filter != "" {
+		details = append(details, "Filter: "+cfg.Filter)
+	}
+	if p := cfg.DeadLetterPolicy; p != nil {
+		details = append(details, fmt.Sprintf("Dead letter topic: %s after %d delivery attempts", p.DeadLetterTopic, p.MaxDeliveryAttempts))
+	}
+	if p := cfg.RetryPolicy; p != nil {
+		details = append(details, fmt.Sprintf("Retry backoff: %v to %v", p.MinimumBackoff, p.MaximumBackoff))
+	}
+	if cfg.Detached {
+		details = append(details, "Detached: true")
+	}
+	return details
+}
+
+// formatLabels renders labels as k1=v1,k2=v2 in key order
+func formatLabels(labels map[string]string) string {
+	parts := make([]string, 0, len(labels))
+	for _, k := range sortedKeys(labels) {
+		parts = append(parts, k+"="+labels[k])
+	}
+	return strings.Join(parts, ",")
+}
+
+// configETag returns the strong ETag of a configuration's details
+func configETag(details []string) string {
+	sum := sha256.Sum256([]byte(strings.Join(details, "\n")))
+	return `"` + hex.EncodeToString(sum[:12]) + `"`
+}
+
+// etagMatches reports whether an If-Match or If-None-Match header lists the ETag (or is *)
+func etagMatches(header, etag string) bool {
+	for _, tag := range strings.Split(header, ",") {
+		tag = strings.TrimSpace(tag)
+		if tag == "*" || tag == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// writeDetails responds to GET with the details of a topic or subscription and their ETag,
+// or with 304 if the client's copy, named in If-None-Match, is current
+func writeDetails(w http.ResponseWriter, r *http.Request, name string, details []string) {
+	etag := configETag(details)
+	w.Header().Set("ETag", etag)
+	if inm := r.Header.Get("If-None-Match"); inm != "" && etagMatches(inm, etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	fmt.Fprintln(w, name)
+	for _, line := range details {
+		fmt.Fprintln(w, line)
+	}
+}
+
+// checkIfMatch responds 428 to a request without If-Match and 412 to one whose If-Match doesn't
+// list the current ETag, reporting whether the request may go ahead
+func checkIfMatch(w http.ResponseWriter, r *http.Request, etag string) bool {
+	ifMatch := r.Header.Get("If-Match")
+	if ifMatch == "" {
+		http.Error(w, "If-Match is required: send the ETag of the GET response the change is based on", http.StatusPreconditionRequired)
+		return false
+	}
+	if !etagMatches(ifMatch, etag) {
+		w.Header().Set("ETag", etag)
+		http.Error(w, "the configuration changed since it was read (ETag "+etag+"): GET it again and reapply the change", http.StatusPreconditionFailed)
+		return false
+	}
+	return true
+}
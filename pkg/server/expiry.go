@@ -0,0 +1,299 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/pubsub"
+	"google.golang.org/api/iterator"
+)
+
+// Subscriptions expire after their expiration policy's period without activity (25h for those
+// created by this service). Pub/Sub doesn't tell when a subscription was last active, so the
+// expiry watchdog estimates it from what this service knows: the subscription's created-at and
+// renewed-at labels and the messages received through the service since it started. Every
+// EXPIRY_WATCHDOG_INTERVAL it lists the subscriptions expiring within EXPIRY_WINDOW and, with
+// EXPIRY_AUTO_RENEW=true, renews those labeled keep-alive=true by pulling from them briefly.
+
+const (
+	// keepAliveLabel marks subscriptions the watchdog renews, with the value "true"
+	keepAliveLabel = "keep-alive"
+	// renewedAtLabel records when the watchdog last renewed a subscription, in Unix seconds
+	renewedAtLabel = "renewed-at"
+
+	defaultExpiryWatchdogInterval = 15 * time.Minute
+	defaultExpiryWindow           = 2 * time.Hour
+
+	// renewPullDuration is how long a renewal pulls from a subscription; the messages pulled are nacked
+	renewPullDuration = 3 * time.Second
+)
+
+// expiringSubscription is a subscription expiring within the window
+type expiringSubscription struct {
+	name      string
+	expires   time.Time
+	last      time.Time // its last known activity
+	basis     string    // what that activity was: created, renewed or received
+	keepAlive bool
+	labels    map[string]string
+}
+
+// expiryWatchdog reports subscriptions about to expire and renews those to keep alive
+var expiryWatchdog = struct {
+	sync.Mutex
+	interval  time.Duration
+	window    time.Duration
+	autoRenew bool
+	lastRun   time.Time
+	expiring  []expiringSubscription // as of the last run
+	renewed   int
+	errors    []string
+	received  map[string]time.Time // when messages were last received through this service, by subscription
+}{received: map[string]time.Time{}}
+
+// startExpiryWatchdog reads the watchdog's settings and starts it, unless its interval is 0
+func startExpiryWatchdog() {
+	expiryWatchdog.Lock()
+	defer expiryWatchdog.Unlock()
+	expiryWatchdog.interval = defaultExpiryWatchdogInterval
+	if s := setting("EXPIRY_WATCHDOG_INTERVAL"); s != "" {
+		if d, err := time.ParseDuration(s); err != nil || d < 0 {
+			log.Printf("expiry watchdog: invalid EXPIRY_WATCHDOG_INTERVAL %q, using %s", s, defaultExpiryWatchdogInterval)
+		} else {
+			expiryWatchdog.interval = d
+		}
+	}
+	expiryWatchdog.window = defaultExpiryWindow
+	if s := setting("EXPIRY_WINDOW"); s != "" {
+		if d, err := time.ParseDuration(s); err != nil || d <= 0 {
+			log.Printf("expiry watchdog: invalid EXPIRY_WINDOW %q, using %s", s, defaultExpiryWindow)
+		} else {
+			expiryWatchdog.window = d
+		}
+	}
+	expiryWatchdog.autoRenew = setting("EXPIRY_AUTO_RENEW") == "true"
+	if expiryWatchdog.interval == 0 {
+		return
+	}
+	interval := expiryWatchdog.interval
+	go func() {
+		for {
+			// with several replicas, the leader runs the watchdog
+			if isLeader() {
+				runExpiryWatchdog()
+			}
+			time.Sleep(interval)
+		}
+	}()
+}
+
+// noteSubscriptionActivity records that messages were received from a subscription through this service
+func noteSubscriptionActivity(subscrName string) {
+	expiryWatchdog.Lock()
+	expiryWatchdog.received[subscrName] = time.Now()
+	expiryWatchdog.Unlock()
+}
+
+// runExpiryWatchdog lists the subscriptions about to expire once, renewing those to keep alive
+func runExpiryWatchdog() {
+	projectID := setting("GOOGLE_CLOUD_PROJECT")
+	if projectID == "" {
+		log.Printf("expiry watchdog: failed to get project ID")
+		return
+	}
+	expiryWatchdog.Lock()
+	window, autoRenew, interval := expiryWatchdog.window, expiryWatchdog.autoRenew, expiryWatchdog.interval
+	expiryWatchdog.Unlock()
+	ctx, cancel := context.WithTimeout(context.Background(), interval)
+	defer cancel()
+	client, err := pubsub.NewClient(ctx, projectID, backendOptions()...)
+	if err != nil {
+		log.Printf("expiry watchdog: %v", err)
+		return
+	}
+	defer client.Close()
+
+	expiring, err := expiringSubscriptions(ctx, client, window)
+	var errs []string
+	if err != nil {
+		errs = append(errs, err.Error())
+	}
+	renewed := 0
+	for _, s := range expiring {
+		if !s.keepAlive || !autoRenew {
+			log.Printf("expiry watchdog: subscription %s expires around %s", s.name, s.expires.Format(time.RFC3339))
+			continue
+		}
+		if err := renewSubscription(ctx, client, s.name, s.labels); err != nil {
+			errs = append(errs, fmt.Sprintf("renewing subscription %s: %v", s.name, err))
+			continue
+		}
+		renewed++
+		log.Printf("expiry watchdog: renewed subscription %s, which expired around %s", s.name, s.expires.Format(time.RFC3339))
+	}
+
+	expiryWatchdog.Lock()
+	expiryWatchdog.lastRun = time.Now()
+	expiryWatchdog.expiring = expiring
+	expiryWatchdog.renewed += renewed
+	expiryWatchdog.errors = errs
+	expiryWatchdog.Unlock()
+}
+
+// expiringSubscriptions lists the subscriptions whose estimated expiry is within the window,
+// soonest first; subscriptions that never expire or whose last activity is unknown are left out
+func expiringSubscriptions(ctx context.Context, client *pubsub.Client, window time.Duration) ([]expiringSubscription, error) {
+	expiryWatchdog.Lock()
+	received := make(map[string]time.Time, len(expiryWatchdog.received))
+	for name, at := range expiryWatchdog.received {
+		received[name] = at
+	}
+	expiryWatchdog.Unlock()
+	labelTime := func(labels map[string]string, label string) time.Time {
+		secs, err := strconv.ParseInt(labels[label], 10, 64)
+		if err != nil {
+			return time.Time{}
+		}
+		return time.Unix(secs, 0)
+	}
+
+	var expiring []expiringSubscription
+	var err error
+	it := client.Subscriptions(ctx)
+	for {
+		var s *pubsub.Subscription
+		if s, err = it.Next(); err != nil {
+			break
+		}
+		var cfg pubsub.SubscriptionConfig
+		if cfg, err = s.Config(ctx); err != nil {
+			break
+		}
+		ttl, _ := cfg.ExpirationPolicy.(time.Duration)
+		if ttl <= 0 {
+			continue
+		}
+		last, basis := labelTime(cfg.Labels, createdAtLabel), "created"
+		if t := labelTime(cfg.Labels, renewedAtLabel); t.After(last) {
+			last, basis = t, "renewed"
+		}
+		if t := received[s.ID()]; t.After(last) {
+			last, basis = t, "received"
+		}
+		if last.IsZero() {
+			continue
+		}
+		if expires := last.Add(ttl); time.Until(expires) <= window {
+			expiring = append(expiring, expiringSubscription{
+				name:      s.ID(),
+				expires:   expires,
+				last:      last,
+				basis:     basis,
+				keepAlive: cfg.Labels[keepAliveLabel] == "true",
+				labels:    cfg.Labels,
+			})
+		}
+	}
+	if err == iterator.Done {
+		err = nil
+	}
+	sort.Slice(expiring, func(i, j int) bool { return expiring[i].expires.Before(expiring[j].expires) })
+	return expiring, err
+}
+
+// renewSubscription renews a subscription by pulling from it briefly, which is subscriber activity,
+// nacking what it receives for the subscription's consumers, and records the renewal in its labels
+func renewSubscription(ctx context.Context, client *pubsub.Client, name string, labels map[string]string) error {
+	subscr := client.Subscription(name)
+	subscr.ReceiveSettings.MaxOutstandingMessages = 1
+	pullCtx, cancel := context.WithTimeout(ctx, renewPullDuration)
+	defer cancel()
+	err := subscr.Receive(pullCtx, func(_ context.Context, msg *pubsub.Message) {
+		msg.Nack()
+	})
+	if err != nil {
+		return err
+	}
+	updated := map[string]string{renewedAtLabel: strconv.FormatInt(time.Now().Unix(), 10)}
+	for k, v := range labels {
+		if k != renewedAtLabel {
+			updated[k] = v
+		}
+	}
+	_, err = subscr.Update(ctx, pubsub.SubscriptionConfigToUpdate{Labels: updated})
+	return err
+}
+
+// expiringHandler handles GET to /expiring, listing the subscriptions expiring within the
+// watchdog's window, or ?window=<duration>
+func expiringHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := context.Background()
+	client, ok := newClient(ctx, w)
+	if !ok {
+		return
+	}
+	defer client.Close()
+
+	expiryWatchdog.Lock()
+	window := expiryWatchdog.window
+	expiryWatchdog.Unlock()
+	if window == 0 {
+		window = defaultExpiryWindow
+	}
+	if s := r.URL.Query().Get("window"); s != "" {
+		d, err := time.ParseDuration(s)
+		if err != nil || d <= 0 {
+			http.Error(w, "window must be a positive duration", http.StatusBadRequest)
+			return
+		}
+		window = d
+	}
+	if err := waitAdminQuota(r.Context(), adminOpList); err != nil {
+		writeAdminError(w, err, http.StatusServiceUnavailable)
+		return
+	}
+	expiring, err := expiringSubscriptions(ctx, client, window)
+	if err != nil {
+		writeAdminError(w, err, http.StatusInternalServerError)
+		return
+	}
+	writeExpiryWatchdogStatus(w)
+	fmt.Fprintf(w, "Subscriptions expiring within %s (estimated from their last known activity)\n", window)
+	for i, s := range expiring {
+		line := fmt.Sprintf("[%d] %s expires around %s (%s %s ago)", i, s.name, s.expires.Format(time.RFC3339),
+			s.basis, time.Since(s.last).Round(time.Minute))
+		if s.keepAlive {
+			line += " keep-alive"
+		}
+		fmt.Fprintln(w, line)
+	}
+	if len(expiring) == 0 {
+		fmt.Fprintln(w, "(none)")
+	}
+}
+
+// writeExpiryWatchdogStatus reports the watchdog's configuration and last run
+func writeExpiryWatchdogStatus(w io.Writer) {
+	expiryWatchdog.Lock()
+	defer expiryWatchdog.Unlock()
+	if expiryWatchdog.interval == 0 {
+		fmt.Fprintln(w, "expiry watchdog disabled")
+		return
+	}
+	fmt.Fprintf(w, "expiry watchdog interval=%s window=%s autoRenew=%t renewed=%d", expiryWatchdog.interval,
+		expiryWatchdog.window, expiryWatchdog.autoRenew, expiryWatchdog.renewed)
+	if !expiryWatchdog.lastRun.IsZero() {
+		fmt.Fprintf(w, " lastRun=%s expiring=%d", expiryWatchdog.lastRun.Format(time.RFC3339), len(expiryWatchdog.expiring))
+	}
+	fmt.Fprintln(w)
+	for _, e := range expiryWatchdog.errors {
+		fmt.Fprintf(w, "    last run error: %s\n", e)
+	}
+}
@@ -0,0 +1,120 @@
+package server
+
+import (
+	"context"
+	"log"
+	"strings"
+	"time"
+
+	monitoring "google.golang.org/api/monitoring/v3"
+)
+
+const (
+	minMonitoringExportInterval = 10 * time.Second
+
+	// maxTimeSeriesPerRequest is the most time series Cloud Monitoring accepts in one write
+	maxTimeSeriesPerRequest = 200
+
+	customMetricPrefix = "custom.googleapis.com/second/"
+)
+
+// exportedMetrics are the counters written to Cloud Monitoring, as custom metrics named
+// custom.googleapis.com/second/<name without the second_ prefix>
+var exportedMetrics = []string{
+	publishedMessagesMetric,
+	receivedMessagesMetric,
+	routeMessagesMetric,
+	outboxPublishedMetric,
+	ingestRequestsMetric,
+	smtpMessagesMetric,
+	sinkRowsMetric,
+}
+
+// processStart is the start time of the cumulative metrics exported
+var processStart = time.Now()
+
+// startMonitoringExport periodically writes the exported metrics to Cloud Monitoring,
+// every MONITORING_EXPORT_INTERVAL (disabled if not set)
+func startMonitoringExport() {
+	s := setting("MONITORING_EXPORT_INTERVAL")
+	if s == "" {
+		return
+	}
+	interval, err := time.ParseDuration(s)
+	if err != nil || interval < minMonitoringExportInterval {
+		log.Printf("monitoring export: MONITORING_EXPORT_INTERVAL must be a duration of at least %s (export disabled)", minMonitoringExportInterval)
+		return
+	}
+	projectID := setting("GOOGLE_CLOUD_PROJECT")
+	if projectID == "" {
+		log.Printf("monitoring export: failed to get project ID (export disabled)")
+		return
+	}
+	svc, err := monitoring.NewService(context.Background())
+	if err != nil {
+		log.Printf("monitoring export: %v (export disabled)", err)
+		return
+	}
+	log.Printf("Exporting metrics to Cloud Monitoring every %s", interval)
+	go func() {
+		for range time.Tick(interval) {
+			if err := exportMetrics(svc, projectID); err != nil {
+				log.Printf("monitoring export: %v", err)
+			}
+		}
+	}()
+}
+
+// exportMetrics writes the current value of each exported counter as a point of a cumulative
+// time series; the instance label keeps the series of several instances apart
+func exportMetrics(svc *monitoring.Service, projectID string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	interval := &monitoring.TimeInterval{
+		StartTime: processStart.Format(time.RFC3339Nano),
+		EndTime:   time.Now().Format(time.RFC3339Nano),
+	}
+	var series []*monitoring.TimeSeries
+	for _, name := range exportedMetrics {
+		kind, _, samples := metricSamples(name)
+		if kind != "counter" {
+			continue
+		}
+		for _, sample := range samples {
+			labels := map[string]string{"instance": instanceID}
+			for i := 0; i+1 < len(sample.labels); i += 2 {
+				labels[sample.labels[i]] = sample.labels[i+1]
+			}
+			value := sample.value
+			series = append(series, &monitoring.TimeSeries{
+				Metric: &monitoring.Metric{
+					Type:   customMetricPrefix + strings.TrimPrefix(name, "second_"),
+					Labels: labels,
+				},
+				Resource: &monitoring.MonitoredResource{
+					Type:   "global",
+					Labels: map[string]string{"project_id": projectID},
+				},
+				MetricKind: "CUMULATIVE",
+				ValueType:  "DOUBLE",
+				Points:     []*monitoring.Point{{Interval: interval, Value: &monitoring.TypedValue{DoubleValue: &value}}},
+			})
+		}
+	}
+
+	for len(series) > 0 {
+		n := len(series)
+		if n > maxTimeSeriesPerRequest {
+			n = maxTimeSeriesPerRequest
+		}
+		_, err := svc.Projects.TimeSeries.Create("projects/"+projectID, &monitoring.CreateTimeSeriesRequest{
+			TimeSeries: series[:n],
+		}).Context(ctx).Do()
+		if err != nil {
+			return err
+		}
+		series = series[n:]
+	}
+	return nil
+}
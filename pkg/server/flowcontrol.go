@@ -0,0 +1,65 @@
+package server
+
+import (
+	"errors"
+	"log"
+	"strconv"
+	"time"
+
+	"cloud.google.com/go/pubsub"
+)
+
+const (
+	defaultPublishMaxOutstandingMessages = 1000
+	defaultPublishMaxOutstandingBytes    = 10 << 20
+
+	// publishRetryAfter is the Retry-After hint given when publishing is throttled
+	publishRetryAfter = time.Second
+
+	publishThrottledMetric = "second_publish_throttled_total"
+)
+
+// publishFlowControl limits the messages a topic handle holds before they are sent: with
+// PUBLISH_FLOW_CONTROL=reject (the default) publishing beyond the limits fails right away and
+// the caller gets a 429, with PUBLISH_FLOW_CONTROL=block it waits for room instead
+var publishFlowControl pubsub.FlowControlSettings
+
+// loadPublishFlowControl reads the flow control settings of the topic handles
+func loadPublishFlowControl() {
+	publishFlowControl = pubsub.FlowControlSettings{
+		MaxOutstandingMessages: defaultPublishMaxOutstandingMessages,
+		MaxOutstandingBytes:    defaultPublishMaxOutstandingBytes,
+		LimitExceededBehavior:  pubsub.FlowControlSignalError,
+	}
+	switch s := setting("PUBLISH_FLOW_CONTROL"); s {
+	case "", "reject":
+	case "block":
+		publishFlowControl.LimitExceededBehavior = pubsub.FlowControlBlock
+	default:
+		log.Printf("flow control: invalid PUBLISH_FLOW_CONTROL %q, using reject", s)
+	}
+	if s := setting("PUBLISH_MAX_OUTSTANDING_MESSAGES"); s != "" {
+		if n, err := strconv.Atoi(s); err != nil || n < 1 {
+			log.Printf("flow control: invalid PUBLISH_MAX_OUTSTANDING_MESSAGES %q, using %d", s, defaultPublishMaxOutstandingMessages)
+		} else {
+			publishFlowControl.MaxOutstandingMessages = n
+		}
+	}
+	if s := setting("PUBLISH_MAX_OUTSTANDING_BYTES"); s != "" {
+		if n, err := strconv.Atoi(s); err != nil || n < 1 {
+			log.Printf("flow control: invalid PUBLISH_MAX_OUTSTANDING_BYTES %q, using %d", s, defaultPublishMaxOutstandingBytes)
+		} else {
+			publishFlowControl.MaxOutstandingBytes = n
+		}
+	}
+}
+
+// isFlowControlError reports whether a publish failed because the publisher's limits were reached,
+// counting it as throttled
+func isFlowControlError(err error) bool {
+	if errors.Is(err, pubsub.ErrFlowControllerMaxOutstandingMessages) || errors.Is(err, pubsub.ErrFlowControllerMaxOutstandingBytes) {
+		counterAdd(publishThrottledMetric, "Messages rejected by the publisher's flow control.", 1)
+		return true
+	}
+	return false
+}
@@ -0,0 +1,452 @@
+package server
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// This is a parser for the subset of the GraphQL query language served at /graphql:
+// operations with variables, aliases, arguments and nested selections; fragments and
+// directives are rejected.
+
+// gqlOperation is a query, mutation or subscription of a GraphQL document
+type gqlOperation struct {
+	kind       string // "query", "mutation" or "subscription"
+	name       string
+	vars       []gqlVarDef
+	selections []*gqlField
+}
+
+// gqlVarDef is a variable definition like "$name: String! = "default""
+type gqlVarDef struct {
+	name       string
+	nonNull    bool
+	defaultVal interface{}
+	hasDefault bool
+}
+
+// gqlField is a field selection, with its alias, arguments and sub-selections
+type gqlField struct {
+	alias      string // the response key, the name if there's no alias
+	name       string
+	args       map[string]interface{}
+	selections []*gqlField
+}
+
+// gqlVariable and gqlEnum are argument values referring to a variable and an enum value
+type (
+	gqlVariable string
+	gqlEnum     string
+)
+
+type gqlToken struct {
+	kind byte // 'p' punctuator, 'n' name, 'i' int, 'f' float, 's' string, 0 end of document
+	val  string
+	pos  int
+}
+
+type gqlParser struct {
+	tokens []gqlToken
+	i      int
+}
+
+// parseGraphQL parses a document, returning its operations
+func parseGraphQL(src string) ([]*gqlOperation, error) {
+	tokens, err := gqlTokenize(src)
+	if err != nil {
+		return nil, err
+	}
+	p := &gqlParser{tokens: tokens}
+	var ops []*gqlOperation
+	for p.peek().kind != 0 {
+		op, err := p.operation()
+		if err != nil {
+			return nil, err
+		}
+		ops = append(ops, op)
+	}
+	if len(ops) == 0 {
+		return nil, fmt.Errorf("document contains no operation")
+	}
+	return ops, nil
+}
+
+func (p *gqlParser) peek() gqlToken {
+	return p.tokens[p.i]
+}
+
+func (p *gqlParser) next() gqlToken {
+	t := p.tokens[p.i]
+	if t.kind != 0 {
+		p.i++
+	}
+	return t
+}
+
+// isPunct reports whether the next token is the punctuator s
+func (p *gqlParser) isPunct(s string) bool {
+	t := p.peek()
+	return t.kind == 'p' && t.val == s
+}
+
+// expect consumes the punctuator s
+func (p *gqlParser) expect(s string) error {
+	t := p.next()
+	if t.kind != 'p' || t.val != s {
+		return p.unexpected(t, fmt.Sprintf("%q", s))
+	}
+	return nil
+}
+
+func (p *gqlParser) name() (string, error) {
+	t := p.next()
+	if t.kind != 'n' {
+		return "", p.unexpected(t, "a name")
+	}
+	return t.val, nil
+}
+
+func (p *gqlParser) unexpected(t gqlToken, want string) error {
+	if t.kind == 0 {
+		return fmt.Errorf("syntax error: unexpected end of document, expected %s", want)
+	}
+	return fmt.Errorf("syntax error at offset %d: unexpected %q, expected %s", t.pos, t.val, want)
+}
+
+func (p *gqlParser) operation() (*gqlOperation, error) {
+	op := &gqlOperation{kind: "query"}
+	if t := p.peek(); t.kind == 'n' {
+		switch t.val {
+		case "query", "mutation", "subscription":
+			op.kind = t.val
+		case "fragment":
+			return nil, fmt.Errorf("fragments are not supported")
+		default:
+			return nil, p.unexpected(t, "an operation")
+		}
+		p.next()
+		if p.peek().kind == 'n' {
+			op.name = p.next().val
+		}
+		if p.isPunct("(") {
+			vars, err := p.varDefs()
+			if err != nil {
+				return nil, err
+			}
+			op.vars = vars
+		}
+		if p.isPunct("@") {
+			return nil, fmt.Errorf("directives are not supported")
+		}
+	}
+	selections, err := p.selectionSet()
+	if err != nil {
+		return nil, err
+	}
+	op.selections = selections
+	return op, nil
+}
+
+func (p *gqlParser) varDefs() ([]gqlVarDef, error) {
+	p.next() // (
+	var defs []gqlVarDef
+	for !p.isPunct(")") {
+		if err := p.expect("$"); err != nil {
+			return nil, err
+		}
+		name, err := p.name()
+		if err != nil {
+			return nil, err
+		}
+		if err := p.expect(":"); err != nil {
+			return nil, err
+		}
+		nonNull, err := p.typeRef()
+		if err != nil {
+			return nil, err
+		}
+		def := gqlVarDef{name: name, nonNull: nonNull}
+		if p.isPunct("=") {
+			p.next()
+			if def.defaultVal, err = p.value(true); err != nil {
+				return nil, err
+			}
+			def.hasDefault = true
+		}
+		defs = append(defs, def)
+	}
+	p.next() // )
+	return defs, nil
+}
+
+// typeRef skips a type like "[String!]!", reporting whether it is non-null;
+// variable types aren't checked beyond that
+func (p *gqlParser) typeRef() (bool, error) {
+	if p.isPunct("[") {
+		p.next()
+		if _, err := p.typeRef(); err != nil {
+			return false, err
+		}
+		if err := p.expect("]"); err != nil {
+			return false, err
+		}
+	} else if _, err := p.name(); err != nil {
+		return false, err
+	}
+	if p.isPunct("!") {
+		p.next()
+		return true, nil
+	}
+	return false, nil
+}
+
+func (p *gqlParser) selectionSet() ([]*gqlField, error) {
+	if err := p.expect("{"); err != nil {
+		return nil, err
+	}
+	var fields []*gqlField
+	for !p.isPunct("}") {
+		if p.isPunct("...") {
+			return nil, fmt.Errorf("fragments are not supported")
+		}
+		f, err := p.field()
+		if err != nil {
+			return nil, err
+		}
+		fields = append(fields, f)
+	}
+	p.next() // }
+	if len(fields) == 0 {
+		return nil, fmt.Errorf("syntax error: empty selection set")
+	}
+	return fields, nil
+}
+
+func (p *gqlParser) field() (*gqlField, error) {
+	name, err := p.name()
+	if err != nil {
+		return nil, err
+	}
+	f := &gqlField{alias: name, name: name}
+	if p.isPunct(":") {
+		p.next()
+		if f.name, err = p.name(); err != nil {
+			return nil, err
+		}
+	}
+	if p.isPunct("(") {
+		p.next()
+		f.args = map[string]interface{}{}
+		for !p.isPunct(")") {
+			arg, err := p.name()
+			if err != nil {
+				return nil, err
+			}
+			if err := p.expect(":"); err != nil {
+				return nil, err
+			}
+			if f.args[arg], err = p.value(false); err != nil {
+				return nil, err
+			}
+		}
+		p.next() // )
+	}
+	if p.isPunct("@") {
+		return nil, fmt.Errorf("directives are not supported")
+	}
+	if p.isPunct("{") {
+		if f.selections, err = p.selectionSet(); err != nil {
+			return nil, err
+		}
+	}
+	return f, nil
+}
+
+// value parses an argument value; constant values (defaults) may not refer to variables
+func (p *gqlParser) value(constant bool) (interface{}, error) {
+	t := p.next()
+	switch t.kind {
+	case 's':
+		return t.val, nil
+	case 'i':
+		n, err := strconv.Atoi(t.val)
+		if err != nil {
+			return nil, fmt.Errorf("invalid Int %s", t.val)
+		}
+		return n, nil
+	case 'f':
+		return strconv.ParseFloat(t.val, 64)
+	case 'n':
+		switch t.val {
+		case "true":
+			return true, nil
+		case "false":
+			return false, nil
+		case "null":
+			return nil, nil
+		}
+		return gqlEnum(t.val), nil
+	case 'p':
+		switch t.val {
+		case "$":
+			if constant {
+				return nil, fmt.Errorf("syntax error at offset %d: variables are not allowed in default values", t.pos)
+			}
+			name, err := p.name()
+			return gqlVariable(name), err
+		case "[":
+			list := []interface{}{}
+			for !p.isPunct("]") {
+				v, err := p.value(constant)
+				if err != nil {
+					return nil, err
+				}
+				list = append(list, v)
+			}
+			p.next()
+			return list, nil
+		case "{":
+			obj := map[string]interface{}{}
+			for !p.isPunct("}") {
+				key, err := p.name()
+				if err != nil {
+					return nil, err
+				}
+				if err := p.expect(":"); err != nil {
+					return nil, err
+				}
+				if obj[key], err = p.value(constant); err != nil {
+					return nil, err
+				}
+			}
+			p.next()
+			return obj, nil
+		}
+	}
+	return nil, p.unexpected(t, "a value")
+}
+
+// gqlTokenize splits a document into tokens, skipping whitespace, commas and comments
+func gqlTokenize(src string) ([]gqlToken, error) {
+	var tokens []gqlToken
+	i := 0
+	for i < len(src) {
+		c := src[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == ',':
+			i++
+		case c == '#':
+			for i < len(src) && src[i] != '\n' && src[i] != '\r' {
+				i++
+			}
+		case strings.HasPrefix(src[i:], "\ufeff"):
+			i += len("\ufeff")
+		case strings.HasPrefix(src[i:], "..."):
+			tokens = append(tokens, gqlToken{kind: 'p', val: "...", pos: i})
+			i += 3
+		case strings.IndexByte("!$&():=@[]{}|", c) >= 0:
+			tokens = append(tokens, gqlToken{kind: 'p', val: string(c), pos: i})
+			i++
+		case c == '_' || c >= 'A' && c <= 'Z' || c >= 'a' && c <= 'z':
+			start := i
+			for i < len(src) && (src[i] == '_' || src[i] >= 'A' && src[i] <= 'Z' || src[i] >= 'a' && src[i] <= 'z' || src[i] >= '0' && src[i] <= '9') {
+				i++
+			}
+			tokens = append(tokens, gqlToken{kind: 'n', val: src[start:i], pos: start})
+		case c == '-' || c >= '0' && c <= '9':
+			start := i
+			kind := byte('i')
+			if c == '-' {
+				i++
+			}
+			digits := func() {
+				for i < len(src) && src[i] >= '0' && src[i] <= '9' {
+					i++
+				}
+			}
+			digits()
+			if i < len(src) && src[i] == '.' {
+				kind = 'f'
+				i++
+				digits()
+			}
+			if i < len(src) && (src[i] == 'e' || src[i] == 'E') {
+				kind = 'f'
+				i++
+				if i < len(src) && (src[i] == '+' || src[i] == '-') {
+					i++
+				}
+				digits()
+			}
+			tokens = append(tokens, gqlToken{kind: kind, val: src[start:i], pos: start})
+		case strings.HasPrefix(src[i:], `"""`):
+			// block strings are taken as they are, without removing the indentation
+			end := strings.Index(src[i+3:], `"""`)
+			if end < 0 {
+				return nil, fmt.Errorf("syntax error at offset %d: unterminated string", i)
+			}
+			tokens = append(tokens, gqlToken{kind: 's', val: src[i+3 : i+3+end], pos: i})
+			i += 3 + end + 3
+		case c == '"':
+			s, n, err := gqlString(src[i:])
+			if err != nil {
+				return nil, fmt.Errorf("syntax error at offset %d: %v", i, err)
+			}
+			tokens = append(tokens, gqlToken{kind: 's', val: s, pos: i})
+			i += n
+		default:
+			r, _ := utf8.DecodeRuneInString(src[i:])
+			return nil, fmt.Errorf("syntax error at offset %d: unexpected character %q", i, r)
+		}
+	}
+	return append(tokens, gqlToken{pos: len(src)}), nil
+}
+
+// gqlString decodes the quoted string at the start of src, returning it and its length in src
+func gqlString(src string) (string, int, error) {
+	var b strings.Builder
+	for i := 1; i < len(src); i++ {
+		switch c := src[i]; c {
+		case '"':
+			return b.String(), i + 1, nil
+		case '\n', '\r':
+			return "", 0, fmt.Errorf("unterminated string")
+		case '\\':
+			i++
+			if i >= len(src) {
+				return "", 0, fmt.Errorf("unterminated string")
+			}
+			switch src[i] {
+			case '"', '\\', '/':
+				b.WriteByte(src[i])
+			case 'b':
+				b.WriteByte('\b')
+			case 'f':
+				b.WriteByte('\f')
+			case 'n':
+				b.WriteByte('\n')
+			case 'r':
+				b.WriteByte('\r')
+			case 't':
+				b.WriteByte('\t')
+			case 'u':
+				if i+4 >= len(src) {
+					return "", 0, fmt.Errorf("invalid unicode escape")
+				}
+				r, err := strconv.ParseUint(src[i+1:i+5], 16, 32)
+				if err != nil {
+					return "", 0, fmt.Errorf("invalid unicode escape")
+				}
+				b.WriteRune(rune(r))
+				i += 4
+			default:
+				return "", 0, fmt.Errorf("invalid escape \\%c", src[i])
+			}
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return "", 0, fmt.Errorf("unterminated string")
+}
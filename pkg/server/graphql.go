@@ -0,0 +1,885 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/pubsub"
+	"golang.org/x/net/websocket"
+	"google.golang.org/api/iterator"
+)
+
+// graphqlSchema documents the schema served at /graphql
+const graphqlSchema = `type Query {
+  topics: [Topic!]!
+  topic(name: String!): Topic
+  subscriptions: [Subscription!]!
+  subscription(name: String!): Subscription
+}
+
+type Mutation {
+  createTopic(name: String!, labels: [LabelInput!]): Topic!
+  deleteTopic(name: String!, confirm: String): Boolean!  # confirm: token of GET /topics/{name}/delete-plan
+  createSubscription(name: String!, topic: String!, labels: [LabelInput!]): Subscription!
+  deleteSubscription(name: String!, confirm: String): Boolean!
+  publish(topic: String!, messages: [String!]!): [String!]!  # message IDs
+}
+
+type SubscriptionRoot {  # the subscription operation type, over WebSocket only
+  messages(subscription: String!): Message!  # acks each message as it is sent
+}
+
+type Topic { name: String!  labels: [Label!]!  messageRetentionDuration: String  subscriptions: [Subscription!]! }
+type Subscription { name: String!  topic: Topic!  ackDeadline: String!  retainAckedMessages: Boolean!  retentionDuration: String
+                    filter: String  enableMessageOrdering: Boolean!  labels: [Label!]! }
+type Message { id: String!  data: String!  attributes: [Label!]!  publishTime: String!  orderingKey: String  deliveryAttempt: Int }
+type Label { key: String!  value: String! }
+input LabelInput { key: String!  value: String! }
+`
+
+// graphqlWSProtocol is the WebSocket subprotocol of GraphQL subscriptions (the graphql-ws library's)
+const graphqlWSProtocol = "graphql-transport-ws"
+
+// gqlResolver resolves a field of an object, given the field's arguments
+type gqlResolver func(ctx context.Context, args map[string]interface{}) (interface{}, error)
+
+// gqlObject is a GraphQL object: its fields are only resolved when selected
+type gqlObject map[string]gqlResolver
+
+// gqlResult is a selection's result, keeping the fields in the order they were selected
+type gqlResult []gqlResultField
+
+type gqlResultField struct {
+	key   string
+	value interface{}
+}
+
+func (res gqlResult) MarshalJSON() ([]byte, error) {
+	var b bytes.Buffer
+	b.WriteByte('{')
+	for i, f := range res {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		key, _ := json.Marshal(f.key)
+		value, err := json.Marshal(f.value)
+		if err != nil {
+			return nil, err
+		}
+		b.Write(key)
+		b.WriteByte(':')
+		b.Write(value)
+	}
+	b.WriteByte('}')
+	return b.Bytes(), nil
+}
+
+// gqlError is an error in a GraphQL response, with the path of the field it occurred at
+type gqlError struct {
+	Message string        `json:"message"`
+	Path    []interface{} `json:"path,omitempty"`
+}
+
+// gqlRequest is a GraphQL request, as posted to /graphql or sent in a subscribe message
+type gqlRequest struct {
+	Query         string                 `json:"query"`
+	OperationName string                 `json:"operationName"`
+	Variables     map[string]interface{} `json:"variables"`
+}
+
+// gqlResponse is a GraphQL response
+type gqlResponse struct {
+	Data   interface{} `json:"data"`
+	Errors []gqlError  `json:"errors,omitempty"`
+}
+
+// gqlExecution executes the selections of one operation
+type gqlExecution struct {
+	vars   map[string]interface{}
+	errors []gqlError
+}
+
+// prepare parses a request and picks the operation to execute, with its variables
+func (req *gqlRequest) prepare() (*gqlOperation, *gqlExecution, error) {
+	ops, err := parseGraphQL(req.Query)
+	if err != nil {
+		return nil, nil, err
+	}
+	var op *gqlOperation
+	switch {
+	case req.OperationName != "":
+		for _, o := range ops {
+			if o.name == req.OperationName {
+				op = o
+			}
+		}
+		if op == nil {
+			return nil, nil, fmt.Errorf("unknown operation %q", req.OperationName)
+		}
+	case len(ops) == 1:
+		op = ops[0]
+	default:
+		return nil, nil, fmt.Errorf("operationName must be provided for documents with several operations")
+	}
+
+	vars := map[string]interface{}{}
+	for _, def := range op.vars {
+		v, ok := req.Variables[def.name]
+		if !ok && def.hasDefault {
+			v, ok = def.defaultVal, true
+		}
+		if (!ok || v == nil) && def.nonNull {
+			return nil, nil, fmt.Errorf("variable $%s of non-null type not provided", def.name)
+		}
+		vars[def.name] = v
+	}
+	return op, &gqlExecution{vars: vars}, nil
+}
+
+// selectObject resolves the selected fields of an object
+func (e *gqlExecution) selectObject(ctx context.Context, obj gqlObject, selections []*gqlField, path []interface{}) gqlResult {
+	res := make(gqlResult, 0, len(selections))
+	for _, f := range selections {
+		fieldPath := append(append([]interface{}{}, path...), f.alias)
+		resolve, ok := obj[f.name]
+		if !ok {
+			e.fail(fieldPath, fmt.Errorf("cannot query field %q", f.name))
+			res = append(res, gqlResultField{f.alias, nil})
+			continue
+		}
+		args, err := e.args(f)
+		var v interface{}
+		if err == nil {
+			v, err = resolve(ctx, args)
+		}
+		if err != nil {
+			e.fail(fieldPath, err)
+			res = append(res, gqlResultField{f.alias, nil})
+			continue
+		}
+		res = append(res, gqlResultField{f.alias, e.complete(ctx, v, f, fieldPath)})
+	}
+	return res
+}
+
+// complete turns a resolved value into its result: objects (and lists of them) are selected from
+func (e *gqlExecution) complete(ctx context.Context, v interface{}, f *gqlField, path []interface{}) interface{} {
+	switch v := v.(type) {
+	case gqlObject:
+		if len(f.selections) == 0 {
+			e.fail(path, fmt.Errorf("field %q of object type must have a selection of subfields", f.name))
+			return nil
+		}
+		return e.selectObject(ctx, v, f.selections, path)
+	case []gqlObject:
+		list := make([]interface{}, len(v))
+		for i, obj := range v {
+			list[i] = e.complete(ctx, obj, f, append(append([]interface{}{}, path...), i))
+		}
+		return list
+	}
+	if len(f.selections) > 0 {
+		e.fail(path, fmt.Errorf("field %q must not have a selection since it has no subfields", f.name))
+		return nil
+	}
+	return v
+}
+
+// args returns the field's arguments, with the variables they refer to substituted
+func (e *gqlExecution) args(f *gqlField) (map[string]interface{}, error) {
+	args := map[string]interface{}{}
+	for name, v := range f.args {
+		resolved, err := e.resolveValue(v)
+		if err != nil {
+			return nil, err
+		}
+		args[name] = resolved
+	}
+	return args, nil
+}
+
+func (e *gqlExecution) resolveValue(v interface{}) (interface{}, error) {
+	switch v := v.(type) {
+	case gqlVariable:
+		value, ok := e.vars[string(v)]
+		if !ok {
+			return nil, fmt.Errorf("variable $%s is not defined", v)
+		}
+		return value, nil
+	case gqlEnum:
+		return string(v), nil
+	case []interface{}:
+		list := make([]interface{}, len(v))
+		for i, item := range v {
+			var err error
+			if list[i], err = e.resolveValue(item); err != nil {
+				return nil, err
+			}
+		}
+		return list, nil
+	case map[string]interface{}:
+		obj := map[string]interface{}{}
+		for key, item := range v {
+			var err error
+			if obj[key], err = e.resolveValue(item); err != nil {
+				return nil, err
+			}
+		}
+		return obj, nil
+	}
+	return v, nil
+}
+
+func (e *gqlExecution) fail(path []interface{}, err error) {
+	e.errors = append(e.errors, gqlError{Message: err.Error(), Path: path})
+}
+
+// gqlStringArg returns a required String argument
+func gqlStringArg(args map[string]interface{}, name string) (string, error) {
+	s, ok := args[name].(string)
+	if !ok {
+		return "", fmt.Errorf("argument %q of type String! is required", name)
+	}
+	return s, nil
+}
+
+// gqlLabelsArg returns an optional [LabelInput!] argument as a map
+func gqlLabelsArg(args map[string]interface{}, name string) (map[string]string, error) {
+	v, ok := args[name]
+	if !ok || v == nil {
+		return nil, nil
+	}
+	list, ok := v.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("argument %q must be of type [LabelInput!]", name)
+	}
+	labels := map[string]string{}
+	for _, item := range list {
+		obj, ok := item.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("argument %q must be of type [LabelInput!]", name)
+		}
+		key, err := gqlStringArg(obj, "key")
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", name, err)
+		}
+		value, err := gqlStringArg(obj, "value")
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", name, err)
+		}
+		labels[key] = value
+	}
+	return labels, nil
+}
+
+// gqlOptionalStringArg returns the value of an optional String argument, "" if it's not given
+func gqlOptionalStringArg(args map[string]interface{}, name string) string {
+	s, _ := args[name].(string)
+	return s
+}
+
+// graphqlHandler handles GET and POST to /graphql: queries and mutations are posted as
+// '{"query":"...", "variables":{...}, "operationName":"..."}' (or passed as ?query=), subscriptions
+// are served over a WebSocket with the graphql-transport-ws protocol; GET without a query
+// returns the schema
+func graphqlHandler(w http.ResponseWriter, r *http.Request) {
+	if strings.EqualFold(r.Header.Get("Upgrade"), "websocket") {
+		// STOMP clients may share the endpoint, asking for a STOMP subprotocol
+		offered := strings.Split(strings.ReplaceAll(r.Header.Get("Sec-WebSocket-Protocol"), " ", ""), ",")
+		end, ok := beginStream(w)
+		if !ok {
+			return
+		}
+		defer end()
+		if stompProtocol(offered) != "" {
+			stompWSServer.ServeHTTP(w, r)
+			return
+		}
+		graphqlWSServer.ServeHTTP(w, r)
+		return
+	}
+
+	var req gqlRequest
+	if r.Method == http.MethodPost {
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if err := json.Unmarshal(body, &req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	} else {
+		q := r.URL.Query()
+		req.Query, req.OperationName = q.Get("query"), q.Get("operationName")
+		if req.Query == "" {
+			fmt.Fprint(w, graphqlSchema)
+			return
+		}
+		if v := q.Get("variables"); v != "" {
+			if err := json.Unmarshal([]byte(v), &req.Variables); err != nil {
+				http.Error(w, "variables: "+err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+	}
+
+	ctx := context.Background()
+	client, ok := newClient(ctx, w)
+	if !ok {
+		return
+	}
+	resp, status := executeGraphQL(ctx, client, r, &req, r.Method == http.MethodPost)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(resp)
+}
+
+// executeGraphQL executes a query, or a mutation of the request r if allowed, returning the response
+// and its HTTP status
+func executeGraphQL(ctx context.Context, client *pubsub.Client, r *http.Request, req *gqlRequest, allowMutation bool) (*gqlResponse, int) {
+	op, e, err := req.prepare()
+	if err != nil {
+		return &gqlResponse{Errors: []gqlError{{Message: err.Error()}}}, http.StatusBadRequest
+	}
+	var root gqlObject
+	switch op.kind {
+	case "query":
+		root = gqlQueryRoot(client)
+	case "mutation":
+		if !allowMutation {
+			return &gqlResponse{Errors: []gqlError{{Message: "mutations must be posted"}}}, http.StatusMethodNotAllowed
+		}
+		root = gqlMutationRoot(client, r)
+	default:
+		return &gqlResponse{Errors: []gqlError{{Message: "subscriptions require a WebSocket connection using the " +
+			graphqlWSProtocol + " protocol"}}}, http.StatusBadRequest
+	}
+	data := e.selectObject(ctx, root, op.selections, nil)
+	return &gqlResponse{Data: data, Errors: e.errors}, http.StatusOK
+}
+
+// gqlQueryRoot returns the fields of the Query type
+func gqlQueryRoot(client *pubsub.Client) gqlObject {
+	return gqlObject{
+		"__typename": gqlConst("Query"),
+		"topics": func(ctx context.Context, _ map[string]interface{}) (interface{}, error) {
+			if err := waitAdminQuota(ctx, adminOpList); err != nil {
+				return nil, err
+			}
+			var list []gqlObject
+			it := client.Topics(ctx)
+			for {
+				t, err := it.Next()
+				if err == iterator.Done {
+					return list, nil
+				}
+				if err != nil {
+					return nil, err
+				}
+				list = append(list, gqlTopic(client, t))
+			}
+		},
+		"topic": func(ctx context.Context, args map[string]interface{}) (interface{}, error) {
+			name, err := gqlStringArg(args, "name")
+			if err != nil {
+				return nil, err
+			}
+			t := client.Topic(name)
+			if exists, err := t.Exists(ctx); err != nil || !exists {
+				return nil, err
+			}
+			return gqlTopic(client, t), nil
+		},
+		"subscriptions": func(ctx context.Context, _ map[string]interface{}) (interface{}, error) {
+			if err := waitAdminQuota(ctx, adminOpList); err != nil {
+				return nil, err
+			}
+			var list []gqlObject
+			it := client.Subscriptions(ctx)
+			for {
+				s, err := it.Next()
+				if err == iterator.Done {
+					return list, nil
+				}
+				if err != nil {
+					return nil, err
+				}
+				list = append(list, gqlSubscription(client, s))
+			}
+		},
+		"subscription": func(ctx context.Context, args map[string]interface{}) (interface{}, error) {
+			name, err := gqlStringArg(args, "name")
+			if err != nil {
+				return nil, err
+			}
+			s := client.Subscription(name)
+			if exists, err := s.Exists(ctx); err != nil || !exists {
+				return nil, err
+			}
+			return gqlSubscription(client, s), nil
+		},
+	}
+}
+
+// gqlMutationRoot returns the fields of the Mutation type, for the request r (the WebSocket's
+// handshake over a WebSocket), whose credentials publishing is authorized with
+func gqlMutationRoot(client *pubsub.Client, r *http.Request) gqlObject {
+	return gqlObject{
+		"__typename": gqlConst("Mutation"),
+		"createTopic": func(ctx context.Context, args map[string]interface{}) (interface{}, error) {
+			name, err := gqlStringArg(args, "name")
+			if err != nil {
+				return nil, err
+			}
+			labels, err := gqlLabelsArg(args, "labels")
+			if err != nil {
+				return nil, err
+			}
+			if err := validateNewResource("topic", name, labels); err != nil {
+				return nil, err
+			}
+			var t *pubsub.Topic
+			err = retryAdmin(ctx, adminOpCreate, func() (err error) {
+				t, err = client.CreateTopicWithConfig(ctx, name, &pubsub.TopicConfig{Labels: withDemoLabels(labels)})
+				return err
+			})
+			if err != nil {
+				return nil, err
+			}
+			noteResourceChange("created", "topic", name, "graphql")
+			return gqlTopic(client, t), nil
+		},
+		"deleteTopic": func(ctx context.Context, args map[string]interface{}) (interface{}, error) {
+			name, err := gqlStringArg(args, "name")
+			if err != nil {
+				return nil, err
+			}
+			if deleteConfirmationRequired() {
+				plan, err := topicDeletePlan(ctx, client.Topic(name))
+				if err != nil {
+					return nil, err
+				}
+				if err := confirmDelete(plan, gqlOptionalStringArg(args, "confirm")); err != nil {
+					return nil, err
+				}
+			}
+			trashed, err := deleteOrTrashTopic(ctx, client, name)
+			if err != nil {
+				return nil, err
+			}
+			if !trashed {
+				noteResourceChange("deleted", "topic", name, "graphql")
+			}
+			return true, nil
+		},
+		"createSubscription": func(ctx context.Context, args map[string]interface{}) (interface{}, error) {
+			name, err := gqlStringArg(args, "name")
+			if err != nil {
+				return nil, err
+			}
+			topicName, err := gqlStringArg(args, "topic")
+			if err != nil {
+				return nil, err
+			}
+			labels, err := gqlLabelsArg(args, "labels")
+			if err != nil {
+				return nil, err
+			}
+			if err := validateNewResource("subscription", name, labels); err != nil {
+				return nil, err
+			}
+			if err := validateResourceName("topic", topicName); err != nil {
+				return nil, err
+			}
+			cfg := newSubscriptionConfig(client.Topic(topicName))
+			cfg.Labels = withDemoLabels(labels)
+			var s *pubsub.Subscription
+			err = retryAdmin(ctx, adminOpCreate, func() (err error) {
+				s, err = client.CreateSubscription(ctx, name, cfg)
+				return err
+			})
+			if err != nil {
+				return nil, err
+			}
+			noteResourceChange("created", "subscription", name, "graphql")
+			return gqlSubscription(client, s), nil
+		},
+		"deleteSubscription": func(ctx context.Context, args map[string]interface{}) (interface{}, error) {
+			name, err := gqlStringArg(args, "name")
+			if err != nil {
+				return nil, err
+			}
+			if deleteConfirmationRequired() {
+				plan := subscriptionDeletePlan(ctx, client.Subscription(name))
+				if err := confirmDelete(plan, gqlOptionalStringArg(args, "confirm")); err != nil {
+					return nil, err
+				}
+			}
+			err = retryAdmin(ctx, adminOpDelete, func() error {
+				return client.Subscription(name).Delete(ctx)
+			})
+			if err != nil {
+				return nil, err
+			}
+			noteResourceChange("deleted", "subscription", name, "graphql")
+			return true, nil
+		},
+		"publish": func(ctx context.Context, args map[string]interface{}) (interface{}, error) {
+			topicName, err := gqlStringArg(args, "topic")
+			if err != nil {
+				return nil, err
+			}
+			list, ok := args["messages"].([]interface{})
+			if !ok {
+				return nil, fmt.Errorf("argument \"messages\" of type [String!]! is required")
+			}
+			if err := authorizePublish(r, topicName, make([]map[string]string, len(list))); err != nil {
+				return nil, err
+			}
+			topic, release, err := acquireTopic(topicName)
+			if err != nil {
+				return nil, err
+			}
+			defer release()
+			results := make([]*pubsub.PublishResult, len(list))
+			for i, item := range list {
+				data, ok := item.(string)
+				if !ok {
+					return nil, fmt.Errorf("messages[%d] must be a String", i)
+				}
+				results[i] = topic.Publish(ctx, &pubsub.Message{Data: []byte(data)})
+			}
+			ids := make([]string, len(results))
+			for i, res := range results {
+				if ids[i], err = res.Get(ctx); err != nil {
+					return nil, fmt.Errorf("messages[%d]: %v", i, err)
+				}
+				recordPublished(topicName, 1)
+			}
+			return ids, nil
+		},
+	}
+}
+
+// gqlTopic returns the fields of a Topic; its configuration is fetched once, if selected
+func gqlTopic(client *pubsub.Client, t *pubsub.Topic) gqlObject {
+	config := gqlOnce(func(ctx context.Context) (interface{}, error) { return t.Config(ctx) })
+	return gqlObject{
+		"__typename": gqlConst("Topic"),
+		"name":       gqlConst(t.ID()),
+		"labels": func(ctx context.Context, _ map[string]interface{}) (interface{}, error) {
+			cfg, err := config(ctx)
+			if err != nil {
+				return nil, err
+			}
+			return gqlLabels(cfg.(pubsub.TopicConfig).Labels), nil
+		},
+		"messageRetentionDuration": func(ctx context.Context, _ map[string]interface{}) (interface{}, error) {
+			cfg, err := config(ctx)
+			if err != nil {
+				return nil, err
+			}
+			d, _ := cfg.(pubsub.TopicConfig).RetentionDuration.(time.Duration)
+			return gqlDuration(d), nil
+		},
+		"subscriptions": func(ctx context.Context, _ map[string]interface{}) (interface{}, error) {
+			var list []gqlObject
+			it := t.Subscriptions(ctx)
+			for {
+				s, err := it.Next()
+				if err == iterator.Done {
+					return list, nil
+				}
+				if err != nil {
+					return nil, err
+				}
+				list = append(list, gqlSubscription(client, s))
+			}
+		},
+	}
+}
+
+// gqlSubscription returns the fields of a Subscription; its configuration is fetched once, if selected
+func gqlSubscription(client *pubsub.Client, s *pubsub.Subscription) gqlObject {
+	config := gqlOnce(func(ctx context.Context) (interface{}, error) { return s.Config(ctx) })
+	field := func(get func(cfg pubsub.SubscriptionConfig) interface{}) gqlResolver {
+		return func(ctx context.Context, _ map[string]interface{}) (interface{}, error) {
+			cfg, err := config(ctx)
+			if err != nil {
+				return nil, err
+			}
+			return get(cfg.(pubsub.SubscriptionConfig)), nil
+		}
+	}
+	return gqlObject{
+		"__typename": gqlConst("Subscription"),
+		"name":       gqlConst(s.ID()),
+		"topic": field(func(cfg pubsub.SubscriptionConfig) interface{} {
+			return gqlTopic(client, cfg.Topic)
+		}),
+		"ackDeadline": field(func(cfg pubsub.SubscriptionConfig) interface{} { return cfg.AckDeadline.String() }),
+		"retainAckedMessages": field(func(cfg pubsub.SubscriptionConfig) interface{} {
+			return cfg.RetainAckedMessages
+		}),
+		"retentionDuration": field(func(cfg pubsub.SubscriptionConfig) interface{} { return gqlDuration(cfg.RetentionDuration) }),
+		"filter": field(func(cfg pubsub.SubscriptionConfig) interface{} {
+			if cfg.Filter == "" {
+				return nil
+			}
+			return cfg.Filter
+		}),
+		"enableMessageOrdering": field(func(cfg pubsub.SubscriptionConfig) interface{} { return cfg.EnableMessageOrdering }),
+		"labels":                field(func(cfg pubsub.SubscriptionConfig) interface{} { return gqlLabels(cfg.Labels) }),
+	}
+}
+
+// gqlMessage returns the fields of a Message
+func gqlMessage(msg *pubsub.Message) gqlObject {
+	msg = redactMessage(msg)
+	var orderingKey, deliveryAttempt interface{}
+	if msg.OrderingKey != "" {
+		orderingKey = msg.OrderingKey
+	}
+	if msg.DeliveryAttempt != nil {
+		deliveryAttempt = *msg.DeliveryAttempt
+	}
+	return gqlObject{
+		"__typename":      gqlConst("Message"),
+		"id":              gqlConst(msg.ID),
+		"data":            gqlConst(string(msg.Data)),
+		"attributes":      gqlConst(gqlLabels(msg.Attributes)),
+		"publishTime":     gqlConst(msg.PublishTime.Format(time.RFC3339Nano)),
+		"orderingKey":     gqlConst(orderingKey),
+		"deliveryAttempt": gqlConst(deliveryAttempt),
+	}
+}
+
+// gqlLabels returns key/value pairs as Label objects, sorted by key
+func gqlLabels(m map[string]string) []gqlObject {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	list := make([]gqlObject, len(keys))
+	for i, k := range keys {
+		list[i] = gqlObject{"__typename": gqlConst("Label"), "key": gqlConst(k), "value": gqlConst(m[k])}
+	}
+	return list
+}
+
+// gqlDuration returns a duration as a String, or null if it is not set
+func gqlDuration(d time.Duration) interface{} {
+	if d <= 0 {
+		return nil
+	}
+	return d.String()
+}
+
+// gqlConst returns a resolver of a known value
+func gqlConst(v interface{}) gqlResolver {
+	return func(context.Context, map[string]interface{}) (interface{}, error) { return v, nil }
+}
+
+// gqlOnce returns a function calling get the first time only, so that several fields can share a lookup
+func gqlOnce(get func(ctx context.Context) (interface{}, error)) func(ctx context.Context) (interface{}, error) {
+	var (
+		once sync.Once
+		v    interface{}
+		err  error
+	)
+	return func(ctx context.Context) (interface{}, error) {
+		once.Do(func() { v, err = get(ctx) })
+		return v, err
+	}
+}
+
+// gqlWSMessage is a message of the graphql-transport-ws protocol
+type gqlWSMessage struct {
+	ID      string          `json:"id,omitempty"`
+	Type    string          `json:"type"`
+	Payload json.RawMessage `json:"payload,omitempty"`
+}
+
+// graphqlWSServer serves GraphQL over WebSocket; browsers' origins are not restricted,
+// like the rest of the API
+var graphqlWSServer = websocket.Server{
+	Handshake: func(config *websocket.Config, r *http.Request) error {
+		for _, p := range config.Protocol {
+			if p == graphqlWSProtocol {
+				config.Protocol = []string{graphqlWSProtocol}
+				return nil
+			}
+		}
+		return fmt.Errorf("the %s subprotocol is required", graphqlWSProtocol)
+	},
+	Handler: serveGraphQLWS,
+}
+
+// serveGraphQLWS runs a graphql-transport-ws connection: each subscribe message starts an
+// operation, subscriptions stream a "next" message per Pub/Sub message until completed
+func serveGraphQLWS(conn *websocket.Conn) {
+	defer conn.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var sendMu sync.Mutex
+	send := func(msg gqlWSMessage) {
+		sendMu.Lock()
+		defer sendMu.Unlock()
+		websocket.JSON.Send(conn, msg)
+	}
+	payload := func(v interface{}) json.RawMessage {
+		data, _ := json.Marshal(v)
+		return data
+	}
+
+	var (
+		mu          sync.Mutex
+		initialized bool
+		operations  = map[string]context.CancelFunc{}
+	)
+	// on shutdown, the operations end with an error and the connection is closed
+	go func() {
+		select {
+		case <-drainSignal():
+		case <-ctx.Done():
+			return
+		}
+		mu.Lock()
+		for id, stop := range operations {
+			stop()
+			send(gqlWSMessage{ID: id, Type: "error", Payload: payload([]gqlError{{Message: shutdownNotice}})})
+		}
+		operations = map[string]context.CancelFunc{}
+		mu.Unlock()
+		conn.Close()
+	}()
+	for {
+		var msg gqlWSMessage
+		if err := websocket.JSON.Receive(conn, &msg); err != nil {
+			return
+		}
+		switch msg.Type {
+		case "connection_init":
+			mu.Lock()
+			initialized = true
+			mu.Unlock()
+			send(gqlWSMessage{Type: "connection_ack"})
+		case "ping":
+			send(gqlWSMessage{Type: "pong"})
+		case "pong":
+		case "subscribe":
+			mu.Lock()
+			ok := initialized
+			_, duplicate := operations[msg.ID]
+			mu.Unlock()
+			if !ok || msg.ID == "" || duplicate {
+				// the protocol closes the connection on these
+				return
+			}
+			var req gqlRequest
+			if err := json.Unmarshal(msg.Payload, &req); err != nil {
+				send(gqlWSMessage{ID: msg.ID, Type: "error", Payload: payload([]gqlError{{Message: err.Error()}})})
+				continue
+			}
+			opCtx, opCancel := context.WithCancel(ctx)
+			mu.Lock()
+			operations[msg.ID] = opCancel
+			mu.Unlock()
+			go func(id string) {
+				defer func() {
+					mu.Lock()
+					delete(operations, id)
+					mu.Unlock()
+					opCancel()
+				}()
+				next := func(resp *gqlResponse) { send(gqlWSMessage{ID: id, Type: "next", Payload: payload(resp)}) }
+				if err := runGraphQLOperation(opCtx, conn.Request(), &req, next); err != nil {
+					send(gqlWSMessage{ID: id, Type: "error", Payload: payload([]gqlError{{Message: err.Error()}})})
+					return
+				}
+				if opCtx.Err() == nil {
+					send(gqlWSMessage{ID: id, Type: "complete"})
+				}
+			}(msg.ID)
+		case "complete":
+			mu.Lock()
+			if stop, ok := operations[msg.ID]; ok {
+				stop()
+			}
+			mu.Unlock()
+		default:
+			return
+		}
+	}
+}
+
+// runGraphQLOperation executes an operation received over the WebSocket opened by r, passing each
+// result to next: a single one for queries and mutations, one per message for subscriptions
+func runGraphQLOperation(ctx context.Context, r *http.Request, req *gqlRequest, next func(*gqlResponse)) error {
+	op, e, err := req.prepare()
+	if err != nil {
+		return err
+	}
+	projectID := setting("GOOGLE_CLOUD_PROJECT")
+	if projectID == "" {
+		return fmt.Errorf("failed to get project ID")
+	}
+	client, err := pubsub.NewClient(context.Background(), projectID, backendOptions()...)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+	switch op.kind {
+	case "query":
+		next(&gqlResponse{Data: e.selectObject(ctx, gqlQueryRoot(client), op.selections, nil), Errors: e.errors})
+		return nil
+	case "mutation":
+		next(&gqlResponse{Data: e.selectObject(ctx, gqlMutationRoot(client, r), op.selections, nil), Errors: e.errors})
+		return nil
+	}
+
+	if len(op.selections) != 1 || op.selections[0].name != "messages" {
+		return fmt.Errorf("a subscription must select the messages field only")
+	}
+	args, err := e.args(op.selections[0])
+	if err != nil {
+		return err
+	}
+	subscrName, err := gqlStringArg(args, "subscription")
+	if err != nil {
+		return err
+	}
+	subscr := client.Subscription(subscrName)
+	if exists, err := subscr.Exists(ctx); err != nil {
+		return err
+	} else if !exists {
+		return fmt.Errorf("subscription %s not found", subscrName)
+	}
+	var mu sync.Mutex
+	err = subscr.Receive(ctx, func(_ context.Context, msg *pubsub.Message) {
+		mu.Lock()
+		defer mu.Unlock()
+		msg.Ack()
+		recordReceived(subscrName, 1)
+		// every message is a separate execution, with its own errors
+		msgExec := &gqlExecution{vars: e.vars}
+		root := gqlObject{"messages": gqlConst(gqlMessage(msg))}
+		next(&gqlResponse{Data: msgExec.selectObject(ctx, root, op.selections, nil), Errors: msgExec.errors})
+	})
+	if err != nil && ctx.Err() == nil {
+		return err
+	}
+	return nil
+}
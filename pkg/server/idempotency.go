@@ -0,0 +1,246 @@
+package server
+
+import (
+	"bytes"
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	idempotencyKeyHeader = "Idempotency-Key"
+
+	defaultIdempotencyWindow    = 24 * time.Hour
+	defaultIdempotencyCacheSize = 1000
+
+	// maxIdempotentResponse is the largest response kept for replay; retries of requests with
+	// larger responses run again
+	maxIdempotentResponse = 1 << 20
+
+	idempotentReplaysMetric = "second_idempotent_replays_total"
+)
+
+// idempotentResponse is the response to a request with an Idempotency-Key, replayed to retries
+type idempotentResponse struct {
+	key         string // method, path, caller and Idempotency-Key
+	fingerprint [sha256.Size]byte
+	done        bool // false while the first request is in flight
+	status      int
+	header      http.Header
+	body        []byte
+	at          time.Time
+}
+
+// idempotencyCache holds the recent responses to requests with an Idempotency-Key, bounded in
+// size and in time
+var idempotencyCache = struct {
+	sync.Mutex
+	size    int
+	window  time.Duration
+	lru     *list.List // of *idempotentResponse, most recent first
+	entries map[string]*list.Element
+}{lru: list.New(), entries: map[string]*list.Element{}}
+
+// startIdempotencyCache reads the idempotency cache settings
+func startIdempotencyCache() {
+	idempotencyCache.Lock()
+	defer idempotencyCache.Unlock()
+	idempotencyCache.size = defaultIdempotencyCacheSize
+	if s := setting("IDEMPOTENCY_CACHE_SIZE"); s != "" {
+		if n, err := strconv.Atoi(s); err != nil || n < 1 {
+			log.Printf("idempotency: invalid IDEMPOTENCY_CACHE_SIZE %q, using %d", s, defaultIdempotencyCacheSize)
+		} else {
+			idempotencyCache.size = n
+		}
+	}
+	idempotencyCache.window = defaultIdempotencyWindow
+	if s := setting("IDEMPOTENCY_WINDOW"); s != "" {
+		if d, err := time.ParseDuration(s); err != nil || d <= 0 {
+			log.Printf("idempotency: invalid IDEMPOTENCY_WINDOW %q, using %s", s, defaultIdempotencyWindow)
+		} else {
+			idempotencyCache.window = d
+		}
+	}
+	loadIdempotentResponses()
+}
+
+// storedResponse is an idempotentResponse as kept in the state store
+type storedResponse struct {
+	Key         []byte      `json:"key"`
+	Fingerprint []byte      `json:"fingerprint"`
+	Status      int         `json:"status"`
+	Header      http.Header `json:"header"`
+	Body        []byte      `json:"body"`
+	At          time.Time   `json:"at"`
+}
+
+func (resp *idempotentResponse) stored() storedResponse {
+	return storedResponse{Key: []byte(resp.key), Fingerprint: resp.fingerprint[:], Status: resp.status, Header: resp.header, Body: resp.body, At: resp.at}
+}
+
+// stateKey is the key of a response in the state store
+func (resp *idempotentResponse) stateKey() string {
+	sum := sha256.Sum256([]byte(resp.key))
+	return hex.EncodeToString(sum[:])
+}
+
+// loadIdempotentResponses fills the cache with the responses kept in the state store that are
+// still within the window, and drops the others from the store; the cache lock is held
+func loadIdempotentResponses() {
+	var list []*idempotentResponse
+	stateLoad(idempotencyBucket, func(key string, data []byte) error {
+		var s storedResponse
+		if err := json.Unmarshal(data, &s); err != nil {
+			return err
+		}
+		resp := &idempotentResponse{key: string(s.Key), done: true, status: s.Status, header: s.Header, body: s.Body, at: s.At}
+		copy(resp.fingerprint[:], s.Fingerprint)
+		if time.Since(resp.at) <= idempotencyCache.window {
+			list = append(list, resp)
+		}
+		return nil
+	})
+	sort.Slice(list, func(a, b int) bool { return list[a].at.After(list[b].at) })
+	if len(list) > idempotencyCache.size {
+		list = list[:idempotencyCache.size]
+	}
+	kept := map[string]interface{}{}
+	for i := len(list) - 1; i >= 0; i-- {
+		resp := list[i]
+		idempotencyCache.entries[resp.key] = idempotencyCache.lru.PushFront(resp)
+		kept[resp.stateKey()] = resp.stored()
+	}
+	stateReplace(idempotencyBucket, kept)
+}
+
+// idempotencyMiddleware replays the response to a PUT, POST or DELETE request carrying an
+// Idempotency-Key header when the request is retried with the same key within the window:
+// a retry while the first request is still running gets 409, reusing a key for a different
+// request 422; server errors aren't kept, so that retrying them runs the request again
+func idempotencyMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		idemKey := r.Header.Get(idempotencyKeyHeader)
+		if idemKey == "" || (r.Method != http.MethodPut && r.Method != http.MethodPost && r.Method != http.MethodDelete) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		fingerprint := sha256.Sum256(append([]byte(r.URL.RawQuery+"\x00"), body...))
+		// keys are scoped to the caller's credentials, so that callers can't replay each other's responses
+		caller := sha256.Sum256([]byte(r.Header.Get("Authorization") + "\x00" + r.Header.Get(APIKeyHeader)))
+		key := r.Method + " " + r.URL.Path + "\x00" + string(caller[:]) + "\x00" + idemKey
+
+		idempotencyCache.Lock()
+		if e, ok := idempotencyCache.entries[key]; ok {
+			resp := e.Value.(*idempotentResponse)
+			if time.Since(resp.at) <= idempotencyCache.window {
+				idempotencyCache.Unlock()
+				switch {
+				case resp.fingerprint != fingerprint:
+					http.Error(w, "the Idempotency-Key was already used for a different request", http.StatusUnprocessableEntity)
+				case !resp.done:
+					http.Error(w, "a request with this Idempotency-Key is still in progress", http.StatusConflict)
+				default:
+					counterAdd(idempotentReplaysMetric, "Responses replayed to retried requests with an Idempotency-Key.", 1)
+					for k, v := range resp.header {
+						w.Header()[k] = v
+					}
+					w.Header().Set("Idempotent-Replayed", "true")
+					w.WriteHeader(resp.status)
+					w.Write(resp.body)
+				}
+				return
+			}
+			idempotencyCache.lru.Remove(e)
+			delete(idempotencyCache.entries, key)
+		}
+		resp := &idempotentResponse{key: key, fingerprint: fingerprint, at: time.Now()}
+		idempotencyCache.entries[key] = idempotencyCache.lru.PushFront(resp)
+		for idempotencyCache.lru.Len() > idempotencyCache.size {
+			oldest := idempotencyCache.lru.Back()
+			idempotencyCache.lru.Remove(oldest)
+			delete(idempotencyCache.entries, oldest.Value.(*idempotentResponse).key)
+			stateDelete(idempotencyBucket, oldest.Value.(*idempotentResponse).stateKey())
+		}
+		idempotencyCache.Unlock()
+
+		rec := &idempotencyRecorder{ResponseWriter: w, status: http.StatusOK}
+		completed := false
+		defer func() {
+			idempotencyCache.Lock()
+			defer idempotencyCache.Unlock()
+			e, ok := idempotencyCache.entries[key]
+			if !ok || e.Value != resp {
+				return
+			}
+			// a panicking handler is answered with a server error further up
+			if !completed || rec.status >= http.StatusInternalServerError || rec.overflow {
+				idempotencyCache.lru.Remove(e)
+				delete(idempotencyCache.entries, key)
+				return
+			}
+			resp.done, resp.status, resp.header, resp.body = true, rec.status, rec.header, rec.body.Bytes()
+			if resp.header == nil {
+				resp.header = w.Header().Clone()
+			}
+			statePut(idempotencyBucket, resp.stateKey(), resp.stored())
+		}()
+		next.ServeHTTP(rec, r)
+		completed = true
+	})
+}
+
+// idempotencyRecorder keeps a copy of the response it passes through
+type idempotencyRecorder struct {
+	http.ResponseWriter
+	status      int
+	wroteHeader bool
+	header      http.Header
+	body        bytes.Buffer
+	overflow    bool
+}
+
+func (w *idempotencyRecorder) WriteHeader(status int) {
+	if w.wroteHeader {
+		return
+	}
+	w.wroteHeader = true
+	w.status = status
+	w.header = w.Header().Clone()
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *idempotencyRecorder) Write(p []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	if !w.overflow {
+		if w.body.Len()+len(p) > maxIdempotentResponse {
+			w.overflow = true
+			w.body = bytes.Buffer{}
+		} else {
+			w.body.Write(p)
+		}
+	}
+	return w.ResponseWriter.Write(p)
+}
+
+// Flush passes flushes of streamed responses through
+func (w *idempotencyRecorder) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
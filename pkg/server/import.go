@@ -0,0 +1,212 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/pubsub"
+	"cloud.google.com/go/storage"
+	"github.com/linkedin/goavro/v2"
+)
+
+const (
+	defaultImportBatchSize = 100
+	maxImportLineSize      = 10 << 20
+)
+
+// importRecordReader returns successive messages read from an archive object
+type importRecordReader func() (*pubsub.Message, error)
+
+// topicImportRequest is the body of POST /topics/<topic-name>/import
+type topicImportRequest struct {
+	GCSURI        string  `json:"gcsUri"`
+	BatchSize     int     `json:"batchSize"`
+	RatePerSecond float64 `json:"ratePerSecond"`
+}
+
+var topicImportSchema = objectSchema(map[string]*jsonSchema{
+	"gcsUri":        stringSchema("gs://<bucket>/<object> URI of the archive to import"),
+	"batchSize":     numberSchema("messages published at a time", true, 1),
+	"ratePerSecond": numberSchema("messages published per second, 0 for unlimited", false, 0),
+}, "gcsUri")
+
+// topicImportHandler handles POST to /topics/<topic-name>/import, publishing each
+// record of a GCS object (NDJSON as written by archivers or plain lines, or Avro) to the topic
+func topicImportHandler(ctx context.Context, w http.ResponseWriter, r *http.Request, client *pubsub.Client, topic *pubsub.Topic) {
+	// get import details from body:
+	// '{"gcsUri":"gs://my-bucket/archive/file.ndjson", "batchSize":100, "ratePerSecond":50}'
+	req := topicImportRequest{BatchSize: defaultImportBatchSize}
+	if !readRequest(w, r, topicImportSchema, &req) {
+		return
+	}
+	uri := req.GCSURI
+	bucketName, objectName, err := parseGCSURI(uri)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	batchSize := req.BatchSize
+	rate := req.RatePerSecond // messages per second, 0 for unlimited
+	// the records' attributes are checked against the policy as they are read
+	if err := authorizePublish(r, topic.ID(), nil); err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+
+	gcs, err := storage.NewClient(ctx)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer gcs.Close()
+	obj, err := gcs.Bucket(bucketName).Object(objectName).NewReader(ctx)
+	if err == storage.ErrObjectNotExist {
+		http.Error(w, fmt.Sprintf("object %s not found", uri), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer obj.Close()
+
+	next, err := newImportRecordReader(obj, strings.HasSuffix(objectName, ".avro"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// report progress after every batch
+	flusher, _ := w.(http.Flusher)
+	defer topic.Stop()
+	start := time.Now()
+	published, failed := 0, 0
+	var denied error
+	for batch := 0; ; batch++ {
+		var results []*pubsub.PublishResult
+		var readErr error
+		batchFailed := 0
+		for len(results)+batchFailed < batchSize {
+			msg, err := next()
+			if err != nil {
+				readErr = err
+				break
+			}
+			if err := authorizePublish(r, topic.ID(), []map[string]string{msg.Attributes}); err != nil {
+				denied = err
+				batchFailed++
+				continue
+			}
+			results = append(results, topic.Publish(ctx, msg))
+		}
+		batchPublished := 0
+		for _, res := range results {
+			if _, err := res.Get(ctx); err != nil {
+				batchFailed++
+			} else {
+				batchPublished++
+			}
+		}
+		published += batchPublished
+		failed += batchFailed
+		if batchPublished+batchFailed > 0 {
+			fmt.Fprintf(w, "[batch %d] published %d messages (%d failed)\n", batch, batchPublished, batchFailed)
+			if flusher != nil {
+				flusher.Flush()
+			}
+		}
+		if readErr == io.EOF {
+			break
+		}
+		if readErr != nil {
+			fmt.Fprintf(w, "reading %s: %v\n", uri, readErr)
+			break
+		}
+		if rate > 0 {
+			// pace batches so the overall publish rate stays at or below the limit
+			due := start.Add(time.Duration(float64(published+failed) / rate * float64(time.Second)))
+			select {
+			case <-time.After(time.Until(due)):
+			case <-r.Context().Done():
+				return
+			}
+		}
+	}
+	if denied != nil {
+		fmt.Fprintf(w, "records were denied by the publish policy: %v\n", denied)
+	}
+	fmt.Fprintf(w, "imported %d messages from %s to %s in %s (%d failed)\n",
+		published, uri, topic.String(), time.Since(start).Round(time.Millisecond), failed)
+}
+
+// parseGCSURI splits a gs://bucket/object URI into its bucket and object names
+func parseGCSURI(uri string) (bucket, object string, err error) {
+	path := strings.TrimPrefix(uri, "gs://")
+	i := strings.Index(path, "/")
+	if path == uri || i <= 0 || i == len(path)-1 {
+		return "", "", fmt.Errorf("invalid GCS URI %q, expected gs://<bucket>/<object>", uri)
+	}
+	return path[:i], path[i+1:], nil
+}
+
+// newImportRecordReader reads messages from an Avro container file as written by
+// archivers, or line by line, each line being an archived NDJSON record or raw message data
+func newImportRecordReader(rd io.Reader, avro bool) (importRecordReader, error) {
+	if avro {
+		ocf, err := goavro.NewOCFReader(bufio.NewReader(rd))
+		if err != nil {
+			return nil, err
+		}
+		return func() (*pubsub.Message, error) {
+			if !ocf.Scan() {
+				if err := ocf.Err(); err != nil {
+					return nil, err
+				}
+				return nil, io.EOF
+			}
+			datum, err := ocf.Read()
+			if err != nil {
+				return nil, err
+			}
+			rec, ok := datum.(map[string]interface{})
+			if !ok {
+				return nil, fmt.Errorf("unexpected Avro record type %T", datum)
+			}
+			msg := &pubsub.Message{}
+			msg.Data, _ = rec["data"].([]byte)
+			if attrs, ok := rec["attributes"].(map[string]interface{}); ok && len(attrs) > 0 {
+				msg.Attributes = make(map[string]string, len(attrs))
+				for k, v := range attrs {
+					msg.Attributes[k], _ = v.(string)
+				}
+			}
+			return msg, nil
+		}, nil
+	}
+
+	scanner := bufio.NewScanner(rd)
+	scanner.Buffer(make([]byte, 64*1024), maxImportLineSize)
+	return func() (*pubsub.Message, error) {
+		for scanner.Scan() {
+			line := scanner.Bytes()
+			if len(strings.TrimSpace(string(line))) == 0 {
+				continue
+			}
+			var rec archiveRecord
+			if line[0] == '{' && json.Unmarshal(line, &rec) == nil && rec.ID != "" {
+				return &pubsub.Message{Data: []byte(rec.Data), Attributes: rec.Attributes}, nil
+			}
+			return &pubsub.Message{Data: append([]byte(nil), line...)}, nil
+		}
+		if err := scanner.Err(); err != nil {
+			return nil, err
+		}
+		return nil, io.EOF
+	}, nil
+}
@@ -0,0 +1,290 @@
+package server
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/pubsub"
+)
+
+const (
+	maxIngestBodySize = 10 << 20
+
+	// stripeSignatureTolerance is how old a Stripe-Signature timestamp may be, against replays
+	stripeSignatureTolerance = 5 * time.Minute
+
+	ingestSignatureGitHub = "github"
+	ingestSignatureStripe = "stripe"
+	ingestSignatureHMAC   = "hmac-sha256"
+
+	defaultIngestSignatureHeader = "X-Signature"
+
+	ingestRequestsMetric = "second_ingest_requests_total"
+)
+
+// ingestSignature configures how webhook requests to an ingest route are authenticated
+type ingestSignature struct {
+	Scheme string `json:"scheme"`           // github, stripe or hmac-sha256
+	Secret string `json:"secret"`           // shared secret, never shown again
+	Header string `json:"header,omitempty"` // header carrying the hex HMAC, for hmac-sha256
+}
+
+var createIngestRouteSchema = objectSchema(map[string]*jsonSchema{
+	"name":  stringSchema("ingest route name"),
+	"topic": stringSchema("topic the webhook bodies are published to"),
+	"signature": objectSchema(map[string]*jsonSchema{
+		"scheme": {Type: "string", Description: "signature scheme", Enum: []string{ingestSignatureGitHub, ingestSignatureStripe, ingestSignatureHMAC}},
+		"secret": stringSchema("shared secret"),
+		"header": stringSchema("header carrying the hex HMAC, for hmac-sha256 (default " + defaultIngestSignatureHeader + ")"),
+	}, "scheme", "secret"),
+}, "name", "topic")
+
+// ingestRoute publishes the bodies of webhook requests posted to /ingest/<route-name> to a topic
+type ingestRoute struct {
+	name      string
+	topic     string
+	signature *ingestSignature
+	created   time.Time
+
+	mu       sync.Mutex
+	accepted int64
+	rejected int64
+}
+
+var ingestRoutes = struct {
+	sync.Mutex
+	m map[string]*ingestRoute
+}{m: map[string]*ingestRoute{}}
+
+// newIngestRoute validates the definition of an ingest route
+func newIngestRoute(name, topic string, sig *ingestSignature) (*ingestRoute, error) {
+	if name == "" {
+		return nil, fmt.Errorf("name must not be empty")
+	}
+	if err := validateResourceName("topic", topic); err != nil {
+		return nil, err
+	}
+	if sig != nil {
+		switch sig.Scheme {
+		case ingestSignatureGitHub, ingestSignatureStripe:
+		case ingestSignatureHMAC:
+			if sig.Header == "" {
+				sig.Header = defaultIngestSignatureHeader
+			}
+		default:
+			return nil, fmt.Errorf("signature scheme must be %s, %s or %s", ingestSignatureGitHub, ingestSignatureStripe, ingestSignatureHMAC)
+		}
+		if sig.Secret == "" {
+			return nil, fmt.Errorf("signature secret must not be empty")
+		}
+	}
+	return &ingestRoute{name: name, topic: topic, signature: sig, created: time.Now()}, nil
+}
+
+// listIngestRoutesHandler handles GET to /ingest
+func listIngestRoutesHandler(w http.ResponseWriter, r *http.Request) {
+	ingestRoutes.Lock()
+	list := make([]*ingestRoute, 0, len(ingestRoutes.m))
+	for _, ir := range ingestRoutes.m {
+		list = append(list, ir)
+	}
+	ingestRoutes.Unlock()
+	sort.Slice(list, func(i, j int) bool { return list[i].name < list[j].name })
+	fmt.Fprintln(w, "Ingest routes\n-------------")
+	for _, ir := range list {
+		fmt.Fprintln(w, ir.summary())
+	}
+	if len(list) == 0 {
+		fmt.Fprintln(w, "(none)")
+	}
+}
+
+// createIngestRouteHandler handles PUT to /ingest
+func createIngestRouteHandler(w http.ResponseWriter, r *http.Request) {
+	// get ingest route details from body:
+	// '{"name":"github-events", "topic":"my-topic", "signature":{"scheme":"github", "secret":"..."}}'
+	var req struct {
+		Name      string           `json:"name"`
+		Topic     string           `json:"topic"`
+		Signature *ingestSignature `json:"signature"`
+	}
+	if !readRequest(w, r, createIngestRouteSchema, &req) {
+		return
+	}
+	ir, err := newIngestRoute(req.Name, req.Topic, req.Signature)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	// signed webhooks are published on behalf of the route's creator
+	if err := authorizePublish(r, ir.topic, []map[string]string{{"ingestRoute": ir.name}}); err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+
+	ingestRoutes.Lock()
+	defer ingestRoutes.Unlock()
+	if _, ok := ingestRoutes.m[ir.name]; ok {
+		http.Error(w, fmt.Sprintf("ingest route %s already exists", ir.name), http.StatusConflict)
+		return
+	}
+	ingestRoutes.m[ir.name] = ir
+	fmt.Fprintf(w, "created ingest route %s\n", ir.summary())
+}
+
+// deleteIngestRouteHandler handles DELETE to /ingest/<route-name>
+func deleteIngestRouteHandler(w http.ResponseWriter, r *http.Request) {
+	name := pathParam(r, "name")
+	ingestRoutes.Lock()
+	defer ingestRoutes.Unlock()
+	if _, ok := ingestRoutes.m[name]; !ok {
+		http.Error(w, fmt.Sprintf("ingest route %s not found", name), http.StatusNotFound)
+		return
+	}
+	delete(ingestRoutes.m, name)
+	fmt.Fprintf(w, "deleted ingest route %s\n", name)
+}
+
+// ingestHandler handles POST to /ingest/<route-name>: webhooks are verified against the
+// route's signature settings and their body published to the route's topic
+func ingestHandler(w http.ResponseWriter, r *http.Request) {
+	name := pathParam(r, "name")
+	ingestRoutes.Lock()
+	ir, ok := ingestRoutes.m[name]
+	ingestRoutes.Unlock()
+	if !ok {
+		http.Error(w, fmt.Sprintf("ingest route %s not found", name), http.StatusNotFound)
+		return
+	}
+
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxIngestBodySize))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+		return
+	}
+	if ir.signature != nil {
+		if err := ir.signature.verify(r.Header, body); err != nil {
+			ir.mu.Lock()
+			ir.rejected++
+			ir.mu.Unlock()
+			counterAdd(ingestRequestsMetric, "Webhook requests to ingest routes, by route and result.", 1, "route", ir.name, "result", "rejected")
+			http.Error(w, "signature verification failed: "+err.Error(), http.StatusUnauthorized)
+			return
+		}
+	}
+
+	attrs := map[string]string{"ingestRoute": ir.name}
+	if ct := r.Header.Get("Content-Type"); ct != "" {
+		attrs["contentType"] = ct
+	}
+	if event := r.Header.Get("X-GitHub-Event"); event != "" {
+		attrs["githubEvent"] = event
+	}
+	// unsigned webhooks can only be attributed to their own credentials
+	if ir.signature == nil {
+		if err := authorizePublish(r, ir.topic, []map[string]string{attrs}); err != nil {
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+	}
+	id, err := publishMessage(ir.topic, &pubsub.Message{Data: body, Attributes: attrs})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	ir.mu.Lock()
+	ir.accepted++
+	ir.mu.Unlock()
+	counterAdd(ingestRequestsMetric, "Webhook requests to ingest routes, by route and result.", 1, "route", ir.name, "result", "accepted")
+	fmt.Fprintf(w, "published message ID %s\n", id)
+}
+
+// verify checks the request's signature header against the HMAC-SHA256 of the body
+func (sig *ingestSignature) verify(header http.Header, body []byte) error {
+	switch sig.Scheme {
+	case ingestSignatureGitHub:
+		// X-Hub-Signature-256: sha256=<hex>
+		v := header.Get("X-Hub-Signature-256")
+		if !strings.HasPrefix(v, "sha256=") {
+			return fmt.Errorf("X-Hub-Signature-256 header missing or malformed")
+		}
+		return checkHMAC(sig.Secret, body, strings.TrimPrefix(v, "sha256="))
+
+	case ingestSignatureStripe:
+		// Stripe-Signature: t=<unix-time>,v1=<hex>[,v1=<hex>...], signing "<unix-time>.<body>"
+		var ts string
+		var sigs []string
+		for _, part := range strings.Split(header.Get("Stripe-Signature"), ",") {
+			kv := strings.SplitN(strings.TrimSpace(part), "=", 2)
+			if len(kv) != 2 {
+				continue
+			}
+			switch kv[0] {
+			case "t":
+				ts = kv[1]
+			case "v1":
+				sigs = append(sigs, kv[1])
+			}
+		}
+		t, err := strconv.ParseInt(ts, 10, 64)
+		if err != nil || len(sigs) == 0 {
+			return fmt.Errorf("Stripe-Signature header missing or malformed")
+		}
+		if age := time.Since(time.Unix(t, 0)); age > stripeSignatureTolerance || age < -stripeSignatureTolerance {
+			return fmt.Errorf("Stripe-Signature timestamp outside the %s tolerance", stripeSignatureTolerance)
+		}
+		signed := append([]byte(ts+"."), body...)
+		for _, s := range sigs {
+			if checkHMAC(sig.Secret, signed, s) == nil {
+				return nil
+			}
+		}
+		return fmt.Errorf("no matching v1 signature")
+
+	default:
+		// <header>: [sha256=]<hex>
+		v := header.Get(sig.Header)
+		if v == "" {
+			return fmt.Errorf("%s header missing", sig.Header)
+		}
+		return checkHMAC(sig.Secret, body, strings.TrimPrefix(v, "sha256="))
+	}
+}
+
+// checkHMAC compares a hex HMAC-SHA256 signature of data in constant time
+func checkHMAC(secret string, data []byte, signature string) error {
+	got, err := hex.DecodeString(signature)
+	if err != nil {
+		return fmt.Errorf("signature is not hex encoded")
+	}
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(data)
+	if !hmac.Equal(got, mac.Sum(nil)) {
+		return fmt.Errorf("signature mismatch")
+	}
+	return nil
+}
+
+// summary returns a one-line description of the ingest route, without its secret
+func (ir *ingestRoute) summary() string {
+	ir.mu.Lock()
+	defer ir.mu.Unlock()
+	scheme := "none"
+	if ir.signature != nil {
+		scheme = ir.signature.Scheme
+		if scheme == ingestSignatureHMAC {
+			scheme += " (" + ir.signature.Header + ")"
+		}
+	}
+	return fmt.Sprintf("%s: topic=%s signature=%s accepted=%d rejected=%d since=%s",
+		ir.name, ir.topic, scheme, ir.accepted, ir.rejected, ir.created.Format(time.RFC3339))
+}
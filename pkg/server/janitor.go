@@ -0,0 +1,261 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/pubsub"
+	"google.golang.org/api/iterator"
+)
+
+const (
+	// demoLabel marks topics and subscriptions created by this service
+	demoLabel = "demo"
+	// createdAtLabel records when this service created a resource, in Unix seconds
+	createdAtLabel = "created-at"
+
+	defaultJanitorInterval = time.Hour
+)
+
+// demoLabels returns the labels set on resources created by this service
+func demoLabels() map[string]string {
+	return map[string]string{
+		demoLabel:      "second",
+		createdAtLabel: strconv.FormatInt(time.Now().Unix(), 10),
+	}
+}
+
+// withDemoLabels returns labels with the demo labels added, e.g. for resources copied from others
+func withDemoLabels(labels map[string]string) map[string]string {
+	m := demoLabels()
+	for k, v := range labels {
+		if k != demoLabel && k != createdAtLabel {
+			m[k] = v
+		}
+	}
+	return m
+}
+
+// janitorCandidate is an expired demo resource
+type janitorCandidate struct {
+	kind    string // "topic" or "subscription"
+	name    string
+	created time.Time
+}
+
+// janitor periodically deletes demo topics and subscriptions older than JANITOR_TTL
+var janitor = struct {
+	sync.Mutex
+	ttl      time.Duration
+	interval time.Duration
+	lastRun  time.Time
+	deleted  int
+	errors   []string
+}{}
+
+// startJanitor starts the background janitor if JANITOR_TTL is set
+func startJanitor() {
+	janitor.Lock()
+	defer janitor.Unlock()
+	if s := setting("JANITOR_TTL"); s != "" {
+		d, err := time.ParseDuration(s)
+		if err != nil || d <= 0 {
+			log.Printf("janitor: invalid JANITOR_TTL %q, janitor disabled", s)
+			return
+		}
+		janitor.ttl = d
+	}
+	janitor.interval = defaultJanitorInterval
+	if s := setting("JANITOR_INTERVAL"); s != "" {
+		d, err := time.ParseDuration(s)
+		if err != nil || d <= 0 {
+			log.Printf("janitor: invalid JANITOR_INTERVAL %q, using %s", s, defaultJanitorInterval)
+		} else {
+			janitor.interval = d
+		}
+	}
+	if janitor.ttl == 0 {
+		return
+	}
+	log.Printf("Janitor deleting demo resources older than %s every %s", janitor.ttl, janitor.interval)
+	go func() {
+		for {
+			// with several replicas, the leader runs the janitor
+			if isLeader() {
+				runJanitor()
+			}
+			time.Sleep(janitor.interval)
+		}
+	}()
+}
+
+// runJanitor deletes all expired demo resources once
+func runJanitor() {
+	projectID := setting("GOOGLE_CLOUD_PROJECT")
+	if projectID == "" {
+		log.Printf("janitor: failed to get project ID")
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), janitor.interval)
+	defer cancel()
+	client, err := pubsub.NewClient(ctx, projectID, backendOptions()...)
+	if err != nil {
+		log.Printf("janitor: %v", err)
+		return
+	}
+	defer client.Close()
+
+	candidates, err := expiredDemoResources(ctx, client, janitor.ttl)
+	deleted := 0
+	var errs []string
+	if err != nil {
+		errs = append(errs, err.Error())
+	}
+	for _, c := range candidates {
+		err := retryAdmin(ctx, adminOpDelete, func() error {
+			if c.kind == "topic" {
+				return client.Topic(c.name).Delete(ctx)
+			}
+			return client.Subscription(c.name).Delete(ctx)
+		})
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("%s %s: %v", c.kind, c.name, err))
+			continue
+		}
+		deleted++
+		noteResourceChange("deleted", c.kind, c.name, "janitor")
+		log.Printf("janitor: deleted %s %s created %s", c.kind, c.name, c.created.Format(time.RFC3339))
+	}
+
+	janitor.Lock()
+	janitor.lastRun = time.Now()
+	janitor.deleted += deleted
+	janitor.errors = errs
+	janitor.Unlock()
+}
+
+// expiredDemoResources lists demo topics and subscriptions created longer than ttl ago,
+// subscriptions first so they are deleted before their topics
+func expiredDemoResources(ctx context.Context, client *pubsub.Client, ttl time.Duration) ([]janitorCandidate, error) {
+	var candidates []janitorCandidate
+	expired := func(labels map[string]string) (time.Time, bool) {
+		if labels[demoLabel] == "" {
+			return time.Time{}, false
+		}
+		secs, err := strconv.ParseInt(labels[createdAtLabel], 10, 64)
+		if err != nil {
+			return time.Time{}, false
+		}
+		created := time.Unix(secs, 0)
+		return created, time.Since(created) > ttl
+	}
+
+	sit := client.Subscriptions(ctx)
+	for {
+		s, err := sit.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return candidates, err
+		}
+		cfg, err := s.Config(ctx)
+		if err != nil {
+			return candidates, err
+		}
+		if created, ok := expired(cfg.Labels); ok {
+			candidates = append(candidates, janitorCandidate{kind: "subscription", name: s.ID(), created: created})
+		}
+	}
+
+	tit := client.Topics(ctx)
+	for {
+		t, err := tit.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return candidates, err
+		}
+		cfg, err := t.Config(ctx)
+		if err != nil {
+			return candidates, err
+		}
+		if created, ok := expired(cfg.Labels); ok {
+			candidates = append(candidates, janitorCandidate{kind: "topic", name: t.ID(), created: created})
+		}
+	}
+	return candidates, nil
+}
+
+// janitorHandler handles GET to /janitor, reporting what the janitor would delete
+// now (dry run), optionally for a different TTL given as ?ttl=<duration>
+func janitorHandler(w http.ResponseWriter, r *http.Request) {
+	projectID := setting("GOOGLE_CLOUD_PROJECT")
+	if projectID == "" {
+		http.Error(w, "failed to get project ID", http.StatusServiceUnavailable)
+		return
+	}
+
+	janitor.Lock()
+	ttl := janitor.ttl
+	janitor.Unlock()
+	if s := r.URL.Query().Get("ttl"); s != "" {
+		d, err := time.ParseDuration(s)
+		if err != nil || d < 0 {
+			http.Error(w, "ttl must be a non-negative duration", http.StatusBadRequest)
+			return
+		}
+		ttl = d
+	}
+	if ttl == 0 && r.URL.Query().Get("ttl") == "" {
+		http.Error(w, "janitor is disabled (JANITOR_TTL not set), pass ?ttl=<duration> for a report", http.StatusBadRequest)
+		return
+	}
+
+	ctx := context.Background()
+	client, err := pubsub.NewClient(ctx, projectID, backendOptions()...)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer client.Close()
+
+	candidates, err := expiredDemoResources(ctx, client, ttl)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJanitorStatus(w)
+	fmt.Fprintf(w, "Demo resources older than %s (dry run)\n", ttl)
+	for i, c := range candidates {
+		fmt.Fprintf(w, "[%d] %s %s created %s\n", i, c.kind, c.name, c.created.Format(time.RFC3339))
+	}
+	if len(candidates) == 0 {
+		fmt.Fprintln(w, "(none)")
+	}
+}
+
+// writeJanitorStatus reports the janitor's configuration and last run
+func writeJanitorStatus(w io.Writer) {
+	janitor.Lock()
+	defer janitor.Unlock()
+	if janitor.ttl == 0 {
+		fmt.Fprintln(w, "janitor disabled")
+		return
+	}
+	fmt.Fprintf(w, "janitor ttl=%s interval=%s deleted=%d", janitor.ttl, janitor.interval, janitor.deleted)
+	if !janitor.lastRun.IsZero() {
+		fmt.Fprintf(w, " lastRun=%s", janitor.lastRun.Format(time.RFC3339))
+	}
+	fmt.Fprintln(w)
+	for _, e := range janitor.errors {
+		fmt.Fprintf(w, "    last run error: %s\n", e)
+	}
+}
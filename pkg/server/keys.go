@@ -0,0 +1,343 @@
+package server
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// API keys can be managed through /admin/keys instead of PUBLISH_POLICY_FILE: they are kept in the
+// state store, only as hashes, and can expire, be disabled and be rotated. A key's scopes are
+// publish:<topic-pattern> entries, like the topics of a grant. Creating the first key turns the
+// publish policy on.
+
+const (
+	apiKeyScopePublish = "publish:"
+
+	defaultKeyRotationGrace = time.Hour
+)
+
+// managedKey is an API key created through /admin/keys; the key itself is only shown once
+type managedKey struct {
+	ID                 string            `json:"id"`
+	Principal          string            `json:"principal"`
+	Namespace          string            `json:"namespace,omitempty"` // the tenant the key belongs to, if any
+	Hash               string            `json:"hash"`                // hex SHA-256 of the key
+	Scopes             []string          `json:"scopes"`
+	RequiredAttributes map[string]string `json:"requiredAttributes,omitempty"`
+	Created            time.Time         `json:"created"`
+	Expires            time.Time         `json:"expires,omitempty"` // zero if it doesn't expire
+	Disabled           bool              `json:"disabled,omitempty"`
+	Rotated            time.Time         `json:"rotated,omitempty"`
+
+	// the key replaced by the last rotation keeps working until PreviousExpires
+	PreviousHash    string    `json:"previousHash,omitempty"`
+	PreviousExpires time.Time `json:"previousExpires,omitempty"`
+}
+
+var managedKeys = struct {
+	sync.Mutex
+	m map[string]*managedKey
+}{m: map[string]*managedKey{}}
+
+// loadManagedKeys reads the keys kept in the state store
+func loadManagedKeys() {
+	managedKeys.Lock()
+	defer managedKeys.Unlock()
+	stateLoad(apiKeysBucket, func(id string, data []byte) error {
+		k := &managedKey{}
+		if err := json.Unmarshal(data, k); err != nil {
+			return err
+		}
+		managedKeys.m[id] = k
+		return nil
+	})
+}
+
+func hashAPIKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// newAPIKeySecret returns a new key and its hash
+func newAPIKeySecret() (string, string) {
+	key := "sk_" + randomID()
+	return key, hashAPIKey(key)
+}
+
+// managedKeyGrant returns the grant of the managed key matching key, nil if none matches, or
+// the reason the matching key can't be used; the scopes of a tenant's key are within its namespace
+func managedKeyGrant(key string) (*publishGrant, error) {
+	k, err := lookupManagedKey(key)
+	if k == nil {
+		return nil, err
+	}
+	g := &publishGrant{Principal: k.Principal, Key: key, RequiredAttributes: k.RequiredAttributes}
+	for _, scope := range k.Scopes {
+		g.Topics = append(g.Topics, tenantName(k.Namespace, strings.TrimPrefix(scope, apiKeyScopePublish)))
+	}
+	return g, nil
+}
+
+// lookupManagedKey returns a copy of the managed key matching key, nil if none matches, or the
+// reason the matching key can't be used
+func lookupManagedKey(key string) (*managedKey, error) {
+	hash := hashAPIKey(key)
+	now := time.Now()
+	managedKeys.Lock()
+	defer managedKeys.Unlock()
+	for _, k := range managedKeys.m {
+		current := subtle.ConstantTimeCompare([]byte(hash), []byte(k.Hash)) == 1
+		previous := k.PreviousHash != "" && subtle.ConstantTimeCompare([]byte(hash), []byte(k.PreviousHash)) == 1
+		if !current && !previous {
+			continue
+		}
+		switch {
+		case k.Disabled:
+			return nil, fmt.Errorf("API key %s is disabled", k.ID)
+		case !k.Expires.IsZero() && now.After(k.Expires):
+			return nil, fmt.Errorf("API key %s expired at %s", k.ID, k.Expires.Format(time.RFC3339))
+		case previous && now.After(k.PreviousExpires):
+			return nil, fmt.Errorf("API key %s was rotated at %s: use the new key", k.ID, k.Rotated.Format(time.RFC3339))
+		}
+		found := *k
+		return &found, nil
+	}
+	return nil, nil
+}
+
+func managedKeysExist() bool {
+	managedKeys.Lock()
+	defer managedKeys.Unlock()
+	return len(managedKeys.m) > 0
+}
+
+// state returns active, disabled or expired
+func (k *managedKey) state() string {
+	switch {
+	case k.Disabled:
+		return "disabled"
+	case !k.Expires.IsZero() && time.Now().After(k.Expires):
+		return "expired"
+	}
+	return "active"
+}
+
+func (k *managedKey) summary() string {
+	s := fmt.Sprintf("%s: principal=%s hash=sha256:%s… scopes=%s state=%s created=%s",
+		k.ID, k.Principal, k.Hash[:12], strings.Join(k.Scopes, ","), k.state(), k.Created.Format(time.RFC3339))
+	if k.Namespace != "" {
+		s += " namespace=" + k.Namespace
+	}
+	if !k.Expires.IsZero() {
+		s += " expires=" + k.Expires.Format(time.RFC3339)
+	}
+	if !k.Rotated.IsZero() {
+		s += " rotated=" + k.Rotated.Format(time.RFC3339)
+		if time.Now().Before(k.PreviousExpires) {
+			s += " previousKeyValidUntil=" + k.PreviousExpires.Format(time.RFC3339)
+		}
+	}
+	return s
+}
+
+func requireAdmin(w http.ResponseWriter, r *http.Request) bool {
+	if !isAdmin(r) {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		http.Error(w, "admin token required", http.StatusUnauthorized)
+		return false
+	}
+	return true
+}
+
+// listKeysHandler handles GET to /admin/keys
+func listKeysHandler(w http.ResponseWriter, r *http.Request) {
+	if !requireAdmin(w, r) {
+		return
+	}
+	fmt.Fprintln(w, "API keys\n--------")
+	list := managedKeySummaries()
+	for _, s := range list {
+		fmt.Fprintln(w, s)
+	}
+	if len(list) == 0 {
+		fmt.Fprintln(w, "(none)")
+	}
+}
+
+var createKeySchema = objectSchema(map[string]*jsonSchema{
+	"principal":          stringSchema("who the key is for"),
+	"namespace":          stringSchema("tenant namespace the key belongs to (scopes default to publish:*)"),
+	"scopes":             {Type: "array", Description: "what the key may do", Items: stringSchema(apiKeyScopePublish + "<topic-pattern>")},
+	"expiresIn":          stringSchema("how long the key is valid, like \"720h\" (default forever)"),
+	"requiredAttributes": stringMapSchema("attributes the key's messages must carry; $principal stands for the principal"),
+}, "principal")
+
+// createKeyHandler handles POST to /admin/keys
+func createKeyHandler(w http.ResponseWriter, r *http.Request) {
+	// get key details from body:
+	// '{"principal":"team-x", "scopes":["publish:team-x-*"], "expiresIn":"720h", "requiredAttributes":{"source":"$principal"}}',
+	// or for a tenant: '{"principal":"alice", "namespace":"team7", "scopes":["publish:*"]}'
+	if !requireAdmin(w, r) {
+		return
+	}
+	var req struct {
+		Principal          string            `json:"principal"`
+		Namespace          string            `json:"namespace"`
+		Scopes             []string          `json:"scopes"`
+		ExpiresIn          string            `json:"expiresIn"`
+		RequiredAttributes map[string]string `json:"requiredAttributes"`
+	}
+	if !readRequest(w, r, createKeySchema, &req) {
+		return
+	}
+	if req.Principal == "" {
+		http.Error(w, "principal must not be empty", http.StatusBadRequest)
+		return
+	}
+	if req.Namespace != "" {
+		if !namespacePattern.MatchString(req.Namespace) {
+			http.Error(w, "namespace must be a lowercase letter followed by up to 19 lowercase letters or digits", http.StatusBadRequest)
+			return
+		}
+		if len(req.Scopes) == 0 {
+			req.Scopes = []string{apiKeyScopePublish + "*"}
+		}
+	}
+	if len(req.Scopes) == 0 {
+		http.Error(w, "scopes must not be empty", http.StatusBadRequest)
+		return
+	}
+	for _, scope := range req.Scopes {
+		pattern := strings.TrimPrefix(scope, apiKeyScopePublish)
+		if pattern == scope {
+			http.Error(w, fmt.Sprintf("scope %q must be %s<topic-pattern>", scope, apiKeyScopePublish), http.StatusBadRequest)
+			return
+		}
+		if _, err := path.Match(pattern, ""); err != nil {
+			http.Error(w, fmt.Sprintf("scope %q: %v", scope, err), http.StatusBadRequest)
+			return
+		}
+	}
+	key, hash := newAPIKeySecret()
+	k := &managedKey{
+		ID:                 "key-" + randomID()[:8],
+		Principal:          req.Principal,
+		Namespace:          req.Namespace,
+		Hash:               hash,
+		Scopes:             req.Scopes,
+		RequiredAttributes: req.RequiredAttributes,
+		Created:            time.Now(),
+	}
+	if req.ExpiresIn != "" {
+		d, err := time.ParseDuration(req.ExpiresIn)
+		if err != nil || d <= 0 {
+			http.Error(w, "expiresIn must be a positive duration", http.StatusBadRequest)
+			return
+		}
+		k.Expires = k.Created.Add(d)
+	}
+
+	managedKeys.Lock()
+	managedKeys.m[k.ID] = k
+	statePut(apiKeysBucket, k.ID, k)
+	managedKeys.Unlock()
+	w.WriteHeader(http.StatusCreated)
+	fmt.Fprintf(w, "created API key %s\n", k.summary())
+	fmt.Fprintf(w, "key: %s\n(shown only once: send it in the %s header)\n", key, APIKeyHeader)
+}
+
+// lookupManagedKeyLocked returns the key of the request path, or responds 404
+func lookupManagedKeyLocked(w http.ResponseWriter, r *http.Request) (*managedKey, bool) {
+	id := pathParam(r, "id")
+	k, ok := managedKeys.m[id]
+	if !ok {
+		http.Error(w, fmt.Sprintf("API key %s not found", id), http.StatusNotFound)
+	}
+	return k, ok
+}
+
+// disableKeyHandler handles POST to /admin/keys/<key-id>/disable
+func disableKeyHandler(w http.ResponseWriter, r *http.Request) {
+	if !requireAdmin(w, r) {
+		return
+	}
+	managedKeys.Lock()
+	defer managedKeys.Unlock()
+	k, ok := lookupManagedKeyLocked(w, r)
+	if !ok {
+		return
+	}
+	k.Disabled = true
+	statePut(apiKeysBucket, k.ID, k)
+	fmt.Fprintf(w, "disabled API key %s\n", k.summary())
+}
+
+// rotateKeyHandler handles POST to /admin/keys/<key-id>/rotate[?grace=<duration>]: the key is
+// replaced by a new one, and the old one keeps working for the grace period (default 1h)
+func rotateKeyHandler(w http.ResponseWriter, r *http.Request) {
+	if !requireAdmin(w, r) {
+		return
+	}
+	grace := defaultKeyRotationGrace
+	if s := r.URL.Query().Get("grace"); s != "" {
+		d, err := time.ParseDuration(s)
+		if err != nil || d < 0 {
+			http.Error(w, "grace must be a non-negative duration", http.StatusBadRequest)
+			return
+		}
+		grace = d
+	}
+	managedKeys.Lock()
+	defer managedKeys.Unlock()
+	k, ok := lookupManagedKeyLocked(w, r)
+	if !ok {
+		return
+	}
+	if k.Disabled {
+		http.Error(w, fmt.Sprintf("API key %s is disabled", k.ID), http.StatusConflict)
+		return
+	}
+	key, hash := newAPIKeySecret()
+	k.Rotated = time.Now()
+	k.PreviousHash, k.PreviousExpires = k.Hash, k.Rotated.Add(grace)
+	k.Hash = hash
+	statePut(apiKeysBucket, k.ID, k)
+	fmt.Fprintf(w, "rotated API key %s\n", k.summary())
+	fmt.Fprintf(w, "key: %s\n(shown only once; the previous key works until %s)\n", key, k.PreviousExpires.Format(time.RFC3339))
+}
+
+// deleteKeyHandler handles DELETE to /admin/keys/<key-id>
+func deleteKeyHandler(w http.ResponseWriter, r *http.Request) {
+	if !requireAdmin(w, r) {
+		return
+	}
+	managedKeys.Lock()
+	defer managedKeys.Unlock()
+	k, ok := lookupManagedKeyLocked(w, r)
+	if !ok {
+		return
+	}
+	delete(managedKeys.m, k.ID)
+	stateDelete(apiKeysBucket, k.ID)
+	fmt.Fprintf(w, "deleted API key %s\n", k.ID)
+}
+
+func managedKeySummaries() []string {
+	managedKeys.Lock()
+	defer managedKeys.Unlock()
+	var list []string
+	for _, k := range managedKeys.m {
+		list = append(list, k.summary())
+	}
+	sort.Strings(list)
+	return list
+}
@@ -0,0 +1,184 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/pubsub"
+	monitoring "google.golang.org/api/monitoring/v3"
+)
+
+const (
+	// receiveRateWindow is the period the service's own receive rate is averaged over
+	receiveRateWindow = 10 * time.Minute
+
+	receivedMessagesMetric = "second_messages_received_total"
+)
+
+// receiveBucket counts the messages received from a subscription during one minute
+type receiveBucket struct {
+	minute int64 // Unix minute
+	count  int
+}
+
+// receiveRates tracks how many messages this service received per subscription,
+// over the last receiveRateWindow, in per-minute buckets
+var receiveRates = struct {
+	sync.Mutex
+	buckets map[string][]receiveBucket
+}{buckets: map[string][]receiveBucket{}}
+
+// recordReceived records that n messages were received from a subscription
+func recordReceived(subscrName string, n int) {
+	if n == 0 {
+		return
+	}
+	counterAdd(receivedMessagesMetric, "Messages received through this service, by subscription.", float64(n), "subscription", subscrName)
+	noteSubscriptionActivity(subscrName)
+
+	receiveRates.Lock()
+	defer receiveRates.Unlock()
+	minute := time.Now().Unix() / 60
+	buckets := receiveRates.buckets[subscrName]
+	if len(buckets) > 0 && buckets[len(buckets)-1].minute == minute {
+		buckets[len(buckets)-1].count += n
+	} else {
+		buckets = append(buckets, receiveBucket{minute: minute, count: n})
+	}
+	// drop buckets that fell out of the window
+	oldest := minute - int64(receiveRateWindow/time.Minute)
+	for len(buckets) > 0 && buckets[0].minute <= oldest {
+		buckets = buckets[1:]
+	}
+	receiveRates.buckets[subscrName] = buckets
+}
+
+// receiveRate returns the average rate in messages per second this service received
+// from a subscription over the last receiveRateWindow
+func receiveRate(subscrName string) float64 {
+	receiveRates.Lock()
+	defer receiveRates.Unlock()
+	oldest := time.Now().Unix()/60 - int64(receiveRateWindow/time.Minute)
+	total := 0
+	for _, b := range receiveRates.buckets[subscrName] {
+		if b.minute > oldest {
+			total += b.count
+		}
+	}
+	return float64(total) / receiveRateWindow.Seconds()
+}
+
+// subscriptionLagHandler handles GET to /subscriptions/<subscription-name>/lag, combining the
+// subscription's backlog metrics with the service's own receive rate into a time-to-drain estimate
+func subscriptionLagHandler(ctx context.Context, w http.ResponseWriter, r *http.Request, client *pubsub.Client, subscr *pubsub.Subscription) {
+	projectID := setting("GOOGLE_CLOUD_PROJECT")
+	undelivered, undeliveredAt, err := latestSubscriptionMetric(ctx, projectID, subscr.ID(), "pubsub.googleapis.com/subscription/num_undelivered_messages")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	oldestAge, _, err := latestSubscriptionMetric(ctx, projectID, subscr.ID(), "pubsub.googleapis.com/subscription/oldest_unacked_message_age")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	rate := receiveRate(subscr.ID())
+
+	fmt.Fprintln(w, subscr.String())
+	if undeliveredAt.IsZero() {
+		fmt.Fprintln(w, "undelivered messages: unknown (no recent backlog metrics)")
+	} else {
+		fmt.Fprintf(w, "undelivered messages: %d (as of %s)\n", int64(undelivered), undeliveredAt.Format(time.RFC3339))
+	}
+	fmt.Fprintf(w, "oldest unacked message age: %s\n", (time.Duration(oldestAge) * time.Second).String())
+	fmt.Fprintf(w, "receive rate through this service: %.2f messages/s (last %s)\n", rate, receiveRateWindow)
+	switch {
+	case undeliveredAt.IsZero():
+		fmt.Fprintln(w, "estimated time to drain: unknown")
+	case undelivered == 0:
+		fmt.Fprintln(w, "estimated time to drain: 0s (no backlog)")
+	case rate == 0:
+		fmt.Fprintln(w, "estimated time to drain: never at the current rate (nothing received through this service)")
+	default:
+		fmt.Fprintf(w, "estimated time to drain: %s\n", time.Duration(undelivered/rate*float64(time.Second)).Round(time.Second))
+	}
+}
+
+// latestSubscriptionMetric returns the most recent value of a Cloud Monitoring metric for a subscription,
+// and the time it was measured at (zero if there's no data point in the last 10 minutes)
+func latestSubscriptionMetric(ctx context.Context, projectID, subscrID, metricType string) (float64, time.Time, error) {
+	svc, err := monitoring.NewService(ctx)
+	if err != nil {
+		return 0, time.Time{}, err
+	}
+	now := time.Now()
+	resp, err := svc.Projects.TimeSeries.List("projects/" + projectID).
+		Filter(fmt.Sprintf(`metric.type = %q AND resource.labels.subscription_id = %q`, metricType, subscrID)).
+		IntervalStartTime(now.Add(-10 * time.Minute).Format(time.RFC3339)).
+		IntervalEndTime(now.Format(time.RFC3339)).
+		Context(ctx).Do()
+	if err != nil {
+		return 0, time.Time{}, err
+	}
+	for _, ts := range resp.TimeSeries {
+		// points are returned newest first
+		for _, p := range ts.Points {
+			if p.Value == nil || p.Interval == nil {
+				continue
+			}
+			at, _ := time.Parse(time.RFC3339, p.Interval.EndTime)
+			switch {
+			case p.Value.Int64Value != nil:
+				return float64(*p.Value.Int64Value), at, nil
+			case p.Value.DoubleValue != nil:
+				return *p.Value.DoubleValue, at, nil
+			}
+		}
+	}
+	return 0, time.Time{}, nil
+}
+
+// projectBacklog returns the most recent number of undelivered messages of each of the project's
+// subscriptions with a data point in the last 10 minutes, by subscription, and when the newest was measured
+func projectBacklog(ctx context.Context, projectID string) (map[string]float64, time.Time, error) {
+	svc, err := monitoring.NewService(ctx)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	now := time.Now()
+	resp, err := svc.Projects.TimeSeries.List("projects/" + projectID).
+		Filter(`metric.type = "pubsub.googleapis.com/subscription/num_undelivered_messages"`).
+		IntervalStartTime(now.Add(-10 * time.Minute).Format(time.RFC3339)).
+		IntervalEndTime(now.Format(time.RFC3339)).
+		Context(ctx).Do()
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	backlog := map[string]float64{}
+	var latest time.Time
+	for _, ts := range resp.TimeSeries {
+		if ts.Resource == nil || len(ts.Points) == 0 {
+			continue
+		}
+		// points are returned newest first
+		p := ts.Points[0]
+		if p.Value == nil || p.Interval == nil {
+			continue
+		}
+		switch {
+		case p.Value.Int64Value != nil:
+			backlog[ts.Resource.Labels["subscription_id"]] = float64(*p.Value.Int64Value)
+		case p.Value.DoubleValue != nil:
+			backlog[ts.Resource.Labels["subscription_id"]] = *p.Value.DoubleValue
+		default:
+			continue
+		}
+		if at, _ := time.Parse(time.RFC3339, p.Interval.EndTime); at.After(latest) {
+			latest = at
+		}
+	}
+	return backlog, latest, nil
+}
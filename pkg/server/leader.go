@@ -0,0 +1,206 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"google.golang.org/api/googleapi"
+)
+
+// With several replicas of the service, the subsystems that act on their own schedule (the
+// scheduler publishing scheduled messages, the janitor deleting expired demo resources) must run
+// on one replica only. The replicas elect a leader through a lease object in the GCS bucket
+// LEADER_LEASE_BUCKET: the leader rewrites it every third of LEADER_LEASE_TTL, the others take
+// it over once it expired, with generation preconditions making each write a compare-and-swap.
+// Without a bucket, the instance is always the leader, as a single instance should be.
+// Routes, archivers and sinks need no election: replicas pulling from the same subscription
+// share its messages.
+
+const (
+	leaderLeaseObject     = "second-leader-lease"
+	defaultLeaderLeaseTTL = 30 * time.Second
+
+	leaderMetric = "second_leader"
+)
+
+// leaderLease is the content of the lease object
+type leaderLease struct {
+	Holder  string    `json:"holder"`
+	Expires time.Time `json:"expires"`
+}
+
+var leader = struct {
+	sync.Mutex
+	bucket     string
+	ttl        time.Duration
+	gcs        *storage.Client
+	leading    bool
+	expires    time.Time // of the lease this instance holds
+	generation int64     // of the lease object this instance wrote
+	holder     string    // the current leader, as last seen
+	since      time.Time
+	lastError  string
+}{ttl: defaultLeaderLeaseTTL}
+
+// startLeaderElection reads LEADER_LEASE_BUCKET and LEADER_LEASE_TTL and campaigns for leadership
+func startLeaderElection() {
+	leader.Lock()
+	defer leader.Unlock()
+	if s := setting("LEADER_LEASE_TTL"); s != "" {
+		if d, err := time.ParseDuration(s); err != nil || d < 3*time.Second {
+			log.Printf("leader: invalid LEADER_LEASE_TTL %q, using %s", s, defaultLeaderLeaseTTL)
+		} else {
+			leader.ttl = d
+		}
+	}
+	leader.bucket = setting("LEADER_LEASE_BUCKET")
+	if leader.bucket == "" {
+		setLeadingLocked(true, instanceID)
+		return
+	}
+	gcs, err := storage.NewClient(context.Background())
+	if err != nil {
+		// better no scheduled work than duplicate scheduled work
+		log.Printf("leader: %v (not leading)", err)
+		leader.lastError = err.Error()
+		setLeadingLocked(false, "")
+		return
+	}
+	leader.gcs = gcs
+	setLeadingLocked(false, "")
+	log.Printf("Campaigning for leadership as %s with lease gs://%s/%s", instanceID, leader.bucket, leaderLeaseObject)
+	go func() {
+		for {
+			campaign()
+			time.Sleep(leader.ttl / 3)
+		}
+	}()
+}
+
+// isLeader reports whether this instance runs the subsystems that must run on one replica only
+func isLeader() bool {
+	leader.Lock()
+	defer leader.Unlock()
+	return leader.leading
+}
+
+// campaign renews the lease if this instance holds it, or takes it over if it expired
+func campaign() {
+	ctx, cancel := context.WithTimeout(context.Background(), leader.ttl/3)
+	defer cancel()
+	obj := leader.gcs.Bucket(leader.bucket).Object(leaderLeaseObject)
+
+	cond := storage.Conditions{DoesNotExist: true}
+	rd, err := obj.NewReader(ctx)
+	switch {
+	case errors.Is(err, storage.ErrObjectNotExist):
+	case err != nil:
+		campaignFailed(err)
+		return
+	default:
+		var cur leaderLease
+		err := json.NewDecoder(rd).Decode(&cur)
+		rd.Close()
+		if err == nil && cur.Holder != instanceID && time.Now().Before(cur.Expires) {
+			leader.Lock()
+			setLeadingLocked(false, cur.Holder)
+			leader.Unlock()
+			return
+		}
+		cond = storage.Conditions{GenerationMatch: rd.Attrs.Generation}
+	}
+
+	expires := time.Now().Add(leader.ttl)
+	w := obj.If(cond).NewWriter(ctx)
+	w.ContentType = "application/json"
+	json.NewEncoder(w).Encode(leaderLease{Holder: instanceID, Expires: expires})
+	if err := w.Close(); err != nil {
+		var gerr *googleapi.Error
+		if errors.As(err, &gerr) && gerr.Code == http.StatusPreconditionFailed {
+			// another instance wrote the lease since it was read
+			leader.Lock()
+			setLeadingLocked(false, "")
+			leader.Unlock()
+			return
+		}
+		campaignFailed(err)
+		return
+	}
+	leader.Lock()
+	leader.expires, leader.generation, leader.lastError = expires, w.Attrs().Generation, ""
+	setLeadingLocked(true, instanceID)
+	leader.Unlock()
+}
+
+// campaignFailed keeps the leadership until the lease this instance holds expires, since no other
+// instance takes it over before then
+func campaignFailed(err error) {
+	log.Printf("leader: %v", err)
+	leader.Lock()
+	defer leader.Unlock()
+	leader.lastError = err.Error()
+	if leader.leading && time.Now().After(leader.expires) {
+		setLeadingLocked(false, "")
+	}
+}
+
+// stopLeaderElection gives up the lease on shutdown, so that another instance takes over right away
+func stopLeaderElection() {
+	leader.Lock()
+	defer leader.Unlock()
+	if leader.gcs == nil || !leader.leading {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	obj := leader.gcs.Bucket(leader.bucket).Object(leaderLeaseObject)
+	if err := obj.If(storage.Conditions{GenerationMatch: leader.generation}).Delete(ctx); err != nil {
+		log.Printf("leader: releasing lease: %v", err)
+	}
+	setLeadingLocked(false, "")
+}
+
+func setLeadingLocked(leading bool, holder string) {
+	if leading != leader.leading || leader.since.IsZero() {
+		leader.since = time.Now()
+		if leader.bucket != "" {
+			if leading {
+				log.Printf("leader: %s is now leading", instanceID)
+			} else if leader.leading {
+				log.Printf("leader: %s stopped leading", instanceID)
+			}
+		}
+	}
+	leader.leading, leader.holder = leading, holder
+	v := 0.0
+	if leading {
+		v = 1
+	}
+	gaugeSet(leaderMetric, "Whether this instance runs the scheduler and janitor (1) or leaves them to another replica (0).", v)
+}
+
+func leaderSummaries() []string {
+	leader.Lock()
+	defer leader.Unlock()
+	if leader.bucket == "" {
+		return []string{fmt.Sprintf("%s: leading (no LEADER_LEASE_BUCKET, single instance)", instanceID)}
+	}
+	s := fmt.Sprintf("%s: following %s since %s", instanceID, leader.holder, leader.since.Format(time.RFC3339))
+	if leader.holder == "" {
+		s = fmt.Sprintf("%s: no known leader since %s", instanceID, leader.since.Format(time.RFC3339))
+	}
+	if leader.leading {
+		s = fmt.Sprintf("%s: leading since %s, lease until %s", instanceID, leader.since.Format(time.RFC3339), leader.expires.Format(time.RFC3339))
+	}
+	if leader.lastError != "" {
+		s += ", last error: " + leader.lastError
+	}
+	return []string{s}
+}
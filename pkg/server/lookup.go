@@ -0,0 +1,98 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+)
+
+// Looking up a topic or subscription fails for reasons clients handle differently, so the failure
+// is kept with the resource until it's responded with (see writeLookupError): access denied is 403,
+// naming the permission missing, not found 404 (the Pub/Sub client's Exists reports NotFound errors
+// as not existing), transient backend errors 503 with Retry-After, like other admin calls (see
+// writeAdminError), and other errors 500.
+
+// lookupError is the failed lookup of a topic or subscription; err is nil if it doesn't exist
+type lookupError struct {
+	kind string // e.g. "topic" or "reply topic"
+	name string
+	err  error
+}
+
+// lookupPermissions are the IAM permissions looking up a resource takes, by the last word of its kind
+var lookupPermissions = map[string]string{
+	"topic":        "pubsub.topics.get",
+	"subscription": "pubsub.subscriptions.get",
+}
+
+func (e *lookupError) Error() string {
+	if e.err == nil {
+		return fmt.Sprintf("%s %s not found", e.kind, e.name)
+	}
+	if st, ok := grpcStatus(e.err); ok && st.Code() == codes.PermissionDenied {
+		return fmt.Sprintf("permission denied looking up %s %s: missing permission %s (%s)", e.kind, e.name, e.permission(), st.Message())
+	}
+	return fmt.Sprintf("looking up %s %s: %v", e.kind, e.name, e.err)
+}
+
+func (e *lookupError) Unwrap() error { return e.err }
+
+// permission returns the permission a denied lookup lacked, as the backend names it or else
+// the one the lookup takes
+func (e *lookupError) permission() string {
+	if st, ok := grpcStatus(e.err); ok {
+		for _, d := range st.Details() {
+			if info, ok := d.(*errdetails.ErrorInfo); ok && info.Metadata["permission"] != "" {
+				return info.Metadata["permission"]
+			}
+		}
+	}
+	for kind, p := range lookupPermissions {
+		if strings.HasSuffix(e.kind, kind) {
+			return p
+		}
+	}
+	return ""
+}
+
+// status returns the HTTP status of the failed lookup, 0 for that of other backend errors
+func (e *lookupError) status() int {
+	if e.err == nil {
+		return http.StatusNotFound
+	}
+	if st, ok := grpcStatus(e.err); ok && st.Code() == codes.PermissionDenied {
+		return http.StatusForbidden
+	}
+	return 0
+}
+
+// checkExists looks up a topic or subscription with its Exists method, returning a *lookupError
+// unless it exists
+func checkExists(ctx context.Context, kind, name string, exists func(context.Context) (bool, error)) error {
+	ok, err := exists(ctx)
+	if err != nil {
+		return &lookupError{kind: kind, name: name, err: err}
+	}
+	if !ok {
+		return &lookupError{kind: kind, name: name}
+	}
+	return nil
+}
+
+// writeLookupError responds with an error that may be, or wrap, a failed lookup: 403 or 404 as
+// the lookup failed, otherwise 500, or 503 with Retry-After for transient backend errors
+func writeLookupError(w http.ResponseWriter, err error) {
+	var lerr *lookupError
+	if errors.As(err, &lerr) {
+		if status := lerr.status(); status != 0 {
+			http.Error(w, err.Error(), status)
+			return
+		}
+	}
+	writeAdminError(w, err, http.StatusInternalServerError)
+}
@@ -0,0 +1,190 @@
+package server
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// metricFamily is a set of counters, gauges or histograms sharing a name, one per label combination
+type metricFamily struct {
+	help       string
+	kind       string // "counter", "gauge" or "histogram"
+	values     map[string]float64
+	labels     map[string][]string // key/value pairs by rendered label set, of counters and gauges
+	buckets    []float64           // upper bounds, for histograms
+	histograms map[string]*histogramValue
+}
+
+// histogramValue counts observations into cumulative buckets
+type histogramValue struct {
+	labels []string
+	counts []uint64 // per bucket, not cumulative
+	sum    float64
+	count  uint64
+}
+
+// metrics holds the service's own metrics, exposed in the Prometheus text format at /metrics
+var metrics = struct {
+	sync.Mutex
+	families map[string]*metricFamily
+}{families: map[string]*metricFamily{}}
+
+// counterAdd adds delta to the counter identified by name and labels, given as key/value pairs
+func counterAdd(name, help string, delta float64, labels ...string) {
+	metrics.Lock()
+	defer metrics.Unlock()
+	f := metricLocked(name, help, "counter")
+	key := metricLabels(labels)
+	f.values[key] += delta
+	f.labels[key] = labels
+}
+
+// gaugeSet sets the gauge identified by name and labels, given as key/value pairs
+func gaugeSet(name, help string, value float64, labels ...string) {
+	metrics.Lock()
+	defer metrics.Unlock()
+	f := metricLocked(name, help, "gauge")
+	key := metricLabels(labels)
+	f.values[key] = value
+	f.labels[key] = labels
+}
+
+// gaugeDelete removes the gauge identified by name and labels, e.g. when the object it describes is gone
+func gaugeDelete(name string, labels ...string) {
+	metrics.Lock()
+	defer metrics.Unlock()
+	if f, ok := metrics.families[name]; ok {
+		delete(f.values, metricLabels(labels))
+		delete(f.labels, metricLabels(labels))
+	}
+}
+
+// metricSample is the current value of a counter or gauge with its labels
+type metricSample struct {
+	labels []string
+	value  float64
+}
+
+// metricSamples returns the current values of a counter or gauge family, if any
+func metricSamples(name string) (kind, help string, samples []metricSample) {
+	metrics.Lock()
+	defer metrics.Unlock()
+	f, ok := metrics.families[name]
+	if !ok || f.kind == "histogram" {
+		return "", "", nil
+	}
+	for key, value := range f.values {
+		samples = append(samples, metricSample{labels: f.labels[key], value: value})
+	}
+	return f.kind, f.help, samples
+}
+
+// histogramObserve records value in the histogram identified by name and labels, given as key/value pairs;
+// buckets are the upper bounds, the same for every call with that name
+func histogramObserve(name, help string, buckets []float64, value float64, labels ...string) {
+	metrics.Lock()
+	defer metrics.Unlock()
+	f := metricLocked(name, help, "histogram")
+	if f.histograms == nil {
+		f.buckets = buckets
+		f.histograms = map[string]*histogramValue{}
+	}
+	key := metricLabels(labels)
+	h, ok := f.histograms[key]
+	if !ok {
+		h = &histogramValue{labels: labels, counts: make([]uint64, len(f.buckets))}
+		f.histograms[key] = h
+	}
+	for i, le := range f.buckets {
+		if value <= le {
+			h.counts[i]++
+			break
+		}
+	}
+	h.sum += value
+	h.count++
+}
+
+// metricLocked returns the metric family with the given name, creating it if necessary
+func metricLocked(name, help, kind string) *metricFamily {
+	f, ok := metrics.families[name]
+	if !ok {
+		f = &metricFamily{help: help, kind: kind, values: map[string]float64{}, labels: map[string][]string{}}
+		metrics.families[name] = f
+	}
+	return f
+}
+
+// metricLabels renders key/value pairs as a Prometheus label set like {k1="v1",k2="v2"}
+func metricLabels(labels []string) string {
+	if len(labels) == 0 {
+		return ""
+	}
+	var b strings.Builder
+	b.WriteString("{")
+	for i := 0; i+1 < len(labels); i += 2 {
+		if i > 0 {
+			b.WriteString(",")
+		}
+		fmt.Fprintf(&b, "%s=%q", labels[i], labels[i+1])
+	}
+	b.WriteString("}")
+	return b.String()
+}
+
+// metricsHandler handles GET to /metrics
+func metricsHandler(w http.ResponseWriter, r *http.Request) {
+	updateAdminQuotaUsage()
+	metrics.Lock()
+	defer metrics.Unlock()
+	names := make([]string, 0, len(metrics.families))
+	for name := range metrics.families {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	for _, name := range names {
+		f := metrics.families[name]
+		fmt.Fprintf(w, "# HELP %s %s\n", name, f.help)
+		fmt.Fprintf(w, "# TYPE %s %s\n", name, f.kind)
+		if f.kind == "histogram" {
+			writeHistograms(w, name, f)
+			continue
+		}
+		labelSets := make([]string, 0, len(f.values))
+		for labels := range f.values {
+			labelSets = append(labelSets, labels)
+		}
+		sort.Strings(labelSets)
+		for _, labels := range labelSets {
+			fmt.Fprintf(w, "%s%s %g\n", name, labels, f.values[labels])
+		}
+	}
+}
+
+// writeHistograms renders a histogram family as its _bucket, _sum and _count series
+func writeHistograms(w io.Writer, name string, f *metricFamily) {
+	labelSets := make([]string, 0, len(f.histograms))
+	for labels := range f.histograms {
+		labelSets = append(labelSets, labels)
+	}
+	sort.Strings(labelSets)
+	for _, labels := range labelSets {
+		h := f.histograms[labels]
+		var cumulative uint64
+		for i, le := range f.buckets {
+			cumulative += h.counts[i]
+			bucketLabels := append(append([]string{}, h.labels...), "le", strconv.FormatFloat(le, 'g', -1, 64))
+			fmt.Fprintf(w, "%s_bucket%s %d\n", name, metricLabels(bucketLabels), cumulative)
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", name, metricLabels(append(append([]string{}, h.labels...), "le", "+Inf")), h.count)
+		fmt.Fprintf(w, "%s_sum%s %g\n", name, labels, h.sum)
+		fmt.Fprintf(w, "%s_count%s %d\n", name, labels, h.count)
+	}
+}
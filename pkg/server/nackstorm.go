@@ -0,0 +1,133 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/pubsub"
+)
+
+const (
+	maxNackTimes = 100
+
+	// defaultNackStormTimeout is how long a nack storm runs without a timeout, long enough for
+	// a few rounds of redelivery
+	defaultNackStormTimeout = 30 * time.Second
+)
+
+// With ?nackTimes=<n>, a receive request demonstrates redelivery: each message is nacked the
+// first n times it is delivered and acked on the next delivery, and every delivery is reported
+// with its delivery attempt. On a subscription with a dead letter policy, messages nacked
+// maxDeliveryAttempts times are forwarded to the dead letter topic instead of being redelivered.
+
+// nackStormMessage is the delivery history of a message of a nack storm
+type nackStormMessage struct {
+	i          int
+	deliveries int
+	first      time.Time
+	done       bool // acked or dead-lettered
+}
+
+// parseNackTimes reads the nackTimes option of a receive request, 0 if it has none
+func parseNackTimes(r *http.Request) (int, error) {
+	s := r.URL.Query().Get("nackTimes")
+	if s == "" {
+		return 0, nil
+	}
+	n, err := strconv.Atoi(s)
+	if err != nil || n < 1 || n > maxNackTimes {
+		return 0, fmt.Errorf("nackTimes must be a number from 1 to %d", maxNackTimes)
+	}
+	return n, nil
+}
+
+// receiveNackStorm serves a receive request with nackTimes: new messages are received for the
+// request's timeout (default 30s here), and their redeliveries until it ends too
+func receiveNackStorm(w http.ResponseWriter, r *http.Request, subscr *pubsub.Subscription, opts receiveOptions, nackTimes int) {
+	cfg, err := subscr.Config(r.Context())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	timeout := opts.timeout
+	if r.URL.Query().Get("timeout") == "" {
+		timeout = defaultNackStormTimeout
+	}
+	maxAttempts := 0
+	if p := cfg.DeadLetterPolicy; p != nil {
+		maxAttempts = p.MaxDeliveryAttempts
+		fmt.Fprintf(w, "nack storm: nacking each message %d times; after %d delivery attempts messages go to dead letter topic %s\n",
+			nackTimes, maxAttempts, p.DeadLetterTopic)
+	} else {
+		fmt.Fprintf(w, "nack storm: nacking each message %d times; the subscription has no dead letter policy, so delivery "+
+			"attempts aren't counted by Pub/Sub\n", nackTimes)
+	}
+	flushResponse(w)
+
+	ctx, cancel := context.WithTimeout(r.Context(), timeout)
+	defer cancel()
+	var (
+		mu            sync.Mutex
+		messages      = map[string]*nackStormMessage{}
+		acked         int
+		deadLettered  int
+		receivedBytes int
+	)
+	err = subscr.Receive(ctx, func(_ context.Context, msg *pubsub.Message) {
+		mu.Lock()
+		defer mu.Unlock()
+		m, ok := messages[msg.ID]
+		if !ok {
+			if opts.max > 0 && len(messages) == opts.max {
+				msg.Nack()
+				return
+			}
+			m = &nackStormMessage{i: len(messages), first: time.Now()}
+			messages[msg.ID] = m
+			receivedBytes += len(msg.Data)
+			writeReceivedMessage(w, m.i, msg)
+		}
+		if m.done {
+			// redelivered anyway, as Pub/Sub may
+			msg.Ack()
+			return
+		}
+		m.deliveries++
+		attempt := ""
+		if msg.DeliveryAttempt != nil {
+			attempt = fmt.Sprintf(" (delivery attempt %d", *msg.DeliveryAttempt)
+			if maxAttempts > 0 {
+				attempt += fmt.Sprintf(" of %d", maxAttempts)
+			}
+			attempt += ")"
+		}
+		since := time.Since(m.first).Round(time.Millisecond)
+		switch {
+		case m.deliveries > nackTimes:
+			msg.Ack()
+			m.done = true
+			acked++
+			fmt.Fprintf(w, "[%d] delivery %d%s at +%s: acked\n", m.i, m.deliveries, attempt, since)
+		case maxAttempts > 0 && msg.DeliveryAttempt != nil && *msg.DeliveryAttempt >= maxAttempts:
+			msg.Nack()
+			m.done = true
+			deadLettered++
+			fmt.Fprintf(w, "[%d] delivery %d%s at +%s: nacked, off to the dead letter topic\n", m.i, m.deliveries, attempt, since)
+		default:
+			msg.Nack()
+			fmt.Fprintf(w, "[%d] delivery %d%s at +%s: nacked\n", m.i, m.deliveries, attempt, since)
+		}
+		flushResponse(w)
+	})
+	if err != nil {
+		fmt.Fprintf(w, "sub.Receive: %v\n", err)
+	}
+	fmt.Fprintf(w, "%d messages: %d acked, %d dead-lettered, %d still being redelivered\n",
+		len(messages), acked, deadLettered, len(messages)-acked-deadLettered)
+	recordReceived(subscr.ID(), len(messages))
+	recordUsage(r, usageCounters{Received: int64(len(messages)), ReceivedBytes: int64(receivedBytes)})
+}
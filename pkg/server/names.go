@@ -0,0 +1,33 @@
+package server
+
+import (
+	"fmt"
+	"strings"
+)
+
+// validateResourceName checks a topic or subscription name against the Pub/Sub naming
+// rules, so that bad names are rejected with a specific message instead of an opaque
+// backend error; kind is "topic" or "subscription"
+func validateResourceName(kind, name string) error {
+	switch {
+	case name == "":
+		return fmt.Errorf("%s name must not be empty", kind)
+	case len(name) < 3 || len(name) > 255:
+		return fmt.Errorf("%s name %q must be between 3 and 255 characters long", kind, name)
+	case !isASCIILetter(name[0]):
+		return fmt.Errorf("%s name %q must start with a letter", kind, name)
+	case strings.HasPrefix(name, "goog"):
+		return fmt.Errorf("%s name %q must not start with \"goog\"", kind, name)
+	}
+	for _, c := range name {
+		if c < 0x80 && (isASCIILetter(byte(c)) || c >= '0' && c <= '9' || strings.ContainsRune("-_.~+%", c)) {
+			continue
+		}
+		return fmt.Errorf("%s name %q contains %q; only letters, digits and -_.~+%% are allowed", kind, name, c)
+	}
+	return nil
+}
+
+func isASCIILetter(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z'
+}
@@ -0,0 +1,245 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Shared projects can hold topic and subscription names to conventions: NAMING_POLICY_FILE lists
+// naming rules, each a regular expression template whose {variables} stand for the alternatives
+// listed for them (like the teams or environments of the project), with the labels a resource
+// named by the rule must carry. A created topic or subscription must match one of the rules for
+// its kind, and for NAMING_ENVIRONMENT, or the request gets 422 explaining the conventions (or
+// the GraphQL or AWS facade error). The policy applies to every name a client picks or derives,
+// like a priority queue's level topics or an SNS subscription's sns-<topic>-<queue>; the service's
+// own short-lived resources are exempt, as nobody names them: RPC reply subscriptions
+// (rpc-<reply-topic>-<instance>), disposable tail subscriptions, self-test probes, and resources
+// restored from the trash under the name they had.
+
+// namingRule is a naming convention, like {"name":"team topics", "kinds":["topic"],
+// "pattern":"{team}-{env}-[a-z0-9-]+", "variables":{"team":["payments","search"], "env":["dev","prod"]},
+// "requiredLabels":{"team":"{team}", "owner":""}, "example":"payments-dev-orders"}; a required
+// label's value may name a variable, standing for its value in the name, or be empty to allow any value
+type namingRule struct {
+	Name           string              `json:"name"`
+	Kinds          []string            `json:"kinds,omitempty"`        // topic and/or subscription, both if empty
+	Environments   []string            `json:"environments,omitempty"` // the NAMING_ENVIRONMENTs the rule applies in, all if empty
+	Pattern        string              `json:"pattern"`                // matched against the whole name
+	Variables      map[string][]string `json:"variables,omitempty"`
+	RequiredLabels map[string]string   `json:"requiredLabels,omitempty"`
+	Example        string              `json:"example,omitempty"`
+
+	re *regexp.Regexp
+}
+
+// namingPolicy holds the rules of NAMING_POLICY_FILE; without one any valid name is allowed
+var namingPolicy = struct {
+	sync.Mutex
+	rules       []*namingRule
+	environment string
+	err         error // why the file couldn't be loaded, refusing all creates
+}{}
+
+// namingVariable matches the {variables} of a rule's pattern
+var namingVariable = regexp.MustCompile(`\{([A-Za-z][A-Za-z0-9_]*)\}`)
+
+// loadNamingPolicy reads NAMING_POLICY_FILE, a JSON list of naming rules; an invalid file refuses
+// all creates rather than allowing any name
+func loadNamingPolicy() {
+	file := setting("NAMING_POLICY_FILE")
+	var rules []*namingRule
+	var err error
+	if file != "" {
+		var data []byte
+		data, err = os.ReadFile(file)
+		if err == nil {
+			err = json.Unmarshal(data, &rules)
+		}
+		for i, rule := range rules {
+			if err != nil {
+				break
+			}
+			if rule.Name == "" {
+				rule.Name = fmt.Sprintf("rule-%d", i)
+			}
+			err = rule.compile()
+		}
+		if err != nil {
+			log.Printf("naming policy: %s: %v (all creates refused)", file, err)
+			err = fmt.Errorf("the naming policy %s is invalid: %v", file, err)
+			rules = nil
+		}
+	}
+	namingPolicy.Lock()
+	namingPolicy.rules = rules
+	namingPolicy.environment = setting("NAMING_ENVIRONMENT")
+	namingPolicy.err = err
+	namingPolicy.Unlock()
+}
+
+// compile expands the rule's variables in its pattern and compiles it
+func (rule *namingRule) compile() error {
+	if rule.Pattern == "" {
+		return fmt.Errorf("rule %s: pattern not provided", rule.Name)
+	}
+	for _, kind := range rule.Kinds {
+		if kind != "topic" && kind != "subscription" {
+			return fmt.Errorf("rule %s: kinds must be topic or subscription, not %q", rule.Name, kind)
+		}
+	}
+	var err error
+	expanded := namingVariable.ReplaceAllStringFunc(rule.Pattern, func(m string) string {
+		name := m[1 : len(m)-1]
+		values, ok := rule.Variables[name]
+		if !ok || len(values) == 0 {
+			err = fmt.Errorf("rule %s: variable %s has no values", rule.Name, name)
+			return m
+		}
+		quoted := make([]string, len(values))
+		for i, v := range values {
+			quoted[i] = regexp.QuoteMeta(v)
+		}
+		return fmt.Sprintf("(?P<%s>%s)", name, strings.Join(quoted, "|"))
+	})
+	if err != nil {
+		return err
+	}
+	if rule.re, err = regexp.Compile("^(?:" + expanded + ")$"); err != nil {
+		return fmt.Errorf("rule %s: %v", rule.Name, err)
+	}
+	for label, want := range rule.RequiredLabels {
+		if m := namingVariable.FindStringSubmatch(want); m != nil && m[0] == want && rule.re.SubexpIndex(m[1]) < 0 {
+			return fmt.Errorf("rule %s: required label %s names variable %s, which the pattern doesn't use", rule.Name, label, m[1])
+		}
+	}
+	return nil
+}
+
+// appliesTo reports whether the rule names resources of the kind in the environment
+func (rule *namingRule) appliesTo(kind, environment string) bool {
+	if len(rule.Kinds) > 0 && !containsString(rule.Kinds, kind) {
+		return false
+	}
+	return len(rule.Environments) == 0 || containsString(rule.Environments, environment)
+}
+
+// missingLabels returns the required labels the resource lacks, or whose value doesn't match
+// the name, given the submatches of the rule's pattern
+func (rule *namingRule) missingLabels(labels map[string]string, match []string) []string {
+	var missing []string
+	for label, want := range rule.RequiredLabels {
+		if m := namingVariable.FindStringSubmatch(want); m != nil && m[0] == want {
+			want = match[rule.re.SubexpIndex(m[1])]
+		}
+		if got, ok := labels[label]; !ok {
+			missing = append(missing, fmt.Sprintf("%s=%s", label, orAny(want)))
+		} else if want != "" && got != want {
+			missing = append(missing, fmt.Sprintf("%s=%s (not %q)", label, want, got))
+		}
+	}
+	sort.Strings(missing)
+	return missing
+}
+
+func orAny(value string) string {
+	if value == "" {
+		return "<any value>"
+	}
+	return value
+}
+
+func containsString(list []string, s string) bool {
+	for _, x := range list {
+		if x == s {
+			return true
+		}
+	}
+	return false
+}
+
+// namingError is a name or labels breaking the naming policy
+type namingError struct {
+	msg string
+}
+
+func (e *namingError) Error() string { return e.msg }
+
+// checkNamingPolicy checks the name and labels of a topic or subscription to create against the
+// naming policy, returning a *namingError explaining the conventions if they break it
+func checkNamingPolicy(kind, name string, labels map[string]string) error {
+	namingPolicy.Lock()
+	rules, environment, err := namingPolicy.rules, namingPolicy.environment, namingPolicy.err
+	namingPolicy.Unlock()
+	if err != nil {
+		return &namingError{msg: err.Error()}
+	}
+	var applicable []*namingRule
+	for _, rule := range rules {
+		if rule.appliesTo(kind, environment) {
+			applicable = append(applicable, rule)
+		}
+	}
+	if len(applicable) == 0 {
+		return nil
+	}
+	var reasons []string
+	for _, rule := range applicable {
+		match := rule.re.FindStringSubmatch(name)
+		if match == nil {
+			continue
+		}
+		missing := rule.missingLabels(labels, match)
+		if len(missing) == 0 {
+			return nil
+		}
+		reasons = append(reasons, fmt.Sprintf("%s %s matches rule %s, which requires the labels %s", kind, name, rule.Name, strings.Join(missing, ", ")))
+	}
+	if len(reasons) > 0 {
+		return &namingError{msg: strings.Join(reasons, "\n")}
+	}
+	lines := []string{fmt.Sprintf("%s name %q doesn't follow the naming policy; %s names must match one of:", kind, name, kind)}
+	for _, rule := range applicable {
+		line := fmt.Sprintf("  %s: %s", rule.Name, rule.Pattern)
+		vars := make([]string, 0, len(rule.Variables))
+		for v, values := range rule.Variables {
+			vars = append(vars, fmt.Sprintf("{%s} is one of %s", v, strings.Join(values, ", ")))
+		}
+		sort.Strings(vars)
+		if len(vars) > 0 {
+			line += " where " + strings.Join(vars, ", ")
+		}
+		if rule.Example != "" {
+			line += fmt.Sprintf(" (e.g. %s)", rule.Example)
+		}
+		lines = append(lines, line)
+	}
+	return &namingError{msg: strings.Join(lines, "\n")}
+}
+
+// writeCreateError responds to a failed check of a name to create: 422 if it breaks the naming
+// policy, 400 otherwise
+func writeCreateError(w http.ResponseWriter, err error) {
+	var nerr *namingError
+	if errors.As(err, &nerr) {
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+	http.Error(w, err.Error(), http.StatusBadRequest)
+}
+
+// validateNewResource checks the name of a topic or subscription to create, against both the
+// Pub/Sub naming rules and the naming policy
+func validateNewResource(kind, name string, labels map[string]string) error {
+	if err := validateResourceName(kind, name); err != nil {
+		return err
+	}
+	return checkNamingPolicy(kind, name, labels)
+}
@@ -0,0 +1,343 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Requests with a body must declare one of the media types their route accepts (JSON unless listed
+// in routeBodyTypes), or get 415. Responses are plain text lines, which are also available as JSON
+// ({"status":<code>, "lines":[...]} or {"status":<code>, "error":"..."}) and as server-sent events
+// (one event per line, errors as "error" events), as negotiated through the Accept header; a request
+// accepting none of these gets 406. Routes speaking another protocol keep their own response types.
+// 429 and 503 responses get retry hints (see retryhints.go).
+
+const (
+	mediaText        = "text/plain"
+	mediaJSON        = "application/json"
+	mediaNDJSON      = "application/x-ndjson"
+	mediaMultipart   = "multipart/form-data"
+	mediaForm        = "application/x-www-form-urlencoded"
+	mediaEventStream = "text/event-stream"
+)
+
+// responseTypes are the negotiable response media types, the first preferred
+var responseTypes = []string{mediaText, mediaJSON, mediaEventStream}
+
+// routeBodyTypes are the request body media types of the routes accepting others than JSON; nil
+// accepts any
+var routeBodyTypes = map[string][]string{
+	"POST /topics/{name}":        {mediaJSON, mediaNDJSON, mediaMultipart},
+	"POST /ingest/{name}":        nil, // webhooks post whatever their sender does
+	"POST /aws":                  {mediaForm},
+	"POST /aws/{account}/{name}": {mediaForm},
+}
+
+// ownResponseTypeRoutes are the routes whose responses follow their protocol rather than Accept
+var ownResponseTypeRoutes = map[string]bool{
+	"GET /-":                     true,
+	"GET /graphql":               true,
+	"POST /graphql":              true,
+	"GET /stomp":                 true,
+	"POST /aws":                  true,
+	"POST /aws/{account}/{name}": true,
+	"GET /metrics":               true,
+	"GET /status":                true,
+}
+
+// checkContentType responds 415 to a request whose body isn't of a media type the route accepts,
+// returning false if it may not go ahead
+func checkContentType(route apiRoute, w http.ResponseWriter, r *http.Request) bool {
+	if r.ContentLength == 0 || r.Method == http.MethodGet || r.Method == http.MethodHead {
+		return true
+	}
+	accepted, ok := routeBodyTypes[route.method+" "+route.pattern]
+	if !ok {
+		accepted = []string{mediaJSON}
+	} else if accepted == nil {
+		return true
+	}
+	mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err == nil {
+		for _, t := range accepted {
+			if mediaType == t {
+				return true
+			}
+		}
+	}
+	if r.Method == http.MethodPatch {
+		w.Header().Set("Accept-Patch", strings.Join(accepted, ", "))
+	} else if r.Method == http.MethodPost {
+		w.Header().Set("Accept-Post", strings.Join(accepted, ", "))
+	}
+	http.Error(w, fmt.Sprintf("Content-Type must be %s", strings.Join(accepted, " or ")), http.StatusUnsupportedMediaType)
+	return false
+}
+
+// acceptRange is a media range of an Accept header
+type acceptRange struct {
+	mediaType string
+	q         float64
+}
+
+// negotiateResponseType returns the response media type the request's Accept header prefers,
+// "" if it accepts none of responseTypes
+func negotiateResponseType(r *http.Request) string {
+	accept := r.Header.Get("Accept")
+	if accept == "" {
+		return mediaText
+	}
+	var ranges []acceptRange
+	for _, part := range strings.Split(accept, ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+		q := 1.0
+		if s, ok := params["q"]; ok {
+			if q, err = strconv.ParseFloat(s, 64); err != nil {
+				q = 0
+			}
+		}
+		ranges = append(ranges, acceptRange{mediaType, q})
+	}
+	best, bestQ := "", 0.0
+	for _, t := range responseTypes {
+		// the most specific range matching the type gives its quality
+		q, specificity := 0.0, -1
+		for _, ar := range ranges {
+			s := -1
+			switch ar.mediaType {
+			case t:
+				s = 2
+			case t[:strings.IndexByte(t, '/')] + "/*":
+				s = 1
+			case "*/*":
+				s = 0
+			}
+			if s > specificity {
+				q, specificity = ar.q, s
+			}
+		}
+		if q > bestQ {
+			best, bestQ = t, q
+		}
+	}
+	return best
+}
+
+// negotiatedWriter renders a handler's text response in the negotiated media type: JSON
+// responses are buffered until finish, event streams are written line by line
+type negotiatedWriter struct {
+	http.ResponseWriter
+	mediaType   string
+	status      int
+	wroteHeader bool
+	buf         []byte     // the whole JSON response, or the incomplete last line of an event stream
+	retry       *retryHint // of a 429 or 503, see retryhints.go
+}
+
+// negotiateResponse returns the writer of the route's response in the type the request accepts,
+// responding 406 and returning false if it accepts none
+func negotiateResponse(route apiRoute, w http.ResponseWriter, r *http.Request) (*negotiatedWriter, bool) {
+	nw := &negotiatedWriter{ResponseWriter: w, mediaType: mediaText, status: http.StatusOK}
+	if ownResponseTypeRoutes[route.method+" "+route.pattern] {
+		nw.mediaType = ""
+		return nw, true
+	}
+	w.Header().Add("Vary", "Accept")
+	if nw.mediaType = negotiateResponseType(r); nw.mediaType == "" {
+		nw.mediaType = mediaText
+		http.Error(nw, fmt.Sprintf("responses are available as %s", strings.Join(responseTypes, ", ")), http.StatusNotAcceptable)
+		return nw, false
+	}
+	if nw.mediaType == mediaText {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	}
+	return nw, true
+}
+
+func (w *negotiatedWriter) WriteHeader(status int) {
+	if w.wroteHeader {
+		return
+	}
+	w.wroteHeader, w.status = true, status
+	w.retry = addRetryHints(w.Header(), status)
+	switch w.mediaType {
+	case mediaJSON:
+		return // sent by finish
+	case mediaEventStream:
+		h := w.Header()
+		h.Set("Content-Type", mediaEventStream)
+		h.Set("Cache-Control", "no-cache")
+		h.Del("Content-Length")
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *negotiatedWriter) Write(p []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	switch w.mediaType {
+	case mediaJSON:
+		w.buf = append(w.buf, p...)
+		return len(p), nil
+	case mediaEventStream:
+		w.buf = append(w.buf, p...)
+		// errors are sent as one event by finish
+		if w.status < http.StatusBadRequest {
+			if i := bytes.LastIndexByte(w.buf, '\n'); i >= 0 {
+				if err := w.writeEvents("", w.buf[:i]); err != nil {
+					return 0, err
+				}
+				w.buf = append(w.buf[:0], w.buf[i+1:]...)
+			}
+		}
+		return len(p), nil
+	}
+	return w.ResponseWriter.Write(p)
+}
+
+// writeEvents writes each of the lines as an event, or all of them as one event of the given type
+func (w *negotiatedWriter) writeEvents(event string, lines []byte) error {
+	var b bytes.Buffer
+	if event != "" {
+		fmt.Fprintf(&b, "event: %s\n", event)
+	}
+	for _, line := range bytes.Split(lines, []byte("\n")) {
+		fmt.Fprintf(&b, "data: %s\n", line)
+		if event == "" {
+			b.WriteByte('\n')
+		}
+	}
+	if event != "" {
+		b.WriteByte('\n')
+	}
+	_, err := w.ResponseWriter.Write(b.Bytes())
+	return err
+}
+
+// Flush sends the events written so far; JSON responses are only sent whole
+func (w *negotiatedWriter) Flush() {
+	if w.mediaType != mediaJSON {
+		flushResponse(w.ResponseWriter)
+	}
+}
+
+// Hijack allows protocols like WebSocket to take over the connection
+func (w *negotiatedWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	if h, ok := w.ResponseWriter.(http.Hijacker); ok {
+		return h.Hijack()
+	}
+	return nil, nil, http.ErrNotSupported
+}
+
+// finish sends what the handler left buffered
+func (w *negotiatedWriter) finish() {
+	switch w.mediaType {
+	case mediaJSON:
+		h := w.Header()
+		if w.status == http.StatusNotModified || w.status == http.StatusNoContent {
+			w.ResponseWriter.WriteHeader(w.status)
+			return
+		}
+		text := strings.TrimRight(string(w.buf), "\n")
+		var body interface{}
+		if w.status >= http.StatusBadRequest {
+			body = struct {
+				Status int        `json:"status"`
+				Error  string     `json:"error"`
+				Retry  *retryHint `json:"retry,omitempty"`
+			}{w.status, text, w.retry}
+		} else {
+			lines := []string{}
+			if text != "" {
+				lines = strings.Split(text, "\n")
+			}
+			body = struct {
+				Status int      `json:"status"`
+				Lines  []string `json:"lines"`
+			}{w.status, lines}
+		}
+		data, _ := json.Marshal(body)
+		h.Set("Content-Type", mediaJSON)
+		h.Del("Content-Length")
+		w.ResponseWriter.WriteHeader(w.status)
+		w.ResponseWriter.Write(append(data, '\n'))
+	case mediaEventStream:
+		if !w.wroteHeader {
+			w.WriteHeader(http.StatusOK)
+		}
+		text := bytes.TrimRight(w.buf, "\n")
+		if len(text) == 0 {
+			return
+		}
+		event := ""
+		if w.status >= http.StatusBadRequest {
+			event = "error"
+		}
+		w.writeEvents(event, text)
+	}
+}
+
+// readPublishMessages reads the messages of a publish request: a JSON array, NDJSON with a
+// message per line, or a multipart form with a message per part (its content type and file name
+// as the contentType and filename attributes, its form name as the clientId)
+func readPublishMessages(r *http.Request, body []byte) ([]PublishMessage, error) {
+	mediaType, params, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	var msgs []PublishMessage
+	switch mediaType {
+	case mediaNDJSON:
+		for i, line := range bytes.Split(body, []byte("\n")) {
+			if len(bytes.TrimSpace(line)) == 0 {
+				continue
+			}
+			var msg PublishMessage
+			if err := json.Unmarshal(line, &msg); err != nil {
+				return nil, fmt.Errorf("line %d: %v", i+1, err)
+			}
+			msgs = append(msgs, msg)
+		}
+	case mediaMultipart:
+		mr := multipart.NewReader(bytes.NewReader(body), params["boundary"])
+		for {
+			part, err := mr.NextPart()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return nil, err
+			}
+			data, err := io.ReadAll(part)
+			if err != nil {
+				return nil, err
+			}
+			msg := PublishMessage{Data: string(data), ClientID: part.FormName()}
+			if ct := part.Header.Get("Content-Type"); ct != "" || part.FileName() != "" {
+				msg.Attributes = map[string]string{}
+				if ct != "" {
+					msg.Attributes["contentType"] = ct
+				}
+				if name := part.FileName(); name != "" {
+					msg.Attributes["filename"] = name
+				}
+			}
+			msgs = append(msgs, msg)
+		}
+	default:
+		if err := json.Unmarshal(body, &msgs); err != nil {
+			return nil, err
+		}
+	}
+	return msgs, nil
+}
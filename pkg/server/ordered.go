@@ -0,0 +1,178 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/pubsub"
+)
+
+const (
+	defaultOrderedWork = 10 * time.Millisecond
+	maxOrderedWork     = time.Second
+	maxOrderedWorkers  = 100
+)
+
+// orderedResult is a message as processed by the ordered processing demo
+type orderedResult struct {
+	msg       *pubsub.Message
+	delivered int // position in which Pub/Sub delivered the message
+	processed int // position in which processing of the message completed
+}
+
+// subscriptionOrderedHandler handles POST to /subscriptions/<subscription-name>/ordered, receiving messages
+// for a second and processing them either with one sequential worker per ordering key (?workers=per-key,
+// the default) or with a pool of n workers shared by all keys (?workers=<n>), each message taking
+// ?work=<duration> (plus jitter) to process; the output, grouped by ordering key, shows whether each
+// key's messages were processed in the order they were published
+func subscriptionOrderedHandler(ctx context.Context, w http.ResponseWriter, r *http.Request, client *pubsub.Client, subscr *pubsub.Subscription) {
+	q := r.URL.Query()
+	poolSize := 0 // per-key workers
+	if s := q.Get("workers"); s != "" && s != "per-key" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 1 || n > maxOrderedWorkers {
+			http.Error(w, fmt.Sprintf("workers must be \"per-key\" or a number from 1 to %d", maxOrderedWorkers), http.StatusBadRequest)
+			return
+		}
+		poolSize = n
+	}
+	work := defaultOrderedWork
+	if s := q.Get("work"); s != "" {
+		d, err := time.ParseDuration(s)
+		if err != nil || d < 0 || d > maxOrderedWork {
+			http.Error(w, fmt.Sprintf("work must be a non-negative duration up to %s", maxOrderedWork), http.StatusBadRequest)
+			return
+		}
+		work = d
+	}
+
+	cfg, err := subscr.Config(ctx)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// receive for a second, acking right away since processing happens after Receive returned
+	rctx, cancel := context.WithTimeout(r.Context(), time.Second)
+	defer cancel()
+	var (
+		mu      sync.Mutex
+		results []*orderedResult
+	)
+	err = subscr.Receive(rctx, func(_ context.Context, msg *pubsub.Message) {
+		mu.Lock()
+		defer mu.Unlock()
+		results = append(results, &orderedResult{msg: msg, delivered: len(results)})
+		msg.Ack()
+	})
+	if err != nil {
+		fmt.Fprintf(w, "sub.Receive: %v\n", err)
+	}
+	recordReceived(subscr.ID(), len(results))
+
+	// process the messages with the chosen worker model
+	seq := 0
+	process := func(res *orderedResult) {
+		time.Sleep(work + time.Duration(rand.Int63n(int64(work)+1)))
+		mu.Lock()
+		res.processed = seq
+		seq++
+		mu.Unlock()
+	}
+	var wg sync.WaitGroup
+	if poolSize == 0 {
+		byKey := map[string][]*orderedResult{}
+		for _, res := range results {
+			byKey[res.msg.OrderingKey] = append(byKey[res.msg.OrderingKey], res)
+		}
+		for _, keyResults := range byKey {
+			wg.Add(1)
+			go func(keyResults []*orderedResult) {
+				defer wg.Done()
+				for _, res := range keyResults {
+					process(res)
+				}
+			}(keyResults)
+		}
+	} else {
+		queue := make(chan *orderedResult)
+		for i := 0; i < poolSize; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for res := range queue {
+					process(res)
+				}
+			}()
+		}
+		for _, res := range results {
+			queue <- res
+		}
+		close(queue)
+	}
+	wg.Wait()
+
+	model := "one sequential worker per ordering key"
+	if poolSize > 0 {
+		model = fmt.Sprintf("pool of %d workers shared by all ordering keys", poolSize)
+	}
+	ordering := "disabled (Pub/Sub may deliver a key's messages in any order)"
+	if cfg.EnableMessageOrdering {
+		ordering = "enabled"
+	}
+	fmt.Fprintf(w, "subscription %s: message ordering %s\n", subscr.String(), ordering)
+	fmt.Fprintf(w, "processed %d messages with %s, %s each\n", len(results), model, work)
+	if len(results) == 0 {
+		return
+	}
+	writeOrderedResults(w, results)
+}
+
+// writeOrderedResults writes the processed messages grouped by ordering key in processing order,
+// annotating messages processed before an earlier published message of the same key
+func writeOrderedResults(w http.ResponseWriter, results []*orderedResult) {
+	byKey := map[string][]*orderedResult{}
+	var keys []string
+	for _, res := range results {
+		k := res.msg.OrderingKey
+		if _, ok := byKey[k]; !ok {
+			keys = append(keys, k)
+		}
+		byKey[k] = append(byKey[k], res)
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		keyResults := byKey[k]
+		sort.Slice(keyResults, func(i, j int) bool { return keyResults[i].processed < keyResults[j].processed })
+		preserved := true
+		for i := 1; i < len(keyResults); i++ {
+			if keyResults[i].msg.PublishTime.Before(keyResults[i-1].msg.PublishTime) {
+				preserved = false
+			}
+		}
+		name := k
+		if name == "" {
+			name = "(no ordering key: no ordering guarantee)"
+		}
+		status := "ordering preserved"
+		if !preserved {
+			status = "ORDERING BROKEN"
+		}
+		fmt.Fprintf(w, "\nordering key %s: %d messages, %s\n", name, len(keyResults), status)
+		for i, res := range keyResults {
+			note := ""
+			if i > 0 && res.msg.PublishTime.Before(keyResults[i-1].msg.PublishTime) {
+				note = "  <- out of order"
+			}
+			fmt.Fprintf(w, "  processed #%d delivered #%d published %s: \"%s\"%s\n", res.processed, res.delivered,
+				res.msg.PublishTime.Format("15:04:05.000"), string(redactMessage(res.msg).Data), note)
+		}
+	}
+}
@@ -0,0 +1,252 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"cloud.google.com/go/pubsub"
+)
+
+// GET /orphans lists the resources nothing uses anymore: subscriptions whose topic was deleted,
+// subscriptions detached from their topic, and topics without subscriptions created longer than
+// age=<duration> ago (per their created-at label; topics without one are counted, not listed).
+// Topics in the trash and their subscriptions aren't orphans, nor are topics serving as a
+// dead-letter topic. With anything listed comes a cleanup token: DELETE /orphans?confirm=<token>
+// deletes the orphans it was issued for that still are, and nothing else.
+
+// defaultOrphanAge is how long a topic must have had no subscriptions to be an orphan, by default
+const defaultOrphanAge = 24 * time.Hour
+
+// orphan is a topic or subscription nothing uses anymore
+type orphan struct {
+	kind, name string
+	reason     string
+}
+
+func (o orphan) key() string { return o.kind + " " + o.name }
+
+// orphanAge returns the age=<duration> of a request, responding 400 if it's invalid
+func orphanAge(w http.ResponseWriter, r *http.Request) (time.Duration, bool) {
+	s := r.URL.Query().Get("age")
+	if s == "" {
+		return defaultOrphanAge, true
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil || d < 0 {
+		http.Error(w, "age must be a duration, like 24h", http.StatusBadRequest)
+		return 0, false
+	}
+	return d, true
+}
+
+// findOrphans lists the project's orphaned subscriptions then topics, by name, and how many
+// topics without subscriptions were left out for lack of a created-at label
+func findOrphans(ctx context.Context, client *pubsub.Client, age time.Duration) ([]orphan, int, error) {
+	if err := waitAdminQuota(ctx, adminOpList); err != nil {
+		return nil, 0, err
+	}
+	topics, err := liveTopicConfigs(ctx, client)
+	if err != nil {
+		return nil, 0, err
+	}
+	subscrs, err := liveSubscriptionConfigs(ctx, client)
+	if err != nil {
+		return nil, 0, err
+	}
+	trashedSubscrs := map[string]bool{}
+	trash.Lock()
+	for _, t := range trash.topics {
+		for _, s := range t.Subscriptions {
+			trashedSubscrs[s.Name] = true
+		}
+	}
+	trash.Unlock()
+
+	var orphans []orphan
+	used := map[string]bool{}
+	for name, cfg := range subscrs {
+		if p := cfg.DeadLetterPolicy; p != nil {
+			used[resourceID(p.DeadLetterTopic)] = true
+		}
+		if trashedSubscrs[name] {
+			continue
+		}
+		switch {
+		case cfg.Topic == nil || cfg.Topic.String() == detachedTopic:
+			orphans = append(orphans, orphan{kind: "subscription", name: name, reason: "its topic was deleted"})
+		case cfg.Detached:
+			orphans = append(orphans, orphan{kind: "subscription", name: name, reason: "detached from topic " + cfg.Topic.ID()})
+		default:
+			used[cfg.Topic.ID()] = true
+		}
+	}
+	unknownAge := 0
+	for name, cfg := range topics {
+		if used[name] {
+			continue
+		}
+		if _, ok := trashedSince(name); ok {
+			continue
+		}
+		secs, err := strconv.ParseInt(cfg.Labels[createdAtLabel], 10, 64)
+		if err != nil {
+			unknownAge++
+			continue
+		}
+		if created := time.Unix(secs, 0); time.Since(created) >= age {
+			orphans = append(orphans, orphan{kind: "topic", name: name,
+				reason: fmt.Sprintf("no subscriptions, created %s ago", time.Since(created).Round(time.Minute))})
+		}
+	}
+	sort.Slice(orphans, func(i, j int) bool {
+		if orphans[i].kind != orphans[j].kind {
+			return orphans[i].kind == "subscription"
+		}
+		return orphans[i].name < orphans[j].name
+	})
+	return orphans, unknownAge, nil
+}
+
+// listOrphansHandler handles GET to /orphans[?age=<duration>]
+func listOrphansHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := context.Background()
+	client, ok := newClient(ctx, w)
+	if !ok {
+		return
+	}
+	defer client.Close()
+	age, ok := orphanAge(w, r)
+	if !ok {
+		return
+	}
+	orphans, unknownAge, err := findOrphans(ctx, client, age)
+	if err != nil {
+		writeAdminError(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	fmt.Fprintf(w, "Orphaned resources (topics count after %s without subscriptions)\n", age)
+	for i, o := range orphans {
+		fmt.Fprintf(w, "[%d] %s %s: %s\n", i, o.kind, o.name, o.reason)
+	}
+	if len(orphans) == 0 {
+		fmt.Fprintln(w, "(none)")
+	}
+	if unknownAge > 0 {
+		fmt.Fprintf(w, "%d topics without subscriptions left out: their age is unknown (no %s label)\n", unknownAge, createdAtLabel)
+	}
+	if len(orphans) == 0 {
+		return
+	}
+	plan := &deletePlan{kind: "orphans", name: "age=" + age.String()}
+	for _, o := range orphans {
+		plan.losses = append(plan.losses, o.key())
+	}
+	token, expires := issueDeleteToken(plan)
+	fmt.Fprintf(w, "cleanup token: %s (DELETE /orphans?age=%s&confirm=<token> deletes these, valid until %s)\n",
+		token, age, expires.Format(time.RFC3339))
+}
+
+// deleteOrphansHandler handles DELETE to /orphans?confirm=<token>[&age=<duration>][&dryRun=true],
+// deleting the orphans the token was issued for that still are
+func deleteOrphansHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := context.Background()
+	client, ok := newClient(ctx, w)
+	if !ok {
+		return
+	}
+	defer client.Close()
+	age, ok := orphanAge(w, r)
+	if !ok {
+		return
+	}
+	dryRun, ok := dryRunRequested(w, r)
+	if !ok {
+		return
+	}
+	token := r.URL.Query().Get("confirm")
+	if token == "" {
+		http.Error(w, "deleting orphans needs confirmation: get a cleanup token with GET /orphans and pass it as confirm=<token>",
+			http.StatusPreconditionRequired)
+		return
+	}
+	dt, ok := takeDeleteToken(token)
+	switch {
+	case !ok:
+		http.Error(w, "the cleanup token is unknown, used or expired: get a new one with GET /orphans", http.StatusPreconditionRequired)
+		return
+	case dt.kind != "orphans":
+		http.Error(w, fmt.Sprintf("the token confirms deleting %s %s, not orphans: get one with GET /orphans", dt.kind, dt.name),
+			http.StatusPreconditionRequired)
+		return
+	case dt.name != "age="+age.String():
+		http.Error(w, fmt.Sprintf("the cleanup token was issued for %s: pass the same age or get a new token", dt.name),
+			http.StatusPreconditionRequired)
+		return
+	}
+	orphans, _, err := findOrphans(ctx, client, age)
+	if err != nil {
+		writeAdminError(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	var doomed []orphan
+	current := map[string]bool{}
+	for _, o := range orphans {
+		current[o.key()] = true
+		if containsString(dt.losses, o.key()) {
+			doomed = append(doomed, o)
+		} else {
+			fmt.Fprintf(w, "skipped %s: orphaned since the token was issued, review it with GET /orphans\n", o.key())
+		}
+	}
+	for _, key := range dt.losses {
+		if !current[key] {
+			fmt.Fprintf(w, "skipped %s: no longer an orphan\n", key)
+		}
+	}
+	if dryRun {
+		var details []string
+		for _, o := range doomed {
+			details = append(details, fmt.Sprintf("%s (%s)", o.key(), o.reason))
+		}
+		writeDryRun(w, fmt.Sprintf("delete %d orphans (the token is used up)", len(doomed)), details)
+		return
+	}
+
+	trash.Lock()
+	retention := trash.retention
+	trash.Unlock()
+	results := runBatch(len(doomed), func(i int) string {
+		o := doomed[i]
+		if o.kind == "topic" && retention > 0 {
+			if _, err := trashTopic(ctx, client, client.Topic(o.name)); err != nil {
+				return fmt.Sprintf("%s: %s", o.key(), err.Error())
+			}
+			forgetTopic(o.name)
+			noteResourceChange("updated", "topic", o.name, "moved to the trash")
+			return fmt.Sprintf("moved topic %s to the trash", o.name)
+		}
+		err := retryAdmin(ctx, adminOpDelete, func() error {
+			if o.kind == "topic" {
+				return client.Topic(o.name).Delete(ctx)
+			}
+			return client.Subscription(o.name).Delete(ctx)
+		})
+		if err != nil {
+			return fmt.Sprintf("%s: %s", o.key(), err.Error())
+		}
+		if o.kind == "topic" {
+			forgetTopic(o.name)
+		}
+		noteResourceChange("deleted", o.kind, o.name, "orphan")
+		return "deleted " + o.key()
+	})
+	for i, res := range results {
+		fmt.Fprintf(w, "[%d] %s\n", i, res)
+	}
+}
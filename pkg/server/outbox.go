@@ -0,0 +1,335 @@
+package server
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"cloud.google.com/go/pubsub"
+	bolt "go.etcd.io/bbolt"
+)
+
+const (
+	outboxPollInterval  = 5 * time.Second
+	maxOutboxAttempts   = 10
+	maxOutboxListLength = 100
+
+	outboxStatusPending   = "pending"
+	outboxStatusPublished = "published"
+	outboxStatusFailed    = "failed"
+
+	outboxRecordsMetric   = "second_outbox_records"
+	outboxPublishedMetric = "second_outbox_published_total"
+)
+
+var outboxBucket = []byte("records")
+
+// outboxRecord is a message written to the outbox, to be published by the dispatcher
+type outboxRecord struct {
+	ID          uint64            `json:"id"`
+	Topic       string            `json:"topic"`
+	Data        string            `json:"data"`
+	Attributes  map[string]string `json:"attributes,omitempty"`
+	Status      string            `json:"status"`
+	Attempts    int               `json:"attempts,omitempty"`
+	LastError   string            `json:"lastError,omitempty"`
+	MessageID   string            `json:"messageId,omitempty"`
+	Created     time.Time         `json:"created"`
+	PublishedAt *time.Time        `json:"publishedAt,omitempty"`
+}
+
+var writeOutboxSchema = &jsonSchema{Type: "array", Items: objectSchema(map[string]*jsonSchema{
+	"topic":      stringSchema("topic the record is published to"),
+	"data":       stringSchema("message data"),
+	"attributes": stringMapSchema("message attributes"),
+}, "topic")}
+
+// outbox demonstrates the transactional outbox pattern: records are committed to a local
+// BoltDB file (OUTBOX_FILE) first and published to Pub/Sub afterwards by a dispatcher, so
+// a record is never lost once written, though it may be published more than once
+var outbox struct {
+	db   *bolt.DB
+	wake chan struct{}
+	stop chan struct{}
+	done chan struct{}
+}
+
+// startOutbox opens the outbox database and starts the dispatcher
+func startOutbox() {
+	path := setting("OUTBOX_FILE")
+	if path == "" {
+		path = filepath.Join(os.TempDir(), "second-outbox.db")
+	}
+	db, err := bolt.Open(path, 0o600, &bolt.Options{Timeout: time.Second})
+	if err == nil {
+		err = db.Update(func(tx *bolt.Tx) error {
+			_, err := tx.CreateBucketIfNotExists(outboxBucket)
+			return err
+		})
+	}
+	if err != nil {
+		log.Printf("outbox: %s: %v (outbox disabled)", path, err)
+		return
+	}
+	outbox.db = db
+	outbox.wake = make(chan struct{}, 1)
+	outbox.stop = make(chan struct{})
+	outbox.done = make(chan struct{})
+	go runOutbox()
+}
+
+// stopOutbox stops the dispatcher and closes the outbox database
+func stopOutbox() {
+	if outbox.db == nil {
+		return
+	}
+	close(outbox.stop)
+	<-outbox.done
+	outbox.db.Close()
+}
+
+// runOutbox publishes pending records in the order they were written, until stopped
+func runOutbox() {
+	defer close(outbox.done)
+	for {
+		dispatchOutbox()
+		select {
+		case <-outbox.stop:
+			return
+		case <-outbox.wake:
+		case <-time.After(outboxPollInterval):
+		}
+	}
+}
+
+// dispatchOutbox makes one pass over the pending records; a failed record holds back
+// the later records for the same topic, so they are published in order
+func dispatchOutbox() {
+	var pending []*outboxRecord
+	err := outbox.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(outboxBucket).ForEach(func(_, v []byte) error {
+			rec := &outboxRecord{}
+			if err := json.Unmarshal(v, rec); err != nil {
+				return err
+			}
+			if rec.Status == outboxStatusPending {
+				pending = append(pending, rec)
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		log.Printf("outbox: %v", err)
+		return
+	}
+	gaugeSet(outboxRecordsMetric, "Outbox records, by status.", float64(len(pending)), "status", outboxStatusPending)
+
+	blocked := map[string]bool{}
+	for _, rec := range pending {
+		select {
+		case <-outbox.stop:
+			return
+		default:
+		}
+		if blocked[rec.Topic] {
+			continue
+		}
+		id, err := publishMessage(rec.Topic, &pubsub.Message{Data: []byte(rec.Data), Attributes: rec.Attributes})
+		rec.Attempts++
+		if err != nil {
+			blocked[rec.Topic] = true
+			rec.LastError = err.Error()
+			if rec.Attempts >= maxOutboxAttempts {
+				rec.Status = outboxStatusFailed
+				log.Printf("outbox: record %d failed after %d attempts: %v", rec.ID, rec.Attempts, err)
+			}
+		} else {
+			now := time.Now()
+			rec.Status, rec.MessageID, rec.LastError, rec.PublishedAt = outboxStatusPublished, id, "", &now
+			counterAdd(outboxPublishedMetric, "Outbox records published, by topic.", 1, "topic", rec.Topic)
+		}
+		// a crash before this update publishes the record again on restart: at-least-once
+		if err := putOutboxRecord(rec); err != nil {
+			log.Printf("outbox: %v", err)
+		}
+	}
+}
+
+// putOutboxRecord stores a record under its ID
+func putOutboxRecord(rec *outboxRecord) error {
+	data, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	return outbox.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(outboxBucket).Put(outboxKey(rec.ID), data)
+	})
+}
+
+// outboxKey returns the key of a record, which sorts in the order records were written
+func outboxKey(id uint64) []byte {
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, id)
+	return key
+}
+
+// writeOutboxHandler handles POST to /outbox, committing all records in a single
+// transaction: either all of them will be published, or none
+func writeOutboxHandler(w http.ResponseWriter, r *http.Request) {
+	if outbox.db == nil {
+		http.Error(w, "outbox not available", http.StatusServiceUnavailable)
+		return
+	}
+
+	// get records from body:
+	// '[{"topic":"orders", "data":"order 42 created", "attributes":{"orderId":"42"}}, ...]'
+	var recs []*outboxRecord
+	if !readRequest(w, r, writeOutboxSchema, &recs) {
+		return
+	}
+	if len(recs) == 0 {
+		http.Error(w, "no records provided", http.StatusBadRequest)
+		return
+	}
+	for i, rec := range recs {
+		if err := validateResourceName("topic", rec.Topic); err != nil {
+			http.Error(w, fmt.Sprintf("[%d] %v", i, err), http.StatusBadRequest)
+			return
+		}
+		// the dispatcher publishes later, on behalf of the writer
+		if err := authorizePublish(r, rec.Topic, []map[string]string{rec.Attributes}); err != nil {
+			http.Error(w, fmt.Sprintf("[%d] %v", i, err), http.StatusForbidden)
+			return
+		}
+	}
+
+	now := time.Now()
+	err := outbox.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(outboxBucket)
+		for _, rec := range recs {
+			id, err := b.NextSequence()
+			if err != nil {
+				return err
+			}
+			rec.ID, rec.Status, rec.Created = id, outboxStatusPending, now
+			rec.Attempts, rec.LastError, rec.MessageID, rec.PublishedAt = 0, "", "", nil
+			data, err := json.Marshal(rec)
+			if err != nil {
+				return err
+			}
+			if err := b.Put(outboxKey(id), data); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	select {
+	case outbox.wake <- struct{}{}:
+	default:
+	}
+	for i, rec := range recs {
+		fmt.Fprintf(w, "[%d] wrote outbox record %d for topic %s\n", i, rec.ID, rec.Topic)
+	}
+}
+
+// listOutboxHandler handles GET to /outbox[?status=<status>], listing the most recent records first
+func listOutboxHandler(w http.ResponseWriter, r *http.Request) {
+	if outbox.db == nil {
+		http.Error(w, "outbox not available", http.StatusServiceUnavailable)
+		return
+	}
+	status := r.URL.Query().Get("status")
+	switch status {
+	case "", outboxStatusPending, outboxStatusPublished, outboxStatusFailed:
+	default:
+		http.Error(w, fmt.Sprintf("status must be %s, %s or %s", outboxStatusPending, outboxStatusPublished, outboxStatusFailed),
+			http.StatusBadRequest)
+		return
+	}
+
+	var recs []*outboxRecord
+	err := outbox.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(outboxBucket).Cursor()
+		for k, v := c.Last(); k != nil && len(recs) < maxOutboxListLength; k, v = c.Prev() {
+			rec := &outboxRecord{}
+			if err := json.Unmarshal(v, rec); err != nil {
+				return err
+			}
+			if status == "" || rec.Status == status {
+				recs = append(recs, rec)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	fmt.Fprintln(w, "Outbox records\n--------------")
+	for _, rec := range recs {
+		fmt.Fprintln(w, rec.summary())
+	}
+	if len(recs) == 0 {
+		fmt.Fprintln(w, "(none)")
+	}
+}
+
+// getOutboxHandler handles GET to /outbox/<record-id>
+func getOutboxHandler(w http.ResponseWriter, r *http.Request) {
+	if outbox.db == nil {
+		http.Error(w, "outbox not available", http.StatusServiceUnavailable)
+		return
+	}
+	id, err := strconv.ParseUint(pathParam(r, "id"), 10, 64)
+	if err != nil {
+		http.Error(w, "record ID must be a number", http.StatusBadRequest)
+		return
+	}
+	var rec *outboxRecord
+	err = outbox.db.View(func(tx *bolt.Tx) error {
+		v := tx.Bucket(outboxBucket).Get(outboxKey(id))
+		if v == nil {
+			return nil
+		}
+		rec = &outboxRecord{}
+		return json.Unmarshal(v, rec)
+	})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if rec == nil {
+		http.Error(w, fmt.Sprintf("outbox record %d not found", id), http.StatusNotFound)
+		return
+	}
+	fmt.Fprintln(w, rec.summary())
+	fmt.Fprintf(w, "Data: \"%s\"\n", rec.Data)
+	if len(rec.Attributes) > 0 {
+		fmt.Fprintln(w, "Attributes:")
+		for key, value := range rec.Attributes {
+			fmt.Fprintf(w, "    %s = %s\n", key, value)
+		}
+	}
+}
+
+// summary returns a one-line description of the record
+func (rec *outboxRecord) summary() string {
+	s := fmt.Sprintf("%d: topic=%s status=%s created=%s", rec.ID, rec.Topic, rec.Status, rec.Created.Format(time.RFC3339))
+	if rec.MessageID != "" {
+		s += fmt.Sprintf(" messageId=%s publishedAt=%s", rec.MessageID, rec.PublishedAt.Format(time.RFC3339))
+	}
+	if rec.Attempts > 0 && rec.Status != outboxStatusPublished {
+		s += fmt.Sprintf(" attempts=%d lastError=%q", rec.Attempts, rec.LastError)
+	}
+	return s
+}
@@ -0,0 +1,159 @@
+package server
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"sync"
+)
+
+// APIKeyHeader carries the API key publishers are identified by when a publish policy is set
+const APIKeyHeader = "X-API-Key"
+
+// publishGrant lets the holder of an API key publish to the topics matching one of its patterns
+// (like team-x-*), provided every message sets the required attributes; a required value of
+// $principal stands for the grant's principal, an empty one allows any value
+type publishGrant struct {
+	Principal          string            `json:"principal"`
+	Key                string            `json:"key"`
+	Topics             []string          `json:"topics"`
+	RequiredAttributes map[string]string `json:"requiredAttributes,omitempty"`
+}
+
+// publishPolicy holds the grants of PUBLISH_POLICY_FILE and those configured in Firestore;
+// without either publishing is unrestricted
+var publishPolicy = struct {
+	sync.Mutex
+	grants     []*publishGrant
+	loaded     bool
+	configured map[string]*publishGrant // by Firestore document ID
+	enforced   bool                     // by the first grant from Firestore
+}{configured: map[string]*publishGrant{}}
+
+// loadPublishPolicy reads PUBLISH_POLICY_FILE, a JSON list of grants like
+// [{"principal":"team-x", "key":"<secret>", "topics":["team-x-*"], "requiredAttributes":{"source":"$principal"}}];
+// an invalid file denies all publishing rather than allowing it
+func loadPublishPolicy() {
+	file := setting("PUBLISH_POLICY_FILE")
+	if file == "" {
+		publishPolicy.Lock()
+		publishPolicy.grants, publishPolicy.loaded = nil, false
+		publishPolicy.Unlock()
+		return
+	}
+	var grants []*publishGrant
+	data, err := os.ReadFile(file)
+	if err == nil {
+		err = json.Unmarshal(data, &grants)
+	}
+	for _, g := range grants {
+		if err != nil {
+			break
+		}
+		err = g.validate()
+	}
+	if err != nil {
+		log.Printf("policy: %s: %v (all publishing denied)", file, err)
+		grants = nil
+	}
+	publishPolicy.Lock()
+	publishPolicy.grants = grants
+	publishPolicy.loaded = true
+	publishPolicy.Unlock()
+}
+
+func (g *publishGrant) validate() error {
+	if g.Principal == "" || g.Key == "" || len(g.Topics) == 0 {
+		return fmt.Errorf("every grant needs a principal, a key and topics")
+	}
+	for _, pattern := range g.Topics {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("principal %s: topic pattern %q: %v", g.Principal, pattern, err)
+		}
+	}
+	return nil
+}
+
+// publishGrantFor returns the grant of PUBLISH_POLICY_FILE or Firestore holding the key, if any
+func publishGrantFor(key string) *publishGrant {
+	publishPolicy.Lock()
+	defer publishPolicy.Unlock()
+	for _, g := range publishPolicy.grants {
+		if subtle.ConstantTimeCompare([]byte(key), []byte(g.Key)) == 1 {
+			return g
+		}
+	}
+	for _, g := range publishPolicy.configured {
+		if subtle.ConstantTimeCompare([]byte(key), []byte(g.Key)) == 1 {
+			return g
+		}
+	}
+	return nil
+}
+
+// publishPolicyActive reports whether publishing is restricted, by PUBLISH_POLICY_FILE, grants
+// configured in Firestore or managed keys; publishes that can't be attributed to a caller, like
+// those of the SMTP gateway, are then refused
+func publishPolicyActive() bool {
+	publishPolicy.Lock()
+	loaded := publishPolicy.loaded || publishPolicy.enforced
+	publishPolicy.Unlock()
+	return loaded || managedKeysExist()
+}
+
+// authorizePublish checks a publish request against the policy, returning the reason it's denied;
+// attrs are the attributes of each message to publish. Every path publishing on behalf of a
+// request calls it: REST, GraphQL, STOMP, the AWS facade, RPCs, priority queues, the outbox,
+// ingest routes, schedules, imports and replays.
+func authorizePublish(r *http.Request, topicName string, attrs []map[string]string) error {
+	if !publishPolicyActive() {
+		return nil
+	}
+	if t := requestAccessToken(r); t != nil {
+		// the token's publish verb and pattern were checked with the request
+		return nil
+	}
+	key := r.Header.Get(APIKeyHeader)
+	if key == "" {
+		return fmt.Errorf("publishing requires an API key in the %s header", APIKeyHeader)
+	}
+	grant := publishGrantFor(key)
+	if grant == nil {
+		g, err := managedKeyGrant(key)
+		if err != nil {
+			return err
+		}
+		grant = g
+	}
+	if grant == nil {
+		return fmt.Errorf("the API key is not allowed to publish")
+	}
+	allowed := false
+	for _, pattern := range grant.Topics {
+		if ok, _ := path.Match(pattern, topicName); ok {
+			allowed = true
+			break
+		}
+	}
+	if !allowed {
+		return fmt.Errorf("principal %s may not publish to topic %s (allowed: %s)", grant.Principal, topicName, strings.Join(grant.Topics, ", "))
+	}
+	for i, a := range attrs {
+		for name, want := range grant.RequiredAttributes {
+			if want == "$principal" {
+				want = grant.Principal
+			}
+			if got, ok := a[name]; !ok {
+				return fmt.Errorf("message [%d]: principal %s must set attribute %s=%s", i, grant.Principal, name, want)
+			} else if want != "" && got != want {
+				return fmt.Errorf("message [%d]: principal %s must set attribute %s=%s, not %q", i, grant.Principal, name, want, got)
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,378 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/pubsub"
+)
+
+const (
+	defaultPriorityReceiveMax = 10
+	maxPriorityReceiveMax     = 1000
+
+	// priorityLevelWait is how long a combined receive waits for messages of one priority level
+	priorityLevelWait = 500 * time.Millisecond
+)
+
+var defaultPriorityLevels = []string{"high", "medium", "low"}
+
+// priorityQueue is a logical queue mapped to one topic and subscription per priority level,
+// highest priority first; Pub/Sub has no message priorities, so consumers emulate them by
+// draining the subscriptions of higher levels first
+type priorityQueue struct {
+	name    string
+	levels  []string
+	created time.Time
+
+	mu        sync.Mutex
+	published map[string]int64
+	received  map[string]int64
+}
+
+var priorityQueues = struct {
+	sync.Mutex
+	m map[string]*priorityQueue
+}{m: map[string]*priorityQueue{}}
+
+// topicName returns the name of the topic of a priority level
+func (pq *priorityQueue) topicName(level string) string {
+	return pq.name + "-" + level
+}
+
+// subscriptionName returns the name of the subscription of a priority level
+func (pq *priorityQueue) subscriptionName(level string) string {
+	return pq.name + "-" + level + "-sub"
+}
+
+// listPriorityQueuesHandler handles GET to /priority
+func listPriorityQueuesHandler(w http.ResponseWriter, r *http.Request) {
+	priorityQueues.Lock()
+	list := make([]*priorityQueue, 0, len(priorityQueues.m))
+	for _, pq := range priorityQueues.m {
+		list = append(list, pq)
+	}
+	priorityQueues.Unlock()
+	sort.Slice(list, func(i, j int) bool { return list[i].name < list[j].name })
+	fmt.Fprintln(w, "Priority queues\n---------------")
+	for _, pq := range list {
+		fmt.Fprintln(w, pq.summary())
+	}
+	if len(list) == 0 {
+		fmt.Fprintln(w, "(none)")
+	}
+}
+
+var (
+	createPriorityQueueSchema = objectSchema(map[string]*jsonSchema{
+		"name":   stringSchema("queue name"),
+		"levels": {Type: "array", Description: "priority levels, highest first (default high, medium, low)", Items: stringSchema("level")},
+	}, "name")
+	publishPrioritySchema = &jsonSchema{Type: "array", Items: objectSchema(map[string]*jsonSchema{
+		"data":     stringSchema("message data"),
+		"priority": stringSchema("priority level (default the lowest)"),
+	})}
+)
+
+// createPriorityQueueHandler handles PUT to /priority, creating the topic and subscription of
+// each level (or adopting them if they already exist)
+func createPriorityQueueHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := context.Background()
+	client, ok := newClient(ctx, w)
+	if !ok {
+		return
+	}
+
+	// get queue details from body: '{"name":"jobs", "levels":["high", "medium", "low"]}'
+	var req struct {
+		Name   string   `json:"name"`
+		Levels []string `json:"levels"`
+	}
+	if !readRequest(w, r, createPriorityQueueSchema, &req) {
+		return
+	}
+	if req.Name == "" {
+		http.Error(w, "name must not be empty", http.StatusBadRequest)
+		return
+	}
+	pq := &priorityQueue{
+		name:      req.Name,
+		levels:    req.Levels,
+		created:   time.Now(),
+		published: map[string]int64{},
+		received:  map[string]int64{},
+	}
+	if len(pq.levels) == 0 {
+		pq.levels = defaultPriorityLevels
+	}
+	seen := map[string]bool{}
+	for _, level := range pq.levels {
+		if level == "" || seen[level] {
+			http.Error(w, "levels must be distinct and non-empty", http.StatusBadRequest)
+			return
+		}
+		seen[level] = true
+		if err := validateNewResource("topic", pq.topicName(level), nil); err != nil {
+			writeCreateError(w, err)
+			return
+		}
+		if err := validateNewResource("subscription", pq.subscriptionName(level), nil); err != nil {
+			writeCreateError(w, err)
+			return
+		}
+	}
+
+	priorityQueues.Lock()
+	if _, ok := priorityQueues.m[pq.name]; ok {
+		priorityQueues.Unlock()
+		http.Error(w, fmt.Sprintf("priority queue %s already exists", pq.name), http.StatusConflict)
+		return
+	}
+	priorityQueues.m[pq.name] = pq
+	priorityQueues.Unlock()
+
+	for _, level := range pq.levels {
+		if err := createPriorityLevel(ctx, client, pq, level); err != nil {
+			priorityQueues.Lock()
+			delete(priorityQueues.m, pq.name)
+			priorityQueues.Unlock()
+			writeLookupError(w, fmt.Errorf("level %s: %w", level, err))
+			return
+		}
+	}
+	fmt.Fprintf(w, "created priority queue %s\n", pq.summary())
+}
+
+// createPriorityLevel creates the topic and subscription of a priority level unless they exist
+func createPriorityLevel(ctx context.Context, client *pubsub.Client, pq *priorityQueue, level string) error {
+	topic := client.Topic(pq.topicName(level))
+	exists, err := topic.Exists(ctx)
+	if err != nil {
+		return &lookupError{kind: "topic", name: pq.topicName(level), err: err}
+	}
+	if !exists {
+		if topic, err = client.CreateTopicWithConfig(ctx, pq.topicName(level), &pubsub.TopicConfig{
+			Labels: demoLabels(),
+		}); err != nil {
+			return err
+		}
+	}
+	subscr := client.Subscription(pq.subscriptionName(level))
+	exists, err = subscr.Exists(ctx)
+	if err != nil {
+		return &lookupError{kind: "subscription", name: pq.subscriptionName(level), err: err}
+	}
+	if !exists {
+		if _, err := client.CreateSubscription(ctx, pq.subscriptionName(level), newSubscriptionConfig(topic)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// getPriorityQueueHandler handles GET to /priority/<queue-name>
+func getPriorityQueueHandler(w http.ResponseWriter, r *http.Request) {
+	pq, ok := lookupPriorityQueue(w, r)
+	if !ok {
+		return
+	}
+	fmt.Fprintln(w, pq.summary())
+	pq.writeLevels(w)
+}
+
+// deletePriorityQueueHandler handles DELETE to /priority/<queue-name>, deleting the levels' topics and subscriptions
+func deletePriorityQueueHandler(w http.ResponseWriter, r *http.Request) {
+	pq, ok := lookupPriorityQueue(w, r)
+	if !ok {
+		return
+	}
+	ctx := context.Background()
+	client, ok := newClient(ctx, w)
+	if !ok {
+		return
+	}
+	priorityQueues.Lock()
+	delete(priorityQueues.m, pq.name)
+	priorityQueues.Unlock()
+
+	fmt.Fprintf(w, "deleted priority queue %s\n", pq.name)
+	for _, level := range pq.levels {
+		if err := client.Subscription(pq.subscriptionName(level)).Delete(ctx); err != nil {
+			fmt.Fprintf(w, "%s: %s\n", pq.subscriptionName(level), err.Error())
+		}
+		if err := client.Topic(pq.topicName(level)).Delete(ctx); err != nil {
+			fmt.Fprintf(w, "%s: %s\n", pq.topicName(level), err.Error())
+		}
+		forgetTopic(pq.topicName(level))
+	}
+}
+
+// publishPriorityHandler handles POST to /priority/<queue-name>, publishing each message to the
+// topic of its priority level (the lowest level if none is given)
+func publishPriorityHandler(w http.ResponseWriter, r *http.Request) {
+	pq, ok := lookupPriorityQueue(w, r)
+	if !ok {
+		return
+	}
+
+	// get messages to publish from body: '[{"data":"urgent job", "priority":"high"}, {"data":"some job"}, ...]'
+	var msgs []struct {
+		Data     string `json:"data"`
+		Priority string `json:"priority"`
+	}
+	if !readRequest(w, r, publishPrioritySchema, &msgs) {
+		return
+	}
+	lowest := pq.levels[len(pq.levels)-1]
+	for i := range msgs {
+		if msgs[i].Priority == "" {
+			msgs[i].Priority = lowest
+		}
+		if !pq.hasLevel(msgs[i].Priority) {
+			http.Error(w, fmt.Sprintf("[%d] unknown priority %q, must be one of %s", i, msgs[i].Priority, strings.Join(pq.levels, ", ")),
+				http.StatusBadRequest)
+			return
+		}
+		attrs := []map[string]string{{"priority": msgs[i].Priority}}
+		if err := authorizePublish(r, pq.topicName(msgs[i].Priority), attrs); err != nil {
+			http.Error(w, fmt.Sprintf("[%d] %v", i, err), http.StatusForbidden)
+			return
+		}
+	}
+
+	ctx := r.Context()
+	results := make([]*pubsub.PublishResult, len(msgs))
+	for i, msg := range msgs {
+		// publish through the cached handles, so messages of concurrent requests get batched
+		publisher, release, err := acquireTopic(pq.topicName(msg.Priority))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		defer release()
+		results[i] = publisher.Publish(ctx, &pubsub.Message{
+			Data:       []byte(msg.Data),
+			Attributes: map[string]string{"priority": msg.Priority},
+		})
+	}
+	for i, res := range results {
+		id, err := res.Get(ctx)
+		if err != nil {
+			fmt.Fprintf(w, "[%d] %s\n", i, err.Error())
+			continue
+		}
+		pq.mu.Lock()
+		pq.published[msgs[i].Priority]++
+		pq.mu.Unlock()
+		fmt.Fprintf(w, "[%d] published message ID %s with priority %s\n", i, id, msgs[i].Priority)
+	}
+}
+
+// receivePriorityHandler handles POST to /priority/<queue-name>/receive[?max=<n>], receiving up to
+// max messages, taking them from lower priority levels only when the higher ones have none
+func receivePriorityHandler(w http.ResponseWriter, r *http.Request) {
+	pq, ok := lookupPriorityQueue(w, r)
+	if !ok {
+		return
+	}
+	limit := defaultPriorityReceiveMax
+	if s := r.URL.Query().Get("max"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 1 || n > maxPriorityReceiveMax {
+			http.Error(w, fmt.Sprintf("max must be a number from 1 to %d", maxPriorityReceiveMax), http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+	client, ok := newClient(context.Background(), w)
+	if !ok {
+		return
+	}
+
+	var (
+		mu    sync.Mutex
+		count int
+	)
+	for _, level := range pq.levels {
+		if count >= limit || r.Context().Err() != nil {
+			break
+		}
+		subscr := client.Subscription(pq.subscriptionName(level))
+		subscr.ReceiveSettings.MaxOutstandingMessages = limit - count
+		ctx, cancel := context.WithTimeout(r.Context(), priorityLevelWait)
+		received := 0
+		err := subscr.Receive(ctx, func(_ context.Context, msg *pubsub.Message) {
+			mu.Lock()
+			defer mu.Unlock()
+			if count >= limit {
+				// more than needed were pulled, leave them for the next receive
+				msg.Nack()
+				return
+			}
+			msg.Ack()
+			fmt.Fprintf(w, "[%d] priority=%s Data: \"%s\"\n", count, level, string(redactMessage(msg).Data))
+			count++
+			received++
+			if count >= limit {
+				cancel()
+			}
+		})
+		cancel()
+		if err != nil {
+			fmt.Fprintf(w, "%s: sub.Receive: %v\n", subscr.ID(), err)
+		}
+		recordReceived(subscr.ID(), received)
+		pq.mu.Lock()
+		pq.received[level] += int64(received)
+		pq.mu.Unlock()
+		flushResponse(w)
+	}
+	if count == 0 {
+		fmt.Fprintln(w, "(no messages)")
+	}
+}
+
+// lookupPriorityQueue returns the priority queue named in the path, responding 404 if there's none
+func lookupPriorityQueue(w http.ResponseWriter, r *http.Request) (*priorityQueue, bool) {
+	name := pathParam(r, "name")
+	priorityQueues.Lock()
+	pq, ok := priorityQueues.m[name]
+	priorityQueues.Unlock()
+	if !ok {
+		http.Error(w, fmt.Sprintf("priority queue %s not found", name), http.StatusNotFound)
+	}
+	return pq, ok
+}
+
+// hasLevel reports whether level is one of the queue's priority levels
+func (pq *priorityQueue) hasLevel(level string) bool {
+	for _, l := range pq.levels {
+		if l == level {
+			return true
+		}
+	}
+	return false
+}
+
+// summary returns a one-line description of the priority queue
+func (pq *priorityQueue) summary() string {
+	return fmt.Sprintf("%s: levels=%s since=%s", pq.name, strings.Join(pq.levels, ","), pq.created.Format(time.RFC3339))
+}
+
+// writeLevels lists the queue's levels with their topics, subscriptions and counters
+func (pq *priorityQueue) writeLevels(w io.Writer) {
+	pq.mu.Lock()
+	defer pq.mu.Unlock()
+	fmt.Fprintln(w, "Levels (highest priority first)\n-------------------------------")
+	for i, level := range pq.levels {
+		fmt.Fprintf(w, "[%d] %s: topic=%s subscription=%s published=%d received=%d\n", i, level,
+			pq.topicName(level), pq.subscriptionName(level), pq.published[level], pq.received[level])
+	}
+}
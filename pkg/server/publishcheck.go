@@ -0,0 +1,150 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"path"
+	"unicode/utf8"
+
+	"cloud.google.com/go/pubsub"
+	"github.com/linkedin/goavro/v2"
+)
+
+// The messages of a publish request are checked one by one before any is published: a message
+// breaking Pub/Sub's limits gets an error result and is skipped while the others are published,
+// and a response with failed messages is 207 Multi-Status. With ?atomic=true the messages are
+// also checked against the topic's schema, and a request with any invalid message is refused
+// with 422, publishing none of them. Publishing itself is still per message, so a backend failure
+// can leave an atomic request partially published, which its 207 reports.
+
+const (
+	// maxMessageSize is Pub/Sub's limit on the size of a message's data and attributes
+	maxMessageSize = 10 << 20
+	// maxAttributeKeySize is Pub/Sub's limit on the size of an attribute's key
+	maxAttributeKeySize = 256
+)
+
+// checkPublishMessage returns why Pub/Sub would reject a message, "" if it wouldn't
+func checkPublishMessage(msg *pubsub.Message) string {
+	if len(msg.Data) == 0 && len(msg.Attributes) == 0 {
+		return "a message needs data or at least one attribute"
+	}
+	if len(msg.Attributes) > maxMessageAttributes {
+		return fmt.Sprintf("%d attributes, at most %d allowed", len(msg.Attributes), maxMessageAttributes)
+	}
+	size := len(msg.Data)
+	for key, value := range msg.Attributes {
+		if key == "" || len(key) > maxAttributeKeySize {
+			return fmt.Sprintf("attribute key %.32q must have 1 to %d bytes", key, maxAttributeKeySize)
+		}
+		if len(value) > maxAttributeValueSize {
+			return fmt.Sprintf("attribute %s has %d bytes, at most %d allowed", key, len(value), maxAttributeValueSize)
+		}
+		size += len(key) + len(value)
+	}
+	if size > maxMessageSize {
+		return fmt.Sprintf("message has %d bytes, at most %d allowed", size, maxMessageSize)
+	}
+	return ""
+}
+
+// checkPublishMessages checks the messages of a publish request, returning why each is invalid
+// ("" if it isn't); with ?atomic=true it also checks them against the topic's schema and responds
+// 422 if any is invalid, returning false
+func checkPublishMessages(ctx context.Context, w http.ResponseWriter, r *http.Request, topic *pubsub.Topic, msgs []*pubsub.Message) ([]string, bool) {
+	invalid := make([]string, len(msgs))
+	for i, msg := range msgs {
+		invalid[i] = checkPublishMessage(msg)
+	}
+	if s := r.URL.Query().Get("atomic"); s != "true" {
+		if s != "" && s != "false" {
+			http.Error(w, "atomic must be true or false", http.StatusBadRequest)
+			return nil, false
+		}
+		return invalid, true
+	}
+	schema, err := loadTopicSchema(ctx, topic)
+	if err != nil {
+		writeAdminError(w, err, http.StatusInternalServerError)
+		return nil, false
+	}
+	n := 0
+	for i, msg := range msgs {
+		if invalid[i] == "" && schema != nil {
+			invalid[i] = schema.check(msg)
+		}
+		if invalid[i] != "" {
+			n++
+		}
+	}
+	if n == 0 {
+		return invalid, true
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.WriteHeader(http.StatusUnprocessableEntity)
+	fmt.Fprintf(w, "no messages published: %d of %d messages invalid\n", n, len(msgs))
+	for i, reason := range invalid {
+		if reason != "" {
+			fmt.Fprintf(w, "[%d] invalid: %s\n", i, reason)
+		}
+	}
+	return nil, false
+}
+
+// topicSchema is the schema a topic's messages must match
+type topicSchema struct {
+	name     string
+	encoding pubsub.SchemaEncoding
+	codec    *goavro.Codec // nil for protocol buffer schemas, whose messages are only checked for their encoding
+}
+
+// loadTopicSchema returns the schema of the topic's messages, nil if it has none
+func loadTopicSchema(ctx context.Context, topic *pubsub.Topic) (*topicSchema, error) {
+	cfg, err := topic.Config(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.SchemaSettings == nil || cfg.SchemaSettings.Schema == "" {
+		return nil, nil
+	}
+	s := &topicSchema{name: cfg.SchemaSettings.Schema, encoding: cfg.SchemaSettings.Encoding}
+	sc, err := pubsub.NewSchemaClient(ctx, setting("GOOGLE_CLOUD_PROJECT"), backendOptions()...)
+	if err != nil {
+		return nil, err
+	}
+	defer sc.Close()
+	schema, err := sc.Schema(ctx, path.Base(s.name), pubsub.SchemaViewFull)
+	if err != nil {
+		return nil, fmt.Errorf("schema %s: %v", s.name, err)
+	}
+	if schema.Type == pubsub.SchemaAvro {
+		if s.codec, err = goavro.NewCodec(schema.Definition); err != nil {
+			return nil, fmt.Errorf("schema %s: %v", s.name, err)
+		}
+	}
+	return s, nil
+}
+
+// check returns why the message's data doesn't match the schema, "" if it does
+func (s *topicSchema) check(msg *pubsub.Message) string {
+	var err error
+	switch {
+	case s.encoding == pubsub.EncodingJSON && s.codec != nil:
+		_, _, err = s.codec.NativeFromTextual(msg.Data)
+	case s.encoding == pubsub.EncodingJSON:
+		if !utf8.Valid(msg.Data) || !json.Valid(msg.Data) {
+			return fmt.Sprintf("data is not JSON, as schema %s's encoding requires", s.name)
+		}
+	case s.codec != nil:
+		var rest []byte
+		if _, rest, err = s.codec.NativeFromBinary(msg.Data); err == nil && len(rest) > 0 {
+			err = fmt.Errorf("%d bytes left after the record", len(rest))
+		}
+	}
+	if err != nil {
+		return fmt.Sprintf("data doesn't match schema %s: %v", s.name, err)
+	}
+	return ""
+}
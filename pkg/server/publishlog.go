@@ -0,0 +1,282 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"cloud.google.com/go/pubsub"
+)
+
+// Every message published through POST /topics/{name} is recorded in the publish log, kept in the
+// state store with the last PUBLISH_LOG_SIZE publishes: its topic, data (and its hash), attributes
+// and result. POST /replays republishes the logged messages selected by topic, sequence number,
+// time or failure, e.g. once a misconfigured consumer is fixed, to their topic or another one.
+
+const defaultPublishLogSize = 10000
+
+// publishLogSize is the number of publishes kept in the log, 0 to keep none
+var publishLogSize = defaultPublishLogSize
+
+// publishLogEntry is a publish recorded in the log
+type publishLogEntry struct {
+	Seq        uint64            `json:"-"` // the entry's key
+	Time       time.Time         `json:"time"`
+	Topic      string            `json:"topic"`
+	DataHash   string            `json:"dataHash"` // hex SHA-256 of the data
+	Data       []byte            `json:"data"`
+	Attributes map[string]string `json:"attributes,omitempty"`
+	Result     string            `json:"result"` // published, delayed or failed
+	MessageID  string            `json:"messageId,omitempty"`
+	Error      string            `json:"error,omitempty"`
+	ReplayOf   uint64            `json:"replayOf,omitempty"` // the entry a replay republished
+}
+
+// startPublishLog reads the publish log settings
+func startPublishLog() {
+	publishLogSize = defaultPublishLogSize
+	if s := setting("PUBLISH_LOG_SIZE"); s != "" {
+		if n, err := strconv.Atoi(s); err != nil || n < 0 {
+			log.Printf("publish log: invalid PUBLISH_LOG_SIZE %q, using %d", s, defaultPublishLogSize)
+		} else {
+			publishLogSize = n
+		}
+	}
+}
+
+// newPublishLogEntry returns the log entry of a message published to a topic, with its result
+func newPublishLogEntry(topic string, msg *pubsub.Message, id string, err error) *publishLogEntry {
+	sum := sha256.Sum256(msg.Data)
+	e := &publishLogEntry{
+		Time:       time.Now(),
+		Topic:      topic,
+		DataHash:   hex.EncodeToString(sum[:]),
+		Data:       msg.Data,
+		Attributes: msg.Attributes,
+		Result:     "published",
+		MessageID:  id,
+	}
+	if err != nil {
+		e.Result, e.Error = "failed", err.Error()
+	}
+	return e
+}
+
+// recordPublishes appends the entries of a request's publishes to the log
+func recordPublishes(entries []*publishLogEntry) {
+	if publishLogSize == 0 || len(entries) == 0 {
+		return
+	}
+	values := make([]interface{}, len(entries))
+	for i, e := range entries {
+		values[i] = e
+	}
+	stateAppend(publishLogBucket, values, publishLogSize)
+}
+
+// replayRequest is the body of POST /replays, selecting the logged publishes to republish
+type replayRequest struct {
+	Topic  string `json:"topic"`
+	From   int    `json:"from"`
+	To     int    `json:"to"`
+	Since  string `json:"since"`
+	Until  string `json:"until"`
+	Failed bool   `json:"failed"`
+	Target string `json:"target"`
+	DryRun bool   `json:"dryRun"`
+}
+
+var replayRequestSchema = objectSchema(map[string]*jsonSchema{
+	"topic":  stringSchema("only publishes to this topic"),
+	"from":   numberSchema("first sequence number", true, 1),
+	"to":     numberSchema("last sequence number", true, 1),
+	"since":  stringSchema("only publishes at or after this RFC 3339 time"),
+	"until":  stringSchema("only publishes before this RFC 3339 time"),
+	"failed": booleanSchema("only publishes that failed"),
+	"target": stringSchema("topic to republish to instead of the original ones"),
+	"dryRun": booleanSchema("list the publishes selected without republishing them"),
+})
+
+// replaysHandler handles POST to /replays
+func replaysHandler(w http.ResponseWriter, r *http.Request) {
+	// get the selection from body:
+	// '{"topic":"orders", "from":120, "to":180, "since":"<RFC 3339 time>", "until":"<RFC 3339 time>",
+	//   "failed":true, "target":"orders-fixed", "dryRun":true}'
+	var req replayRequest
+	if !readRequest(w, r, replayRequestSchema, &req) {
+		return
+	}
+	if req.Topic == "" && req.From == 0 && req.To == 0 && req.Since == "" && req.Until == "" && !req.Failed {
+		http.Error(w, "select the publishes to replay with at least one of topic, from, to, since, until and failed", http.StatusBadRequest)
+		return
+	}
+	var since, until time.Time
+	var err error
+	if req.Since != "" {
+		if since, err = time.Parse(time.RFC3339, req.Since); err != nil {
+			http.Error(w, fmt.Sprintf("since: %v", err), http.StatusBadRequest)
+			return
+		}
+	}
+	if req.Until != "" {
+		if until, err = time.Parse(time.RFC3339, req.Until); err != nil {
+			http.Error(w, fmt.Sprintf("until: %v", err), http.StatusBadRequest)
+			return
+		}
+	}
+	for _, name := range []string{req.Topic, req.Target} {
+		if name == "" {
+			continue
+		}
+		if err := validateResourceName("topic", name); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	if stateStore.db == nil || publishLogSize == 0 {
+		http.Error(w, "the publish log is disabled: it needs the state store (STATE_FILE) and a PUBLISH_LOG_SIZE", http.StatusServiceUnavailable)
+		return
+	}
+
+	var selected []*publishLogEntry
+	stateLoad(publishLogBucket, func(key string, data []byte) error {
+		e := &publishLogEntry{}
+		if err := json.Unmarshal(data, e); err != nil {
+			return err
+		}
+		seq, err := strconv.ParseUint(key, 10, 64)
+		if err != nil {
+			return err
+		}
+		e.Seq = seq
+		switch {
+		case req.Topic != "" && e.Topic != req.Topic,
+			req.From > 0 && e.Seq < uint64(req.From),
+			req.To > 0 && e.Seq > uint64(req.To),
+			!since.IsZero() && e.Time.Before(since),
+			!until.IsZero() && !e.Time.Before(until),
+			req.Failed && e.Result != "failed":
+			return nil
+		}
+		selected = append(selected, e)
+		return nil
+	})
+	if len(selected) == 0 {
+		fmt.Fprintln(w, "no logged publishes match")
+		return
+	}
+	if req.DryRun {
+		fmt.Fprintf(w, "%d logged publishes match:\n", len(selected))
+		for _, e := range selected {
+			fmt.Fprintln(w, e.summary())
+		}
+		return
+	}
+
+	ctx := context.Background()
+	client, ok := newClient(ctx, w)
+	if !ok {
+		return
+	}
+	defer client.Close()
+	// the topics republished to are looked up once; entries of missing ones fail
+	lookups := map[string]error{}
+	for _, e := range selected {
+		target := e.Topic
+		if req.Target != "" {
+			target = req.Target
+		}
+		if _, ok := lookups[target]; !ok {
+			lookups[target] = checkExists(ctx, "topic", target, client.Topic(target).Exists)
+		}
+	}
+	if err := lookups[req.Target]; req.Target != "" && err != nil {
+		writeLookupError(w, err)
+		return
+	}
+	// replays are published on behalf of the request, like the original publishes
+	attrs := map[string][]map[string]string{}
+	for _, e := range selected {
+		target := e.Topic
+		if req.Target != "" {
+			target = req.Target
+		}
+		attrs[target] = append(attrs[target], e.Attributes)
+	}
+	for target, a := range attrs {
+		if err := authorizePublish(r, target, a); err != nil {
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+	}
+
+	// results are collected first, so that the status code can reflect failed replays
+	out := &bytes.Buffer{}
+	var entries []*publishLogEntry
+	failed := 0
+	for _, e := range selected {
+		target := e.Topic
+		if req.Target != "" {
+			target = req.Target
+		}
+		if err := lookups[target]; err != nil {
+			failed++
+			fmt.Fprintf(out, "[%d] %v\n", e.Seq, err)
+			continue
+		}
+		if r.Context().Err() != nil {
+			break
+		}
+		msg := &pubsub.Message{Data: e.Data, Attributes: e.Attributes}
+		id, err := publishReplayed(r.Context(), target, msg)
+		entry := newPublishLogEntry(target, msg, id, err)
+		entry.ReplayOf = e.Seq
+		entries = append(entries, entry)
+		if err != nil {
+			failed++
+			fmt.Fprintf(out, "[%d] %s\n", e.Seq, err.Error())
+			continue
+		}
+		recordPublished(target, 1)
+		fmt.Fprintf(out, "[%d] republished to %s as message ID %s\n", e.Seq, target, id)
+	}
+	recordPublishes(entries)
+	if failed > 0 {
+		fmt.Fprintf(out, "%d of %d publishes failed to replay\n", failed, len(selected))
+		w.WriteHeader(http.StatusMultiStatus)
+	}
+	w.Write(out.Bytes())
+}
+
+// publishReplayed publishes a replayed message through the topic's cached handle
+func publishReplayed(ctx context.Context, topic string, msg *pubsub.Message) (string, error) {
+	publisher, release, err := acquireTopic(topic)
+	if err != nil {
+		return "", err
+	}
+	defer release()
+	return publisher.Publish(ctx, msg).Get(ctx)
+}
+
+// summary returns a one-line description of the logged publish
+func (e *publishLogEntry) summary() string {
+	s := fmt.Sprintf("[%d] %s topic=%s dataHash=%s size=%d attributes=%d %s", e.Seq, e.Time.Format(time.RFC3339),
+		e.Topic, e.DataHash[:16], len(e.Data), len(e.Attributes), e.Result)
+	if e.MessageID != "" {
+		s += " messageId=" + e.MessageID
+	}
+	if e.Error != "" {
+		s += fmt.Sprintf(" error=%q", e.Error)
+	}
+	if e.ReplayOf != 0 {
+		s += fmt.Sprintf(" replayOf=%d", e.ReplayOf)
+	}
+	return s
+}
@@ -0,0 +1,69 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"cloud.google.com/go/pubsub"
+)
+
+const (
+	defaultReceiveTimeout = time.Second
+	maxReceiveTimeout     = time.Minute
+)
+
+// receiveOptions are the query parameters of a receive request: ?max=<n>&timeout=<duration>&ack=true|false
+type receiveOptions struct {
+	max     int           // 0 for no limit
+	timeout time.Duration // how long to receive for
+	ack     bool          // false leaves the messages for redelivery, like a peek
+}
+
+// parseReceiveOptions reads the receive options of the request's query
+func parseReceiveOptions(r *http.Request) (receiveOptions, error) {
+	opts := receiveOptions{timeout: defaultReceiveTimeout, ack: true}
+	q := r.URL.Query()
+	if s := q.Get("max"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 1 {
+			return opts, fmt.Errorf("max must be a positive number")
+		}
+		opts.max = n
+	}
+	if s := q.Get("timeout"); s != "" {
+		d, err := time.ParseDuration(s)
+		if err != nil || d <= 0 || d > maxReceiveTimeout {
+			return opts, fmt.Errorf("timeout must be a positive duration up to %s", maxReceiveTimeout)
+		}
+		opts.timeout = d
+	}
+	if s := q.Get("ack"); s != "" {
+		ack, err := strconv.ParseBool(s)
+		if err != nil {
+			return opts, fmt.Errorf("ack must be true or false")
+		}
+		opts.ack = ack
+	}
+	return opts, nil
+}
+
+// settle acks or nacks a received message as the options ask
+func (opts receiveOptions) settle(msg *pubsub.Message) {
+	if opts.ack {
+		msg.Ack()
+	} else {
+		msg.Nack()
+	}
+}
+
+// deprecatedReceiveHandler handles POST to /subscriptions/<subscription-name>, which receives
+// like GET /subscriptions/<subscription-name>/messages but is deprecated, as receiving isn't a
+// change made to the subscription
+func deprecatedReceiveHandler(ctx context.Context, w http.ResponseWriter, r *http.Request, client *pubsub.Client, subscr *pubsub.Subscription) {
+	w.Header().Set("Deprecation", "true")
+	w.Header().Set("Link", fmt.Sprintf("<%s/messages>; rel=\"successor-version\"", r.URL.EscapedPath()))
+	receiveHandler(ctx, w, r, client, subscr)
+}
@@ -0,0 +1,180 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Pub/Sub limits administrative operations (creating, deleting and listing topics and subscriptions)
+// per project and minute. Rather than letting bursts, like a batch create, run into
+// RESOURCE_EXHAUSTED, admin calls are counted over a sliding minute and held back once the
+// limit is reached, for up to ADMIN_QUOTA_MAX_WAIT. The limits are per instance, so with several
+// instances sharing a project they should be lowered accordingly.
+
+const (
+	adminOpCreate = "create"
+	adminOpDelete = "delete"
+	adminOpList   = "list"
+
+	// defaultAdminQuota is Pub/Sub's default admin operations quota, per minute
+	defaultAdminQuota        = 6000
+	defaultAdminQuotaMaxWait = 10 * time.Second
+	adminQuotaWindow         = time.Minute
+
+	adminCallsMetric     = "second_admin_calls_total"
+	adminThrottledMetric = "second_admin_throttled_total"
+	adminRejectedMetric  = "second_admin_rejected_total"
+	adminUsageMetric     = "second_admin_quota_usage"
+	adminLimitMetric     = "second_admin_quota_limit"
+)
+
+// adminQuotaError is returned when an admin operation would have had to wait too long for the quota
+type adminQuotaError struct {
+	op   string
+	wait time.Duration
+}
+
+func (e *adminQuotaError) Error() string {
+	return fmt.Sprintf("admin operations quota exhausted: %s operations are limited, retry in %s", e.op, e.wait.Round(time.Second))
+}
+
+// adminQuota tracks the admin calls of the last minute, overall and by operation
+var adminQuota = struct {
+	sync.Mutex
+	limit   int            // overall, per minute
+	limits  map[string]int // by operation, per minute, if configured
+	maxWait time.Duration
+	calls   []adminCall // oldest first
+}{limit: defaultAdminQuota, limits: map[string]int{}, maxWait: defaultAdminQuotaMaxWait}
+
+type adminCall struct {
+	op string
+	at time.Time
+}
+
+// loadAdminQuota reads ADMIN_QUOTA, the overall limit per minute optionally followed by limits
+// of single operations, like 6000,create=600,delete=600, and ADMIN_QUOTA_MAX_WAIT
+func loadAdminQuota() {
+	adminQuota.Lock()
+	defer adminQuota.Unlock()
+	adminQuota.limit, adminQuota.limits, adminQuota.maxWait = defaultAdminQuota, map[string]int{}, defaultAdminQuotaMaxWait
+	if s := setting("ADMIN_QUOTA"); s != "" {
+		for _, part := range strings.Split(s, ",") {
+			part = strings.TrimSpace(part)
+			op, value := "", part
+			if i := strings.IndexByte(part, '='); i >= 0 {
+				op, value = part[:i], part[i+1:]
+			}
+			n, err := strconv.Atoi(value)
+			if err != nil || n < 1 || (op != "" && op != adminOpCreate && op != adminOpDelete && op != adminOpList) {
+				log.Printf("admin quota: invalid ADMIN_QUOTA entry %q (ignored)", part)
+				continue
+			}
+			if op == "" {
+				adminQuota.limit = n
+			} else {
+				adminQuota.limits[op] = n
+			}
+		}
+	}
+	if s := setting("ADMIN_QUOTA_MAX_WAIT"); s != "" {
+		if d, err := time.ParseDuration(s); err != nil || d < 0 {
+			log.Printf("admin quota: invalid ADMIN_QUOTA_MAX_WAIT %q, using %s", s, defaultAdminQuotaMaxWait)
+		} else {
+			adminQuota.maxWait = d
+		}
+	}
+	gaugeSet(adminLimitMetric, "Admin operations allowed per minute.", float64(adminQuota.limit), "op", "all")
+	for op, n := range adminQuota.limits {
+		gaugeSet(adminLimitMetric, "Admin operations allowed per minute.", float64(n), "op", op)
+	}
+}
+
+// waitAdminQuota blocks until an admin operation fits the quota, returning an *adminQuotaError
+// if that would take longer than ADMIN_QUOTA_MAX_WAIT, or the context's error
+func waitAdminQuota(ctx context.Context, op string) error {
+	adminQuota.Lock()
+	deadline := time.Now().Add(adminQuota.maxWait)
+	adminQuota.Unlock()
+	throttled := false
+	for {
+		adminQuota.Lock()
+		wait := adminQuotaWaitLocked(op, time.Now())
+		if wait == 0 {
+			adminQuota.calls = append(adminQuota.calls, adminCall{op: op, at: time.Now()})
+			adminQuota.Unlock()
+			counterAdd(adminCallsMetric, "Pub/Sub admin operations, by operation.", 1, "op", op)
+			return nil
+		}
+		adminQuota.Unlock()
+		if time.Now().Add(wait).After(deadline) {
+			counterAdd(adminRejectedMetric, "Admin operations rejected as the quota stayed exhausted, by operation.", 1, "op", op)
+			return &adminQuotaError{op: op, wait: wait}
+		}
+		if !throttled {
+			throttled = true
+			counterAdd(adminThrottledMetric, "Admin operations held back to stay within the quota, by operation.", 1, "op", op)
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(wait):
+		}
+	}
+}
+
+// adminQuotaWaitLocked drops the calls that left the window and returns how long an operation
+// has to wait for its overall and own limit, 0 if it can go ahead
+func adminQuotaWaitLocked(op string, now time.Time) time.Duration {
+	start := now.Add(-adminQuotaWindow)
+	i := 0
+	for i < len(adminQuota.calls) && !adminQuota.calls[i].at.After(start) {
+		i++
+	}
+	adminQuota.calls = adminQuota.calls[i:]
+
+	var wait time.Duration
+	if n := len(adminQuota.calls); n >= adminQuota.limit {
+		// room is made when the call that brings the count below the limit leaves the window
+		wait = adminQuota.calls[n-adminQuota.limit].at.Sub(start)
+	}
+	if limit, ok := adminQuota.limits[op]; ok {
+		var own []time.Time
+		for _, c := range adminQuota.calls {
+			if c.op == op {
+				own = append(own, c.at)
+			}
+		}
+		if n := len(own); n >= limit {
+			if d := own[n-limit].Sub(start); d > wait {
+				wait = d
+			}
+		}
+	}
+	if wait < 0 {
+		wait = 0
+	}
+	return wait
+}
+
+// updateAdminQuotaUsage sets the usage gauges to the calls of the last minute
+func updateAdminQuotaUsage() {
+	adminQuota.Lock()
+	adminQuotaWaitLocked("", time.Now())
+	usage := map[string]int{adminOpCreate: 0, adminOpDelete: 0, adminOpList: 0}
+	for _, c := range adminQuota.calls {
+		usage[c.op]++
+	}
+	total := len(adminQuota.calls)
+	adminQuota.Unlock()
+
+	gaugeSet(adminUsageMetric, "Admin operations in the last minute.", float64(total), "op", "all")
+	for op, n := range usage {
+		gaugeSet(adminUsageMetric, "Admin operations in the last minute.", float64(n), "op", op)
+	}
+}
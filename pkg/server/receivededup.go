@@ -0,0 +1,135 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/pubsub"
+)
+
+const (
+	// maxReceiveDedupWindow bounds how long delivered message keys are remembered per session
+	maxReceiveDedupWindow = time.Hour
+
+	receiveDedupSuppressedMetric = "second_receive_dedup_suppressed_total"
+)
+
+// receiveDedup suppresses messages already delivered to a client session, demonstrating
+// consumer-side deduplication on top of Pub/Sub's at-least-once delivery
+type receiveDedup struct {
+	session   string
+	window    time.Duration
+	attribute string // key messages by this attribute instead of the message ID
+}
+
+// receiveSession remembers when message keys were delivered to a client session
+type receiveSession struct {
+	seen     map[string]time.Time
+	lastUsed time.Time
+}
+
+var receiveSessions = struct {
+	sync.Mutex
+	m map[string]*receiveSession
+}{m: map[string]*receiveSession{}}
+
+// parseReceiveDedup reads the dedup options of a receive request:
+// ?dedupWindow=<duration>&session=<session-id>[&dedupBy=<attribute-name>];
+// it returns nil if the request doesn't ask for deduplication
+func parseReceiveDedup(r *http.Request, subscrName string) (*receiveDedup, error) {
+	q := r.URL.Query()
+	s := q.Get("dedupWindow")
+	if s == "" {
+		return nil, nil
+	}
+	window, err := time.ParseDuration(s)
+	if err != nil || window <= 0 || window > maxReceiveDedupWindow {
+		return nil, fmt.Errorf("dedupWindow must be a positive duration up to %s", maxReceiveDedupWindow)
+	}
+	session := q.Get("session")
+	if session == "" {
+		return nil, fmt.Errorf("session must be provided with dedupWindow")
+	}
+	return &receiveDedup{
+		// sessions are per subscription, so the same session ID can be used for several
+		session:   subscrName + "\x00" + session,
+		window:    window,
+		attribute: q.Get("dedupBy"),
+	}, nil
+}
+
+// seen reports whether the message was already delivered to the session within the window,
+// and its dedup key; messages lacking the dedupBy attribute are never suppressed
+func (d *receiveDedup) seen(subscrName string, msg *pubsub.Message) (string, bool) {
+	key := msg.ID
+	if d.attribute != "" {
+		var ok bool
+		if key, ok = msg.Attributes[d.attribute]; !ok {
+			return "", false
+		}
+	}
+
+	receiveSessions.Lock()
+	defer receiveSessions.Unlock()
+	now := time.Now()
+	// forget sessions nobody used for a while
+	for id, s := range receiveSessions.m {
+		if now.Sub(s.lastUsed) > maxReceiveDedupWindow {
+			delete(receiveSessions.m, id)
+		}
+	}
+	s, ok := receiveSessions.m[d.session]
+	if !ok {
+		s = &receiveSession{seen: map[string]time.Time{}}
+		receiveSessions.m[d.session] = s
+	}
+	s.lastUsed = now
+	for k, at := range s.seen {
+		if now.Sub(at) > d.window {
+			delete(s.seen, k)
+		}
+	}
+	if _, ok := s.seen[key]; ok {
+		counterAdd(receiveDedupSuppressedMetric, "Received messages suppressed as already delivered to the client session, by subscription.", 1, "subscription", subscrName)
+		return key, true
+	}
+	s.seen[key] = now
+	return key, false
+}
+
+// storedReceiveSession is a receiveSession as kept in the state store
+type storedReceiveSession struct {
+	Seen     map[string]time.Time `json:"seen"`
+	LastUsed time.Time            `json:"lastUsed"`
+}
+
+// saveReceiveSessions keeps the receive sessions in the state store, for the next start
+func saveReceiveSessions() {
+	receiveSessions.Lock()
+	defer receiveSessions.Unlock()
+	values := map[string]interface{}{}
+	for id, s := range receiveSessions.m {
+		values[id] = storedReceiveSession{Seen: s.seen, LastUsed: s.lastUsed}
+	}
+	stateReplace(receiveSessionsBucket, values)
+}
+
+// loadReceiveSessions restores the receive sessions kept in the state store by the last run;
+// sessions unused for longer than they would have been kept are dropped
+func loadReceiveSessions() {
+	receiveSessions.Lock()
+	defer receiveSessions.Unlock()
+	stateLoad(receiveSessionsBucket, func(id string, data []byte) error {
+		var s storedReceiveSession
+		if err := json.Unmarshal(data, &s); err != nil {
+			return err
+		}
+		if time.Since(s.LastUsed) <= maxReceiveDedupWindow && s.Seen != nil {
+			receiveSessions.m[id] = &receiveSession{seen: s.Seen, lastUsed: s.LastUsed}
+		}
+		return nil
+	})
+}
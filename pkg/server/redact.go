@@ -0,0 +1,241 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+
+	"cloud.google.com/go/pubsub"
+)
+
+const defaultRedaction = "[REDACTED]"
+
+// redactionRule hides part of the messages shown in responses; exactly one of Pattern (a regular
+// expression matched against data and attribute values), JSONPath (a dotted path into JSON data,
+// where * matches any key or array element and numbers index arrays) and Attribute (an attribute
+// name) is set
+type redactionRule struct {
+	Name        string `json:"name"`
+	Pattern     string `json:"pattern,omitempty"`
+	JSONPath    string `json:"jsonPath,omitempty"`
+	Attribute   string `json:"attribute,omitempty"`
+	Replacement string `json:"replacement,omitempty"`
+
+	re   *regexp.Regexp
+	path []string
+}
+
+var redactionRulesSchema = &jsonSchema{Type: "array", Items: objectSchema(map[string]*jsonSchema{
+	"name":        stringSchema("rule name (default rule-<number>)"),
+	"pattern":     stringSchema("regular expression matched against data and attribute values"),
+	"jsonPath":    stringSchema("dotted path into JSON data, like payment.card.number (* matches any key or element)"),
+	"attribute":   stringSchema("attribute whose value is hidden"),
+	"replacement": stringSchema("what the redacted part is shown as"),
+})}
+
+// redaction holds the rules applied when rendering received messages; the messages themselves
+// are left intact
+var redaction = struct {
+	sync.Mutex
+	rules []*redactionRule
+}{}
+
+// startRedaction loads the rules from REDACTION_FILE, if set; when reloading, invalid rules leave
+// the previous ones in place
+func startRedaction() {
+	path := setting("REDACTION_FILE")
+	if path == "" {
+		redaction.Lock()
+		redaction.rules = nil
+		redaction.Unlock()
+		return
+	}
+	var rules []*redactionRule
+	data, err := os.ReadFile(path)
+	if err == nil {
+		err = json.Unmarshal(data, &rules)
+	}
+	if err == nil {
+		err = compileRedactionRules(rules)
+	}
+	if err != nil {
+		log.Printf("redaction: %s: %v (rules not applied)", path, err)
+		return
+	}
+	redaction.Lock()
+	redaction.rules = rules
+	redaction.Unlock()
+}
+
+// compileRedactionRules validates rules, compiling their patterns and paths
+func compileRedactionRules(rules []*redactionRule) error {
+	for i, rule := range rules {
+		if rule.Name == "" {
+			rule.Name = fmt.Sprintf("rule-%d", i+1)
+		}
+		set := 0
+		for _, s := range []string{rule.Pattern, rule.JSONPath, rule.Attribute} {
+			if s != "" {
+				set++
+			}
+		}
+		if set != 1 {
+			return fmt.Errorf("rule %s: exactly one of pattern, jsonPath and attribute must be provided", rule.Name)
+		}
+		if rule.Replacement == "" {
+			rule.Replacement = defaultRedaction
+		}
+		if rule.Pattern != "" {
+			re, err := regexp.Compile(rule.Pattern)
+			if err != nil {
+				return fmt.Errorf("rule %s: %v", rule.Name, err)
+			}
+			rule.re = re
+		}
+		if rule.JSONPath != "" {
+			path := strings.TrimPrefix(strings.TrimPrefix(rule.JSONPath, "$"), ".")
+			if path == "" {
+				return fmt.Errorf("rule %s: jsonPath must name a field, like customer.email", rule.Name)
+			}
+			rule.path = strings.Split(path, ".")
+		}
+	}
+	return nil
+}
+
+// getRedactionHandler handles GET to /redaction
+func getRedactionHandler(w http.ResponseWriter, r *http.Request) {
+	redaction.Lock()
+	rules := redaction.rules
+	redaction.Unlock()
+	fmt.Fprintln(w, "Redaction rules\n---------------")
+	for _, rule := range rules {
+		switch {
+		case rule.re != nil:
+			fmt.Fprintf(w, "%s: pattern=%q replacement=%q\n", rule.Name, rule.Pattern, rule.Replacement)
+		case rule.path != nil:
+			fmt.Fprintf(w, "%s: jsonPath=%s replacement=%q\n", rule.Name, rule.JSONPath, rule.Replacement)
+		default:
+			fmt.Fprintf(w, "%s: attribute=%s replacement=%q\n", rule.Name, rule.Attribute, rule.Replacement)
+		}
+	}
+	if len(rules) == 0 {
+		fmt.Fprintln(w, "(none)")
+	}
+}
+
+// putRedactionHandler handles PUT to /redaction, replacing the rules; admins only, as it may
+// also remove them
+func putRedactionHandler(w http.ResponseWriter, r *http.Request) {
+	// get rules from body:
+	// '[{"name":"emails", "pattern":"[\\w.+-]+@[\\w-]+\\.[\\w.]+", "replacement":"[email]"},
+	//   {"name":"cards", "jsonPath":"payment.card.number"}, {"name":"phones", "attribute":"phone"}]'
+	if !isAdmin(r) {
+		http.Error(w, "changing the redaction rules requires the admin token", http.StatusForbidden)
+		return
+	}
+	var rules []*redactionRule
+	if !readRequest(w, r, redactionRulesSchema, &rules) {
+		return
+	}
+	if err := compileRedactionRules(rules); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	redaction.Lock()
+	redaction.rules = rules
+	redaction.Unlock()
+	fmt.Fprintf(w, "set %d redaction rules\n", len(rules))
+}
+
+// redactMessage returns a message as it may be shown: a copy with the rules applied, or the
+// message itself if there are no rules
+func redactMessage(msg *pubsub.Message) *pubsub.Message {
+	redaction.Lock()
+	rules := redaction.rules
+	redaction.Unlock()
+	if len(rules) == 0 {
+		return msg
+	}
+	redacted := *msg
+	redacted.Data = redactData(rules, msg.Data)
+	if len(msg.Attributes) > 0 {
+		redacted.Attributes = make(map[string]string, len(msg.Attributes))
+		for key, value := range msg.Attributes {
+			redacted.Attributes[key] = redactAttribute(rules, key, value)
+		}
+	}
+	return &redacted
+}
+
+// redactData applies the JSON path rules, if the data is JSON, then the patterns
+func redactData(rules []*redactionRule, data []byte) []byte {
+	var doc interface{}
+	parsed := false
+	for _, rule := range rules {
+		if rule.path == nil {
+			continue
+		}
+		if !parsed {
+			if json.Unmarshal(data, &doc) != nil {
+				break
+			}
+			parsed = true
+		}
+		doc = redactPath(doc, rule.path, rule.Replacement)
+	}
+	if parsed {
+		if out, err := json.Marshal(doc); err == nil {
+			data = out
+		}
+	}
+	for _, rule := range rules {
+		if rule.re != nil {
+			data = rule.re.ReplaceAllLiteral(data, []byte(rule.Replacement))
+		}
+	}
+	return data
+}
+
+// redactPath replaces the values at a path in a decoded JSON document
+func redactPath(v interface{}, path []string, replacement string) interface{} {
+	if len(path) == 0 {
+		return replacement
+	}
+	switch x := v.(type) {
+	case map[string]interface{}:
+		for key, child := range x {
+			if path[0] == "*" || path[0] == key {
+				x[key] = redactPath(child, path[1:], replacement)
+			}
+		}
+	case []interface{}:
+		for i, child := range x {
+			if path[0] == "*" || path[0] == strconv.Itoa(i) {
+				x[i] = redactPath(child, path[1:], replacement)
+			}
+		}
+	}
+	return v
+}
+
+// redactAttribute applies the attribute rules, then the patterns, to an attribute value
+func redactAttribute(rules []*redactionRule, key, value string) string {
+	for _, rule := range rules {
+		if rule.Attribute == key {
+			return rule.Replacement
+		}
+	}
+	for _, rule := range rules {
+		if rule.re != nil {
+			value = rule.re.ReplaceAllLiteralString(value, rule.Replacement)
+		}
+	}
+	return value
+}
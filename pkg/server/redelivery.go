@@ -0,0 +1,114 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/pubsub"
+)
+
+const (
+	// redeliveryTrackingPeriod bounds how long the deliveries of a message ID are remembered per session
+	redeliveryTrackingPeriod = time.Hour
+
+	// maxTrackedDeliveries bounds the message IDs remembered per session; beyond it, new IDs aren't tracked
+	maxTrackedDeliveries = 10000
+
+	redeliveriesMetric = "second_receive_redeliveries_total"
+)
+
+// Receive requests naming a client session (?session=<session-id>) have the messages delivered
+// to the session more than once annotated with how often and since when, making Pub/Sub's
+// at-least-once delivery visible; unlike with dedupWindow, the redeliveries aren't suppressed.
+
+// deliveryRecord is how often a message ID was delivered to a session, and when first
+type deliveryRecord struct {
+	firstSeen time.Time
+	count     int
+}
+
+// redeliverySession remembers the message IDs delivered to a client session
+type redeliverySession struct {
+	deliveries map[string]*deliveryRecord
+	lastUsed   time.Time
+}
+
+var redeliverySessions = struct {
+	sync.Mutex
+	m map[string]*redeliverySession
+}{m: map[string]*redeliverySession{}}
+
+// redeliveryTracker tracks the deliveries of a receive request to its client session
+type redeliveryTracker struct {
+	session      string
+	subscription string
+	delivered    int
+	redelivered  int
+}
+
+// parseRedeliveryTracking returns the tracker of a receive request naming a session, nil if it doesn't
+func parseRedeliveryTracking(r *http.Request, subscrName string) *redeliveryTracker {
+	session := r.URL.Query().Get("session")
+	if session == "" {
+		return nil
+	}
+	// sessions are per subscription, like those of dedupWindow
+	return &redeliveryTracker{session: subscrName + "\x00" + session, subscription: subscrName}
+}
+
+// observe records the delivery of a message to the session, returning its record if the
+// message was delivered to the session before
+func (t *redeliveryTracker) observe(msg *pubsub.Message) *deliveryRecord {
+	redeliverySessions.Lock()
+	defer redeliverySessions.Unlock()
+	now := time.Now()
+	for id, s := range redeliverySessions.m {
+		if now.Sub(s.lastUsed) > redeliveryTrackingPeriod {
+			delete(redeliverySessions.m, id)
+		}
+	}
+	s, ok := redeliverySessions.m[t.session]
+	if !ok {
+		s = &redeliverySession{deliveries: map[string]*deliveryRecord{}}
+		redeliverySessions.m[t.session] = s
+	}
+	s.lastUsed = now
+	t.delivered++
+	rec, ok := s.deliveries[msg.ID]
+	if !ok {
+		for id, d := range s.deliveries {
+			if now.Sub(d.firstSeen) > redeliveryTrackingPeriod {
+				delete(s.deliveries, id)
+			}
+		}
+		if len(s.deliveries) < maxTrackedDeliveries {
+			s.deliveries[msg.ID] = &deliveryRecord{firstSeen: now, count: 1}
+		}
+		return nil
+	}
+	rec.count++
+	t.redelivered++
+	counterAdd(redeliveriesMetric, "Messages delivered again to the client session they were delivered to before, by subscription.", 1, "subscription", t.subscription)
+	copied := *rec
+	return &copied
+}
+
+// annotate writes the redelivery note of the i-th message of a receive response
+func (t *redeliveryTracker) annotate(w http.ResponseWriter, i int, msg *pubsub.Message) {
+	rec := t.observe(msg)
+	if rec == nil {
+		return
+	}
+	fmt.Fprintf(w, "[%d] Redelivered: message ID %s delivered %d times to this session, first at %s\n",
+		i, msg.ID, rec.count, rec.firstSeen.UTC().Format(time.RFC3339))
+}
+
+// summary writes how many of the messages delivered by the request were redeliveries
+func (t *redeliveryTracker) summary(w http.ResponseWriter) {
+	if t.delivered == 0 {
+		return
+	}
+	fmt.Fprintf(w, "%d of %d messages delivered were redeliveries to this session\n", t.redelivered, t.delivered)
+}
@@ -0,0 +1,196 @@
+package server
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+// Settings can also be given in CONFIG_FILE, as NAME=value lines overriding the environment. On
+// SIGHUP or POST /admin/reload the file is read again and the changed settings that the running
+// service can take are applied; the others are reported as requiring a restart. The policy,
+// redaction and naming policy files are re-read on every reload, whether or not their setting changed.
+
+// liveSettings are read on each use, so a change applies right away
+var liveSettings = map[string]bool{"ADMIN_TOKEN": true, "DEBUG_ENDPOINTS": true, "CHAOS_MODE": true, "ENCRYPTION_KEYS": true}
+
+// settingReloaders apply changed settings to the running service
+var settingReloaders = []struct {
+	settings []string
+	reload   func()
+}{
+	{[]string{"ADMIN_QUOTA", "ADMIN_QUOTA_MAX_WAIT"}, loadAdminQuota},
+	{[]string{"ADMIN_RETRY_ATTEMPTS", "ADMIN_RETRY_BACKOFF"}, loadAdminRetry},
+	{[]string{"BREAKER_THRESHOLD", "BREAKER_COOLDOWN"}, loadBreaker},
+}
+
+var configFile = struct {
+	sync.Mutex
+	path string
+}{}
+
+// settings hold the values overriding the environment's, without changing the process's
+// environment: CONFIG_FILE's, then those of the embedding program's Options
+var settings = struct {
+	sync.RWMutex
+	file    map[string]string
+	options map[string]string
+}{}
+
+// lookupSetting returns the value of a setting, from CONFIG_FILE, the Options or the environment,
+// and whether it is set
+func lookupSetting(name string) (string, bool) {
+	settings.RLock()
+	defer settings.RUnlock()
+	if v, ok := settings.file[name]; ok {
+		return v, true
+	}
+	if v, ok := settings.options[name]; ok {
+		return v, true
+	}
+	return os.LookupEnv(name)
+}
+
+// setting returns the value of a setting, empty if it isn't set
+func setting(name string) string {
+	v, _ := lookupSetting(name)
+	return v
+}
+
+// loadConfigFile applies CONFIG_FILE over the environment, before the settings are read
+func loadConfigFile() {
+	configFile.Lock()
+	defer configFile.Unlock()
+	configFile.path = setting("CONFIG_FILE")
+	if _, err := applyConfigFileLocked(); err != nil {
+		log.Printf("config file: %v", err)
+	}
+}
+
+// applyConfigFileLocked sets the settings of the config file, in place of those it set before, and
+// returns the names of the settings that changed
+func applyConfigFileLocked() ([]string, error) {
+	if configFile.path == "" {
+		return nil, nil
+	}
+	data, err := os.ReadFile(configFile.path)
+	if err != nil {
+		return nil, err
+	}
+	values := map[string]string{}
+	for i, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		eq := strings.IndexByte(line, '=')
+		if eq <= 0 {
+			return nil, fmt.Errorf("%s:%d: expected NAME=value", configFile.path, i+1)
+		}
+		name := strings.TrimSpace(line[:eq])
+		if name == "CONFIG_FILE" {
+			return nil, fmt.Errorf("%s:%d: CONFIG_FILE can't be set in the config file", configFile.path, i+1)
+		}
+		values[name] = strings.TrimSpace(line[eq+1:])
+	}
+
+	settings.RLock()
+	before := map[string]string{}
+	for name := range settings.file {
+		before[name] = ""
+	}
+	settings.RUnlock()
+	for name := range values {
+		before[name] = ""
+	}
+	for name := range before {
+		before[name] = setting(name)
+	}
+	settings.Lock()
+	settings.file = values
+	settings.Unlock()
+	var changed []string
+	for name, old := range before {
+		if setting(name) != old {
+			changed = append(changed, name)
+		}
+	}
+	sort.Strings(changed)
+	return changed, nil
+}
+
+// reloadConfig re-reads the config file and the policy and redaction files, returning a report of
+// what was applied and what requires a restart
+func reloadConfig() []string {
+	configFile.Lock()
+	defer configFile.Unlock()
+	var report []string
+	changed, err := applyConfigFileLocked()
+	if err != nil {
+		report = append(report, fmt.Sprintf("CONFIG_FILE: %v (settings unchanged)", err))
+	}
+	reload := map[int]bool{}
+	for _, name := range changed {
+		applied := liveSettings[name] || name == "PUBLISH_POLICY_FILE" || name == "REDACTION_FILE" ||
+			name == "NAMING_POLICY_FILE" || name == "NAMING_ENVIRONMENT"
+		for i, r := range settingReloaders {
+			for _, s := range r.settings {
+				if s == name {
+					reload[i], applied = true, true
+				}
+			}
+		}
+		if applied {
+			report = append(report, name+": changed, applied")
+		} else {
+			report = append(report, name+": changed, requires a restart")
+		}
+	}
+	if len(changed) == 0 && err == nil {
+		report = append(report, "no settings changed")
+	}
+	for i, r := range settingReloaders {
+		if reload[i] {
+			r.reload()
+		}
+	}
+	loadPublishPolicy()
+	startRedaction()
+	loadNamingPolicy()
+	for _, name := range []string{"PUBLISH_POLICY_FILE", "REDACTION_FILE", "NAMING_POLICY_FILE"} {
+		if file := setting(name); file != "" {
+			report = append(report, fmt.Sprintf("%s: re-read %s (errors are logged)", name, file))
+		}
+	}
+	for _, line := range report {
+		log.Printf("reload: %s", line)
+	}
+	return report
+}
+
+// startReloadSignal reloads the configuration on SIGHUP
+func startReloadSignal() {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGHUP)
+	go func() {
+		for range sigs {
+			reloadConfig()
+		}
+	}()
+}
+
+// reloadHandler handles POST to /admin/reload (admins only)
+func reloadHandler(w http.ResponseWriter, r *http.Request) {
+	if !requireAdmin(w, r) {
+		return
+	}
+	for _, line := range reloadConfig() {
+		fmt.Fprintln(w, line)
+	}
+}
@@ -0,0 +1,86 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/pubsub"
+)
+
+var subscriptionReplaySchema = objectSchema(map[string]*jsonSchema{
+	"from": stringSchema("RFC 3339 time the subscription is seeked back to, like \"2024-05-01T00:00:00Z\""),
+	"pull": booleanSchema("pull the replayed backlog right away"),
+}, "from")
+
+// subscriptionReplayHandler handles POST to /subscriptions/<subscription-name>/replay, seeking the
+// subscription back to a point in time so that messages published since are delivered again
+// (acked ones only if retained), optionally pulling the replayed backlog right away
+func subscriptionReplayHandler(ctx context.Context, w http.ResponseWriter, r *http.Request, client *pubsub.Client, subscr *pubsub.Subscription) {
+	// get replay details from body: '{"from":"2024-05-01T00:00:00Z", "pull":true}'
+	var req struct {
+		From string `json:"from"`
+		Pull bool   `json:"pull"`
+	}
+	if !readRequest(w, r, subscriptionReplaySchema, &req) {
+		return
+	}
+	from, err := time.Parse(time.RFC3339, req.From)
+	if err != nil {
+		http.Error(w, "from property must be an RFC 3339 time like \"2024-05-01T00:00:00Z\"", http.StatusBadRequest)
+		return
+	}
+	if from.After(time.Now()) {
+		http.Error(w, "from must not be in the future", http.StatusBadRequest)
+		return
+	}
+
+	cfg, err := subscr.Config(ctx)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	retention := cfg.TopicMessageRetentionDuration
+	if cfg.RetainAckedMessages && cfg.RetentionDuration > retention {
+		retention = cfg.RetentionDuration
+	}
+
+	if err := subscr.SeekToTime(ctx, from); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	fmt.Fprintf(w, "seeked subscription %s to %s\n", subscr.String(), from.Format(time.RFC3339))
+	// acked messages can only be replayed if the subscription or its topic retains them
+	if !cfg.RetainAckedMessages && cfg.TopicMessageRetentionDuration == 0 {
+		fmt.Fprintf(w, "warning: the subscription retains no acked messages and its topic has no message retention, so only unacked "+
+			"messages are redelivered; enable retention with PATCH /subscriptions/%s '{\"retainAckedMessages\":true}' (with If-Match)\n", subscr.ID())
+	}
+	if oldest := time.Now().Add(-retention); retention > 0 && from.Before(oldest) {
+		fmt.Fprintf(w, "note: messages are retained for %s, nothing published before %s can be replayed\n", retention, oldest.Format(time.RFC3339))
+	}
+	if !req.Pull {
+		return
+	}
+
+	// pull the replayed backlog for a second to show the effect
+	rctx, cancel := context.WithTimeout(r.Context(), time.Second)
+	defer cancel()
+	var (
+		mu sync.Mutex
+		n  int
+	)
+	err = subscr.Receive(rctx, func(_ context.Context, msg *pubsub.Message) {
+		mu.Lock()
+		defer mu.Unlock()
+		msg.Ack()
+		writeReceivedMessage(w, n, msg)
+		n++
+	})
+	if err != nil {
+		fmt.Fprintf(w, "sub.Receive: %v\n", err)
+	}
+	recordReceived(subscr.ID(), n)
+	fmt.Fprintf(w, "pulled %d replayed messages\n", n)
+}
@@ -0,0 +1,124 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+
+	"cloud.google.com/go/pubsub"
+)
+
+const (
+	minRetentionDuration = 10 * time.Minute
+	maxRetentionDuration = 7 * 24 * time.Hour
+)
+
+// retentionRequest holds the optional message retention properties of a subscription create
+// or update request
+type retentionRequest struct {
+	RetainAckedMessages *bool   `json:"retainAckedMessages"`
+	RetentionDuration   *string `json:"retentionDuration"`
+}
+
+// withRetentionProperties adds the schemas of the retentionRequest properties to properties
+func withRetentionProperties(properties map[string]*jsonSchema) map[string]*jsonSchema {
+	properties["retainAckedMessages"] = booleanSchema("whether acknowledged messages are retained")
+	properties["retentionDuration"] = stringSchema(fmt.Sprintf("message retention duration, from %s to %s", minRetentionDuration, maxRetentionDuration))
+	return properties
+}
+
+var updateSubscriptionSchema = objectSchema(withRetentionProperties(map[string]*jsonSchema{}))
+
+// retentionProps are the message retention settings of a subscription create or update request
+type retentionProps struct {
+	retainAckedMessages *bool
+	retentionDuration   time.Duration // zero if not provided
+}
+
+// parse checks the retention properties of a request
+func (req retentionRequest) parse() (retentionProps, error) {
+	rp := retentionProps{retainAckedMessages: req.RetainAckedMessages}
+	if req.RetentionDuration != nil {
+		d, err := time.ParseDuration(*req.RetentionDuration)
+		if err != nil || d < minRetentionDuration || d > maxRetentionDuration {
+			return rp, fmt.Errorf("retentionDuration must be a duration from %s to %s", minRetentionDuration, maxRetentionDuration)
+		}
+		rp.retentionDuration = d
+	}
+	return rp, nil
+}
+
+// apply sets the retention settings on a new subscription's configuration
+func (rp retentionProps) apply(cfg *pubsub.SubscriptionConfig) {
+	if rp.retainAckedMessages != nil {
+		cfg.RetainAckedMessages = *rp.retainAckedMessages
+	}
+	if rp.retentionDuration != 0 {
+		cfg.RetentionDuration = rp.retentionDuration
+	}
+}
+
+// updateSubscriptionHandler handles PATCH to /subscriptions/<subscription-name>, which requires
+// If-Match with the subscription's current ETag
+func updateSubscriptionHandler(ctx context.Context, w http.ResponseWriter, r *http.Request, client *pubsub.Client, subscr *pubsub.Subscription) {
+	dryRun, ok := dryRunRequested(w, r)
+	if !ok {
+		return
+	}
+
+	// get settings to change from body: '{"retainAckedMessages":true, "retentionDuration":"24h"}'
+	var req retentionRequest
+	if !readRequest(w, r, updateSubscriptionSchema, &req) {
+		return
+	}
+	rp, err := req.parse()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if rp.retainAckedMessages == nil && rp.retentionDuration == 0 {
+		http.Error(w, "nothing to update: provide retainAckedMessages and/or retentionDuration", http.StatusBadRequest)
+		return
+	}
+
+	current, err := subscr.Config(ctx)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !checkIfMatch(w, r, configETag(subscriptionDetails(current))) {
+		return
+	}
+
+	if dryRun {
+		after := current
+		if rp.retainAckedMessages != nil {
+			after.RetainAckedMessages = *rp.retainAckedMessages
+		}
+		if rp.retentionDuration != 0 {
+			after.RetentionDuration = rp.retentionDuration
+		}
+		changes := configChanges(subscriptionDetails(current), subscriptionDetails(after))
+		if len(changes) == 0 {
+			changes = []string{"no changes"}
+		}
+		writeDryRun(w, "update subscription "+subscr.String(), changes)
+		return
+	}
+
+	var upd pubsub.SubscriptionConfigToUpdate
+	if rp.retainAckedMessages != nil {
+		upd.RetainAckedMessages = *rp.retainAckedMessages
+	}
+	upd.RetentionDuration = rp.retentionDuration
+	cfg, err := subscr.Update(ctx, upd)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("ETag", configETag(subscriptionDetails(cfg)))
+	noteResourceChange("updated", "subscription", subscr.ID(), "")
+	fmt.Fprintf(w, "updated subscription %s: retainAckedMessages=%t retentionDuration=%s\n",
+		subscr.String(), cfg.RetainAckedMessages, cfg.RetentionDuration)
+}
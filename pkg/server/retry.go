@@ -0,0 +1,163 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"log"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"google.golang.org/api/googleapi"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	grpcstatus "google.golang.org/grpc/status"
+)
+
+const (
+	defaultAdminRetryAttempts = 4
+	defaultAdminRetryBackoff  = 200 * time.Millisecond
+	maxAdminRetryBackoff      = 10 * time.Second
+
+	adminRetriesMetric = "second_admin_retries_total"
+)
+
+// adminRetry configures retryAdmin: ADMIN_RETRY_ATTEMPTS attempts in all, the first retry after
+// about ADMIN_RETRY_BACKOFF, doubling with each further one
+var adminRetry = struct {
+	sync.Mutex
+	attempts int
+	backoff  time.Duration
+}{attempts: defaultAdminRetryAttempts, backoff: defaultAdminRetryBackoff}
+
+// loadAdminRetry reads the retry settings of admin calls
+func loadAdminRetry() {
+	adminRetry.Lock()
+	defer adminRetry.Unlock()
+	adminRetry.attempts, adminRetry.backoff = defaultAdminRetryAttempts, defaultAdminRetryBackoff
+	if s := setting("ADMIN_RETRY_ATTEMPTS"); s != "" {
+		if n, err := strconv.Atoi(s); err != nil || n < 1 {
+			log.Printf("retry: invalid ADMIN_RETRY_ATTEMPTS %q, using %d", s, defaultAdminRetryAttempts)
+		} else {
+			adminRetry.attempts = n
+		}
+	}
+	if s := setting("ADMIN_RETRY_BACKOFF"); s != "" {
+		if d, err := time.ParseDuration(s); err != nil || d <= 0 {
+			log.Printf("retry: invalid ADMIN_RETRY_BACKOFF %q, using %s", s, defaultAdminRetryBackoff)
+		} else {
+			adminRetry.backoff = d
+		}
+	}
+}
+
+// retryAdmin runs a topic or subscription admin call, waiting for the admin quota before each
+// attempt and retrying transient errors with jittered exponential backoff, or after the delay
+// the backend asked for
+func retryAdmin(ctx context.Context, op string, call func() error) error {
+	adminRetry.Lock()
+	attempts, backoff := adminRetry.attempts, adminRetry.backoff
+	adminRetry.Unlock()
+	for attempt := 1; ; attempt++ {
+		if err := waitAdminQuota(ctx, op); err != nil {
+			return err
+		}
+		err := call()
+		if err == nil || attempt >= attempts || !isTransientError(err) {
+			return err
+		}
+		delay, ok := retryDelay(err)
+		if !ok {
+			// jitter over the upper half of the backoff, so that concurrent callers spread out
+			delay = backoff/2 + time.Duration(rand.Int63n(int64(backoff/2)+1))
+		}
+		if backoff *= 2; backoff > maxAdminRetryBackoff {
+			backoff = maxAdminRetryBackoff
+		}
+		counterAdd(adminRetriesMetric, "Admin operations retried after a transient error, by operation.", 1, "op", op)
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(delay):
+		}
+	}
+}
+
+// isTransientError reports whether a backend error is worth retrying; calls timing out aren't,
+// as they may have taken effect
+func isTransientError(err error) bool {
+	if st, ok := grpcStatus(err); ok {
+		switch st.Code() {
+		case codes.Unavailable, codes.ResourceExhausted, codes.Aborted:
+			return true
+		}
+		return false
+	}
+	var gerr *googleapi.Error
+	if errors.As(err, &gerr) {
+		switch gerr.Code {
+		case http.StatusTooManyRequests, http.StatusBadGateway, http.StatusServiceUnavailable:
+			return true
+		}
+	}
+	return false
+}
+
+// retryDelay returns the delay a backend error asked for, from gRPC retry info or a Retry-After header
+func retryDelay(err error) (time.Duration, bool) {
+	if st, ok := grpcStatus(err); ok {
+		for _, d := range st.Details() {
+			if info, ok := d.(*errdetails.RetryInfo); ok && info.RetryDelay != nil {
+				return info.RetryDelay.AsDuration(), true
+			}
+		}
+		return 0, false
+	}
+	var gerr *googleapi.Error
+	if errors.As(err, &gerr) {
+		if secs, err := strconv.Atoi(gerr.Header.Get("Retry-After")); err == nil && secs >= 0 {
+			return time.Duration(secs) * time.Second, true
+		}
+	}
+	return 0, false
+}
+
+// grpcStatus returns the gRPC status of an error, if it has one, also when wrapped
+func grpcStatus(err error) (*grpcstatus.Status, bool) {
+	var se interface{ GRPCStatus() *grpcstatus.Status }
+	if errors.As(err, &se) {
+		return se.GRPCStatus(), true
+	}
+	return nil, false
+}
+
+// writeAdminError responds to a request whose admin call failed: 429 when the admin quota stayed
+// exhausted, 503 with Retry-After when the backend stayed unavailable or the circuit breaker is open,
+// status otherwise
+func writeAdminError(w http.ResponseWriter, err error, status int) {
+	var qerr *adminQuotaError
+	switch {
+	case errors.As(err, &qerr):
+		w.Header().Set("Retry-After", strconv.Itoa(int(qerr.wait/time.Second)+1))
+		status = http.StatusTooManyRequests
+	case isTransientError(err):
+		delay, ok := retryDelay(err)
+		if !ok {
+			adminRetry.Lock()
+			delay = adminRetry.backoff
+			adminRetry.Unlock()
+		}
+		w.Header().Set("Retry-After", strconv.Itoa(int(delay/time.Second)+1))
+		status = http.StatusServiceUnavailable
+	case errors.Is(err, errCircuitOpen):
+		if d := breakerRetryAfter(); d > 0 {
+			w.Header().Set("Retry-After", strconv.Itoa(int(d/time.Second)+1))
+		}
+		status = http.StatusServiceUnavailable
+	case errors.Is(err, context.Canceled), errors.Is(err, context.DeadlineExceeded):
+		status = http.StatusServiceUnavailable
+	}
+	http.Error(w, err.Error(), status)
+}
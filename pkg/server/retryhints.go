@@ -0,0 +1,67 @@
+package server
+
+import (
+	"math/rand"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Responses telling the client to come back later, 429 when the service throttles and 503 when the
+// backend is unavailable, always carry Retry-After, spread by up to half of the wait so that
+// clients throttled together don't retry together. JSON error responses add a "retry" envelope
+// with the same wait and the backoff clients should follow if the retry fails too: exponential
+// from the wait, capped, with full jitter.
+
+const (
+	// defaultRetryAfter is the wait hinted when a 429 or 503 gives none
+	defaultRetryAfter = time.Second
+
+	retryBackoffMultiplier = 2
+	retryBackoffMax        = time.Minute
+)
+
+// retryHint is the "retry" envelope of a 429 or 503 JSON error response
+type retryHint struct {
+	Reason       string       `json:"reason"` // throttled or unavailable
+	AfterSeconds int          `json:"afterSeconds"`
+	Backoff      retryBackoff `json:"backoff"`
+}
+
+// retryBackoff describes the backoff of repeated retries: attempt n waits a random time between 0
+// and min(maxSeconds, initialSeconds * multiplier^n)
+type retryBackoff struct {
+	InitialSeconds int    `json:"initialSeconds"`
+	Multiplier     int    `json:"multiplier"`
+	MaxSeconds     int    `json:"maxSeconds"`
+	Jitter         string `json:"jitter"`
+}
+
+// addRetryHints sets the jittered Retry-After of a 429 or 503 response, from the one the handler
+// set or defaultRetryAfter, returning the hint for its body; nil for other statuses
+func addRetryHints(h http.Header, status int) *retryHint {
+	reason := "unavailable"
+	switch status {
+	case http.StatusTooManyRequests:
+		reason = "throttled"
+	case http.StatusServiceUnavailable:
+	default:
+		return nil
+	}
+	wait, err := strconv.Atoi(h.Get("Retry-After"))
+	if err != nil || wait < 1 {
+		wait = int(defaultRetryAfter / time.Second)
+	}
+	after := wait + rand.Intn(wait/2+1)
+	h.Set("Retry-After", strconv.Itoa(after))
+	return &retryHint{
+		Reason:       reason,
+		AfterSeconds: after,
+		Backoff: retryBackoff{
+			InitialSeconds: wait,
+			Multiplier:     retryBackoffMultiplier,
+			MaxSeconds:     int(retryBackoffMax / time.Second),
+			Jitter:         "full",
+		},
+	}
+}
@@ -0,0 +1,524 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/pubsub"
+)
+
+const (
+	routeMessagesMetric = "second_route_messages_total"
+	routeMessagesHelp   = "Messages consumed by routes, by matching rule."
+)
+
+// routeRule republishes messages whose attribute or JSON payload field matches to a topic;
+// without equals or matches the rule matches whenever the attribute or field is present
+type routeRule struct {
+	Name      string `json:"name"`
+	Attribute string `json:"attribute,omitempty"`
+	JSONPath  string `json:"jsonPath,omitempty"`
+	Equals    string `json:"equals,omitempty"`
+	Matches   string `json:"matches,omitempty"`
+	Topic     string `json:"topic"`
+
+	re      *regexp.Regexp
+	matched int64
+}
+
+// router consumes from a source subscription and republishes each message to the
+// topic of the first matching rule, or to the default topic if no rule matches
+type router struct {
+	name         string
+	subscription string
+	rules        []*routeRule
+	defaultTopic string
+	started      time.Time
+
+	cancel context.CancelFunc
+	done   chan struct{}
+
+	mu        sync.Mutex
+	defaulted int64
+	unrouted  int64
+	failed    int64
+	lastError error
+}
+
+var routers = struct {
+	sync.Mutex
+	m map[string]*router
+}{m: map[string]*router{}}
+
+// listRoutesHandler handles GET to /routes
+func listRoutesHandler(w http.ResponseWriter, r *http.Request) {
+	routers.Lock()
+	list := make([]*router, 0, len(routers.m))
+	for _, rt := range routers.m {
+		list = append(list, rt)
+	}
+	routers.Unlock()
+	sort.Slice(list, func(i, j int) bool { return list[i].name < list[j].name })
+	fmt.Fprintln(w, "Routes\n------")
+	for _, rt := range list {
+		fmt.Fprintln(w, rt.summary())
+	}
+	if len(list) == 0 {
+		fmt.Fprintln(w, "(none)")
+	}
+}
+
+// createRouteHandler handles PUT to /routes
+func createRouteHandler(w http.ResponseWriter, r *http.Request) {
+	// get route details from body:
+	// '{"name":"my-route", "subscription":"my-subscription", "defaultTopic":"other-topic",
+	//   "rules":[{"name":"errors", "attribute":"severity", "equals":"ERROR", "topic":"errors-topic"},
+	//            {"name":"eu", "jsonPath":"$.customer.region", "matches":"^eu-", "topic":"eu-topic"}]}'
+	var req routeSpec
+	if !readRequest(w, r, routeSchema, &req) {
+		return
+	}
+	rt := req.router()
+	if err := rt.validate(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	routers.Lock()
+	if _, ok := routers.m[rt.name]; ok {
+		routers.Unlock()
+		http.Error(w, fmt.Sprintf("route %s already exists", rt.name), http.StatusConflict)
+		return
+	}
+	routers.m[rt.name] = rt
+	routers.Unlock()
+
+	if err := rt.start(); err != nil {
+		routers.Lock()
+		delete(routers.m, rt.name)
+		routers.Unlock()
+		writeLookupError(w, err)
+		return
+	}
+	rt.save()
+	fmt.Fprintf(w, "created route %s\n", rt.name)
+}
+
+// getRouteHandler handles GET to /routes/<route-name>
+func getRouteHandler(w http.ResponseWriter, r *http.Request) {
+	rt, ok := lookupRoute(w, r)
+	if !ok {
+		return
+	}
+	fmt.Fprintln(w, rt.summary())
+	rt.writeRules(w)
+}
+
+// deleteRouteHandler handles DELETE to /routes/<route-name>
+func deleteRouteHandler(w http.ResponseWriter, r *http.Request) {
+	rt, ok := lookupRoute(w, r)
+	if !ok {
+		return
+	}
+	rt.stop()
+	routers.Lock()
+	delete(routers.m, rt.name)
+	routers.Unlock()
+	stateDelete(routesBucket, rt.name)
+	fmt.Fprintf(w, "stopped route %s\n", rt.name)
+	rt.writeRules(w)
+}
+
+// routeSpec is the definition of a route, as given to PUT /routes and kept in the state store
+type routeSpec struct {
+	Name         string       `json:"name"`
+	Subscription string       `json:"subscription"`
+	DefaultTopic string       `json:"defaultTopic"`
+	Rules        []*routeRule `json:"rules"`
+}
+
+var routeSchema = objectSchema(map[string]*jsonSchema{
+	"name":         stringSchema("route name"),
+	"subscription": stringSchema("subscription the route consumes from"),
+	"defaultTopic": stringSchema("topic of the messages no rule matches (without it, they're acked and counted as unrouted)"),
+	"rules": {Type: "array", Description: "rules, the first matching one routing a message", Items: objectSchema(map[string]*jsonSchema{
+		"name":      stringSchema("rule name (default rule-<index>)"),
+		"attribute": stringSchema("attribute matched"),
+		"jsonPath":  stringSchema("field of the JSON payload matched, like $.customer.region"),
+		"equals":    stringSchema("value the attribute or field must equal"),
+		"matches":   stringSchema("regular expression the attribute or field must match"),
+		"topic":     stringSchema("topic the matching messages are republished to"),
+	}, "topic")},
+}, "name", "subscription")
+
+func (spec routeSpec) router() *router {
+	return &router{
+		name:         spec.Name,
+		subscription: spec.Subscription,
+		rules:        spec.Rules,
+		defaultTopic: spec.DefaultTopic,
+	}
+}
+
+// save keeps the route's definition in the state store, so it's restarted with the service
+func (rt *router) save() {
+	statePut(routesBucket, rt.name, routeSpec{Name: rt.name, Subscription: rt.subscription, DefaultTopic: rt.defaultTopic, Rules: rt.rules})
+}
+
+// restoreRoutes restarts the routes kept in the state store; routes that fail to start are
+// logged and kept, to be retried on the next start
+func restoreRoutes() {
+	var list []*router
+	stateLoad(routesBucket, func(key string, data []byte) error {
+		var spec routeSpec
+		if err := json.Unmarshal(data, &spec); err != nil {
+			return err
+		}
+		rt := spec.router()
+		if err := rt.validate(); err != nil {
+			return err
+		}
+		list = append(list, rt)
+		return nil
+	})
+	for _, rt := range list {
+		routers.Lock()
+		routers.m[rt.name] = rt
+		routers.Unlock()
+		if err := rt.start(); err != nil {
+			log.Printf("route %s: %v (not restored)", rt.name, err)
+			routers.Lock()
+			delete(routers.m, rt.name)
+			routers.Unlock()
+		}
+	}
+	if len(list) > 0 {
+		log.Printf("Restored %d routes from %s", len(list), stateStore.path)
+	}
+}
+
+// lookupRoute returns the route named in the path, responding 404 if there's none
+func lookupRoute(w http.ResponseWriter, r *http.Request) (*router, bool) {
+	name := pathParam(r, "name")
+	routers.Lock()
+	rt, ok := routers.m[name]
+	routers.Unlock()
+	if !ok {
+		http.Error(w, fmt.Sprintf("route %s not found", name), http.StatusNotFound)
+	}
+	return rt, ok
+}
+
+// validate checks the route definition and compiles the rules' regular expressions
+func (rt *router) validate() error {
+	if rt.name == "" {
+		return fmt.Errorf("name must not be empty")
+	}
+	if rt.subscription == "" {
+		return fmt.Errorf("subscription must not be empty")
+	}
+	if err := validateResourceName("subscription", rt.subscription); err != nil {
+		return err
+	}
+	if rt.defaultTopic != "" {
+		if err := validateResourceName("topic", rt.defaultTopic); err != nil {
+			return fmt.Errorf("defaultTopic: %v", err)
+		}
+	}
+	if len(rt.rules) == 0 && rt.defaultTopic == "" {
+		return fmt.Errorf("at least one rule or a defaultTopic must be provided")
+	}
+	for i, rule := range rt.rules {
+		if rule.Name == "" {
+			rule.Name = fmt.Sprintf("rule-%d", i)
+		}
+		if (rule.Attribute == "") == (rule.JSONPath == "") {
+			return fmt.Errorf("rule %s: exactly one of attribute and jsonPath must be provided", rule.Name)
+		}
+		if rule.Topic == "" {
+			return fmt.Errorf("rule %s: topic must not be empty", rule.Name)
+		}
+		if err := validateResourceName("topic", rule.Topic); err != nil {
+			return fmt.Errorf("rule %s: %v", rule.Name, err)
+		}
+		if rule.Equals != "" && rule.Matches != "" {
+			return fmt.Errorf("rule %s: only one of equals and matches may be provided", rule.Name)
+		}
+		if rule.Matches != "" {
+			re, err := regexp.Compile(rule.Matches)
+			if err != nil {
+				return fmt.Errorf("rule %s: %v", rule.Name, err)
+			}
+			rule.re = re
+		}
+	}
+	return nil
+}
+
+// start checks the source subscription and target topics exist and launches the background consumer
+func (rt *router) start() error {
+	projectID := setting("GOOGLE_CLOUD_PROJECT")
+	if projectID == "" {
+		return fmt.Errorf("failed to get project ID")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	client, err := pubsub.NewClient(ctx, projectID, backendOptions()...)
+	if err != nil {
+		cancel()
+		return err
+	}
+	fail := func(err error) error {
+		cancel()
+		client.Close()
+		return err
+	}
+	subscr := client.Subscription(rt.subscription)
+	if err := checkExists(ctx, "subscription", rt.subscription, subscr.Exists); err != nil {
+		return fail(err)
+	}
+	// the messages being republished are held in memory: beyond the limits the pull pauses
+	limits := loadBufferLimits(routeBuffer)
+	limits.applyTo(subscr)
+
+	// one publisher per target topic, shared by the rules routing to it
+	topics := map[string]*pubsub.Topic{}
+	targets := []string{rt.defaultTopic}
+	for _, rule := range rt.rules {
+		targets = append(targets, rule.Topic)
+	}
+	for _, name := range targets {
+		if _, ok := topics[name]; ok || name == "" {
+			continue
+		}
+		topic := client.Topic(name)
+		if err := checkExists(ctx, "topic", name, topic.Exists); err != nil {
+			return fail(err)
+		}
+		// ordering keys are passed through, which requires ordering to be enabled
+		topic.EnableMessageOrdering = true
+		if limits.bytes > 0 {
+			topic.PublishSettings.BufferedByteLimit = limits.bytes
+		}
+		topics[name] = topic
+	}
+
+	rt.started = time.Now()
+	rt.cancel = cancel
+	rt.done = make(chan struct{})
+	go rt.run(ctx, client, subscr, topics, limits)
+	return nil
+}
+
+// run routes messages until the route is stopped; a message not republished within the age limit
+// is nacked for redelivery
+func (rt *router) run(ctx context.Context, client *pubsub.Client, subscr *pubsub.Subscription, topics map[string]*pubsub.Topic,
+	limits bufferLimits) {
+	defer close(rt.done)
+	defer client.Close()
+	defer func() {
+		for _, topic := range topics {
+			topic.Stop()
+		}
+	}()
+
+	err := subscr.Receive(ctx, func(ctx context.Context, msg *pubsub.Message) {
+		recordReceived(rt.subscription, 1)
+		rule := rt.match(msg)
+		ruleName, target := "default", rt.defaultTopic
+		if rule != nil {
+			ruleName, target = rule.Name, rule.Topic
+		}
+		if target == "" {
+			// nothing matched and there is no default route
+			rt.mu.Lock()
+			rt.unrouted++
+			rt.mu.Unlock()
+			counterAdd(routeMessagesMetric, routeMessagesHelp, 1, "route", rt.name, "rule", "unrouted")
+			msg.Ack()
+			return
+		}
+
+		pctx, cancel := ctx, func() {}
+		if limits.age > 0 {
+			pctx, cancel = context.WithTimeout(ctx, limits.age)
+		}
+		defer cancel()
+		err := chaosFault()
+		if err == nil {
+			_, err = topics[target].Publish(pctx, &pubsub.Message{
+				Data:        msg.Data,
+				Attributes:  msg.Attributes,
+				OrderingKey: msg.OrderingKey,
+			}).Get(pctx)
+		}
+		if err != nil && pctx.Err() != nil && ctx.Err() == nil {
+			recordBufferDrops(routeBuffer, "age", 1)
+		}
+		rt.mu.Lock()
+		defer rt.mu.Unlock()
+		if err != nil {
+			if msg.OrderingKey != "" {
+				topics[target].ResumePublish(msg.OrderingKey)
+			}
+			rt.failed++
+			rt.lastError = err
+			counterAdd(routeMessagesMetric, routeMessagesHelp, 1, "route", rt.name, "rule", "failed")
+			msg.Nack()
+			return
+		}
+		if rule != nil {
+			rule.matched++
+		} else {
+			rt.defaulted++
+		}
+		counterAdd(routeMessagesMetric, routeMessagesHelp, 1, "route", rt.name, "rule", ruleName)
+		msg.Ack()
+	})
+	if err != nil {
+		log.Printf("route %s: receive: %v", rt.name, err)
+		rt.mu.Lock()
+		rt.lastError = err
+		rt.mu.Unlock()
+	}
+}
+
+// match returns the first rule matching msg, or nil if none does
+func (rt *router) match(msg *pubsub.Message) *routeRule {
+	var payload interface{}
+	parsed := false
+	for _, rule := range rt.rules {
+		var value string
+		var ok bool
+		if rule.Attribute != "" {
+			value, ok = msg.Attributes[rule.Attribute]
+		} else {
+			if !parsed {
+				parsed = true
+				if err := json.Unmarshal(msg.Data, &payload); err != nil {
+					payload = nil
+				}
+			}
+			value, ok = jsonPathLookup(payload, rule.JSONPath)
+		}
+		if !ok {
+			continue
+		}
+		if rule.Equals != "" && value != rule.Equals {
+			continue
+		}
+		if rule.re != nil && !rule.re.MatchString(value) {
+			continue
+		}
+		return rule
+	}
+	return nil
+}
+
+// jsonPathLookup evaluates a simple JSON path like "$.order.items[0].sku" against a decoded
+// JSON document, returning the value found as a string (JSON encoded unless it is a scalar)
+func jsonPathLookup(doc interface{}, path string) (string, bool) {
+	path = strings.TrimPrefix(strings.TrimPrefix(path, "$"), ".")
+	v := doc
+	for _, part := range strings.Split(path, ".") {
+		if part == "" {
+			continue
+		}
+		// split "items[0][1]" into the field name and its indexes
+		field, indexes := part, ""
+		if i := strings.Index(part, "["); i >= 0 {
+			field, indexes = part[:i], part[i:]
+		}
+		if field != "" {
+			m, ok := v.(map[string]interface{})
+			if !ok {
+				return "", false
+			}
+			if v, ok = m[field]; !ok {
+				return "", false
+			}
+		}
+		for indexes != "" {
+			end := strings.Index(indexes, "]")
+			if indexes[0] != '[' || end < 0 {
+				return "", false
+			}
+			n, err := strconv.Atoi(indexes[1:end])
+			a, ok := v.([]interface{})
+			if err != nil || !ok || n < 0 || n >= len(a) {
+				return "", false
+			}
+			v, indexes = a[n], indexes[end+1:]
+		}
+	}
+
+	switch x := v.(type) {
+	case nil:
+		return "", false
+	case string:
+		return x, true
+	case float64:
+		return strconv.FormatFloat(x, 'f', -1, 64), true
+	case bool:
+		return strconv.FormatBool(x), true
+	default:
+		b, _ := json.Marshal(x)
+		return string(b), true
+	}
+}
+
+// stop cancels the consumer and waits for it to finish
+func (rt *router) stop() {
+	rt.cancel()
+	<-rt.done
+}
+
+// summary returns a one-line description of the route
+func (rt *router) summary() string {
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+	s := fmt.Sprintf("%s: subscription=%s rules=%d defaultTopic=%s since=%s",
+		rt.name, rt.subscription, len(rt.rules), rt.defaultTopic, rt.started.Format(time.RFC3339))
+	if rt.lastError != nil {
+		s += fmt.Sprintf(" lastError=%q", rt.lastError.Error())
+	}
+	return s
+}
+
+// writeRules lists the route's rules with their counters
+func (rt *router) writeRules(w io.Writer) {
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+	fmt.Fprintln(w, "Rules\n-----")
+	for i, rule := range rt.rules {
+		cond := "present"
+		if rule.Equals != "" {
+			cond = fmt.Sprintf("== %q", rule.Equals)
+		} else if rule.Matches != "" {
+			cond = fmt.Sprintf("=~ %q", rule.Matches)
+		}
+		field := "attributes." + rule.Attribute
+		if rule.JSONPath != "" {
+			field = "payload " + rule.JSONPath
+		}
+		fmt.Fprintf(w, "[%d] %s: %s %s -> %s (%d messages)\n", i, rule.Name, field, cond, rule.Topic, rule.matched)
+	}
+	if rt.defaultTopic != "" {
+		fmt.Fprintf(w, "default -> %s (%d messages)\n", rt.defaultTopic, rt.defaulted)
+	} else {
+		fmt.Fprintf(w, "unrouted (acked and dropped): %d messages\n", rt.unrouted)
+	}
+	if rt.failed > 0 {
+		fmt.Fprintf(w, "failed to republish (nacked): %d messages\n", rt.failed)
+	}
+}
@@ -0,0 +1,192 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+// apiRoute is a registered method and path pattern; pattern segments like "{name}"
+// match any single non-empty path element
+type apiRoute struct {
+	method   string
+	pattern  string
+	segments []string
+	handler  http.HandlerFunc
+}
+
+// apiMux dispatches requests by method and path pattern, responding 404 to paths
+// matching no pattern (including nested paths like /topics/a/b, empty elements like
+// /topics//b and trailing slashes, which REDIRECT_TRAILING_SLASH=true redirects instead)
+// and 405 with an Allow header to methods a matching pattern doesn't support. Path
+// elements are matched unescaped, so names with characters like % and + can be
+// requested escaped (e.g. /topics/100%25-done), but not names containing /.
+type apiMux struct {
+	routes []apiRoute
+}
+
+// pathParamsKey is the request context key of the path parameters matched by apiMux
+type pathParamsKey struct{}
+
+// handle registers a handler for a method and path pattern, e.g. ("GET", "/topics/{name}")
+func (m *apiMux) handle(method, pattern string, h http.HandlerFunc) {
+	m.routes = append(m.routes, apiRoute{method: method, pattern: pattern, segments: splitPath(pattern), handler: h})
+}
+
+func (m *apiMux) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	segments, err := splitEscapedPath(r.URL.EscapedPath())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	for i, seg := range segments {
+		if seg == "" && i == len(segments)-1 {
+			m.trailingSlash(w, r, segments[:i])
+			return
+		}
+		if seg == "" || strings.Contains(seg, "/") {
+			http.Error(w, fmt.Sprintf("%s is not a valid path: path elements must not be empty or contain /", r.URL.EscapedPath()), http.StatusNotFound)
+			return
+		}
+	}
+	var allowed []string
+	for _, route := range m.routes {
+		params, ok := route.match(segments)
+		if !ok {
+			continue
+		}
+		if route.method != r.Method && !(route.method == http.MethodGet && r.Method == http.MethodHead) {
+			allowed = append(allowed, route.method)
+			continue
+		}
+		if len(params) > 0 {
+			r = r.WithContext(context.WithValue(r.Context(), pathParamsKey{}, params))
+		}
+		// requests are measured per route, for the latency histograms and SLOs
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		start := time.Now()
+		// responses are rendered in the type negotiated through Accept (see negotiate.go)
+		if nw, ok := negotiateResponse(route, rec, r); ok {
+			if checkContentType(route, nw, r) && checkDryRun(route, nw, r) {
+				// X-Request-Deadline and Request-Timeout bound the request's context (see deadline.go)
+				dr, cancel, ok := applyRequestDeadline(nw, r)
+				if ok {
+					// workshop tokens and tenants are confined to their resources (see tokens.go and tenancy.go)
+					if ar, ok := applyAccessToken(route, params, nw, dr); ok {
+						if tw, tr, ok := applyTenancy(route, params, nw, ar); ok {
+							tr = tr.WithContext(context.WithValue(tr.Context(), usageAccountKey{}, usageAccount(tr)))
+							route.handler(tw, tr)
+							if usageAdminRoutes[route.method+" "+route.pattern] {
+								recordUsage(tr, usageCounters{AdminCalls: 1})
+							}
+						}
+					}
+				}
+				cancel()
+			}
+			nw.finish()
+		}
+		observeRequest(route.method+" "+route.pattern, rec.status, time.Since(start))
+		if rec.status >= 500 {
+			body := bytes.TrimSpace(rec.errorBody)
+			recordRecentError(route.method+" "+route.pattern, rec.status, string(body))
+			noteServerError(r, route.method+" "+route.pattern, rec.status, body)
+		}
+		return
+	}
+	if len(allowed) == 0 {
+		for _, route := range m.routes {
+			// e.g. /topics/a/b for /topics/{name}: names can't contain a slash
+			n := len(route.segments)
+			if n == 0 || n >= len(segments) || !strings.HasPrefix(route.segments[n-1], "{") {
+				continue
+			}
+			if _, ok := route.match(segments[:n]); ok {
+				http.Error(w, fmt.Sprintf("%s is not a valid path: no route matches it and names can't contain / (for %s)",
+					r.URL.EscapedPath(), route.pattern), http.StatusNotFound)
+				return
+			}
+		}
+		http.NotFound(w, r)
+		return
+	}
+	sort.Strings(allowed)
+	w.Header().Set("Allow", strings.Join(allowed, ", "))
+	http.Error(w, fmt.Sprintf("method %s not allowed", r.Method), http.StatusMethodNotAllowed)
+}
+
+// trailingSlash responds to a path ending in a slash: with REDIRECT_TRAILING_SLASH=true a
+// path matching a route without the slash is redirected there (308, keeping the method)
+func (m *apiMux) trailingSlash(w http.ResponseWriter, r *http.Request, segments []string) {
+	path := strings.TrimSuffix(r.URL.EscapedPath(), "/")
+	if setting("REDIRECT_TRAILING_SLASH") == "true" {
+		for _, route := range m.routes {
+			if _, ok := route.match(segments); ok {
+				if r.URL.RawQuery != "" {
+					path += "?" + r.URL.RawQuery
+				}
+				http.Redirect(w, r, path, http.StatusPermanentRedirect)
+				return
+			}
+		}
+	}
+	http.Error(w, fmt.Sprintf("%s is not a valid path: remove the trailing slash (%s)", r.URL.EscapedPath(), path), http.StatusNotFound)
+}
+
+// match reports whether the path segments match the route's pattern, returning the path parameters
+func (route apiRoute) match(segments []string) (map[string]string, bool) {
+	if len(segments) != len(route.segments) {
+		return nil, false
+	}
+	var params map[string]string
+	for i, seg := range route.segments {
+		if strings.HasPrefix(seg, "{") && strings.HasSuffix(seg, "}") {
+			if segments[i] == "" {
+				return nil, false
+			}
+			if params == nil {
+				params = map[string]string{}
+			}
+			params[seg[1:len(seg)-1]] = segments[i]
+			continue
+		}
+		if seg != segments[i] {
+			return nil, false
+		}
+	}
+	return params, true
+}
+
+// splitPath splits a URL path into its elements; "/" has none
+func splitPath(path string) []string {
+	path = strings.TrimPrefix(path, "/")
+	if path == "" {
+		return nil
+	}
+	return strings.Split(path, "/")
+}
+
+// splitEscapedPath splits an escaped URL path into its unescaped elements, so that an escaped
+// slash stays within its element
+func splitEscapedPath(path string) ([]string, error) {
+	segments := splitPath(path)
+	for i, seg := range segments {
+		s, err := url.PathUnescape(seg)
+		if err != nil {
+			return nil, fmt.Errorf("invalid path: %v", err)
+		}
+		segments[i] = s
+	}
+	return segments, nil
+}
+
+// pathParam returns a parameter matched from the request path, e.g. "name" for "/topics/{name}"
+func pathParam(r *http.Request, name string) string {
+	params, _ := r.Context().Value(pathParamsKey{}).(map[string]string)
+	return params[name]
+}
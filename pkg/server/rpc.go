@@ -0,0 +1,244 @@
+package server
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/pubsub"
+)
+
+const (
+	rpcCorrelationIDAttr = "correlationId"
+	rpcReplyTopicAttr    = "replyTopic"
+
+	defaultRPCTimeout = 10 * time.Second
+	maxRPCTimeout     = 5 * time.Minute
+)
+
+// instanceID identifies this process, so that reply subscriptions of several
+// instances of the service don't steal each others' replies
+var instanceID = randomID()
+
+// rpcReplyListener receives replies from a reply topic via a subscription owned by
+// this instance, handing each one to the request waiting for its correlation ID
+type rpcReplyListener struct {
+	subscription string
+
+	mu      sync.Mutex
+	waiting map[string]chan *pubsub.Message
+}
+
+var rpcListeners = struct {
+	sync.Mutex
+	m map[string]*rpcReplyListener
+}{m: map[string]*rpcReplyListener{}}
+
+// rpcRequest is the body of POST /rpc/<topic-name>
+type rpcRequest struct {
+	Data       string            `json:"data"`
+	Attributes map[string]string `json:"attributes"`
+	ReplyTopic string            `json:"replyTopic"`
+	Timeout    string            `json:"timeout"`
+}
+
+var rpcSchema = objectSchema(map[string]*jsonSchema{
+	"data":       stringSchema("request message text"),
+	"attributes": stringMapSchema("request message attributes"),
+	"replyTopic": stringSchema("topic the reply is published to (default <topic-name>-replies)"),
+	"timeout":    stringSchema(fmt.Sprintf("how long to wait for the reply, up to %s", maxRPCTimeout)),
+}, "data")
+
+// rpcHandler handles POST to /rpc/<topic-name>
+func rpcHandler(w http.ResponseWriter, r *http.Request) {
+	projectID := setting("GOOGLE_CLOUD_PROJECT")
+	if projectID == "" {
+		http.Error(w, "failed to get project ID", http.StatusServiceUnavailable)
+		return
+	}
+
+	ctx := context.Background()
+	client, err := pubsub.NewClient(ctx, projectID, backendOptions()...)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	topicName := pathParam(r, "name")
+	if err := validateResourceName("topic", topicName); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// get request details from body:
+	// '{"data":"request text", "attributes":{"k":"v"}, "replyTopic":"my-replies", "timeout":"10s"}'
+	req := rpcRequest{ReplyTopic: topicName + "-replies"}
+	if !readRequest(w, r, rpcSchema, &req) {
+		return
+	}
+	data, replyTopicName := req.Data, req.ReplyTopic
+	if err := validateResourceName("topic", replyTopicName); err != nil {
+		http.Error(w, "replyTopic: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	attrs := req.Attributes
+	if attrs == nil {
+		attrs = map[string]string{}
+	}
+	timeout := defaultRPCTimeout
+	if req.Timeout != "" {
+		d, err := time.ParseDuration(req.Timeout)
+		if err != nil || d <= 0 || d > maxRPCTimeout {
+			http.Error(w, fmt.Sprintf("timeout property must be a positive duration up to %s", maxRPCTimeout), http.StatusBadRequest)
+			return
+		}
+		timeout = d
+	}
+	if err := authorizePublish(r, topicName, []map[string]string{attrs}); err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+
+	topic := client.Topic(topicName)
+	if err := checkExists(ctx, "topic", topicName, topic.Exists); err != nil {
+		writeLookupError(w, err)
+		return
+	}
+	defer topic.Stop()
+
+	listener, err := rpcListener(ctx, client, replyTopicName)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// register before publishing so that a fast reply can't be missed
+	correlationID := randomID()
+	reply := listener.expect(correlationID)
+	defer listener.forget(correlationID)
+
+	attrs[rpcCorrelationIDAttr] = correlationID
+	attrs[rpcReplyTopicAttr] = replyTopicName
+	start := time.Now()
+	id, err := topic.Publish(ctx, &pubsub.Message{
+		Data:       []byte(data),
+		Attributes: attrs,
+	}).Get(ctx)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	select {
+	case msg := <-reply:
+		msg = redactMessage(msg)
+		fmt.Fprintf(w, "request message ID %s, correlation ID %s\n", id, correlationID)
+		fmt.Fprintf(w, "reply message ID %s received after %s\n", msg.ID, time.Since(start).Round(time.Millisecond))
+		fmt.Fprintf(w, "Data: \"%s\"\n", string(msg.Data))
+		if len(msg.Attributes) > 0 {
+			fmt.Fprintln(w, "Attributes:")
+			for key, value := range msg.Attributes {
+				fmt.Fprintf(w, "    %s = %s\n", key, value)
+			}
+		}
+	case <-time.After(timeout):
+		http.Error(w, fmt.Sprintf("no reply for correlation ID %s on topic %s within %s", correlationID, replyTopicName, timeout),
+			http.StatusGatewayTimeout)
+	case <-r.Context().Done():
+	}
+}
+
+// rpcListener returns the reply listener for a reply topic, creating (or reusing) this
+// instance's reply subscription and starting to receive from it on first use
+func rpcListener(ctx context.Context, client *pubsub.Client, replyTopicName string) (*rpcReplyListener, error) {
+	rpcListeners.Lock()
+	defer rpcListeners.Unlock()
+	if l, ok := rpcListeners.m[replyTopicName]; ok {
+		return l, nil
+	}
+
+	replyTopic := client.Topic(replyTopicName)
+	if err := checkExists(ctx, "reply topic", replyTopicName, replyTopic.Exists); err != nil {
+		return nil, err
+	}
+
+	// the subscription expires a day after this instance stops receiving from it
+	subscrName := fmt.Sprintf("rpc-%s-%s", replyTopicName, instanceID)
+	subscr := client.Subscription(subscrName)
+	exists, err := subscr.Exists(ctx)
+	if err != nil {
+		return nil, &lookupError{kind: "subscription", name: subscrName, err: err}
+	}
+	if !exists {
+		subscr, err = client.CreateSubscription(ctx, subscrName, pubsub.SubscriptionConfig{
+			Topic:             replyTopic,
+			AckDeadline:       10 * time.Second,
+			RetentionDuration: 10 * time.Minute,
+			ExpirationPolicy:  24 * time.Hour,
+			Labels:            demoLabels(),
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	l := &rpcReplyListener{
+		subscription: subscrName,
+		waiting:      map[string]chan *pubsub.Message{},
+	}
+	go func() {
+		err := subscr.Receive(context.Background(), func(_ context.Context, msg *pubsub.Message) {
+			// replies nobody waits for (any more) are dropped
+			msg.Ack()
+			l.deliver(msg)
+		})
+		log.Printf("rpc reply subscription %s: receive stopped: %v", subscrName, err)
+		rpcListeners.Lock()
+		delete(rpcListeners.m, replyTopicName)
+		rpcListeners.Unlock()
+	}()
+	rpcListeners.m[replyTopicName] = l
+	return l, nil
+}
+
+// expect registers interest in the reply with the given correlation ID
+func (l *rpcReplyListener) expect(correlationID string) <-chan *pubsub.Message {
+	ch := make(chan *pubsub.Message, 1)
+	l.mu.Lock()
+	l.waiting[correlationID] = ch
+	l.mu.Unlock()
+	return ch
+}
+
+// forget removes interest in the reply with the given correlation ID
+func (l *rpcReplyListener) forget(correlationID string) {
+	l.mu.Lock()
+	delete(l.waiting, correlationID)
+	l.mu.Unlock()
+}
+
+// deliver hands a reply to the request waiting for it, if any
+func (l *rpcReplyListener) deliver(msg *pubsub.Message) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	ch, ok := l.waiting[msg.Attributes[rpcCorrelationIDAttr]]
+	if !ok {
+		return
+	}
+	delete(l.waiting, msg.Attributes[rpcCorrelationIDAttr])
+	ch <- msg
+}
+
+// randomID returns a random 128 bit hex string
+func randomID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,327 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"text/template"
+	"time"
+
+	"cloud.google.com/go/pubsub"
+	"github.com/robfig/cron/v3"
+)
+
+// schedule is a recurring publish of a templated payload to a topic
+type schedule struct {
+	Name       string            `json:"name"`
+	Topic      string            `json:"topic"`
+	Schedule   string            `json:"schedule"`
+	Payload    string            `json:"payload"`
+	Attributes map[string]string `json:"attributes,omitempty"`
+	Paused     bool              `json:"paused"`
+
+	Runs          int       `json:"runs"`
+	LastRun       time.Time `json:"lastRun,omitempty"`
+	LastMessageID string    `json:"lastMessageId,omitempty"`
+	LastError     string    `json:"lastError,omitempty"`
+
+	tmpl  *template.Template
+	entry cron.EntryID
+}
+
+var createScheduleSchema = objectSchema(map[string]*jsonSchema{
+	"name":       stringSchema("schedule name"),
+	"topic":      stringSchema("topic the schedule publishes to"),
+	"schedule":   stringSchema("cron expression like \"*/5 * * * *\", or \"@every 30s\""),
+	"payload":    stringSchema("message data, a template like \"tick {{.Seq}} at {{.Time}}\""),
+	"attributes": stringMapSchema("message attributes"),
+	"paused":     booleanSchema("create the schedule paused"),
+}, "name", "topic", "schedule")
+
+// scheduleTemplateData is available to payload templates, e.g. '{"seq":{{.Seq}}, "time":"{{.Time}}"}'
+type scheduleTemplateData struct {
+	Name  string
+	Topic string
+	Time  string
+	Seq   int
+}
+
+// scheduler runs schedules in the background and persists them to a file,
+// so they survive restarts of the service
+var scheduler = struct {
+	sync.Mutex
+	cron      *cron.Cron
+	path      string
+	schedules map[string]*schedule
+}{schedules: map[string]*schedule{}}
+
+// startScheduler loads persisted schedules and starts running them
+func startScheduler() {
+	scheduler.Lock()
+	defer scheduler.Unlock()
+
+	scheduler.cron = cron.New()
+	scheduler.path = setting("SCHEDULES_FILE")
+	if scheduler.path == "" {
+		scheduler.path = filepath.Join(os.TempDir(), "second-schedules.json")
+	}
+
+	data, err := os.ReadFile(scheduler.path)
+	if err != nil && !os.IsNotExist(err) {
+		log.Printf("schedules: %v", err)
+	}
+	if len(data) > 0 {
+		var list []*schedule
+		if err := json.Unmarshal(data, &list); err != nil {
+			log.Printf("schedules: %s: %v", scheduler.path, err)
+		}
+		for _, s := range list {
+			if err := s.compile(); err != nil {
+				log.Printf("schedules: %s: %v", s.Name, err)
+				continue
+			}
+			scheduler.schedules[s.Name] = s
+			if !s.Paused {
+				s.entry = scheduler.cron.Schedule(s.cronSchedule(), s)
+			}
+		}
+		log.Printf("Loaded %d schedules from %s", len(scheduler.schedules), scheduler.path)
+	}
+	scheduler.cron.Start()
+}
+
+// listSchedulesHandler handles GET to /schedules
+func listSchedulesHandler(w http.ResponseWriter, r *http.Request) {
+	scheduler.Lock()
+	defer scheduler.Unlock()
+	list := sortedSchedulesLocked()
+	fmt.Fprintln(w, "Schedules\n---------")
+	for _, s := range list {
+		fmt.Fprintln(w, s.summaryLocked())
+	}
+	if len(list) == 0 {
+		fmt.Fprintln(w, "(none)")
+	}
+	if !isLeader() {
+		fmt.Fprintln(w, "(this instance isn't the leader: schedules run on the leading replica)")
+	}
+}
+
+// createScheduleHandler handles PUT to /schedules
+func createScheduleHandler(w http.ResponseWriter, r *http.Request) {
+	// get schedule details from body:
+	// '{"name":"heartbeat", "topic":"my-topic", "schedule":"@every 30s", "payload":"tick {{.Seq}} at {{.Time}}",
+	//   "attributes":{"source":"scheduler"}}'
+	s := &schedule{}
+	if !readRequest(w, r, createScheduleSchema, s) {
+		return
+	}
+	if s.Name == "" || s.Topic == "" {
+		http.Error(w, "name and topic must not be empty", http.StatusBadRequest)
+		return
+	}
+	if err := validateResourceName("topic", s.Topic); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := s.compile(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	// the scheduler publishes on behalf of the schedule's creator
+	if err := authorizePublish(r, s.Topic, []map[string]string{s.Attributes}); err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+
+	scheduler.Lock()
+	defer scheduler.Unlock()
+	if _, ok := scheduler.schedules[s.Name]; ok {
+		http.Error(w, fmt.Sprintf("schedule %s already exists", s.Name), http.StatusConflict)
+		return
+	}
+	scheduler.schedules[s.Name] = s
+	if !s.Paused {
+		s.entry = scheduler.cron.Schedule(s.cronSchedule(), s)
+	}
+	if err := saveSchedulesLocked(); err != nil {
+		log.Printf("schedules: %v", err)
+	}
+	fmt.Fprintf(w, "created schedule %s\n", s.summaryLocked())
+}
+
+// getScheduleHandler handles GET to /schedules/<schedule-name>
+func getScheduleHandler(w http.ResponseWriter, r *http.Request) {
+	scheduler.Lock()
+	defer scheduler.Unlock()
+	s, ok := lookupScheduleLocked(w, r)
+	if !ok {
+		return
+	}
+	fmt.Fprintln(w, s.summaryLocked())
+	if !s.Paused {
+		fmt.Fprintf(w, "next run at %s\n", scheduler.cron.Entry(s.entry).Next.Format(time.RFC3339))
+	}
+}
+
+// deleteScheduleHandler handles DELETE to /schedules/<schedule-name>
+func deleteScheduleHandler(w http.ResponseWriter, r *http.Request) {
+	scheduler.Lock()
+	defer scheduler.Unlock()
+	s, ok := lookupScheduleLocked(w, r)
+	if !ok {
+		return
+	}
+	scheduler.cron.Remove(s.entry)
+	delete(scheduler.schedules, s.Name)
+	if err := saveSchedulesLocked(); err != nil {
+		log.Printf("schedules: %v", err)
+	}
+	fmt.Fprintf(w, "deleted schedule %s\n", s.Name)
+}
+
+// pauseScheduleHandler returns the handler for POST to /schedules/<schedule-name>/pause
+// (pause true) or /schedules/<schedule-name>/resume (pause false)
+func pauseScheduleHandler(pause bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		scheduler.Lock()
+		defer scheduler.Unlock()
+		s, ok := lookupScheduleLocked(w, r)
+		if !ok {
+			return
+		}
+		if s.Paused != pause {
+			s.Paused = pause
+			if pause {
+				scheduler.cron.Remove(s.entry)
+			} else {
+				s.entry = scheduler.cron.Schedule(s.cronSchedule(), s)
+			}
+			if err := saveSchedulesLocked(); err != nil {
+				log.Printf("schedules: %v", err)
+			}
+		}
+		fmt.Fprintln(w, s.summaryLocked())
+	}
+}
+
+// lookupScheduleLocked returns the schedule named in the path, responding 404 if there's none
+func lookupScheduleLocked(w http.ResponseWriter, r *http.Request) (*schedule, bool) {
+	name := pathParam(r, "name")
+	s, ok := scheduler.schedules[name]
+	if !ok {
+		http.Error(w, fmt.Sprintf("schedule %s not found", name), http.StatusNotFound)
+	}
+	return s, ok
+}
+
+// compile parses the schedule expression and the payload template
+func (s *schedule) compile() error {
+	if _, err := scheduleParser.Parse(s.Schedule); err != nil {
+		return fmt.Errorf("invalid schedule %q: %v", s.Schedule, err)
+	}
+	tmpl, err := template.New(s.Name).Option("missingkey=error").Parse(s.Payload)
+	if err != nil {
+		return fmt.Errorf("invalid payload template: %v", err)
+	}
+	s.tmpl = tmpl
+	return nil
+}
+
+// scheduleParser accepts standard 5-field cron expressions and descriptors like "@hourly" or "@every 30s"
+var scheduleParser = cron.NewParser(cron.Minute | cron.Hour | cron.Dom | cron.Month | cron.Dow | cron.Descriptor)
+
+// cronSchedule returns the parsed schedule expression, which compile has already validated
+func (s *schedule) cronSchedule() cron.Schedule {
+	cs, _ := scheduleParser.Parse(s.Schedule)
+	return cs
+}
+
+// Run publishes the payload once; it is called by the cron scheduler
+func (s *schedule) Run() {
+	// with several replicas, the leader runs the schedules
+	if !isLeader() {
+		return
+	}
+	scheduler.Lock()
+	s.Runs++
+	data := scheduleTemplateData{Name: s.Name, Topic: s.Topic, Time: time.Now().UTC().Format(time.RFC3339), Seq: s.Runs}
+	topicName, attrs, tmpl := s.Topic, s.Attributes, s.tmpl
+	scheduler.Unlock()
+
+	id, err := publishScheduled(topicName, tmpl, data, attrs)
+
+	scheduler.Lock()
+	defer scheduler.Unlock()
+	s.LastRun = time.Now()
+	s.LastMessageID, s.LastError = id, ""
+	if err != nil {
+		log.Printf("schedule %s: %v", s.Name, err)
+		s.LastError = err.Error()
+	}
+	if err := saveSchedulesLocked(); err != nil {
+		log.Printf("schedules: %v", err)
+	}
+}
+
+// publishScheduled renders the payload and publishes it
+func publishScheduled(topicName string, tmpl *template.Template, data scheduleTemplateData, attrs map[string]string) (string, error) {
+	var payload bytes.Buffer
+	if err := tmpl.Execute(&payload, data); err != nil {
+		return "", err
+	}
+
+	return publishMessage(topicName, &pubsub.Message{
+		Data:       payload.Bytes(),
+		Attributes: attrs,
+	})
+}
+
+// summaryLocked returns a one-line description of the schedule
+func (s *schedule) summaryLocked() string {
+	state := "active"
+	if s.Paused {
+		state = "paused"
+	}
+	str := fmt.Sprintf("%s: topic=%s schedule=%q state=%s runs=%d", s.Name, s.Topic, s.Schedule, state, s.Runs)
+	if !s.LastRun.IsZero() {
+		str += fmt.Sprintf(" lastRun=%s", s.LastRun.Format(time.RFC3339))
+	}
+	if s.LastMessageID != "" {
+		str += fmt.Sprintf(" lastMessageId=%s", s.LastMessageID)
+	}
+	if s.LastError != "" {
+		str += fmt.Sprintf(" lastError=%q", s.LastError)
+	}
+	return str
+}
+
+// sortedSchedulesLocked returns all schedules ordered by name
+func sortedSchedulesLocked() []*schedule {
+	list := make([]*schedule, 0, len(scheduler.schedules))
+	for _, s := range scheduler.schedules {
+		list = append(list, s)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return list
+}
+
+// saveSchedulesLocked writes all schedules to the schedules file
+func saveSchedulesLocked() error {
+	data, err := json.MarshalIndent(sortedSchedulesLocked(), "", "  ")
+	if err != nil {
+		return err
+	}
+	// write to a temporary file first so a crash can't leave a truncated file behind
+	tmp := scheduler.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, scheduler.path)
+}
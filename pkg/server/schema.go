@@ -0,0 +1,175 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// Request bodies are decoded into typed request structs after being validated against a JSON
+// Schema, of which the subset below is supported: type, properties, required, additionalProperties
+// (false unless given a schema, so unknown properties are errors), items, enum and minimum. A
+// request failing validation gets a 400 listing every offending field.
+
+// jsonSchema is a JSON Schema describing a request body
+type jsonSchema struct {
+	Type                 string                 `json:"type"` // object, array, string, number, integer or boolean
+	Description          string                 `json:"description,omitempty"`
+	Properties           map[string]*jsonSchema `json:"properties,omitempty"`
+	Required             []string               `json:"required,omitempty"`
+	AdditionalProperties *jsonSchema            `json:"additionalProperties,omitempty"` // schema of the values of a map
+	Items                *jsonSchema            `json:"items,omitempty"`
+	Enum                 []string               `json:"enum,omitempty"`
+	Minimum              *float64               `json:"minimum,omitempty"`
+}
+
+// objectSchema describes an object with the given properties, of which those named are required
+func objectSchema(properties map[string]*jsonSchema, required ...string) *jsonSchema {
+	return &jsonSchema{Type: "object", Properties: properties, Required: required}
+}
+
+func stringSchema(description string) *jsonSchema {
+	return &jsonSchema{Type: "string", Description: description}
+}
+
+func booleanSchema(description string) *jsonSchema {
+	return &jsonSchema{Type: "boolean", Description: description}
+}
+
+// stringMapSchema describes an object with string values, like message attributes
+func stringMapSchema(description string) *jsonSchema {
+	return &jsonSchema{Type: "object", Description: description, AdditionalProperties: &jsonSchema{Type: "string"}}
+}
+
+// numberSchema describes a number (an integer if integer is set) of at least min
+func numberSchema(description string, integer bool, min float64) *jsonSchema {
+	s := &jsonSchema{Type: "number", Description: description, Minimum: &min}
+	if integer {
+		s.Type = "integer"
+	}
+	return s
+}
+
+// jsonType returns the JSON Schema type of a decoded JSON value
+func jsonType(v interface{}) string {
+	switch v := v.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case float64:
+		if v == math.Trunc(v) {
+			return "integer"
+		}
+		return "number"
+	case string:
+		return "string"
+	case []interface{}:
+		return "array"
+	case map[string]interface{}:
+		return "object"
+	}
+	return fmt.Sprintf("%T", v)
+}
+
+// validate returns the errors of v against the schema, each prefixed by the path of the field
+func (s *jsonSchema) validate(path string, v interface{}) []string {
+	field := path
+	if field == "" {
+		field = "body"
+	}
+	t := jsonType(v)
+	if t != s.Type && !(s.Type == "number" && t == "integer") {
+		article := "a"
+		if strings.IndexByte("aeiou", s.Type[0]) >= 0 {
+			article = "an"
+		}
+		return []string{fmt.Sprintf("%s: must be %s %s, got %s", field, article, s.Type, t)}
+	}
+
+	var errs []string
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for _, name := range s.Required {
+			if _, ok := v[name]; !ok {
+				errs = append(errs, fmt.Sprintf("%s: required property missing", joinSchemaPath(path, name)))
+			}
+		}
+		names := make([]string, 0, len(v))
+		for name := range v {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			ps, ok := s.Properties[name]
+			if !ok {
+				ps = s.AdditionalProperties
+			}
+			if ps == nil {
+				errs = append(errs, fmt.Sprintf("%s: unknown property", joinSchemaPath(path, name)))
+				continue
+			}
+			errs = append(errs, ps.validate(joinSchemaPath(path, name), v[name])...)
+		}
+	case []interface{}:
+		if s.Items != nil {
+			for i, item := range v {
+				errs = append(errs, s.Items.validate(fmt.Sprintf("%s[%d]", path, i), item)...)
+			}
+		}
+	case string:
+		if len(s.Enum) > 0 {
+			found := false
+			for _, e := range s.Enum {
+				found = found || e == v
+			}
+			if !found {
+				errs = append(errs, fmt.Sprintf("%s: must be one of %q", field, s.Enum))
+			}
+		}
+	case float64:
+		if s.Minimum != nil && v < *s.Minimum {
+			errs = append(errs, fmt.Sprintf("%s: must be at least %v", field, *s.Minimum))
+		}
+	}
+	return errs
+}
+
+func joinSchemaPath(path, name string) string {
+	if path == "" {
+		return name
+	}
+	return path + "." + name
+}
+
+// decodeRequest validates body against the schema and decodes it into req, a pointer to the
+// request struct, returning the validation errors joined in one
+func decodeRequest(body []byte, schema *jsonSchema, req interface{}) error {
+	var v interface{}
+	if err := json.Unmarshal(body, &v); err != nil {
+		return fmt.Errorf("body is not valid JSON: %v", err)
+	}
+	if errs := schema.validate("", v); len(errs) > 0 {
+		return fmt.Errorf("invalid request body:\n  %s", strings.Join(errs, "\n  "))
+	}
+	return json.Unmarshal(body, req)
+}
+
+// readRequest reads the request body into req after validating it against the schema,
+// responding with the validation errors if that fails
+func readRequest(w http.ResponseWriter, r *http.Request, schema *jsonSchema, req interface{}) bool {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return false
+	}
+	if err := decodeRequest(body, schema, req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return false
+	}
+	return true
+}
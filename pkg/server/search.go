@@ -0,0 +1,164 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/pubsub"
+)
+
+const (
+	defaultSearchSample  = 100
+	maxSearchSample      = 10000
+	defaultSearchTimeout = 10 * time.Second
+	maxSearchTimeout     = time.Minute
+)
+
+// searchRequest is the body of POST /subscriptions/<subscription-name>/search
+type searchRequest struct {
+	Query    string  `json:"query"`
+	Regex    bool    `json:"regex"`
+	JSONPath string  `json:"jsonPath"`
+	Sample   int     `json:"sample"`
+	Timeout  *string `json:"timeout"`
+}
+
+var searchSchema = objectSchema(map[string]*jsonSchema{
+	"query":    stringSchema("substring (or regular expression) the messages are searched for"),
+	"regex":    booleanSchema("whether query is a regular expression"),
+	"jsonPath": stringSchema("JSON path, like $.order.id, of the field of JSON messages searched instead of the whole message"),
+	"sample":   numberSchema(fmt.Sprintf("how many messages of the backlog are searched, up to %d", maxSearchSample), true, 1),
+	"timeout":  stringSchema(fmt.Sprintf("how long to pull the sample for, up to %s", maxSearchTimeout)),
+}, "query")
+
+// messageSearch is a parsed search request
+type messageSearch struct {
+	query    string
+	re       *regexp.Regexp // nil for a substring search
+	jsonPath string
+	sample   int
+	timeout  time.Duration
+}
+
+// parse checks a search request
+func (req searchRequest) parse() (*messageSearch, error) {
+	s := &messageSearch{query: req.Query, jsonPath: req.JSONPath, sample: defaultSearchSample, timeout: defaultSearchTimeout}
+	if req.Query == "" {
+		return nil, fmt.Errorf("query must not be empty")
+	}
+	if req.Regex {
+		re, err := regexp.Compile(req.Query)
+		if err != nil {
+			return nil, fmt.Errorf("query: %v", err)
+		}
+		s.re = re
+	}
+	if req.Sample != 0 {
+		if req.Sample > maxSearchSample {
+			return nil, fmt.Errorf("sample must be at most %d", maxSearchSample)
+		}
+		s.sample = req.Sample
+	}
+	if req.Timeout != nil {
+		d, err := time.ParseDuration(*req.Timeout)
+		if err != nil || d <= 0 || d > maxSearchTimeout {
+			return nil, fmt.Errorf("timeout must be a positive duration up to %s", maxSearchTimeout)
+		}
+		s.timeout = d
+	}
+	return s, nil
+}
+
+// matches reports whether a message, as it would be shown to the client, matches the search
+func (s *messageSearch) matches(msg *pubsub.Message) bool {
+	text := string(msg.Data)
+	if s.jsonPath != "" {
+		var doc interface{}
+		if json.Unmarshal(msg.Data, &doc) != nil {
+			return false
+		}
+		v, ok := jsonPathLookup(doc, s.jsonPath)
+		if !ok {
+			return false
+		}
+		text = v
+	}
+	if s.re != nil {
+		return s.re.MatchString(text)
+	}
+	return strings.Contains(text, s.query)
+}
+
+// subscriptionSearchHandler handles POST to /subscriptions/<subscription-name>/search, pulling a
+// sample of the backlog and returning the messages matching the search; the messages are held
+// until the sample is complete or the timeout passes, then nacked, so none is consumed
+func subscriptionSearchHandler(_ context.Context, w http.ResponseWriter, r *http.Request, client *pubsub.Client, subscr *pubsub.Subscription) {
+	// get the search from body: '{"query":"order-42", "regex":false, "jsonPath":"$.order.id", "sample":1000, "timeout":"10s"}'
+	var req searchRequest
+	if !readRequest(w, r, searchSchema, &req) {
+		return
+	}
+	search, err := req.parse()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), search.timeout)
+	defer cancel()
+	subscr.ReceiveSettings.MaxOutstandingMessages = search.sample
+	var (
+		mu      sync.Mutex
+		done    bool
+		held    []*pubsub.Message
+		seen    = map[string]bool{}
+		matched []*pubsub.Message
+	)
+	// Receive only returns once its messages are settled, so they're nacked as soon as the search ends
+	go func() {
+		<-ctx.Done()
+		mu.Lock()
+		defer mu.Unlock()
+		done = true
+		for _, msg := range held {
+			msg.Nack()
+		}
+	}()
+	err = subscr.Receive(ctx, func(_ context.Context, msg *pubsub.Message) {
+		mu.Lock()
+		defer mu.Unlock()
+		if done {
+			msg.Nack()
+			return
+		}
+		held = append(held, msg)
+		// a message redelivered during the search is only inspected once
+		if seen[msg.ID] || len(seen) == search.sample {
+			return
+		}
+		seen[msg.ID] = true
+		shown, decryptErr := decryptForDisplay(msg)
+		if decryptErr == nil && search.matches(redactMessage(shown)) {
+			matched = append(matched, msg)
+		}
+		if len(seen) == search.sample {
+			cancel()
+		}
+	})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	fmt.Fprintf(w, "searched %d messages of subscription %s, %d matched\n", len(seen), subscr.String(), len(matched))
+	for i, msg := range matched {
+		fmt.Fprintf(w, "[%d] Message ID: %s (published %s)\n", i, msg.ID, msg.PublishTime.UTC().Format(time.RFC3339))
+		writeReceivedMessage(w, i, msg)
+	}
+}
@@ -0,0 +1,115 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+
+	"cloud.google.com/go/pubsub"
+)
+
+const selftestTimeout = 30 * time.Second
+
+// selftestStep is the outcome of one step of the self test
+type selftestStep struct {
+	name    string
+	latency time.Duration
+	err     error
+}
+
+// selftestHandler handles POST to /selftest, exercising the full Pub/Sub path with a
+// temporary topic and subscription; it responds 503 if any step fails, for uptime checks
+func selftestHandler(w http.ResponseWriter, r *http.Request) {
+	projectID := setting("GOOGLE_CLOUD_PROJECT")
+	if projectID == "" {
+		http.Error(w, "failed to get project ID", http.StatusServiceUnavailable)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), selftestTimeout)
+	defer cancel()
+	client, err := pubsub.NewClient(ctx, projectID, clientOptions...)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer client.Close()
+
+	var steps []selftestStep
+	step := func(name string, f func() error) bool {
+		start := time.Now()
+		err := f()
+		steps = append(steps, selftestStep{name: name, latency: time.Since(start), err: err})
+		return err == nil
+	}
+
+	name := "selftest-" + randomID()[:12]
+	probe := []byte("probe " + randomID())
+	var (
+		topic  *pubsub.Topic
+		subscr *pubsub.Subscription
+	)
+	total := time.Now()
+	ok := step("create topic "+name, func() (err error) {
+		topic, err = client.CreateTopicWithConfig(ctx, name, &pubsub.TopicConfig{Labels: demoLabels()})
+		return err
+	}) && step("create subscription "+name, func() (err error) {
+		subscr, err = client.CreateSubscription(ctx, name, pubsub.SubscriptionConfig{
+			Topic:            topic,
+			AckDeadline:      10 * time.Second,
+			ExpirationPolicy: 24 * time.Hour,
+			Labels:           demoLabels(),
+		})
+		return err
+	}) && step("publish probe message", func() error {
+		defer topic.Stop()
+		_, err := topic.Publish(ctx, &pubsub.Message{Data: probe}).Get(ctx)
+		return err
+	}) && step("receive probe message", func() error {
+		rctx, rcancel := context.WithCancel(ctx)
+		defer rcancel()
+		found := false
+		err := subscr.Receive(rctx, func(_ context.Context, msg *pubsub.Message) {
+			msg.Ack()
+			if bytes.Equal(msg.Data, probe) {
+				found = true
+				rcancel()
+			}
+		})
+		if err != nil {
+			return err
+		}
+		if !found {
+			return fmt.Errorf("probe message not received: %v", ctx.Err())
+		}
+		return nil
+	})
+
+	// clean up whatever was created, even after a failure; use a fresh context in case the test timed out
+	cctx, ccancel := context.WithTimeout(context.Background(), selftestTimeout)
+	defer ccancel()
+	if subscr != nil {
+		ok = step("delete subscription "+name, func() error { return subscr.Delete(cctx) }) && ok
+	}
+	if topic != nil {
+		ok = step("delete topic "+name, func() error { return topic.Delete(cctx) }) && ok
+	}
+
+	if !ok {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	for i, s := range steps {
+		status := "ok"
+		if s.err != nil {
+			status = "FAILED: " + s.err.Error()
+		}
+		fmt.Fprintf(w, "[%d] %s: %s (%s)\n", i, s.name, status, s.latency.Round(time.Millisecond))
+	}
+	result := "passed"
+	if !ok {
+		result = "FAILED"
+	}
+	fmt.Fprintf(w, "selftest %s in %s\n", result, time.Since(total).Round(time.Millisecond))
+}
@@ -0,0 +1,1027 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/pubsub"
+	"google.golang.org/api/iterator"
+	"google.golang.org/api/option"
+)
+
+// Options configure the server NewServer returns. The service is otherwise configured through
+// environment variables (see the README), which Settings can override without changing the
+// process's environment. The configuration and state of a server are the process's, so only one
+// server per process is supported: calling NewServer again reconfigures the server already made.
+type Options struct {
+	// ProjectID is the Google Cloud project of the topics and subscriptions, by default
+	// $GOOGLE_CLOUD_PROJECT
+	ProjectID string
+	// Settings override the environment variables of the same names, CONFIG_FILE's settings
+	// taking precedence
+	Settings map[string]string
+	// ClientOptions are added to those of the server's Pub/Sub clients, e.g. to connect them to
+	// a fake or the emulator
+	ClientOptions []option.ClientOption
+}
+
+// clientOptions are the Options' ClientOptions
+var clientOptions []option.ClientOption
+
+// NewServer returns the handler of the service's API, which also serves the /debug/pprof/ and
+// /debug/vars endpoints; Start starts its background work before serving and Stop stops it
+// afterwards. Only one server per process is supported (see Options).
+func NewServer(opts Options) http.Handler {
+	options := map[string]string{}
+	for name, value := range opts.Settings {
+		options[name] = value
+	}
+	if opts.ProjectID != "" {
+		options["GOOGLE_CLOUD_PROJECT"] = opts.ProjectID
+	}
+	settings.Lock()
+	settings.options = options
+	settings.Unlock()
+	clientOptions = opts.ClientOptions
+	loadConfigFile()
+	api := &apiMux{}
+	api.handle(http.MethodGet, "/", api.indexHandler)
+	api.handle(http.MethodGet, "/-", api.discoveryHandler)
+
+	api.handle(http.MethodGet, "/topics", listTopicsHandler)
+	api.handle(http.MethodPut, "/topics", createTopicHandler)
+	api.handle(http.MethodDelete, "/topics", asyncable(bulkDeleteTopicsHandler))
+	api.handle(http.MethodPost, "/topics:batchCreate", asyncable(batchCreateTopicsHandler))
+	api.handle(http.MethodGet, "/topics/{name}", withTopic(getTopicHandler))
+	api.handle(http.MethodPost, "/topics/{name}", withTopic(publishHandler))
+	api.handle(http.MethodDelete, "/topics/{name}", withTopic(deleteTopicHandler))
+	api.handle(http.MethodGet, "/topics/{name}/delete-plan", withTopic(topicDeletePlanHandler))
+	api.handle(http.MethodPost, "/topics/{name}/import", asyncable(withTopic(topicImportHandler)))
+	api.handle(http.MethodPost, "/topics/{name}/clone", asyncable(withTopic(topicCloneHandler)))
+	api.handle(http.MethodPost, "/topics/{name}/tap", withTopic(topicTapHandler))
+
+	api.handle(http.MethodGet, "/subscriptions", listSubscriptionsHandler)
+	api.handle(http.MethodPut, "/subscriptions", createSubscriptionHandler)
+	api.handle(http.MethodDelete, "/subscriptions", asyncable(bulkDeleteSubscriptionsHandler))
+	api.handle(http.MethodPost, "/subscriptions:batchCreate", asyncable(batchCreateSubscriptionsHandler))
+	api.handle(http.MethodGet, "/subscriptions/{name}", withSubscription(getSubscriptionHandler))
+	api.handle(http.MethodPost, "/subscriptions/{name}", withSubscription(deprecatedReceiveHandler))
+	api.handle(http.MethodPatch, "/subscriptions/{name}", withSubscription(updateSubscriptionHandler))
+	api.handle(http.MethodDelete, "/subscriptions/{name}", withSubscription(deleteSubscriptionHandler))
+	api.handle(http.MethodGet, "/subscriptions/{name}/delete-plan", withSubscription(subscriptionDeletePlanHandler))
+	api.handle(http.MethodGet, "/subscriptions/{name}/lag", withSubscription(subscriptionLagHandler))
+	api.handle(http.MethodGet, "/subscriptions/{name}/messages", withSubscription(receiveHandler))
+	api.handle(http.MethodPost, "/subscriptions/{name}/clone", asyncable(withSubscription(subscriptionCloneHandler)))
+	api.handle(http.MethodPost, "/subscriptions/{name}/ordered", withSubscription(subscriptionOrderedHandler))
+	api.handle(http.MethodPost, "/subscriptions/{name}/replay", asyncable(withSubscription(subscriptionReplayHandler)))
+	api.handle(http.MethodPost, "/subscriptions/{name}/search", withSubscription(subscriptionSearchHandler))
+	api.handle(http.MethodGet, "/subscriptions/{name}/tail", withSubscription(subscriptionTailHandler))
+
+	api.handle(http.MethodGet, "/archivers", listArchiversHandler)
+	api.handle(http.MethodPut, "/archivers", createArchiverHandler)
+	api.handle(http.MethodGet, "/archivers/{name}", getArchiverHandler)
+	api.handle(http.MethodDelete, "/archivers/{name}", deleteArchiverHandler)
+
+	api.handle(http.MethodGet, "/sinks", listSinksHandler)
+	api.handle(http.MethodPut, "/sinks", createSinkHandler)
+	api.handle(http.MethodGet, "/sinks/{name}", getSinkHandler)
+	api.handle(http.MethodDelete, "/sinks/{name}", deleteSinkHandler)
+
+	api.handle(http.MethodGet, "/jobs", listJobsHandler)
+	api.handle(http.MethodPost, "/jobs", launchJobHandler)
+	api.handle(http.MethodGet, "/jobs/{id}", getJobHandler)
+	api.handle(http.MethodDelete, "/jobs/{id}", stopJobHandler)
+
+	api.handle(http.MethodPost, "/rpc/{name}", rpcHandler)
+
+	api.handle(http.MethodGet, "/schedules", listSchedulesHandler)
+	api.handle(http.MethodPut, "/schedules", createScheduleHandler)
+	api.handle(http.MethodGet, "/schedules/{name}", getScheduleHandler)
+	api.handle(http.MethodDelete, "/schedules/{name}", deleteScheduleHandler)
+	api.handle(http.MethodPost, "/schedules/{name}/pause", pauseScheduleHandler(true))
+	api.handle(http.MethodPost, "/schedules/{name}/resume", pauseScheduleHandler(false))
+
+	api.handle(http.MethodGet, "/delayed", delayedHandler)
+	api.handle(http.MethodPost, "/replays", asyncable(replaysHandler))
+	api.handle(http.MethodPost, "/diff", diffHandler)
+
+	api.handle(http.MethodGet, "/routes", listRoutesHandler)
+	api.handle(http.MethodPut, "/routes", createRouteHandler)
+	api.handle(http.MethodGet, "/routes/{name}", getRouteHandler)
+	api.handle(http.MethodDelete, "/routes/{name}", deleteRouteHandler)
+
+	api.handle(http.MethodGet, "/priority", listPriorityQueuesHandler)
+	api.handle(http.MethodPut, "/priority", createPriorityQueueHandler)
+	api.handle(http.MethodGet, "/priority/{name}", getPriorityQueueHandler)
+	api.handle(http.MethodPost, "/priority/{name}", publishPriorityHandler)
+	api.handle(http.MethodDelete, "/priority/{name}", deletePriorityQueueHandler)
+	api.handle(http.MethodPost, "/priority/{name}/receive", receivePriorityHandler)
+
+	api.handle(http.MethodGet, "/ingest", listIngestRoutesHandler)
+	api.handle(http.MethodPut, "/ingest", createIngestRouteHandler)
+	api.handle(http.MethodPost, "/ingest/{name}", ingestHandler)
+	api.handle(http.MethodDelete, "/ingest/{name}", deleteIngestRouteHandler)
+
+	api.handle(http.MethodGet, "/outbox", listOutboxHandler)
+	api.handle(http.MethodPost, "/outbox", writeOutboxHandler)
+	api.handle(http.MethodGet, "/outbox/{id}", getOutboxHandler)
+
+	api.handle(http.MethodGet, "/graphql", graphqlHandler)
+	api.handle(http.MethodPost, "/graphql", graphqlHandler)
+	api.handle(http.MethodGet, "/stomp", stompHandler)
+
+	if setting("AWS_FACADE") == "true" {
+		api.handle(http.MethodPost, "/aws", awsHandler)
+		api.handle(http.MethodPost, "/aws/{account}/{name}", awsHandler)
+	}
+
+	api.handle(http.MethodGet, "/redaction", getRedactionHandler)
+	api.handle(http.MethodPut, "/redaction", putRedactionHandler)
+
+	api.handle(http.MethodGet, "/metrics", metricsHandler)
+	api.handle(http.MethodGet, "/readyz", readyzHandler)
+	api.handle(http.MethodGet, "/slo", sloHandler)
+	api.handle(http.MethodGet, "/status", statusHandler)
+	api.handle(http.MethodGet, "/consumers", listConsumersHandler)
+	api.handle(http.MethodGet, "/consumers/{id}/stats", consumerStatsHandler)
+	api.handle(http.MethodGet, "/consumers/{id}/messages", consumerMessagesHandler)
+	api.handle(http.MethodPost, "/consumers", createConsumerHandler)
+	api.handle(http.MethodPatch, "/consumers/{id}", updateConsumerHandler)
+	api.handle(http.MethodPost, "/selftest", selftestHandler)
+
+	api.handle(http.MethodGet, "/janitor", janitorHandler)
+	api.handle(http.MethodGet, "/expiring", expiringHandler)
+	api.handle(http.MethodGet, "/watch", watchHandler)
+	api.handle(http.MethodGet, "/summary", summaryHandler)
+	api.handle(http.MethodGet, "/orphans", listOrphansHandler)
+	api.handle(http.MethodDelete, "/orphans", deleteOrphansHandler)
+	api.handle(http.MethodGet, "/drift", driftHandler)
+	api.handle(http.MethodGet, "/drift/baseline", getBaselineHandler)
+	api.handle(http.MethodPut, "/drift/baseline", putBaselineHandler)
+	api.handle(http.MethodDelete, "/drift/baseline", deleteBaselineHandler)
+	api.handle(http.MethodGet, "/trash", listTrashHandler)
+	api.handle(http.MethodPost, "/trash/{name}/restore", restoreTrashHandler)
+	api.handle(http.MethodDelete, "/trash/{name}", purgeTrashHandler)
+
+	api.handle(http.MethodPost, "/admin/reload", reloadHandler)
+	api.handle(http.MethodGet, "/usage", usageHandler)
+	api.handle(http.MethodGet, "/admin/keys", listKeysHandler)
+	api.handle(http.MethodPost, "/admin/keys", createKeyHandler)
+	api.handle(http.MethodDelete, "/admin/keys/{id}", deleteKeyHandler)
+	api.handle(http.MethodPost, "/admin/keys/{id}/disable", disableKeyHandler)
+	api.handle(http.MethodPost, "/admin/keys/{id}/rotate", rotateKeyHandler)
+	api.handle(http.MethodGet, "/admin/tokens", listTokensHandler)
+	api.handle(http.MethodPost, "/admin/tokens", createTokenHandler)
+	api.handle(http.MethodDelete, "/admin/tokens/{id}", deleteTokenHandler)
+
+	api.handle(http.MethodGet, "/debug/chaos", getChaosHandler)
+	api.handle(http.MethodPut, "/debug/chaos", putChaosHandler)
+	api.handle(http.MethodDelete, "/debug/chaos", deleteChaosHandler)
+
+	// pprof and expvar register their endpoints on the default mux, everything else goes to the API
+	mux := http.NewServeMux()
+	mux.Handle("/debug/pprof/", http.DefaultServeMux)
+	mux.Handle("/debug/vars", http.DefaultServeMux)
+	mux.Handle("/", api)
+	return recoverMiddleware(debugMiddleware(chaosMiddleware(gzipMiddleware(idempotencyMiddleware(mux)))))
+}
+
+// Start starts the server's background work, like schedules, the delay queue, the outbox and
+// routes, and loads the state and configuration it keeps
+func Start() {
+	startLeaderElection()
+	startScheduler()
+	startDelayQueue()
+	startOutbox()
+	startRedaction()
+	startSLOs()
+	startMonitoringExport()
+	startErrorReporting()
+	startStatus()
+	startWarmSessions()
+	startJanitor()
+	startExpiryWatchdog()
+	startStateStore()
+	loadManagedKeys()
+	loadAccessTokens()
+	startUsage()
+	loadPublishPolicy()
+	loadNamingPolicy()
+	loadAdminQuota()
+	loadAdminRetry()
+	loadBreaker()
+	startTopicCache()
+	startDedupCache()
+	startIdempotencyCache()
+	startPublishLog()
+	startTrash()
+	startDrift()
+	loadReceiveSessions()
+	startSMTPGateway()
+	startReloadSignal()
+
+	// routes pull from their subscriptions as soon as they're up, so they're restored alongside serving,
+	// before the routes configured in Firestore take over
+	go func() {
+		restoreRoutes()
+		startConfigWatch()
+	}()
+}
+
+// Stop stops the server's background work once it has stopped serving: the outbox dispatcher
+// stops, messages still batched in cached topic handles are flushed and the state is saved
+func Stop() {
+	stopOutbox()
+	flushTopicCache()
+	saveReceiveSessions()
+	saveUsage()
+	stopStateStore()
+	stopLeaderElection()
+}
+
+// newClient creates a Pub/Sub client for the project, responding with an error if that fails
+func newClient(ctx context.Context, w http.ResponseWriter) (*pubsub.Client, bool) {
+	if writeCircuitOpen(w) {
+		return nil, false
+	}
+	projectID := setting("GOOGLE_CLOUD_PROJECT")
+	if projectID == "" {
+		http.Error(w, "failed to get project ID", http.StatusServiceUnavailable)
+		return nil, false
+	}
+	client, err := pubsub.NewClient(ctx, projectID, backendOptions()...)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return nil, false
+	}
+	return client, true
+}
+
+// topicHandlerFunc handles a request to /topics/{name}[/<action>] for an existing topic
+type topicHandlerFunc func(ctx context.Context, w http.ResponseWriter, r *http.Request, client *pubsub.Client, topic *pubsub.Topic)
+
+// withTopic looks up the topic named in the path, responding 404 if it doesn't exist and 410 if
+// it's in the trash
+func withTopic(h topicHandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := withRequestDeadline(context.Background(), r)
+		defer cancel()
+		client, ok := newClient(ctx, w)
+		if !ok {
+			return
+		}
+		topicName := pathParam(r, "name")
+		if err := validateResourceName("topic", topicName); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if since, ok := trashedSince(topicName); ok {
+			writeTrashedError(w, topicName, since)
+			return
+		}
+		topic := client.Topic(topicName)
+		if err := checkExists(ctx, "topic", topicName, topic.Exists); err != nil {
+			if requestDeadlineExceeded(r) {
+				writeDeadlineExceeded(w, "looking up topic "+topicName)
+				return
+			}
+			writeLookupError(w, err)
+			return
+		}
+		h(ctx, w, r, client, topic)
+	}
+}
+
+// subscriptionHandlerFunc handles a request to /subscriptions/{name}[/<action>] for an existing subscription
+type subscriptionHandlerFunc func(ctx context.Context, w http.ResponseWriter, r *http.Request, client *pubsub.Client, subscr *pubsub.Subscription)
+
+// withSubscription looks up the subscription named in the path, responding 404 if it doesn't exist
+func withSubscription(h subscriptionHandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := withRequestDeadline(context.Background(), r)
+		defer cancel()
+		client, ok := newClient(ctx, w)
+		if !ok {
+			return
+		}
+		subscrName := pathParam(r, "name")
+		if err := validateResourceName("subscription", subscrName); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		subscr := client.Subscription(subscrName)
+		if err := checkExists(ctx, "subscription", subscrName, subscr.Exists); err != nil {
+			if requestDeadlineExceeded(r) {
+				writeDeadlineExceeded(w, "looking up subscription "+subscrName)
+				return
+			}
+			writeLookupError(w, err)
+			return
+		}
+		h(ctx, w, r, client, subscr)
+	}
+}
+
+// listTopicsHandler handles GET to /topics
+func listTopicsHandler(w http.ResponseWriter, r *http.Request) {
+	client, ok := newClient(context.Background(), w)
+	if !ok {
+		return
+	}
+
+	if err := waitAdminQuota(r.Context(), adminOpList); err != nil {
+		writeAdminError(w, err, http.StatusServiceUnavailable)
+		return
+	}
+
+	// stream the listing, stopping early if the client goes away
+	it := client.Topics(r.Context())
+	fmt.Fprintln(w, "Topics\n------")
+	i := 0
+	for {
+		t, err := it.Next()
+		if err == iterator.Done {
+			break
+		}
+		if r.Context().Err() != nil {
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if !tenantOwns(r, t.ID()) {
+			continue
+		}
+		fmt.Fprintln(w, t)
+		flushResponse(w)
+		i++
+	}
+	if i == 0 {
+		fmt.Fprintln(w, "(none)")
+	}
+}
+
+// createTopicRequest is the body of PUT /topics
+type createTopicRequest struct {
+	Name   string            `json:"name"`
+	Labels map[string]string `json:"labels"`
+}
+
+var createTopicSchema = objectSchema(map[string]*jsonSchema{
+	"name":   stringSchema("topic name"),
+	"labels": stringMapSchema("labels of the topic, besides those of this service"),
+}, "name")
+
+// createTopicHandler handles PUT to /topics
+func createTopicHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := context.Background()
+	client, ok := newClient(ctx, w)
+	if !ok {
+		return
+	}
+
+	dryRun, ok := dryRunRequested(w, r)
+	if !ok {
+		return
+	}
+
+	// get topic name from body: '{"name":"my-topic", "labels":{"team":"payments"}}'
+	var req createTopicRequest
+	if !readRequest(w, r, createTopicSchema, &req) {
+		return
+	}
+	name := req.Name
+	if err := validateNewResource("topic", name, req.Labels); err != nil {
+		writeCreateError(w, err)
+		return
+	}
+	if dryRun {
+		topic := client.Topic(name)
+		if dryRunCreatable(ctx, w, "topic", name, topic.Exists) {
+			writeDryRun(w, "create topic "+topic.String(), topicDetails(pubsub.TopicConfig{Labels: withDemoLabels(req.Labels)}))
+		}
+		return
+	}
+	var topic *pubsub.Topic
+	err := retryAdmin(ctx, adminOpCreate, func() (err error) {
+		topic, err = client.CreateTopicWithConfig(ctx, name, &pubsub.TopicConfig{
+			Labels: withDemoLabels(req.Labels),
+		})
+		return err
+	})
+	if err != nil {
+		writeAdminError(w, err, http.StatusInternalServerError)
+		return
+	}
+	noteResourceChange("created", "topic", topic.ID(), "")
+	fmt.Fprintf(w, "created topic %s\n", topic.String())
+}
+
+// getTopicHandler handles GET to /topics/<topic-name>, returning the topic's configuration and
+// subscriptions, which are fetched concurrently
+func getTopicHandler(ctx context.Context, w http.ResponseWriter, r *http.Request, client *pubsub.Client, topic *pubsub.Topic) {
+	var cfg pubsub.TopicConfig
+	var subscrNames []string
+	errs := runBatch(2, func(i int) string {
+		var err error
+		if i == 0 {
+			cfg, err = topic.Config(ctx)
+		} else {
+			subscrNames, err = topicSubscriptionNames(ctx, topic)
+		}
+		if err != nil {
+			return err.Error()
+		}
+		return ""
+	})
+	for _, err := range errs {
+		if err != "" {
+			http.Error(w, err, http.StatusInternalServerError)
+			return
+		}
+	}
+	details := topicDetails(cfg)
+	details = append(details, fmt.Sprintf("Subscriptions: %d", len(subscrNames)))
+	for _, name := range subscrNames {
+		details = append(details, "  "+name)
+	}
+	writeDetails(w, r, topic.String(), details)
+}
+
+// topicSubscriptionNames returns the full names of the subscriptions attached to a topic, sorted
+func topicSubscriptionNames(ctx context.Context, topic *pubsub.Topic) ([]string, error) {
+	var names []string
+	it := topic.Subscriptions(ctx)
+	for {
+		s, err := it.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		names = append(names, s.String())
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// publishHandler handles POST to /topics/<topic-name>
+func publishHandler(ctx context.Context, w http.ResponseWriter, r *http.Request, client *pubsub.Client, topic *pubsub.Topic) {
+	// get messages to publish from body:
+	// '["this is message 1", "second message", ...]', where messages may also be given
+	// with attributes, a dedupKey and a clientId echoed in their result:
+	// '[{"data":"this is message 1", "attributes":{...}, "dedupKey":"order-42", "clientId":"row-17"}, ...]'
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	msgs, err := readPublishMessages(r, body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	attrs := make([]map[string]string, len(msgs))
+	for i, msg := range msgs {
+		attrs[i] = msg.Attributes
+	}
+	if err := authorizePublish(r, topic.ID(), attrs); err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	// optionally hold the messages back in the delay queue: ?deliverAfter=<duration>
+	var deliverAfter time.Duration
+	if s := r.URL.Query().Get("deliverAfter"); s != "" {
+		deliverAfter, err = time.ParseDuration(s)
+		if err != nil || deliverAfter <= 0 || deliverAfter > maxDeliverAfter {
+			http.Error(w, fmt.Sprintf("deliverAfter must be a positive duration up to %s", maxDeliverAfter), http.StatusBadRequest)
+			return
+		}
+		// the delay queue would drop the message as too old before it's due
+		if limits := loadBufferLimits(delayBuffer); limits.age > 0 && deliverAfter > limits.age {
+			http.Error(w, fmt.Sprintf("deliverAfter must be at most %s, the age limit of DELAY_QUEUE_LIMITS", limits.age), http.StatusBadRequest)
+			return
+		}
+	}
+	pmsgs := make([]*pubsub.Message, len(msgs))
+	for i, msg := range msgs {
+		pmsgs[i] = &pubsub.Message{Data: []byte(msg.Data), Attributes: msg.Attributes}
+	}
+	// messages Pub/Sub would reject are skipped, or with ?atomic=true fail the request (see publishcheck.go)
+	invalid, ok := checkPublishMessages(ctx, w, r, topic, pmsgs)
+	if !ok {
+		return
+	}
+	// optionally encrypt the messages: ?encrypt=<key-ref> (see encrypt.go)
+	if keyRef := r.URL.Query().Get("encrypt"); keyRef != "" {
+		if err := validateKeyRef(keyRef); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		for _, msg := range pmsgs {
+			if err := encryptMessage(r.Context(), keyRef, msg); err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+		}
+	}
+	// results are collected first, so that the status code can still reflect publisher backpressure
+	// and failed messages
+	out := &bytes.Buffer{}
+	failed := 0
+	for i, reason := range invalid {
+		if reason != "" {
+			fmt.Fprintf(out, "%s invalid: %s\n", msgs[i].resultPrefix(i), reason)
+			failed++
+		}
+	}
+	// the publishes are recorded in the publish log (see publishlog.go)
+	var entries []*publishLogEntry
+	// skip messages whose dedupKey was published recently
+	duplicate := make([]bool, len(msgs))
+	for i, msg := range msgs {
+		if msg.DedupKey == "" || invalid[i] != "" {
+			continue
+		}
+		id, dup := dedupReserve(topic.ID(), msg.DedupKey)
+		if !dup {
+			continue
+		}
+		duplicate[i] = true
+		if id == "" {
+			fmt.Fprintf(out, "%s deduplicated: dedupKey %s is being published by another request\n", msg.resultPrefix(i), msg.DedupKey)
+		} else {
+			fmt.Fprintf(out, "%s deduplicated: dedupKey %s already published as message ID %s\n", msg.resultPrefix(i), msg.DedupKey, id)
+		}
+	}
+	if deliverAfter > 0 {
+		due := time.Now().Add(deliverAfter)
+		for i, msg := range msgs {
+			if duplicate[i] || invalid[i] != "" {
+				continue
+			}
+			id, err := enqueueDelayed(topic.ID(), pmsgs[i], due)
+			if err != nil {
+				if msg.DedupKey != "" {
+					dedupRelease(topic.ID(), msg.DedupKey)
+				}
+				fmt.Fprintf(out, "%s rejected: %v (DELAY_QUEUE_LIMITS), retry later\n", msg.resultPrefix(i), err)
+				failed++
+				continue
+			}
+			if msg.DedupKey != "" {
+				dedupRecord(topic.ID(), msg.DedupKey, id)
+			}
+			entry := newPublishLogEntry(topic.ID(), pmsgs[i], id, nil)
+			entry.Result = "delayed"
+			entries = append(entries, entry)
+			fmt.Fprintf(out, "%s delayed message ID %s, due at %s\n", msg.resultPrefix(i), id, due.Format(time.RFC3339))
+		}
+		recordPublishes(entries)
+		if failed > 0 {
+			w.WriteHeader(http.StatusMultiStatus)
+		}
+		w.Write(out.Bytes())
+		return
+	}
+	// publish through the cached handle, so messages of concurrent requests get batched
+	publisher, release, err := acquireTopic(topic.ID())
+	if err != nil {
+		for i, msg := range msgs {
+			if msg.DedupKey != "" && !duplicate[i] {
+				dedupRelease(topic.ID(), msg.DedupKey)
+			}
+		}
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer release()
+	results := make([]*pubsub.PublishResult, len(msgs))
+	for i := range msgs {
+		if duplicate[i] || invalid[i] != "" {
+			continue
+		}
+		// with PUBLISH_FLOW_CONTROL=block this waits for room in the publisher, at most as long as the client does
+		results[i] = publisher.Publish(r.Context(), pmsgs[i])
+	}
+	throttled := false
+	for i, res := range results {
+		if res == nil {
+			continue
+		}
+		id, err := res.Get(ctx)
+		entries = append(entries, newPublishLogEntry(topic.ID(), pmsgs[i], id, err))
+		if err != nil {
+			if msgs[i].DedupKey != "" {
+				dedupRelease(topic.ID(), msgs[i].DedupKey)
+			}
+			if isFlowControlError(err) {
+				throttled = true
+			}
+			failed++
+			fmt.Fprintf(out, "%s %s\n", msgs[i].resultPrefix(i), err.Error())
+			continue
+		}
+		if msgs[i].DedupKey != "" {
+			dedupRecord(topic.ID(), msgs[i].DedupKey, id)
+		}
+		recordPublished(topic.ID(), 1)
+		recordUsage(r, usageCounters{Published: 1, PublishedBytes: int64(len(pmsgs[i].Data))})
+		fmt.Fprintf(out, "%s published message ID %s\n", msgs[i].resultPrefix(i), id)
+	}
+	recordPublishes(entries)
+	if failed > 0 && requestDeadlineExceeded(r) {
+		// the messages without an ID may still be published, after the caller gave up
+		fmt.Fprintln(out, "request deadline exceeded: the messages not reported published may still be")
+		w.WriteHeader(http.StatusGatewayTimeout)
+	} else if throttled {
+		// some messages were rejected by the publisher's flow control: ask the client to retry those later
+		w.Header().Set("Retry-After", strconv.Itoa(int(publishRetryAfter/time.Second)))
+		w.WriteHeader(http.StatusTooManyRequests)
+	} else if failed > 0 {
+		// the per-message results tell which messages failed
+		w.WriteHeader(http.StatusMultiStatus)
+	}
+	w.Write(out.Bytes())
+}
+
+// deleteTopicHandler handles DELETE to /topics/<topic-name>, moving the topic to the trash with
+// TRASH_RETENTION set; with DELETE_CONFIRMATION=true, a topic with subscriptions needs confirm=<token>
+func deleteTopicHandler(ctx context.Context, w http.ResponseWriter, r *http.Request, client *pubsub.Client, topic *pubsub.Topic) {
+	dryRun, ok := dryRunRequested(w, r)
+	if !ok {
+		return
+	}
+	trash.Lock()
+	retention := trash.retention
+	trash.Unlock()
+	if dryRun || deleteConfirmationRequired() {
+		plan, err := topicDeletePlan(ctx, topic)
+		if err != nil {
+			writeAdminError(w, err, http.StatusInternalServerError)
+			return
+		}
+		if dryRun {
+			action := "delete topic " + topic.String()
+			if retention > 0 {
+				action = fmt.Sprintf("move topic %s to the trash for %s", topic.String(), retention)
+			}
+			writeDeleteDryRun(w, action, plan)
+			return
+		}
+		if !deleteConfirmed(w, r, plan) {
+			return
+		}
+	}
+	if retention > 0 {
+		t, err := trashTopic(ctx, client, topic)
+		if err != nil {
+			writeAdminError(w, err, http.StatusInternalServerError)
+			return
+		}
+		forgetTopic(topic.ID())
+		noteResourceChange("updated", "topic", topic.ID(), "moved to the trash")
+		fmt.Fprintf(w, "moved topic %s to the trash, detaching %d subscriptions; restore it with POST /trash/%s/restore before %s\n",
+			topic.String(), len(t.Subscriptions), topic.ID(), t.TrashedAt.Add(retention).Format(time.RFC3339))
+		return
+	}
+	err := retryAdmin(ctx, adminOpDelete, func() error {
+		return topic.Delete(ctx)
+	})
+	if err != nil {
+		writeAdminError(w, err, http.StatusServiceUnavailable)
+		return
+	}
+	forgetTopic(topic.ID())
+	noteResourceChange("deleted", "topic", topic.ID(), "")
+	fmt.Fprintf(w, "deleted topic %s\n", topic.String())
+}
+
+// listSubscriptionsHandler handles GET to /subscriptions
+func listSubscriptionsHandler(w http.ResponseWriter, r *http.Request) {
+	client, ok := newClient(context.Background(), w)
+	if !ok {
+		return
+	}
+
+	if err := waitAdminQuota(r.Context(), adminOpList); err != nil {
+		writeAdminError(w, err, http.StatusServiceUnavailable)
+		return
+	}
+
+	// stream the listing, stopping early if the client goes away
+	it := client.Subscriptions(r.Context())
+	fmt.Fprintln(w, "Subscriptions\n-------------")
+	i := 0
+	for {
+		t, err := it.Next()
+		if err == iterator.Done {
+			break
+		}
+		if r.Context().Err() != nil {
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if !tenantOwns(r, t.ID()) {
+			continue
+		}
+		fmt.Fprintln(w, t)
+		flushResponse(w)
+		i++
+	}
+	if i == 0 {
+		fmt.Fprintln(w, "(none)")
+	}
+}
+
+// createSubscriptionRequest is the body of PUT /subscriptions
+type createSubscriptionRequest struct {
+	Name   string            `json:"name"`
+	Topic  string            `json:"topic"`
+	Labels map[string]string `json:"labels"`
+	retentionRequest
+}
+
+var createSubscriptionSchema = objectSchema(withRetentionProperties(map[string]*jsonSchema{
+	"name":   stringSchema("subscription name"),
+	"topic":  stringSchema("name of the topic to subscribe to"),
+	"labels": stringMapSchema("labels of the subscription, besides those of this service"),
+}), "name", "topic")
+
+// createSubscriptionHandler handles PUT to /subscriptions
+func createSubscriptionHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := context.Background()
+	client, ok := newClient(ctx, w)
+	if !ok {
+		return
+	}
+
+	dryRun, ok := dryRunRequested(w, r)
+	if !ok {
+		return
+	}
+
+	// get subscription details from body:
+	// '{"name":"my-subscription", "topic": "my-topic", "labels":{"team":"payments"},
+	//   "retainAckedMessages":true, "retentionDuration":"24h"}'
+	var req createSubscriptionRequest
+	if !readRequest(w, r, createSubscriptionSchema, &req) {
+		return
+	}
+	subscrName, topicName := req.Name, req.Topic
+	if err := validateNewResource("subscription", subscrName, req.Labels); err != nil {
+		writeCreateError(w, err)
+		return
+	}
+	if err := validateResourceName("topic", topicName); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	retention, err := req.retentionRequest.parse()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	topic := client.Topic(topicName)
+	if topic == nil {
+		http.Error(w, fmt.Sprintf("topic %s not found", topicName), http.StatusBadRequest)
+		return
+	}
+	cfg := newSubscriptionConfig(topic)
+	cfg.Labels = withDemoLabels(req.Labels)
+	retention.apply(&cfg)
+	if dryRun {
+		if err := checkExists(ctx, "topic", topicName, topic.Exists); err != nil {
+			writeLookupError(w, err)
+			return
+		}
+		subscr := client.Subscription(subscrName)
+		if dryRunCreatable(ctx, w, "subscription", subscrName, subscr.Exists) {
+			writeDryRun(w, "create subscription "+subscr.String(), subscriptionDetails(cfg))
+		}
+		return
+	}
+	var subscr *pubsub.Subscription
+	err = retryAdmin(ctx, adminOpCreate, func() (err error) {
+		subscr, err = client.CreateSubscription(ctx, subscrName, cfg)
+		return err
+	})
+	if err != nil {
+		writeAdminError(w, err, http.StatusInternalServerError)
+		return
+	}
+	noteResourceChange("created", "subscription", subscr.ID(), "")
+	fmt.Fprintf(w, "created subscription %s\n", subscr.String())
+}
+
+// newSubscriptionConfig returns the configuration of subscriptions created by this service
+func newSubscriptionConfig(topic *pubsub.Topic) pubsub.SubscriptionConfig {
+	return pubsub.SubscriptionConfig{
+		Topic:            topic,
+		AckDeadline:      60 * time.Second,
+		ExpirationPolicy: 25 * time.Hour,
+		Labels:           demoLabels(),
+	}
+}
+
+// getSubscriptionHandler handles GET to /subscriptions/<subscription-name>
+func getSubscriptionHandler(ctx context.Context, w http.ResponseWriter, r *http.Request, client *pubsub.Client, subscr *pubsub.Subscription) {
+	cfg, err := subscr.Config(ctx)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeDetails(w, r, subscr.String(), subscriptionDetails(cfg))
+}
+
+// receiveHandler handles GET to /subscriptions/<subscription-name>/messages, returning the messages
+// received within the timeout (default a second), up to max
+func receiveHandler(_ context.Context, w http.ResponseWriter, r *http.Request, client *pubsub.Client, subscr *pubsub.Subscription) {
+	opts, err := parseReceiveOptions(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	dedup, err := parseReceiveDedup(r, subscr.ID())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	redeliveries := parseRedeliveryTracking(r, subscr.ID())
+	ackDelay, err := parseAckDelay(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	nackTimes, err := parseNackTimes(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	// each pull returns other messages
+	w.Header().Set("Cache-Control", "no-store")
+	if ackDelay > 0 || nackTimes > 0 {
+		if q := r.URL.Query(); q.Get("warm") == "true" || q.Get("warmSession") != "" || (ackDelay > 0 && nackTimes > 0) {
+			http.Error(w, "ackDelay and nackTimes can't be combined with each other or with warm sessions, which ack on pull",
+				http.StatusBadRequest)
+			return
+		}
+		if nackTimes > 0 {
+			receiveNackStorm(w, r, subscr, opts, nackTimes)
+		} else {
+			receiveAckExperiment(w, r, subscr, opts, ackDelay)
+		}
+		return
+	}
+
+	var (
+		outMu         sync.Mutex
+		out           int // messages written, including chaos duplicates
+		received      int
+		receivedBytes int
+	)
+	deliver := func(msg *pubsub.Message) {
+		if dedup != nil {
+			if key, seen := dedup.seen(subscr.ID(), msg); seen {
+				fmt.Fprintf(w, "[-] suppressed message ID %s: %s already delivered to this session\n", msg.ID, key)
+				return
+			}
+		}
+		if redeliveries != nil {
+			redeliveries.annotate(w, out, msg)
+		}
+		writeReceivedMessage(w, out, msg)
+		out++
+	}
+	if redeliveries != nil {
+		defer redeliveries.summary(w)
+	}
+	if q := r.URL.Query(); q.Get("warm") == "true" || q.Get("warmSession") != "" {
+		receiveWarm(w, r, client, subscr, opts, deliver)
+		return
+	}
+
+	end, ok := beginStream(w)
+	if !ok {
+		return
+	}
+	defer end()
+	ctx, cancel := withDrain(r.Context())
+	defer cancel()
+	ctx, cancel = context.WithTimeout(ctx, opts.timeout)
+	defer cancel()
+	if opts.max > 0 {
+		subscr.ReceiveSettings.MaxOutstandingMessages = opts.max
+	}
+
+	// Receive blocks until the context is cancelled or an error occurs;
+	// messages are streamed to the client as they arrive
+	handle := func(_ context.Context, msg *pubsub.Message) {
+		outMu.Lock()
+		defer outMu.Unlock()
+		if r.Context().Err() != nil || (opts.max > 0 && received == opts.max) {
+			// the client went away or has enough, leave the message for someone else
+			msg.Nack()
+			return
+		}
+		opts.settle(msg)
+		received++
+		receivedBytes += len(msg.Data)
+		deliver(msg)
+		// in chaos mode some messages are delivered to the client twice
+		if chaosModeAllowed() && chaosDuplicate() {
+			deliver(msg)
+		}
+		flushResponse(w)
+		if received == opts.max {
+			cancel()
+		}
+	}
+	// event streams are paced by the client (see sse.go)
+	if pacer := newSSEPacer(w, subscr); pacer != nil {
+		pacer.start(ctx, handle)
+		err = subscr.Receive(ctx, pacer.receive)
+		pacer.stop()
+	} else {
+		err = subscr.Receive(ctx, handle)
+	}
+	if err != nil {
+		fmt.Fprintf(w, "sub.Receive: %v", err)
+	} else if requestDeadlineExceeded(r) && (opts.max == 0 || received < opts.max) {
+		if out == 0 {
+			writeDeadlineExceeded(w, "before a message was received")
+		} else {
+			fmt.Fprintf(w, "request deadline reached after %d messages, before the timeout\n", received)
+		}
+	} else if r.Context().Err() == nil && (opts.max == 0 || received < opts.max) && draining() {
+		writeShutdownNotice(w)
+	}
+	recordReceived(subscr.ID(), received)
+	recordUsage(r, usageCounters{Received: int64(received), ReceivedBytes: int64(receivedBytes)})
+}
+
+// deleteSubscriptionHandler handles DELETE to /subscriptions/<subscription-name>; with
+// DELETE_CONFIRMATION=true, a subscription with a backlog needs confirm=<token>
+func deleteSubscriptionHandler(ctx context.Context, w http.ResponseWriter, r *http.Request, client *pubsub.Client, subscr *pubsub.Subscription) {
+	dryRun, ok := dryRunRequested(w, r)
+	if !ok {
+		return
+	}
+	if dryRun {
+		writeDeleteDryRun(w, "delete subscription "+subscr.String(), subscriptionDeletePlan(ctx, subscr))
+		return
+	}
+	if deleteConfirmationRequired() && !deleteConfirmed(w, r, subscriptionDeletePlan(ctx, subscr)) {
+		return
+	}
+	err := retryAdmin(ctx, adminOpDelete, func() error {
+		return subscr.Delete(ctx)
+	})
+	if err != nil {
+		writeAdminError(w, err, http.StatusServiceUnavailable)
+		return
+	}
+	noteResourceChange("deleted", "subscription", subscr.ID(), "")
+	fmt.Fprintf(w, "deleted subscription %s\n", subscr.String())
+}
+
+// writeReceivedMessage writes a received message as the i-th one of a receive response,
+// decrypting it if it was encrypted with a key this service has access to, and redacting it
+func writeReceivedMessage(w io.Writer, i int, msg *pubsub.Message) {
+	msg, err := decryptForDisplay(msg)
+	msg = redactMessage(msg)
+	if err != nil {
+		fmt.Fprintf(w, "[%d] Data (encrypted, base64): \"%s\"\n", i, base64.StdEncoding.EncodeToString(msg.Data))
+		fmt.Fprintf(w, "[%d] Not decrypted: %v\n", i, err)
+	} else {
+		fmt.Fprintf(w, "[%d] Data: \"%s\"\n", i, string(msg.Data))
+	}
+	if len(msg.Attributes) == 0 {
+		return
+	}
+	fmt.Fprintf(w, "[%d] Attributes:\n", i)
+	for key, value := range msg.Attributes {
+		fmt.Fprintf(w, "    %s = %s\n", key, value)
+	}
+}
+
+// flushResponse sends what was written so far to the client, so that long
+// listings are streamed instead of being held back in the response buffer
+func flushResponse(w http.ResponseWriter) {
+	if f, ok := w.(http.Flusher); ok {
+		f.Flush()
+	}
+}
@@ -0,0 +1,1340 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/pubsub"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/websocket"
+	"google.golang.org/grpc/codes"
+	grpcstatus "google.golang.org/grpc/status"
+
+	"helloworld/pkg/server/servertest"
+)
+
+const testProject = "test-project"
+
+// newTestServer returns a server backed by a fake Pub/Sub, and the fake
+func newTestServer(t *testing.T) (http.Handler, *servertest.Fake) {
+	t.Helper()
+	fake := servertest.NewFake()
+	// the server's state is the process's: the cached topic handles, connected to this fake,
+	// mustn't outlive it, and failures injected by earlier tests mustn't keep the breaker open
+	t.Cleanup(func() {
+		flushTopicCache()
+		topicCache.Lock()
+		if topicCache.client != nil {
+			topicCache.client.Close()
+			topicCache.client = nil
+		}
+		topicCache.Unlock()
+		fake.Close()
+	})
+	breaker.Lock()
+	breaker.failures = 0
+	setBreakerStateLocked(breakerClosed)
+	breaker.Unlock()
+	return NewServer(Options{ProjectID: testProject, ClientOptions: fake.ClientOptions()}), fake
+}
+
+// serve sends a request to the server, with a JSON body unless body is empty, and the header's
+// name and value pairs
+func serve(h http.Handler, method, target, body string, header ...string) *httptest.ResponseRecorder {
+	var rd io.Reader
+	if body != "" {
+		rd = strings.NewReader(body)
+	}
+	r := httptest.NewRequest(method, target, rd)
+	if body != "" {
+		r.Header.Set("Content-Type", mediaJSON)
+	}
+	for i := 0; i+1 < len(header); i += 2 {
+		r.Header.Set(header[i], header[i+1])
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	return w
+}
+
+// expect checks a response's status and that its body contains each of the strings
+func expect(t *testing.T, w *httptest.ResponseRecorder, status int, contains ...string) {
+	t.Helper()
+	if w.Code != status {
+		t.Fatalf("status %d, want %d; body:\n%s", w.Code, status, w.Body)
+	}
+	for _, s := range contains {
+		if !strings.Contains(w.Body.String(), s) {
+			t.Errorf("body doesn't contain %q:\n%s", s, w.Body)
+		}
+	}
+}
+
+// createTopicAndSubscription creates a topic and a subscription to it
+func createTopicAndSubscription(t *testing.T, h http.Handler, topic, subscr string) {
+	t.Helper()
+	expect(t, serve(h, http.MethodPut, "/topics", `{"name":"`+topic+`"}`), http.StatusOK)
+	expect(t, serve(h, http.MethodPut, "/subscriptions", `{"name":"`+subscr+`", "topic":"`+topic+`"}`), http.StatusOK)
+}
+
+func TestTopics(t *testing.T) {
+	h, _ := newTestServer(t)
+	expect(t, serve(h, http.MethodGet, "/topics", ""), http.StatusOK, "(none)")
+	expect(t, serve(h, http.MethodPut, "/topics", `{"name":"orders"}`), http.StatusOK,
+		"created topic projects/"+testProject+"/topics/orders")
+	expect(t, serve(h, http.MethodGet, "/topics", ""), http.StatusOK, "projects/"+testProject+"/topics/orders")
+	expect(t, serve(h, http.MethodPut, "/subscriptions", `{"name":"orders-audit", "topic":"orders"}`), http.StatusOK)
+	expect(t, serve(h, http.MethodGet, "/topics/orders", ""), http.StatusOK,
+		"projects/"+testProject+"/topics/orders", "Subscriptions: 1", "  projects/"+testProject+"/subscriptions/orders-audit")
+	expect(t, serve(h, http.MethodDelete, "/topics/orders", ""), http.StatusOK, "deleted topic projects/"+testProject+"/topics/orders")
+	expect(t, serve(h, http.MethodGet, "/topics/orders", ""), http.StatusNotFound, "topic orders not found")
+	expect(t, serve(h, http.MethodDelete, "/topics/orders", ""), http.StatusNotFound, "topic orders not found")
+}
+
+func TestSubscriptions(t *testing.T) {
+	h, _ := newTestServer(t)
+	expect(t, serve(h, http.MethodGet, "/subscriptions", ""), http.StatusOK, "(none)")
+	createTopicAndSubscription(t, h, "orders", "orders-audit")
+	expect(t, serve(h, http.MethodGet, "/subscriptions", ""), http.StatusOK, "projects/"+testProject+"/subscriptions/orders-audit")
+	expect(t, serve(h, http.MethodGet, "/subscriptions/orders-audit", ""), http.StatusOK, "projects/"+testProject+"/subscriptions/orders-audit")
+	expect(t, serve(h, http.MethodDelete, "/subscriptions/orders-audit", ""), http.StatusOK,
+		"deleted subscription projects/"+testProject+"/subscriptions/orders-audit")
+	expect(t, serve(h, http.MethodGet, "/subscriptions/orders-audit", ""), http.StatusNotFound, "subscription orders-audit not found")
+}
+
+func TestPublishAndReceive(t *testing.T) {
+	h, fake := newTestServer(t)
+	createTopicAndSubscription(t, h, "orders", "orders-audit")
+	expect(t, serve(h, http.MethodPost, "/topics/orders", `["one", {"data":"two", "attributes":{"source":"test"}, "clientId":"row-2"}]`),
+		http.StatusOK, "[0] published message ID", "[1] clientId row-2: published message ID")
+	if n := len(fake.Pubsub.Messages()); n != 2 {
+		t.Fatalf("%d messages published, want 2", n)
+	}
+	expect(t, serve(h, http.MethodGet, "/subscriptions/orders-audit/messages?max=2&timeout=5s", ""), http.StatusOK,
+		`Data: "one"`, `Data: "two"`, "source = test")
+	// the messages were acked
+	w := serve(h, http.MethodGet, "/subscriptions/orders-audit/messages?timeout=500ms", "")
+	expect(t, w, http.StatusOK)
+	if strings.Contains(w.Body.String(), "Data:") {
+		t.Errorf("acked messages received again:\n%s", w.Body)
+	}
+}
+
+func TestPublishPartialFailure(t *testing.T) {
+	h, fake := newTestServer(t)
+	expect(t, serve(h, http.MethodPut, "/topics", `{"name":"orders"}`), http.StatusOK)
+	body := `["one", {"data":"", "clientId":"empty"}, "three"]`
+	expect(t, serve(h, http.MethodPost, "/topics/orders", body), http.StatusMultiStatus,
+		"[0] published message ID", "[1] clientId empty: invalid: a message needs data", "[2] published message ID")
+	if n := len(fake.Pubsub.Messages()); n != 2 {
+		t.Fatalf("%d messages published, want 2", n)
+	}
+	fake.Pubsub.ClearMessages()
+	expect(t, serve(h, http.MethodPost, "/topics/orders?atomic=true", body), http.StatusUnprocessableEntity,
+		"no messages published: 1 of 3 messages invalid", "[1] invalid: a message needs data")
+	if n := len(fake.Pubsub.Messages()); n != 0 {
+		t.Fatalf("%d messages published, want none", n)
+	}
+	expect(t, serve(h, http.MethodPost, "/topics/orders?atomic=true", `["one", "two"]`), http.StatusOK)
+}
+
+func TestPublishAtomicSchema(t *testing.T) {
+	h, fake := newTestServer(t)
+	ctx := context.Background()
+	sc, err := pubsub.NewSchemaClient(ctx, testProject, fake.ClientOptions()...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sc.Close()
+	schema, err := sc.CreateSchema(ctx, "order", pubsub.SchemaConfig{Type: pubsub.SchemaAvro,
+		Definition: `{"type":"record", "name":"Order", "fields":[{"name":"id", "type":"string"}]}`})
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := pubsub.NewClient(ctx, testProject, fake.ClientOptions()...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	_, err = client.CreateTopicWithConfig(ctx, "orders", &pubsub.TopicConfig{
+		SchemaSettings: &pubsub.SchemaSettings{Schema: schema.Name, Encoding: pubsub.EncodingJSON}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect(t, serve(h, http.MethodPost, "/topics/orders?atomic=true", `["{\"id\":\"42\"}", "{\"id\":42}"]`),
+		http.StatusUnprocessableEntity, "[1] invalid: data doesn't match schema "+schema.Name)
+	expect(t, serve(h, http.MethodPost, "/topics/orders?atomic=true", `["{\"id\":\"42\"}"]`), http.StatusOK)
+}
+
+func TestPublishLogReplay(t *testing.T) {
+	h, fake := newTestServer(t)
+	os.Setenv("STATE_FILE", filepath.Join(t.TempDir(), "state.db"))
+	defer os.Unsetenv("STATE_FILE")
+	startStateStore()
+	defer func() {
+		stopStateStore()
+		stateStore.db = nil
+	}()
+	expect(t, serve(h, http.MethodPut, "/topics", `{"name":"orders"}`), http.StatusOK)
+	expect(t, serve(h, http.MethodPut, "/topics", `{"name":"orders-fixed"}`), http.StatusOK)
+	expect(t, serve(h, http.MethodPost, "/topics/orders", `["one", "two"]`), http.StatusOK)
+	expect(t, serve(h, http.MethodPost, "/replays", `{}`), http.StatusBadRequest, "select the publishes")
+	expect(t, serve(h, http.MethodPost, "/replays", `{"topic":"orders", "dryRun":true}`), http.StatusOK,
+		"2 logged publishes match", "[1] ", "topic=orders", "[2] ")
+	expect(t, serve(h, http.MethodPost, "/replays", `{"from":2, "target":"orders-fixed"}`), http.StatusOK,
+		"[2] republished to orders-fixed as message ID")
+	msgs := fake.Pubsub.Messages()
+	if len(msgs) != 3 || string(msgs[2].Data) != "two" {
+		t.Fatalf("%d messages published, want the second one replayed", len(msgs))
+	}
+	expect(t, serve(h, http.MethodPost, "/replays", `{"topic":"orders-fixed", "dryRun":true}`), http.StatusOK,
+		"1 logged publishes match", "replayOf=2")
+	expect(t, serve(h, http.MethodPost, "/replays", `{"from":1, "target":"missing"}`), http.StatusNotFound, "topic missing not found")
+}
+
+func TestExpiring(t *testing.T) {
+	h, _ := newTestServer(t)
+	createTopicAndSubscription(t, h, "orders", "orders-audit")
+	expect(t, serve(h, http.MethodGet, "/expiring?window=26h", ""), http.StatusOK,
+		"Subscriptions expiring within 26h0m0s", "[0] orders-audit expires around", "(created 0s ago)")
+	expect(t, serve(h, http.MethodGet, "/expiring?window=1h", ""), http.StatusOK, "(none)")
+	expect(t, serve(h, http.MethodGet, "/expiring?window=soon", ""), http.StatusBadRequest)
+}
+
+func TestNamingPolicy(t *testing.T) {
+	os.Setenv("AWS_FACADE", "true")
+	defer os.Unsetenv("AWS_FACADE")
+	h, _ := newTestServer(t)
+	file := filepath.Join(t.TempDir(), "naming.json")
+	err := os.WriteFile(file, []byte(`[{"name":"team", "pattern":"{team}-[a-z0-9-]+", "variables":{"team":["payments","search"]},
+		"requiredLabels":{"team":"{team}", "owner":""}, "example":"payments-orders"}]`), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.Setenv("NAMING_POLICY_FILE", file)
+	loadNamingPolicy()
+	defer func() {
+		os.Unsetenv("NAMING_POLICY_FILE")
+		loadNamingPolicy()
+	}()
+	expect(t, serve(h, http.MethodPut, "/topics", `{"name":"test123"}`), http.StatusUnprocessableEntity,
+		`topic name "test123" doesn't follow the naming policy`, "team: {team}-[a-z0-9-]+ where {team} is one of payments, search (e.g. payments-orders)")
+	expect(t, serve(h, http.MethodPut, "/topics", `{"name":"payments-orders", "labels":{"team":"search"}}`), http.StatusUnprocessableEntity,
+		"matches rule team, which requires the labels owner=<any value>, team=payments (not \"search\")")
+	expect(t, serve(h, http.MethodPut, "/topics", `{"name":"payments-orders", "labels":{"team":"payments", "owner":"ana"}}`), http.StatusOK)
+	expect(t, serve(h, http.MethodPost, "/topics:batchCreate", `[{"name":"test123"}]`), http.StatusOK,
+		`[0] topic name "test123" doesn't follow the naming policy`)
+	expect(t, serve(h, http.MethodPost, "/topics/payments-orders/clone", `{"newName":"search-orders"}`), http.StatusUnprocessableEntity,
+		"team=search (not \"payments\")")
+
+	// the other protocols are held to the same policy
+	gql := func(mutation string) string {
+		w := serve(h, http.MethodPost, "/graphql", `{"query":"mutation { `+strings.ReplaceAll(mutation, `"`, `\"`)+` }"}`)
+		expect(t, w, http.StatusOK)
+		return w.Body.String()
+	}
+	if body := gql(`createTopic(name: "test456") { name }`); !strings.Contains(body, "doesn't follow the naming policy") {
+		t.Errorf("GraphQL created a topic against the naming policy: %s", body)
+	}
+	if body := gql(`createTopic(name: "search-orders", labels: [{key: "team", value: "search"}, {key: "owner", value: "bo"}]) { name }`); strings.Contains(body, "errors") {
+		t.Errorf("GraphQL createTopic failed: %s", body)
+	}
+	expect(t, serve(h, http.MethodPost, "/aws?Action=CreateTopic&Name=test456", ""), http.StatusBadRequest,
+		"<Code>InvalidParameter</Code>", "doesn&#39;t follow the naming policy")
+	expect(t, serve(h, http.MethodPost, "/aws?Action=CreateTopic&Name=search-events&Tags.member.1.Key=team&Tags.member.1.Value=search"+
+		"&Tags.member.2.Key=owner&Tags.member.2.Value=bo", ""), http.StatusOK)
+	expect(t, serve(h, http.MethodPost, "/aws?Action=CreateQueue&QueueName=test456", ""), http.StatusBadRequest, "<Code>InvalidParameterValue</Code>")
+	expect(t, serve(h, http.MethodPut, "/priority", `{"name":"test456"}`), http.StatusUnprocessableEntity, "doesn't follow the naming policy")
+}
+
+func TestPublishPolicy(t *testing.T) {
+	h, _ := newTestServer(t)
+	file := filepath.Join(t.TempDir(), "policy.json")
+	if err := os.WriteFile(file, []byte(`[{"principal":"team-x", "key":"secret-x", "topics":["team-x-*"]}]`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	createTopicAndSubscription(t, h, "orders", "orders-audit")
+	expect(t, serve(h, http.MethodPut, "/topics", `{"name":"team-x-orders"}`), http.StatusOK)
+	os.Setenv("PUBLISH_POLICY_FILE", file)
+	loadPublishPolicy()
+	defer func() {
+		os.Unsetenv("PUBLISH_POLICY_FILE")
+		loadPublishPolicy()
+	}()
+	key := []string{APIKeyHeader, "secret-x"}
+	expect(t, serve(h, http.MethodPost, "/topics/orders", `["x"]`, key...), http.StatusForbidden, "principal team-x may not publish to topic orders")
+
+	// the other protocols are held to the same policy
+	gql := func(topic string) string {
+		w := serve(h, http.MethodPost, "/graphql", `{"query":"mutation { publish(topic: \"`+topic+`\", messages: [\"x\"]) }"}`, key...)
+		expect(t, w, http.StatusOK)
+		return w.Body.String()
+	}
+	if body := gql("orders"); !strings.Contains(body, "principal team-x may not publish to topic orders") {
+		t.Errorf("GraphQL publish allowed: %s", body)
+	}
+	if body := gql("team-x-orders"); strings.Contains(body, "errors") {
+		t.Errorf("GraphQL publish denied: %s", body)
+	}
+
+	srv := httptest.NewServer(h)
+	defer srv.Close()
+	cfg, err := websocket.NewConfig("ws"+strings.TrimPrefix(srv.URL, "http")+"/stomp", srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.Protocol = []string{"v12.stomp"}
+	cfg.Header = http.Header{APIKeyHeader: {"secret-x"}}
+	ws, err := websocket.DialConfig(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ws.Close()
+	frame := func(f string) string {
+		if err := websocket.Message.Send(ws, f+"\x00"); err != nil {
+			t.Fatal(err)
+		}
+		var reply string
+		if err := websocket.Message.Receive(ws, &reply); err != nil {
+			t.Fatal(err)
+		}
+		return reply
+	}
+	if reply := frame("CONNECT\naccept-version:1.2\n\n"); !strings.HasPrefix(reply, "CONNECTED") {
+		t.Fatalf("CONNECT: %s", reply)
+	}
+	if reply := frame("SEND\ndestination:/topic/orders\nreceipt:1\n\nx"); !strings.HasPrefix(reply, "ERROR") ||
+		!strings.Contains(reply, "principal team-x may not publish to topic orders") {
+		t.Errorf("STOMP SEND allowed: %s", reply)
+	}
+}
+
+func TestTrash(t *testing.T) {
+	os.Setenv("AWS_FACADE", "true")
+	defer os.Unsetenv("AWS_FACADE")
+	h, _ := newTestServer(t)
+	os.Setenv("TRASH_RETENTION", "24h")
+	startTrash()
+	defer func() {
+		os.Unsetenv("TRASH_RETENTION")
+		startTrash()
+	}()
+	createTopicAndSubscription(t, h, "orders", "orders-audit")
+	expect(t, serve(h, http.MethodDelete, "/topics/orders", ""), http.StatusOK, "moved topic projects/test-project/topics/orders to the trash, detaching 1 subscriptions")
+	expect(t, serve(h, http.MethodPost, "/topics/orders", `["x"]`), http.StatusGone, "topic orders is in the trash since")
+	expect(t, serve(h, http.MethodGet, "/trash", ""), http.StatusOK, "trash retention=24h0m0s topics=1", "[0] orders trashed at", "subscriptions [orders-audit]")
+	expect(t, serve(h, http.MethodPost, "/trash/orders/restore", ""), http.StatusOK, "recreated subscription orders-audit", "restored topic")
+	expect(t, serve(h, http.MethodGet, "/topics/orders", ""), http.StatusOK, "orders-audit")
+	expect(t, serve(h, http.MethodPost, "/trash/orders/restore", ""), http.StatusNotFound, "topic orders is not in the trash")
+
+	expect(t, serve(h, http.MethodDelete, "/topics/orders", ""), http.StatusOK)
+	expect(t, serve(h, http.MethodDelete, "/trash/orders", ""), http.StatusOK, "purged topic")
+	expect(t, serve(h, http.MethodGet, "/topics/orders", ""), http.StatusNotFound)
+	expect(t, serve(h, http.MethodGet, "/subscriptions/orders-audit", ""), http.StatusNotFound)
+
+	// bulk deletes go to the trash too
+	createTopicAndSubscription(t, h, "demo-a", "demo-a-audit")
+	expect(t, serve(h, http.MethodDelete, "/topics?match=demo-*", ""), http.StatusBadRequest, "add confirm=true to trash these 1 topics")
+	expect(t, serve(h, http.MethodDelete, "/topics?match=demo-*&confirm=true", ""), http.StatusOK, "[0] moved topic demo-a to the trash, detaching 1 subscriptions")
+	expect(t, serve(h, http.MethodPost, "/trash/demo-a/restore", ""), http.StatusOK, "recreated subscription demo-a-audit", "restored topic")
+
+	// and so do those of GraphQL and the AWS facade
+	createTopicAndSubscription(t, h, "graph", "graph-audit")
+	expect(t, serve(h, http.MethodPost, "/graphql", `{"query":"mutation { deleteTopic(name: \"graph\") }"}`), http.StatusOK, `"deleteTopic":true`)
+	expect(t, serve(h, http.MethodPost, "/trash/graph/restore", ""), http.StatusOK, "recreated subscription graph-audit", "restored topic")
+	createTopicAndSubscription(t, h, "sns", "sns-audit")
+	expect(t, serve(h, http.MethodPost, "/aws?Action=DeleteTopic&TopicArn=arn:aws:sns:us-east-1:000000000000:sns", ""), http.StatusOK)
+	expect(t, serve(h, http.MethodPost, "/trash/sns/restore", ""), http.StatusOK, "recreated subscription sns-audit", "restored topic")
+}
+
+func TestDeleteConfirmation(t *testing.T) {
+	os.Setenv("AWS_FACADE", "true")
+	defer os.Unsetenv("AWS_FACADE")
+	h, _ := newTestServer(t)
+	os.Setenv("DELETE_CONFIRMATION", "true")
+	defer os.Unsetenv("DELETE_CONFIRMATION")
+	createTopicAndSubscription(t, h, "orders", "orders-audit")
+	expect(t, serve(h, http.MethodPut, "/topics", `{"name":"empty"}`), http.StatusOK)
+	expect(t, serve(h, http.MethodDelete, "/topics/empty", ""), http.StatusOK, "deleted topic")
+	expect(t, serve(h, http.MethodDelete, "/topics/orders", ""), http.StatusPreconditionRequired, "GET /topics/orders/delete-plan")
+	w := serve(h, http.MethodGet, "/topics/orders/delete-plan", "")
+	expect(t, w, http.StatusOK, "subscription orders-audit is detached", "confirmation token: ")
+	token := strings.Fields(strings.SplitAfter(w.Body.String(), "confirmation token: ")[1])[0]
+	expect(t, serve(h, http.MethodDelete, "/topics/orders?confirm=nope", ""), http.StatusPreconditionRequired, "unknown, used or expired")
+	// bulk deletes only delete what loses nothing
+	expect(t, serve(h, http.MethodDelete, "/topics?match=ord*&confirm=true", ""), http.StatusPreconditionRequired,
+		"deleting 1 of these topics loses data", "subscription orders-audit is detached")
+	expect(t, serve(h, http.MethodDelete, "/subscriptions?match=orders-*&confirm=true", ""), http.StatusPreconditionRequired,
+		"deleting 1 of these subscriptions loses data", "its backlog is unknown")
+	expect(t, serve(h, http.MethodPut, "/topics", `{"name":"empty"}`), http.StatusOK)
+	expect(t, serve(h, http.MethodDelete, "/topics?match=emp*&confirm=true", ""), http.StatusOK, "[0] deleted topic empty")
+	// the AWS facade can't pass a token, GraphQL takes it as an argument
+	expect(t, serve(h, http.MethodPost, "/aws?Action=DeleteTopic&TopicArn=arn:aws:sns:us-east-1:000000000000:orders", ""),
+		http.StatusBadRequest, "deleting topic orders loses data")
+	expect(t, serve(h, http.MethodPost, "/aws/000000000000/orders-audit?Action=DeleteQueue", ""), http.StatusBadRequest,
+		"deleting subscription orders-audit loses data")
+	gql := func(mutation string) string {
+		w := serve(h, http.MethodPost, "/graphql", `{"query":"mutation { `+strings.ReplaceAll(mutation, `"`, `\"`)+` }"}`)
+		expect(t, w, http.StatusOK)
+		return w.Body.String()
+	}
+	if body := gql(`deleteSubscription(name: "orders-audit")`); !strings.Contains(body, "deleting subscription orders-audit loses data") {
+		t.Errorf("GraphQL delete without a token: %s", body)
+	}
+	if body := gql(`deleteTopic(name: "orders", confirm: "` + token + `")`); !strings.Contains(body, `"deleteTopic":true`) {
+		t.Errorf("GraphQL delete with a token: %s", body)
+	}
+	createTopicAndSubscription(t, h, "invoices", "invoices-audit")
+	w = serve(h, http.MethodGet, "/topics/invoices/delete-plan", "")
+	token = strings.Fields(strings.SplitAfter(w.Body.String(), "confirmation token: ")[1])[0]
+	expect(t, serve(h, http.MethodDelete, "/topics/invoices?confirm="+token, ""), http.StatusOK, "deleted topic")
+}
+
+func TestDryRun(t *testing.T) {
+	h, _ := newTestServer(t)
+	createTopicAndSubscription(t, h, "orders", "orders-audit")
+	expect(t, serve(h, http.MethodPut, "/topics?dryRun=true", `{"name":"invoices", "labels":{"team":"billing"}}`), http.StatusOK,
+		"dry run, nothing changed: would create topic projects/test-project/topics/invoices", "Labels: created-at=", "team=billing")
+	expect(t, serve(h, http.MethodGet, "/topics/invoices", ""), http.StatusNotFound)
+	expect(t, serve(h, http.MethodPut, "/topics?dryRun=true", `{"name":"orders"}`), http.StatusConflict, "topic orders already exists")
+	expect(t, serve(h, http.MethodPut, "/subscriptions?dryRun=true", `{"name":"orders-new", "topic":"orders", "retentionDuration":"1h"}`), http.StatusOK,
+		"would create subscription projects/test-project/subscriptions/orders-new", "Topic: orders", "Retention duration: 1h0m0s")
+	expect(t, serve(h, http.MethodPut, "/subscriptions?dryRun=true", `{"name":"orders-new", "topic":"missing"}`), http.StatusNotFound)
+	expect(t, serve(h, http.MethodPost, "/topics:batchCreate?dryRun=true", `[{"name":"invoices"}, {"name":"orders"}]`), http.StatusOK,
+		"[0] would create topic projects/test-project/topics/invoices (dry run)", "[1] topic orders already exists")
+	expect(t, serve(h, http.MethodDelete, "/topics/orders?dryRun=true", ""), http.StatusOK,
+		"would delete topic projects/test-project/topics/orders", "subscription orders-audit is detached")
+	expect(t, serve(h, http.MethodDelete, "/topics?match=ord*&dryRun=true", ""), http.StatusOK, "would delete these 1 topics:", "orders")
+	// routes that can't preview their changes refuse dry runs rather than make them
+	expect(t, serve(h, http.MethodPut, "/schedules?dryRun=true", `{"name":"tick", "topic":"orders", "schedule":"@every 1m"}`),
+		http.StatusBadRequest, "PUT /schedules doesn't support dryRun")
+	expect(t, serve(h, http.MethodGet, "/schedules/tick", ""), http.StatusNotFound)
+	expect(t, serve(h, http.MethodGet, "/topics?dryRun=true", ""), http.StatusOK)
+	etag := serve(h, http.MethodGet, "/subscriptions/orders-audit", "").Header().Get("ETag")
+	expect(t, serve(h, http.MethodPatch, "/subscriptions/orders-audit?dryRun=true", `{"retainAckedMessages":true}`, "If-Match", etag), http.StatusOK,
+		"would update subscription", "Retain acked messages: false -> true")
+	expect(t, serve(h, http.MethodGet, "/topics/orders", ""), http.StatusOK, "orders-audit")
+	expect(t, serve(h, http.MethodPut, "/topics?dryRun=maybe", `{"name":"x"}`), http.StatusBadRequest, "dryRun must be true or false")
+}
+
+func TestDiff(t *testing.T) {
+	h, _ := newTestServer(t)
+	createTopicAndSubscription(t, h, "orders", "orders-audit")
+	expect(t, serve(h, http.MethodPut, "/topics", `{"name":"old-demo"}`), http.StatusOK)
+	expect(t, serve(h, http.MethodPost, "/diff", `{"topics":["orders", "invoices"], "subscriptions":[
+		{"name":"orders-audit", "topic":"invoices", "labels":{"team":"billing"}, "retainAckedMessages":true},
+		{"name":"invoices-audit", "topic":"invoices"}]}`), http.StatusOK,
+		"+ topic invoices\n", "- topic old-demo\n", "+ subscription invoices-audit\n    Topic: invoices",
+		"~ subscription orders-audit\n    topic: orders -> invoices", "labels.team: (none) -> billing", "retainAckedMessages: false -> true",
+		"2 to create, 1 to update, 1 to delete")
+	expect(t, serve(h, http.MethodPost, "/diff", `{"topics":["orders", "old-demo"], "subscriptions":[{"name":"orders-audit", "topic":"orders"}]}`),
+		http.StatusOK, "no changes")
+	expect(t, serve(h, http.MethodPost, "/diff", `{"subscriptions":[{"name":"x"}]}`), http.StatusBadRequest, "topic")
+}
+
+func TestWatch(t *testing.T) {
+	h, fake := newTestServer(t)
+	os.Setenv("WATCH_INTERVAL", "50ms")
+	defer os.Unsetenv("WATCH_INTERVAL")
+	srv := httptest.NewServer(h)
+	defer srv.Close()
+	resp, err := (&http.Client{Timeout: 5 * time.Second}).Get(srv.URL + "/watch?kind=topic")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	events := bufio.NewReader(resp.Body)
+	next := func(want string) {
+		t.Helper()
+		line, err := events.ReadString('\n')
+		if err != nil || !strings.Contains(line, want) {
+			t.Fatalf("got %q (%v), want a line with %q", line, err, want)
+		}
+	}
+	next("watching topics")
+	// the first listing, the one later ones are compared with, is done by now
+	time.Sleep(200 * time.Millisecond)
+	createTopicAndSubscription(t, h, "orders", "orders-audit")
+	next("created topic orders source=api")
+	client, err := pubsub.NewClient(context.Background(), testProject, fake.ClientOptions()...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	if _, err := client.CreateTopic(context.Background(), "external"); err != nil {
+		t.Fatal(err)
+	}
+	next("created topic external source=reconcile")
+}
+
+func TestSummary(t *testing.T) {
+	h, fake := newTestServer(t)
+	createTopicAndSubscription(t, h, "orders", "orders-audit")
+	expect(t, serve(h, http.MethodPut, "/topics", `{"name":"invoices"}`), http.StatusOK)
+	expect(t, serve(h, http.MethodPut, "/topics", `{"name":"orders-dead"}`), http.StatusOK)
+	client, err := pubsub.NewClient(context.Background(), testProject, fake.ClientOptions()...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	_, err = client.CreateSubscription(context.Background(), "orders-billing", pubsub.SubscriptionConfig{
+		Topic:            client.Topic("orders"),
+		DeadLetterPolicy: &pubsub.DeadLetterPolicy{DeadLetterTopic: client.Topic("orders-dead").String(), MaxDeliveryAttempts: 5},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expect(t, serve(h, http.MethodGet, "/summary?backlog=false", ""), http.StatusOK,
+		"topics: 3 (0 in the trash)",
+		"subscriptions: 2 (2 pull, 0 push, 0 detached)",
+		"estimated backlog: not read",
+		"findings: 3",
+		"subscriptions without a dead-letter policy (those on dead-letter topics aside) (1): orders-audit",
+		"topics without subscriptions (not counting the trash) (2): invoices, orders-dead")
+	expect(t, serve(h, http.MethodGet, "/summary?backlog=maybe", ""), http.StatusBadRequest)
+}
+
+func TestOrphans(t *testing.T) {
+	h, fake := newTestServer(t)
+	createTopicAndSubscription(t, h, "orders", "orders-audit")
+	expect(t, serve(h, http.MethodPut, "/topics", `{"name":"invoices"}`), http.StatusOK)
+	createTopicAndSubscription(t, h, "refunds", "refunds-audit")
+	expect(t, serve(h, http.MethodDelete, "/topics/refunds", ""), http.StatusOK)
+	client, err := pubsub.NewClient(context.Background(), testProject, fake.ClientOptions()...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	if _, err := client.CreateTopic(context.Background(), "external"); err != nil {
+		t.Fatal(err)
+	}
+
+	expect(t, serve(h, http.MethodGet, "/orphans", ""), http.StatusOK,
+		"[0] subscription refunds-audit: its topic was deleted",
+		"1 topics without subscriptions left out")
+	w := serve(h, http.MethodGet, "/orphans?age=0s", "")
+	expect(t, w, http.StatusOK,
+		"[0] subscription refunds-audit: its topic was deleted",
+		"[1] topic invoices: no subscriptions",
+		"cleanup token: ")
+	token := strings.Fields(strings.SplitAfter(w.Body.String(), "cleanup token: ")[1])[0]
+
+	expect(t, serve(h, http.MethodDelete, "/orphans?age=0s", ""), http.StatusPreconditionRequired)
+	expect(t, serve(h, http.MethodDelete, "/orphans?confirm="+token, ""), http.StatusPreconditionRequired, "issued for age=0s")
+	expect(t, serve(h, http.MethodDelete, "/orphans?age=0s&confirm="+token, ""), http.StatusPreconditionRequired, "unknown, used or expired")
+
+	w = serve(h, http.MethodGet, "/orphans?age=0s", "")
+	token = strings.Fields(strings.SplitAfter(w.Body.String(), "cleanup token: ")[1])[0]
+	expect(t, serve(h, http.MethodPut, "/topics", `{"name":"payments"}`), http.StatusOK)
+	expect(t, serve(h, http.MethodDelete, "/orphans?age=0s&confirm="+token, ""), http.StatusOK,
+		"skipped topic payments: orphaned since the token was issued",
+		"deleted subscription refunds-audit",
+		"deleted topic invoices")
+	expect(t, serve(h, http.MethodGet, "/orphans?age=0s", ""), http.StatusOK, "[0] topic payments")
+	expect(t, serve(h, http.MethodGet, "/topics/orders", ""), http.StatusOK)
+}
+
+func TestDrift(t *testing.T) {
+	h, fake := newTestServer(t)
+	drift.Lock()
+	drift.topic = "ops-events"
+	drift.Unlock()
+	defer func() {
+		drift.Lock()
+		drift.topic, drift.published = "", 0
+		drift.Unlock()
+	}()
+	createTopicAndSubscription(t, h, "ops-events", "ops-audit")
+
+	expect(t, serve(h, http.MethodGet, "/drift", ""), http.StatusNotFound, "no baseline registered")
+	expect(t, serve(h, http.MethodPut, "/drift/baseline", `{"topics":["orders"]}`), http.StatusOK, "registered a baseline of 1 topics")
+	expect(t, serve(h, http.MethodPut, "/drift/baseline", `{"topics":["orders", "ops-events"], "subscriptions":[
+		{"name":"orders-audit", "topic":"orders"}, {"name":"ops-audit", "topic":"ops-events"}]}`),
+		http.StatusOK, "registered a baseline of 2 topics and 2 subscriptions")
+	defer serve(h, http.MethodDelete, "/drift/baseline", "")
+	expect(t, serve(h, http.MethodGet, "/drift/baseline", ""), http.StatusOK, "topic orders", "subscription orders-audit on topic orders")
+	expect(t, serve(h, http.MethodGet, "/drift", ""), http.StatusOK, "not checked yet")
+	expect(t, serve(h, http.MethodGet, "/drift?refresh=true", ""), http.StatusOK,
+		"+ topic orders", "+ subscription orders-audit", "drift: 2 missing, 0 changed, 0 unexpected", "published=1")
+
+	createTopicAndSubscription(t, h, "orders", "orders-audit")
+	expect(t, serve(h, http.MethodPut, "/topics", `{"name":"stray"}`), http.StatusOK)
+	expect(t, serve(h, http.MethodGet, "/drift?refresh=true", ""), http.StatusOK, "- topic stray", "drift: 0 missing, 0 changed, 1 unexpected")
+	expect(t, serve(h, http.MethodGet, "/metrics", ""), http.StatusOK, `second_drift_resources{change="unexpected"} 1`)
+	// an unchanged drift isn't published again
+	expect(t, serve(h, http.MethodGet, "/drift?refresh=true", ""), http.StatusOK, "published=2")
+
+	expect(t, serve(h, http.MethodDelete, "/topics/stray", ""), http.StatusOK)
+	expect(t, serve(h, http.MethodGet, "/drift?refresh=true", ""), http.StatusOK, "no drift", "published=3")
+	messages := fake.Pubsub.Messages()
+	if len(messages) != 3 || messages[2].Attributes["drift"] != "resolved" || !strings.Contains(string(messages[1].Data), `"unexpected":1`) {
+		t.Errorf("drift events published: %v", messages)
+	}
+
+	expect(t, serve(h, http.MethodDelete, "/drift/baseline", ""), http.StatusOK)
+	expect(t, serve(h, http.MethodGet, "/drift/baseline", ""), http.StatusNotFound)
+}
+
+func TestWorkshopTokens(t *testing.T) {
+	h, _ := newTestServer(t)
+	os.Setenv("ADMIN_TOKEN", "admin-secret")
+	defer os.Unsetenv("ADMIN_TOKEN")
+	admin := []string{"Authorization", "Bearer admin-secret"}
+	createTopicAndSubscription(t, h, "team7-orders", "team7-orders-audit")
+	createTopicAndSubscription(t, h, "team8-orders", "team8-orders-audit")
+
+	expect(t, serve(h, http.MethodPost, "/admin/tokens", `{"principal":"attendee-3", "names":"team7-*", "verbs":["read"]}`), http.StatusUnauthorized)
+	expect(t, serve(h, http.MethodPost, "/admin/tokens", `{"principal":"attendee-3", "names":"team7-*", "verbs":["read"], "expiresIn":"48h"}`, admin...),
+		http.StatusBadRequest, "at most 24h")
+	w := serve(h, http.MethodPost, "/admin/tokens", `{"principal":"attendee-3", "names":"team7-*", "verbs":["read", "publish"], "expiresIn":"4h"}`, admin...)
+	expect(t, w, http.StatusCreated, "names=team7-* verbs=read,publish state=active")
+	token := []string{"Authorization", "Bearer " + strings.Fields(strings.SplitAfter(w.Body.String(), "token: ")[1])[0]}
+
+	w = serve(h, http.MethodGet, "/topics", "", token...)
+	expect(t, w, http.StatusOK, "team7-orders")
+	if strings.Contains(w.Body.String(), "team8") {
+		t.Errorf("the token lists topics outside its pattern:\n%s", w.Body)
+	}
+	expect(t, serve(h, http.MethodPost, "/topics/team7-orders", `["hello"]`, token...), http.StatusOK, "published message ID")
+	expect(t, serve(h, http.MethodPost, "/topics/team8-orders", `["hello"]`, token...), http.StatusForbidden, "only reaches names matching team7-*")
+	expect(t, serve(h, http.MethodPut, "/topics", `{"name":"team7-invoices"}`, token...), http.StatusForbidden, "may not create")
+	expect(t, serve(h, http.MethodGet, "/summary", "", token...), http.StatusForbidden, "not available to workshop tokens")
+
+	os.Setenv("ACCESS_TOKENS_REQUIRED", "true")
+	defer os.Unsetenv("ACCESS_TOKENS_REQUIRED")
+	expect(t, serve(h, http.MethodGet, "/topics", ""), http.StatusUnauthorized, "workshop token or the admin token is required")
+	expect(t, serve(h, http.MethodGet, "/topics", "", admin...), http.StatusOK, "team8-orders")
+	expect(t, serve(h, http.MethodGet, "/readyz", ""), http.StatusOK)
+
+	w = serve(h, http.MethodGet, "/admin/tokens", "", admin...)
+	id := strings.TrimSuffix(strings.Fields(strings.SplitAfter(w.Body.String(), "---------------\n")[1])[0], ":")
+	expect(t, serve(h, http.MethodDelete, "/admin/tokens/"+id, "", admin...), http.StatusOK, "revoked workshop token "+id)
+	expect(t, serve(h, http.MethodGet, "/topics", "", token...), http.StatusUnauthorized, "unknown or revoked")
+}
+
+func TestRequestDeadline(t *testing.T) {
+	h, _ := newTestServer(t)
+	createTopicAndSubscription(t, h, "orders", "orders-audit")
+
+	expect(t, serve(h, http.MethodGet, "/topics/orders", "", "X-Request-Deadline", "soon"), http.StatusBadRequest, "X-Request-Deadline must be")
+	expect(t, serve(h, http.MethodGet, "/topics/orders", "", "Request-Timeout", "-1"), http.StatusBadRequest, "Request-Timeout must be")
+	expect(t, serve(h, http.MethodGet, "/topics/orders", "", "X-Request-Deadline", time.Now().Add(-time.Second).Format(time.RFC3339)),
+		http.StatusGatewayTimeout, "has passed")
+	expect(t, serve(h, http.MethodPost, "/topics/orders", `["one"]`, "Request-Timeout", "5"), http.StatusOK, "published message ID")
+
+	// the pull's 5s timeout is cut short by the deadline
+	start := time.Now()
+	expect(t, serve(h, http.MethodGet, "/subscriptions/orders-audit/messages?max=2&timeout=5s", "", "X-Request-Deadline", "1s"),
+		http.StatusOK, `Data: "one"`, "request deadline reached after 1 messages")
+	expect(t, serve(h, http.MethodGet, "/subscriptions/orders-audit/messages?timeout=5s", "", "X-Request-Deadline", "500ms"),
+		http.StatusGatewayTimeout, "request deadline exceeded before a message was received")
+	if d := time.Since(start); d > 8*time.Second {
+		t.Errorf("the pulls took %s, past their deadlines", d)
+	}
+}
+
+func TestHTTPServer(t *testing.T) {
+	h, _ := newTestServer(t)
+	os.Setenv("H2C", "true")
+	os.Setenv("HTTP_MAX_CONNECTIONS", "2")
+	defer os.Unsetenv("H2C")
+	defer os.Unsetenv("HTTP_MAX_CONNECTIONS")
+	srv := NewHTTPServer("127.0.0.1:0", h)
+	if srv.IdleTimeout != defaultHTTPIdleTimeout || srv.ReadHeaderTimeout != defaultHTTPReadHeaderTimeout || srv.WriteTimeout != 0 {
+		t.Errorf("timeouts: idle %s, read header %s, write %s", srv.IdleTimeout, srv.ReadHeaderTimeout, srv.WriteTimeout)
+	}
+	ln, err := Listen(srv.Addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go srv.Serve(ln)
+	defer srv.Close()
+
+	// HTTP/2 with prior knowledge, without TLS
+	h2 := &http.Client{Timeout: 5 * time.Second, Transport: &http2.Transport{
+		AllowHTTP: true,
+		DialTLS: func(network, addr string, _ *tls.Config) (net.Conn, error) {
+			return net.Dial(network, addr)
+		},
+	}}
+	resp, err := h2.Get("http://" + ln.Addr().String() + "/topics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || resp.ProtoMajor != 2 {
+		t.Errorf("got %s over %s", resp.Status, resp.Proto)
+	}
+
+	// HTTP/1.1 as before
+	resp, err = (&http.Client{Timeout: 5 * time.Second}).Get("http://" + ln.Addr().String() + "/topics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || resp.ProtoMajor != 1 {
+		t.Errorf("got %s over %s", resp.Status, resp.Proto)
+	}
+}
+
+func TestUnixSocket(t *testing.T) {
+	h, _ := newTestServer(t)
+	dir, err := os.MkdirTemp("", "second")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "second.sock")
+	os.Setenv("UNIX_SOCKET", path)
+	defer os.Unsetenv("UNIX_SOCKET")
+	// a socket left over by an earlier run is replaced
+	stale, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	stale.Close()
+
+	srv := NewHTTPServer(":0", h)
+	ln, err := Listen(srv.Addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go srv.Serve(ln)
+	defer srv.Close()
+	if fi, err := os.Stat(path); err != nil || fi.Mode().Perm() != 0660 {
+		t.Errorf("socket %v (%v)", fi, err)
+	}
+	if _, err := Listen(srv.Addr); err == nil || !strings.Contains(err.Error(), "in use") {
+		t.Errorf("listening again: %v", err)
+	}
+	client := &http.Client{Timeout: 5 * time.Second, Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, "unix", path)
+		},
+	}}
+	resp, err := client.Get("http://second/topics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("got %s", resp.Status)
+	}
+}
+
+func TestDrain(t *testing.T) {
+	h, _ := newTestServer(t)
+	defer func() {
+		streams.Lock()
+		streams.draining, streams.stop = false, make(chan struct{})
+		streams.Unlock()
+	}()
+	srv := httptest.NewServer(h)
+	defer srv.Close()
+	req, _ := http.NewRequest(http.MethodGet, srv.URL+"/watch", nil)
+	req.Header.Set("Accept", "text/event-stream")
+	resp, err := (&http.Client{Timeout: 5 * time.Second}).Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	events := bufio.NewReader(resp.Body)
+	if line, err := events.ReadString('\n'); err != nil || !strings.Contains(line, "watching") {
+		t.Fatalf("got %q (%v)", line, err)
+	}
+
+	if open := Drain(); open != 0 {
+		t.Errorf("%d streams still open", open)
+	}
+	rest, err := io.ReadAll(events)
+	if err != nil || !strings.Contains(string(rest), "event: shutdown\ndata: "+shutdownNotice) {
+		t.Errorf("got %q (%v)", rest, err)
+	}
+	// streams opened while draining are refused
+	expect(t, serve(h, http.MethodGet, "/watch", ""), http.StatusServiceUnavailable, "server shutting down")
+}
+
+func TestConsumerConcurrency(t *testing.T) {
+	h, fake := newTestServer(t)
+	createTopicAndSubscription(t, h, "orders", "orders-audit")
+	os.Setenv("ADMIN_TOKEN", "admin-secret")
+	defer os.Unsetenv("ADMIN_TOKEN")
+	admin := []string{"Authorization", "Bearer admin-secret"}
+
+	expect(t, serve(h, http.MethodPost, "/consumers", `{"subscription":"orders-audit"}`), http.StatusUnauthorized)
+	expect(t, serve(h, http.MethodPost, "/consumers", `{"subscription":"orders-audit", "numGoroutines":100}`, admin...),
+		http.StatusBadRequest, "numGoroutines must be between 1 and 64")
+	expect(t, serve(h, http.MethodPost, "/consumers", `{"subscription":"missing"}`, admin...), http.StatusNotFound)
+	w := serve(h, http.MethodPost, "/consumers", `{"subscription":"orders-audit", "numGoroutines":2, "maxConcurrency":1}`, admin...)
+	expect(t, w, http.StatusCreated, "numGoroutines=2 maxConcurrency=1")
+	id := w.Header().Get(warmSessionHeader)
+	defer func() {
+		warmSessions.Lock()
+		s := warmSessions.m[id]
+		delete(warmSessions.m, id)
+		warmSessions.Unlock()
+		s.close()
+	}()
+
+	// with maxConcurrency=1, the session holds one message until it's pulled
+	client, err := pubsub.NewClient(context.Background(), testProject, fake.ClientOptions()...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	topic := client.Topic("orders")
+	defer topic.Stop()
+	for _, data := range []string{"one", "two"} {
+		if _, err := topic.Publish(context.Background(), &pubsub.Message{Data: []byte(data)}).Get(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for !strings.Contains(serve(h, http.MethodGet, "/consumers/"+id+"/stats", "").Body.String(), "Outstanding messages: 1 of 1") {
+		if time.Now().After(deadline) {
+			t.Fatal(serve(h, http.MethodGet, "/consumers/"+id+"/stats", "").Body.String())
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	expect(t, serve(h, http.MethodGet, "/consumers/"+id+"/stats", ""), http.StatusOK, "paused", "numGoroutines=2 maxConcurrency=1 (restarted 0 times)")
+
+	expect(t, serve(h, http.MethodPatch, "/consumers/"+id, `{"maxConcurrency":10}`, admin...), http.StatusOK,
+		"updated consumer "+id+": numGoroutines=2 maxConcurrency=10 (was numGoroutines=2 maxConcurrency=1)",
+		"returning 1 buffered messages for redelivery")
+	expect(t, serve(h, http.MethodPatch, "/consumers/"+id, `{"maxConcurrency":10}`, admin...), http.StatusOK, "unchanged")
+	expect(t, serve(h, http.MethodPatch, "/consumers/missing", `{"maxConcurrency":10}`, admin...), http.StatusNotFound)
+	expect(t, serve(h, http.MethodGet, "/consumers/"+id+"/stats", ""), http.StatusOK, "(restarted 1 times)", "of 10")
+
+	// the restarted streaming pull receives the message returned for redelivery, and new ones (the
+	// other, held back by the client library under flow control when the first pull stopped, may
+	// only be redelivered once its ack deadline expires)
+	if _, err := topic.Publish(context.Background(), &pubsub.Message{Data: []byte("three")}).Get(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	received := ""
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline) && !(strings.Contains(received, "one") && strings.Contains(received, "three")); {
+		received += serve(h, http.MethodGet, "/subscriptions/orders-audit/messages?warmSession="+id, "").Body.String()
+	}
+	if !strings.Contains(received, "one") || !strings.Contains(received, "three") {
+		t.Errorf("received %q", received)
+	}
+}
+
+func TestConsumerMessages(t *testing.T) {
+	h, fake := newTestServer(t)
+	createTopicAndSubscription(t, h, "orders", "orders-audit")
+	os.Setenv("ADMIN_TOKEN", "admin-secret")
+	defer os.Unsetenv("ADMIN_TOKEN")
+	w := serve(h, http.MethodPost, "/consumers", `{"subscription":"orders-audit"}`, "Authorization", "Bearer admin-secret")
+	expect(t, w, http.StatusCreated)
+	id := w.Header().Get(warmSessionHeader)
+	defer func() {
+		warmSessions.Lock()
+		s := warmSessions.m[id]
+		delete(warmSessions.m, id)
+		warmSessions.Unlock()
+		s.close()
+	}()
+
+	client, err := pubsub.NewClient(context.Background(), testProject, fake.ClientOptions()...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	topic := client.Topic("orders")
+	defer topic.Stop()
+	for _, data := range []string{"one", "two", "three"} {
+		if _, err := topic.Publish(context.Background(), &pubsub.Message{Data: []byte(data)}).Get(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for deadline := time.Now().Add(5 * time.Second); !strings.Contains(serve(h, http.MethodGet, "/consumers/"+id+"/messages", "").Body.String(), "last offset 3"); {
+		if time.Now().After(deadline) {
+			t.Fatal("the consumer didn't receive the messages")
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	// viewers page through the messages without taking them from the buffer
+	for i := 0; i < 2; i++ {
+		w = serve(h, http.MethodGet, "/consumers/"+id+"/messages?after=0&limit=2", "")
+		expect(t, w, http.StatusOK, "[1] Data:", "[2] Data:", "next: after=2 (last offset 3)")
+		if strings.Contains(w.Body.String(), "[3]") {
+			t.Errorf("limit not applied: %s", w.Body)
+		}
+	}
+	expect(t, serve(h, http.MethodGet, "/consumers/"+id+"/messages?after=2", ""), http.StatusOK, "[3] Data:", "next: after=3")
+	expect(t, serve(h, http.MethodGet, "/consumers/"+id+"/messages?after=3", ""), http.StatusOK, "no messages after this offset yet")
+	expect(t, serve(h, http.MethodGet, "/consumers/"+id+"/messages?after=9", ""), http.StatusBadRequest, "beyond the last message")
+	expect(t, serve(h, http.MethodGet, "/consumers/"+id+"/messages?limit=0", ""), http.StatusBadRequest)
+	expect(t, serve(h, http.MethodGet, "/subscriptions/orders-audit/messages?warmSession="+id, ""), http.StatusOK, "one", "two", "three")
+}
+
+func TestBufferLimits(t *testing.T) {
+	h, fake := newTestServer(t)
+	createTopicAndSubscription(t, h, "orders", "orders-audit")
+	defer func() {
+		delayQueue.Lock()
+		delayQueue.msgs, delayQueue.bytes = nil, 0
+		delayQueue.Unlock()
+	}()
+
+	// the delay queue rejects messages beyond its limits, or drops the oldest
+	os.Setenv("DELAY_QUEUE_LIMITS", "messages=2")
+	defer os.Unsetenv("DELAY_QUEUE_LIMITS")
+	expect(t, serve(h, http.MethodPost, "/topics/orders?deliverAfter=1h", `["one", "two", "three"]`), http.StatusMultiStatus,
+		"rejected: the delay queue is full")
+	expect(t, serve(h, http.MethodGet, "/delayed", ""), http.StatusOK, "2 messages, 6 bytes (limits: messages=2 bytes=67108864 age=unlimited policy=reject)")
+	dropped := metricTotal(bufferDroppedMetric)
+	os.Setenv("DELAY_QUEUE_LIMITS", "messages=2,policy=drop-oldest")
+	expect(t, serve(h, http.MethodPost, "/topics/orders?deliverAfter=1h", `["four"]`), http.StatusOK, "delayed message ID")
+	w := serve(h, http.MethodGet, "/delayed", "")
+	expect(t, w, http.StatusOK, "2 messages, 7 bytes")
+	if got := metricTotal(bufferDroppedMetric) - dropped; got != 1 {
+		t.Errorf("%v messages dropped", got)
+	}
+	os.Setenv("DELAY_QUEUE_LIMITS", "age=300ms")
+	time.Sleep(350 * time.Millisecond)
+	expect(t, serve(h, http.MethodPost, "/topics/orders?deliverAfter=300ms", `["five"]`), http.StatusOK)
+	expect(t, serve(h, http.MethodGet, "/delayed", ""), http.StatusOK, "1 messages, 4 bytes")
+	// a message due after the age limit would be dropped before it's due
+	os.Setenv("DELAY_QUEUE_LIMITS", "age=1h")
+	expect(t, serve(h, http.MethodPost, "/topics/orders?deliverAfter=2h", `["six"]`), http.StatusBadRequest,
+		"deliverAfter must be at most 1h0m0s, the age limit of DELAY_QUEUE_LIMITS")
+
+	// a consumer retains the messages it received within its limits
+	os.Setenv("ADMIN_TOKEN", "admin-secret")
+	defer os.Unsetenv("ADMIN_TOKEN")
+	os.Setenv("CONSUMER_BUFFER_LIMITS", "messages=2")
+	defer os.Unsetenv("CONSUMER_BUFFER_LIMITS")
+	w = serve(h, http.MethodPost, "/consumers", `{"subscription":"orders-audit"}`, "Authorization", "Bearer admin-secret")
+	expect(t, w, http.StatusCreated)
+	id := w.Header().Get(warmSessionHeader)
+	defer func() {
+		warmSessions.Lock()
+		s := warmSessions.m[id]
+		delete(warmSessions.m, id)
+		warmSessions.Unlock()
+		s.close()
+	}()
+	client, err := pubsub.NewClient(context.Background(), testProject, fake.ClientOptions()...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	topic := client.Topic("orders")
+	defer topic.Stop()
+	for _, data := range []string{"one", "two", "three"} {
+		if _, err := topic.Publish(context.Background(), &pubsub.Message{Data: []byte(data)}).Get(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for deadline := time.Now().Add(5 * time.Second); !strings.Contains(serve(h, http.MethodGet, "/consumers/"+id+"/messages", "").Body.String(), "last offset 3"); {
+		if time.Now().After(deadline) {
+			t.Fatal("the consumer didn't receive the messages")
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	w = serve(h, http.MethodGet, "/consumers/"+id+"/messages", "")
+	expect(t, w, http.StatusOK, "messages 1 to", "are no longer retained")
+	// the buffer for pulls returns the oldest messages to the subscription to make room
+	if got := metricTotal(bufferDroppedMetric) - dropped; got < 2 {
+		t.Errorf("%v messages dropped", got)
+	}
+	w = serve(h, http.MethodGet, "/subscriptions/orders-audit/messages?warmSession="+id, "")
+	expect(t, w, http.StatusOK)
+	if n := strings.Count(w.Body.String(), "Data:"); n == 0 || n > 2 {
+		t.Errorf("pulled %d messages from a buffer of 2: %s", n, w.Body)
+	}
+}
+
+func TestSSEBackpressure(t *testing.T) {
+	h, _ := newTestServer(t)
+	createTopicAndSubscription(t, h, "orders", "orders-audit")
+	os.Setenv("SSE_WINDOW", "3")
+	defer os.Unsetenv("SSE_WINDOW")
+	os.Setenv("SSE_LAG_INTERVAL", "10ms")
+	defer os.Unsetenv("SSE_LAG_INTERVAL")
+
+	// event streams still get their messages through the pacer
+	expect(t, serve(h, http.MethodPost, "/topics/orders", `["one", "two"]`), http.StatusOK)
+	expect(t, serve(h, http.MethodGet, "/subscriptions/orders-audit/messages?max=2&timeout=5s", "", "Accept", "text/event-stream"),
+		http.StatusOK, `Data: "one"`, `Data: "two"`)
+
+	// a slow reader pauses the pull at the window, and hears it's behind
+	paced := func(subscr *pubsub.Subscription) (*ssePacer, *httptest.ResponseRecorder) {
+		rec := httptest.NewRecorder()
+		p := newSSEPacer(&negotiatedWriter{ResponseWriter: rec, mediaType: mediaEventStream, status: http.StatusOK}, subscr)
+		p.start(context.Background(), func(_ context.Context, msg *pubsub.Message) {
+			time.Sleep(30 * time.Millisecond)
+			fmt.Fprintf(p.w, "%s\n", msg.Data)
+		})
+		return p, rec
+	}
+	subscr := &pubsub.Subscription{}
+	p, rec := paced(subscr)
+	if max := subscr.ReceiveSettings.MaxOutstandingMessages; max != 3 {
+		t.Errorf("MaxOutstandingMessages = %d, want 3", max)
+	}
+	for i := 0; i < 12; i++ {
+		p.receive(context.Background(), &pubsub.Message{Data: []byte(strconv.Itoa(i))})
+	}
+	p.stop()
+	body := rec.Body.String()
+	if !strings.Contains(body, "event: lag\ndata: behind by 3 messages (window 3), the last one written waited") || !strings.Contains(body, "streaming pull paused") {
+		t.Errorf("no lag event for the paused pull:\n%s", body)
+	}
+	if !strings.Contains(body, "data: 0\n") || !strings.Contains(body, "data: 11\n") {
+		t.Errorf("messages missing:\n%s", body)
+	}
+
+	// with SSE_OVERFLOW=nack, the messages beyond the window are nacked instead
+	os.Setenv("SSE_OVERFLOW", "nack")
+	defer os.Unsetenv("SSE_OVERFLOW")
+	subscr = &pubsub.Subscription{}
+	p, rec = paced(subscr)
+	if max := subscr.ReceiveSettings.MaxOutstandingMessages; max != 0 {
+		t.Errorf("MaxOutstandingMessages = %d, want the default", max)
+	}
+	for i := 0; i < 8; i++ {
+		p.receive(context.Background(), &pubsub.Message{Data: []byte(strconv.Itoa(i))})
+	}
+	time.Sleep(200 * time.Millisecond) // the queue drains, then the lag event reports the nacks
+	p.stop()
+	if body := rec.Body.String(); !strings.Contains(body, "nacked for redelivery") || strings.Contains(body, "data: 7\n") {
+		t.Errorf("overflow not nacked:\n%s", body)
+	}
+}
+
+func TestTenantIsolation(t *testing.T) {
+	h, _ := newTestServer(t)
+	os.Setenv("ADMIN_TOKEN", "admin-secret")
+	defer os.Unsetenv("ADMIN_TOKEN")
+	admin := []string{"Authorization", "Bearer admin-secret"}
+	tenantKey := func(ns string) []string {
+		w := serve(h, http.MethodPost, "/admin/keys", `{"principal":"`+ns+`-owner", "namespace":"`+ns+`"}`, admin...)
+		expect(t, w, http.StatusCreated)
+		i := strings.Index(w.Body.String(), "key: ")
+		return []string{APIKeyHeader, strings.Fields(w.Body.String()[i+len("key: "):])[0]}
+	}
+
+	// a namespace with a dash could own another's resources: "team" those of "team-7"
+	expect(t, serve(h, http.MethodPost, "/admin/keys", `{"principal":"p", "namespace":"team-7"}`, admin...),
+		http.StatusBadRequest, "lowercase letters or digits")
+	team, team7 := tenantKey("team"), tenantKey("team7")
+	expect(t, serve(h, http.MethodPut, "/topics", `{"name":"foo"}`, team7...), http.StatusOK)
+	expect(t, serve(h, http.MethodPut, "/topics", `{"name":"bar"}`, team...), http.StatusOK)
+	expect(t, serve(h, http.MethodGet, "/topics/foo", "", team7...), http.StatusOK)
+	expect(t, serve(h, http.MethodGet, "/topics/7-foo", "", team...), http.StatusNotFound)
+	if w := serve(h, http.MethodGet, "/topics", "", team...); strings.Contains(w.Body.String(), "foo") || !strings.Contains(w.Body.String(), "bar") {
+		t.Errorf("tenant team lists:\n%s", w.Body)
+	}
+	if w := serve(h, http.MethodGet, "/topics", "", team7...); strings.Contains(w.Body.String(), "bar") || !strings.Contains(w.Body.String(), "foo") {
+		t.Errorf("tenant team7 lists:\n%s", w.Body)
+	}
+}
+
+func TestServerSettings(t *testing.T) {
+	newTestServer(t)
+	NewServer(Options{ProjectID: testProject, Settings: map[string]string{"DELETE_CONFIRMATION": "true"}})
+	if !deleteConfirmationRequired() {
+		t.Error("the DELETE_CONFIRMATION setting wasn't applied")
+	}
+	if _, set := os.LookupEnv("DELETE_CONFIRMATION"); set {
+		t.Error("the DELETE_CONFIRMATION setting was set in the environment")
+	}
+	newTestServer(t)
+	if deleteConfirmationRequired() {
+		t.Error("the DELETE_CONFIRMATION setting outlived its server")
+	}
+}
+
+func TestInvalidRequests(t *testing.T) {
+	h, _ := newTestServer(t)
+	createTopicAndSubscription(t, h, "orders", "orders-audit")
+	for _, tc := range []struct {
+		name         string
+		method, path string
+		body         string
+		header       []string
+		status       int
+		contains     string
+	}{
+		{"invalid name", http.MethodPut, "/topics", `{"name":"no spaces"}`, nil, http.StatusBadRequest, ""},
+		{"missing name", http.MethodPut, "/topics", `{}`, nil, http.StatusBadRequest, "name"},
+		{"malformed JSON", http.MethodPut, "/topics", `{"name":`, nil, http.StatusBadRequest, ""},
+		{"wrong content type", http.MethodPut, "/topics", `{"name":"x"}`, []string{"Content-Type", "text/csv"}, http.StatusUnsupportedMediaType, ""},
+		{"unacceptable response", http.MethodGet, "/topics", "", []string{"Accept", "image/png"}, http.StatusNotAcceptable, ""},
+		{"invalid name in path", http.MethodGet, "/topics/no%20spaces", "", nil, http.StatusBadRequest, ""},
+		{"missing topic", http.MethodPost, "/topics/missing", `["x"]`, nil, http.StatusNotFound, "topic missing not found"},
+		{"missing subscription", http.MethodGet, "/subscriptions/missing/messages", "", nil, http.StatusNotFound, "subscription missing not found"},
+		{"invalid publish body", http.MethodPost, "/topics/orders", `{"data":"x"}`, nil, http.StatusBadRequest, ""},
+		{"unknown property", http.MethodPut, "/schedules", `{"name":"tick", "topic":"orders", "schedule":"@every 1m", "payloud":"x"}`, nil,
+			http.StatusBadRequest, "payloud: unknown property"},
+		{"missing property", http.MethodPut, "/routes", `{"name":"r", "defaultTopic":"orders"}`, nil, http.StatusBadRequest, "subscription: required property missing"},
+		{"wrong property type", http.MethodPut, "/sinks", `{"name":"s", "subscription":"x", "table":"d.t", "batchSize":"10"}`, nil,
+			http.StatusBadRequest, "batchSize: must be an integer, got string"},
+		{"wrong item type", http.MethodPut, "/priority", `{"name":"jobs", "levels":[1]}`, nil, http.StatusBadRequest, "levels[0]: must be a string, got integer"},
+		{"invalid receive option", http.MethodGet, "/subscriptions/orders-audit/messages?max=-1", "", nil, http.StatusBadRequest, "max must be a positive number"},
+		{"invalid receive timeout", http.MethodGet, "/subscriptions/orders-audit/messages?timeout=0s", "", nil, http.StatusBadRequest, "timeout must be a positive duration"},
+		{"invalid receive ack", http.MethodGet, "/subscriptions/orders-audit/messages?ack=maybe", "", nil, http.StatusBadRequest, "ack must be true or false"},
+		{"method not allowed", http.MethodPatch, "/topics", `{}`, nil, http.StatusMethodNotAllowed, "method PATCH not allowed"},
+		{"unknown route", http.MethodGet, "/nope", "", nil, http.StatusNotFound, ""},
+		{"trailing slash", http.MethodGet, "/topics/", "", nil, http.StatusNotFound, "remove the trailing slash"},
+		{"nested path", http.MethodGet, "/topics/a/b", "", nil, http.StatusNotFound, "names can't contain /"},
+		{"escaped slash", http.MethodGet, "/topics/a%2Fb", "", nil, http.StatusNotFound, "must not be empty or contain /"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			w := serve(h, tc.method, tc.path, tc.body, tc.header...)
+			expect(t, w, tc.status, tc.contains)
+			if tc.status == http.StatusMethodNotAllowed && w.Header().Get("Allow") == "" {
+				t.Errorf("405 without Allow header")
+			}
+		})
+	}
+}
+
+func TestJSONResponses(t *testing.T) {
+	h, _ := newTestServer(t)
+	expect(t, serve(h, http.MethodPut, "/topics", `{"name":"orders"}`), http.StatusOK)
+	var resp struct {
+		Status int      `json:"status"`
+		Lines  []string `json:"lines"`
+		Error  string   `json:"error"`
+	}
+	w := serve(h, http.MethodGet, "/topics", "", "Accept", mediaJSON)
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("%v:\n%s", err, w.Body)
+	}
+	if resp.Status != http.StatusOK || len(resp.Lines) != 3 || resp.Lines[2] != "projects/"+testProject+"/topics/orders" {
+		t.Errorf("unexpected response %+v", resp)
+	}
+	w = serve(h, http.MethodGet, "/topics/missing", "", "Accept", mediaJSON)
+	resp.Lines = nil
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("%v:\n%s", err, w.Body)
+	}
+	if w.Code != http.StatusNotFound || resp.Status != http.StatusNotFound || resp.Error != "topic missing not found" {
+		t.Errorf("unexpected response %d %+v", w.Code, resp)
+	}
+}
+
+func TestBackendFailures(t *testing.T) {
+	h, fake := newTestServer(t)
+	createTopicAndSubscription(t, h, "orders", "orders-audit")
+	for _, tc := range []struct {
+		name         string
+		rpc          string
+		err          error
+		method, path string
+		body         string
+		status       int
+	}{
+		// listings are streamed, so a failure after the heading is reported in the body
+		{"list topics", "ListTopics", grpcstatus.Error(codes.PermissionDenied, "denied"), http.MethodGet, "/topics", "", http.StatusOK},
+		{"create topic", "CreateTopic", grpcstatus.Error(codes.PermissionDenied, "denied"), http.MethodPut, "/topics", `{"name":"other"}`, http.StatusInternalServerError},
+		{"delete subscription", "DeleteSubscription", grpcstatus.Error(codes.Internal, "boom"), http.MethodDelete, "/subscriptions/orders-audit", "", http.StatusServiceUnavailable},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			fake.Fail(tc.rpc, tc.err)
+			defer fake.Fail(tc.rpc, nil)
+			expect(t, serve(h, tc.method, tc.path, tc.body), tc.status, grpcstatus.Convert(tc.err).Message())
+			if fake.Calls(tc.rpc) == 0 {
+				t.Errorf("%s wasn't called", tc.rpc)
+			}
+		})
+	}
+	// the resources are intact once the backend recovers
+	expect(t, serve(h, http.MethodGet, "/subscriptions/orders-audit", ""), http.StatusOK)
+}
+
+func TestLookupFailures(t *testing.T) {
+	h, fake := newTestServer(t)
+	createTopicAndSubscription(t, h, "orders", "orders-audit")
+	for _, tc := range []struct {
+		name       string
+		rpc        string
+		err        error
+		path       string
+		status     int
+		contains   string
+		retryAfter bool
+	}{
+		{"topic permission denied", "GetTopic", grpcstatus.Error(codes.PermissionDenied, "denied"), "/topics/orders",
+			http.StatusForbidden, "permission denied looking up topic orders: missing permission pubsub.topics.get", false},
+		{"subscription permission denied", "GetSubscription", grpcstatus.Error(codes.PermissionDenied, "denied"), "/subscriptions/orders-audit/messages",
+			http.StatusForbidden, "missing permission pubsub.subscriptions.get", false},
+		{"backend not found", "GetTopic", grpcstatus.Error(codes.NotFound, "project not found"), "/topics/orders",
+			http.StatusNotFound, "topic orders not found", false},
+		{"transient", "GetSubscription", grpcstatus.Error(codes.ResourceExhausted, "slow down"), "/subscriptions/orders-audit",
+			http.StatusServiceUnavailable, "looking up subscription orders-audit", true},
+		{"other", "GetTopic", grpcstatus.Error(codes.Internal, "boom"), "/topics/orders",
+			http.StatusInternalServerError, "looking up topic orders", false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			fake.Fail(tc.rpc, tc.err)
+			defer fake.Fail(tc.rpc, nil)
+			w := serve(h, http.MethodGet, tc.path, "")
+			expect(t, w, tc.status, tc.contains)
+			if got := w.Header().Get("Retry-After") != ""; got != tc.retryAfter {
+				t.Errorf("Retry-After %q", w.Header().Get("Retry-After"))
+			}
+		})
+	}
+}
+
+func TestRetryHints(t *testing.T) {
+	h, fake := newTestServer(t)
+	createTopicAndSubscription(t, h, "orders", "orders-audit")
+	fake.Fail("GetSubscription", grpcstatus.Error(codes.ResourceExhausted, "slow down"))
+	defer fake.Fail("GetSubscription", nil)
+
+	w := serve(h, http.MethodGet, "/subscriptions/orders-audit", "", "Accept", "application/json")
+	expect(t, w, http.StatusServiceUnavailable)
+	var body struct {
+		Retry *retryHint `json:"retry"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil || body.Retry == nil {
+		t.Fatalf("no retry envelope in %s (%v)", w.Body, err)
+	}
+	after, err := strconv.Atoi(w.Header().Get("Retry-After"))
+	if err != nil || after != body.Retry.AfterSeconds {
+		t.Errorf("Retry-After %q, envelope %+v", w.Header().Get("Retry-After"), body.Retry)
+	}
+	b := body.Retry.Backoff
+	if body.Retry.Reason != "unavailable" || after < b.InitialSeconds || after > b.InitialSeconds+b.InitialSeconds/2 ||
+		b.Multiplier != 2 || b.MaxSeconds != 60 || b.Jitter != "full" {
+		t.Errorf("envelope %+v", body.Retry)
+	}
+
+	// plain text responses only get the header
+	w = serve(h, http.MethodGet, "/subscriptions/orders-audit", "")
+	expect(t, w, http.StatusServiceUnavailable)
+	if w.Header().Get("Retry-After") == "" || strings.Contains(w.Body.String(), "backoff") {
+		t.Errorf("Retry-After %q, body %s", w.Header().Get("Retry-After"), w.Body)
+	}
+}
+
+func TestBackendLatency(t *testing.T) {
+	h, fake := newTestServer(t)
+	expect(t, serve(h, http.MethodPut, "/topics", `{"name":"orders"}`), http.StatusOK)
+	fake.SetLatency(200 * time.Millisecond)
+	start := time.Now()
+	expect(t, serve(h, http.MethodGet, "/topics/orders", ""), http.StatusOK)
+	if d := time.Since(start); d < 200*time.Millisecond {
+		t.Errorf("request took %s despite the backend's latency", d)
+	}
+}
+
+// TestEveryRoute sends a request to each route listed by the discovery document, checking that
+// it's routed to its handler, which answers without panicking, even for missing resources and
+// without the server's background work started
+func TestEveryRoute(t *testing.T) {
+	h, _ := newTestServer(t)
+	w := serve(h, http.MethodGet, "/-", "")
+	expect(t, w, http.StatusOK)
+	var doc struct {
+		Routes []discoveryRoute `json:"routes"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &doc); err != nil {
+		t.Fatal(err)
+	}
+	if len(doc.Routes) < 50 {
+		t.Fatalf("only %d routes discovered", len(doc.Routes))
+	}
+	// the core routes' responses to requests for missing resources, or with empty bodies
+	wantErrors := map[string]struct {
+		status   int
+		contains string
+	}{
+		"PUT /topics":                           {http.StatusBadRequest, "name: required property missing"},
+		"DELETE /topics":                        {http.StatusBadRequest, "match parameter not provided"},
+		"GET /topics/{name}":                    {http.StatusNotFound, "topic missing-name not found"},
+		"POST /topics/{name}":                   {http.StatusNotFound, "topic missing-name not found"},
+		"DELETE /topics/{name}":                 {http.StatusNotFound, "topic missing-name not found"},
+		"GET /topics/{name}/delete-plan":        {http.StatusNotFound, "topic missing-name not found"},
+		"PUT /subscriptions":                    {http.StatusBadRequest, "topic: required property missing"},
+		"DELETE /subscriptions":                 {http.StatusBadRequest, "match parameter not provided"},
+		"GET /subscriptions/{name}":             {http.StatusNotFound, "subscription missing-name not found"},
+		"POST /subscriptions/{name}":            {http.StatusNotFound, "subscription missing-name not found"},
+		"PATCH /subscriptions/{name}":           {http.StatusNotFound, "subscription missing-name not found"},
+		"DELETE /subscriptions/{name}":          {http.StatusNotFound, "subscription missing-name not found"},
+		"GET /subscriptions/{name}/delete-plan": {http.StatusNotFound, "subscription missing-name not found"},
+		"GET /subscriptions/{name}/lag":         {http.StatusNotFound, "subscription missing-name not found"},
+		"GET /subscriptions/{name}/messages":    {http.StatusNotFound, "subscription missing-name not found"},
+	}
+	discovered := map[string]bool{}
+	for _, route := range doc.Routes {
+		discovered[route.Method+" "+route.Path] = true
+	}
+	for key := range wantErrors {
+		if !discovered[key] {
+			t.Errorf("route %s not discovered", key)
+		}
+	}
+	// a real server, for the routes taking over the connection like /stomp
+	srv := httptest.NewServer(h)
+	defer srv.Close()
+	client := &http.Client{Timeout: 5 * time.Second}
+	for _, route := range doc.Routes {
+		t.Run(route.Method+" "+route.Path, func(t *testing.T) {
+			var elements []string
+			for _, e := range strings.Split(route.Path, "/") {
+				if strings.HasPrefix(e, "{") {
+					e = "missing-" + strings.Trim(e, "{}")
+				}
+				elements = append(elements, e)
+			}
+			var body io.Reader
+			if route.Method == http.MethodPut || route.Method == http.MethodPost || route.Method == http.MethodPatch {
+				body = strings.NewReader("{}")
+			}
+			r, err := http.NewRequest(route.Method, srv.URL+strings.Join(elements, "/"), body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if body != nil {
+				contentType := mediaJSON
+				if len(route.RequestTypes) > 0 {
+					contentType = route.RequestTypes[0]
+				}
+				r.Header.Set("Content-Type", contentType)
+			}
+			resp, err := client.Do(r)
+			if err != nil {
+				// streaming routes, like tails, keep going until the client leaves
+				if !strings.Contains(err.Error(), "Client.Timeout") {
+					t.Fatal(err)
+				}
+				return
+			}
+			defer resp.Body.Close()
+			out, _ := io.ReadAll(resp.Body)
+			switch {
+			case resp.StatusCode == http.StatusMethodNotAllowed, string(out) == "404 page not found\n":
+				t.Errorf("not routed: %s %s", resp.Status, out)
+			case string(out) == "internal error\n":
+				t.Errorf("handler panicked")
+			}
+			if want, ok := wantErrors[route.Method+" "+route.Path]; ok &&
+				(resp.StatusCode != want.status || !strings.Contains(string(out), want.contains)) {
+				t.Errorf("got %s %q, want %d containing %q", resp.Status, out, want.status, want.contains)
+			}
+		})
+	}
+}
@@ -0,0 +1,124 @@
+// Package servertest provides a fake Pub/Sub backend for exercising the handlers of package server
+// without Google Cloud credentials, e.g.
+//
+//	fake := servertest.NewFake()
+//	defer fake.Close()
+//	h := server.NewServer(server.Options{ProjectID: "test", ClientOptions: fake.ClientOptions()})
+//	fake.Fail("GetTopic", status.Error(codes.PermissionDenied, "denied"))
+//
+// The fake is an in-memory Pub/Sub server (cloud.google.com/go/pubsub/pstest): topics, subscriptions
+// and messages behave like Pub/Sub's, deterministically, with message IDs numbered in publish order.
+// Its calls can be made to fail or to take longer.
+package servertest
+
+import (
+	"context"
+	"path"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/pubsub/pstest"
+	"google.golang.org/api/option"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+)
+
+// Fake is a fake Pub/Sub backend; servers connect to it with its ClientOptions
+type Fake struct {
+	// Pubsub is the in-memory Pub/Sub server, e.g. to publish messages or see those published
+	Pubsub *pstest.Server
+
+	mu       sync.Mutex
+	failures map[string]error // by method, e.g. "Publish"
+	latency  time.Duration
+	calls    map[string]int
+}
+
+// NewFake starts a fake Pub/Sub backend
+func NewFake() *Fake {
+	return &Fake{Pubsub: pstest.NewServer(), failures: map[string]error{}, calls: map[string]int{}}
+}
+
+// ClientOptions returns the options connecting a Pub/Sub client to the fake
+func (f *Fake) ClientOptions() []option.ClientOption {
+	return []option.ClientOption{
+		option.WithEndpoint(f.Pubsub.Addr),
+		option.WithoutAuthentication(),
+		option.WithGRPCDialOption(grpc.WithTransportCredentials(insecure.NewCredentials())),
+		option.WithGRPCDialOption(grpc.WithChainUnaryInterceptor(f.unaryInterceptor)),
+		option.WithGRPCDialOption(grpc.WithChainStreamInterceptor(f.streamInterceptor)),
+	}
+}
+
+// Fail makes the calls of a Pub/Sub method, e.g. "GetTopic" or "StreamingPull", fail with err,
+// which should be a gRPC status error (see google.golang.org/grpc/status); a nil err lets them
+// succeed again. The client retries some errors, like Unavailable, for up to a minute.
+func (f *Fake) Fail(method string, err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err == nil {
+		delete(f.failures, method)
+	} else {
+		f.failures[method] = err
+	}
+}
+
+// SetLatency delays every call by d, or until the call's context is done
+func (f *Fake) SetLatency(d time.Duration) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.latency = d
+}
+
+// Calls returns the number of calls made to a Pub/Sub method, including those failed
+func (f *Fake) Calls(method string) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.calls[method]
+}
+
+// Reset removes the failures, latency and counted calls, and the messages published
+func (f *Fake) Reset() {
+	f.mu.Lock()
+	f.failures, f.latency, f.calls = map[string]error{}, 0, map[string]int{}
+	f.mu.Unlock()
+	f.Pubsub.ClearMessages()
+}
+
+// Close stops the fake
+func (f *Fake) Close() error {
+	return f.Pubsub.Close()
+}
+
+// intercept counts a call, waits for the latency and returns the method's failure
+func (f *Fake) intercept(ctx context.Context, fullMethod string) error {
+	method := path.Base(fullMethod)
+	f.mu.Lock()
+	f.calls[method]++
+	latency, err := f.latency, f.failures[method]
+	f.mu.Unlock()
+	if latency > 0 {
+		t := time.NewTimer(latency)
+		defer t.Stop()
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return err
+}
+
+func (f *Fake) unaryInterceptor(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+	if err := f.intercept(ctx, method); err != nil {
+		return err
+	}
+	return invoker(ctx, method, req, reply, cc, opts...)
+}
+
+func (f *Fake) streamInterceptor(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn, method string, streamer grpc.Streamer, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+	if err := f.intercept(ctx, method); err != nil {
+		return nil, err
+	}
+	return streamer(ctx, desc, cc, method, opts...)
+}
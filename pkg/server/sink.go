@@ -0,0 +1,623 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/pubsub"
+	"google.golang.org/api/option"
+	gtransport "google.golang.org/api/transport/grpc"
+	storagepb "google.golang.org/genproto/googleapis/cloud/bigquery/storage/v1"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/descriptorpb"
+	"google.golang.org/protobuf/types/dynamicpb"
+)
+
+const (
+	defaultSinkBatchSize = 500
+	maxSinkBatchSize     = 10000
+	defaultSinkMaxDelay  = time.Second
+
+	bigQueryStorageEndpoint = "bigquerystorage.googleapis.com:443"
+
+	sinkRowsMetric = "second_sink_rows_total"
+)
+
+// sinkColumnTypes are the BigQuery column types a sink can write, and the proto field types
+// they're sent as over the Storage Write API (timestamps as microseconds since the epoch, JSON as text)
+var sinkColumnTypes = map[string]descriptorpb.FieldDescriptorProto_Type{
+	"STRING":    descriptorpb.FieldDescriptorProto_TYPE_STRING,
+	"INT64":     descriptorpb.FieldDescriptorProto_TYPE_INT64,
+	"FLOAT64":   descriptorpb.FieldDescriptorProto_TYPE_DOUBLE,
+	"BOOL":      descriptorpb.FieldDescriptorProto_TYPE_BOOL,
+	"BYTES":     descriptorpb.FieldDescriptorProto_TYPE_BYTES,
+	"TIMESTAMP": descriptorpb.FieldDescriptorProto_TYPE_INT64,
+	"JSON":      descriptorpb.FieldDescriptorProto_TYPE_STRING,
+}
+
+var sinkColumnName = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]{0,299}$`)
+
+// sinkColumn maps a part of a message to a table column: From is one of data, messageId,
+// publishTime, orderingKey, attributes (all of them, as JSON), attributes.<key>, json (the data,
+// which must be JSON) or json.<path> (a dotted path into the JSON data)
+type sinkColumn struct {
+	Name string `json:"name"`
+	Type string `json:"type,omitempty"`
+	From string `json:"from"`
+}
+
+var createSinkSchema = objectSchema(map[string]*jsonSchema{
+	"name":         stringSchema("sink name"),
+	"subscription": stringSchema("subscription whose messages are written"),
+	"table":        stringSchema("BigQuery table, [<project>.]<dataset>.<table>"),
+	"columns": {Type: "array", Description: "columns of the rows (default id, publish_time, attributes, ordering_key, data)",
+		Items: objectSchema(map[string]*jsonSchema{
+			"name": stringSchema("column name"),
+			"type": stringSchema("column type: STRING (default), INT64, FLOAT64, BOOL, BYTES, TIMESTAMP or JSON"),
+			"from": stringSchema("what the column is filled from: data, messageId, publishTime, orderingKey, attributes, attributes.<key>, json or json.<path>"),
+		}, "name", "from")},
+	"batchSize": numberSchema(fmt.Sprintf("rows per append, at most %d", maxSinkBatchSize), true, 1),
+	"maxDelay":  stringSchema("how long rows wait for a full batch, like \"1s\""),
+}, "name", "subscription", "table")
+
+// defaultSinkColumns are a sink's columns when the create request has none
+var defaultSinkColumns = []sinkColumn{
+	{Name: "id", Type: "STRING", From: "messageId"},
+	{Name: "publish_time", Type: "TIMESTAMP", From: "publishTime"},
+	{Name: "attributes", Type: "JSON", From: "attributes"},
+	{Name: "ordering_key", Type: "STRING", From: "orderingKey"},
+	{Name: "data", Type: "STRING", From: "data"},
+}
+
+// sink is a background consumer streaming messages from a subscription into a BigQuery table
+// through the Storage Write API's default stream; messages are acked once their batch is appended
+type sink struct {
+	name         string
+	subscription string
+	table        string // projects/<project>/datasets/<dataset>/tables/<table>
+	columns      []sinkColumn
+	batchSize    int
+	maxDelay     time.Duration
+	started      time.Time
+
+	descriptor *descriptorpb.DescriptorProto
+	rowType    protoreflect.MessageDescriptor
+
+	cancel context.CancelFunc
+	done   chan struct{}
+
+	mu       sync.Mutex
+	pending  []*pubsub.Message
+	rows     [][]byte
+	oldest   time.Time
+	written  int64
+	rejected int64
+	failed   int64
+	err      error
+}
+
+var sinks = struct {
+	sync.Mutex
+	m map[string]*sink
+}{m: map[string]*sink{}}
+
+// listSinksHandler handles GET to /sinks
+func listSinksHandler(w http.ResponseWriter, r *http.Request) {
+	fmt.Fprintln(w, "Sinks\n-----")
+	list := sinkSummaries()
+	for _, s := range list {
+		fmt.Fprintln(w, s)
+	}
+	if len(list) == 0 {
+		fmt.Fprintln(w, "(none)")
+	}
+}
+
+// createSinkHandler handles PUT to /sinks
+func createSinkHandler(w http.ResponseWriter, r *http.Request) {
+	// get sink details from body:
+	// '{"name":"my-sink", "subscription":"my-subscription", "table":"[<project>.]<dataset>.<table>",
+	//   "columns":[{"name":"order_id", "type":"STRING", "from":"attributes.orderId"}, ...],
+	//   "batchSize":500, "maxDelay":"1s"}'
+	var req struct {
+		Name         string       `json:"name"`
+		Subscription string       `json:"subscription"`
+		Table        string       `json:"table"`
+		Columns      []sinkColumn `json:"columns"`
+		BatchSize    int          `json:"batchSize"`
+		MaxDelay     string       `json:"maxDelay"`
+	}
+	if !readRequest(w, r, createSinkSchema, &req) {
+		return
+	}
+	s := &sink{
+		name:         req.Name,
+		subscription: req.Subscription,
+		columns:      req.Columns,
+		batchSize:    req.BatchSize,
+		maxDelay:     defaultSinkMaxDelay,
+	}
+	if req.MaxDelay != "" {
+		d, err := time.ParseDuration(req.MaxDelay)
+		if err != nil || d <= 0 {
+			http.Error(w, "maxDelay must be a positive duration like \"1s\"", http.StatusBadRequest)
+			return
+		}
+		s.maxDelay = d
+	}
+	if err := s.validate(req.Table); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	sinks.Lock()
+	if _, ok := sinks.m[s.name]; ok {
+		sinks.Unlock()
+		http.Error(w, fmt.Sprintf("sink %s already exists", s.name), http.StatusConflict)
+		return
+	}
+	sinks.m[s.name] = s
+	sinks.Unlock()
+
+	if err := s.start(); err != nil {
+		sinks.Lock()
+		delete(sinks.m, s.name)
+		sinks.Unlock()
+		writeLookupError(w, err)
+		return
+	}
+	fmt.Fprintf(w, "created sink %s\n", s.name)
+}
+
+// getSinkHandler handles GET to /sinks/<sink-name>
+func getSinkHandler(w http.ResponseWriter, r *http.Request) {
+	s, ok := lookupSink(w, r)
+	if !ok {
+		return
+	}
+	fmt.Fprintln(w, s.summary())
+	fmt.Fprintln(w, "Columns\n-------")
+	for _, c := range s.columns {
+		fmt.Fprintf(w, "%s %s <- %s\n", c.Name, c.Type, c.From)
+	}
+}
+
+// deleteSinkHandler handles DELETE to /sinks/<sink-name>
+func deleteSinkHandler(w http.ResponseWriter, r *http.Request) {
+	s, ok := lookupSink(w, r)
+	if !ok {
+		return
+	}
+	s.stop()
+	sinks.Lock()
+	delete(sinks.m, s.name)
+	sinks.Unlock()
+	fmt.Fprintf(w, "stopped sink %s\n", s.name)
+	fmt.Fprintln(w, s.summary())
+}
+
+// lookupSink returns the sink named in the path, responding 404 if there's none
+func lookupSink(w http.ResponseWriter, r *http.Request) (*sink, bool) {
+	name := pathParam(r, "name")
+	sinks.Lock()
+	s, ok := sinks.m[name]
+	sinks.Unlock()
+	if !ok {
+		http.Error(w, fmt.Sprintf("sink %s not found", name), http.StatusNotFound)
+	}
+	return s, ok
+}
+
+// validate checks the sink's properties, resolving the table and building the row descriptor
+func (s *sink) validate(table string) error {
+	if s.name == "" {
+		return fmt.Errorf("name must not be empty")
+	}
+	if err := validateResourceName("subscription", s.subscription); err != nil {
+		return err
+	}
+	parts := strings.Split(table, ".")
+	switch len(parts) {
+	case 2:
+		parts = append([]string{setting("GOOGLE_CLOUD_PROJECT")}, parts...)
+	case 3:
+	default:
+		return fmt.Errorf("table must be [<project>.]<dataset>.<table>")
+	}
+	for _, p := range parts {
+		if p == "" {
+			return fmt.Errorf("table must be [<project>.]<dataset>.<table>")
+		}
+	}
+	s.table = fmt.Sprintf("projects/%s/datasets/%s/tables/%s", parts[0], parts[1], parts[2])
+
+	if s.batchSize == 0 {
+		s.batchSize = defaultSinkBatchSize
+	}
+	if s.batchSize < 1 || s.batchSize > maxSinkBatchSize {
+		return fmt.Errorf("batchSize must be from 1 to %d", maxSinkBatchSize)
+	}
+	if len(s.columns) == 0 {
+		s.columns = append([]sinkColumn(nil), defaultSinkColumns...)
+	}
+
+	s.descriptor = &descriptorpb.DescriptorProto{Name: proto.String("Row")}
+	seen := map[string]bool{}
+	for i := range s.columns {
+		c := &s.columns[i]
+		if !sinkColumnName.MatchString(c.Name) {
+			return fmt.Errorf("column name %q is not valid", c.Name)
+		}
+		if seen[strings.ToLower(c.Name)] {
+			return fmt.Errorf("column %s is mapped twice", c.Name)
+		}
+		seen[strings.ToLower(c.Name)] = true
+		if c.Type == "" {
+			c.Type = "STRING"
+		}
+		c.Type = strings.ToUpper(c.Type)
+		fieldType, ok := sinkColumnTypes[c.Type]
+		if !ok {
+			return fmt.Errorf("column %s: type must be one of STRING, INT64, FLOAT64, BOOL, BYTES, TIMESTAMP, JSON", c.Name)
+		}
+		switch {
+		case c.From == "data", c.From == "messageId", c.From == "publishTime", c.From == "orderingKey",
+			c.From == "attributes", c.From == "json", strings.HasPrefix(c.From, "attributes.") && len(c.From) > len("attributes."),
+			strings.HasPrefix(c.From, "json.") && len(c.From) > len("json."):
+		default:
+			return fmt.Errorf("column %s: from must be data, messageId, publishTime, orderingKey, attributes, attributes.<key>, json or json.<path>", c.Name)
+		}
+		s.descriptor.Field = append(s.descriptor.Field, &descriptorpb.FieldDescriptorProto{
+			Name:   proto.String(c.Name),
+			Number: proto.Int32(int32(i + 1)),
+			Type:   fieldType.Enum(),
+			Label:  descriptorpb.FieldDescriptorProto_LABEL_OPTIONAL.Enum(),
+		})
+	}
+	file, err := protodesc.NewFile(&descriptorpb.FileDescriptorProto{
+		Name:        proto.String(s.name + ".proto"),
+		Syntax:      proto.String("proto2"),
+		MessageType: []*descriptorpb.DescriptorProto{s.descriptor},
+	}, nil)
+	if err != nil {
+		return err
+	}
+	s.rowType = file.Messages().Get(0)
+	return nil
+}
+
+// start checks the subscription exists, connects to the Storage Write API and launches the background consumer
+func (s *sink) start() error {
+	projectID := setting("GOOGLE_CLOUD_PROJECT")
+	if projectID == "" {
+		return fmt.Errorf("failed to get project ID")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	client, err := pubsub.NewClient(ctx, projectID, backendOptions()...)
+	if err != nil {
+		cancel()
+		return err
+	}
+	subscr := client.Subscription(s.subscription)
+	if err := checkExists(ctx, "subscription", s.subscription, subscr.Exists); err != nil {
+		cancel()
+		client.Close()
+		return err
+	}
+	conn, err := gtransport.Dial(ctx,
+		option.WithEndpoint(bigQueryStorageEndpoint),
+		option.WithScopes("https://www.googleapis.com/auth/bigquery.insertdata"))
+	if err != nil {
+		cancel()
+		client.Close()
+		return err
+	}
+
+	s.started = time.Now()
+	s.cancel = cancel
+	s.done = make(chan struct{})
+	go s.run(ctx, client, conn, subscr)
+	return nil
+}
+
+// run receives messages until the sink is stopped, then appends the last batch
+func (s *sink) run(ctx context.Context, client *pubsub.Client, conn *grpc.ClientConn, subscr *pubsub.Subscription) {
+	defer close(s.done)
+	defer client.Close()
+	defer conn.Close()
+
+	bq := storagepb.NewBigQueryWriteClient(conn)
+	go func() {
+		ticker := time.NewTicker(s.maxDelay / 4)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				s.mu.Lock()
+				if len(s.pending) > 0 && time.Since(s.oldest) >= s.maxDelay {
+					s.flushLocked(bq)
+				}
+				s.mu.Unlock()
+			}
+		}
+	}()
+
+	// room for a full batch while the previous one is being appended
+	subscr.ReceiveSettings.MaxOutstandingMessages = 2 * s.batchSize
+	err := subscr.Receive(ctx, func(_ context.Context, msg *pubsub.Message) {
+		recordReceived(s.subscription, 1)
+		row, err := s.row(msg)
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if err != nil {
+			// redelivered until the mapping is fixed, or the subscription's dead letter topic takes it
+			log.Printf("sink %s: message %s: %v", s.name, msg.ID, err)
+			s.err = fmt.Errorf("message %s: %v", msg.ID, err)
+			s.rejected++
+			counterAdd(sinkRowsMetric, "Rows written to BigQuery by sinks, by result.", 1, "sink", s.name, "result", "rejected")
+			msg.Nack()
+			return
+		}
+		if len(s.pending) == 0 {
+			s.oldest = time.Now()
+		}
+		s.pending = append(s.pending, msg)
+		s.rows = append(s.rows, row)
+		if len(s.pending) >= s.batchSize {
+			s.flushLocked(bq)
+		}
+	})
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err != nil {
+		log.Printf("sink %s: receive: %v", s.name, err)
+		s.err = err
+	}
+	s.flushLocked(bq)
+}
+
+// flushLocked appends the pending rows to the table, acking their messages on success
+func (s *sink) flushLocked(bq storagepb.BigQueryWriteClient) {
+	if len(s.pending) == 0 {
+		return
+	}
+	msgs, rows := s.pending, s.rows
+	s.pending, s.rows = nil, nil
+
+	err := s.append(bq, rows)
+	result := "written"
+	if err != nil {
+		log.Printf("sink %s: append: %v", s.name, err)
+		s.err = err
+		s.failed += int64(len(msgs))
+		result = "failed"
+	} else {
+		s.written += int64(len(msgs))
+	}
+	counterAdd(sinkRowsMetric, "Rows written to BigQuery by sinks, by result.", float64(len(msgs)), "sink", s.name, "result", result)
+	for _, msg := range msgs {
+		if err != nil {
+			msg.Nack()
+		} else {
+			msg.Ack()
+		}
+	}
+}
+
+// append writes rows to the table's default stream, on a stream of its own: the rows are committed
+// once the append succeeds
+func (s *sink) append(bq storagepb.BigQueryWriteClient, rows [][]byte) error {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	writeStream := s.table + "/streams/_default"
+	ctx = metadata.AppendToOutgoingContext(ctx, "x-goog-request-params", "write_stream="+url.QueryEscape(writeStream))
+	stream, err := bq.AppendRows(ctx)
+	if err != nil {
+		return err
+	}
+	err = stream.Send(&storagepb.AppendRowsRequest{
+		WriteStream: writeStream,
+		Rows: &storagepb.AppendRowsRequest_ProtoRows{ProtoRows: &storagepb.AppendRowsRequest_ProtoData{
+			WriterSchema: &storagepb.ProtoSchema{ProtoDescriptor: s.descriptor},
+			Rows:         &storagepb.ProtoRows{SerializedRows: rows},
+		}},
+	})
+	if err != nil {
+		return err
+	}
+	if err := stream.CloseSend(); err != nil {
+		return err
+	}
+	resp, err := stream.Recv()
+	if err != nil {
+		return err
+	}
+	if e := resp.GetError(); e != nil {
+		return fmt.Errorf("%s (code %d)", e.GetMessage(), e.GetCode())
+	}
+	return nil
+}
+
+// row maps a message to a serialized table row; values that are absent are left NULL
+func (s *sink) row(msg *pubsub.Message) ([]byte, error) {
+	row := dynamicpb.NewMessage(s.rowType)
+	var parsed interface{}
+	parsedOK := false
+	for i, c := range s.columns {
+		var v interface{}
+		switch {
+		case c.From == "data":
+			if c.Type == "BYTES" {
+				v = msg.Data
+			} else {
+				v = string(msg.Data)
+			}
+		case c.From == "messageId":
+			v = msg.ID
+		case c.From == "publishTime":
+			v = msg.PublishTime
+		case c.From == "orderingKey":
+			if msg.OrderingKey != "" {
+				v = msg.OrderingKey
+			}
+		case c.From == "attributes":
+			attrs := map[string]string{}
+			for k, val := range msg.Attributes {
+				attrs[k] = val
+			}
+			v = attrs
+		case strings.HasPrefix(c.From, "attributes."):
+			if val, ok := msg.Attributes[strings.TrimPrefix(c.From, "attributes.")]; ok {
+				v = val
+			}
+		default: // json, json.<path>
+			if !parsedOK {
+				if err := json.Unmarshal(msg.Data, &parsed); err != nil {
+					return nil, fmt.Errorf("column %s: data is not JSON: %v", c.Name, err)
+				}
+				parsedOK = true
+			}
+			v = parsed
+			if path := strings.TrimPrefix(c.From, "json"); path != "" {
+				for _, key := range strings.Split(path[1:], ".") {
+					obj, ok := v.(map[string]interface{})
+					if !ok {
+						v = nil
+						break
+					}
+					v = obj[key]
+				}
+			}
+		}
+		if v == nil {
+			continue
+		}
+		value, err := sinkValue(c.Type, v)
+		if err != nil {
+			return nil, fmt.Errorf("column %s: %v", c.Name, err)
+		}
+		row.Set(s.rowType.Fields().ByNumber(protoreflect.FieldNumber(i+1)), value)
+	}
+	return proto.Marshal(row)
+}
+
+// sinkValue converts a message value (a string, []byte, time, or decoded JSON) to a column's type
+func sinkValue(columnType string, v interface{}) (protoreflect.Value, error) {
+	text := func() string {
+		switch x := v.(type) {
+		case string:
+			return x
+		case []byte:
+			return string(x)
+		case time.Time:
+			return x.Format(time.RFC3339Nano)
+		}
+		data, _ := json.Marshal(v)
+		return string(data)
+	}
+	switch columnType {
+	case "STRING":
+		return protoreflect.ValueOfString(text()), nil
+	case "BYTES":
+		return protoreflect.ValueOfBytes([]byte(text())), nil
+	case "JSON":
+		if s, ok := v.(string); ok && json.Valid([]byte(s)) {
+			return protoreflect.ValueOfString(s), nil
+		}
+		data, err := json.Marshal(v)
+		if err != nil {
+			return protoreflect.Value{}, err
+		}
+		return protoreflect.ValueOfString(string(data)), nil
+	case "INT64":
+		if f, ok := v.(float64); ok {
+			return protoreflect.ValueOfInt64(int64(f)), nil
+		}
+		n, err := strconv.ParseInt(text(), 10, 64)
+		if err != nil {
+			return protoreflect.Value{}, fmt.Errorf("%q is not an INT64", text())
+		}
+		return protoreflect.ValueOfInt64(n), nil
+	case "FLOAT64":
+		if f, ok := v.(float64); ok {
+			return protoreflect.ValueOfFloat64(f), nil
+		}
+		f, err := strconv.ParseFloat(text(), 64)
+		if err != nil {
+			return protoreflect.Value{}, fmt.Errorf("%q is not a FLOAT64", text())
+		}
+		return protoreflect.ValueOfFloat64(f), nil
+	case "BOOL":
+		if b, ok := v.(bool); ok {
+			return protoreflect.ValueOfBool(b), nil
+		}
+		b, err := strconv.ParseBool(text())
+		if err != nil {
+			return protoreflect.Value{}, fmt.Errorf("%q is not a BOOL", text())
+		}
+		return protoreflect.ValueOfBool(b), nil
+	case "TIMESTAMP":
+		var t time.Time
+		switch x := v.(type) {
+		case time.Time:
+			t = x
+		case float64:
+			// seconds since the epoch
+			t = time.Unix(0, int64(x*float64(time.Second)))
+		default:
+			var err error
+			if t, err = time.Parse(time.RFC3339Nano, text()); err != nil {
+				return protoreflect.Value{}, fmt.Errorf("%q is not an RFC 3339 TIMESTAMP", text())
+			}
+		}
+		return protoreflect.ValueOfInt64(t.UnixNano() / int64(time.Microsecond)), nil
+	}
+	return protoreflect.Value{}, fmt.Errorf("unsupported type %s", columnType)
+}
+
+// stop cancels the consumer and waits for the last batch to be appended
+func (s *sink) stop() {
+	s.cancel()
+	<-s.done
+}
+
+// summary returns a one-line description of the sink
+func (s *sink) summary() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	summary := fmt.Sprintf("%s: subscription=%s table=%s columns=%d batchSize=%d maxDelay=%s written=%d rejected=%d failed=%d pending=%d",
+		s.name, s.subscription, s.table, len(s.columns), s.batchSize, s.maxDelay, s.written, s.rejected, s.failed, len(s.pending))
+	if s.err != nil {
+		summary += fmt.Sprintf(" lastError=%q", s.err.Error())
+	}
+	return summary
+}
+
+func sinkSummaries() []string {
+	sinks.Lock()
+	defer sinks.Unlock()
+	var list []string
+	for _, s := range sinks.m {
+		list = append(list, s.summary())
+	}
+	sort.Strings(list)
+	return list
+}
@@ -0,0 +1,247 @@
+package server
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// sloSlots are the one-minute slots of request outcomes kept per route, so SLOs are evaluated over the last hour
+	sloSlots = 60
+
+	// sloBurnAlertRate is the burn rate alerted on in both the 5 minute and 1 hour windows: at this
+	// rate a 30-day error budget would be 2% spent within the hour
+	sloBurnAlertRate = 14.4
+
+	defaultSLOLatency   = time.Second
+	defaultSLOObjective = 0.99
+
+	requestDurationMetric = "second_http_request_duration_seconds"
+	requestsMetric        = "second_http_requests_total"
+	sloBurnRateMetric     = "second_slo_burn_rate"
+)
+
+var requestDurationBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 30, 60}
+
+// sloObjective is a target for a route (like "POST /topics/{name}", or "*" for all routes not listed):
+// the fraction of requests that must complete within the latency without a server error
+type sloObjective struct {
+	Route     string  `json:"route"`
+	Latency   string  `json:"latency"`
+	Objective float64 `json:"objective"`
+
+	latency time.Duration
+}
+
+// sloSlot counts the requests of one minute, and those that missed the objective
+type sloSlot struct {
+	minute int64
+	total  int64
+	bad    int64
+}
+
+// sloRoute tracks a route's requests against its objective
+type sloRoute struct {
+	objective *sloObjective
+	slots     [sloSlots]sloSlot
+	alerting  bool
+}
+
+// slos holds the objectives (from SLO_FILE) and the per-route request outcomes
+var slos = struct {
+	sync.Mutex
+	objectives map[string]*sloObjective
+	routes     map[string]*sloRoute
+}{routes: map[string]*sloRoute{}}
+
+// startSLOs loads the objectives and starts logging burn rate alerts
+func startSLOs() {
+	list := []*sloObjective{{Route: "*", Latency: defaultSLOLatency.String(), Objective: defaultSLOObjective}}
+	if path := setting("SLO_FILE"); path != "" {
+		var fromFile []*sloObjective
+		data, err := os.ReadFile(path)
+		if err == nil {
+			err = json.Unmarshal(data, &fromFile)
+		}
+		if err != nil {
+			log.Printf("slo: %s: %v (using the default objective)", path, err)
+		} else {
+			list = append(list, fromFile...)
+		}
+	}
+
+	objectives := map[string]*sloObjective{}
+	for _, o := range list {
+		d, err := time.ParseDuration(o.Latency)
+		if err != nil || d <= 0 || o.Objective <= 0 || o.Objective >= 1 {
+			log.Printf("slo: %s: latency must be a positive duration and objective between 0 and 1, ignored", o.Route)
+			continue
+		}
+		o.latency = d
+		objectives[o.Route] = o
+	}
+	slos.Lock()
+	slos.objectives = objectives
+	slos.Unlock()
+
+	go func() {
+		for range time.Tick(time.Minute) {
+			evaluateSLOs()
+		}
+	}()
+}
+
+// observeRequest records a request's latency and whether it met its route's objective
+func observeRequest(route string, status int, elapsed time.Duration) {
+	histogramObserve(requestDurationMetric, "Latency of API requests, by route.", requestDurationBuckets, elapsed.Seconds(), "route", route)
+	counterAdd(requestsMetric, "API requests, by route and status code.", 1, "route", route, "code", strconv.Itoa(status))
+
+	slos.Lock()
+	defer slos.Unlock()
+	sr, ok := slos.routes[route]
+	if !ok {
+		o := slos.objectives[route]
+		if o == nil {
+			o = slos.objectives["*"]
+		}
+		if o == nil {
+			return
+		}
+		sr = &sloRoute{objective: o}
+		slos.routes[route] = sr
+	}
+	minute := time.Now().Unix() / 60
+	slot := &sr.slots[minute%sloSlots]
+	if slot.minute != minute {
+		*slot = sloSlot{minute: minute}
+	}
+	slot.total++
+	if status >= 500 || elapsed > sr.objective.latency {
+		slot.bad++
+	}
+}
+
+// window returns the requests and bad requests of the last n minutes
+func (sr *sloRoute) window(n int64) (total, bad int64) {
+	now := time.Now().Unix() / 60
+	for _, slot := range sr.slots {
+		if slot.minute > now-n {
+			total += slot.total
+			bad += slot.bad
+		}
+	}
+	return total, bad
+}
+
+// burnRate returns how fast the error budget is spent over the last n minutes: 1 spends it exactly
+// by the end of the SLO period, higher rates sooner
+func (sr *sloRoute) burnRate(n int64) float64 {
+	total, bad := sr.window(n)
+	if total == 0 {
+		return 0
+	}
+	return float64(bad) / float64(total) / (1 - sr.objective.Objective)
+}
+
+// evaluateSLOs exports the burn rates and logs when a route starts or stops burning its
+// error budget too fast
+func evaluateSLOs() {
+	slos.Lock()
+	defer slos.Unlock()
+	for route, sr := range slos.routes {
+		burn5m, burn1h := sr.burnRate(5), sr.burnRate(sloSlots)
+		gaugeSet(sloBurnRateMetric, "Error budget burn rate, by route and window.", burn5m, "route", route, "window", "5m")
+		gaugeSet(sloBurnRateMetric, "Error budget burn rate, by route and window.", burn1h, "route", route, "window", "1h")
+		alerting := burn5m > sloBurnAlertRate && burn1h > sloBurnAlertRate
+		if alerting != sr.alerting {
+			sr.alerting = alerting
+			if alerting {
+				log.Printf("slo: ALERT %s is burning its error budget %.1fx too fast (5m) / %.1fx (1h)", route, burn5m, burn1h)
+			} else {
+				log.Printf("slo: resolved %s, burn rate %.1f (5m) / %.1f (1h)", route, burn5m, burn1h)
+			}
+		}
+	}
+}
+
+// sloHandler handles GET to /slo, reporting each route's compliance over the last hour
+func sloHandler(w http.ResponseWriter, r *http.Request) {
+	slos.Lock()
+	defer slos.Unlock()
+	routes := make([]string, 0, len(slos.routes))
+	for route := range slos.routes {
+		routes = append(routes, route)
+	}
+	sort.Strings(routes)
+
+	fmt.Fprintln(w, "SLOs (last hour)\n----------------")
+	for _, route := range routes {
+		sr := slos.routes[route]
+		total, bad := sr.window(sloSlots)
+		compliance := 1.0
+		if total > 0 {
+			compliance = 1 - float64(bad)/float64(total)
+		}
+		status := "OK"
+		if burn5m, burn1h := sr.burnRate(5), sr.burnRate(sloSlots); burn5m > sloBurnAlertRate && burn1h > sloBurnAlertRate {
+			status = "ALERT"
+		} else if compliance < sr.objective.Objective {
+			status = "VIOLATED"
+		}
+		fmt.Fprintf(w, "%s: objective=%g%% within %s requests=%d compliance=%.2f%% burn5m=%.1f burn1h=%.1f %s\n",
+			route, sr.objective.Objective*100, sr.objective.latency, total, compliance*100, sr.burnRate(5), sr.burnRate(sloSlots), status)
+	}
+	if len(routes) == 0 {
+		fmt.Fprintln(w, "(no requests yet)")
+	}
+}
+
+// statusRecorder remembers the status code a handler responded with, and the start of server error responses
+type statusRecorder struct {
+	http.ResponseWriter
+	status      int
+	wroteHeader bool
+	errorBody   []byte
+}
+
+func (rec *statusRecorder) WriteHeader(status int) {
+	if !rec.wroteHeader {
+		rec.status, rec.wroteHeader = status, true
+	}
+	rec.ResponseWriter.WriteHeader(status)
+}
+
+func (rec *statusRecorder) Write(p []byte) (int, error) {
+	rec.wroteHeader = true
+	if rec.status >= 500 && len(rec.errorBody) < maxReportedErrorBody {
+		n := maxReportedErrorBody - len(rec.errorBody)
+		if n > len(p) {
+			n = len(p)
+		}
+		rec.errorBody = append(rec.errorBody, p[:n]...)
+	}
+	return rec.ResponseWriter.Write(p)
+}
+
+// Flush keeps streaming responses working through the recorder
+func (rec *statusRecorder) Flush() {
+	flushResponse(rec.ResponseWriter)
+}
+
+// Hijack allows protocols like WebSocket to take over the connection
+func (rec *statusRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	if h, ok := rec.ResponseWriter.(http.Hijacker); ok {
+		rec.status, rec.wroteHeader = http.StatusSwitchingProtocols, true
+		return h.Hijack()
+	}
+	return nil, nil, http.ErrNotSupported
+}
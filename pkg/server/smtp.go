@@ -0,0 +1,353 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net"
+	"net/mail"
+	"net/textproto"
+	"os"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/pubsub"
+)
+
+const (
+	// maxSMTPMessageSize is the largest mail accepted, Pub/Sub's message size limit
+	maxSMTPMessageSize = 10 << 20
+
+	maxSMTPRecipients = 100
+
+	// smtpCommandTimeout is how long an SMTP client may take to send a command, or a message
+	smtpCommandTimeout = 5 * time.Minute
+
+	// maxAttributeValueSize and maxMessageAttributes are Pub/Sub's limits on message attributes
+	maxAttributeValueSize = 1024
+	maxMessageAttributes  = 100
+
+	smtpMessagesMetric = "second_smtp_messages_total"
+)
+
+// startSMTPGateway listens for mail on SMTP_PORT, if set: each recipient's local part names a topic
+// (alerts@anything publishes to topic alerts) and the mail is published to it, the headers as
+// attributes and the body as data. SMTP_DOMAIN restricts the recipient domain.
+func startSMTPGateway() {
+	port := setting("SMTP_PORT")
+	if port == "" {
+		return
+	}
+	ln, err := net.Listen("tcp", ":"+port)
+	if err != nil {
+		log.Printf("smtp: %v (gateway disabled)", err)
+		return
+	}
+	log.Printf("smtp: listening on port %s", port)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				log.Printf("smtp: %v", err)
+				return
+			}
+			go serveSMTP(conn)
+		}
+	}()
+}
+
+// smtpSession is the state of an SMTP connection's mail transaction
+type smtpSession struct {
+	text   *textproto.Conn
+	conn   net.Conn
+	client *pubsub.Client
+	domain string
+
+	from   string
+	inMail bool
+	topics []string
+}
+
+// serveSMTP runs an SMTP conversation; there is no authentication, nor TLS
+func serveSMTP(conn net.Conn) {
+	s := &smtpSession{text: textproto.NewConn(conn), conn: conn, domain: strings.ToLower(setting("SMTP_DOMAIN"))}
+	defer func() {
+		s.text.Close()
+		if s.client != nil {
+			s.client.Close()
+		}
+	}()
+	hostname, _ := os.Hostname()
+	s.reply(220, "%s second ESMTP mail-to-topic gateway", hostname)
+	for {
+		conn.SetDeadline(time.Now().Add(smtpCommandTimeout))
+		line, err := s.text.ReadLine()
+		if err != nil {
+			return
+		}
+		verb, arg := line, ""
+		if i := strings.IndexByte(line, ' '); i >= 0 {
+			verb, arg = line[:i], strings.TrimSpace(line[i+1:])
+		}
+		switch strings.ToUpper(verb) {
+		case "HELO":
+			s.reset()
+			s.reply(250, "%s", hostname)
+		case "EHLO":
+			s.reset()
+			s.text.PrintfLine("250-%s", hostname)
+			s.text.PrintfLine("250-SIZE %d", maxSMTPMessageSize)
+			s.text.PrintfLine("250-8BITMIME")
+			s.reply(250, "PIPELINING")
+		case "MAIL":
+			s.mail(arg)
+		case "RCPT":
+			s.rcpt(arg)
+		case "DATA":
+			s.data()
+		case "RSET":
+			s.reset()
+			s.reply(250, "OK")
+		case "NOOP":
+			s.reply(250, "OK")
+		case "VRFY":
+			s.reply(252, "cannot verify, but will try delivery")
+		case "QUIT":
+			s.reply(221, "bye")
+			return
+		default:
+			s.reply(502, "5.5.1 command not implemented")
+		}
+	}
+}
+
+func (s *smtpSession) reply(code int, format string, args ...interface{}) {
+	s.text.PrintfLine("%d %s", code, fmt.Sprintf(format, args...))
+}
+
+func (s *smtpSession) reset() {
+	s.from, s.inMail, s.topics = "", false, nil
+}
+
+// mail starts a transaction: MAIL FROM:<address> [SIZE=<bytes>]
+func (s *smtpSession) mail(arg string) {
+	if s.inMail {
+		s.reply(503, "5.5.1 nested MAIL command")
+		return
+	}
+	if !strings.HasPrefix(strings.ToUpper(arg), "FROM:") {
+		s.reply(501, "5.5.4 syntax: MAIL FROM:<address>")
+		return
+	}
+	fields := strings.Fields(arg[len("FROM:"):])
+	if len(fields) == 0 {
+		s.reply(501, "5.5.4 syntax: MAIL FROM:<address>")
+		return
+	}
+	for _, param := range fields[1:] {
+		var size int
+		if _, err := fmt.Sscanf(strings.ToUpper(param), "SIZE=%d", &size); err == nil && size > maxSMTPMessageSize {
+			s.reply(552, "5.3.4 message size exceeds %d bytes", maxSMTPMessageSize)
+			return
+		}
+	}
+	s.from = strings.Trim(fields[0], "<>")
+	s.inMail = true
+	s.reply(250, "2.1.0 OK")
+}
+
+// rcpt adds a recipient, whose local part must name an existing topic
+func (s *smtpSession) rcpt(arg string) {
+	if !s.inMail {
+		s.reply(503, "5.5.1 need MAIL before RCPT")
+		return
+	}
+	if !strings.HasPrefix(strings.ToUpper(arg), "TO:") {
+		s.reply(501, "5.5.4 syntax: RCPT TO:<address>")
+		return
+	}
+	if len(s.topics) >= maxSMTPRecipients {
+		s.reply(452, "4.5.3 too many recipients")
+		return
+	}
+	fields := strings.Fields(arg[len("TO:"):])
+	if len(fields) == 0 {
+		s.reply(501, "5.5.4 syntax: RCPT TO:<address>")
+		return
+	}
+	addr := strings.Trim(fields[0], "<>")
+	at := strings.LastIndexByte(addr, '@')
+	if at < 0 {
+		s.reply(501, "5.1.3 recipient must be <topic-name>@<domain>")
+		return
+	}
+	topicName, domain := addr[:at], strings.ToLower(addr[at+1:])
+	if s.domain != "" && domain != s.domain {
+		s.reply(550, "5.7.1 relaying to %s denied", domain)
+		return
+	}
+	if err := validateResourceName("topic", topicName); err != nil {
+		s.reply(550, "5.1.1 %v", err)
+		return
+	}
+	if publishPolicyActive() {
+		s.reply(550, "5.7.1 mail can't be attributed to an API key, publishing by mail is disabled by the publish policy")
+		return
+	}
+	if s.client == nil {
+		projectID := setting("GOOGLE_CLOUD_PROJECT")
+		if projectID == "" {
+			s.reply(451, "4.3.0 failed to get project ID")
+			return
+		}
+		client, err := pubsub.NewClient(context.Background(), projectID, backendOptions()...)
+		if err != nil {
+			s.reply(451, "4.3.0 %v", err)
+			return
+		}
+		s.client = client
+	}
+	exists, err := s.client.Topic(topicName).Exists(context.Background())
+	if err != nil {
+		s.reply(451, "4.3.0 %v", err)
+		return
+	}
+	if !exists {
+		s.reply(550, "5.1.1 topic %s not found", topicName)
+		return
+	}
+	s.topics = append(s.topics, topicName)
+	s.reply(250, "2.1.5 OK")
+}
+
+// data reads the mail and publishes it to the recipients' topics
+func (s *smtpSession) data() {
+	if len(s.topics) == 0 {
+		s.reply(503, "5.5.1 need RCPT before DATA")
+		return
+	}
+	s.reply(354, "end data with <CR><LF>.<CR><LF>")
+	dr := s.text.DotReader()
+	raw, err := io.ReadAll(io.LimitReader(dr, maxSMTPMessageSize+1))
+	if err != nil {
+		return
+	}
+	topics, from := s.topics, s.from
+	s.reset()
+	if len(raw) > maxSMTPMessageSize {
+		// skip the rest of the message before answering
+		io.Copy(io.Discard, dr)
+		counterAdd(smtpMessagesMetric, "Mails received by the SMTP gateway, by result.", 1, "result", "rejected")
+		s.reply(552, "5.3.4 message size exceeds %d bytes", maxSMTPMessageSize)
+		return
+	}
+	msg, err := parseMail(raw, from)
+	if err != nil {
+		counterAdd(smtpMessagesMetric, "Mails received by the SMTP gateway, by result.", 1, "result", "rejected")
+		s.reply(554, "5.6.0 %v", err)
+		return
+	}
+
+	var ids []string
+	for _, topicName := range topics {
+		id, err := publishMessage(topicName, &pubsub.Message{Data: msg.Data, Attributes: msg.Attributes})
+		if err != nil {
+			counterAdd(smtpMessagesMetric, "Mails received by the SMTP gateway, by result.", 1, "result", "failed")
+			s.reply(451, "4.3.0 publish to %s: %v", topicName, err)
+			return
+		}
+		ids = append(ids, id)
+	}
+	counterAdd(smtpMessagesMetric, "Mails received by the SMTP gateway, by result.", 1, "result", "published")
+	s.reply(250, "2.0.0 OK published as %s", strings.Join(ids, " "))
+}
+
+// parseMail turns a mail into a message: the headers become attributes (decoded, one per header
+// name, truncated to Pub/Sub's limits) and the body its data; a multipart mail's data is its first
+// text/plain part
+func parseMail(raw []byte, envelopeFrom string) (*pubsub.Message, error) {
+	m, err := mail.ReadMessage(bytes.NewReader(raw))
+	if err != nil {
+		return nil, err
+	}
+	attrs := map[string]string{}
+	if envelopeFrom != "" {
+		attrs["X-Envelope-From"] = envelopeFrom
+	}
+	var dec mime.WordDecoder
+	for name, values := range m.Header {
+		if len(attrs) >= maxMessageAttributes {
+			break
+		}
+		if strings.HasPrefix(strings.ToLower(name), "goog") {
+			// reserved by Pub/Sub
+			continue
+		}
+		value := strings.Join(values, ", ")
+		if decoded, err := dec.DecodeHeader(value); err == nil {
+			value = decoded
+		}
+		if len(value) > maxAttributeValueSize {
+			value = value[:maxAttributeValueSize]
+		}
+		attrs[name] = value
+	}
+
+	body, err := io.ReadAll(m.Body)
+	if err != nil {
+		return nil, err
+	}
+	data, contentType, err := mailBody(textproto.MIMEHeader(m.Header), body)
+	if err != nil {
+		return nil, err
+	}
+	if contentType != "" {
+		attrs["Content-Type"] = contentType
+	}
+	delete(attrs, "Content-Transfer-Encoding")
+	return &pubsub.Message{Data: data, Attributes: attrs}, nil
+}
+
+// mailBody decodes a body by its Content-Transfer-Encoding; of a multipart body it returns the
+// first text/plain part, and its content type
+func mailBody(header textproto.MIMEHeader, body []byte) ([]byte, string, error) {
+	mediaType, params, err := mime.ParseMediaType(header.Get("Content-Type"))
+	if err == nil && strings.HasPrefix(mediaType, "multipart/") && params["boundary"] != "" {
+		r := multipart.NewReader(bytes.NewReader(body), params["boundary"])
+		for {
+			part, err := r.NextRawPart()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return nil, "", err
+			}
+			partBody, err := io.ReadAll(part)
+			if err != nil {
+				return nil, "", err
+			}
+			if partType, _, _ := mime.ParseMediaType(part.Header.Get("Content-Type")); partType == "text/plain" || partType == "" {
+				data, _, err := mailBody(part.Header, partBody)
+				return data, part.Header.Get("Content-Type"), err
+			}
+		}
+		// no text part, keep it all
+		return body, "", nil
+	}
+
+	switch strings.ToLower(header.Get("Content-Transfer-Encoding")) {
+	case "base64":
+		data, err := io.ReadAll(base64.NewDecoder(base64.StdEncoding, bytes.NewReader(body)))
+		return data, "", err
+	case "quoted-printable":
+		data, err := io.ReadAll(quotedprintable.NewReader(bytes.NewReader(body)))
+		return data, "", err
+	}
+	return body, "", nil
+}
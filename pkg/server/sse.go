@@ -0,0 +1,181 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/pubsub"
+)
+
+// Messages streamed as server-sent events (receives and tails with 'Accept: text/event-stream')
+// are paced by the client: they go through a queue of SSE_WINDOW messages, settled once written,
+// so that when the client reads slower than messages arrive the streaming pull's flow control
+// pauses it instead of messages piling up in the service. With SSE_OVERFLOW=nack, messages that
+// don't fit in the queue are nacked for redelivery instead. While the client is behind, a "lag"
+// event tells it by how much every SSE_LAG_INTERVAL.
+
+const (
+	defaultSSEWindow      = 100
+	defaultSSELagInterval = 5 * time.Second
+
+	sseOverflowPause = "pause"
+	sseOverflowNack  = "nack"
+)
+
+// pacedMessage is a message waiting to be written to the client
+type pacedMessage struct {
+	msg    *pubsub.Message
+	queued time.Time
+}
+
+// ssePacer paces the messages of an event stream to the client
+type ssePacer struct {
+	w           http.ResponseWriter
+	window      int
+	overflow    string
+	lagInterval time.Duration
+	queue       chan pacedMessage
+	done        chan struct{}
+
+	paused  int           // messages outstanding when the pull pauses, 0 with SSE_OVERFLOW=nack
+	maxWait time.Duration // messages queued longer are nacked instead of written, if not 0 (tails)
+	waited  time.Duration // how long the message written last waited in the queue
+
+	mu     sync.Mutex
+	nacked int // overflowing messages, with SSE_OVERFLOW=nack
+}
+
+// eventStreamWriter returns the writer of the response if it's an event stream, nil otherwise
+func eventStreamWriter(w http.ResponseWriter) *negotiatedWriter {
+	for {
+		switch rw := w.(type) {
+		case *tenantResponseWriter:
+			w = rw.ResponseWriter
+		case *negotiatedWriter:
+			if rw.mediaType == mediaEventStream && rw.status < http.StatusBadRequest {
+				return rw
+			}
+			return nil
+		default:
+			return nil
+		}
+	}
+}
+
+// newSSEPacer returns the pacer of the messages received from the subscription if the response
+// is an event stream, nil otherwise; it sets the subscription's flow control to the window
+func newSSEPacer(w http.ResponseWriter, subscr *pubsub.Subscription) *ssePacer {
+	if eventStreamWriter(w) == nil {
+		return nil
+	}
+	p := &ssePacer{
+		w:           w,
+		window:      envInt("SSE_WINDOW", defaultSSEWindow),
+		overflow:    sseOverflowPause,
+		lagInterval: envDuration("SSE_LAG_INTERVAL", defaultSSELagInterval),
+		done:        make(chan struct{}),
+	}
+	if p.window == 0 {
+		p.window = defaultSSEWindow
+	}
+	if setting("SSE_OVERFLOW") == sseOverflowNack {
+		p.overflow = sseOverflowNack
+	}
+	p.queue = make(chan pacedMessage, p.window)
+	if p.overflow == sseOverflowPause {
+		// unsettled messages hold the pull back: at most the window is received ahead of the client
+		if max := subscr.ReceiveSettings.MaxOutstandingMessages; max <= 0 || max > p.window {
+			subscr.ReceiveSettings.MaxOutstandingMessages = p.window
+		}
+		p.paused = subscr.ReceiveSettings.MaxOutstandingMessages
+	}
+	return p
+}
+
+// receive is the callback of the streaming pull, queueing the messages for the client
+func (p *ssePacer) receive(ctx context.Context, msg *pubsub.Message) {
+	m := pacedMessage{msg: msg, queued: time.Now()}
+	select {
+	case p.queue <- m:
+		return
+	default:
+	}
+	if p.overflow == sseOverflowNack {
+		msg.Nack()
+		p.mu.Lock()
+		p.nacked++
+		p.mu.Unlock()
+		return
+	}
+	select {
+	case p.queue <- m:
+	case <-ctx.Done():
+		msg.Nack()
+	}
+}
+
+// start writes the queued messages to the client with write, which settles them, and the lag
+// events, until stop; once ctx is done the messages still queued are nacked instead
+func (p *ssePacer) start(ctx context.Context, write func(context.Context, *pubsub.Message)) {
+	go func() {
+		defer close(p.done)
+		ticker := time.NewTicker(p.lagInterval)
+		defer ticker.Stop()
+		reported := 0
+		for {
+			select {
+			case m, ok := <-p.queue:
+				if !ok {
+					return
+				}
+				if ctx.Err() != nil {
+					m.msg.Nack()
+					continue
+				}
+				p.waited = time.Since(m.queued)
+				if p.maxWait > 0 && p.waited > p.maxWait {
+					m.msg.Nack()
+					recordBufferDrops(tailBuffer, "age", 1)
+					continue
+				}
+				write(ctx, m.msg)
+			case <-ticker.C:
+				reported = p.writeLag(reported)
+			}
+		}
+	}()
+}
+
+// stop ends the writing once the streaming pull has returned
+func (p *ssePacer) stop() {
+	close(p.queue)
+	<-p.done
+}
+
+// writeLag sends a lag event if the client is behind, or messages were nacked since the last one;
+// it returns the messages nacked so far
+func (p *ssePacer) writeLag(reported int) int {
+	queued := len(p.queue)
+	p.mu.Lock()
+	nacked := p.nacked
+	p.mu.Unlock()
+	if queued == 0 && nacked == reported {
+		return reported
+	}
+	line := fmt.Sprintf("behind by %d messages (window %d), the last one written waited %s",
+		queued, p.window, p.waited.Round(time.Millisecond))
+	if p.overflow == sseOverflowNack {
+		line += fmt.Sprintf(", %d nacked for redelivery (%d since the last lag event)", nacked, nacked-reported)
+	} else if queued >= p.paused {
+		// nothing is being written between messages: the queued ones are all those outstanding
+		line += ", streaming pull paused"
+	}
+	if ew := eventStreamWriter(p.w); ew != nil {
+		ew.writeEvents("lag", []byte(line))
+		flushResponse(ew)
+	}
+	return nacked
+}
@@ -0,0 +1,203 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// The state store keeps the service's own state in a BoltDB file (STATE_FILE), one bucket per
+// kind of state, so that it survives restarts: routes, the responses kept for Idempotency-Key
+// retries, the receive dedup sessions, the API keys managed through /admin/keys, the usage
+// counters, the publish log, the trashed topics, the drift baseline and the workshop tokens.
+// Schedules keep their own file (SCHEDULES_FILE) and outbox records their own database
+// (OUTBOX_FILE). Without a usable file, state lives in memory only, as before.
+
+var (
+	routesBucket          = []byte("routes")
+	idempotencyBucket     = []byte("idempotency")
+	receiveSessionsBucket = []byte("receive-sessions")
+	apiKeysBucket         = []byte("api-keys")
+	usageBucket           = []byte("usage")
+	publishLogBucket      = []byte("publish-log")
+	trashBucket           = []byte("trash")
+	baselineBucket        = []byte("baseline")
+	accessTokensBucket    = []byte("access-tokens")
+
+	stateBuckets = [][]byte{routesBucket, idempotencyBucket, receiveSessionsBucket, apiKeysBucket, usageBucket, publishLogBucket, trashBucket, baselineBucket, accessTokensBucket}
+)
+
+var stateStore struct {
+	db   *bolt.DB
+	path string
+}
+
+// startStateStore opens the state database
+func startStateStore() {
+	path := setting("STATE_FILE")
+	if path == "" {
+		path = filepath.Join(os.TempDir(), "second-state.db")
+	}
+	db, err := bolt.Open(path, 0o600, &bolt.Options{Timeout: time.Second})
+	if err == nil {
+		err = db.Update(func(tx *bolt.Tx) error {
+			for _, b := range stateBuckets {
+				if _, err := tx.CreateBucketIfNotExists(b); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+	}
+	if err != nil {
+		log.Printf("state: %s: %v (state kept in memory only)", path, err)
+		return
+	}
+	stateStore.db = db
+	stateStore.path = path
+}
+
+// stopStateStore closes the state database
+func stopStateStore() {
+	if stateStore.db != nil {
+		stateStore.db.Close()
+	}
+}
+
+// statePut stores a value as JSON under a key of a bucket
+func statePut(bucket []byte, key string, v interface{}) {
+	if stateStore.db == nil {
+		return
+	}
+	data, err := json.Marshal(v)
+	if err == nil {
+		err = stateStore.db.Update(func(tx *bolt.Tx) error {
+			return tx.Bucket(bucket).Put([]byte(key), data)
+		})
+	}
+	if err != nil {
+		log.Printf("state: %s/%s: %v", bucket, key, err)
+	}
+}
+
+// stateDelete removes a key of a bucket
+func stateDelete(bucket []byte, key string) {
+	if stateStore.db == nil {
+		return
+	}
+	err := stateStore.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucket).Delete([]byte(key))
+	})
+	if err != nil {
+		log.Printf("state: %s/%s: %v", bucket, key, err)
+	}
+}
+
+// stateReplace replaces the contents of a bucket with the given values, by key
+func stateReplace(bucket []byte, values map[string]interface{}) {
+	if stateStore.db == nil {
+		return
+	}
+	err := stateStore.db.Update(func(tx *bolt.Tx) error {
+		if err := tx.DeleteBucket(bucket); err != nil {
+			return err
+		}
+		b, err := tx.CreateBucket(bucket)
+		if err != nil {
+			return err
+		}
+		for key, v := range values {
+			data, err := json.Marshal(v)
+			if err != nil {
+				return err
+			}
+			if err := b.Put([]byte(key), data); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		log.Printf("state: %s: %v", bucket, err)
+	}
+}
+
+// stateLoad calls load with the key and JSON value of each entry of a bucket, in key order;
+// entries that fail to load are logged and dropped
+func stateLoad(bucket []byte, load func(key string, data []byte) error) {
+	if stateStore.db == nil {
+		return
+	}
+	var bad []string
+	err := stateStore.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucket).ForEach(func(k, v []byte) error {
+			if err := load(string(k), v); err != nil {
+				log.Printf("state: %s/%s: %v (dropped)", bucket, k, err)
+				bad = append(bad, string(k))
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		log.Printf("state: %s: %v", bucket, err)
+	}
+	for _, key := range bad {
+		stateDelete(bucket, key)
+	}
+}
+
+// stateAppend appends values to a bucket kept as a log, keyed by sequence numbers in order, and
+// drops its oldest entries beyond keep, returning the sequence number of the first value
+func stateAppend(bucket []byte, values []interface{}, keep int) uint64 {
+	if stateStore.db == nil || len(values) == 0 {
+		return 0
+	}
+	var first uint64
+	err := stateStore.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(bucket)
+		for i, v := range values {
+			data, err := json.Marshal(v)
+			if err != nil {
+				return err
+			}
+			seq, err := b.NextSequence()
+			if err != nil {
+				return err
+			}
+			if i == 0 {
+				first = seq
+			}
+			if err := b.Put([]byte(stateSeqKey(seq)), data); err != nil {
+				return err
+			}
+		}
+		// sequence numbers are consecutive, so the entries kept are those of the last keep ones
+		if b.Sequence() <= uint64(keep) {
+			return nil
+		}
+		oldest := []byte(stateSeqKey(b.Sequence() - uint64(keep) + 1))
+		c := b.Cursor()
+		for k, _ := c.First(); k != nil && bytes.Compare(k, oldest) < 0; k, _ = c.First() {
+			if err := c.Delete(); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		log.Printf("state: %s: %v", bucket, err)
+		return 0
+	}
+	return first
+}
+
+// stateSeqKey is the key of a log entry, which sorts by sequence number
+func stateSeqKey(seq uint64) string {
+	return fmt.Sprintf("%020d", seq)
+}
@@ -0,0 +1,259 @@
+package server
+
+import (
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	maxRecentErrors = 20
+
+	// statusRefresh is how often the /status page reloads itself
+	statusRefresh = 5 * time.Second
+
+	// rateSampleInterval and rateSamples make the rates on the /status page cover the last minute
+	rateSampleInterval = 10 * time.Second
+	rateSamples        = 7
+)
+
+// statusConfigVars are the settings shown on the /status page; secrets only show whether they're set
+var statusConfigVars = []string{
+	"GOOGLE_CLOUD_PROJECT", "SCHEDULES_FILE", "DELAY_QUEUE_FILE", "DELAY_QUEUE_LIMITS", "CONSUMER_BUFFER_LIMITS", "ROUTE_BUFFER_LIMITS", "TAIL_BUFFER_LIMITS", "JANITOR_TTL", "JANITOR_INTERVAL", "EXPIRY_WATCHDOG_INTERVAL", "EXPIRY_WINDOW", "EXPIRY_AUTO_RENEW", "CHAOS_MODE",
+	"ADMIN_TOKEN", "DEBUG_ENDPOINTS", "TOPIC_CACHE_SIZE", "TOPIC_CACHE_IDLE", "PUBLISH_FLOW_CONTROL",
+	"PUBLISH_MAX_OUTSTANDING_MESSAGES", "PUBLISH_MAX_OUTSTANDING_BYTES", "DEDUP_WINDOW", "DEDUP_CACHE_SIZE",
+	"SLO_FILE", "MONITORING_EXPORT_INTERVAL", "ERROR_REPORTING", "ERROR_REPORTING_THRESHOLD", "OUTBOX_FILE",
+	"AWS_FACADE", "AWS_REGION", "SMTP_PORT", "SMTP_DOMAIN", "DATAFLOW_REGION",
+	"ENCRYPTION_KEYS", "REDACTION_FILE", "PUBLISH_POLICY_FILE", "NAMING_POLICY_FILE", "NAMING_ENVIRONMENT", "ADMIN_QUOTA", "ADMIN_QUOTA_MAX_WAIT",
+	"ADMIN_RETRY_ATTEMPTS", "ADMIN_RETRY_BACKOFF", "BREAKER_THRESHOLD", "BREAKER_COOLDOWN",
+	"IDEMPOTENCY_WINDOW", "IDEMPOTENCY_CACHE_SIZE", "STATE_FILE", "PUBLISH_LOG_SIZE", "TRASH_RETENTION", "DELETE_CONFIRMATION", "WATCH_INTERVAL", "DRIFT_INTERVAL", "DRIFT_TOPIC",
+	"LEADER_LEASE_BUCKET", "LEADER_LEASE_TTL", "FIRESTORE_CONFIG_PREFIX", "CONFIG_FILE",
+	"TENANCY_REQUIRED", "ACCESS_TOKENS_REQUIRED", "REDIRECT_TRAILING_SLASH",
+	"H2C", "HTTP_IDLE_TIMEOUT", "HTTP_READ_HEADER_TIMEOUT", "HTTP_KEEP_ALIVES", "HTTP_TCP_KEEP_ALIVE", "HTTP_MAX_CONNECTIONS", "HTTP2_MAX_CONCURRENT_STREAMS",
+	"UNIX_SOCKET", "UNIX_SOCKET_MODE", "DRAIN_WINDOW", "SSE_WINDOW", "SSE_OVERFLOW", "SSE_LAG_INTERVAL",
+}
+
+var statusSecretVars = map[string]bool{"ADMIN_TOKEN": true, "ENCRYPTION_KEYS": true}
+
+// recentError is a server error response, or a handler panic
+type recentError struct {
+	Time    time.Time
+	Route   string
+	Status  int
+	Message string
+}
+
+// rateSample is the total of messages published and received through the service at a point in time
+type rateSample struct {
+	at                  time.Time
+	published, received float64
+}
+
+// status holds what the /status page shows beyond the other subsystems' state
+var status = struct {
+	sync.Mutex
+	errors  []recentError // most recent last
+	samples []rateSample  // oldest first
+}{}
+
+// startStatus starts sampling the message totals the /status page derives rates from
+func startStatus() {
+	go func() {
+		for ; ; time.Sleep(rateSampleInterval) {
+			s := rateSample{at: time.Now(), published: metricTotal(publishedMessagesMetric), received: metricTotal(receivedMessagesMetric)}
+			status.Lock()
+			status.samples = append(status.samples, s)
+			if len(status.samples) > rateSamples {
+				status.samples = status.samples[1:]
+			}
+			status.Unlock()
+		}
+	}()
+}
+
+// metricTotal returns the sum of a counter over all its labels
+func metricTotal(name string) float64 {
+	_, _, samples := metricSamples(name)
+	var total float64
+	for _, s := range samples {
+		total += s.value
+	}
+	return total
+}
+
+// recordRecentError keeps an error for the /status page, dropping the oldest beyond maxRecentErrors
+func recordRecentError(route string, statusCode int, msg string) {
+	status.Lock()
+	defer status.Unlock()
+	status.errors = append(status.errors, recentError{Time: time.Now(), Route: route, Status: statusCode, Message: msg})
+	if len(status.errors) > maxRecentErrors {
+		status.errors = status.errors[1:]
+	}
+}
+
+// statusPage is what the /status page template renders
+type statusPage struct {
+	Refresh   int
+	Now       time.Time
+	Uptime    time.Duration
+	Published string
+	Received  string
+	Sections  []statusSection
+	Errors    []recentError
+	Config    [][2]string
+}
+
+// statusSection lists the active objects of a subsystem
+type statusSection struct {
+	Title string
+	Items []string
+}
+
+var statusTemplate = template.Must(template.New("status").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta http-equiv="refresh" content="{{.Refresh}}">
+<title>second status</title>
+<style>
+body { font-family: sans-serif; margin: 2em; }
+pre, td { font-family: monospace; }
+td { padding: 0 1em 0 0; vertical-align: top; }
+.error { color: #b00; }
+</style>
+</head>
+<body>
+<h1>second status</h1>
+<p>{{.Now.Format "2006-01-02 15:04:05 MST"}}, up {{.Uptime}}, refreshed every {{.Refresh}}s</p>
+<h2>Throughput (last minute)</h2>
+<table>
+<tr><td>published</td><td>{{.Published}}</td></tr>
+<tr><td>received</td><td>{{.Received}}</td></tr>
+</table>
+{{range .Sections}}
+<h2>{{.Title}} ({{len .Items}})</h2>
+{{if .Items}}<pre>{{range .Items}}{{.}}
+{{end}}</pre>{{else}}<p>(none)</p>{{end}}
+{{end}}
+<h2>Recent errors</h2>
+{{if .Errors}}<table>
+{{range .Errors}}<tr class="error"><td>{{.Time.Format "15:04:05"}}</td><td>{{.Route}}</td><td>{{.Status}}</td><td>{{.Message}}</td></tr>
+{{end}}</table>{{else}}<p>(none)</p>{{end}}
+<h2>Configuration</h2>
+<table>
+{{range .Config}}<tr><td>{{index . 0}}</td><td>{{index . 1}}</td></tr>
+{{end}}</table>
+</body>
+</html>
+`))
+
+// statusHandler handles GET to /status, an auto-refreshing overview for demos and incidents
+func statusHandler(w http.ResponseWriter, r *http.Request) {
+	page := statusPage{
+		Refresh: int(statusRefresh / time.Second),
+		Now:     time.Now(),
+		Uptime:  time.Since(startTime).Round(time.Second),
+	}
+
+	status.Lock()
+	page.Published, page.Received = "n/a", "n/a"
+	if n := len(status.samples); n >= 2 {
+		first, last := status.samples[0], status.samples[n-1]
+		secs := last.at.Sub(first.at).Seconds()
+		page.Published = fmt.Sprintf("%.1f msg/s", (last.published-first.published)/secs)
+		page.Received = fmt.Sprintf("%.1f msg/s", (last.received-first.received)/secs)
+	}
+	for i := len(status.errors) - 1; i >= 0; i-- {
+		page.Errors = append(page.Errors, status.errors[i])
+	}
+	status.Unlock()
+
+	page.Sections = []statusSection{
+		{Title: "Backend circuit breaker", Items: breakerSummaries()},
+		{Title: "Leader election", Items: leaderSummaries()},
+		{Title: "Firestore configuration", Items: configSummaries()},
+		{Title: "API keys", Items: managedKeySummaries()},
+		{Title: "Routes", Items: routeSummaries()},
+		{Title: "Archivers", Items: archiverSummaries()},
+		{Title: "Sinks", Items: sinkSummaries()},
+		{Title: "Asynchronous jobs", Items: asyncJobSummaries()},
+		{Title: "Dataflow jobs", Items: jobSummaries()},
+		{Title: "Schedules", Items: scheduleSummaries()},
+		{Title: "Priority queues", Items: priorityQueueSummaries()},
+		{Title: "Ingest routes", Items: ingestRouteSummaries()},
+	}
+
+	for _, name := range statusConfigVars {
+		value := setting(name)
+		switch {
+		case value == "":
+			value = "(not set)"
+		case statusSecretVars[name]:
+			value = "(set)"
+		}
+		page.Config = append(page.Config, [2]string{name, value})
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := statusTemplate.Execute(w, page); err != nil {
+		log.Printf("status: %v", err)
+	}
+}
+
+func routeSummaries() []string {
+	routers.Lock()
+	defer routers.Unlock()
+	var list []string
+	for _, rt := range routers.m {
+		list = append(list, rt.summary())
+	}
+	sort.Strings(list)
+	return list
+}
+
+func archiverSummaries() []string {
+	archivers.Lock()
+	defer archivers.Unlock()
+	var list []string
+	for _, a := range archivers.m {
+		list = append(list, a.summary())
+	}
+	sort.Strings(list)
+	return list
+}
+
+func scheduleSummaries() []string {
+	scheduler.Lock()
+	defer scheduler.Unlock()
+	var list []string
+	for _, s := range sortedSchedulesLocked() {
+		list = append(list, s.summaryLocked())
+	}
+	return list
+}
+
+func priorityQueueSummaries() []string {
+	priorityQueues.Lock()
+	defer priorityQueues.Unlock()
+	var list []string
+	for _, pq := range priorityQueues.m {
+		list = append(list, pq.summary())
+	}
+	sort.Strings(list)
+	return list
+}
+
+func ingestRouteSummaries() []string {
+	ingestRoutes.Lock()
+	defer ingestRoutes.Unlock()
+	var list []string
+	for _, ir := range ingestRoutes.m {
+		list = append(list, ir.summary())
+	}
+	sort.Strings(list)
+	return list
+}
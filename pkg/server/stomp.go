@@ -0,0 +1,548 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode/utf8"
+
+	"cloud.google.com/go/pubsub"
+	"golang.org/x/net/websocket"
+)
+
+// STOMP over WebSocket (at /stomp, and on the /graphql WebSocket for clients asking for a STOMP
+// subprotocol): SEND publishes to the destination's topic, SUBSCRIBE receives from the destination's
+// subscription and ACK/NACK acknowledge its messages. Destinations are /topic/<topic-name> for SEND,
+// /subscription/<subscription-name> for SUBSCRIBE, and /queue/<name> for either, naming a topic and
+// a subscription of the same name.
+
+const (
+	// maxStompOutstanding bounds the messages of a client-acknowledged STOMP subscription delivered but not yet acked
+	maxStompOutstanding = 100
+
+	stompServerName = "second"
+)
+
+// stompProtocols maps the WebSocket subprotocols of STOMP to their versions
+var stompProtocols = map[string]string{"v12.stomp": "1.2", "v11.stomp": "1.1", "v10.stomp": "1.0"}
+
+// stompFrame is a STOMP frame; headers keep their order, the first of repeated headers applies
+type stompFrame struct {
+	command string
+	headers [][2]string
+	body    []byte
+}
+
+func (f *stompFrame) header(name string) string {
+	for _, h := range f.headers {
+		if h[0] == name {
+			return h[1]
+		}
+	}
+	return ""
+}
+
+// stompSubscription is a SUBSCRIBE of a STOMP connection, with the messages awaiting an ACK
+type stompSubscription struct {
+	id     string
+	ack    string // "auto", "client" or "client-individual"
+	cancel context.CancelFunc
+	done   chan struct{}
+
+	mu      sync.Mutex
+	pending []*pubsub.Message // in delivery order
+}
+
+// stompConn is a STOMP session over a WebSocket connection
+type stompConn struct {
+	ws      *websocket.Conn
+	version string
+	client  *pubsub.Client
+
+	sendMu sync.Mutex
+
+	mu            sync.Mutex
+	subscriptions map[string]*stompSubscription
+}
+
+// stompWSServer serves STOMP over WebSocket; browsers' origins are not restricted, like the rest of the API
+var stompWSServer = websocket.Server{
+	Handshake: func(config *websocket.Config, r *http.Request) error {
+		if p := stompProtocol(config.Protocol); p != "" {
+			config.Protocol = []string{p}
+		}
+		// clients not asking for a subprotocol get STOMP anyway
+		return nil
+	},
+	Handler: serveStomp,
+}
+
+// stompProtocol returns the preferred STOMP subprotocol of those offered, if any
+func stompProtocol(offered []string) string {
+	best := ""
+	for _, p := range offered {
+		if v, ok := stompProtocols[p]; ok && (best == "" || v > stompProtocols[best]) {
+			best = p
+		}
+	}
+	return best
+}
+
+// stompHandler handles GET to /stomp, a WebSocket endpoint for STOMP clients
+func stompHandler(w http.ResponseWriter, r *http.Request) {
+	end, ok := beginStream(w)
+	if !ok {
+		return
+	}
+	defer end()
+	stompWSServer.ServeHTTP(w, r)
+}
+
+// serveStomp runs a STOMP session: the first frame must be CONNECT (or STOMP), an ERROR frame
+// closes the connection
+func serveStomp(ws *websocket.Conn) {
+	defer ws.Close()
+	c := &stompConn{ws: ws, subscriptions: map[string]*stompSubscription{}}
+	defer c.unsubscribeAll()
+	// on shutdown, the session ends with an ERROR frame
+	closed := make(chan struct{})
+	defer close(closed)
+	go func() {
+		select {
+		case <-drainSignal():
+			c.sendError(nil, shutdownNotice)
+			ws.Close()
+		case <-closed:
+		}
+	}()
+
+	var buf []byte
+	for {
+		var data []byte
+		if err := websocket.Message.Receive(ws, &data); err != nil {
+			return
+		}
+		buf = append(buf, data...)
+		for {
+			f, n, err := parseStompFrame(buf, c.version != "1.0")
+			if err != nil {
+				c.sendError(nil, err.Error())
+				return
+			}
+			if f == nil {
+				break
+			}
+			buf = buf[n:]
+			if !c.handle(f) {
+				return
+			}
+		}
+	}
+}
+
+// handle processes a client frame, returning false when the connection is to be closed
+func (c *stompConn) handle(f *stompFrame) bool {
+	if c.client == nil && f.command != "CONNECT" && f.command != "STOMP" {
+		c.sendError(f, "the first frame must be CONNECT")
+		return false
+	}
+	switch f.command {
+	case "CONNECT", "STOMP":
+		if c.client != nil {
+			c.sendError(f, "already connected")
+			return false
+		}
+		return c.connect(f)
+	case "SEND":
+		if err := c.publish(f); err != nil {
+			c.sendError(f, err.Error())
+			return false
+		}
+	case "SUBSCRIBE":
+		if err := c.subscribe(f); err != nil {
+			c.sendError(f, err.Error())
+			return false
+		}
+	case "UNSUBSCRIBE":
+		id := f.header("id")
+		c.mu.Lock()
+		s, ok := c.subscriptions[id]
+		delete(c.subscriptions, id)
+		c.mu.Unlock()
+		if !ok {
+			c.sendError(f, fmt.Sprintf("no subscription %q", id))
+			return false
+		}
+		s.stop()
+	case "ACK", "NACK":
+		if err := c.acknowledge(f, f.command == "ACK"); err != nil {
+			c.sendError(f, err.Error())
+			return false
+		}
+	case "BEGIN", "COMMIT", "ABORT":
+		c.sendError(f, "transactions are not supported")
+		return false
+	case "DISCONNECT":
+		c.receipt(f)
+		return false
+	default:
+		c.sendError(f, fmt.Sprintf("unknown command %q", f.command))
+		return false
+	}
+	c.receipt(f)
+	return true
+}
+
+// connect negotiates the protocol version and opens the session's Pub/Sub client; heart-beating
+// is declined
+func (c *stompConn) connect(f *stompFrame) bool {
+	c.version = "1.0"
+	for _, v := range strings.Split(f.header("accept-version"), ",") {
+		if v = strings.TrimSpace(v); (v == "1.1" || v == "1.2") && v > c.version {
+			c.version = v
+		}
+	}
+	if p := c.ws.Config().Protocol; len(p) == 1 && stompProtocols[p[0]] != "" && stompProtocols[p[0]] < c.version {
+		c.version = stompProtocols[p[0]]
+	}
+	projectID := setting("GOOGLE_CLOUD_PROJECT")
+	if projectID == "" {
+		c.sendError(f, "failed to get project ID")
+		return false
+	}
+	client, err := pubsub.NewClient(context.Background(), projectID, backendOptions()...)
+	if err != nil {
+		c.sendError(f, err.Error())
+		return false
+	}
+	c.client = client
+	c.send(&stompFrame{command: "CONNECTED", headers: [][2]string{
+		{"version", c.version}, {"heart-beat", "0,0"}, {"server", stompServerName}, {"session", randomID()},
+	}})
+	return true
+}
+
+// stompDestination splits a destination into the topic and subscription it names
+func stompDestination(dest string) (topic, subscription string, err error) {
+	switch {
+	case strings.HasPrefix(dest, "/topic/"):
+		topic = strings.TrimPrefix(dest, "/topic/")
+	case strings.HasPrefix(dest, "/subscription/"):
+		subscription = strings.TrimPrefix(dest, "/subscription/")
+	case strings.HasPrefix(dest, "/queue/"):
+		topic = strings.TrimPrefix(dest, "/queue/")
+		subscription = topic
+	default:
+		return "", "", fmt.Errorf("destination %q must be /topic/<topic-name>, /subscription/<subscription-name> or /queue/<name>", dest)
+	}
+	if topic != "" {
+		if err := validateResourceName("topic", topic); err != nil {
+			return "", "", err
+		}
+	}
+	if subscription != "" {
+		if err := validateResourceName("subscription", subscription); err != nil {
+			return "", "", err
+		}
+	}
+	return topic, subscription, nil
+}
+
+// publish publishes a SEND frame's body; its headers, other than the frame's own, become attributes
+func (c *stompConn) publish(f *stompFrame) error {
+	topic, _, err := stompDestination(f.header("destination"))
+	if err != nil {
+		return err
+	}
+	if topic == "" {
+		return fmt.Errorf("cannot SEND to a subscription")
+	}
+	msg := &pubsub.Message{Data: f.body, Attributes: map[string]string{}}
+	for _, h := range f.headers {
+		switch h[0] {
+		case "destination", "content-length", "receipt", "transaction":
+			continue
+		}
+		if _, ok := msg.Attributes[h[0]]; !ok {
+			msg.Attributes[h[0]] = h[1]
+		}
+	}
+	// publishing is authorized with the credentials of the WebSocket's handshake
+	if err := authorizePublish(c.ws.Request(), topic, []map[string]string{msg.Attributes}); err != nil {
+		return err
+	}
+	_, err = publishMessage(topic, msg)
+	return err
+}
+
+// subscribe starts receiving from the destination's subscription, sending a MESSAGE frame per message
+func (c *stompConn) subscribe(f *stompFrame) error {
+	id := f.header("id")
+	if id == "" {
+		if c.version != "1.0" {
+			return fmt.Errorf("SUBSCRIBE requires an id header")
+		}
+		id = f.header("destination")
+	}
+	ack := f.header("ack")
+	switch ack {
+	case "":
+		ack = "auto"
+	case "auto", "client", "client-individual":
+	default:
+		return fmt.Errorf("invalid ack mode %q", ack)
+	}
+	_, subscrName, err := stompDestination(f.header("destination"))
+	if err != nil {
+		return err
+	}
+	if subscrName == "" {
+		return fmt.Errorf("cannot SUBSCRIBE to a topic, subscribe to one of its subscriptions")
+	}
+	subscr := c.client.Subscription(subscrName)
+	exists, err := subscr.Exists(context.Background())
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return fmt.Errorf("subscription %s not found", subscrName)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	s := &stompSubscription{id: id, ack: ack, cancel: cancel, done: make(chan struct{})}
+	c.mu.Lock()
+	if _, ok := c.subscriptions[id]; ok {
+		c.mu.Unlock()
+		cancel()
+		return fmt.Errorf("subscription id %q is already in use", id)
+	}
+	c.subscriptions[id] = s
+	c.mu.Unlock()
+
+	subscr.ReceiveSettings.MaxOutstandingMessages = maxStompOutstanding
+	dest := f.header("destination")
+	go func() {
+		defer close(s.done)
+		var deliverMu sync.Mutex
+		err := subscr.Receive(ctx, func(_ context.Context, msg *pubsub.Message) {
+			// one MESSAGE frame at a time, so that "client" acks cover the messages sent before
+			deliverMu.Lock()
+			defer deliverMu.Unlock()
+			headers := [][2]string{
+				{"subscription", id}, {"message-id", msg.ID}, {"destination", dest},
+			}
+			if ack == "auto" {
+				msg.Ack()
+			} else {
+				s.mu.Lock()
+				s.pending = append(s.pending, msg)
+				s.mu.Unlock()
+				if c.version == "1.2" {
+					headers = append(headers, [2]string{"ack", msg.ID})
+				}
+			}
+			for _, key := range sortedKeys(msg.Attributes) {
+				headers = append(headers, [2]string{key, msg.Attributes[key]})
+			}
+			recordReceived(subscrName, 1)
+			c.send(&stompFrame{command: "MESSAGE", headers: headers, body: msg.Data})
+		})
+		if err != nil && ctx.Err() == nil {
+			c.sendError(nil, fmt.Sprintf("subscription %s: %v", id, err))
+			c.ws.Close()
+		}
+	}()
+	return nil
+}
+
+// acknowledge acks or nacks a message by its ack (message ID) header; with the "client" ack mode
+// the messages delivered before it on the subscription are acked or nacked too
+func (c *stompConn) acknowledge(f *stompFrame, ack bool) error {
+	if f.header("transaction") != "" {
+		return fmt.Errorf("transactions are not supported")
+	}
+	msgID := f.header("id")
+	if c.version != "1.2" {
+		msgID = f.header("message-id")
+	}
+	c.mu.Lock()
+	var subs []*stompSubscription
+	if id := f.header("subscription"); id != "" {
+		if s, ok := c.subscriptions[id]; ok {
+			subs = append(subs, s)
+		}
+	} else {
+		// STOMP 1.2 acks name the message only
+		for _, s := range c.subscriptions {
+			subs = append(subs, s)
+		}
+	}
+	c.mu.Unlock()
+
+	for _, s := range subs {
+		s.mu.Lock()
+		for i, msg := range s.pending {
+			if msg.ID != msgID {
+				continue
+			}
+			settle := []*pubsub.Message{msg}
+			rest := append(s.pending[:i:i], s.pending[i+1:]...)
+			if s.ack == "client" {
+				settle = s.pending[:i+1]
+				rest = s.pending[i+1:]
+			}
+			s.pending = rest
+			s.mu.Unlock()
+			for _, m := range settle {
+				if ack {
+					m.Ack()
+				} else {
+					m.Nack()
+				}
+			}
+			return nil
+		}
+		s.mu.Unlock()
+	}
+	return fmt.Errorf("message %q is not awaiting acknowledgement", msgID)
+}
+
+// stop ends a subscription, returning its unacknowledged messages for redelivery
+func (s *stompSubscription) stop() {
+	s.cancel()
+	<-s.done
+	s.mu.Lock()
+	for _, msg := range s.pending {
+		msg.Nack()
+	}
+	s.pending = nil
+	s.mu.Unlock()
+}
+
+func (c *stompConn) unsubscribeAll() {
+	c.mu.Lock()
+	subs := c.subscriptions
+	c.subscriptions = map[string]*stompSubscription{}
+	c.mu.Unlock()
+	for _, s := range subs {
+		s.stop()
+	}
+	if c.client != nil {
+		c.client.Close()
+	}
+}
+
+// receipt answers a frame's receipt header
+func (c *stompConn) receipt(f *stompFrame) {
+	if id := f.header("receipt"); id != "" {
+		c.send(&stompFrame{command: "RECEIPT", headers: [][2]string{{"receipt-id", id}}})
+	}
+}
+
+// sendError sends an ERROR frame, about the frame f if not nil
+func (c *stompConn) sendError(f *stompFrame, message string) {
+	headers := [][2]string{{"message", message}}
+	if f != nil {
+		if id := f.header("receipt"); id != "" {
+			headers = append(headers, [2]string{"receipt-id", id})
+		}
+	}
+	c.send(&stompFrame{command: "ERROR", headers: headers, body: []byte(message)})
+}
+
+// send writes a frame as a WebSocket message, a text one unless the body isn't UTF-8
+func (c *stompConn) send(f *stompFrame) {
+	var b bytes.Buffer
+	b.WriteString(f.command + "\n")
+	escape := c.version != "" && c.version != "1.0" && f.command != "CONNECTED"
+	for _, h := range f.headers {
+		if escape {
+			b.WriteString(stompEscape(h[0]) + ":" + stompEscape(h[1]) + "\n")
+		} else {
+			b.WriteString(h[0] + ":" + h[1] + "\n")
+		}
+	}
+	if f.body != nil {
+		b.WriteString("content-length:" + strconv.Itoa(len(f.body)) + "\n")
+	}
+	b.WriteString("\n")
+	b.Write(f.body)
+	b.WriteByte(0)
+
+	c.sendMu.Lock()
+	defer c.sendMu.Unlock()
+	if utf8.Valid(b.Bytes()) {
+		websocket.Message.Send(c.ws, b.String())
+	} else {
+		websocket.Message.Send(c.ws, b.Bytes())
+	}
+}
+
+var (
+	stompEscaper   = strings.NewReplacer("\\", `\\`, "\r", `\r`, "\n", `\n`, ":", `\c`)
+	stompUnescaper = strings.NewReplacer(`\\`, "\\", `\r`, "\r", `\n`, "\n", `\c`, ":")
+)
+
+func stompEscape(s string) string {
+	return stompEscaper.Replace(s)
+}
+
+// parseStompFrame parses the frame at the start of data, returning it and its length in data, or
+// nil if the frame is incomplete; heart-beat EOLs before it are skipped
+func parseStompFrame(data []byte, unescape bool) (*stompFrame, int, error) {
+	start := 0
+	for start < len(data) && (data[start] == '\n' || data[start] == '\r') {
+		start++
+	}
+	if start == len(data) {
+		return nil, 0, nil
+	}
+	end := bytes.Index(data[start:], []byte("\n\n"))
+	sep := 2
+	if crlf := bytes.Index(data[start:], []byte("\r\n\r\n")); crlf >= 0 && (end < 0 || crlf < end) {
+		end, sep = crlf, 4
+	}
+	if end < 0 {
+		return nil, 0, nil
+	}
+	lines := strings.Split(strings.ReplaceAll(string(data[start:start+end]), "\r\n", "\n"), "\n")
+	f := &stompFrame{command: lines[0]}
+	command := f.command
+	for _, line := range lines[1:] {
+		i := strings.IndexByte(line, ':')
+		if i < 0 {
+			return nil, 0, fmt.Errorf("malformed header %q", line)
+		}
+		name, value := line[:i], line[i+1:]
+		if unescape && command != "CONNECT" && command != "STOMP" {
+			name, value = stompUnescaper.Replace(name), stompUnescaper.Replace(value)
+		}
+		f.headers = append(f.headers, [2]string{name, value})
+	}
+
+	bodyStart := start + end + sep
+	if s := f.header("content-length"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 0 {
+			return nil, 0, fmt.Errorf("invalid content-length %q", s)
+		}
+		if len(data) < bodyStart+n+1 {
+			return nil, 0, nil
+		}
+		if data[bodyStart+n] != 0 {
+			return nil, 0, fmt.Errorf("frame body is longer than its content-length")
+		}
+		f.body = append([]byte(nil), data[bodyStart:bodyStart+n]...)
+		return f, bodyStart + n + 1, nil
+	}
+	nul := bytes.IndexByte(data[bodyStart:], 0)
+	if nul < 0 {
+		return nil, 0, nil
+	}
+	f.body = append([]byte(nil), data[bodyStart:bodyStart+nul]...)
+	return f, bodyStart + nul + 1, nil
+}
@@ -0,0 +1,214 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/pubsub"
+)
+
+// GET /summary is a health overview of the project for workshop operators, in one report: how
+// many topics and subscriptions there are, their total estimated backlog, and hygiene findings
+// like subscriptions without a dead-letter policy or topics nobody subscribes to. The backlog
+// comes from Cloud Monitoring and is left out with ?backlog=false.
+
+const (
+	// summaryBacklogTimeout bounds reading the backlog metrics, which are reported unknown past it
+	summaryBacklogTimeout = 10 * time.Second
+
+	// summaryTopBacklogs is how many of the subscriptions with the largest backlog are listed
+	summaryTopBacklogs = 5
+)
+
+// summaryFinding is a hygiene issue and the resources that have it
+type summaryFinding struct {
+	issue     string
+	resources []string
+}
+
+// summaryHandler handles GET to /summary[?backlog=false]
+func summaryHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := context.Background()
+	client, ok := newClient(ctx, w)
+	if !ok {
+		return
+	}
+	defer client.Close()
+
+	readBacklog := true
+	switch s := r.URL.Query().Get("backlog"); s {
+	case "", "true":
+	case "false":
+		readBacklog = false
+	default:
+		http.Error(w, "backlog must be true or false", http.StatusBadRequest)
+		return
+	}
+	if err := waitAdminQuota(r.Context(), adminOpList); err != nil {
+		writeAdminError(w, err, http.StatusServiceUnavailable)
+		return
+	}
+	topics, err := liveTopicConfigs(ctx, client)
+	if err != nil {
+		writeAdminError(w, err, http.StatusInternalServerError)
+		return
+	}
+	subscrs, err := liveSubscriptionConfigs(ctx, client)
+	if err != nil {
+		writeAdminError(w, err, http.StatusInternalServerError)
+		return
+	}
+	expiring, err := expiringSubscriptions(ctx, client, defaultExpiryWindow)
+	if err != nil {
+		writeAdminError(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	projectID := setting("GOOGLE_CLOUD_PROJECT")
+	fmt.Fprintf(w, "Project %s, as of %s\n", projectID, time.Now().UTC().Format(time.RFC3339))
+	trashed := 0
+	for name := range topics {
+		if _, ok := trashedSince(name); ok {
+			trashed++
+		}
+	}
+	fmt.Fprintf(w, "topics: %d (%d in the trash)\n", len(topics), trashed)
+	push, detached := 0, 0
+	for _, cfg := range subscrs {
+		if cfg.PushConfig.Endpoint != "" {
+			push++
+		}
+		if cfg.Detached || cfg.Topic == nil || cfg.Topic.String() == detachedTopic {
+			detached++
+		}
+	}
+	fmt.Fprintf(w, "subscriptions: %d (%d pull, %d push, %d detached)\n", len(subscrs), len(subscrs)-push, push, detached)
+	if readBacklog {
+		bctx, cancel := context.WithTimeout(ctx, summaryBacklogTimeout)
+		backlog, at, err := projectBacklog(bctx, projectID)
+		cancel()
+		writeSummaryBacklog(w, backlog, at, err)
+	} else {
+		fmt.Fprintln(w, "estimated backlog: not read (backlog=false)")
+	}
+
+	findings := summaryFindings(topics, subscrs, expiring)
+	total := 0
+	for _, f := range findings {
+		total += len(f.resources)
+	}
+	if total == 0 {
+		fmt.Fprintln(w, "findings: none")
+		return
+	}
+	fmt.Fprintf(w, "findings: %d\n", total)
+	for _, f := range findings {
+		if len(f.resources) > 0 {
+			fmt.Fprintf(w, "  %s (%d): %s\n", f.issue, len(f.resources), strings.Join(f.resources, ", "))
+		}
+	}
+}
+
+// writeSummaryBacklog writes the total backlog and the subscriptions with the largest ones
+func writeSummaryBacklog(w http.ResponseWriter, backlog map[string]float64, at time.Time, err error) {
+	switch {
+	case err != nil:
+		fmt.Fprintf(w, "estimated backlog: unknown (%v)\n", err)
+		return
+	case at.IsZero():
+		fmt.Fprintln(w, "estimated backlog: unknown (no recent backlog metrics)")
+		return
+	}
+	var total float64
+	names := make([]string, 0, len(backlog))
+	for name, n := range backlog {
+		total += n
+		if n > 0 {
+			names = append(names, name)
+		}
+	}
+	fmt.Fprintf(w, "estimated backlog: %d undelivered messages in %d subscriptions (as of %s)\n",
+		int64(total), len(names), at.Format(time.RFC3339))
+	sort.Slice(names, func(i, j int) bool {
+		if backlog[names[i]] != backlog[names[j]] {
+			return backlog[names[i]] > backlog[names[j]]
+		}
+		return names[i] < names[j]
+	})
+	if len(names) > summaryTopBacklogs {
+		names = names[:summaryTopBacklogs]
+	}
+	for _, name := range names {
+		fmt.Fprintf(w, "  %s: %d\n", name, int64(backlog[name]))
+	}
+}
+
+// summaryFindings returns the project's hygiene issues, each with the resources having it by name
+func summaryFindings(topics map[string]pubsub.TopicConfig, subscrs map[string]pubsub.SubscriptionConfig, expiring []expiringSubscription) []summaryFinding {
+	subscribed := map[string]bool{}
+	deadLetterTopics := map[string]bool{}
+	for _, cfg := range subscrs {
+		if cfg.Topic != nil {
+			subscribed[cfg.Topic.ID()] = true
+		}
+		if p := cfg.DeadLetterPolicy; p != nil {
+			deadLetterTopics[resourceID(p.DeadLetterTopic)] = true
+		}
+	}
+	noSubscriptions := summaryFinding{issue: "topics without subscriptions (not counting the trash)"}
+	for name := range topics {
+		if _, ok := trashedSince(name); ok {
+			continue
+		}
+		if !subscribed[name] {
+			noSubscriptions.resources = append(noSubscriptions.resources, name)
+		}
+	}
+	noDeadLetter := summaryFinding{issue: "subscriptions without a dead-letter policy (those on dead-letter topics aside)"}
+	missingDeadLetter := summaryFinding{issue: "subscriptions whose dead-letter topic doesn't exist"}
+	detached := summaryFinding{issue: "subscriptions detached from their topic, which receive nothing"}
+	for name, cfg := range subscrs {
+		isDetached := cfg.Detached || cfg.Topic == nil || cfg.Topic.String() == detachedTopic
+		if isDetached {
+			detached.resources = append(detached.resources, name)
+		}
+		if p := cfg.DeadLetterPolicy; p == nil {
+			if !isDetached && !deadLetterTopics[cfg.Topic.ID()] {
+				noDeadLetter.resources = append(noDeadLetter.resources, name)
+			}
+		} else if _, ok := topics[resourceID(p.DeadLetterTopic)]; !ok {
+			missingDeadLetter.resources = append(missingDeadLetter.resources, name+" -> "+resourceID(p.DeadLetterTopic))
+		}
+	}
+	naming := summaryFinding{issue: "resources breaking the naming policy"}
+	for name, cfg := range topics {
+		if checkNamingPolicy("topic", name, cfg.Labels) != nil {
+			naming.resources = append(naming.resources, "topic "+name)
+		}
+	}
+	for name, cfg := range subscrs {
+		if checkNamingPolicy("subscription", name, cfg.Labels) != nil {
+			naming.resources = append(naming.resources, "subscription "+name)
+		}
+	}
+	soonExpiring := summaryFinding{issue: fmt.Sprintf("subscriptions expiring within %s for lack of activity (see GET /expiring)", defaultExpiryWindow)}
+	for _, s := range expiring {
+		soonExpiring.resources = append(soonExpiring.resources, s.name)
+	}
+
+	findings := []summaryFinding{noDeadLetter, missingDeadLetter, noSubscriptions, detached, soonExpiring, naming}
+	for _, f := range findings {
+		sort.Strings(f.resources)
+	}
+	return findings
+}
+
+// resourceID returns the last segment of a full resource name, like the topic ID of
+// projects/<project>/topics/<topic>
+func resourceID(name string) string {
+	return name[strings.LastIndex(name, "/")+1:]
+}
@@ -0,0 +1,206 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/pubsub"
+)
+
+const (
+	defaultTailSince = 5 * time.Minute
+	maxTailSince     = 7 * 24 * time.Hour
+
+	// disposableCleanupTimeout bounds deleting a disposable subscription (and a tail's snapshot)
+	// after the client left
+	disposableCleanupTimeout = 30 * time.Second
+	// disposableExpiration is the shortest expiration policy Pub/Sub allows
+	disposableExpiration = 24 * time.Hour
+)
+
+// subscriptionTailHandler handles GET to /subscriptions/<subscription-name>/tail[?since=<duration>],
+// streaming the messages of the subscription's topic from since ago (default 5m) until the client
+// disconnects, as server-sent events with 'Accept: text/event-stream'. The messages are received
+// through a disposable subscription seeked back in time, which leaves the subscription itself
+// untouched; topics without message retention only have the subscription's backlog to replay,
+// which is taken from a snapshot instead.
+func subscriptionTailHandler(ctx context.Context, w http.ResponseWriter, r *http.Request, client *pubsub.Client, subscr *pubsub.Subscription) {
+	since := defaultTailSince
+	if s := r.URL.Query().Get("since"); s != "" {
+		d, err := time.ParseDuration(s)
+		if err != nil || d < 0 || d > maxTailSince {
+			http.Error(w, fmt.Sprintf("since must be a duration up to %s", maxTailSince), http.StatusBadRequest)
+			return
+		}
+		since = d
+	}
+	cfg, err := subscr.Config(ctx)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if cfg.Detached || cfg.Topic == nil {
+		http.Error(w, fmt.Sprintf("subscription %s is detached from its topic", subscr.ID()), http.StatusConflict)
+		return
+	}
+
+	var snapshot *pubsub.SnapshotConfig
+	if cfg.TopicMessageRetentionDuration == 0 && since > 0 {
+		if snapshot, err = subscr.CreateSnapshot(ctx, ""); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		defer func() {
+			cctx, cancel := context.WithTimeout(context.Background(), disposableCleanupTimeout)
+			defer cancel()
+			if err := snapshot.Delete(cctx); err != nil {
+				log.Printf("tail of %s: deleting snapshot: %v", subscr.ID(), err)
+			}
+		}()
+	}
+
+	// the tail's subscription is named after the source, which keeps it in a tenant's namespace
+	streamDisposable(w, r, client, cfg.Topic, subscr.ID()+"-tail", func(tail *pubsub.Subscription) error {
+		var err error
+		switch {
+		case snapshot != nil:
+			err = tail.SeekToSnapshot(ctx, snapshot.Snapshot)
+		case since > 0:
+			err = tail.SeekToTime(ctx, time.Now().Add(-since))
+		}
+		if err != nil {
+			return err
+		}
+		if snapshot != nil {
+			fmt.Fprintf(w, "tailing topic %s from the backlog of subscription %s (the topic retains no messages)\n", cfg.Topic.ID(), subscr.ID())
+		} else {
+			fmt.Fprintf(w, "tailing topic %s from %s\n", cfg.Topic.ID(), time.Now().Add(-since).UTC().Format(time.RFC3339))
+		}
+		return nil
+	})
+}
+
+// streamDisposable creates a subscription to the topic, named prefix-<random-id>, which prepare
+// may seek before it is received from, streams its messages until the client disconnects, and
+// deletes it; should deleting it fail, it expires after a day, the shortest expiration possible
+func streamDisposable(w http.ResponseWriter, r *http.Request, client *pubsub.Client, topic *pubsub.Topic, prefix string,
+	prepare func(*pubsub.Subscription) error) {
+	end, ok := beginStream(w)
+	if !ok {
+		return
+	}
+	defer end()
+	if len(prefix) > 240 {
+		prefix = prefix[:240]
+	}
+	name := prefix + "-" + randomID()[:12]
+	cfg := newSubscriptionConfig(topic)
+	cfg.ExpirationPolicy = disposableExpiration
+	subscr, err := client.CreateSubscription(r.Context(), name, cfg)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer func() {
+		cctx, cancel := context.WithTimeout(context.Background(), disposableCleanupTimeout)
+		defer cancel()
+		if err := subscr.Delete(cctx); err != nil {
+			log.Printf("disposable subscription %s: delete: %v", name, err)
+		}
+	}()
+	w.Header().Set("Cache-Control", "no-store")
+	if err := prepare(subscr); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	flushResponse(w)
+
+	var (
+		mu            sync.Mutex
+		received      int
+		receivedBytes int
+	)
+	ctx, cancel := withDrain(r.Context())
+	defer cancel()
+	// messages are settled once written, so those waiting for a slow client count against the
+	// limits and pause the pull; those waiting longer than the age limit are nacked
+	limits := loadBufferLimits(tailBuffer)
+	limits.applyTo(subscr)
+	writeLocked := func(msg *pubsub.Message) {
+		received++
+		receivedBytes += len(msg.Data)
+		fmt.Fprintln(w, tailLine(msg))
+		flushResponse(w)
+		msg.Ack()
+	}
+	// event streams are paced by the client (see sse.go)
+	if pacer := newSSEPacer(w, subscr); pacer != nil {
+		pacer.maxWait = limits.age
+		pacer.start(ctx, func(_ context.Context, msg *pubsub.Message) {
+			mu.Lock()
+			defer mu.Unlock()
+			writeLocked(msg)
+		})
+		err = subscr.Receive(ctx, pacer.receive)
+		pacer.stop()
+	} else {
+		err = subscr.Receive(ctx, func(_ context.Context, msg *pubsub.Message) {
+			arrived := time.Now()
+			mu.Lock()
+			defer mu.Unlock()
+			if limits.expired(arrived) {
+				msg.Nack()
+				recordBufferDrops(tailBuffer, "age", 1)
+				return
+			}
+			writeLocked(msg)
+		})
+	}
+	if err != nil && ctx.Err() == nil {
+		fmt.Fprintf(w, "sub.Receive: %v\n", err)
+	}
+	if r.Context().Err() == nil && draining() {
+		writeShutdownNotice(w)
+	}
+	recordReceived(name, received)
+	recordUsage(r, usageCounters{Received: int64(received), ReceivedBytes: int64(receivedBytes)})
+}
+
+// topicTapHandler handles POST to /topics/<topic-name>/tap, streaming the messages published to the
+// topic from now on until the client disconnects, through a subscription deleted afterwards
+func topicTapHandler(_ context.Context, w http.ResponseWriter, r *http.Request, client *pubsub.Client, topic *pubsub.Topic) {
+	streamDisposable(w, r, client, topic, topic.ID()+"-tap", func(tap *pubsub.Subscription) error {
+		fmt.Fprintf(w, "tapping topic %s through subscription %s\n", topic.ID(), tap.ID())
+		return nil
+	})
+}
+
+// tailLine formats a tailed message as one line: its publish time, ID, data and attributes
+func tailLine(msg *pubsub.Message) string {
+	shown, err := decryptForDisplay(msg)
+	shown = redactMessage(shown)
+	data := fmt.Sprintf("%q", shown.Data)
+	if err != nil {
+		data = "(encrypted)"
+	}
+	keys := make([]string, 0, len(shown.Attributes))
+	for k := range shown.Attributes {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	attrs := make([]string, len(keys))
+	for i, k := range keys {
+		attrs[i] = k + "=" + shown.Attributes[k]
+	}
+	line := fmt.Sprintf("%s %s %s", msg.PublishTime.UTC().Format(time.RFC3339Nano), msg.ID, data)
+	if len(attrs) > 0 {
+		line += " " + strings.Join(attrs, " ")
+	}
+	return line
+}
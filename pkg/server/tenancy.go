@@ -0,0 +1,168 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+// A managed API key created with a namespace belongs to a tenant. A tenant's requests see the
+// topics and subscriptions named <namespace>-<name> as plain <name>: names in paths and request
+// bodies are prefixed, listings only show the tenant's resources, and resource names in responses
+// are unprefixed. Tenants are limited to the topic and subscription endpoints below, as the others
+// (routes, archivers, schedules, ...) name resources in ways that can't be confined to a namespace.
+// With TENANCY_REQUIRED=true, requests need a tenant's key or the admin token. Namespaces have no
+// dashes, so that no namespace is the <namespace>- prefix of another's resources.
+
+var namespacePattern = regexp.MustCompile(`^[a-z][a-z0-9]{0,19}$`)
+
+// tenantRoutes are the routes open to tenants, by method and pattern
+var tenantRoutes = map[string]bool{
+	"GET /topics":                        true,
+	"PUT /topics":                        true,
+	"GET /topics/{name}":                 true,
+	"POST /topics/{name}":                true,
+	"DELETE /topics/{name}":              true,
+	"POST /topics/{name}/tap":            true,
+	"GET /subscriptions":                 true,
+	"PUT /subscriptions":                 true,
+	"GET /subscriptions/{name}":          true,
+	"POST /subscriptions/{name}":         true,
+	"PATCH /subscriptions/{name}":        true,
+	"DELETE /subscriptions/{name}":       true,
+	"GET /subscriptions/{name}/lag":      true,
+	"GET /subscriptions/{name}/messages": true,
+	"POST /subscriptions/{name}/search":  true,
+	"GET /usage":                         true,
+	"GET /consumers":                     true,
+	"GET /consumers/{id}/stats":          true,
+	"GET /consumers/{id}/messages":       true,
+	"POST /consumers":                    true,
+	"PATCH /consumers/{id}":              true,
+	"GET /":                              true,
+	"GET /-":                             true,
+	"GET /readyz":                        true,
+}
+
+// tenantBodyNames are the properties of request bodies naming topics or subscriptions, by route
+var tenantBodyNames = map[string][]string{
+	"PUT /topics":        {"name"},
+	"PUT /subscriptions": {"name", "topic"},
+	"POST /consumers":    {"subscription"},
+}
+
+// tenantKey is the request context key of the tenant's namespace
+type tenantKey struct{}
+
+// tenantName returns the name of a tenant's resource as known to Pub/Sub
+func tenantName(namespace, name string) string {
+	if namespace == "" {
+		return name
+	}
+	return namespace + "-" + name
+}
+
+// requestTenant returns the namespace of the request's tenant, "" if it's not a tenant's
+func requestTenant(r *http.Request) string {
+	ns, _ := r.Context().Value(tenantKey{}).(string)
+	return ns
+}
+
+// tenantOwns reports whether the request may see the topic or subscription with the given ID,
+// which a workshop token's pattern must match too
+func tenantOwns(r *http.Request, id string) bool {
+	if t := requestAccessToken(r); t != nil && !t.reaches(id) {
+		return false
+	}
+	ns := requestTenant(r)
+	return ns == "" || strings.HasPrefix(id, ns+"-")
+}
+
+// applyTenancy confines the request of a tenant to its namespace, responding 401 or 403 and
+// returning false if it may not go ahead
+func applyTenancy(route apiRoute, params map[string]string, w http.ResponseWriter, r *http.Request) (http.ResponseWriter, *http.Request, bool) {
+	routeKey := route.method + " " + route.pattern
+	if isAdmin(r) {
+		return w, r, true
+	}
+	var ns string
+	if key := r.Header.Get(APIKeyHeader); key != "" {
+		k, err := lookupManagedKey(key)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return w, r, false
+		}
+		if k != nil {
+			ns = k.Namespace
+		}
+	}
+	if ns == "" {
+		if setting("TENANCY_REQUIRED") == "true" && routeKey != "GET /" && routeKey != "GET /-" && routeKey != "GET /readyz" {
+			http.Error(w, fmt.Sprintf("a tenant's API key is required in the %s header", APIKeyHeader), http.StatusUnauthorized)
+			return w, r, false
+		}
+		return w, r, true
+	}
+	if !tenantRoutes[routeKey] {
+		http.Error(w, fmt.Sprintf("%s is not available to tenants", routeKey), http.StatusForbidden)
+		return w, r, false
+	}
+
+	if name, ok := params["name"]; ok {
+		params["name"] = tenantName(ns, name)
+	}
+	if fields := tenantBodyNames[routeKey]; len(fields) > 0 {
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return w, r, false
+		}
+		var props map[string]interface{}
+		if json.Unmarshal(body, &props) == nil {
+			for _, f := range fields {
+				if name, ok := props[f].(string); ok {
+					props[f] = tenantName(ns, name)
+				}
+			}
+			body, _ = json.Marshal(props)
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		r.ContentLength = int64(len(body))
+	}
+	r = r.WithContext(context.WithValue(r.Context(), tenantKey{}, ns))
+	prefix := ns + "-"
+	tw := &tenantResponseWriter{
+		ResponseWriter: w,
+		unprefix: strings.NewReplacer(
+			"/topics/"+prefix, "/topics/",
+			"/subscriptions/"+prefix, "/subscriptions/",
+			"topic "+prefix, "topic ",
+			"subscription "+prefix, "subscription ",
+			"Topic: "+prefix, "Topic: ",
+		),
+	}
+	return tw, r, true
+}
+
+// tenantResponseWriter unprefixes the resource names in a tenant's responses
+type tenantResponseWriter struct {
+	http.ResponseWriter
+	unprefix *strings.Replacer
+}
+
+func (w *tenantResponseWriter) Write(p []byte) (int, error) {
+	if _, err := w.ResponseWriter.Write([]byte(w.unprefix.Replace(string(p)))); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// Flush passes flushes of streamed responses through
+func (w *tenantResponseWriter) Flush() {
+	flushResponse(w.ResponseWriter)
+}
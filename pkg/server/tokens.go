@@ -0,0 +1,302 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Workshop tokens are short-lived credentials an admin mints with POST /admin/tokens for
+// attendees: sent as 'Authorization: Bearer <token>', a token reaches the topic and subscription
+// endpoints of its verbs only, for the topics and subscriptions whose names match its pattern
+// (like team7-*), and stops working when it expires, within a day. Listings only show the
+// matching resources. With ACCESS_TOKENS_REQUIRED=true, requests need a workshop token or the
+// admin token.
+
+const (
+	defaultTokenTTL = 8 * time.Hour
+	maxTokenTTL     = 24 * time.Hour
+
+	// tokenPrefix starts workshop tokens, telling them from the admin token
+	tokenPrefix = "wt_"
+)
+
+// tokenRouteVerbs are the routes open to workshop tokens, by method and pattern, with the verb
+// a token needs for each; "" for those open to every token
+var tokenRouteVerbs = map[string]string{
+	"GET /":                                 "",
+	"GET /-":                                "",
+	"GET /readyz":                           "",
+	"GET /topics":                           "read",
+	"GET /topics/{name}":                    "read",
+	"GET /subscriptions":                    "read",
+	"GET /subscriptions/{name}":             "read",
+	"GET /subscriptions/{name}/lag":         "read",
+	"PUT /topics":                           "create",
+	"PUT /subscriptions":                    "create",
+	"PATCH /subscriptions/{name}":           "update",
+	"GET /topics/{name}/delete-plan":        "delete",
+	"GET /subscriptions/{name}/delete-plan": "delete",
+	"DELETE /topics/{name}":                 "delete",
+	"DELETE /subscriptions/{name}":          "delete",
+	"POST /topics/{name}":                   "publish",
+	"GET /subscriptions/{name}/messages":    "receive",
+	"POST /subscriptions/{name}":            "receive",
+	"GET /subscriptions/{name}/tail":        "receive",
+	"POST /subscriptions/{name}/search":     "receive",
+}
+
+// tokenVerbs are the verbs a workshop token can be given
+var tokenVerbs = []string{"read", "create", "update", "delete", "publish", "receive"}
+
+// accessToken is a workshop token; the token itself is only shown once
+type accessToken struct {
+	ID        string    `json:"id"`
+	Principal string    `json:"principal"`
+	Hash      string    `json:"hash"`  // hex SHA-256 of the token
+	Names     string    `json:"names"` // the pattern of the topics and subscriptions it reaches
+	Verbs     []string  `json:"verbs"`
+	Created   time.Time `json:"created"`
+	Expires   time.Time `json:"expires"`
+}
+
+var accessTokens = struct {
+	sync.Mutex
+	m map[string]*accessToken
+}{m: map[string]*accessToken{}}
+
+// accessTokenKey is the request context key of the request's workshop token
+type accessTokenKey struct{}
+
+var createTokenSchema = objectSchema(map[string]*jsonSchema{
+	"principal": stringSchema("who the token is for, like an attendee"),
+	"names":     stringSchema("pattern of the topics and subscriptions the token reaches, like team7-*"),
+	"verbs":     {Type: "array", Description: "what the token may do", Items: &jsonSchema{Type: "string", Enum: tokenVerbs}},
+	"expiresIn": stringSchema("how long the token is valid, at most 24h (default 8h)"),
+}, "principal", "names", "verbs")
+
+// loadAccessTokens reads the workshop tokens kept in the state store
+func loadAccessTokens() {
+	accessTokens.Lock()
+	defer accessTokens.Unlock()
+	accessTokens.m = map[string]*accessToken{}
+	stateLoad(accessTokensBucket, func(id string, data []byte) error {
+		t := &accessToken{}
+		if err := json.Unmarshal(data, t); err != nil {
+			return err
+		}
+		accessTokens.m[id] = t
+		return nil
+	})
+}
+
+// lookupAccessToken returns a copy of the workshop token of the request's Authorization header,
+// nil if it has none, or the reason it can't be used
+func lookupAccessToken(r *http.Request) (*accessToken, error) {
+	auth := r.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, "Bearer "+tokenPrefix) {
+		return nil, nil
+	}
+	hash := hashAPIKey(strings.TrimPrefix(auth, "Bearer "))
+	accessTokens.Lock()
+	defer accessTokens.Unlock()
+	for _, t := range accessTokens.m {
+		if subtle.ConstantTimeCompare([]byte(hash), []byte(t.Hash)) != 1 {
+			continue
+		}
+		if time.Now().After(t.Expires) {
+			return nil, fmt.Errorf("workshop token %s expired at %s", t.ID, t.Expires.Format(time.RFC3339))
+		}
+		found := *t
+		return &found, nil
+	}
+	return nil, fmt.Errorf("unknown or revoked workshop token")
+}
+
+// requestAccessToken returns the workshop token of the request, nil if it has none
+func requestAccessToken(r *http.Request) *accessToken {
+	t, _ := r.Context().Value(accessTokenKey{}).(*accessToken)
+	return t
+}
+
+// reaches reports whether the token's pattern matches the name of a topic or subscription
+func (t *accessToken) reaches(name string) bool {
+	ok, _ := path.Match(t.Names, name)
+	return ok
+}
+
+// applyAccessToken confines the request of a workshop token to its verbs and names, responding
+// 401 or 403 and returning false if it may not go ahead
+func applyAccessToken(route apiRoute, params map[string]string, w http.ResponseWriter, r *http.Request) (*http.Request, bool) {
+	routeKey := route.method + " " + route.pattern
+	t, err := lookupAccessToken(r)
+	if err != nil {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return r, false
+	}
+	if t == nil {
+		if setting("ACCESS_TOKENS_REQUIRED") == "true" && !isAdmin(r) {
+			if verb, ok := tokenRouteVerbs[routeKey]; !ok || verb != "" {
+				w.Header().Set("WWW-Authenticate", "Bearer")
+				http.Error(w, "a workshop token or the admin token is required as 'Authorization: Bearer <token>'", http.StatusUnauthorized)
+				return r, false
+			}
+		}
+		return r, true
+	}
+
+	verb, ok := tokenRouteVerbs[routeKey]
+	if !ok {
+		http.Error(w, fmt.Sprintf("%s is not available to workshop tokens", routeKey), http.StatusForbidden)
+		return r, false
+	}
+	if verb != "" && !containsString(t.Verbs, verb) {
+		http.Error(w, fmt.Sprintf("workshop token %s may not %s (allowed: %s)", t.ID, verb, strings.Join(t.Verbs, ", ")), http.StatusForbidden)
+		return r, false
+	}
+	var names []string
+	if name, ok := params["name"]; ok {
+		names = append(names, name)
+	}
+	if fields := tenantBodyNames[routeKey]; len(fields) > 0 {
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return r, false
+		}
+		var props map[string]interface{}
+		if json.Unmarshal(body, &props) == nil {
+			for _, f := range fields {
+				if name, ok := props[f].(string); ok {
+					names = append(names, name)
+				}
+			}
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+	}
+	for _, name := range names {
+		if !t.reaches(name) {
+			http.Error(w, fmt.Sprintf("workshop token %s only reaches names matching %s, not %s", t.ID, t.Names, name), http.StatusForbidden)
+			return r, false
+		}
+	}
+	return r.WithContext(context.WithValue(r.Context(), accessTokenKey{}, t)), true
+}
+
+func (t *accessToken) summary() string {
+	state := "active"
+	if time.Now().After(t.Expires) {
+		state = "expired"
+	}
+	return fmt.Sprintf("%s: principal=%s hash=sha256:%s… names=%s verbs=%s state=%s created=%s expires=%s",
+		t.ID, t.Principal, t.Hash[:12], t.Names, strings.Join(t.Verbs, ","), state,
+		t.Created.Format(time.RFC3339), t.Expires.Format(time.RFC3339))
+}
+
+// listTokensHandler handles GET to /admin/tokens
+func listTokensHandler(w http.ResponseWriter, r *http.Request) {
+	if !requireAdmin(w, r) {
+		return
+	}
+	accessTokens.Lock()
+	var list []string
+	for _, t := range accessTokens.m {
+		list = append(list, t.summary())
+	}
+	accessTokens.Unlock()
+	sort.Strings(list)
+	fmt.Fprintln(w, "Workshop tokens\n---------------")
+	for _, s := range list {
+		fmt.Fprintln(w, s)
+	}
+	if len(list) == 0 {
+		fmt.Fprintln(w, "(none)")
+	}
+}
+
+// createTokenHandler handles POST to /admin/tokens, minting a workshop token; tokens expired
+// for a day are dropped at the same time
+func createTokenHandler(w http.ResponseWriter, r *http.Request) {
+	if !requireAdmin(w, r) {
+		return
+	}
+	// get token details from body:
+	// '{"principal":"attendee-3", "names":"team7-*", "verbs":["read","publish","receive"], "expiresIn":"4h"}'
+	var req struct {
+		Principal string   `json:"principal"`
+		Names     string   `json:"names"`
+		Verbs     []string `json:"verbs"`
+		ExpiresIn string   `json:"expiresIn"`
+	}
+	if !readRequest(w, r, createTokenSchema, &req) {
+		return
+	}
+	if req.Principal == "" || req.Names == "" || len(req.Verbs) == 0 {
+		http.Error(w, "principal, names and verbs must not be empty", http.StatusBadRequest)
+		return
+	}
+	if _, err := path.Match(req.Names, ""); err != nil {
+		http.Error(w, fmt.Sprintf("names %q: %v", req.Names, err), http.StatusBadRequest)
+		return
+	}
+	ttl := defaultTokenTTL
+	if req.ExpiresIn != "" {
+		d, err := time.ParseDuration(req.ExpiresIn)
+		if err != nil || d <= 0 || d > maxTokenTTL {
+			http.Error(w, fmt.Sprintf("expiresIn must be a positive duration of at most %s", maxTokenTTL), http.StatusBadRequest)
+			return
+		}
+		ttl = d
+	}
+	secret := tokenPrefix + randomID()
+	t := &accessToken{
+		ID:        "tok-" + randomID()[:8],
+		Principal: req.Principal,
+		Hash:      hashAPIKey(secret),
+		Names:     req.Names,
+		Verbs:     req.Verbs,
+		Created:   time.Now(),
+	}
+	t.Expires = t.Created.Add(ttl)
+
+	accessTokens.Lock()
+	for id, old := range accessTokens.m {
+		if time.Since(old.Expires) > maxTokenTTL {
+			delete(accessTokens.m, id)
+			stateDelete(accessTokensBucket, id)
+		}
+	}
+	accessTokens.m[t.ID] = t
+	statePut(accessTokensBucket, t.ID, t)
+	accessTokens.Unlock()
+	w.WriteHeader(http.StatusCreated)
+	fmt.Fprintf(w, "created workshop token %s\n", t.summary())
+	fmt.Fprintf(w, "token: %s\n(shown only once: send it as 'Authorization: Bearer <token>')\n", secret)
+}
+
+// deleteTokenHandler handles DELETE to /admin/tokens/<token-id>, revoking the token
+func deleteTokenHandler(w http.ResponseWriter, r *http.Request) {
+	if !requireAdmin(w, r) {
+		return
+	}
+	id := pathParam(r, "id")
+	accessTokens.Lock()
+	defer accessTokens.Unlock()
+	if _, ok := accessTokens.m[id]; !ok {
+		http.Error(w, fmt.Sprintf("workshop token %s not found", id), http.StatusNotFound)
+		return
+	}
+	delete(accessTokens.m, id)
+	stateDelete(accessTokensBucket, id)
+	fmt.Fprintf(w, "revoked workshop token %s\n", id)
+}
@@ -0,0 +1,169 @@
+package server
+
+import (
+	"container/list"
+	"context"
+	"fmt"
+	"log"
+	"strconv"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/pubsub"
+)
+
+const (
+	defaultTopicCacheSize = 100
+	defaultTopicCacheIdle = 10 * time.Minute
+
+	topicCacheSizeMetric      = "second_topic_cache_size"
+	topicCacheRequestsMetric  = "second_topic_cache_requests_total"
+	topicCacheEvictionsMetric = "second_topic_cache_evictions_total"
+)
+
+// topicCacheEntry is a cached topic handle; handles in use are never evicted
+type topicCacheEntry struct {
+	name     string
+	topic    *pubsub.Topic
+	inUse    int
+	lastUsed time.Time
+}
+
+// topicCache keeps topic handles (and so their publishers' batching) alive across
+// requests, evicting the least recently used ones and those idle for too long
+var topicCache = struct {
+	sync.Mutex
+	client  *pubsub.Client
+	size    int
+	idle    time.Duration
+	lru     *list.List // of *topicCacheEntry, most recently used first
+	entries map[string]*list.Element
+}{lru: list.New(), entries: map[string]*list.Element{}}
+
+// startTopicCache reads the cache settings and starts evicting idle handles
+func startTopicCache() {
+	topicCache.Lock()
+	topicCache.size = defaultTopicCacheSize
+	if s := setting("TOPIC_CACHE_SIZE"); s != "" {
+		if n, err := strconv.Atoi(s); err != nil || n < 1 {
+			log.Printf("topic cache: invalid TOPIC_CACHE_SIZE %q, using %d", s, defaultTopicCacheSize)
+		} else {
+			topicCache.size = n
+		}
+	}
+	topicCache.idle = defaultTopicCacheIdle
+	if s := setting("TOPIC_CACHE_IDLE"); s != "" {
+		if d, err := time.ParseDuration(s); err != nil || d <= 0 {
+			log.Printf("topic cache: invalid TOPIC_CACHE_IDLE %q, using %s", s, defaultTopicCacheIdle)
+		} else {
+			topicCache.idle = d
+		}
+	}
+	idle := topicCache.idle
+	loadPublishFlowControl()
+	topicCache.Unlock()
+
+	go func() {
+		for range time.Tick(idle / 2) {
+			topicCache.Lock()
+			for e := topicCache.lru.Back(); e != nil; {
+				prev := e.Prev()
+				if entry := e.Value.(*topicCacheEntry); entry.inUse == 0 && time.Since(entry.lastUsed) > idle {
+					evictTopicLocked(e, "idle")
+				}
+				e = prev
+			}
+			topicCache.Unlock()
+		}
+	}()
+}
+
+// acquireTopic returns a cached handle for the topic, which must be released after use
+func acquireTopic(name string) (*pubsub.Topic, func(), error) {
+	topicCache.Lock()
+	defer topicCache.Unlock()
+
+	e, ok := topicCache.entries[name]
+	if ok {
+		topicCache.lru.MoveToFront(e)
+		counterAdd(topicCacheRequestsMetric, "Topic handle cache lookups, by result.", 1, "result", "hit")
+	} else {
+		if topicCache.client == nil {
+			projectID := setting("GOOGLE_CLOUD_PROJECT")
+			if projectID == "" {
+				return nil, nil, fmt.Errorf("failed to get project ID")
+			}
+			client, err := pubsub.NewClient(context.Background(), projectID, backendOptions()...)
+			if err != nil {
+				return nil, nil, err
+			}
+			topicCache.client = client
+		}
+		topic := topicCache.client.Topic(name)
+		topic.PublishSettings.FlowControlSettings = publishFlowControl
+		e = topicCache.lru.PushFront(&topicCacheEntry{name: name, topic: topic})
+		topicCache.entries[name] = e
+		gaugeSet(topicCacheSizeMetric, "Topic handles currently cached.", float64(topicCache.lru.Len()))
+		counterAdd(topicCacheRequestsMetric, "Topic handle cache lookups, by result.", 1, "result", "miss")
+
+		// make room, skipping handles still in use
+		for victim := topicCache.lru.Back(); victim != nil && topicCache.lru.Len() > topicCache.size; {
+			prev := victim.Prev()
+			if victim.Value.(*topicCacheEntry).inUse == 0 && victim != e {
+				evictTopicLocked(victim, "size")
+			}
+			victim = prev
+		}
+	}
+
+	entry := e.Value.(*topicCacheEntry)
+	entry.inUse++
+	entry.lastUsed = time.Now()
+	released := false
+	release := func() {
+		topicCache.Lock()
+		defer topicCache.Unlock()
+		if !released {
+			released = true
+			entry.inUse--
+			entry.lastUsed = time.Now()
+		}
+	}
+	return entry.topic, release, nil
+}
+
+// forgetTopic evicts the cached handle for a topic, e.g. after the topic was deleted
+func forgetTopic(name string) {
+	topicCache.Lock()
+	defer topicCache.Unlock()
+	if e, ok := topicCache.entries[name]; ok {
+		evictTopicLocked(e, "deleted")
+	}
+}
+
+// evictTopicLocked removes a handle from the cache and flushes its pending messages in the background
+func evictTopicLocked(e *list.Element, reason string) {
+	entry := e.Value.(*topicCacheEntry)
+	topicCache.lru.Remove(e)
+	delete(topicCache.entries, entry.name)
+	gaugeSet(topicCacheSizeMetric, "Topic handles currently cached.", float64(topicCache.lru.Len()))
+	counterAdd(topicCacheEvictionsMetric, "Topic handles evicted from the cache, by reason.", 1, "reason", reason)
+	go entry.topic.Stop()
+}
+
+// flushTopicCache stops all cached handles, waiting for their pending messages to be published
+func flushTopicCache() {
+	topicCache.Lock()
+	defer topicCache.Unlock()
+	var wg sync.WaitGroup
+	for e := topicCache.lru.Front(); e != nil; e = e.Next() {
+		wg.Add(1)
+		go func(t *pubsub.Topic) {
+			defer wg.Done()
+			t.Stop()
+		}(e.Value.(*topicCacheEntry).topic)
+	}
+	wg.Wait()
+	topicCache.lru.Init()
+	topicCache.entries = map[string]*list.Element{}
+}
@@ -0,0 +1,211 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+	"golang.org/x/net/netutil"
+)
+
+// The HTTP server's connections are tuned through HTTP_* settings: load balancers in front of the
+// service keep connections open for the long SSE, WebSocket and tail streams, so idle keep-alive
+// connections are closed after HTTP_IDLE_TIMEOUT, dead peers are found by TCP keep-alives and
+// HTTP_MAX_CONNECTIONS caps the connections accepted at once. With H2C=true, HTTP/2 is also served
+// without TLS (prior knowledge or an h2c upgrade), multiplexing streams over one connection, e.g.
+// for a colocated gRPC gateway. Responses have no write timeout, which would cut streams short.
+//
+// For sidecar deployments consumed by a local process only, the service listens on the unix socket
+// UNIX_SOCKET instead of a TCP port, or on the socket systemd passes it with socket activation
+// (LISTEN_FDS), which takes precedence.
+
+const (
+	defaultHTTPIdleTimeout       = 2 * time.Minute
+	defaultHTTPReadHeaderTimeout = 10 * time.Second
+	defaultTCPKeepAlive          = 30 * time.Second
+	defaultHTTP2MaxStreams       = 250
+	defaultUnixSocketMode        = 0660
+
+	// listenFDsStart is the first file descriptor systemd passes sockets from
+	listenFDsStart = 3
+)
+
+// transportSettings are the HTTP server's connection settings
+type transportSettings struct {
+	h2c               bool
+	idleTimeout       time.Duration
+	readHeaderTimeout time.Duration
+	keepAlives        bool
+	tcpKeepAlive      time.Duration // 0 disables TCP keep-alives
+	maxConnections    int           // 0 for no limit
+	maxStreams        uint32        // concurrent HTTP/2 streams per connection
+}
+
+// readTransportSettings reads the HTTP_* and H2C settings, logging invalid ones and using their
+// defaults instead
+func readTransportSettings() transportSettings {
+	s := transportSettings{
+		h2c:               setting("H2C") == "true",
+		idleTimeout:       envDuration("HTTP_IDLE_TIMEOUT", defaultHTTPIdleTimeout),
+		readHeaderTimeout: envDuration("HTTP_READ_HEADER_TIMEOUT", defaultHTTPReadHeaderTimeout),
+		keepAlives:        setting("HTTP_KEEP_ALIVES") != "false",
+		tcpKeepAlive:      envDuration("HTTP_TCP_KEEP_ALIVE", defaultTCPKeepAlive),
+		maxConnections:    envInt("HTTP_MAX_CONNECTIONS", 0),
+		maxStreams:        uint32(envInt("HTTP2_MAX_CONCURRENT_STREAMS", defaultHTTP2MaxStreams)),
+	}
+	if s.maxStreams == 0 {
+		s.maxStreams = defaultHTTP2MaxStreams
+	}
+	return s
+}
+
+// envDuration returns the non-negative duration of an environment variable, def if it's unset or
+// invalid
+func envDuration(name string, def time.Duration) time.Duration {
+	v := setting(name)
+	if v == "" {
+		return def
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil || d < 0 {
+		log.Printf("invalid %s %q, using %s", name, v, def)
+		return def
+	}
+	return d
+}
+
+// envInt returns the non-negative integer of an environment variable, def if it's unset or invalid
+func envInt(name string, def int) int {
+	v := setting(name)
+	if v == "" {
+		return def
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n < 0 {
+		log.Printf("invalid %s %q, using %d", name, v, def)
+		return def
+	}
+	return n
+}
+
+// NewHTTPServer returns the HTTP server of the handler on addr, configured by the HTTP_* and H2C
+// settings; serve it with Listen's listener to apply them all
+func NewHTTPServer(addr string, handler http.Handler) *http.Server {
+	s := readTransportSettings()
+	h2s := &http2.Server{MaxConcurrentStreams: s.maxStreams, IdleTimeout: s.idleTimeout}
+	if s.h2c {
+		handler = h2c.NewHandler(handler, h2s)
+	}
+	srv := &http.Server{
+		Addr:              addr,
+		Handler:           handler,
+		ReadHeaderTimeout: s.readHeaderTimeout,
+		IdleTimeout:       s.idleTimeout,
+	}
+	srv.SetKeepAlivesEnabled(s.keepAlives)
+	if err := http2.ConfigureServer(srv, h2s); err != nil {
+		log.Printf("http2: %v", err)
+	}
+	return srv
+}
+
+// Listen returns the listener of the socket systemd passed the process, or else of UNIX_SOCKET, or
+// else the TCP listener of addr with the HTTP_TCP_KEEP_ALIVE period, accepting at most
+// HTTP_MAX_CONNECTIONS connections at once
+func Listen(addr string) (net.Listener, error) {
+	s := readTransportSettings()
+	ln, err := activatedListener()
+	switch {
+	case err != nil:
+		return nil, err
+	case ln != nil:
+	case setting("UNIX_SOCKET") != "":
+		if ln, err = listenUnix(setting("UNIX_SOCKET")); err != nil {
+			return nil, err
+		}
+	default:
+		lc := net.ListenConfig{KeepAlive: s.tcpKeepAlive}
+		if s.tcpKeepAlive == 0 {
+			lc.KeepAlive = -1
+		}
+		if ln, err = lc.Listen(context.Background(), "tcp", addr); err != nil {
+			return nil, err
+		}
+	}
+	if s.maxConnections > 0 {
+		ln = netutil.LimitListener(ln, s.maxConnections)
+	}
+	return ln, nil
+}
+
+// activatedListener returns the listener of the socket systemd passed the process with socket
+// activation, nil if it passed none; the LISTEN_* variables are cleared so that child processes
+// don't take the socket for theirs
+func activatedListener() (net.Listener, error) {
+	if pid, err := strconv.Atoi(os.Getenv("LISTEN_PID")); err != nil || pid != os.Getpid() {
+		return nil, nil
+	}
+	n, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || n < 1 {
+		return nil, nil
+	}
+	defer func() {
+		os.Unsetenv("LISTEN_PID")
+		os.Unsetenv("LISTEN_FDS")
+		os.Unsetenv("LISTEN_FDNAMES")
+	}()
+	if n > 1 {
+		log.Printf("systemd passed %d sockets, serving the first", n)
+	}
+	f := os.NewFile(listenFDsStart, "LISTEN_FD_3")
+	defer f.Close()
+	ln, err := net.FileListener(f)
+	if err != nil {
+		return nil, fmt.Errorf("socket activation: %v", err)
+	}
+	return ln, nil
+}
+
+// listenUnix listens on the unix socket path, replacing a socket left over by an earlier run, with
+// the permissions of UNIX_SOCKET_MODE (0660 by default, for the owner and its group)
+func listenUnix(path string) (net.Listener, error) {
+	mode := os.FileMode(defaultUnixSocketMode)
+	if v := setting("UNIX_SOCKET_MODE"); v != "" {
+		m, err := strconv.ParseUint(v, 8, 32)
+		if err != nil || m > 0777 {
+			return nil, fmt.Errorf("UNIX_SOCKET_MODE must be octal permissions, like 0660")
+		}
+		mode = os.FileMode(m)
+	}
+	if fi, err := os.Lstat(path); err == nil {
+		if fi.Mode()&os.ModeSocket == 0 {
+			return nil, fmt.Errorf("UNIX_SOCKET %s exists and is not a socket", path)
+		}
+		if c, err := net.Dial("unix", path); err == nil {
+			c.Close()
+			return nil, fmt.Errorf("UNIX_SOCKET %s is in use", path)
+		}
+		os.Remove(path)
+	}
+	// the socket is created with the mode, rather than with the process's umask until chmod'ed
+	var ln net.Listener
+	err := withUmask(0o777&^int(mode), func() (err error) {
+		ln, err = net.Listen("unix", path)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, mode); err != nil {
+		ln.Close()
+		return nil, err
+	}
+	return ln, nil
+}
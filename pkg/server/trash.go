@@ -0,0 +1,461 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/pubsub"
+	"google.golang.org/api/iterator"
+)
+
+// With TRASH_RETENTION set, DELETE /topics/{name} moves the topic to the trash instead of deleting
+// it, guarding shared demos against mistaken deletes: the topic is labeled trashed-at, its
+// subscriptions are detached (their configuration kept in the state store) and requests for it get
+// 410 Gone. POST /trash/{name}/restore brings it back, recreating its subscriptions (without the
+// messages they held), and the leader purges topics trashed for longer than the retention.
+
+const (
+	// trashedAtLabel records when a topic was moved to the trash, in Unix seconds
+	trashedAtLabel = "trashed-at"
+
+	// trashPurgeInterval is how often topics trashed for longer than the retention are purged
+	trashPurgeInterval = time.Minute
+
+	// detachedTopic is the topic of subscriptions whose topic was deleted
+	detachedTopic = "_deleted-topic_"
+)
+
+// trashedTopic is a topic in the trash, with the subscriptions it had
+type trashedTopic struct {
+	Topic         string                `json:"topic"`
+	TrashedAt     time.Time             `json:"trashedAt"`
+	Subscriptions []trashedSubscription `json:"subscriptions,omitempty"`
+}
+
+// trashedSubscription is the configuration of a subscription detached from a trashed topic, as
+// much of it as a restore recreates
+type trashedSubscription struct {
+	Name                  string            `json:"name"`
+	AckDeadline           time.Duration     `json:"ackDeadline"`
+	RetainAckedMessages   bool              `json:"retainAckedMessages,omitempty"`
+	RetentionDuration     time.Duration     `json:"retentionDuration,omitempty"`
+	ExpirationPolicy      *time.Duration    `json:"expirationPolicy,omitempty"` // 0 never expires, nil for the default
+	Filter                string            `json:"filter,omitempty"`
+	EnableMessageOrdering bool              `json:"enableMessageOrdering,omitempty"`
+	PushEndpoint          string            `json:"pushEndpoint,omitempty"`
+	Labels                map[string]string `json:"labels,omitempty"`
+}
+
+// trash holds the trashed topics, by name
+var trash = struct {
+	sync.Mutex
+	retention time.Duration // 0 when deleting topics deletes them right away
+	topics    map[string]*trashedTopic
+	lastPurge time.Time
+	purged    int
+	errors    []string
+}{topics: map[string]*trashedTopic{}}
+
+// startTrash reads TRASH_RETENTION, loads the trashed topics from the state store and starts
+// purging them; topics trashed before can still be restored or purged with the trash disabled
+func startTrash() {
+	trash.Lock()
+	defer trash.Unlock()
+	trash.retention = 0
+	if s := setting("TRASH_RETENTION"); s != "" {
+		d, err := time.ParseDuration(s)
+		if err != nil || d <= 0 {
+			log.Printf("trash: invalid TRASH_RETENTION %q, topics are deleted right away", s)
+		} else {
+			trash.retention = d
+		}
+	}
+	trash.topics = map[string]*trashedTopic{}
+	stateLoad(trashBucket, func(key string, data []byte) error {
+		t := &trashedTopic{}
+		if err := json.Unmarshal(data, t); err != nil {
+			return err
+		}
+		trash.topics[key] = t
+		return nil
+	})
+	if trash.retention == 0 {
+		return
+	}
+	go func() {
+		for {
+			time.Sleep(trashPurgeInterval)
+			// with several replicas, the leader purges the trash
+			if isLeader() {
+				purgeExpiredTrash()
+			}
+		}
+	}()
+}
+
+// trashedSince returns when the topic was moved to the trash, if it's there
+func trashedSince(topicName string) (time.Time, bool) {
+	trash.Lock()
+	defer trash.Unlock()
+	t, ok := trash.topics[topicName]
+	if !ok {
+		return time.Time{}, false
+	}
+	return t.TrashedAt, true
+}
+
+// writeTrashedError responds 410 to a request for a trashed topic
+func writeTrashedError(w http.ResponseWriter, topicName string, since time.Time) {
+	http.Error(w, fmt.Sprintf("topic %s is in the trash since %s: restore it with POST /trash/%s/restore",
+		topicName, since.Format(time.RFC3339), topicName), http.StatusGone)
+}
+
+// trashTopic moves a topic to the trash: its subscriptions' configurations are saved and the
+// subscriptions detached, then the topic is labeled
+func trashTopic(ctx context.Context, client *pubsub.Client, topic *pubsub.Topic) (*trashedTopic, error) {
+	t := &trashedTopic{Topic: topic.ID(), TrashedAt: time.Now()}
+	it := topic.Subscriptions(ctx)
+	for {
+		subscr, err := it.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		cfg, err := subscr.Config(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("subscription %s: %v", subscr.ID(), err)
+		}
+		t.Subscriptions = append(t.Subscriptions, newTrashedSubscription(subscr.ID(), cfg))
+	}
+	// the record is kept before anything changes, so that a failure half-way can be restored from
+	trash.Lock()
+	trash.topics[t.Topic] = t
+	trash.Unlock()
+	statePut(trashBucket, t.Topic, t)
+	for _, s := range t.Subscriptions {
+		if _, err := client.DetachSubscription(ctx, client.Subscription(s.Name).String()); err != nil {
+			return t, fmt.Errorf("detaching subscription %s: %v", s.Name, err)
+		}
+	}
+	cfg, err := topic.Config(ctx)
+	if err != nil {
+		return t, err
+	}
+	labels := map[string]string{trashedAtLabel: strconv.FormatInt(t.TrashedAt.Unix(), 10)}
+	for k, v := range cfg.Labels {
+		if k != trashedAtLabel {
+			labels[k] = v
+		}
+	}
+	_, err = topic.Update(ctx, pubsub.TopicConfigToUpdate{Labels: labels})
+	return t, err
+}
+
+// deleteOrTrashTopic deletes a topic, or moves it to the trash with TRASH_RETENTION set, for the
+// GraphQL and AWS facades; it reports whether the topic was trashed
+func deleteOrTrashTopic(ctx context.Context, client *pubsub.Client, name string) (bool, error) {
+	trash.Lock()
+	retention := trash.retention
+	trash.Unlock()
+	if retention > 0 {
+		if _, err := trashTopic(ctx, client, client.Topic(name)); err != nil {
+			return false, err
+		}
+		forgetTopic(name)
+		noteResourceChange("updated", "topic", name, "moved to the trash")
+		return true, nil
+	}
+	err := retryAdmin(ctx, adminOpDelete, func() error {
+		return client.Topic(name).Delete(ctx)
+	})
+	if err != nil {
+		return false, err
+	}
+	forgetTopic(name)
+	return false, nil
+}
+
+// newTrashedSubscription returns what a restore needs of a subscription's configuration
+func newTrashedSubscription(name string, cfg pubsub.SubscriptionConfig) trashedSubscription {
+	s := trashedSubscription{
+		Name:                  name,
+		AckDeadline:           cfg.AckDeadline,
+		RetainAckedMessages:   cfg.RetainAckedMessages,
+		RetentionDuration:     cfg.RetentionDuration,
+		Filter:                cfg.Filter,
+		EnableMessageOrdering: cfg.EnableMessageOrdering,
+		PushEndpoint:          cfg.PushConfig.Endpoint,
+		Labels:                cfg.Labels,
+	}
+	if ttl, ok := cfg.ExpirationPolicy.(time.Duration); ok {
+		s.ExpirationPolicy = &ttl
+	}
+	return s
+}
+
+// config returns the configuration recreating the subscription on the restored topic
+func (s trashedSubscription) config(topic *pubsub.Topic) pubsub.SubscriptionConfig {
+	cfg := pubsub.SubscriptionConfig{
+		Topic:                 topic,
+		AckDeadline:           s.AckDeadline,
+		RetainAckedMessages:   s.RetainAckedMessages,
+		RetentionDuration:     s.RetentionDuration,
+		Filter:                s.Filter,
+		EnableMessageOrdering: s.EnableMessageOrdering,
+		PushConfig:            pubsub.PushConfig{Endpoint: s.PushEndpoint},
+		Labels:                s.Labels,
+	}
+	if s.ExpirationPolicy != nil {
+		cfg.ExpirationPolicy = *s.ExpirationPolicy
+	}
+	return cfg
+}
+
+// removeTrashed drops a topic's trash record
+func removeTrashed(topicName string) {
+	trash.Lock()
+	delete(trash.topics, topicName)
+	trash.Unlock()
+	stateDelete(trashBucket, topicName)
+}
+
+// lookupTrashed returns the trash record of the topic named in the path, responding 404 if it
+// isn't in the trash
+func lookupTrashed(w http.ResponseWriter, r *http.Request) (*trashedTopic, bool) {
+	name := pathParam(r, "name")
+	if err := validateResourceName("topic", name); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return nil, false
+	}
+	trash.Lock()
+	t, ok := trash.topics[name]
+	trash.Unlock()
+	if !ok {
+		http.Error(w, fmt.Sprintf("topic %s is not in the trash", name), http.StatusNotFound)
+		return nil, false
+	}
+	return t, true
+}
+
+// listTrashHandler handles GET to /trash
+func listTrashHandler(w http.ResponseWriter, r *http.Request) {
+	trash.Lock()
+	retention := trash.retention
+	topics := make([]*trashedTopic, 0, len(trash.topics))
+	for _, t := range trash.topics {
+		topics = append(topics, t)
+	}
+	trash.Unlock()
+	sort.Slice(topics, func(i, j int) bool { return topics[i].TrashedAt.Before(topics[j].TrashedAt) })
+
+	writeTrashStatus(w)
+	for i, t := range topics {
+		line := fmt.Sprintf("[%d] %s trashed at %s", i, t.Topic, t.TrashedAt.Format(time.RFC3339))
+		if retention > 0 {
+			line += fmt.Sprintf(", purged around %s", t.TrashedAt.Add(retention).Format(time.RFC3339))
+		}
+		names := make([]string, len(t.Subscriptions))
+		for j, s := range t.Subscriptions {
+			names[j] = s.Name
+		}
+		fmt.Fprintf(w, "%s, subscriptions %v\n", line, names)
+	}
+	if len(topics) == 0 {
+		fmt.Fprintln(w, "(empty)")
+	}
+}
+
+// restoreTrashHandler handles POST to /trash/{name}/restore
+func restoreTrashHandler(w http.ResponseWriter, r *http.Request) {
+	t, ok := lookupTrashed(w, r)
+	if !ok {
+		return
+	}
+	ctx := context.Background()
+	client, ok := newClient(ctx, w)
+	if !ok {
+		return
+	}
+	defer client.Close()
+	topic := client.Topic(t.Topic)
+	if err := checkExists(ctx, "topic", t.Topic, topic.Exists); err != nil {
+		writeLookupError(w, err)
+		return
+	}
+
+	// the detached subscriptions can't be reattached, so each is replaced by a new one; results are
+	// collected first, so that the status code can reflect failures
+	out := &bytes.Buffer{}
+	failed := 0
+	for _, s := range t.Subscriptions {
+		err := deleteDetachedSubscription(ctx, client, t.Topic, s.Name)
+		if err == nil {
+			err = retryAdmin(ctx, adminOpCreate, func() error {
+				_, err := client.CreateSubscription(ctx, s.Name, s.config(topic))
+				return err
+			})
+		}
+		if err != nil {
+			failed++
+			fmt.Fprintf(out, "subscription %s: %v\n", s.Name, err)
+			continue
+		}
+		noteResourceChange("created", "subscription", s.Name, "restored from the trash")
+		fmt.Fprintf(out, "recreated subscription %s\n", s.Name)
+	}
+	if failed > 0 {
+		fmt.Fprintf(out, "%d of %d subscriptions not recreated: topic %s stays in the trash\n", failed, len(t.Subscriptions), t.Topic)
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write(out.Bytes())
+		return
+	}
+	cfg, err := topic.Config(ctx)
+	if err == nil {
+		labels := map[string]string{}
+		for k, v := range cfg.Labels {
+			if k != trashedAtLabel {
+				labels[k] = v
+			}
+		}
+		_, err = topic.Update(ctx, pubsub.TopicConfigToUpdate{Labels: labels})
+	}
+	if err != nil {
+		writeAdminError(w, err, http.StatusInternalServerError)
+		return
+	}
+	removeTrashed(t.Topic)
+	noteResourceChange("updated", "topic", t.Topic, "restored from the trash")
+	w.Write(out.Bytes())
+	fmt.Fprintf(w, "restored topic %s\n", topic.String())
+}
+
+// purgeTrashHandler handles DELETE to /trash/{name}, deleting a trashed topic right away
+func purgeTrashHandler(w http.ResponseWriter, r *http.Request) {
+	t, ok := lookupTrashed(w, r)
+	if !ok {
+		return
+	}
+	ctx := context.Background()
+	client, ok := newClient(ctx, w)
+	if !ok {
+		return
+	}
+	defer client.Close()
+	if err := purgeTrashed(ctx, client, t); err != nil {
+		writeAdminError(w, err, http.StatusServiceUnavailable)
+		return
+	}
+	fmt.Fprintf(w, "purged topic %s\n", client.Topic(t.Topic).String())
+}
+
+// deleteDetachedSubscription deletes a subscription detached from a trashed topic, if it still
+// exists; a subscription of that name created on another topic since is left alone, as an error
+func deleteDetachedSubscription(ctx context.Context, client *pubsub.Client, topicName, name string) error {
+	subscr := client.Subscription(name)
+	return retryAdmin(ctx, adminOpDelete, func() error {
+		exists, err := subscr.Exists(ctx)
+		if err != nil || !exists {
+			return err
+		}
+		cfg, err := subscr.Config(ctx)
+		if err != nil {
+			return err
+		}
+		if cfg.Topic != nil && cfg.Topic.ID() != topicName && cfg.Topic.String() != detachedTopic {
+			return fmt.Errorf("now a subscription to topic %s", cfg.Topic.ID())
+		}
+		return subscr.Delete(ctx)
+	})
+}
+
+// purgeTrashed deletes a trashed topic and its detached subscriptions
+func purgeTrashed(ctx context.Context, client *pubsub.Client, t *trashedTopic) error {
+	for _, s := range t.Subscriptions {
+		if err := deleteDetachedSubscription(ctx, client, t.Topic, s.Name); err != nil {
+			return fmt.Errorf("subscription %s: %v", s.Name, err)
+		}
+	}
+	topic := client.Topic(t.Topic)
+	err := retryAdmin(ctx, adminOpDelete, func() error {
+		exists, err := topic.Exists(ctx)
+		if err != nil || !exists {
+			return err
+		}
+		return topic.Delete(ctx)
+	})
+	if err != nil {
+		return err
+	}
+	forgetTopic(t.Topic)
+	removeTrashed(t.Topic)
+	noteResourceChange("deleted", "topic", t.Topic, "purged from the trash")
+	return nil
+}
+
+// purgeExpiredTrash purges the topics trashed for longer than the retention once
+func purgeExpiredTrash() {
+	trash.Lock()
+	var expired []*trashedTopic
+	for _, t := range trash.topics {
+		if time.Since(t.TrashedAt) > trash.retention {
+			expired = append(expired, t)
+		}
+	}
+	trash.Unlock()
+	var errs []string
+	purged := 0
+	if len(expired) > 0 {
+		projectID := setting("GOOGLE_CLOUD_PROJECT")
+		ctx, cancel := context.WithTimeout(context.Background(), trashPurgeInterval)
+		defer cancel()
+		client, err := pubsub.NewClient(ctx, projectID, backendOptions()...)
+		if err != nil {
+			log.Printf("trash: %v", err)
+			return
+		}
+		defer client.Close()
+		for _, t := range expired {
+			if err := purgeTrashed(ctx, client, t); err != nil {
+				errs = append(errs, fmt.Sprintf("purging topic %s: %v", t.Topic, err))
+				continue
+			}
+			purged++
+			log.Printf("trash: purged topic %s, trashed at %s", t.Topic, t.TrashedAt.Format(time.RFC3339))
+		}
+	}
+	trash.Lock()
+	trash.lastPurge = time.Now()
+	trash.purged += purged
+	trash.errors = errs
+	trash.Unlock()
+}
+
+// writeTrashStatus reports the trash's configuration and last purge
+func writeTrashStatus(w io.Writer) {
+	trash.Lock()
+	defer trash.Unlock()
+	if trash.retention == 0 {
+		fmt.Fprintf(w, "trash disabled (topics are deleted right away), %d topics in the trash\n", len(trash.topics))
+		return
+	}
+	fmt.Fprintf(w, "trash retention=%s topics=%d purged=%d", trash.retention, len(trash.topics), trash.purged)
+	if !trash.lastPurge.IsZero() {
+		fmt.Fprintf(w, " lastPurge=%s", trash.lastPurge.Format(time.RFC3339))
+	}
+	fmt.Fprintln(w)
+	for _, e := range trash.errors {
+		fmt.Fprintf(w, "    last purge error: %s\n", e)
+	}
+}
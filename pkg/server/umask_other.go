@@ -0,0 +1,9 @@
+//go:build windows || plan9
+// +build windows plan9
+
+package server
+
+// withUmask calls f: there's no umask to set on this platform
+func withUmask(mask int, f func() error) error {
+	return f()
+}
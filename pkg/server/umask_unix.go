@@ -0,0 +1,14 @@
+//go:build !windows && !plan9
+// +build !windows,!plan9
+
+package server
+
+import "syscall"
+
+// withUmask calls f with the process's umask set to mask, restoring it afterwards; the umask is
+// the process's, so files other goroutines create meanwhile get it too
+func withUmask(mask int, f func() error) error {
+	old := syscall.Umask(mask)
+	defer syscall.Umask(old)
+	return f()
+}
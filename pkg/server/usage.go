@@ -0,0 +1,196 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Usage is accounted per day (UTC) and per account: the tenant of the request, else its API key,
+// else admin or anonymous. The counters are kept in the state store, written every minute and at
+// shutdown, and reported by GET /usage.
+
+const (
+	usageDateFormat   = "2006-01-02"
+	usageFlushPeriod  = time.Minute
+	defaultUsageRange = 30 * 24 * time.Hour
+)
+
+// usageCounters are the usage of an account on a day
+type usageCounters struct {
+	Published      int64 `json:"published"`
+	PublishedBytes int64 `json:"publishedBytes"`
+	Received       int64 `json:"received"`
+	ReceivedBytes  int64 `json:"receivedBytes"`
+	AdminCalls     int64 `json:"adminCalls"`
+}
+
+func (c *usageCounters) add(d usageCounters) {
+	c.Published += d.Published
+	c.PublishedBytes += d.PublishedBytes
+	c.Received += d.Received
+	c.ReceivedBytes += d.ReceivedBytes
+	c.AdminCalls += d.AdminCalls
+}
+
+func (c usageCounters) String() string {
+	return fmt.Sprintf("published=%d (%d bytes) received=%d (%d bytes) adminCalls=%d",
+		c.Published, c.PublishedBytes, c.Received, c.ReceivedBytes, c.AdminCalls)
+}
+
+var usage = struct {
+	sync.Mutex
+	counters map[string]*usageCounters // by <day>/<account>
+	dirty    map[string]bool
+}{counters: map[string]*usageCounters{}, dirty: map[string]bool{}}
+
+// usageAdminRoutes are the routes counted as admin calls
+var usageAdminRoutes = map[string]bool{
+	"GET /topics":                     true,
+	"PUT /topics":                     true,
+	"DELETE /topics":                  true,
+	"POST /topics:batchCreate":        true,
+	"DELETE /topics/{name}":           true,
+	"GET /subscriptions":              true,
+	"PUT /subscriptions":              true,
+	"DELETE /subscriptions":           true,
+	"POST /subscriptions:batchCreate": true,
+	"PATCH /subscriptions/{name}":     true,
+	"DELETE /subscriptions/{name}":    true,
+}
+
+// usageAccountKey is the request context key of the account the request's usage is counted for
+type usageAccountKey struct{}
+
+// startUsage loads the usage counters from the state store and writes them back every minute
+func startUsage() {
+	usage.Lock()
+	stateLoad(usageBucket, func(key string, data []byte) error {
+		c := &usageCounters{}
+		if err := json.Unmarshal(data, c); err != nil {
+			return err
+		}
+		usage.counters[key] = c
+		return nil
+	})
+	usage.Unlock()
+	go func() {
+		for range time.Tick(usageFlushPeriod) {
+			saveUsage()
+		}
+	}()
+}
+
+// saveUsage writes the counters changed since they were last written
+func saveUsage() {
+	usage.Lock()
+	defer usage.Unlock()
+	for key := range usage.dirty {
+		statePut(usageBucket, key, usage.counters[key])
+	}
+	usage.dirty = map[string]bool{}
+}
+
+// usageAccount returns the account a request's usage is counted for
+func usageAccount(r *http.Request) string {
+	if account, ok := r.Context().Value(usageAccountKey{}).(string); ok {
+		return account
+	}
+	if ns := requestTenant(r); ns != "" {
+		return "tenant:" + ns
+	}
+	if t := requestAccessToken(r); t != nil {
+		return "token:" + t.ID
+	}
+	if key := r.Header.Get(APIKeyHeader); key != "" {
+		if k, _ := lookupManagedKey(key); k != nil {
+			return "key:" + k.ID
+		}
+		if g := publishGrantFor(key); g != nil {
+			return "principal:" + g.Principal
+		}
+	}
+	if isAdmin(r) {
+		return "admin"
+	}
+	return "anonymous"
+}
+
+// recordUsage adds to the usage of the request's account today
+func recordUsage(r *http.Request, d usageCounters) {
+	key := time.Now().UTC().Format(usageDateFormat) + "/" + usageAccount(r)
+	usage.Lock()
+	defer usage.Unlock()
+	c, ok := usage.counters[key]
+	if !ok {
+		c = &usageCounters{}
+		usage.counters[key] = c
+	}
+	c.add(d)
+	usage.dirty[key] = true
+}
+
+// usageHandler handles GET to /usage[?from=<date>&to=<date>&account=<account>&by=day]: admins see
+// every account, tenants their own
+func usageHandler(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	account := q.Get("account")
+	if ns := requestTenant(r); ns != "" {
+		account = "tenant:" + ns
+	} else if !requireAdmin(w, r) {
+		return
+	}
+	now := time.Now().UTC()
+	to := now.Format(usageDateFormat)
+	from := now.Add(-defaultUsageRange).Format(usageDateFormat)
+	for name, v := range map[string]*string{"from": &from, "to": &to} {
+		if s := q.Get(name); s != "" {
+			if _, err := time.Parse(usageDateFormat, s); err != nil {
+				http.Error(w, fmt.Sprintf("%s must be a date like %s", name, usageDateFormat), http.StatusBadRequest)
+				return
+			}
+			*v = s
+		}
+	}
+	byDay := q.Get("by") == "day"
+
+	totals := map[string]*usageCounters{}
+	usage.Lock()
+	for key, c := range usage.counters {
+		i := strings.IndexByte(key, '/')
+		day, acct := key[:i], key[i+1:]
+		// dates in this format compare like strings
+		if day < from || day > to || (account != "" && acct != account) {
+			continue
+		}
+		row := acct
+		if byDay {
+			row = day + " " + acct
+		}
+		t, ok := totals[row]
+		if !ok {
+			t = &usageCounters{}
+			totals[row] = t
+		}
+		t.add(*c)
+	}
+	usage.Unlock()
+
+	rows := make([]string, 0, len(totals))
+	for row := range totals {
+		rows = append(rows, row)
+	}
+	sort.Strings(rows)
+	fmt.Fprintf(w, "Usage from %s to %s\n", from, to)
+	fmt.Fprintln(w, "--------------------------------")
+	for _, row := range rows {
+		fmt.Fprintf(w, "%s: %s\n", row, totals[row])
+	}
+	if len(rows) == 0 {
+		fmt.Fprintln(w, "(none)")
+	}
+}
@@ -0,0 +1,301 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/pubsub"
+)
+
+const (
+	// maxWarmBuffered and maxWarmBufferedBytes bound the messages a warm session holds (unacked)
+	// for its next pull by default: beyond them the streaming pull's flow control pauses
+	// receiving; the session's maxConcurrency (see consumers.go) and the bytes limit of
+	// CONSUMER_BUFFER_LIMITS (see buffers.go) override them
+	maxWarmBuffered      = 100
+	maxWarmBufferedBytes = 10 << 20
+
+	// warmSessionIdle is how long a warm session is kept open without pulls
+	warmSessionIdle = 2 * time.Minute
+
+	// warmPullWait is how long a pull from a warm session with nothing buffered waits for a message
+	warmPullWait = time.Second
+
+	warmSessionHeader = "Warm-Session"
+)
+
+// warmSession keeps a streaming pull open between receive requests, buffering messages so
+// that pulls with the session ID return them without paying the streaming pull setup again
+type warmSession struct {
+	id           string
+	subscription string
+	client       *pubsub.Client
+
+	mu       sync.Mutex
+	settings consumerSettings
+	cancel   context.CancelFunc // of the streaming pull
+	done     chan struct{}      // closed when the streaming pull ends
+	closing  bool               // the streaming pull is stopping, messages are returned
+	limits   bufferLimits       // CONSUMER_BUFFER_LIMITS
+	buffered []consumerMessage
+	log      consumerLog   // the messages received, for GET /consumers/<session-id>/messages
+	arrived  chan struct{} // signalled when a message is buffered
+	lastPull time.Time
+	err      error
+	stats    consumerStats
+}
+
+var warmSessions = struct {
+	sync.Mutex
+	m map[string]*warmSession
+}{m: map[string]*warmSession{}}
+
+// startWarmSessions closes warm sessions nobody pulled from for warmSessionIdle
+func startWarmSessions() {
+	go func() {
+		for range time.Tick(warmSessionIdle / 4) {
+			warmSessions.Lock()
+			for id, s := range warmSessions.m {
+				s.mu.Lock()
+				idle := time.Since(s.lastPull) > warmSessionIdle
+				s.expireLocked()
+				s.mu.Unlock()
+				if idle {
+					delete(warmSessions.m, id)
+					go s.close()
+				}
+			}
+			warmSessions.Unlock()
+			recordConsumerBuffers()
+		}
+	}()
+}
+
+// openWarmSession starts a streaming pull from the subscription that buffers messages until pulled
+func openWarmSession(client *pubsub.Client, subscrName string, settings consumerSettings) *warmSession {
+	s := &warmSession{
+		id:           randomID(),
+		subscription: subscrName,
+		client:       client,
+		settings:     settings,
+		limits:       loadBufferLimits(consumerBuffer),
+		arrived:      make(chan struct{}, 1),
+		lastPull:     time.Now(),
+		stats:        consumerStats{opened: time.Now()},
+	}
+	s.mu.Lock()
+	s.startReceiveLocked()
+	s.mu.Unlock()
+
+	warmSessions.Lock()
+	warmSessions.m[s.id] = s
+	warmSessions.Unlock()
+	return s
+}
+
+// startReceiveLocked starts the session's streaming pull with its settings
+func (s *warmSession) startReceiveLocked() {
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	s.cancel, s.done, s.err, s.closing = cancel, done, nil, false
+	// a handle of its own, as the flow control settings apply to the whole streaming pull
+	subscr := s.client.Subscription(s.subscription)
+	subscr.ReceiveSettings.NumGoroutines = s.settings.NumGoroutines
+	subscr.ReceiveSettings.MaxOutstandingMessages = s.settings.MaxConcurrency
+	subscr.ReceiveSettings.MaxOutstandingBytes = s.limits.bytes
+	if s.limits.bytes == 0 {
+		subscr.ReceiveSettings.MaxOutstandingBytes = -1 // no limit
+	}
+	go func() {
+		defer close(done)
+		// the client keeps extending the ack deadline of buffered messages
+		err := subscr.Receive(ctx, func(_ context.Context, msg *pubsub.Message) {
+			s.mu.Lock()
+			if s.closing {
+				s.mu.Unlock()
+				msg.Nack()
+				return
+			}
+			s.expireLocked()
+			if !s.makeRoomLocked(len(msg.Data)) {
+				s.mu.Unlock()
+				msg.Nack()
+				recordBufferDrops(consumerBuffer, "rejected", 1)
+				return
+			}
+			s.buffered = append(s.buffered, s.log.add(msg, s.limits))
+			s.stats.received++
+			s.updateStatsLocked()
+			s.mu.Unlock()
+			select {
+			case s.arrived <- struct{}{}:
+			default:
+			}
+		})
+		if ctx.Err() == nil {
+			s.mu.Lock()
+			s.err = err
+			s.mu.Unlock()
+		}
+	}()
+}
+
+// close stops the streaming pull, returning the messages still buffered for redelivery (they
+// can't be acked once it has stopped, which waits for them to be settled); it returns their number
+func (s *warmSession) close() int {
+	s.mu.Lock()
+	cancel, done := s.cancel, s.done
+	s.closing = true
+	returned := len(s.buffered)
+	for _, m := range s.buffered {
+		m.msg.Nack()
+	}
+	s.buffered = nil
+	s.updateStatsLocked()
+	s.mu.Unlock()
+	cancel()
+	<-done
+	return returned
+}
+
+// expireLocked returns the messages buffered for longer than the age limit for redelivery, and
+// drops those retained for viewers
+func (s *warmSession) expireLocked() {
+	n := 0
+	for n < len(s.buffered) && s.limits.expired(s.buffered[n].received) {
+		s.buffered[n].msg.Nack()
+		n++
+	}
+	if n > 0 {
+		s.buffered = s.buffered[n:]
+		s.updateStatsLocked()
+		recordBufferDrops(consumerBuffer, "age", n)
+	}
+	s.log.expire(s.limits)
+}
+
+// makeRoomLocked applies the messages and bytes limits before buffering a message of size bytes:
+// with drop-oldest, the oldest buffered messages are returned for redelivery to make room; with
+// reject, it reports false if there's no room
+func (s *warmSession) makeRoomLocked(size int) bool {
+	n, bytes := 0, s.stats.outstandingBytes
+	for s.limits.policy == bufferPolicyDropOldest && n < len(s.buffered) && s.limits.full(len(s.buffered)-n, bytes, size) {
+		s.buffered[n].msg.Nack()
+		bytes -= len(s.buffered[n].msg.Data)
+		n++
+	}
+	if n > 0 {
+		s.buffered = s.buffered[n:]
+		s.updateStatsLocked()
+		recordBufferDrops(consumerBuffer, "full", n)
+	}
+	return !s.limits.full(len(s.buffered), bytes, size)
+}
+
+func (s *warmSession) updateStatsLocked() {
+	s.stats.update(s.buffered, s.settings.MaxConcurrency, s.limits.bytes)
+}
+
+// recordConsumerBuffers records the messages and bytes held by the warm sessions
+func recordConsumerBuffers() {
+	warmSessions.Lock()
+	defer warmSessions.Unlock()
+	var messages, bytes, logMessages, logBytes int
+	for _, s := range warmSessions.m {
+		s.mu.Lock()
+		messages += s.stats.outstanding
+		bytes += s.stats.outstandingBytes
+		logMessages += len(s.log.entries)
+		logBytes += s.log.bytes
+		s.mu.Unlock()
+	}
+	recordBufferSize(consumerBuffer, messages, bytes)
+	recordBufferSize(consumerLogBuffer, logMessages, logBytes)
+}
+
+// pull takes the buffered messages, up to max if it's not 0, waiting up to warmPullWait for one
+// if there are none
+func (s *warmSession) pull(ctx context.Context, max int) ([]*pubsub.Message, error) {
+	s.mu.Lock()
+	s.lastPull = time.Now()
+	s.expireLocked()
+	empty := len(s.buffered) == 0
+	done := s.done
+	s.mu.Unlock()
+	if empty {
+		timer := time.NewTimer(warmPullWait)
+		defer timer.Stop()
+		select {
+		case <-s.arrived:
+		case <-done:
+		case <-timer.C:
+		case <-ctx.Done():
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	taken := s.buffered
+	s.buffered = nil
+	if max > 0 && len(taken) > max {
+		// the session keeps the rest for the next pull
+		taken, s.buffered = taken[:max], taken[max:]
+	}
+	s.stats.pulls++
+	s.updateStatsLocked()
+	if len(taken) == 0 && s.err != nil {
+		return nil, s.err
+	}
+	msgs := make([]*pubsub.Message, len(taken))
+	for i, m := range taken {
+		msgs[i] = m.msg
+	}
+	return msgs, nil
+}
+
+// receiveWarm serves a receive request with ?warm=true (opening a warm session, whose ID is
+// returned in the Warm-Session header) or ?warmSession=<session-id> from the session's buffer;
+// the timeout doesn't apply, as the session has been receiving all along
+func receiveWarm(w http.ResponseWriter, r *http.Request, client *pubsub.Client, subscr *pubsub.Subscription, opts receiveOptions, deliver func(*pubsub.Message)) {
+	var s *warmSession
+	if id := r.URL.Query().Get("warmSession"); id != "" {
+		warmSessions.Lock()
+		s = warmSessions.m[id]
+		warmSessions.Unlock()
+		if s == nil {
+			http.Error(w, fmt.Sprintf("warm session %s not found (sessions close after %s without pulls), open a new one with ?warm=true",
+				id, warmSessionIdle), http.StatusNotFound)
+			return
+		}
+		if s.subscription != subscr.ID() {
+			http.Error(w, fmt.Sprintf("warm session %s belongs to subscription %s", id, s.subscription), http.StatusBadRequest)
+			return
+		}
+	} else {
+		s = openWarmSession(client, subscr.ID(), defaultConsumerSettings())
+	}
+	w.Header().Set(warmSessionHeader, s.id)
+
+	msgs, err := s.pull(r.Context(), opts.max)
+	if r.Context().Err() != nil {
+		// the client went away, leave the messages for someone else
+		for _, msg := range msgs {
+			msg.Nack()
+		}
+		return
+	}
+	receivedBytes := 0
+	for _, msg := range msgs {
+		opts.settle(msg)
+		receivedBytes += len(msg.Data)
+		deliver(msg)
+	}
+	if err != nil {
+		fmt.Fprintf(w, "sub.Receive: %v", err)
+	}
+	recordReceived(subscr.ID(), len(msgs))
+	recordUsage(r, usageCounters{Received: int64(len(msgs)), ReceivedBytes: int64(receivedBytes)})
+}
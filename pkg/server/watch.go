@@ -0,0 +1,248 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/pubsub"
+)
+
+// GET /watch streams the changes to the project's topics and subscriptions, an event each with
+// 'Accept: text/event-stream', so that UIs and scripts needn't poll the lists. Changes made through
+// this service's endpoints are reported as they happen; others, like those of other clients or of
+// the janitor, are found by reconciliation, which lists the project every WATCH_INTERVAL while
+// anyone watches and compares it with the previous listing.
+
+const (
+	defaultWatchInterval = 30 * time.Second
+
+	// watchBuffer is how many events a slow watcher may fall behind by before events are dropped
+	watchBuffer = 100
+
+	// watchListTimeout bounds a reconciliation's listing of the project
+	watchListTimeout = time.Minute
+)
+
+// watchEvent is a change to a topic or subscription
+type watchEvent struct {
+	time   time.Time
+	change string // created, updated or deleted
+	kind   string // topic or subscription
+	name   string
+	source string // "api" for changes made through this service, "reconcile" for those found by listing
+	detail string
+}
+
+func (e watchEvent) String() string {
+	s := fmt.Sprintf("%s %s %s %s source=%s", e.time.UTC().Format(time.RFC3339), e.change, e.kind, e.name, e.source)
+	if e.detail != "" {
+		s += " (" + e.detail + ")"
+	}
+	return s
+}
+
+// watch holds the watchers and the state of the reconciliation, which runs while there are any
+var watch = struct {
+	sync.Mutex
+	watchers map[chan watchEvent]bool
+	stop     chan struct{}     // closed when the last watcher leaves, stopping the reconciliation; nil while none runs
+	known    map[string]string // the ETags of the configurations listed last, by "<kind> <name>"; nil before the first listing
+	noted    map[string]string // the changes made through this service since the last listing, by "<kind> <name>"
+	dropped  int
+}{watchers: map[chan watchEvent]bool{}, noted: map[string]string{}}
+
+// noteResourceChange reports a change made through this service to the watchers
+func noteResourceChange(change, kind, name, detail string) {
+	watch.Lock()
+	defer watch.Unlock()
+	if len(watch.watchers) == 0 {
+		return
+	}
+	watch.noted[kind+" "+name] = change
+	broadcastLocked(watchEvent{time: time.Now(), change: change, kind: kind, name: name, source: "api", detail: detail})
+}
+
+// broadcastLocked sends an event to the watchers, dropping it for those too far behind
+func broadcastLocked(e watchEvent) {
+	for ch := range watch.watchers {
+		select {
+		case ch <- e:
+		default:
+			watch.dropped++
+		}
+	}
+}
+
+// watchInterval returns the reconciliation interval, WATCH_INTERVAL
+func watchInterval() time.Duration {
+	if s := setting("WATCH_INTERVAL"); s != "" {
+		d, err := time.ParseDuration(s)
+		if err == nil && d > 0 {
+			return d
+		}
+		log.Printf("watch: invalid WATCH_INTERVAL %q, using %s", s, defaultWatchInterval)
+	}
+	return defaultWatchInterval
+}
+
+// addWatcher registers a watcher, starting the reconciliation if it's the first
+func addWatcher() chan watchEvent {
+	ch := make(chan watchEvent, watchBuffer)
+	watch.Lock()
+	defer watch.Unlock()
+	watch.watchers[ch] = true
+	if watch.stop == nil {
+		watch.stop = make(chan struct{})
+		watch.known, watch.noted = nil, map[string]string{}
+		go reconcileWhileWatched(watch.stop, watchInterval())
+	}
+	return ch
+}
+
+// removeWatcher unregisters a watcher, stopping the reconciliation if it's the last
+func removeWatcher(ch chan watchEvent) {
+	watch.Lock()
+	defer watch.Unlock()
+	delete(watch.watchers, ch)
+	if len(watch.watchers) == 0 && watch.stop != nil {
+		close(watch.stop)
+		watch.stop = nil
+	}
+}
+
+// reconcileWhileWatched lists the project every interval until nobody watches, reporting the
+// changes not made through this service
+func reconcileWhileWatched(stop chan struct{}, interval time.Duration) {
+	for {
+		if err := reconcileWatch(stop); err != nil {
+			log.Printf("watch: %v", err)
+		}
+		select {
+		case <-stop:
+			return
+		case <-time.After(interval):
+		}
+	}
+}
+
+// reconcileWatch lists the project's topics and subscriptions once, reporting how they changed
+// since the previous listing, except for the changes already reported as made through this service
+func reconcileWatch(stop chan struct{}) error {
+	ctx, cancel := context.WithTimeout(context.Background(), watchListTimeout)
+	defer cancel()
+	go func() {
+		select {
+		case <-stop:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	client, err := pubsub.NewClient(ctx, setting("GOOGLE_CLOUD_PROJECT"), backendOptions()...)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+	if err := waitAdminQuota(ctx, adminOpList); err != nil {
+		return err
+	}
+	topics, err := liveTopicConfigs(ctx, client)
+	if err != nil {
+		return err
+	}
+	subscrs, err := liveSubscriptionConfigs(ctx, client)
+	if err != nil {
+		return err
+	}
+	current := map[string]string{}
+	for name, cfg := range topics {
+		current["topic "+name] = configETag(topicDetails(cfg))
+	}
+	for name, cfg := range subscrs {
+		current["subscription "+name] = configETag(subscriptionDetails(cfg))
+	}
+
+	watch.Lock()
+	defer watch.Unlock()
+	select {
+	case <-stop:
+		return nil // nobody watches anymore, or a later reconciliation took over
+	default:
+	}
+	known, noted := watch.known, watch.noted
+	watch.known, watch.noted = current, map[string]string{}
+	if known == nil {
+		return nil
+	}
+	now := time.Now()
+	report := func(key, change string) {
+		if noted[key] == change {
+			return
+		}
+		var kind, name string
+		fmt.Sscan(key, &kind, &name)
+		broadcastLocked(watchEvent{time: now, change: change, kind: kind, name: name, source: "reconcile"})
+	}
+	for key, etag := range current {
+		if prev, ok := known[key]; !ok {
+			report(key, "created")
+		} else if prev != etag {
+			report(key, "updated")
+		}
+	}
+	for key := range known {
+		if _, ok := current[key]; !ok {
+			report(key, "deleted")
+		}
+	}
+	return nil
+}
+
+// watchHandler handles GET to /watch[?kind=topic|subscription], streaming changes until the client
+// disconnects
+func watchHandler(w http.ResponseWriter, r *http.Request) {
+	kind := r.URL.Query().Get("kind")
+	if kind != "" && kind != "topic" && kind != "subscription" {
+		http.Error(w, "kind must be topic or subscription", http.StatusBadRequest)
+		return
+	}
+	end, ok := beginStream(w)
+	if !ok {
+		return
+	}
+	defer end()
+	ch := addWatcher()
+	defer removeWatcher(ch)
+	stop := drainSignal()
+
+	w.Header().Set("Cache-Control", "no-store")
+	fmt.Fprintf(w, "watching %s: changes through this service as they happen, others within %s\n",
+		orAll(kind), watchInterval())
+	flushResponse(w)
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-stop:
+			writeShutdownNotice(w)
+			return
+		case e := <-ch:
+			if kind != "" && e.kind != kind {
+				continue
+			}
+			fmt.Fprintln(w, e)
+			flushResponse(w)
+		}
+	}
+}
+
+// orAll names the kind of resources watched
+func orAll(kind string) string {
+	if kind == "" {
+		return "topics and subscriptions"
+	}
+	return kind + "s"
+}
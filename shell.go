@@ -0,0 +1,377 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+
+	"helloworld/pkg/server"
+)
+
+// "second shell" is an interactive prompt over the service, taking the commands of the cli
+// subcommand and tail, apply, diff and help. Tab completes commands and the names of topics and
+// subscriptions (on terminals the line editor supports, see shell_linux.go); up and down
+// recall earlier commands.
+
+const shellPrompt = "second> "
+
+// shellCommand is a command of the shell
+type shellCommand struct {
+	usage    string
+	help     string
+	complete string // what its arguments complete to: "topic", "subscription" or ""
+}
+
+var shellCommands = map[string]shellCommand{
+	"topics":              {"topics", "list topics", ""},
+	"topic":               {"topic <name>", "show a topic", "topic"},
+	"create-topic":        {"create-topic <name>", "create a topic", ""},
+	"delete-topic":        {"delete-topic <name>", "delete a topic", "topic"},
+	"subscriptions":       {"subscriptions", "list subscriptions", ""},
+	"subscription":        {"subscription <name>", "show a subscription", "subscription"},
+	"create-subscription": {"create-subscription <name> <topic>", "create a subscription to a topic", "topic"},
+	"delete-subscription": {"delete-subscription <name>", "delete a subscription", "subscription"},
+	"publish":             {"publish [-attr k=v]... <topic> <message>...", "publish messages ('quote' messages with spaces)", "topic"},
+	"pull":                {"pull [-max n] [-timeout d] [-ack=false] <subscription>", "receive messages", "subscription"},
+	"tail":                {"tail <subscription> [since]", "stream the topic's messages from since ago (default 5m) until Ctrl-C", "subscription"},
+	"apply":               {"apply [-dry-run] <file>", `create the topics and subscriptions of a JSON file {"topics":[...], "subscriptions":[{"name":..., "topic":...}]} that don't exist (-dry-run: only show what would be created)`, ""},
+	"diff":                {"diff <file>", "show what apply would create and change, and the service's topics and subscriptions the file doesn't declare", ""},
+	"help":                {"help", "list the commands", ""},
+	"exit":                {"exit", "leave the shell (or Ctrl-D)", ""},
+}
+
+// shell is an interactive session of the shell subcommand
+type shell struct {
+	c             *cliClient
+	topics        []string // for completion
+	subscriptions []string
+	history       []string
+}
+
+// lineReader reads the command lines of the shell
+type lineReader interface {
+	readLine(prompt string) (string, error) // io.EOF when the input ends
+	close()
+}
+
+// bufferedLineReader reads lines without editing, from pipes and unsupported terminals
+type bufferedLineReader struct {
+	in *bufio.Reader
+}
+
+func (r *bufferedLineReader) readLine(prompt string) (string, error) {
+	fmt.Print(prompt)
+	line, err := r.in.ReadString('\n')
+	if err == io.EOF && line != "" {
+		err = nil
+	}
+	return strings.TrimRight(line, "\r\n"), err
+}
+
+func (r *bufferedLineReader) close() {}
+
+func shellMain(args []string) int {
+	c := &cliClient{http: &http.Client{}, output: "table"}
+	fs := flag.NewFlagSet("shell", flag.ContinueOnError)
+	fs.StringVar(&c.url, "url", envOr("SECOND_URL", "http://localhost:8080"), "URL of the service")
+	fs.StringVar(&c.apiKey, "api-key", os.Getenv("SECOND_API_KEY"), "API key sent in "+server.APIKeyHeader)
+	fs.StringVar(&c.token, "token", os.Getenv("SECOND_ADMIN_TOKEN"), "admin token")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	sh := &shell{c: c}
+	if err := sh.refresh(); err != nil {
+		fmt.Fprintf(os.Stderr, "shell: %v\n", err)
+		return 1
+	}
+	fmt.Printf("connected to %s; type help for the commands, Tab to complete\n", c.url)
+	in := newLineReader(sh)
+	defer in.close()
+	for {
+		line, err := in.readLine(shellPrompt)
+		if err == io.EOF {
+			fmt.Println()
+			return 0
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "shell: %v\n", err)
+			return 1
+		}
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		sh.history = append(sh.history, line)
+		if done := sh.exec(line); done {
+			return 0
+		}
+	}
+}
+
+// refresh reloads the names of the topics and subscriptions that complete
+func (sh *shell) refresh() error {
+	topics, err := sh.c.listNames("/topics")
+	if err != nil {
+		return err
+	}
+	subscriptions, err := sh.c.listNames("/subscriptions")
+	if err != nil {
+		return err
+	}
+	sh.topics, sh.subscriptions = topics, subscriptions
+	return nil
+}
+
+// exec runs a command line, reporting whether the shell is done
+func (sh *shell) exec(line string) bool {
+	words, err := splitShellWords(line)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return false
+	}
+	command, args := words[0], words[1:]
+	switch command {
+	case "exit", "quit":
+		return true
+	case "help":
+		names := make([]string, 0, len(shellCommands))
+		for name := range shellCommands {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			fmt.Printf("  %-56s %s\n", shellCommands[name].usage, shellCommands[name].help)
+		}
+		return false
+	case "tail":
+		err = sh.tail(args)
+	case "apply":
+		err = sh.apply(args)
+	case "diff":
+		err = sh.diff(args)
+	default:
+		if _, ok := shellCommands[command]; !ok {
+			fmt.Fprintf(os.Stderr, "unknown command %q (type help for the commands)\n", command)
+			return false
+		}
+		err = sh.c.run(command, args)
+	}
+	if err == errCLIUsage {
+		err = fmt.Errorf("usage: %s", shellCommands[command].usage)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+	}
+	if strings.HasPrefix(command, "create-") || strings.HasPrefix(command, "delete-") || command == "apply" {
+		if err := sh.refresh(); err != nil {
+			fmt.Fprintf(os.Stderr, "refreshing names: %v\n", err)
+		}
+	}
+	return false
+}
+
+// tail streams GET /subscriptions/<name>/tail until interrupted
+func (sh *shell) tail(args []string) error {
+	if len(args) < 1 || len(args) > 2 {
+		return errCLIUsage
+	}
+	path := "/subscriptions/" + url.PathEscape(args[0]) + "/tail"
+	if len(args) == 2 {
+		path += "?since=" + url.QueryEscape(args[1])
+	}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, strings.TrimSuffix(sh.c.url, "/")+path, nil)
+	if err != nil {
+		return err
+	}
+	if sh.c.apiKey != "" {
+		req.Header.Set(server.APIKeyHeader, sh.c.apiKey)
+	}
+	if sh.c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+sh.c.token)
+	}
+	resp, err := sh.c.http.Do(req)
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil
+		}
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+	fmt.Println("(Ctrl-C to stop)")
+	if _, err := io.Copy(os.Stdout, resp.Body); err != nil && ctx.Err() == nil {
+		return err
+	}
+	return nil
+}
+
+// shellApplyFile declares the topics and subscriptions apply creates
+type shellApplyFile struct {
+	Topics        []string `json:"topics"`
+	Subscriptions []struct {
+		Name  string `json:"name"`
+		Topic string `json:"topic"`
+	} `json:"subscriptions"`
+}
+
+// apply creates the topics and subscriptions of a file that don't exist yet, or with -dry-run
+// shows what it would create
+func (sh *shell) apply(args []string) error {
+	fs := flag.NewFlagSet("apply", flag.ContinueOnError)
+	dryRun := fs.Bool("dry-run", false, "only show what would be created")
+	if err := fs.Parse(args); err != nil || fs.NArg() != 1 {
+		return errCLIUsage
+	}
+	data, err := os.ReadFile(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	var f shellApplyFile
+	if err := json.Unmarshal(data, &f); err != nil {
+		return fmt.Errorf("%s: %v", fs.Arg(0), err)
+	}
+	query := ""
+	if *dryRun {
+		query = "?dryRun=true"
+	}
+	create := func(kind, path string, body map[string]string) {
+		lines, err := sh.c.do(http.MethodPut, path+query, body)
+		var serr *cliStatusError
+		switch {
+		case err == nil && *dryRun && len(lines) > 0:
+			fmt.Println(lines[0])
+		case err == nil:
+			fmt.Printf("created %s %s\n", kind, body["name"])
+		case errors.As(err, &serr) && serr.code == http.StatusConflict:
+			fmt.Printf("%s %s exists\n", kind, body["name"])
+		default:
+			fmt.Printf("%s %s: %v\n", kind, body["name"], err)
+		}
+	}
+	for _, name := range f.Topics {
+		create("topic", "/topics", map[string]string{"name": name})
+	}
+	for _, s := range f.Subscriptions {
+		create("subscription", "/subscriptions", map[string]string{"name": s.Name, "topic": s.Topic})
+	}
+	return nil
+}
+
+// diff prints how the project differs from the topics and subscriptions of an apply file
+func (sh *shell) diff(args []string) error {
+	if len(args) != 1 {
+		return errCLIUsage
+	}
+	data, err := os.ReadFile(args[0])
+	if err != nil {
+		return err
+	}
+	if !json.Valid(data) {
+		return fmt.Errorf("%s: not JSON", args[0])
+	}
+	lines, err := sh.c.do(http.MethodPost, "/diff", json.RawMessage(data))
+	if err != nil {
+		return err
+	}
+	for _, line := range lines {
+		fmt.Println(line)
+	}
+	return nil
+}
+
+// complete returns the candidates for the last word of a line
+func (sh *shell) complete(line string) []string {
+	// words holds the words before the one completed, then its prefix
+	words := strings.Fields(line)
+	if len(words) == 0 || strings.HasSuffix(line, " ") {
+		words = append(words, "")
+	}
+	prefix := words[len(words)-1]
+	var options []string
+	if len(words) == 1 {
+		for name := range shellCommands {
+			options = append(options, name)
+		}
+	} else {
+		switch shellCommands[words[0]].complete {
+		case "topic":
+			options = sh.topics
+		case "subscription":
+			options = sh.subscriptions
+		}
+		// create-subscription <name> <topic>: only the topic completes
+		if words[0] == "create-subscription" && len(words) != 3 {
+			options = nil
+		}
+	}
+	var matches []string
+	for _, o := range options {
+		if strings.HasPrefix(o, prefix) {
+			matches = append(matches, o)
+		}
+	}
+	sort.Strings(matches)
+	return matches
+}
+
+// splitShellWords splits a command line into words, keeping 'quoted' and "quoted" words whole
+func splitShellWords(line string) ([]string, error) {
+	var words []string
+	var word strings.Builder
+	inWord := false
+	var quote rune
+	for _, c := range line {
+		switch {
+		case quote != 0 && c == quote:
+			quote = 0
+		case quote != 0:
+			word.WriteRune(c)
+		case c == '\'' || c == '"':
+			quote, inWord = c, true
+		case c == ' ' || c == '\t':
+			if inWord {
+				words = append(words, word.String())
+				word.Reset()
+				inWord = false
+			}
+		default:
+			word.WriteRune(c)
+			inWord = true
+		}
+	}
+	if quote != 0 {
+		return nil, fmt.Errorf("unterminated %c quote", quote)
+	}
+	if inWord {
+		words = append(words, word.String())
+	}
+	return words, nil
+}
+
+// commonPrefix returns the longest common prefix of the strings
+func commonPrefix(s []string) string {
+	if len(s) == 0 {
+		return ""
+	}
+	prefix := s[0]
+	for _, x := range s[1:] {
+		for !strings.HasPrefix(x, prefix) {
+			prefix = prefix[:len(prefix)-1]
+		}
+	}
+	return prefix
+}
@@ -0,0 +1,125 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// terminalLineReader edits the shell's lines on a terminal in raw mode: Tab completes, up and
+// down walk the history, Ctrl-C clears the line and Ctrl-D on an empty line ends the input. The
+// terminal is back in its normal mode while commands run, so Ctrl-C interrupts them.
+type terminalLineReader struct {
+	sh     *shell
+	fd     int
+	normal unix.Termios
+	in     *bufio.Reader
+}
+
+// newLineReader returns the line editor if stdin is a terminal
+func newLineReader(sh *shell) lineReader {
+	fd := int(os.Stdin.Fd())
+	t, err := unix.IoctlGetTermios(fd, unix.TCGETS)
+	if err != nil {
+		return &bufferedLineReader{in: bufio.NewReader(os.Stdin)}
+	}
+	return &terminalLineReader{sh: sh, fd: fd, normal: *t, in: bufio.NewReader(os.Stdin)}
+}
+
+func (r *terminalLineReader) readLine(prompt string) (string, error) {
+	raw := r.normal
+	raw.Lflag &^= unix.ICANON | unix.ECHO | unix.ISIG | unix.IEXTEN
+	raw.Iflag &^= unix.ICRNL | unix.IXON
+	raw.Cc[unix.VMIN], raw.Cc[unix.VTIME] = 1, 0
+	if err := unix.IoctlSetTermios(r.fd, unix.TCSETS, &raw); err != nil {
+		return "", err
+	}
+	defer r.close()
+
+	var line []rune
+	history := len(r.sh.history) // index of the history entry shown, len for the new line
+	redraw := func() { fmt.Printf("\r\033[K%s%s", prompt, string(line)) }
+	redraw()
+	for {
+		c, _, err := r.in.ReadRune()
+		if err != nil {
+			return "", err
+		}
+		switch c {
+		case '\r', '\n':
+			fmt.Print("\r\n")
+			return string(line), nil
+		case 3: // Ctrl-C
+			fmt.Print("^C\r\n")
+			line, history = nil, len(r.sh.history)
+			redraw()
+		case 4: // Ctrl-D
+			if len(line) == 0 {
+				return "", io.EOF
+			}
+		case 127, '\b':
+			if len(line) > 0 {
+				line = line[:len(line)-1]
+				redraw()
+			}
+		case '\t':
+			line = r.completeLine(line)
+			redraw()
+		case 27: // escape sequences: up and down arrows, others are ignored
+			if b, _ := r.in.ReadByte(); b != '[' {
+				continue
+			}
+			b, _ := r.in.ReadByte()
+			switch {
+			case b == 'A' && history > 0:
+				history--
+			case b == 'B' && history < len(r.sh.history):
+				history++
+			default:
+				continue
+			}
+			line = nil
+			if history < len(r.sh.history) {
+				line = []rune(r.sh.history[history])
+			}
+			redraw()
+		default:
+			if c >= ' ' {
+				line = append(line, c)
+				fmt.Print(string(c))
+			}
+		}
+	}
+}
+
+// completeLine completes the last word of a line: to the only candidate, to the candidates'
+// common prefix, or else by listing them
+func (r *terminalLineReader) completeLine(line []rune) []rune {
+	s := string(line)
+	matches := r.sh.complete(s)
+	if len(matches) == 0 {
+		return line
+	}
+	prefix := s[strings.LastIndexAny(s, " \t")+1:]
+	base := s[:len(s)-len(prefix)]
+	if len(matches) == 1 {
+		return []rune(base + matches[0] + " ")
+	}
+	if common := commonPrefix(matches); len(common) > len(prefix) {
+		return []rune(base + common)
+	}
+	fmt.Printf("\r\n%s\r\n", strings.Join(matches, "  "))
+	return line
+}
+
+// close restores the terminal's normal mode
+func (r *terminalLineReader) close() {
+	unix.IoctlSetTermios(r.fd, unix.TCSETS, &r.normal)
+}
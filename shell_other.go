@@ -0,0 +1,15 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import (
+	"bufio"
+	"os"
+)
+
+// newLineReader reads the shell's lines as they are typed, without completion or history,
+// which the line editor of shell_linux.go only supports on Linux
+func newLineReader(sh *shell) lineReader {
+	return &bufferedLineReader{in: bufio.NewReader(os.Stdin)}
+}